@@ -0,0 +1,202 @@
+/*
+Package accesslist provides http.Handler middleware accepting or rejecting the requests by the IP of the client.
+
+The denied networks are checked first: a client in a denied network is always rejected. When allowed networks are
+set, the clients outside of them are rejected as well, otherwise all the other clients are accepted.
+Both IPv4 and IPv6 networks are supported. Behind other proxies, extract the real IP of the client with
+utils.NewForwardedForExtractor.
+
+Examples of an access list:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte("hello"))
+	})
+
+	// Accept the private networks only, except for one subnet
+	al, _ := accesslist.New(handler,
+	  accesslist.Allow("10.0.0.0/8", "fd00::/8"),
+	  accesslist.Deny("10.66.0.0/16"))
+
+	// The lists can be updated at runtime
+	al.SetDenied("10.66.0.0/16", "10.67.0.0/16")
+*/
+package accesslist
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessList rejects the requests of the clients not allowed to access the next handler
+type AccessList struct {
+	next       http.Handler
+	extract    utils.SourceExtractor
+	errHandler utils.ErrorHandler
+
+	mtx     *sync.RWMutex
+	allowed utils.IPRanges
+	denied  utils.IPRanges
+
+	log *log.Logger
+}
+
+// New returns a new access list middleware accepting all the clients unless networks are allowed or denied.
+// New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*AccessList, error) {
+	a := &AccessList{
+		next:       next,
+		extract:    utils.ExtractorFunc(remoteIP),
+		errHandler: &AccessErrHandler{},
+		mtx:        &sync.RWMutex{},
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+type optSetter func(a *AccessList) error
+
+// Allow sets the networks allowed to access the next handler, as CIDRs or single IPs
+func Allow(cidrs ...string) optSetter {
+	return func(a *AccessList) error {
+		return a.SetAllowed(cidrs...)
+	}
+}
+
+// Deny sets the networks denied to access the next handler, as CIDRs or single IPs
+func Deny(cidrs ...string) optSetter {
+	return func(a *AccessList) error {
+		return a.SetDenied(cidrs...)
+	}
+}
+
+// Extractor sets the extractor of the IP of the client, defaults to the IP of the peer
+func Extractor(e utils.SourceExtractor) optSetter {
+	return func(a *AccessList) error {
+		if e == nil {
+			return fmt.Errorf("extractor can not be nil")
+		}
+		a.extract = e
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler answering the rejected requests, it is called with an *AccessDeniedError
+// or with the error of the extractor. Defaults to AccessErrHandler.
+func ErrorHandler(h utils.ErrorHandler) optSetter {
+	return func(a *AccessList) error {
+		a.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the access list will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(a *AccessList) error {
+		a.log = l
+		return nil
+	}
+}
+
+// SetAllowed replaces the allowed networks, no networks allows all the clients that are not denied
+func (a *AccessList) SetAllowed(cidrs ...string) error {
+	ranges, err := utils.ParseIPRanges(cidrs...)
+	if err != nil {
+		return err
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.allowed = ranges
+	return nil
+}
+
+// SetDenied replaces the denied networks
+func (a *AccessList) SetDenied(cidrs ...string) error {
+	ranges, err := utils.ParseIPRanges(cidrs...)
+	if err != nil {
+		return err
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.denied = ranges
+	return nil
+}
+
+// Wrap sets the next handler to be called by access list handler.
+func (a *AccessList) Wrap(next http.Handler) {
+	a.next = next
+}
+
+func (a *AccessList) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if a.log.Level >= log.DebugLevel {
+		logEntry := a.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/accesslist: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/accesslist: completed ServeHttp on request")
+	}
+
+	if err := a.check(req); err != nil {
+		a.log.Debugf("vulcand/oxy/accesslist: rejecting Request(%v %v), err: %v", req.Method, req.URL, err)
+		a.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	a.next.ServeHTTP(w, req)
+}
+
+func (a *AccessList) check(req *http.Request) error {
+	source, _, err := a.extract.Extract(req)
+	if err != nil {
+		return err
+	}
+	ip := utils.ParseAddrIP(source)
+	if ip == nil {
+		return &AccessDeniedError{IP: source}
+	}
+
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	if a.denied.Contains(ip) || (len(a.allowed) != 0 && !a.allowed.Contains(ip)) {
+		return &AccessDeniedError{IP: ip.String()}
+	}
+	return nil
+}
+
+func remoteIP(req *http.Request) (string, int64, error) {
+	ip := utils.ParseAddrIP(req.RemoteAddr)
+	if ip == nil {
+		return "", 0, fmt.Errorf("failed to parse client IP: %v", req.RemoteAddr)
+	}
+	return ip.String(), 1, nil
+}
+
+// AccessDeniedError is returned for the clients not allowed to access the next handler
+type AccessDeniedError struct {
+	IP string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("access denied to %v", e.IP)
+}
+
+// AccessErrHandler answers 403 to the rejected requests
+type AccessErrHandler struct{}
+
+func (e *AccessErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if _, ok := err.(*AccessDeniedError); ok {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(http.StatusText(http.StatusForbidden)))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
@@ -0,0 +1,85 @@
+package accesslist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var hello = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("hello"))
+})
+
+func serve(h http.Handler, remoteAddr string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw.Code
+}
+
+func TestAllowDeny(t *testing.T) {
+	al, err := New(hello, Allow("10.0.0.0/8", "fd00::/8"), Deny("10.66.0.0/16", "fd00::6"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		remoteAddr string
+		expected   int
+	}{
+		{remoteAddr: "10.1.2.3:4242", expected: http.StatusOK},
+		{remoteAddr: "10.66.1.1:4242", expected: http.StatusForbidden},
+		{remoteAddr: "192.0.2.1:4242", expected: http.StatusForbidden},
+		{remoteAddr: "[fd00::1]:4242", expected: http.StatusOK},
+		{remoteAddr: "[fd00::6]:4242", expected: http.StatusForbidden},
+		{remoteAddr: "[2001:db8::1]:4242", expected: http.StatusForbidden},
+		{remoteAddr: "garbage", expected: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, serve(al, test.remoteAddr), test.remoteAddr)
+	}
+}
+
+func TestDenyOnly(t *testing.T) {
+	al, err := New(hello, Deny("192.0.2.0/24"))
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, serve(al, "198.51.100.1:80"))
+	assert.Equal(t, http.StatusForbidden, serve(al, "192.0.2.1:80"))
+
+	// runtime updates
+	require.NoError(t, al.SetDenied())
+	assert.Equal(t, http.StatusOK, serve(al, "192.0.2.1:80"))
+	require.NoError(t, al.SetAllowed("198.51.100.0/24"))
+	assert.Equal(t, http.StatusForbidden, serve(al, "192.0.2.1:80"))
+	assert.Error(t, al.SetAllowed("not a cidr"))
+}
+
+func TestExtractorAndErrorHandler(t *testing.T) {
+	trusted, err := utils.ParseIPRanges("10.0.0.0/8")
+	require.NoError(t, err)
+
+	var rejected error
+	al, err := New(hello,
+		Deny("203.0.113.0/24"),
+		Extractor(utils.NewForwardedForExtractor(trusted)),
+		ErrorHandler(utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+			rejected = err
+			w.WriteHeader(http.StatusUnauthorized)
+		})),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, serve(al, "10.0.0.1:80"))
+	assert.Equal(t, &AccessDeniedError{IP: "203.0.113.9"}, rejected)
+
+	// the header of untrusted peers is ignored
+	assert.Equal(t, http.StatusOK, serve(al, "192.0.2.1:80"))
+
+	_, err = New(hello, Extractor(nil))
+	assert.Error(t, err)
+}
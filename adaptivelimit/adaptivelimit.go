@@ -0,0 +1,376 @@
+/*
+Package adaptivelimit limits the concurrent requests to a limit discovered from the latency of the responses, instead
+of a static number, in the manner of the gradient algorithm of Netflix concurrency-limits.
+
+The limiter compares the average latency of the requests of every window to a long term average, the latency of the
+next handler with no queueing: as long as the recent latency stays within the tolerance the limit grows by about its
+square root, once requests queue up and the latency rises the limit shrinks in proportion. Windows with a 5xx response
+shrink the limit by the backoff ratio. The requests over the limit are answered with 503 and a Retry-After header.
+
+Examples of an adaptive limiter:
+
+	lim, _ := adaptivelimit.New(next,
+		adaptivelimit.InitialLimit(20),
+		adaptivelimit.MaxLimit(1000),
+	)
+*/
+package adaptivelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInitialLimit = 20
+	defaultMinLimit     = 1
+	defaultMaxLimit     = 1000
+	defaultTolerance    = 1.5
+	defaultSmoothing    = 0.2
+	defaultBackoff      = 0.9
+	defaultWindow       = time.Second
+	defaultLongWindow   = 100
+	defaultRetryAfter   = time.Second
+	warmupWindows       = 10
+)
+
+// Limiter is an http.Handler limiting the concurrent requests to an adaptive limit
+type Limiter struct {
+	mutex *sync.Mutex
+	next  http.Handler
+
+	minLimit, maxLimit float64
+	tolerance          float64
+	smoothing          float64
+	backoff            float64
+	window             time.Duration
+	longWindow         int
+	retryAfter         time.Duration
+
+	limit  float64
+	active int
+	// longRTT is the long term average latency, in nanoseconds
+	longRTT float64
+	samples window
+
+	clock      timetools.TimeProvider
+	errHandler utils.ErrorHandler
+	inflight   utils.Inflight
+	log        *log.Logger
+}
+
+// window holds the samples of the current window
+type window struct {
+	end       time.Time
+	sum       time.Duration
+	count     int
+	dropped   bool
+	maxActive int
+	// windows counts the windows of the long term average, up to the warm up
+	windows int
+}
+
+// New creates a new adaptive Limiter
+func New(next http.Handler, options ...Option) (*Limiter, error) {
+	l := &Limiter{
+		mutex:      &sync.Mutex{},
+		next:       next,
+		limit:      defaultInitialLimit,
+		minLimit:   defaultMinLimit,
+		maxLimit:   defaultMaxLimit,
+		tolerance:  defaultTolerance,
+		smoothing:  defaultSmoothing,
+		backoff:    defaultBackoff,
+		window:     defaultWindow,
+		longWindow: defaultLongWindow,
+		retryAfter: defaultRetryAfter,
+		clock:      &timetools.RealTime{},
+		log:        log.StandardLogger(),
+	}
+	for _, o := range options {
+		if err := o(l); err != nil {
+			return nil, err
+		}
+	}
+	if l.minLimit > l.maxLimit {
+		return nil, fmt.Errorf("min limit %v is over max limit %v", l.minLimit, l.maxLimit)
+	}
+	l.limit = math.Max(l.minLimit, math.Min(l.maxLimit, l.limit))
+	if l.errHandler == nil {
+		l.errHandler = &ErrHandler{}
+	}
+	return l, nil
+}
+
+// Option is a functional option of the adaptive limiter
+type Option func(l *Limiter) error
+
+// InitialLimit sets the limit the limiter starts with, it defaults to 20
+func InitialLimit(n int) Option {
+	return func(l *Limiter) error {
+		if n < 1 {
+			return fmt.Errorf("initial limit should be >= 1, got %d", n)
+		}
+		l.limit = float64(n)
+		return nil
+	}
+}
+
+// MinLimit sets the limit the limiter never goes under, it defaults to 1
+func MinLimit(n int) Option {
+	return func(l *Limiter) error {
+		if n < 1 {
+			return fmt.Errorf("min limit should be >= 1, got %d", n)
+		}
+		l.minLimit = float64(n)
+		return nil
+	}
+}
+
+// MaxLimit sets the limit the limiter never goes over, it defaults to 1000
+func MaxLimit(n int) Option {
+	return func(l *Limiter) error {
+		if n < 1 {
+			return fmt.Errorf("max limit should be >= 1, got %d", n)
+		}
+		l.maxLimit = float64(n)
+		return nil
+	}
+}
+
+// Tolerance sets the ratio of the recent latency to the long term one tolerated before the limit shrinks,
+// it defaults to 1.5
+func Tolerance(ratio float64) Option {
+	return func(l *Limiter) error {
+		if ratio < 1 {
+			return fmt.Errorf("tolerance should be >= 1, got %v", ratio)
+		}
+		l.tolerance = ratio
+		return nil
+	}
+}
+
+// Smoothing sets the share of the new limit computed at the end of a window that is applied, it defaults to 0.2
+func Smoothing(ratio float64) Option {
+	return func(l *Limiter) error {
+		if ratio <= 0 || ratio > 1 {
+			return fmt.Errorf("smoothing should be in (0, 1], got %v", ratio)
+		}
+		l.smoothing = ratio
+		return nil
+	}
+}
+
+// Backoff sets the ratio the limit is multiplied by after a window with a 5xx response, it defaults to 0.9
+func Backoff(ratio float64) Option {
+	return func(l *Limiter) error {
+		if ratio <= 0 || ratio >= 1 {
+			return fmt.Errorf("backoff should be in (0, 1), got %v", ratio)
+		}
+		l.backoff = ratio
+		return nil
+	}
+}
+
+// Window sets how long the latency is sampled for before the limit is updated, and the number of windows the
+// long term latency is averaged over. They default to a second and 100 windows.
+func Window(d time.Duration, longWindow int) Option {
+	return func(l *Limiter) error {
+		if d <= 0 {
+			return fmt.Errorf("window should be > 0, got %v", d)
+		}
+		if longWindow < 1 {
+			return fmt.Errorf("long window should be >= 1, got %d", longWindow)
+		}
+		l.window = d
+		l.longWindow = longWindow
+		return nil
+	}
+}
+
+// RetryAfter sets the delay advertised to the rejected clients by the Retry-After header, it defaults to a second
+func RetryAfter(d time.Duration) Option {
+	return func(l *Limiter) error {
+		if d < 0 {
+			return fmt.Errorf("retry after should be >= 0, got %v", d)
+		}
+		l.retryAfter = d
+		return nil
+	}
+}
+
+// Clock sets the clock measuring the latency
+func Clock(clock timetools.TimeProvider) Option {
+	return func(l *Limiter) error {
+		l.clock = clock
+		return nil
+	}
+}
+
+// ErrorHandler sets the error handler of the requests over the limit
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(l *Limiter) error {
+		l.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the adaptive limiter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(lim *Limiter) error {
+		lim.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by the limiter.
+func (l *Limiter) Wrap(h http.Handler) {
+	l.next = h
+}
+
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete. It returns the error of the context if it is done first.
+func (l *Limiter) Shutdown(ctx context.Context) error {
+	return l.inflight.Shutdown(ctx)
+}
+
+// Limit returns the current concurrency limit
+func (l *Limiter) Limit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int(l.limit)
+}
+
+// Active returns the number of requests being served
+func (l *Limiter) Active() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.active
+}
+
+func (l *Limiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !l.inflight.Acquire() {
+		l.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer l.inflight.Release()
+
+	if err := l.acquire(); err != nil {
+		l.log.Debugf("vulcand/oxy/adaptivelimit: rejecting request: %v", err)
+		l.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	pw := utils.NewProxyWriter(w)
+	start := l.clock.UtcNow()
+	l.next.ServeHTTP(pw, req)
+	l.release(l.clock.UtcNow().Sub(start), pw.StatusCode() >= http.StatusInternalServerError)
+}
+
+func (l *Limiter) acquire() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.active >= int(l.limit) {
+		return &LimitExceededError{Limit: int(l.limit), RetryAfter: l.retryAfter}
+	}
+	l.active++
+	if l.samples.end.IsZero() {
+		l.samples.end = l.clock.UtcNow().Add(l.window)
+	}
+	if l.active > l.samples.maxActive {
+		l.samples.maxActive = l.active
+	}
+	return nil
+}
+
+// release records the latency of the request, updating the limit at the end of the window
+func (l *Limiter) release(rtt time.Duration, dropped bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.active--
+
+	now := l.clock.UtcNow()
+	l.samples.sum += rtt
+	l.samples.count++
+	l.samples.dropped = l.samples.dropped || dropped
+
+	if now.Before(l.samples.end) {
+		return
+	}
+	l.update()
+	l.samples = window{end: now.Add(l.window), maxActive: l.active, windows: l.samples.windows}
+}
+
+// update computes the limit from the samples of the window
+func (l *Limiter) update() {
+	short := float64(l.samples.sum) / float64(l.samples.count)
+
+	// the long term average is a plain average over the first windows, an exponential one afterwards
+	if l.samples.windows < warmupWindows && l.samples.windows < l.longWindow {
+		l.samples.windows++
+		l.longRTT += (short - l.longRTT) / float64(l.samples.windows)
+	} else {
+		l.longRTT += (short - l.longRTT) * 2 / float64(l.longWindow+1)
+	}
+	// the latency dropped a lot, e.g. after a load spike, let the long term average catch up faster
+	if l.longRTT/short > 2 {
+		l.longRTT *= 0.95
+	}
+
+	limit := l.limit
+	switch {
+	case l.samples.dropped:
+		limit = l.limit * l.backoff
+	case float64(l.samples.maxActive) < l.limit/2:
+		// too few requests to tell whether the limit is too low
+		return
+	default:
+		gradient := math.Max(0.5, math.Min(1, l.tolerance*l.longRTT/short))
+		limit = l.limit*gradient + math.Sqrt(l.limit)
+	}
+	limit = l.limit*(1-l.smoothing) + limit*l.smoothing
+	limit = math.Max(l.minLimit, math.Min(l.maxLimit, limit))
+
+	if int(limit) != int(l.limit) {
+		l.log.Debugf("vulcand/oxy/adaptivelimit: limit %d -> %d, latency %v, long term %v",
+			int(l.limit), int(limit), time.Duration(short), time.Duration(l.longRTT))
+	}
+	l.limit = limit
+}
+
+// LimitExceededError is the error of the requests over the limit
+type LimitExceededError struct {
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("concurrency limit reached: %d", e.Limit)
+}
+
+// ErrHandler is the default error handler of the limiter, it answers the requests over the limit with 503
+// and a Retry-After header
+type ErrHandler struct{}
+
+func (e *ErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if le, ok := err.(*LimitExceededError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(le.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
@@ -0,0 +1,139 @@
+package adaptivelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func newTestLimiter(t *testing.T, options ...Option) (*Limiter, *timetools.FreezedTime) {
+	clock := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	l, err := New(nil, append([]Option{Clock(clock)}, options...)...)
+	require.NoError(t, err)
+	return l, clock
+}
+
+// runWindow serves n concurrent requests with the given latency and closes the window
+func runWindow(t *testing.T, l *Limiter, clock *timetools.FreezedTime, n int, rtt time.Duration, dropped bool) {
+	for i := 0; i < n; i++ {
+		require.NoError(t, l.acquire())
+	}
+	clock.Sleep(l.window)
+	for i := 0; i < n; i++ {
+		l.release(rtt, dropped)
+	}
+}
+
+func TestLimitGrows(t *testing.T) {
+	l, clock := newTestLimiter(t, InitialLimit(10))
+
+	for i := 0; i < 20; i++ {
+		runWindow(t, l, clock, l.Limit(), 10*time.Millisecond, false)
+	}
+	assert.True(t, l.Limit() > 20, "limit %d", l.Limit())
+	assert.Equal(t, 0, l.Active())
+}
+
+func TestLimitShrinksWithLatency(t *testing.T) {
+	l, clock := newTestLimiter(t, InitialLimit(50))
+
+	for i := 0; i < warmupWindows; i++ {
+		runWindow(t, l, clock, l.Limit(), 10*time.Millisecond, false)
+	}
+	limit := l.Limit()
+
+	// the requests queue up behind the next handler
+	for i := 0; i < 10; i++ {
+		runWindow(t, l, clock, l.Limit(), 100*time.Millisecond, false)
+	}
+	assert.True(t, l.Limit() < limit*2/3, "limit %d from %d", l.Limit(), limit)
+}
+
+func TestLimitBacksOffOnErrors(t *testing.T) {
+	l, clock := newTestLimiter(t, InitialLimit(100), Smoothing(1), Backoff(0.5))
+
+	runWindow(t, l, clock, 1, 10*time.Millisecond, true)
+	assert.Equal(t, 50, l.Limit())
+}
+
+func TestLimitBounds(t *testing.T) {
+	l, clock := newTestLimiter(t, InitialLimit(10), MinLimit(5), MaxLimit(12), Smoothing(1), Backoff(0.1))
+
+	for i := 0; i < 10; i++ {
+		runWindow(t, l, clock, l.Limit(), 10*time.Millisecond, false)
+	}
+	assert.Equal(t, 12, l.Limit())
+
+	runWindow(t, l, clock, 1, 10*time.Millisecond, true)
+	assert.Equal(t, 5, l.Limit())
+}
+
+func TestLimitIdle(t *testing.T) {
+	l, clock := newTestLimiter(t, InitialLimit(10))
+
+	// a few requests tell nothing about the limit
+	for i := 0; i < 10; i++ {
+		runWindow(t, l, clock, 2, 10*time.Millisecond, false)
+	}
+	assert.Equal(t, 10, l.Limit())
+}
+
+func TestLimitExceeded(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("hello"))
+	})
+
+	l, err := New(handler, InitialLimit(1), MinLimit(1), RetryAfter(1500*time.Millisecond))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	codes := make(chan int)
+	go func() {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		codes <- re.StatusCode
+	}()
+	<-started
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "2", re.Header.Get("Retry-After"))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, o := range []Option{
+		InitialLimit(0),
+		MinLimit(0),
+		MaxLimit(0),
+		Tolerance(0.5),
+		Smoothing(0),
+		Backoff(1),
+		Window(0, 10),
+		Window(time.Second, 0),
+		RetryAfter(-time.Second),
+	} {
+		_, err := New(nil, o)
+		assert.Error(t, err)
+	}
+
+	_, err := New(nil, MinLimit(10), MaxLimit(5))
+	assert.Error(t, err)
+}
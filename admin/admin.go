@@ -0,0 +1,295 @@
+/*
+Package admin provides an http.Handler exposing the status of the components of a running proxy as JSON.
+
+Components are registered by name: load balancers with the weights and the health of their servers,
+circuit breakers with their state, connection limiters with the connections of every source, rate limiters
+with the occupancy of their store and round trip metrics with a snapshot of the counters and latencies.
+
+Examples of an admin handler:
+
+	a, _ := admin.New()
+	a.Balancer("api", lb, healthChecker)
+	a.CircuitBreaker("api", cb)
+	a.ConnLimiter("clients", cl)
+	a.RateLimiter("clients", tl)
+	a.RTMetrics("api", rtm)
+
+	// the status must not be exposed to the clients of the proxy
+	mux := http.NewServeMux()
+	mux.Handle("/status", a)
+	go http.ListenAndServe("127.0.0.1:8081", mux)
+*/
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/heebyunglee/oxy/cbreaker"
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+// Balancer is implemented by the load balancers of the roundrobin package.
+// The weights of the servers are reported if it implements ServerWeight(u *url.URL) (int, bool) as well.
+type Balancer interface {
+	Servers() []*url.URL
+}
+
+// HealthChecker is implemented by the roundrobin.HealthChecker
+type HealthChecker interface {
+	Servers() []*url.URL
+	IsHealthy(u *url.URL) (bool, bool)
+}
+
+// Breaker is implemented by the circuit breakers of the cbreaker package
+type Breaker interface {
+	State() cbreaker.State
+}
+
+// ConnCounter is implemented by the connection limiters of the connlimit package
+type ConnCounter interface {
+	Connections() map[string]int64
+}
+
+// RateLimiter is implemented by the token limiters of the ratelimit package
+type RateLimiter interface {
+	Occupancy() (ratelimit.Occupancy, bool)
+}
+
+type weighted interface {
+	ServerWeight(u *url.URL) (int, bool)
+}
+
+type balancer struct {
+	lb Balancer
+	hc HealthChecker
+}
+
+// Admin serves the status of the registered components
+type Admin struct {
+	quantiles []float64
+
+	mtx          *sync.Mutex
+	balancers    map[string]balancer
+	breakers     map[string]Breaker
+	connLimiters map[string]ConnCounter
+	rateLimiters map[string]RateLimiter
+	metrics      map[string]*memmetrics.RTMetrics
+
+	log *log.Logger
+}
+
+// New returns a new admin handler. New() function supports optional functional arguments
+func New(setters ...optSetter) (*Admin, error) {
+	a := &Admin{
+		quantiles: memmetrics.DefaultQuantiles,
+
+		mtx:          &sync.Mutex{},
+		balancers:    make(map[string]balancer),
+		breakers:     make(map[string]Breaker),
+		connLimiters: make(map[string]ConnCounter),
+		rateLimiters: make(map[string]RateLimiter),
+		metrics:      make(map[string]*memmetrics.RTMetrics),
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+type optSetter func(a *Admin) error
+
+// Quantiles sets the quantiles of the latencies of the metrics snapshots, in percents,
+// defaults to memmetrics.DefaultQuantiles
+func Quantiles(quantiles ...float64) optSetter {
+	return func(a *Admin) error {
+		if len(quantiles) == 0 {
+			return fmt.Errorf("provide at least one quantile")
+		}
+		for _, q := range quantiles {
+			if q <= 0 || q > 100 {
+				return fmt.Errorf("quantile should be in (0, 100] got %v", q)
+			}
+		}
+		a.quantiles = quantiles
+		return nil
+	}
+}
+
+// Logger defines the logger the admin handler will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(a *Admin) error {
+		a.log = l
+		return nil
+	}
+}
+
+// Balancer exposes the servers of the load balancer. When the servers are added through a health checker,
+// pass it as well to expose the health of the servers, including the unhealthy ones removed from the balancer.
+// hc can be nil.
+func (a *Admin) Balancer(name string, lb Balancer, hc HealthChecker) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.balancers[name] = balancer{lb: lb, hc: hc}
+}
+
+// CircuitBreaker exposes the state of the circuit breaker
+func (a *Admin) CircuitBreaker(name string, b Breaker) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.breakers[name] = b
+}
+
+// ConnLimiter exposes the connections counted by the connection limiter
+func (a *Admin) ConnLimiter(name string, c ConnCounter) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.connLimiters[name] = c
+}
+
+// RateLimiter exposes the occupancy of the store of the token limiter
+func (a *Admin) RateLimiter(name string, r RateLimiter) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.rateLimiters[name] = r
+}
+
+// RTMetrics exposes a snapshot of the round trip metrics
+func (a *Admin) RTMetrics(name string, m *memmetrics.RTMetrics) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.metrics[name] = m
+}
+
+// Status is the status of the registered components, by name
+type Status struct {
+	Balancers       map[string][]ServerStatus         `json:"balancers"`
+	CircuitBreakers map[string]string                 `json:"circuit_breakers"`
+	ConnLimiters    map[string]ConnStatus             `json:"conn_limiters"`
+	RateLimiters    map[string]*ratelimit.Occupancy   `json:"rate_limiters"` // nil if the store can not tell
+	Metrics         map[string]*memmetrics.RTSnapshot `json:"metrics"`
+}
+
+// ServerStatus is the status of a server of a load balancer
+type ServerStatus struct {
+	URL string `json:"url"`
+	// InRotation tells if the load balancer sends requests to the server
+	InRotation bool `json:"in_rotation"`
+	// Weight is the weight of the server, if the load balancer has weights
+	Weight *int `json:"weight,omitempty"`
+	// Healthy is the health of the server, if a health checker watches it
+	Healthy *bool `json:"healthy,omitempty"`
+}
+
+// ConnStatus is the status of a connection limiter
+type ConnStatus struct {
+	Total   int64            `json:"total"`
+	Sources map[string]int64 `json:"sources"`
+}
+
+// Status returns the status of the registered components
+func (a *Admin) Status() *Status {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	s := &Status{
+		Balancers:       make(map[string][]ServerStatus, len(a.balancers)),
+		CircuitBreakers: make(map[string]string, len(a.breakers)),
+		ConnLimiters:    make(map[string]ConnStatus, len(a.connLimiters)),
+		RateLimiters:    make(map[string]*ratelimit.Occupancy, len(a.rateLimiters)),
+		Metrics:         make(map[string]*memmetrics.RTSnapshot, len(a.metrics)),
+	}
+	for name, b := range a.balancers {
+		s.Balancers[name] = b.status()
+	}
+	for name, b := range a.breakers {
+		s.CircuitBreakers[name] = b.State().String()
+	}
+	for name, c := range a.connLimiters {
+		cs := ConnStatus{Sources: c.Connections()}
+		for _, count := range cs.Sources {
+			cs.Total += count
+		}
+		s.ConnLimiters[name] = cs
+	}
+	for name, r := range a.rateLimiters {
+		var occupancy *ratelimit.Occupancy
+		if o, ok := r.Occupancy(); ok {
+			occupancy = &o
+		}
+		s.RateLimiters[name] = occupancy
+	}
+	for name, m := range a.metrics {
+		snapshot, err := m.Snapshot(a.quantiles...)
+		if err != nil {
+			a.log.Errorf("vulcand/oxy/admin: failed to snapshot metrics %v, err: %v", name, err)
+			continue
+		}
+		s.Metrics[name] = snapshot
+	}
+	return s
+}
+
+// status lists the servers of the load balancer followed by the ones only known to the health checker
+func (b balancer) status() []ServerStatus {
+	servers := []ServerStatus{}
+	seen := make(map[string]bool)
+	add := func(u *url.URL, inRotation bool) {
+		if seen[u.String()] {
+			return
+		}
+		seen[u.String()] = true
+		st := ServerStatus{URL: u.String(), InRotation: inRotation}
+		if w, ok := b.lb.(weighted); ok && inRotation {
+			if weight, ok := w.ServerWeight(u); ok {
+				st.Weight = &weight
+			}
+		}
+		if b.hc != nil {
+			if healthy, ok := b.hc.IsHealthy(u); ok {
+				st.Healthy = &healthy
+			}
+		}
+		servers = append(servers, st)
+	}
+	for _, u := range b.lb.Servers() {
+		add(u, true)
+	}
+	if b.hc != nil {
+		for _, u := range b.hc.Servers() {
+			add(u, false)
+		}
+	}
+	return servers
+}
+
+// ServeHTTP renders the status of the registered components as JSON
+func (a *Admin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := json.MarshalIndent(a.Status(), "", "  ")
+	if err != nil {
+		a.log.Errorf("vulcand/oxy/admin: failed to marshal status, err: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+	w.Write([]byte("\n"))
+}
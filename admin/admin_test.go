@@ -0,0 +1,144 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/cbreaker"
+	"github.com/heebyunglee/oxy/connlimit"
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/ratelimit"
+	"github.com/heebyunglee/oxy/roundrobin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/oxy/utils"
+)
+
+func TestBalancerStatus(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	down := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer down.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	lb, err := roundrobin.New(fwd)
+	require.NoError(t, err)
+	hc, err := roundrobin.NewHealthChecker(lb)
+	require.NoError(t, err)
+
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(a.URL), roundrobin.Weight(3)))
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(down.URL)))
+	hc.Check()
+
+	adm, err := New()
+	require.NoError(t, err)
+	adm.Balancer("api", lb, hc)
+	adm.Balancer("plain", lb, nil)
+
+	status := adm.Status()
+
+	weight, healthy, unhealthy := 3, true, false
+	assert.Equal(t, []ServerStatus{
+		{URL: a.URL, InRotation: true, Weight: &weight, Healthy: &healthy},
+		{URL: down.URL, InRotation: false, Healthy: &unhealthy},
+	}, status.Balancers["api"])
+	assert.Equal(t, []ServerStatus{
+		{URL: a.URL, InRotation: true, Weight: &weight},
+	}, status.Balancers["plain"])
+}
+
+func TestLimitersStatus(t *testing.T) {
+	extract, err := utils.NewExtractor("client.ip")
+	require.NoError(t, err)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+
+	cl, err := connlimit.New(handler, extract, 10)
+	require.NoError(t, err)
+
+	rates := ratelimit.NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 10, 10))
+	tl, err := ratelimit.New(cl, extract, rates, ratelimit.Capacity(100))
+	require.NoError(t, err)
+
+	adm, err := New()
+	require.NoError(t, err)
+	adm.ConnLimiter("clients", cl)
+	adm.RateLimiter("clients", tl)
+
+	srv := httptest.NewServer(tl)
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		testutils.Get(srv.URL)
+		close(done)
+	}()
+	<-entered
+
+	status := adm.Status()
+	assert.Equal(t, ConnStatus{Total: 1, Sources: map[string]int64{"127.0.0.1": 1}}, status.ConnLimiters["clients"])
+	assert.Equal(t, &ratelimit.Occupancy{Sources: 1, Capacity: 100}, status.RateLimiters["clients"])
+
+	close(release)
+	<-done
+	assert.Equal(t, ConnStatus{Total: 0, Sources: map[string]int64{}}, adm.Status().ConnLimiters["clients"])
+}
+
+func TestServeHTTP(t *testing.T) {
+	cb, err := cbreaker.New(http.NotFoundHandler(), "NetworkErrorRatio() > 0.5")
+	require.NoError(t, err)
+
+	rtm, err := memmetrics.NewRTMetrics()
+	require.NoError(t, err)
+	rtm.RecordRequest(http.MethodGet, http.StatusTooManyRequests, time.Millisecond)
+
+	adm, err := New(Quantiles(99))
+	require.NoError(t, err)
+	adm.CircuitBreaker("api", cb)
+	adm.RTMetrics("api", rtm)
+
+	srv := httptest.NewServer(adm)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "application/json", re.Header.Get("Content-Type"))
+
+	var status map[string]map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &status))
+
+	assert.Equal(t, "standby", status["circuit_breakers"]["api"])
+	metrics := status["metrics"]["api"].(map[string]interface{})
+	assert.EqualValues(t, 1, metrics["total"])
+	assert.Equal(t, map[string]interface{}{"429": 1.0}, metrics["status_codes"])
+	assert.Len(t, metrics["latency"].(map[string]interface{})["quantiles"], 1)
+	assert.Empty(t, status["balancers"])
+
+	re, _, err = testutils.MakeRequest(srv.URL, testutils.Method(http.MethodPost))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, re.StatusCode)
+}
+
+func TestQuantilesValidation(t *testing.T) {
+	_, err := New(Quantiles())
+	assert.Error(t, err)
+
+	_, err = New(Quantiles(50, 101))
+	assert.Error(t, err)
+}
@@ -0,0 +1,293 @@
+/*
+Package auth provides http.Handler middleware authenticating the requests before passing them to the next handler.
+
+The name of the authenticated user is stored in the context of the request, see utils.UserFromRequest, and can be
+sent to the backends in a header. The requests without credentials are answered with 401 Unauthorized and
+a WWW-Authenticate challenge, the ones with wrong credentials with 401 for HTTP Basic authentication, so that
+browsers prompt again, and with 403 Forbidden for API keys.
+
+Examples of authentication middlewares:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte("hello " + utils.UserFromRequest(req)))
+	})
+
+	// HTTP Basic authentication, the credentials are not forwarded to the backends
+	auth.NewBasic(handler, auth.StaticUsers(map[string]string{"alice": "secret"}),
+	  auth.Realm("backoffice"), auth.RemoveCredentials())
+
+	// API keys, rotated by adding the new key before removing the old one
+	keys := auth.NewKeySet(map[string]string{"3f1c...": "customer-1"})
+	auth.NewAPIKey(handler, keys.Verify, auth.Header("X-Api-Key"), auth.QueryParam("api_key"),
+	  auth.UserHeader("X-Customer"))
+	keys.Add("9b2e...", "customer-1")
+	keys.Remove("3f1c...")
+
+	// JSON Web Tokens signed by the keys of an identity provider, the claims are stored in the context
+	// of the request, see utils.ClaimsFromRequest, and the subject is the authenticated user
+	jwks, _ := auth.NewJWKS("https://idp.example.com/.well-known/jwks.json")
+	validator, _ := auth.NewJWTValidator(jwks.Key, auth.Issuer("https://idp.example.com/"), auth.Audience("api"))
+	auth.NewJWT(handler, validator)
+*/
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// BasicVerifier tells if the credentials of HTTP Basic authentication are valid
+type BasicVerifier func(username, password string) bool
+
+// KeyVerifier returns the user owning the API key, false if the key is not valid
+type KeyVerifier func(key string) (user string, ok bool)
+
+// StaticUsers returns a verifier of the users and their passwords, the passwords are compared in constant time
+func StaticUsers(users map[string]string) BasicVerifier {
+	copied := make(map[string]string, len(users))
+	for u, p := range users {
+		copied[u] = p
+	}
+	return func(username, password string) bool {
+		expected, ok := copied[username]
+		// compare anyway so that unknown users take as long as wrong passwords
+		match := subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+		return ok && match
+	}
+}
+
+// authenticator authenticates a request, returning the user and the verified claims of its token if any,
+// or an *AuthError
+type authenticator func(a *Auth, req *http.Request) (string, map[string]interface{}, error)
+
+// Auth authenticates the requests
+type Auth struct {
+	next         http.Handler
+	authenticate authenticator
+
+	realm             string
+	header            string
+	queryParam        string
+	userHeader        string
+	removeCredentials bool
+	errHandler        utils.ErrorHandler
+
+	log *log.Logger
+}
+
+// NewBasic returns a new middleware authenticating the requests with HTTP Basic authentication.
+// NewBasic() function supports optional functional arguments
+func NewBasic(next http.Handler, verify BasicVerifier, setters ...optSetter) (*Auth, error) {
+	if verify == nil {
+		return nil, fmt.Errorf("provide a verifier")
+	}
+	return newAuth(next, func(a *Auth, req *http.Request) (string, map[string]interface{}, error) {
+		username, password, ok := req.BasicAuth()
+		if !ok {
+			return "", nil, &AuthError{Status: http.StatusUnauthorized, Challenge: a.challenge("Basic"), Reason: "no credentials"}
+		}
+		if !verify(username, password) {
+			return "", nil, &AuthError{Status: http.StatusUnauthorized, Challenge: a.challenge("Basic"), Reason: "invalid credentials of user " + username}
+		}
+		return username, nil, nil
+	}, "Authorization", setters)
+}
+
+// NewAPIKey returns a new middleware authenticating the requests with an API key sent in a header,
+// X-Api-Key by default, or in a query parameter. NewAPIKey() function supports optional functional arguments
+func NewAPIKey(next http.Handler, verify KeyVerifier, setters ...optSetter) (*Auth, error) {
+	if verify == nil {
+		return nil, fmt.Errorf("provide a verifier")
+	}
+	return newAuth(next, func(a *Auth, req *http.Request) (string, map[string]interface{}, error) {
+		key := req.Header.Get(a.header)
+		if key == "" && a.queryParam != "" {
+			key = req.URL.Query().Get(a.queryParam)
+		}
+		if key == "" {
+			return "", nil, &AuthError{Status: http.StatusUnauthorized, Challenge: a.challenge("ApiKey"), Reason: "no API key"}
+		}
+		user, ok := verify(key)
+		if !ok {
+			return "", nil, &AuthError{Status: http.StatusForbidden, Reason: "invalid API key"}
+		}
+		return user, nil, nil
+	}, "X-Api-Key", setters)
+}
+
+func newAuth(next http.Handler, authenticate authenticator, header string, setters []optSetter) (*Auth, error) {
+	a := &Auth{
+		next:         next,
+		authenticate: authenticate,
+		realm:        "Restricted",
+		header:       header,
+		errHandler:   &AuthErrHandler{},
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+type optSetter func(a *Auth) error
+
+// Realm sets the realm of the WWW-Authenticate challenge, defaults to Restricted
+func Realm(realm string) optSetter {
+	return func(a *Auth) error {
+		a.realm = realm
+		return nil
+	}
+}
+
+// Header sets the header carrying the API key, defaults to X-Api-Key, or the bearer token, defaults to
+// Authorization. It is ignored by Basic authentication.
+func Header(name string) optSetter {
+	return func(a *Auth) error {
+		if name == "" {
+			return fmt.Errorf("header name can not be empty")
+		}
+		a.header = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// QueryParam sets the query parameter carrying the API key when the header is missing.
+// It is ignored by Basic authentication.
+func QueryParam(name string) optSetter {
+	return func(a *Auth) error {
+		a.queryParam = name
+		return nil
+	}
+}
+
+// UserHeader sets the header carrying the name of the authenticated user to the next handler.
+// The header sent by the client is always replaced.
+func UserHeader(name string) optSetter {
+	return func(a *Auth) error {
+		a.userHeader = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// RemoveCredentials removes the credentials from the requests passed to the next handler
+func RemoveCredentials() optSetter {
+	return func(a *Auth) error {
+		a.removeCredentials = true
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler answering the requests failing authentication, it is called with an *AuthError.
+// Defaults to AuthErrHandler.
+func ErrorHandler(h utils.ErrorHandler) optSetter {
+	return func(a *Auth) error {
+		a.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the authentication middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(a *Auth) error {
+		a.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by authentication handler.
+func (a *Auth) Wrap(next http.Handler) {
+	a.next = next
+}
+
+func (a *Auth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if a.log.Level >= log.DebugLevel {
+		logEntry := a.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/auth: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/auth: completed ServeHttp on request")
+	}
+
+	user, claims, err := a.authenticate(a, req)
+	if err != nil {
+		a.log.Debugf("vulcand/oxy/auth: rejecting Request(%v %v), err: %v", req.Method, req.URL, err)
+		a.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	a.next.ServeHTTP(w, a.authenticated(req, user, claims))
+}
+
+// authenticated returns the request passed to the next handler
+func (a *Auth) authenticated(req *http.Request, user string, claims map[string]interface{}) *http.Request {
+	outReq := utils.WithUser(req, user)
+	if claims != nil {
+		outReq = utils.WithClaims(outReq, claims)
+	}
+	if a.userHeader == "" && !a.removeCredentials {
+		return outReq
+	}
+
+	// the headers are shared with the original request, work on a copy
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+	if a.userHeader != "" {
+		outReq.Header.Set(a.userHeader, user)
+	}
+	if a.removeCredentials {
+		outReq.Header.Del(a.header)
+		if a.queryParam != "" {
+			u := utils.CopyURL(req.URL)
+			q := u.Query()
+			if _, ok := q[a.queryParam]; ok {
+				q.Del(a.queryParam)
+				u.RawQuery = q.Encode()
+				outReq.URL = u
+				// the forwarder rebuilds the URL from the request URI
+				outReq.RequestURI = u.RequestURI()
+			}
+		}
+	}
+	return outReq
+}
+
+func (a *Auth) challenge(scheme string) string {
+	return fmt.Sprintf("%s realm=%q", scheme, a.realm)
+}
+
+// AuthError is returned for the requests failing authentication
+type AuthError struct {
+	// Status is the status code of the response, 401 or 403
+	Status int
+	// Challenge is the WWW-Authenticate header of 401 responses
+	Challenge string
+	// Reason explains why the request failed authentication, it is logged but not sent to the client
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", e.Reason)
+}
+
+// AuthErrHandler answers the requests failing authentication with the status of the error and its challenge
+type AuthErrHandler struct{}
+
+func (e *AuthErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if authErr, ok := err.(*AuthError); ok {
+		if authErr.Challenge != "" {
+			w.Header().Set("WWW-Authenticate", authErr.Challenge)
+		}
+		w.WriteHeader(authErr.Status)
+		w.Write([]byte(http.StatusText(authErr.Status)))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
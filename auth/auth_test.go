@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(utils.UserFromRequest(req)))
+})
+
+func TestBasic(t *testing.T) {
+	a, err := NewBasic(whoami, StaticUsers(map[string]string{"alice": "secret"}), Realm("backoffice"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL, testutils.BasicAuth("alice", "secret"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "alice", string(body))
+
+	for _, opts := range [][]testutils.ReqOption{
+		nil,
+		{testutils.BasicAuth("alice", "wrong")},
+		{testutils.BasicAuth("bob", "secret")},
+		{testutils.Header("Authorization", "Bearer token")},
+	} {
+		re, _, err = testutils.Get(srv.URL, opts...)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, re.StatusCode)
+		assert.Equal(t, `Basic realm="backoffice"`, re.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	keys := NewKeySet(map[string]string{"k1": "customer-1"})
+	a, err := NewAPIKey(whoami, keys.Verify, QueryParam("api_key"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL, testutils.Header("X-Api-Key", "k1"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "customer-1", string(body))
+
+	re, body, err = testutils.Get(srv.URL + "/?api_key=k1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "customer-1", string(body))
+
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, re.StatusCode)
+	assert.Equal(t, `ApiKey realm="Restricted"`, re.Header.Get("WWW-Authenticate"))
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("X-Api-Key", "k2"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, re.StatusCode)
+	assert.Empty(t, re.Header.Get("WWW-Authenticate"))
+}
+
+func TestForwardedRequest(t *testing.T) {
+	var got *http.Request
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+	})
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	keys := NewKeySet(map[string]string{"k1": "customer-1"})
+	a, err := NewAPIKey(handler, keys.Verify, Header("X-Key"), QueryParam("api_key"), UserHeader("X-Customer"), RemoveCredentials())
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL+"/path?api_key=k1&page=2", testutils.Header("X-Customer", "forged"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "customer-1", got.Header.Get("X-Customer"))
+	assert.Equal(t, "/path", got.URL.Path)
+	assert.Equal(t, "page=2", got.URL.RawQuery)
+
+	_, _, err = testutils.Get(srv.URL, testutils.Header("X-Key", "k1"))
+	require.NoError(t, err)
+	assert.Empty(t, got.Header.Get("X-Key"))
+}
+
+func TestOptionsValidation(t *testing.T) {
+	_, err := NewBasic(whoami, nil)
+	assert.Error(t, err)
+
+	_, err = NewAPIKey(whoami, nil)
+	assert.Error(t, err)
+
+	_, err = NewAPIKey(whoami, NewKeySet(nil).Verify, Header(""))
+	assert.Error(t, err)
+}
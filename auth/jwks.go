@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+const (
+	// DefaultJWKSTTL is how long the fetched keys are used before being fetched again
+	DefaultJWKSTTL = time.Hour
+	// DefaultJWKSMinRefresh is the minimum interval between two fetches triggered by unknown key IDs
+	DefaultJWKSMinRefresh = 5 * time.Minute
+
+	maxJWKSSize = 1 << 20
+)
+
+// JWKS fetches the public keys of an identity provider published as a JSON Web Key Set and caches them.
+// Its Key method is a KeyFunc: the keys are fetched again when they expire or when a token is signed with
+// an unknown key ID, at most once per minimum refresh interval, so that rotated keys are picked up.
+type JWKS struct {
+	url        string
+	client     *http.Client
+	ttl        time.Duration
+	minRefresh time.Duration
+	clock      timetools.TimeProvider
+
+	mutex     sync.Mutex
+	keys      map[string]jwk
+	fetched   time.Time
+	attempted time.Time
+}
+
+type jwk struct {
+	alg string
+	key interface{}
+}
+
+// NewJWKS returns the key set published at the URL, the keys are fetched on first use.
+// NewJWKS() function supports optional functional arguments
+func NewJWKS(url string, setters ...JWKSOption) (*JWKS, error) {
+	if url == "" {
+		return nil, fmt.Errorf("provide the URL of the key set")
+	}
+	k := &JWKS{
+		url:        url,
+		client:     http.DefaultClient,
+		ttl:        DefaultJWKSTTL,
+		minRefresh: DefaultJWKSMinRefresh,
+		clock:      &timetools.RealTime{},
+	}
+	for _, s := range setters {
+		if err := s(k); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// JWKSOption configures a JWKS
+type JWKSOption func(k *JWKS) error
+
+// JWKSClient sets the client fetching the keys, defaults to http.DefaultClient
+func JWKSClient(c *http.Client) JWKSOption {
+	return func(k *JWKS) error {
+		if c == nil {
+			return fmt.Errorf("client can not be nil")
+		}
+		k.client = c
+		return nil
+	}
+}
+
+// JWKSTTL sets how long the keys are cached, defaults to DefaultJWKSTTL
+func JWKSTTL(ttl time.Duration) JWKSOption {
+	return func(k *JWKS) error {
+		if ttl <= 0 {
+			return fmt.Errorf("ttl should be positive: %v", ttl)
+		}
+		k.ttl = ttl
+		return nil
+	}
+}
+
+// JWKSMinRefresh sets the minimum interval between two fetches triggered by unknown key IDs,
+// defaults to DefaultJWKSMinRefresh
+func JWKSMinRefresh(d time.Duration) JWKSOption {
+	return func(k *JWKS) error {
+		if d < 0 {
+			return fmt.Errorf("minimum refresh interval can not be negative: %v", d)
+		}
+		k.minRefresh = d
+		return nil
+	}
+}
+
+// JWKSClock sets the clock expiring the cached keys
+func JWKSClock(clock timetools.TimeProvider) JWKSOption {
+	return func(k *JWKS) error {
+		k.clock = clock
+		return nil
+	}
+}
+
+// Key returns the key with the ID, when the token has no key ID the key set must hold a single key
+func (k *JWKS) Key(alg, kid string) (interface{}, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	now := k.clock.UtcNow()
+	if k.keys == nil || now.Sub(k.fetched) >= k.ttl {
+		// keep using the expired keys when the identity provider is unavailable
+		if err := k.refresh(now); err != nil && k.keys == nil {
+			return nil, err
+		}
+	}
+	key, ok := k.lookup(kid)
+	if !ok && now.Sub(k.attempted) >= k.minRefresh {
+		if err := k.refresh(now); err != nil {
+			return nil, err
+		}
+		key, ok = k.lookup(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if key.alg != "" && key.alg != alg {
+		return nil, fmt.Errorf("key %q can not verify %v tokens", kid, alg)
+	}
+	return key.key, nil
+}
+
+// Refresh fetches the keys now
+func (k *JWKS) Refresh() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.refresh(k.clock.UtcNow())
+}
+
+func (k *JWKS) lookup(kid string) (jwk, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *JWKS) refresh(now time.Time) error {
+	k.attempted = now
+	re, err := k.client.Get(k.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch key set: %v", err)
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch key set: %v", re.Status)
+	}
+	keys, err := parseJWKS(io.LimitReader(re.Body, maxJWKSSize))
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	k.fetched = now
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the signing keys of the set, the keys of unknown types or for encryption are skipped
+func parseJWKS(r io.Reader) (map[string]jwk, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key set: %v", err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("malformed key set: %v", err)
+	}
+
+	keys := make(map[string]jwk, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAKey(k)
+		case "EC":
+			key, err = parseECKey(k)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = jwk{alg: k.Alg, key: key}
+	}
+	return keys, nil
+}
+
+func parseRSAKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := decodeInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 2 || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func parseECKey(k jsonWebKey) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := decodeInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, fmt.Errorf("point is not on curve %v", k.Crv)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("missing parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// keyServer publishes the public keys as a JSON Web Key Set and counts the fetches
+type keyServer struct {
+	mutex   sync.Mutex
+	keys    []map[string]string
+	fetches int
+	srv     *httptest.Server
+}
+
+func newKeyServer() *keyServer {
+	s := &keyServer{}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+	return s
+}
+
+func (s *keyServer) publish(kid string, key interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	enc := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		s.keys = append(s.keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": enc(k.N), "e": enc(big.NewInt(int64(k.E)))})
+	case *ecdsa.PublicKey:
+		s.keys = append(s.keys, map[string]string{"kty": "EC", "kid": kid, "crv": k.Curve.Params().Name, "x": enc(k.X), "y": enc(k.Y)})
+	}
+}
+
+func (s *keyServer) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fetches
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	s := newKeyServer()
+	defer s.srv.Close()
+	s.publish("rsa", &rsaKey.PublicKey)
+	s.publish("ec", &ecKey.PublicKey)
+
+	jwks, err := NewJWKS(s.srv.URL)
+	require.NoError(t, err)
+	v, err := NewJWTValidator(jwks.Key, Algorithms("RS256", "ES256"))
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "alice"}
+	_, err = v.Validate(sign(t, "RS256", "rsa", rsaKey, claims))
+	assert.NoError(t, err)
+	_, err = v.Validate(sign(t, "ES256", "ec", ecKey, claims))
+	assert.NoError(t, err)
+	_, err = v.Validate(sign(t, "ES256", "rsa", ecKey, claims))
+	assert.Error(t, err)
+	assert.Equal(t, 1, s.count())
+
+	// no key ID with several keys
+	_, err = v.Validate(sign(t, "RS256", "", rsaKey, claims))
+	assert.Error(t, err)
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	s := newKeyServer()
+	defer s.srv.Close()
+	s.publish("old", &oldKey.PublicKey)
+
+	clock := testutils.GetClock()
+	jwks, err := NewJWKS(s.srv.URL, JWKSTTL(time.Hour), JWKSMinRefresh(time.Minute), JWKSClock(clock))
+	require.NoError(t, err)
+	v, err := NewJWTValidator(jwks.Key, JWTClock(clock))
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "alice"}
+	_, err = v.Validate(sign(t, "RS256", "", oldKey, claims))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.count())
+
+	// the unknown key is not fetched again before the minimum refresh interval
+	_, err = v.Validate(sign(t, "RS256", "new", newKey, claims))
+	assert.Error(t, err)
+	assert.Equal(t, 1, s.count())
+
+	s.publish("new", &newKey.PublicKey)
+	_, err = v.Validate(sign(t, "RS256", "new", newKey, claims))
+	assert.Error(t, err)
+	assert.Equal(t, 1, s.count())
+
+	clock.Sleep(time.Minute)
+	_, err = v.Validate(sign(t, "RS256", "new", newKey, claims))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.count())
+
+	// the keys are fetched again when they expire, and kept when the identity provider is down
+	clock.Sleep(time.Hour)
+	s.srv.Close()
+	_, err = v.Validate(sign(t, "RS256", "old", oldKey, claims))
+	assert.NoError(t, err)
+	assert.Error(t, jwks.Refresh())
+}
+
+func TestJWKSParse(t *testing.T) {
+	keys, err := parseJWKS(strings.NewReader(`{"keys":[
+		{"kty":"oct","kid":"secret","k":"c2VjcmV0"},
+		{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"},
+		{"kty":"RSA","kid":"sig","alg":"RS256","n":"AQAB","e":"AQAB"}]}`))
+	require.NoError(t, err)
+	assert.Len(t, keys, 1)
+	assert.Equal(t, "RS256", keys["sig"].alg)
+
+	for _, set := range []string{
+		`{"keys":[{"kty":"RSA","kid":"a","n":"","e":"AQAB"}]}`,
+		`{"keys":[{"kty":"EC","kid":"a","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		`{"keys":[{"kty":"EC","kid":"a","crv":"secp256k1","x":"AQ","y":"AQ"}]}`,
+		`not json`,
+	} {
+		_, err := parseJWKS(strings.NewReader(set))
+		assert.Error(t, err, set)
+	}
+}
+
+func TestJWKSOptionsValidation(t *testing.T) {
+	_, err := NewJWKS("")
+	assert.Error(t, err)
+
+	_, err = NewJWKS("http://localhost", JWKSTTL(0))
+	assert.Error(t, err)
+
+	_, err = NewJWKS("http://localhost", JWKSClient(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	// register the hashes of the algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// KeyFunc returns the key verifying the signature of a token given the algorithm and the key ID of its header:
+// a []byte secret for the HS algorithms, an *rsa.PublicKey for RS and an *ecdsa.PublicKey for ES
+type KeyFunc func(alg, kid string) (interface{}, error)
+
+// HMACKey returns a KeyFunc verifying the tokens signed with the shared secret
+func HMACKey(secret []byte) KeyFunc {
+	return func(alg, kid string) (interface{}, error) {
+		return secret, nil
+	}
+}
+
+// PublicKey returns a KeyFunc verifying the tokens signed with the private key of the RSA or ECDSA public key
+func PublicKey(key crypto.PublicKey) KeyFunc {
+	return func(alg, kid string) (interface{}, error) {
+		return key, nil
+	}
+}
+
+// DefaultAlgorithms are the algorithms accepted by the validators, "none" is never accepted
+var DefaultAlgorithms = []string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// JWTValidator verifies the signature and the registered claims of JSON Web Tokens
+type JWTValidator struct {
+	keys       KeyFunc
+	algorithms map[string]bool
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	clock      timetools.TimeProvider
+}
+
+// NewJWTValidator returns a validator of the tokens signed with the keys returned by the KeyFunc.
+// NewJWTValidator() function supports optional functional arguments
+func NewJWTValidator(keys KeyFunc, setters ...JWTOption) (*JWTValidator, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("provide a key function")
+	}
+	v := &JWTValidator{
+		keys:  keys,
+		clock: &timetools.RealTime{},
+	}
+	for _, s := range setters {
+		if err := s(v); err != nil {
+			return nil, err
+		}
+	}
+	if v.algorithms == nil {
+		if err := Algorithms(DefaultAlgorithms...)(v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// JWTOption configures a JWTValidator
+type JWTOption func(v *JWTValidator) error
+
+// Algorithms sets the signing algorithms accepted, defaults to DefaultAlgorithms.
+// Restrict them to the family of the keys, e.g. RS256 only.
+func Algorithms(algs ...string) JWTOption {
+	return func(v *JWTValidator) error {
+		if len(algs) == 0 {
+			return fmt.Errorf("provide at least one algorithm")
+		}
+		v.algorithms = make(map[string]bool, len(algs))
+		for _, alg := range algs {
+			if _, err := hashOf(alg); err != nil {
+				return err
+			}
+			v.algorithms[alg] = true
+		}
+		return nil
+	}
+}
+
+// Issuer requires the tokens to be issued by the issuer, the iss claim
+func Issuer(iss string) JWTOption {
+	return func(v *JWTValidator) error {
+		v.issuer = iss
+		return nil
+	}
+}
+
+// Audience requires the tokens to be intended for the audience, one of the aud claim
+func Audience(aud string) JWTOption {
+	return func(v *JWTValidator) error {
+		v.audience = aud
+		return nil
+	}
+}
+
+// Leeway sets the clock skew tolerated when checking the exp and nbf claims
+func Leeway(d time.Duration) JWTOption {
+	return func(v *JWTValidator) error {
+		if d < 0 {
+			return fmt.Errorf("leeway can not be negative: %v", d)
+		}
+		v.leeway = d
+		return nil
+	}
+}
+
+// JWTClock sets the clock checking the expiration of the tokens
+func JWTClock(clock timetools.TimeProvider) JWTOption {
+	return func(v *JWTValidator) error {
+		v.clock = clock
+		return nil
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Validate verifies the token and returns its claims
+func (v *JWTValidator) Validate(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if !v.algorithms[header.Alg] {
+		return nil, fmt.Errorf("algorithm %q is not accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	key, err := v.keys(header.Alg, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTValidator) checkClaims(claims map[string]interface{}) error {
+	now := v.clock.UtcNow()
+	if exp, ok, err := numericDate(claims, "exp"); err != nil {
+		return err
+	} else if ok && !now.Before(exp.Add(v.leeway)) {
+		return fmt.Errorf("token expired at %v", exp)
+	}
+	if nbf, ok, err := numericDate(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(v.leeway).Before(nbf) {
+		return fmt.Errorf("token not valid before %v", nbf)
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return fmt.Errorf("token is not intended for audience %q", v.audience)
+	}
+	return nil
+}
+
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim %v is not a numeric date", name)
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), true, nil
+}
+
+func hasAudience(aud interface{}, expected string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == expected
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func hashOf(alg string) (crypto.Hash, error) {
+	if len(alg) == 5 {
+		switch alg[:2] {
+		case "HS", "RS", "ES":
+			switch alg[2:] {
+			case "256":
+				return crypto.SHA256, nil
+			case "384":
+				return crypto.SHA384, nil
+			case "512":
+				return crypto.SHA512, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// verifySignature checks the signature with a key of the type of the algorithm,
+// an RSA public key must not be mistaken for an HMAC secret
+func verifySignature(alg string, key interface{}, signed string, signature []byte) error {
+	hash, err := hashOf(alg)
+	if err != nil {
+		return err
+	}
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("key of type %T can not verify %v tokens", key, alg)
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key of type %T can not verify %v tokens", key, alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	default:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != curveOf(alg) {
+			return fmt.Errorf("key of type %T can not verify %v tokens", key, alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+}
+
+func curveOf(alg string) elliptic.Curve {
+	switch alg {
+	case "ES256":
+		return elliptic.P256()
+	case "ES384":
+		return elliptic.P384()
+	case "ES512":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// NewJWT returns a new middleware authenticating the requests with a JSON Web Token sent as a bearer token in
+// the Authorization header, or the one set with Header. The claims of the valid tokens are stored in the context of the request, see
+// utils.ClaimsFromRequest, and the sub claim is the authenticated user.
+// NewJWT() function supports optional functional arguments
+func NewJWT(next http.Handler, validator *JWTValidator, setters ...optSetter) (*Auth, error) {
+	if validator == nil {
+		return nil, fmt.Errorf("provide a validator")
+	}
+	return newAuth(next, func(a *Auth, req *http.Request) (string, map[string]interface{}, error) {
+		auth := req.Header.Get(a.header)
+		if len(auth) < len("bearer ") || !strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+			return "", nil, &AuthError{Status: http.StatusUnauthorized, Challenge: a.challenge("Bearer"), Reason: "no bearer token"}
+		}
+		claims, err := validator.Validate(strings.TrimSpace(auth[len("bearer "):]))
+		if err != nil {
+			return "", nil, &AuthError{
+				Status:    http.StatusUnauthorized,
+				Challenge: a.challenge("Bearer") + `, error="invalid_token"`,
+				Reason:    err.Error(),
+			}
+		}
+		sub, _ := claims["sub"].(string)
+		return sub, claims, nil
+	}, "Authorization", setters)
+}
@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// sign returns a token signed with the private key or the secret
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+
+	hash, err := hashOf(alg)
+	require.NoError(t, err)
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := digestOf(hash, signed)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digestOf(hash, signed))
+		require.NoError(t, err)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[size-len(rb):size], rb)
+		copy(signature[2*size-len(sb):], sb)
+	}
+	return signed + "." + enc.EncodeToString(signature)
+}
+
+func digestOf(hash crypto.Hash, signed string) []byte {
+	h := hash.New()
+	h.Write([]byte(signed))
+	return h.Sum(nil)
+}
+
+func TestValidateAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	secret := []byte("secret")
+	claims := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		desc   string
+		alg    string
+		signer interface{}
+		keys   KeyFunc
+		valid  bool
+	}{
+		{desc: "HS256", alg: "HS256", signer: secret, keys: HMACKey(secret), valid: true},
+		{desc: "HS512", alg: "HS512", signer: secret, keys: HMACKey(secret), valid: true},
+		{desc: "wrong secret", alg: "HS256", signer: []byte("other"), keys: HMACKey(secret)},
+		{desc: "RS256", alg: "RS256", signer: rsaKey, keys: PublicKey(&rsaKey.PublicKey), valid: true},
+		{desc: "RS384", alg: "RS384", signer: rsaKey, keys: PublicKey(&rsaKey.PublicKey), valid: true},
+		{desc: "ES256", alg: "ES256", signer: ecKey, keys: PublicKey(&ecKey.PublicKey), valid: true},
+		{desc: "ES384", alg: "ES384", signer: ec384Key, keys: PublicKey(&ec384Key.PublicKey), valid: true},
+		{desc: "curve of another algorithm", alg: "ES256", signer: ecKey, keys: PublicKey(&ec384Key.PublicKey)},
+		{desc: "HMAC with a public key", alg: "HS256", signer: secret, keys: PublicKey(&rsaKey.PublicKey)},
+		{desc: "RSA with a secret", alg: "RS256", signer: rsaKey, keys: HMACKey(secret)},
+	}
+	for _, test := range tests {
+		v, err := NewJWTValidator(test.keys)
+		require.NoError(t, err)
+		got, err := v.Validate(sign(t, test.alg, "", test.signer, claims))
+		if !test.valid {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		require.NoError(t, err, test.desc)
+		assert.Equal(t, claims, got, test.desc)
+	}
+}
+
+func TestValidateRejectsNone(t *testing.T) {
+	v, err := NewJWTValidator(HMACKey([]byte("secret")))
+	require.NoError(t, err)
+
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(`{"sub":"alice"}`)) + "."
+	_, err = v.Validate(token)
+	assert.Error(t, err)
+
+	v, err = NewJWTValidator(HMACKey([]byte("secret")), Algorithms("RS256"))
+	require.NoError(t, err)
+	_, err = v.Validate(sign(t, "HS256", "", []byte("secret"), map[string]interface{}{}))
+	assert.Error(t, err)
+
+	for _, token := range []string{"", "a.b", "a.b.c", "a.b.c.d"} {
+		_, err = v.Validate(token)
+		assert.Error(t, err, token)
+	}
+}
+
+func TestValidateClaims(t *testing.T) {
+	secret := []byte("secret")
+	clock := testutils.GetClock()
+	now := float64(clock.UtcNow().Unix())
+
+	v, err := NewJWTValidator(HMACKey(secret), Issuer("https://idp.example.com/"), Audience("api"),
+		Leeway(time.Minute), JWTClock(clock))
+	require.NoError(t, err)
+
+	valid := func(c map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"iss": "https://idp.example.com/", "aud": "api", "exp": now + 60}
+		for k, v := range c {
+			claims[k] = v
+		}
+		return claims
+	}
+	tests := []struct {
+		desc   string
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{desc: "valid", claims: valid(nil), valid: true},
+		{desc: "audience in a list", claims: valid(map[string]interface{}{"aud": []string{"web", "api"}}), valid: true},
+		{desc: "expired within leeway", claims: valid(map[string]interface{}{"exp": now - 30}), valid: true},
+		{desc: "expired", claims: valid(map[string]interface{}{"exp": now - 60})},
+		{desc: "not yet valid", claims: valid(map[string]interface{}{"nbf": now + 120})},
+		{desc: "not yet valid within leeway", claims: valid(map[string]interface{}{"nbf": now + 30}), valid: true},
+		{desc: "malformed expiration", claims: valid(map[string]interface{}{"exp": "tomorrow"})},
+		{desc: "other issuer", claims: valid(map[string]interface{}{"iss": "https://evil.example.com/"})},
+		{desc: "other audience", claims: valid(map[string]interface{}{"aud": []string{"web"}})},
+	}
+	for _, test := range tests {
+		_, err := v.Validate(sign(t, "HS256", "", secret, test.claims))
+		if test.valid {
+			assert.NoError(t, err, test.desc)
+		} else {
+			assert.Error(t, err, test.desc)
+		}
+	}
+}
+
+func TestJWT(t *testing.T) {
+	secret := []byte("secret")
+	v, err := NewJWTValidator(HMACKey(secret), Algorithms("HS256"))
+	require.NoError(t, err)
+
+	var claims map[string]interface{}
+	a, err := NewJWT(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		claims = utils.ClaimsFromRequest(req)
+		tenant, _, err := utils.NewJWTClaimExtractor("tenant").Extract(req)
+		require.NoError(t, err)
+		w.Write([]byte(utils.UserFromRequest(req) + "@" + tenant))
+	}), v, Realm("api"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(a)
+	defer srv.Close()
+
+	token := sign(t, "HS256", "", secret, map[string]interface{}{"sub": "alice", "tenant": "acme"})
+	re, body, err := testutils.Get(srv.URL, testutils.Header("Authorization", "Bearer "+token))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "alice@acme", string(body))
+	assert.Equal(t, map[string]interface{}{"sub": "alice", "tenant": "acme"}, claims)
+
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, re.StatusCode)
+	assert.Equal(t, `Bearer realm="api"`, re.Header.Get("WWW-Authenticate"))
+
+	forged := sign(t, "HS256", "", []byte("guess"), map[string]interface{}{"sub": "alice", "tenant": "acme"})
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Authorization", "Bearer "+forged))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, re.StatusCode)
+	assert.Equal(t, `Bearer realm="api", error="invalid_token"`, re.Header.Get("WWW-Authenticate"))
+}
+
+func TestJWTOptionsValidation(t *testing.T) {
+	_, err := NewJWT(whoami, nil)
+	assert.Error(t, err)
+
+	_, err = NewJWTValidator(nil)
+	assert.Error(t, err)
+
+	_, err = NewJWTValidator(HMACKey(nil), Algorithms("none"))
+	assert.Error(t, err)
+
+	_, err = NewJWTValidator(HMACKey(nil), Algorithms())
+	assert.Error(t, err)
+
+	_, err = NewJWTValidator(HMACKey(nil), Leeway(-time.Second))
+	assert.Error(t, err)
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// KeySet is a set of API keys and their users that can be updated at runtime, e.g. to rotate the keys:
+// add the new key, let the clients switch to it, then remove the old one.
+// The keys are kept hashed so that looking them up does not leak their content through timing.
+type KeySet struct {
+	mtx  *sync.RWMutex
+	keys map[[sha256.Size]byte]string
+}
+
+// NewKeySet returns a new key set from keys mapped to their users
+func NewKeySet(keys map[string]string) *KeySet {
+	ks := &KeySet{mtx: &sync.RWMutex{}}
+	ks.Replace(keys)
+	return ks
+}
+
+// Add adds a key owned by user, replacing the user of an existing key
+func (ks *KeySet) Add(key, user string) {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	ks.keys[sha256.Sum256([]byte(key))] = user
+}
+
+// Remove removes a key
+func (ks *KeySet) Remove(key string) {
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	delete(ks.keys, sha256.Sum256([]byte(key)))
+}
+
+// Replace replaces all the keys
+func (ks *KeySet) Replace(keys map[string]string) {
+	hashed := make(map[[sha256.Size]byte]string, len(keys))
+	for key, user := range keys {
+		hashed[sha256.Sum256([]byte(key))] = user
+	}
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	ks.keys = hashed
+}
+
+// Len returns the number of keys
+func (ks *KeySet) Len() int {
+	ks.mtx.RLock()
+	defer ks.mtx.RUnlock()
+	return len(ks.keys)
+}
+
+// Verify returns the user owning the key, it is a KeyVerifier
+func (ks *KeySet) Verify(key string) (string, bool) {
+	h := sha256.Sum256([]byte(key))
+	ks.mtx.RLock()
+	defer ks.mtx.RUnlock()
+	user, ok := ks.keys[h]
+	return user, ok
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySet(t *testing.T) {
+	ks := NewKeySet(map[string]string{"old": "alice"})
+	assert.Equal(t, 1, ks.Len())
+
+	user, ok := ks.Verify("old")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+
+	// rotation
+	ks.Add("new", "alice")
+	_, ok = ks.Verify("new")
+	assert.True(t, ok)
+	ks.Remove("old")
+	_, ok = ks.Verify("old")
+	assert.False(t, ok)
+
+	ks.Replace(map[string]string{"other": "bob"})
+	_, ok = ks.Verify("new")
+	assert.False(t, ok)
+	user, ok = ks.Verify("other")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", user)
+}
@@ -28,25 +28,48 @@ Examples of a buffering middleware:
     buffer.MemResponseBodyBytes(2 * 1024 * 1024),
     buffer.MaxResponseBodyBytes(10 * 1024 * 1024))
 
+  // The temporary files are created in the given directory instead of the system one
+  buffer.New(handler, buffer.TempDir("/var/spool/proxy"))
+
   // Buffer will replay the request if the handler returns error at least 3 times
   // before returning the response
   buffer.New(handler, buffer.Retry(`IsNetworkError() && Attempts() <= 2`))
 
+  // The load balancer will send the replayed request to another server than the one that failed
+  buffer.New(lb, buffer.Retry(`IsNetworkError() && Attempts() <= 2`), buffer.RetryNextServer())
+
+  // The parts of the multipart/form-data uploads are limited to 5MB each, the file parts other than images are
+  // stripped and the file parts are written to the disk
+  buffer.New(handler,
+    buffer.MaxPartBytes(5 * 1024 * 1024),
+    buffer.AllowedPartTypes("image/*"))
+
+  // The request body is rewritten before it is forwarded, the Content-Length is computed from the new body
+  buffer.New(handler, buffer.TransformRequest(func(req *http.Request, body io.Reader) (io.Reader, error) {
+    data, err := ioutil.ReadAll(body)
+    if err != nil {
+      return nil, err
+    }
+    return bytes.NewReader(bytes.ToUpper(data)), nil
+  }))
+
 */
 package buffer
 
 import (
 	"bufio"
+	gocontext "context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"reflect"
 
+	"github.com/heebyunglee/oxy/utils"
 	"github.com/mailgun/multibuf"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 const (
@@ -69,12 +92,23 @@ type Buffer struct {
 	maxResponseBodyBytes int64
 	memResponseBodyBytes int64
 
-	retryPredicate hpredicate
+	tempDir string
+
+	retryPredicate  hpredicate
+	retryNextServer bool
+
+	transformers []RequestTransformer
+
+	multipart    bool
+	maxPartBytes int64
+	partTypes    []string
 
 	next       http.Handler
 	errHandler utils.ErrorHandler
+	inflight   utils.Inflight
 
-	log *log.Logger
+	log    *log.Logger
+	logger utils.Logger
 }
 
 // New returns a new buffer middleware. New() function supports optional functional arguments
@@ -98,6 +132,9 @@ func New(next http.Handler, setters ...optSetter) (*Buffer, error) {
 	if strm.errHandler == nil {
 		strm.errHandler = errHandler
 	}
+	if strm.logger == nil {
+		strm.logger = utils.NewLogrusLogger(strm.log)
+	}
 
 	return strm, nil
 }
@@ -112,6 +149,17 @@ func Logger(l *log.Logger) optSetter {
 	}
 }
 
+// StructuredLogger defines the structured logger the buffer logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by Logger.
+func StructuredLogger(l utils.Logger) optSetter {
+	return func(b *Buffer) error {
+		b.logger = l
+		return nil
+	}
+}
+
 type optSetter func(b *Buffer) error
 
 // CondSetter Conditional setter.
@@ -148,6 +196,36 @@ func Retry(predicate string) optSetter {
 	}
 }
 
+// RetryNextServer makes the load balancers of the roundrobin package send a replayed request to a server
+// it was not sent to yet, instead of possibly retrying the server that just failed.
+// The stickiness of the session is ignored when the server it sticks to was tried already.
+func RetryNextServer() optSetter {
+	return func(b *Buffer) error {
+		b.retryNextServer = true
+		return nil
+	}
+}
+
+// RequestTransformer rewrites the buffered request body before it is forwarded, e.g. injecting fields into JSON,
+// recompressing it or stripping PII. It returns a reader of the new body reading the original one, the readers
+// implementing io.Closer are closed once read. The request is a copy whose headers can be changed, e.g. the
+// Content-Type or Content-Encoding; the Content-Length is computed from the new body.
+type RequestTransformer func(req *http.Request, body io.Reader) (io.Reader, error)
+
+// TransformRequest registers transformers of the request bodies, applied in order. The new body is buffered
+// and checked against the limits of the request bodies like the original one.
+func TransformRequest(transformers ...RequestTransformer) optSetter {
+	return func(b *Buffer) error {
+		for _, t := range transformers {
+			if t == nil {
+				return fmt.Errorf("transformer can not be nil")
+			}
+		}
+		b.transformers = append(b.transformers, transformers...)
+		return nil
+	}
+}
+
 // ErrorHandler sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) optSetter {
 	return func(b *Buffer) error {
@@ -202,21 +280,51 @@ func MemResponseBodyBytes(m int64) optSetter {
 	}
 }
 
+// TempDir sets the directory of the temporary files holding the part of the bodies over the memory limits,
+// defaults to the system temporary directory. The files are removed once the request is served.
+func TempDir(dir string) optSetter {
+	return func(b *Buffer) error {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%v is not a directory", dir)
+		}
+		b.tempDir = dir
+		return nil
+	}
+}
+
 // Wrap sets the next handler to be called by buffer handler.
 func (b *Buffer) Wrap(next http.Handler) error {
 	b.next = next
 	return nil
 }
 
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete, their temporary files being removed as they do.
+// It returns the error of the context if it is done first.
+func (b *Buffer) Shutdown(ctx gocontext.Context) error {
+	return b.inflight.Shutdown(ctx)
+}
+
 func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if b.log.Level >= log.DebugLevel {
-		logEntry := b.log.WithField("Request", utils.DumpHttpRequest(req))
-		logEntry.Debug("vulcand/oxy/buffer: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/buffer: completed ServeHttp on request")
+	if !b.inflight.Acquire() {
+		b.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer b.inflight.Release()
+
+	logger := utils.RequestLogger(req, b.logger)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req)})
+		logEntry.Debugf("vulcand/oxy/buffer: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/buffer: completed ServeHttp on request")
 	}
 
 	if err := b.checkLimit(req); err != nil {
-		b.log.Errorf("vulcand/oxy/buffer: request body over limit, err: %v", err)
+		logger.Errorf("vulcand/oxy/buffer: request body over limit, err: %v", err)
 		b.errHandler.ServeHTTP(w, req, err)
 		return
 	}
@@ -225,9 +333,15 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// to read into memory and disk. This reader returns an error if the total request size exceeds the
 	// predefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
 	// and the reader would be unbounded bufio in the http.Server
-	body, err := multibuf.New(req.Body, multibuf.MaxBytes(b.maxRequestBodyBytes), multibuf.MemBytes(b.memRequestBodyBytes))
+	var body multibuf.MultiReader
+	var err error
+	if boundary := b.multipartBoundary(req); boundary != "" {
+		body, err = b.readMultipart(req.Body, boundary, logger)
+	} else {
+		body, err = newSpillReader(req.Body, b.memRequestBodyBytes, b.maxRequestBodyBytes, b.tempDir)
+	}
 	if err != nil || body == nil {
-		b.log.Errorf("vulcand/oxy/buffer: error when reading request body, err: %v", err)
+		logger.Errorf("vulcand/oxy/buffer: error when reading request body, err: %v", err)
 		b.errHandler.ServeHTTP(w, req, err)
 		return
 	}
@@ -239,16 +353,25 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		if body != nil {
 			errClose := body.Close()
 			if errClose != nil {
-				b.log.Errorf("vulcand/oxy/buffer: failed to close body, err: %v", errClose)
+				logger.Errorf("vulcand/oxy/buffer: failed to close body, err: %v", errClose)
 			}
 		}
 	}()
 
+	if len(b.transformers) != 0 {
+		req, body, err = b.transform(req, body)
+		if err != nil {
+			logger.Errorf("vulcand/oxy/buffer: failed to transform request body, err: %v", err)
+			b.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+	}
+
 	// We need to set ContentLength based on known request size. The incoming request may have been
 	// set without content length or using chunked TransferEncoding
 	totalSize, err := body.Size()
 	if err != nil {
-		b.log.Errorf("vulcand/oxy/buffer: failed to get request size, err: %v", err)
+		logger.Errorf("vulcand/oxy/buffer: failed to get request size, err: %v", err)
 		b.errHandler.ServeHTTP(w, req, err)
 		return
 	}
@@ -257,30 +380,29 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		body = nil
 	}
 
+	if b.retryNextServer {
+		req, _ = utils.WithServerAttempts(req)
+	}
+
 	outreq := b.copyRequest(req, body, totalSize)
 
 	attempt := 1
 	for {
 		// We create a special writer that will limit the response size, buffer it to disk if necessary
-		writer, err := multibuf.NewWriterOnce(multibuf.MaxBytes(b.maxResponseBodyBytes), multibuf.MemBytes(b.memResponseBodyBytes))
-		if err != nil {
-			b.log.Errorf("vulcand/oxy/buffer: failed create response writer, err: %v", err)
-			b.errHandler.ServeHTTP(w, req, err)
-			return
-		}
+		writer := newSpillWriter(b.memResponseBodyBytes, b.maxResponseBodyBytes, b.tempDir)
 
 		// We are mimicking http.ResponseWriter to replace writer with our special writer
 		bw := &bufferWriter{
 			header:         make(http.Header),
 			buffer:         writer,
 			responseWriter: w,
-			log:            b.log,
+			log:            logger,
 		}
 		defer bw.Close()
 
 		b.next.ServeHTTP(bw, outreq)
 		if bw.hijacked {
-			b.log.Debugf("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
+			logger.Debugf("vulcand/oxy/buffer: connection was hijacked downstream. Not taking any action in buffer.")
 			return
 		}
 
@@ -288,7 +410,7 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		if bw.expectBody(outreq) {
 			rdr, err := writer.Reader()
 			if err != nil {
-				b.log.Errorf("vulcand/oxy/buffer: failed to read response, err: %v", err)
+				logger.Errorf("vulcand/oxy/buffer: failed to read response, err: %v", err)
 				b.errHandler.ServeHTTP(w, req, err)
 				return
 			}
@@ -309,17 +431,46 @@ func (b *Buffer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		attempt++
 		if body != nil {
 			if _, err := body.Seek(0, 0); err != nil {
-				b.log.Errorf("vulcand/oxy/buffer: failed to rewind response body, err: %v", err)
+				logger.Errorf("vulcand/oxy/buffer: failed to rewind response body, err: %v", err)
 				b.errHandler.ServeHTTP(w, req, err)
 				return
 			}
 		}
 
 		outreq = b.copyRequest(req, body, totalSize)
-		b.log.Debugf("vulcand/oxy/buffer: retry Request(%v %v) attempt %v", req.Method, req.URL, attempt)
+		logger.Debugf("vulcand/oxy/buffer: retry Request(%v %v) attempt %v", req.Method, req.URL, attempt)
 	}
 }
 
+// transform applies the transformers to the body and buffers the new body, the original one is closed.
+// It returns a copy of the request carrying the headers set by the transformers.
+func (b *Buffer) transform(req *http.Request, body multibuf.MultiReader) (*http.Request, multibuf.MultiReader, error) {
+	defer body.Close()
+
+	o := *req
+	o.Header = make(http.Header)
+	utils.CopyHeaders(o.Header, req.Header)
+
+	var r io.Reader = body
+	for _, t := range b.transformers {
+		next, err := t(&o, r)
+		if err != nil {
+			return req, nil, err
+		}
+		if c, ok := next.(io.Closer); ok && next != io.Reader(body) {
+			defer c.Close()
+		}
+		r = next
+	}
+
+	transformed, err := newSpillReader(r, b.memRequestBodyBytes, b.maxRequestBodyBytes, b.tempDir)
+	if err != nil {
+		return req, nil, err
+	}
+	o.Header.Del("Content-Length")
+	return &o, transformed, nil
+}
+
 func (b *Buffer) copyRequest(req *http.Request, body io.ReadCloser, bodySize int64) *http.Request {
 	o := *req
 	o.URL = utils.CopyURL(req.URL)
@@ -353,7 +504,7 @@ type bufferWriter struct {
 	buffer         multibuf.WriterOnce
 	responseWriter http.ResponseWriter
 	hijacked       bool
-	log            *log.Logger
+	log            utils.Logger
 }
 
 // RFC2616 #4.4
@@ -387,14 +538,27 @@ func (b *bufferWriter) Write(buf []byte) (int, error) {
 	if err != nil {
 		// Since go1.11 (https://github.com/golang/go/commit/8f38f28222abccc505b9a1992deecfe3e2cb85de)
 		// if the writer returns an error, the reverse proxy panics
-		b.log.Error(err)
+		b.log.Errorf("%v", err)
 		length = len(buf)
 	}
 	return length, nil
 }
 
-// WriteHeader sets rw.Code.
+// WriteHeader sets rw.Code. The informational responses, e.g. 103 Early Hints, are sent to the client
+// right away, but 100 Continue as the request body was read already.
 func (b *bufferWriter) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		if code == http.StatusContinue {
+			return
+		}
+		h := b.responseWriter.Header()
+		utils.CopyHeaders(h, b.header)
+		b.responseWriter.WriteHeader(code)
+		for k := range b.header {
+			h.Del(k)
+		}
+		return
+	}
 	b.code = code
 }
 
@@ -403,7 +567,7 @@ func (b *bufferWriter) CloseNotify() <-chan bool {
 	if cn, ok := b.responseWriter.(http.CloseNotifier); ok {
 		return cn.CloseNotify()
 	}
-	b.log.Warningf("Upstream ResponseWriter of type %v does not implement http.CloseNotifier. Returning dummy channel.", reflect.TypeOf(b.responseWriter))
+	b.log.Warnf("Upstream ResponseWriter of type %v does not implement http.CloseNotifier. Returning dummy channel.", reflect.TypeOf(b.responseWriter))
 	return make(<-chan bool)
 }
 
@@ -416,7 +580,7 @@ func (b *bufferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 		}
 		return conn, rw, err
 	}
-	b.log.Warningf("Upstream ResponseWriter of type %v does not implement http.Hijacker. Returning dummy channel.", reflect.TypeOf(b.responseWriter))
+	b.log.Warnf("Upstream ResponseWriter of type %v does not implement http.Hijacker. Returning dummy channel.", reflect.TypeOf(b.responseWriter))
 	return nil, nil, fmt.Errorf("the response writer wrapped in this proxy does not implement http.Hijacker. Its type is: %v", reflect.TypeOf(b.responseWriter))
 }
 
@@ -424,10 +588,15 @@ func (b *bufferWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 type SizeErrHandler struct{}
 
 func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
-	if _, ok := err.(*multibuf.MaxSizeReachedError); ok {
+	switch err.(type) {
+	case *multibuf.MaxSizeReachedError, *MaxPartSizeError:
 		w.WriteHeader(http.StatusRequestEntityTooLarge)
 		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
 		return
+	case *MultipartError:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		return
 	}
 	utils.DefaultHandler.ServeHTTP(w, req, err)
 }
@@ -2,14 +2,20 @@ package buffer
 
 import (
 	"bufio"
+	"bytes"
+	gocontext "context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -234,6 +240,37 @@ func TestFileStreamingResponse(t *testing.T) {
 	assert.Equal(t, "hello, this response is too large to fit in memory", string(body))
 }
 
+func TestTempDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Len(t, tempFiles(t, dir), 1)
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+
+	st, err := New(handler, MemRequestBodyBytes(4), MemResponseBodyBytes(4), TempDir(dir))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("hello, this request is too large to fit in memory"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello, this request is too large to fit in memory", string(body))
+
+	assert.Empty(t, tempFiles(t, dir))
+}
+
+func TestTempDirValidation(t *testing.T) {
+	_, err := New(nil, TempDir("/this/directory/does/not/exist"))
+	assert.Error(t, err)
+}
+
 func TestCustomErrorHandler(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("hello, this response is too large"))
@@ -392,3 +429,159 @@ func TestNotNilBody(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 	assert.Equal(t, "hello", string(body))
 }
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	st, err := New(handler)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	done := make(chan int)
+	go func() {
+		re, _, errGet := testutils.Get(proxy.URL)
+		require.NoError(t, errGet)
+		done <- re.StatusCode
+	}()
+	<-started
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, gocontext.DeadlineExceeded, st.Shutdown(ctx))
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	close(release)
+	assert.NoError(t, st.Shutdown(gocontext.Background()))
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestTransformRequest(t *testing.T) {
+	var reqBody, contentType string
+	var contentLength int64
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		reqBody = string(body)
+		contentType = req.Header.Get("Content-Type")
+		contentLength = req.ContentLength
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	upper := func(req *http.Request, body io.Reader) (io.Reader, error) {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/upper")
+		return bytes.NewReader(bytes.ToUpper(data)), nil
+	}
+	wrap := func(req *http.Request, body io.Reader) (io.Reader, error) {
+		return io.MultiReader(strings.NewReader("<"), body, strings.NewReader(">")), nil
+	}
+
+	// the transformed body is spilled to the disk like the original one
+	st, err := New(rdr, TransformRequest(upper, wrap), MemRequestBodyBytes(4))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("hello"), testutils.Header("Content-Type", "text/plain"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	assert.Equal(t, "<HELLO>", reqBody)
+	assert.EqualValues(t, 7, contentLength)
+	assert.Equal(t, "text/upper", contentType)
+}
+
+func TestTransformRequestErrors(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+
+	failing := func(req *http.Request, body io.Reader) (io.Reader, error) {
+		return nil, fmt.Errorf("invalid JSON")
+	}
+	st, err := New(handler, TransformRequest(failing))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{")))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+
+	// the transformed body is checked against the limits
+	double := func(req *http.Request, body io.Reader) (io.Reader, error) {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(append(data, data...)), nil
+	}
+	st, err = New(handler, TransformRequest(double), MaxRequestBodyBytes(8))
+	require.NoError(t, err)
+
+	rw = httptest.NewRecorder()
+	st.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+
+	_, err = New(handler, TransformRequest(nil))
+	assert.Error(t, err)
+}
+
+func TestInterimResponses(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("hello"))
+	})
+	st, err := New(handler)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	re, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusEarlyHints, re.StatusCode)
+	assert.Equal(t, "</style.css>; rel=preload", re.Header.Get("Link"))
+
+	re, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "", re.Header.Get("Link"))
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
@@ -0,0 +1,160 @@
+package buffer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/multibuf"
+)
+
+// MaxPartSizeError is returned when a part of a multipart/form-data request body is larger than the limit
+type MaxPartSizeError struct {
+	// Name is the form name of the part
+	Name    string
+	MaxSize int64
+}
+
+func (e *MaxPartSizeError) Error() string {
+	return fmt.Sprintf("part %q larger than %d bytes", e.Name, e.MaxSize)
+}
+
+// MultipartError is returned when a multipart/form-data request body is malformed
+type MultipartError struct {
+	Err error
+}
+
+func (e *MultipartError) Error() string {
+	return fmt.Sprintf("malformed multipart body: %v", e.Err)
+}
+
+// MaxPartBytes sets the maximum size in bytes of each part of the multipart/form-data request bodies.
+// The multipart/form-data bodies are parsed as they are buffered once a multipart option is set, and their
+// file parts are written to the disk rather than kept in memory.
+func MaxPartBytes(m int64) optSetter {
+	return func(b *Buffer) error {
+		if m <= 0 {
+			return fmt.Errorf("max part bytes should be > 0 got %d", m)
+		}
+		b.maxPartBytes = m
+		b.multipart = true
+		return nil
+	}
+}
+
+// AllowedPartTypes sets the media types of the file parts of the multipart/form-data request bodies,
+// "image/*" matches all the image types. The file parts of other types are stripped from the body.
+func AllowedPartTypes(types ...string) optSetter {
+	return func(b *Buffer) error {
+		if len(types) == 0 {
+			return fmt.Errorf("provide at least one part type")
+		}
+		b.partTypes = make([]string, len(types))
+		for i, t := range types {
+			b.partTypes[i] = strings.ToLower(t)
+		}
+		b.multipart = true
+		return nil
+	}
+}
+
+// multipartBoundary returns the boundary of the multipart/form-data request bodies, if the buffer parses them
+func (b *Buffer) multipartBoundary(req *http.Request) string {
+	if !b.multipart {
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// readMultipart buffers the multipart/form-data body part by part, enforcing the limits of the parts and
+// stripping the file parts of disallowed types. The body is encoded again with the same boundary, the first parts
+// are kept in memory up to the memory limit and the file parts go to the disk.
+func (b *Buffer) readMultipart(body io.Reader, boundary string, logger utils.Logger) (multibuf.MultiReader, error) {
+	maxBytes, memBytes := b.maxRequestBodyBytes, b.memRequestBodyBytes
+	if maxBytes > 0 && maxBytes < memBytes {
+		memBytes = maxBytes
+	}
+	sw := &spillWriter{memBytes: memBytes, maxBytes: maxBytes, dir: b.tempDir}
+	defer sw.Close()
+
+	mw := multipart.NewWriter(sw)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return nil, &MultipartError{Err: err}
+	}
+
+	mr := multipart.NewReader(body, boundary)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &MultipartError{Err: err}
+		}
+
+		if p.FileName() != "" {
+			if !b.partAllowed(p.Header.Get("Content-Type")) {
+				logger.Debugf("vulcand/oxy/buffer: stripping part %q of type %q", p.FormName(), p.Header.Get("Content-Type"))
+				if _, err := io.Copy(ioutil.Discard, p); err != nil {
+					return nil, &MultipartError{Err: err}
+				}
+				continue
+			}
+			if err := sw.spill(); err != nil {
+				return nil, err
+			}
+		}
+
+		pw, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return nil, err
+		}
+		src := io.Reader(p)
+		if b.maxPartBytes > 0 {
+			src = io.LimitReader(p, b.maxPartBytes+1)
+		}
+		n, err := io.Copy(pw, src)
+		if err != nil {
+			if _, ok := err.(*multibuf.MaxSizeReachedError); ok {
+				return nil, err
+			}
+			return nil, &MultipartError{Err: err}
+		}
+		if b.maxPartBytes > 0 && n > b.maxPartBytes {
+			return nil, &MaxPartSizeError{Name: p.FormName(), MaxSize: b.maxPartBytes}
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return sw.Reader()
+}
+
+// partAllowed tells if the file parts of the content type are kept, the parts without type being binary files
+func (b *Buffer) partAllowed(contentType string) bool {
+	if len(b.partTypes) == 0 {
+		return true
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range b.partTypes {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package buffer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testPart struct {
+	name, filename, contentType, body string
+}
+
+func multipartBody(t *testing.T, parts ...testPart) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, p := range parts {
+		h := make(textproto.MIMEHeader)
+		if p.filename != "" {
+			h.Set("Content-Disposition", `form-data; name="`+p.name+`"; filename="`+p.filename+`"`)
+		} else {
+			h.Set("Content-Disposition", `form-data; name="`+p.name+`"`)
+		}
+		if p.contentType != "" {
+			h.Set("Content-Type", p.contentType)
+		}
+		pw, err := mw.CreatePart(h)
+		require.NoError(t, err)
+		pw.Write([]byte(p.body))
+	}
+	require.NoError(t, mw.Close())
+	return body, mw.FormDataContentType()
+}
+
+func TestMultipartStripsParts(t *testing.T) {
+	var form *multipart.Form
+	var contentLength int64
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentLength = req.ContentLength
+		require.NoError(t, req.ParseMultipartForm(1024))
+		form = req.MultipartForm
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	st, err := New(handler, AllowedPartTypes("image/*"))
+	require.NoError(t, err)
+
+	body, contentType := multipartBody(t,
+		testPart{name: "title", body: "holidays"},
+		testPart{name: "photo", filename: "beach.png", contentType: "image/png", body: "png data"},
+		testPart{name: "script", filename: "evil.sh", contentType: "text/x-sh", body: "rm -rf /"},
+		testPart{name: "blob", filename: "blob", body: "binary"},
+	)
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", contentType)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	assert.Equal(t, []string{"holidays"}, form.Value["title"])
+	require.Len(t, form.File["photo"], 1)
+	assert.Equal(t, "beach.png", form.File["photo"][0].Filename)
+	assert.Empty(t, form.File["script"])
+	assert.Empty(t, form.File["blob"])
+	assert.True(t, contentLength > 0)
+}
+
+func TestMultipartMaxPartBytes(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	st, err := New(handler, MaxPartBytes(8))
+	require.NoError(t, err)
+
+	body, contentType := multipartBody(t,
+		testPart{name: "small", body: "12345678"},
+		testPart{name: "file", filename: "big.txt", body: "123456789"},
+	)
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", contentType)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+
+	// the total limit still applies to the chunked uploads
+	st, err = New(handler, MaxPartBytes(100), MaxRequestBodyBytes(100))
+	require.NoError(t, err)
+
+	body, contentType = multipartBody(t,
+		testPart{name: "a", body: strings.Repeat("a", 60)},
+		testPart{name: "b", body: strings.Repeat("b", 60)},
+	)
+	req = httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = -1
+
+	rw = httptest.NewRecorder()
+	st.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+}
+
+func TestMultipartFilePartsOnDisk(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var files int
+	var received string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		files = len(tempFiles(t, dir))
+		require.NoError(t, req.ParseMultipartForm(1024))
+		f, err := req.MultipartForm.File["upload"][0].Open()
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		received = string(data)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	// the body is way below the memory limit
+	st, err := New(handler, MaxPartBytes(1024), TempDir(dir))
+	require.NoError(t, err)
+
+	body, contentType := multipartBody(t, testPart{name: "upload", filename: "a.txt", contentType: "text/plain", body: "file content"})
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", contentType)
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	assert.Equal(t, 1, files)
+	assert.Equal(t, "file content", received)
+	assert.Empty(t, tempFiles(t, dir))
+}
+
+func TestMultipartMalformed(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+	st, err := New(handler, MaxPartBytes(1024))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nno end"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+
+	rw := httptest.NewRecorder()
+	st.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	// the other bodies are buffered as they are
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("--xyz"))
+	req.Header.Set("Content-Type", "text/plain")
+
+	rw = httptest.NewRecorder()
+	st.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestMultipartOptions(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	_, err := New(handler, MaxPartBytes(0))
+	assert.Error(t, err)
+
+	_, err = New(handler, AllowedPartTypes())
+	assert.Error(t, err)
+}
@@ -5,10 +5,10 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/heebyunglee/oxy/roundrobin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/forward"
-	"github.com/vulcand/oxy/roundrobin"
 	"github.com/vulcand/oxy/testutils"
 )
 
@@ -72,6 +72,80 @@ func TestRetryExceedAttempts(t *testing.T) {
 	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
 }
 
+func TestRetryNextServer(t *testing.T) {
+	broken := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer broken.Close()
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	for _, retryNextServer := range []bool{false, true} {
+		fwd, err := forward.New()
+		require.NoError(t, err)
+
+		lb, err := roundrobin.New(fwd)
+		require.NoError(t, err)
+
+		// the load balancer picks the broken server twice in a row
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(broken.URL), roundrobin.Weight(2)))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(srv.URL), roundrobin.Weight(1)))
+
+		st, err := New(lb, Retry(`IsNetworkError() && Attempts() <= 1`), CondSetter(retryNextServer, RetryNextServer()))
+		require.NoError(t, err)
+
+		proxy := httptest.NewServer(st)
+
+		re, _, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		if retryNextServer {
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+		}
+		proxy.Close()
+	}
+}
+
+func TestRetryNextServerSticky(t *testing.T) {
+	broken := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer broken.Close()
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := roundrobin.New(fwd, roundrobin.EnableStickySession(roundrobin.NewStickySession("test")))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(broken.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(srv.URL)))
+
+	st, err := New(lb, Retry(`IsNetworkError() && Attempts() <= 1`), RetryNextServer())
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "test", Value: broken.URL})
+
+	re, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	re.Body.Close()
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+}
+
 func newBufferMiddleware(t *testing.T, p string) (*roundrobin.RoundRobin, *Buffer) {
 	// forwarder will proxy the request to whatever destination
 	fwd, err := forward.New()
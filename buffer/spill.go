@@ -0,0 +1,218 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mailgun/multibuf"
+)
+
+const tempFilePrefix = "oxy-buffer-"
+
+// spillReader is a multibuf.MultiReader keeping the beginning of a body in memory and the rest in a temporary file.
+// The file is removed when the reader is closed.
+type spillReader struct {
+	size int64
+	mem  *bytes.Reader
+	file *os.File
+	r    io.Reader
+}
+
+// newSpillReader reads the input up to memBytes in memory and the rest in a temporary file created in dir,
+// the system temporary directory if dir is empty. It returns a *multibuf.MaxSizeReachedError if the input
+// is larger than maxBytes, negative maxBytes meaning no limit.
+func newSpillReader(input io.Reader, memBytes, maxBytes int64, dir string) (multibuf.MultiReader, error) {
+	if maxBytes > 0 && maxBytes < memBytes {
+		memBytes = maxBytes
+	}
+
+	lr := &io.LimitedReader{R: input, N: memBytes}
+	mem, err := ioutil.ReadAll(lr)
+	if err != nil {
+		return nil, err
+	}
+	sr := &spillReader{size: int64(len(mem)), mem: bytes.NewReader(mem)}
+	if lr.N > 0 {
+		sr.r = io.MultiReader(sr.mem)
+		return sr, nil
+	}
+
+	// the memory is full, the rest of the body goes to the disk
+	file, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return nil, err
+	}
+	sr.file = file
+
+	src := input
+	if maxBytes > 0 {
+		src = io.LimitReader(input, maxBytes-sr.size+1)
+	}
+	written, err := io.Copy(file, src)
+	if err == nil && maxBytes > 0 && sr.size+written > maxBytes {
+		err = &multibuf.MaxSizeReachedError{MaxSize: maxBytes}
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sr.Close()
+		return nil, err
+	}
+	sr.size += written
+	sr.r = io.MultiReader(sr.mem, file)
+	return sr, nil
+}
+
+func (sr *spillReader) Read(p []byte) (int, error) {
+	return sr.r.Read(p)
+}
+
+// WriteTo implements io.WriterTo so that io.Copy does not allocate an intermediate buffer
+func (sr *spillReader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, sr.r)
+}
+
+// Seek only supports rewinding the reader to its beginning
+func (sr *spillReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, fmt.Errorf("spillReader: only seeking to the start is supported")
+	}
+	if _, err := sr.mem.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if sr.file == nil {
+		sr.r = io.MultiReader(sr.mem)
+		return 0, nil
+	}
+	if _, err := sr.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	sr.r = io.MultiReader(sr.mem, sr.file)
+	return 0, nil
+}
+
+// Size returns the total size of the body, not the length remaining
+func (sr *spillReader) Size() (int64, error) {
+	return sr.size, nil
+}
+
+// Close removes the temporary file, if any
+func (sr *spillReader) Close() error {
+	if sr.file == nil {
+		return nil
+	}
+	err := removeTempFile(sr.file)
+	sr.file = nil
+	return err
+}
+
+// spillWriter is a multibuf.WriterOnce keeping up to memBytes in memory and writing the rest to a temporary file.
+// The file belongs to the reader once Reader is called, it is removed on Close otherwise.
+type spillWriter struct {
+	memBytes int64
+	maxBytes int64
+	dir      string
+
+	mem     bytes.Buffer
+	file    *os.File
+	size    int64
+	written bool
+	read    bool
+}
+
+func newSpillWriter(memBytes, maxBytes int64, dir string) multibuf.WriterOnce {
+	return &spillWriter{memBytes: memBytes, maxBytes: maxBytes, dir: dir}
+}
+
+func (sw *spillWriter) Write(p []byte) (int, error) {
+	if sw.read {
+		return 0, fmt.Errorf("can not write after reader has been called")
+	}
+	if sw.maxBytes > 0 && sw.size+int64(len(p)) > sw.maxBytes {
+		return 0, &multibuf.MaxSizeReachedError{MaxSize: sw.maxBytes}
+	}
+	sw.written = true
+
+	toMem := len(p)
+	if left := sw.memBytes - int64(sw.mem.Len()); int64(toMem) > left {
+		toMem = int(left)
+	}
+	if sw.file == nil && toMem > 0 {
+		sw.mem.Write(p[:toMem])
+		sw.size += int64(toMem)
+		if toMem == len(p) {
+			return toMem, nil
+		}
+	} else {
+		toMem = 0
+	}
+
+	if sw.file == nil {
+		file, err := ioutil.TempFile(sw.dir, tempFilePrefix)
+		if err != nil {
+			return toMem, err
+		}
+		sw.file = file
+	}
+	n, err := sw.file.Write(p[toMem:])
+	sw.size += int64(n)
+	return toMem + n, err
+}
+
+// spill sends the next writes to the temporary file, whatever the memory left
+func (sw *spillWriter) spill() error {
+	if sw.file != nil {
+		return nil
+	}
+	file, err := ioutil.TempFile(sw.dir, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	sw.file = file
+	return nil
+}
+
+func (sw *spillWriter) Reader() (multibuf.MultiReader, error) {
+	if sw.read {
+		return nil, fmt.Errorf("reader has been called")
+	}
+	if !sw.written {
+		return nil, fmt.Errorf("no data ready")
+	}
+	sw.read = true
+
+	sr := &spillReader{size: sw.size, mem: bytes.NewReader(sw.mem.Bytes()), file: sw.file}
+	sw.file = nil
+	if sr.file == nil {
+		sr.r = io.MultiReader(sr.mem)
+		return sr, nil
+	}
+	if _, err := sr.file.Seek(0, io.SeekStart); err != nil {
+		sr.Close()
+		return nil, err
+	}
+	sr.r = io.MultiReader(sr.mem, sr.file)
+	return sr, nil
+}
+
+// Close removes the temporary file if the reader has not been called
+func (sw *spillWriter) Close() error {
+	if sw.file == nil {
+		return nil
+	}
+	err := removeTempFile(sw.file)
+	sw.file = nil
+	return err
+}
+
+func removeTempFile(file *os.File) error {
+	errClose := file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	return errClose
+}
@@ -0,0 +1,124 @@
+package buffer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mailgun/multibuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillReaderMemory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	r, err := newSpillReader(strings.NewReader("hello"), 10, -1, dir)
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.Empty(t, tempFiles(t, dir))
+	assertContent(t, r, "hello")
+}
+
+func TestSpillReaderDisk(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	r, err := newSpillReader(strings.NewReader("hello, world"), 4, -1, dir)
+	require.NoError(t, err)
+
+	assert.Len(t, tempFiles(t, dir), 1)
+	assertContent(t, r, "hello, world")
+
+	// the body can be replayed
+	_, err = r.Seek(0, 0)
+	require.NoError(t, err)
+	assertContent(t, r, "hello, world")
+
+	require.NoError(t, r.Close())
+	assert.Empty(t, tempFiles(t, dir))
+}
+
+func TestSpillReaderMaxBytes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := newSpillReader(strings.NewReader("hello, world"), 4, 8, dir)
+	require.Error(t, err)
+	assert.IsType(t, &multibuf.MaxSizeReachedError{}, err)
+	assert.Empty(t, tempFiles(t, dir))
+
+	r, err := newSpillReader(strings.NewReader("hello, w"), 4, 8, dir)
+	require.NoError(t, err)
+	defer r.Close()
+	assertContent(t, r, "hello, w")
+}
+
+func TestSpillWriterDisk(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := newSpillWriter(4, -1, dir)
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte(", world"))
+	require.NoError(t, err)
+	assert.Len(t, tempFiles(t, dir), 1)
+
+	r, err := w.Reader()
+	require.NoError(t, err)
+	assertContent(t, r, "hello, world")
+
+	// the file belongs to the reader
+	require.NoError(t, w.Close())
+	assert.Len(t, tempFiles(t, dir), 1)
+	require.NoError(t, r.Close())
+	assert.Empty(t, tempFiles(t, dir))
+}
+
+func TestSpillWriterCloseRemovesFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := newSpillWriter(4, -1, dir)
+	_, err := w.Write([]byte("hello, world"))
+	require.NoError(t, err)
+	assert.Len(t, tempFiles(t, dir), 1)
+
+	require.NoError(t, w.Close())
+	assert.Empty(t, tempFiles(t, dir))
+}
+
+func TestSpillWriterMaxBytes(t *testing.T) {
+	w := newSpillWriter(4, 8, "")
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte(", world"))
+	assert.IsType(t, &multibuf.MaxSizeReachedError{}, err)
+	require.NoError(t, w.Close())
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "oxy-buffer-test-")
+	require.NoError(t, err)
+	return dir
+}
+
+func tempFiles(t *testing.T, dir string) []os.FileInfo {
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	return files
+}
+
+func assertContent(t *testing.T, r multibuf.MultiReader, expected string) {
+	size, err := r.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(expected)), size)
+
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(out))
+}
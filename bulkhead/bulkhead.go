@@ -0,0 +1,284 @@
+/*
+Package bulkhead isolates the requests of the routes or the backends in independent concurrency pools, so that a slow
+dependency holding its requests can not take all the capacity of the proxy from the others.
+
+The requests are assigned to a pool by a key, e.g. the name of the route they matched with "request.route" or the
+backend a load balancer picked for them with "request.backend" (see utils.NewExtractor). Every pool serves up to its
+maximum number of requests at a time, and can queue a bounded number of requests for a while once it is full.
+
+Examples of a bulkhead:
+
+	key, _ := utils.NewExtractor("request.route")
+	bh, _ := bulkhead.New(next, key,
+		bulkhead.Pool("payments", bulkhead.PoolConfig{MaxConcurrent: 20, QueueDepth: 10, QueueTimeout: time.Second}),
+		bulkhead.Pool("search", bulkhead.PoolConfig{MaxConcurrent: 50}),
+		bulkhead.DefaultPool(bulkhead.PoolConfig{MaxConcurrent: 100}),
+	)
+*/
+package bulkhead
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// PoolConfig is the size of a concurrency pool
+type PoolConfig struct {
+	// MaxConcurrent is the number of requests the pool serves at a time
+	MaxConcurrent int
+	// QueueDepth is the number of requests waiting for the pool once it is full, 0 rejects them right away
+	QueueDepth int
+	// QueueTimeout is how long a queued request waits before being rejected
+	QueueTimeout time.Duration
+}
+
+func (c PoolConfig) validate() error {
+	if c.MaxConcurrent < 1 {
+		return fmt.Errorf("max concurrent requests should be >= 1, got %d", c.MaxConcurrent)
+	}
+	if c.QueueDepth < 0 {
+		return fmt.Errorf("queue depth should be >= 0, got %d", c.QueueDepth)
+	}
+	if c.QueueDepth > 0 && c.QueueTimeout <= 0 {
+		return fmt.Errorf("queue timeout should be > 0, got %v", c.QueueTimeout)
+	}
+	return nil
+}
+
+// pool is a semaphore with a bounded queue of the requests waiting for a slot to be released
+type pool struct {
+	name   string
+	config PoolConfig
+	slots  chan struct{}
+	queued int
+}
+
+func newPool(name string, config PoolConfig) *pool {
+	return &pool{name: name, config: config, slots: make(chan struct{}, config.MaxConcurrent)}
+}
+
+// Bulkhead is an http.Handler limiting the concurrent requests of every pool
+type Bulkhead struct {
+	mutex       *sync.Mutex
+	next        http.Handler
+	extract     utils.SourceExtractor
+	pools       map[string]*pool
+	defaultPool *pool
+
+	errHandler utils.ErrorHandler
+	inflight   utils.Inflight
+	log        *log.Logger
+}
+
+// New creates a new Bulkhead, extract provides the key of the pool of the requests.
+// The requests of the keys with no pool are served without limit unless a DefaultPool is set.
+func New(next http.Handler, extract utils.SourceExtractor, options ...Option) (*Bulkhead, error) {
+	if extract == nil {
+		return nil, fmt.Errorf("extract function can not be nil")
+	}
+	b := &Bulkhead{
+		mutex:   &sync.Mutex{},
+		next:    next,
+		extract: extract,
+		pools:   make(map[string]*pool),
+		log:     log.StandardLogger(),
+	}
+	for _, o := range options {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	if b.errHandler == nil {
+		b.errHandler = &ErrHandler{}
+	}
+	return b, nil
+}
+
+// Option is a functional option of the bulkhead
+type Option func(b *Bulkhead) error
+
+// Pool allocates a pool to the requests of the key
+func Pool(key string, config PoolConfig) Option {
+	return func(b *Bulkhead) error {
+		if err := config.validate(); err != nil {
+			return fmt.Errorf("pool %q: %v", key, err)
+		}
+		b.pools[key] = newPool(key, config)
+		return nil
+	}
+}
+
+// DefaultPool allocates a pool shared by the requests of all the keys with no pool of their own
+func DefaultPool(config PoolConfig) Option {
+	return func(b *Bulkhead) error {
+		if err := config.validate(); err != nil {
+			return fmt.Errorf("default pool: %v", err)
+		}
+		b.defaultPool = newPool("default", config)
+		return nil
+	}
+}
+
+// ErrorHandler sets the error handler of the requests rejected by a full pool
+func ErrorHandler(h utils.ErrorHandler) Option {
+	return func(b *Bulkhead) error {
+		b.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the bulkhead will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(b *Bulkhead) error {
+		b.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by the bulkhead.
+func (b *Bulkhead) Wrap(h http.Handler) {
+	b.next = h
+}
+
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete, the queued ones included. It returns the error of the context if it is done first.
+func (b *Bulkhead) Shutdown(ctx context.Context) error {
+	return b.inflight.Shutdown(ctx)
+}
+
+// PoolUsage is the usage of a pool at a point in time
+type PoolUsage struct {
+	Active        int `json:"active"`
+	Queued        int `json:"queued"`
+	MaxConcurrent int `json:"maxConcurrent"`
+}
+
+// Usage returns the usage of every pool, the default pool under the empty key
+func (b *Bulkhead) Usage() map[string]PoolUsage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	out := make(map[string]PoolUsage, len(b.pools)+1)
+	for key, p := range b.pools {
+		out[key] = p.usage()
+	}
+	if b.defaultPool != nil {
+		out[""] = b.defaultPool.usage()
+	}
+	return out
+}
+
+func (p *pool) usage() PoolUsage {
+	return PoolUsage{Active: len(p.slots), Queued: p.queued, MaxConcurrent: p.config.MaxConcurrent}
+}
+
+func (b *Bulkhead) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !b.inflight.Acquire() {
+		b.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer b.inflight.Release()
+
+	key, _, err := b.extract.Extract(req)
+	if err != nil {
+		b.log.Errorf("vulcand/oxy/bulkhead: failed to extract the pool key: %v", err)
+		b.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	p := b.pool(key)
+	if p == nil {
+		b.next.ServeHTTP(w, req)
+		return
+	}
+
+	if err := b.acquire(req, p); err != nil {
+		b.log.Debugf("vulcand/oxy/bulkhead: rejecting request of %q: %v", key, err)
+		b.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer func() { <-p.slots }()
+
+	b.next.ServeHTTP(w, req)
+}
+
+func (b *Bulkhead) pool(key string) *pool {
+	if p, ok := b.pools[key]; ok {
+		return p
+	}
+	return b.defaultPool
+}
+
+// acquire takes a slot of the pool, queueing the request if the pool is full and its queue has room
+func (b *Bulkhead) acquire(req *http.Request, p *pool) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	full := &PoolFullError{Pool: p.name, Max: p.config.MaxConcurrent}
+	if !b.enqueue(p) {
+		return full
+	}
+	defer b.dequeue(p)
+
+	timer := time.NewTimer(p.config.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return full
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (b *Bulkhead) enqueue(p *pool) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if p.queued >= p.config.QueueDepth {
+		return false
+	}
+	p.queued++
+	return true
+}
+
+func (b *Bulkhead) dequeue(p *pool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	p.queued--
+}
+
+// PoolFullError is the error of the requests rejected by a full pool
+type PoolFullError struct {
+	Pool string
+	Max  int
+}
+
+func (e *PoolFullError) Error() string {
+	return fmt.Sprintf("pool %q is full: %d concurrent requests", e.Pool, e.Max)
+}
+
+// ErrHandler is the default error handler of the bulkhead, it answers the requests rejected by a full pool with 503
+type ErrHandler struct{}
+
+func (e *ErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if _, ok := err.(*PoolFullError); ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
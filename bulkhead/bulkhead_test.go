@@ -0,0 +1,171 @@
+package bulkhead
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// blockingHandler holds the requests of the paths starting with /slow until it is released
+type blockingHandler struct {
+	release chan struct{}
+	started chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{release: make(chan struct{}), started: make(chan struct{}, 100)}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/slow" {
+		h.started <- struct{}{}
+		<-h.release
+	}
+	w.Write([]byte("hello"))
+}
+
+func newBulkhead(t *testing.T, next http.Handler, options ...Option) *Bulkhead {
+	key, err := utils.NewExtractor("request.path")
+	require.NoError(t, err)
+
+	b, err := New(next, key, options...)
+	require.NoError(t, err)
+	return b
+}
+
+func TestPoolIsolation(t *testing.T) {
+	h := newBlockingHandler()
+	b := newBulkhead(t, h,
+		Pool("/slow", PoolConfig{MaxConcurrent: 2}),
+		Pool("/fast", PoolConfig{MaxConcurrent: 2}))
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			re, _, err := testutils.Get(srv.URL + "/slow")
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+		}()
+	}
+	<-h.started
+	<-h.started
+
+	// the slow pool is full while the other pools and the requests with no pool are served
+	re, body, err := testutils.Get(srv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Contains(t, string(body), `pool "/slow" is full`)
+
+	re, _, err = testutils.Get(srv.URL + "/fast")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL + "/other")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	assert.Equal(t, PoolUsage{Active: 2, MaxConcurrent: 2}, b.Usage()["/slow"])
+
+	close(h.release)
+	wg.Wait()
+	assert.Equal(t, PoolUsage{MaxConcurrent: 2}, b.Usage()["/slow"])
+}
+
+func TestPoolQueue(t *testing.T) {
+	h := newBlockingHandler()
+	b := newBulkhead(t, h, Pool("/slow", PoolConfig{MaxConcurrent: 1, QueueDepth: 1, QueueTimeout: time.Minute}))
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			re, _, err := testutils.Get(srv.URL + "/slow")
+			require.NoError(t, err)
+			codes <- re.StatusCode
+		}()
+	}
+	<-h.started
+	for b.Usage()["/slow"].Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is full
+	re, _, err := testutils.Get(srv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	// the queued request is served once the slot is released
+	close(h.release)
+	assert.Equal(t, http.StatusOK, <-codes)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestPoolQueueTimeout(t *testing.T) {
+	h := newBlockingHandler()
+	b := newBulkhead(t, h, Pool("/slow", PoolConfig{MaxConcurrent: 1, QueueDepth: 1, QueueTimeout: 10 * time.Millisecond}))
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	defer close(h.release)
+
+	go testutils.Get(srv.URL + "/slow")
+	<-h.started
+
+	re, _, err := testutils.Get(srv.URL + "/slow")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 0, b.Usage()["/slow"].Queued)
+}
+
+func TestDefaultPool(t *testing.T) {
+	h := newBlockingHandler()
+	b := newBulkhead(t, h, DefaultPool(PoolConfig{MaxConcurrent: 1}))
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	go testutils.Get(srv.URL + "/slow")
+	<-h.started
+
+	// the keys with no pool share the default one
+	re, _, err := testutils.Get(srv.URL + "/other")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 1, b.Usage()[""].Active)
+
+	close(h.release)
+}
+
+func TestInvalidPools(t *testing.T) {
+	key, err := utils.NewExtractor("request.path")
+	require.NoError(t, err)
+
+	_, err = New(nil, nil)
+	assert.Error(t, err)
+
+	for _, config := range []PoolConfig{
+		{},
+		{MaxConcurrent: 1, QueueDepth: -1},
+		{MaxConcurrent: 1, QueueDepth: 1},
+	} {
+		_, err = New(nil, key, Pool("a", config))
+		assert.Error(t, err, "%+v", config)
+
+		_, err = New(nil, key, DefaultPool(config))
+		assert.Error(t, err, "%+v", config)
+	}
+}
@@ -0,0 +1,671 @@
+/*
+Package cache provides http.Handler middleware caching the responses in memory, as a shared cache.
+
+The responses to GET requests are stored according to their Cache-Control, Expires and Vary headers,
+the responses carrying cookies or marked private or no-store are never stored. The fresh responses are served
+without calling the next handler, HEAD requests included, and the stale ones are revalidated with conditional
+requests when they have an ETag or a Last-Modified header. Within the stale-while-revalidate window of a response,
+the stale response is served at once while it is revalidated in the background. With StaleIfError, the stale
+responses stand in for the failures of the backends and for the fallback of a tripped circuit breaker.
+
+The unsafe requests, e.g. POST or DELETE, invalidate the responses stored for their URL. The least recently used
+responses are evicted when the cache is full.
+
+Examples of a caching middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=30")
+	  w.Write([]byte("hello"))
+	})
+
+	// Cache up to 256MB of responses of 4MB at most, for an hour at most
+	cache.New(handler, cache.MaxSize(256<<20), cache.MaxEntrySize(4<<20), cache.MaxTTL(time.Hour))
+
+	// Serve the pages up to a day old while the backend is down
+	cb, _ := cbreaker.New(handler, "NetworkErrorRatio() > 0.5")
+	cache.New(cb, cache.StaleIfError(24*time.Hour, "text/html"), cache.CircuitBreaker(cb))
+*/
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heebyunglee/oxy/cbreaker"
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxSize is the default maximum size of the cache, in bytes
+	DefaultMaxSize = 64 << 20
+	// DefaultMaxEntrySize is the default maximum size of a stored response, in bytes
+	DefaultMaxEntrySize = 1 << 20
+
+	// XCache is the header telling the clients how the response was served:
+	// HIT, STALE, REVALIDATED or MISS
+	XCache = "X-Cache"
+
+	// WarningStale is the warning added to the stale responses
+	WarningStale = `110 - "Response is Stale"`
+	// WarningRevalidationFailed is the warning added to the stale responses served because the backend failed
+	WarningRevalidationFailed = `111 - "Revalidation Failed"`
+)
+
+// Cache serves the responses of the next handler from memory
+type Cache struct {
+	next  http.Handler
+	store *store
+
+	maxSize              int64
+	maxEntrySize         int64
+	defaultTTL           time.Duration
+	maxTTL               time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	staleContentTypes    []string
+	breaker              *cbreaker.CircuitBreaker
+	clock                timetools.TimeProvider
+
+	log *log.Logger
+}
+
+// New returns a new caching middleware.
+// New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*Cache, error) {
+	c := &Cache{
+		next:         next,
+		maxSize:      DefaultMaxSize,
+		maxEntrySize: DefaultMaxEntrySize,
+		clock:        &timetools.RealTime{},
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.maxEntrySize > c.maxSize {
+		return nil, fmt.Errorf("maximum size of the entries %v is larger than the maximum size of the cache %v", c.maxEntrySize, c.maxSize)
+	}
+	c.store = newStore(c.maxSize)
+	return c, nil
+}
+
+type optSetter func(c *Cache) error
+
+// MaxSize sets the maximum size of the stored responses, bodies and headers, defaults to DefaultMaxSize.
+// The least recently used responses are evicted beyond it.
+func MaxSize(bytes int64) optSetter {
+	return func(c *Cache) error {
+		if bytes <= 0 {
+			return fmt.Errorf("maximum size should be positive: %v", bytes)
+		}
+		c.maxSize = bytes
+		return nil
+	}
+}
+
+// MaxEntrySize sets the maximum size of the body of a stored response, defaults to DefaultMaxEntrySize.
+// The larger responses are streamed to the clients without being stored.
+func MaxEntrySize(bytes int64) optSetter {
+	return func(c *Cache) error {
+		if bytes <= 0 {
+			return fmt.Errorf("maximum entry size should be positive: %v", bytes)
+		}
+		c.maxEntrySize = bytes
+		return nil
+	}
+}
+
+// DefaultTTL sets how long the responses without Cache-Control max-age or Expires header are fresh.
+// Defaults to 0: such responses are stored only if they can be revalidated.
+func DefaultTTL(ttl time.Duration) optSetter {
+	return func(c *Cache) error {
+		if ttl < 0 {
+			return fmt.Errorf("default TTL can not be negative: %v", ttl)
+		}
+		c.defaultTTL = ttl
+		return nil
+	}
+}
+
+// MaxTTL caps how long the responses are fresh, regardless of their headers. Defaults to 0, no cap.
+func MaxTTL(ttl time.Duration) optSetter {
+	return func(c *Cache) error {
+		if ttl < 0 {
+			return fmt.Errorf("maximum TTL can not be negative: %v", ttl)
+		}
+		c.maxTTL = ttl
+		return nil
+	}
+}
+
+// StaleWhileRevalidate sets how long the stale responses without a stale-while-revalidate directive
+// are served while being revalidated in the background. Defaults to 0.
+func StaleWhileRevalidate(d time.Duration) optSetter {
+	return func(c *Cache) error {
+		if d < 0 {
+			return fmt.Errorf("stale while revalidate can not be negative: %v", d)
+		}
+		c.staleWhileRevalidate = d
+		return nil
+	}
+}
+
+// StaleIfError serves the stale responses, up to maxStale after they expired, when the next handler fails with
+// a 500, 502, 503 or 504 status code, or when the circuit breaker is tripped, see CircuitBreaker.
+// The stale-if-error directive of the responses overrides maxStale. When content types are given, e.g. "text/*",
+// only the responses of these types are served stale. The responses are annotated with Warning headers.
+func StaleIfError(maxStale time.Duration, contentTypes ...string) optSetter {
+	return func(c *Cache) error {
+		if maxStale < 0 {
+			return fmt.Errorf("maximum staleness can not be negative: %v", maxStale)
+		}
+		c.staleIfError = maxStale
+		c.staleContentTypes = make([]string, len(contentTypes))
+		for i, t := range contentTypes {
+			c.staleContentTypes[i] = strings.ToLower(t)
+		}
+		return nil
+	}
+}
+
+// CircuitBreaker sets the circuit breaker protecting the next handler: while it is tripped, the stale responses
+// allowed by StaleIfError are served without calling the next handler, instead of its fallback response.
+func CircuitBreaker(cb *cbreaker.CircuitBreaker) optSetter {
+	return func(c *Cache) error {
+		c.breaker = cb
+		return nil
+	}
+}
+
+// Clock sets the clock expiring the responses
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(c *Cache) error {
+		c.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the cache will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(c *Cache) error {
+		c.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by cache handler.
+func (c *Cache) Wrap(next http.Handler) {
+	c.next = next
+}
+
+// Len returns the number of stored responses
+func (c *Cache) Len() int {
+	n, _ := c.store.stats()
+	return n
+}
+
+// Size returns the size of the stored responses, in bytes
+func (c *Cache) Size() int64 {
+	_, size := c.store.stats()
+	return size
+}
+
+// Purge removes all the stored responses
+func (c *Cache) Purge() {
+	c.store.purge()
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/cache: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/cache: completed ServeHttp on request")
+	}
+
+	primary := primaryKey(req)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		if req.Method != http.MethodOptions && req.Method != http.MethodTrace {
+			c.store.invalidate(primary)
+		}
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	cc := parseCacheControl(req.Header["Cache-Control"])
+	if cc.has("no-store") {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	var e, stale *entry
+	if maxAge, ok := cc.duration("max-age"); !cc.has("no-cache") && (!ok || maxAge > 0) {
+		e = c.store.get(primary, req)
+	}
+	if e != nil {
+		now := c.clock.UtcNow()
+		if now.Before(e.expires) {
+			c.serve(w, req, e, now, "HIT")
+			return
+		}
+		if now.Before(e.staleUntil) {
+			if c.store.startRevalidation(e) {
+				// the request outlives the client's one, detach it
+				outReq := conditionalRequest(req.WithContext(context.Background()), e)
+				outReq.URL = utils.CopyURL(req.URL)
+				outReq.Body = http.NoBody
+				outReq.ContentLength = 0
+				go c.revalidate(outReq, e)
+			}
+			c.serve(w, req, e, now, "STALE", WarningStale)
+			return
+		}
+		if now.Before(e.staleIfErrorUntil) {
+			stale = e
+			if c.breaker != nil && c.breaker.State() == cbreaker.StateTripped {
+				c.log.Debugf("vulcand/oxy/cache: circuit breaker tripped, serving stale Request(%v %v)", req.Method, req.URL)
+				c.serve(w, req, stale, now, "STALE", WarningStale, WarningRevalidationFailed)
+				return
+			}
+		}
+		if !e.hasValidators() {
+			e = nil
+		}
+	}
+
+	outReq := req
+	if e != nil {
+		outReq = conditionalRequest(req, e)
+	}
+	cw := &cacheWriter{ResponseWriter: w, c: c, req: req, revalidating: e != nil, stale: stale}
+	c.next.ServeHTTP(cw, outReq)
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	now := c.clock.UtcNow()
+	if cw.failed {
+		c.log.Debugf("vulcand/oxy/cache: backend failed with %v, serving stale Request(%v %v)", cw.status, req.Method, req.URL)
+		c.serve(w, req, stale, now, "STALE", WarningStale, WarningRevalidationFailed)
+		return
+	}
+	if cw.notModified {
+		if refreshed := c.refresh(req, e, cw.header, now); refreshed != nil {
+			c.store.put(refreshed)
+			e = refreshed
+		} else {
+			c.store.remove(e)
+		}
+		c.serve(w, req, e, now, "REVALIDATED")
+		return
+	}
+	if cw.buffering {
+		if stored := c.newEntry(req, cw.status, cw.header, cw.body.Bytes(), now); stored != nil {
+			c.store.put(stored)
+		}
+	}
+}
+
+// serve answers the request with the stored response
+func (c *Cache) serve(w http.ResponseWriter, req *http.Request, e *entry, now time.Time, status string, warnings ...string) {
+	h := w.Header()
+	for k, vv := range e.header {
+		h[k] = append([]string(nil), vv...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(now.Sub(e.date)/time.Second), 10))
+	h.Set(XCache, status)
+	for _, warning := range warnings {
+		h.Add("Warning", warning)
+	}
+
+	if notModified(req, e) {
+		utils.RemoveHeaders(h, "Content-Length", "Content-Type", "Content-Encoding")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	if req.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// revalidate refreshes the stale entry in the background while it is served, with the conditional request
+func (c *Cache) revalidate(req *http.Request, e *entry) {
+	defer c.store.endRevalidation(e)
+	defer func() {
+		if err := recover(); err != nil {
+			c.log.Errorf("vulcand/oxy/cache: panic while revalidating %v: %v", e.primary, err)
+		}
+	}()
+
+	rec := &recorder{header: make(http.Header), maxSize: c.maxEntrySize}
+	c.next.ServeHTTP(rec, req)
+
+	now := c.clock.UtcNow()
+	var refreshed *entry
+	if rec.status == http.StatusNotModified {
+		refreshed = c.refresh(req, e, rec.header, now)
+	} else if serverError(rec.statusCode()) && now.Before(e.staleIfErrorUntil) {
+		// keep serving the stale response until the backend recovers
+		return
+	} else if !rec.overflow && req.Method == http.MethodGet {
+		refreshed = c.newEntry(req, rec.statusCode(), storedHeader(rec.header), rec.body.Bytes(), now)
+	}
+	if refreshed == nil {
+		c.store.remove(e)
+		return
+	}
+	c.store.put(refreshed)
+}
+
+// refresh returns the entry updated with the headers of the 304 Not Modified response, nil if it can not be stored
+func (c *Cache) refresh(req *http.Request, e *entry, header http.Header, now time.Time) *entry {
+	merged := make(http.Header, len(e.header))
+	utils.CopyHeaders(merged, e.header)
+	for k, vv := range header {
+		switch k {
+		case "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding":
+		default:
+			merged[k] = vv
+		}
+	}
+	return c.newEntry(req, e.status, storedHeader(merged), e.body, now)
+}
+
+// newEntry returns the entry storing the response to the request, nil if it can not be stored
+func (c *Cache) newEntry(req *http.Request, status int, header http.Header, body []byte, now time.Time) *entry {
+	if int64(len(body)) > c.maxEntrySize {
+		return nil
+	}
+	cc := parseCacheControl(header["Cache-Control"])
+	if !storable(req, status, header, cc) {
+		return nil
+	}
+
+	ttl := freshnessLifetime(header, cc, now, c.defaultTTL)
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	e := &entry{
+		primary: primaryKey(req),
+		vary:    parseVary(header),
+		status:  status,
+		header:  header,
+		body:    body,
+		date:    now.Add(-age(header)),
+	}
+	e.key = variantKey(e.primary, e.vary, req)
+	e.expires = e.date.Add(ttl)
+	if !e.expires.After(now) && !e.hasValidators() {
+		return nil
+	}
+
+	e.staleUntil = e.expires
+	if !cc.has("no-cache") && !cc.has("must-revalidate") && !cc.has("proxy-revalidate") {
+		swr, ok := cc.duration("stale-while-revalidate")
+		if !ok {
+			swr = c.staleWhileRevalidate
+		}
+		e.staleUntil = e.expires.Add(swr)
+
+		sie, ok := cc.duration("stale-if-error")
+		if !ok {
+			sie = c.staleIfError
+		}
+		if c.staleAllowed(header.Get("Content-Type")) {
+			e.staleIfErrorUntil = e.expires.Add(sie)
+		}
+	}
+	return e
+}
+
+// staleAllowed tells if the responses of the content type can be served stale when the backend fails
+func (c *Cache) staleAllowed(contentType string) bool {
+	if len(c.staleContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.staleContentTypes {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverError tells if the status code is a failure of the backend the stale responses can stand in for
+func serverError(code int) bool {
+	switch code {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// primaryKey returns the key of the responses to the URL of the request, HEAD requests share it with GET
+func primaryKey(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+// conditionalRequest returns a copy of the request validating the stored response
+func conditionalRequest(req *http.Request, e *entry) *http.Request {
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+	utils.RemoveHeaders(outReq.Header, "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range")
+	if etag := e.header.Get("Etag"); etag != "" {
+		outReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.header.Get("Last-Modified"); lastModified != "" {
+		outReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return outReq
+}
+
+// notModified tells if the conditional request of the client matches the stored response
+func notModified(req *http.Request, e *entry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := e.header.Get("Etag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range splitTags(inm) {
+			if candidate == "*" || weakTag(candidate) == weakTag(etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(e.header.Get("Last-Modified"))
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+func splitTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// weakTag strips the weak indicator, If-None-Match uses the weak comparison
+func weakTag(tag string) string {
+	return strings.TrimPrefix(tag, "W/")
+}
+
+// storedHeader returns a copy of the header of the response without the hop-by-hop headers
+func storedHeader(h http.Header) http.Header {
+	stored := make(http.Header, len(h))
+	utils.CopyHeaders(stored, h)
+	utils.RemoveHeaders(stored, forward.HopHeaders...)
+	utils.RemoveHeaders(stored, XCache)
+	return stored
+}
+
+// cacheWriter sends the response to the client, keeping a copy of the body when the response may be stored
+type cacheWriter struct {
+	http.ResponseWriter
+	c            *Cache
+	req          *http.Request
+	revalidating bool
+	// stale is served instead of the failures of the next handler
+	stale *entry
+
+	wroteHeader bool
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	buffering   bool
+	notModified bool
+	failed      bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	if code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+	cw.header = storedHeader(cw.Header())
+
+	if cw.revalidating && code == http.StatusNotModified {
+		// the stored response is served instead
+		cw.notModified = true
+	}
+	if cw.stale != nil && serverError(code) {
+		cw.failed = true
+	}
+	if cw.notModified || cw.failed {
+		for k := range cw.Header() {
+			delete(cw.Header(), k)
+		}
+		return
+	}
+	cw.buffering = cw.req.Method == http.MethodGet && cacheableStatus[code]
+	cw.Header().Set(XCache, "MISS")
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified || cw.failed {
+		return len(b), nil
+	}
+	if cw.buffering {
+		if int64(cw.body.Len()+len(b)) > cw.c.maxEntrySize {
+			cw.buffering = false
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified || cw.failed {
+		return
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true) when the client connection has gone away
+func (cw *cacheWriter) CloseNotify() <-chan bool {
+	if cn, ok := cw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (cw *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		cw.buffering = false
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", cw.ResponseWriter)
+}
+
+// recorder records the responses of the background revalidations
+type recorder struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	maxSize  int64
+	overflow bool
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.status == 0 && code >= http.StatusOK {
+		r.status = code
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.overflow {
+		return len(b), nil
+	}
+	if int64(r.body.Len()+len(b)) > r.maxSize {
+		r.overflow = true
+		r.body = bytes.Buffer{}
+		return len(b), nil
+	}
+	return r.body.Write(b)
+}
+
+func (r *recorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
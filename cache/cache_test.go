@@ -0,0 +1,460 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/cbreaker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// origin counts the requests and answers with the version of its content
+type origin struct {
+	calls   int32
+	version int32
+	header  http.Header
+}
+
+func (o *origin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&o.calls, 1)
+	version := atomic.LoadInt32(&o.version)
+	for k, vv := range o.header {
+		w.Header()[k] = vv
+	}
+	etag := fmt.Sprintf(`"v%d"`, version)
+	w.Header().Set("Etag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	fmt.Fprintf(w, "version %d of %v", version, req.URL.RequestURI())
+}
+
+func (o *origin) count() int {
+	return int(atomic.LoadInt32(&o.calls))
+}
+
+func get(c http.Handler, url string, headers ...string) *httptest.ResponseRecorder {
+	return do(c, http.MethodGet, url, headers...)
+}
+
+func do(c http.Handler, method, url string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, req)
+	return w
+}
+
+func TestHit(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	clock := testutils.GetClock()
+	c, err := New(o, Clock(clock))
+	require.NoError(t, err)
+
+	w := get(c, "/a")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "MISS", w.Header().Get(XCache))
+	assert.Equal(t, "version 0 of /a", w.Body.String())
+
+	clock.Sleep(10 * time.Second)
+	w = get(c, "/a")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "HIT", w.Header().Get(XCache))
+	assert.Equal(t, "10", w.Header().Get("Age"))
+	assert.Equal(t, "version 0 of /a", w.Body.String())
+	assert.Equal(t, 1, o.count())
+
+	w = do(c, http.MethodHead, "/a")
+	assert.Equal(t, "HIT", w.Header().Get(XCache))
+	assert.Empty(t, w.Body.String())
+
+	// other URL
+	get(c, "/a?page=2")
+	assert.Equal(t, 2, o.count())
+	assert.Equal(t, 2, c.Len())
+	assert.True(t, c.Size() > 0)
+
+	// the client asks for a fresh response
+	w = get(c, "/a", "Cache-Control", "no-cache")
+	assert.Equal(t, "MISS", w.Header().Get(XCache))
+	assert.Equal(t, 3, o.count())
+
+	c.Purge()
+	assert.Equal(t, 0, c.Len())
+	assert.EqualValues(t, 0, c.Size())
+}
+
+func TestNotStored(t *testing.T) {
+	tests := []struct {
+		desc   string
+		header http.Header
+		req    []string
+	}{
+		{desc: "no-store", header: http.Header{"Cache-Control": {"no-store"}}},
+		{desc: "private", header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{desc: "cookie", header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=1"}}},
+		{desc: "vary *", header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+		{desc: "authorization", header: http.Header{"Cache-Control": {"max-age=60"}}, req: []string{"Authorization", "Bearer token"}},
+		{desc: "request no-store", header: http.Header{"Cache-Control": {"max-age=60"}}, req: []string{"Cache-Control", "no-store"}},
+	}
+	for _, test := range tests {
+		o := &origin{header: test.header}
+		c, err := New(o)
+		require.NoError(t, err)
+
+		get(c, "/", test.req...)
+		get(c, "/", test.req...)
+		assert.Equal(t, 2, o.count(), test.desc)
+		assert.Equal(t, 0, c.Len(), test.desc)
+	}
+}
+
+func TestAuthorizationPublic(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"public, max-age=60"}}}
+	c, err := New(o)
+	require.NoError(t, err)
+
+	get(c, "/", "Authorization", "Bearer token")
+	w := get(c, "/", "Authorization", "Bearer token")
+	assert.Equal(t, "HIT", w.Header().Get(XCache))
+	assert.Equal(t, 1, o.count())
+}
+
+func TestVary(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("hello in " + req.Header.Get("Accept-Language")))
+	})
+	c, err := New(handler)
+	require.NoError(t, err)
+
+	assert.Equal(t, "MISS", get(c, "/", "Accept-Language", "fr").Header().Get(XCache))
+	assert.Equal(t, "MISS", get(c, "/", "Accept-Language", "de").Header().Get(XCache))
+
+	w := get(c, "/", "Accept-Language", "fr")
+	assert.Equal(t, "HIT", w.Header().Get(XCache))
+	assert.Equal(t, "hello in fr", w.Body.String())
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestRevalidate(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	clock := testutils.GetClock()
+	c, err := New(o, Clock(clock))
+	require.NoError(t, err)
+
+	get(c, "/")
+	clock.Sleep(time.Minute)
+
+	w := get(c, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "REVALIDATED", w.Header().Get(XCache))
+	assert.Equal(t, "version 0 of /", w.Body.String())
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	assert.Equal(t, 2, o.count())
+
+	w = get(c, "/")
+	assert.Equal(t, "HIT", w.Header().Get(XCache))
+	assert.Equal(t, 2, o.count())
+
+	// the content changed
+	clock.Sleep(time.Minute)
+	atomic.StoreInt32(&o.version, 1)
+	w = get(c, "/")
+	assert.Equal(t, "MISS", w.Header().Get(XCache))
+	assert.Equal(t, "version 1 of /", w.Body.String())
+
+	w = get(c, "/")
+	assert.Equal(t, "HIT", w.Header().Get(XCache))
+	assert.Equal(t, "version 1 of /", w.Body.String())
+}
+
+func TestNoCacheResponse(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"no-cache"}}}
+	c, err := New(o)
+	require.NoError(t, err)
+
+	get(c, "/")
+	w := get(c, "/")
+	assert.Equal(t, "REVALIDATED", w.Header().Get(XCache))
+	assert.Equal(t, 2, o.count())
+}
+
+func TestClientConditional(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	c, err := New(o)
+	require.NoError(t, err)
+
+	get(c, "/")
+	w := get(c, "/", "If-None-Match", `"v1", W/"v0"`)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = get(c, "/", "If-None-Match", `"v1"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, o.count())
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60, stale-while-revalidate=30"}}}
+	clock := testutils.GetClock()
+	c, err := New(o, Clock(clock))
+	require.NoError(t, err)
+
+	get(c, "/")
+	atomic.StoreInt32(&o.version, 1)
+	clock.Sleep(70 * time.Second)
+
+	w := get(c, "/")
+	assert.Equal(t, "STALE", w.Header().Get(XCache))
+	assert.Equal(t, "version 0 of /", w.Body.String())
+
+	// wait for the background revalidation
+	for i := 0; i < 100 && o.count() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var body string
+	for i := 0; i < 100; i++ {
+		w = get(c, "/")
+		if body = w.Body.String(); body == "version 1 of /" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "version 1 of /", body)
+	assert.Equal(t, "HIT", w.Header().Get(XCache))
+	assert.Equal(t, 2, o.count())
+
+	// beyond the window the response is revalidated synchronously
+	clock.Sleep(2 * time.Minute)
+	w = get(c, "/")
+	assert.Equal(t, "REVALIDATED", w.Header().Get(XCache))
+}
+
+func TestTTLs(t *testing.T) {
+	o := &origin{}
+	clock := testutils.GetClock()
+	c, err := New(o, Clock(clock), DefaultTTL(time.Minute))
+	require.NoError(t, err)
+
+	get(c, "/")
+	clock.Sleep(30 * time.Second)
+	assert.Equal(t, "HIT", get(c, "/").Header().Get(XCache))
+
+	o.header = http.Header{"Cache-Control": {"max-age=3600"}}
+	c, err = New(o, Clock(clock), MaxTTL(time.Minute))
+	require.NoError(t, err)
+
+	get(c, "/")
+	clock.Sleep(time.Minute)
+	assert.Equal(t, "REVALIDATED", get(c, "/").Header().Get(XCache))
+}
+
+func TestInvalidate(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	c, err := New(o)
+	require.NoError(t, err)
+
+	get(c, "/a")
+	get(c, "/b")
+	do(c, http.MethodPost, "/a")
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, "MISS", get(c, "/a").Header().Get(XCache))
+	assert.Equal(t, "HIT", get(c, "/b").Header().Get(XCache))
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.Repeat("a", 64)))
+		w.Write([]byte(strings.Repeat("b", 64)))
+	})
+	c, err := New(handler, MaxEntrySize(100))
+	require.NoError(t, err)
+
+	w := get(c, "/")
+	assert.Equal(t, 128, w.Body.Len())
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestEviction(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	c, err := New(o)
+	require.NoError(t, err)
+	get(c, "/a")
+	size := c.Size()
+
+	// room for two responses
+	c, err = New(o, MaxSize(2*size+size/2), MaxEntrySize(size))
+	require.NoError(t, err)
+
+	get(c, "/a")
+	get(c, "/b")
+	get(c, "/a")
+	get(c, "/c")
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, 2*size, c.Size())
+	assert.Equal(t, "HIT", get(c, "/c").Header().Get(XCache))
+	assert.Equal(t, "MISS", get(c, "/b").Header().Get(XCache))
+}
+
+func TestServer(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	c, err := New(o)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		re, body, err := testutils.Get(srv.URL + "/page")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "version 0 of /page", string(body))
+	}
+	assert.Equal(t, 1, o.count())
+}
+
+func TestOptionsValidation(t *testing.T) {
+	_, err := New(nil, MaxSize(0))
+	assert.Error(t, err)
+
+	_, err = New(nil, MaxSize(100), MaxEntrySize(1000))
+	assert.Error(t, err)
+
+	_, err = New(nil, DefaultTTL(-time.Second))
+	assert.Error(t, err)
+
+	_, err = New(nil, StaleIfError(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestStaleIfError(t *testing.T) {
+	failing := int32(0)
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}, "Content-Type": {"text/html"}}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("bad gateway"))
+			return
+		}
+		o.ServeHTTP(w, req)
+	})
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock), StaleIfError(time.Hour, "text/*"))
+	require.NoError(t, err)
+
+	get(c, "/")
+	atomic.StoreInt32(&failing, 1)
+	clock.Sleep(30 * time.Minute)
+
+	w := get(c, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "STALE", w.Header().Get(XCache))
+	assert.Equal(t, "version 0 of /", w.Body.String())
+	assert.Equal(t, "1800", w.Header().Get("Age"))
+	assert.Equal(t, []string{WarningStale, WarningRevalidationFailed}, w.Header()["Warning"])
+
+	// beyond the maximum staleness the error is returned
+	clock.Sleep(time.Hour)
+	w = get(c, "/")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "bad gateway", w.Body.String())
+}
+
+func TestStaleIfErrorContentTypes(t *testing.T) {
+	failing := int32(0)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		if req.URL.Path == "/api" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "max-age=60, stale-if-error=30")
+		}
+		w.Write([]byte("ok"))
+	})
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock), StaleIfError(time.Hour, "text/html"))
+	require.NoError(t, err)
+
+	get(c, "/api")
+	get(c, "/image", "Accept", "image/png")
+	atomic.StoreInt32(&failing, 1)
+	clock.Sleep(61 * time.Second)
+
+	assert.Equal(t, http.StatusServiceUnavailable, get(c, "/api").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get(c, "/image").Code)
+}
+
+func TestStaleIfErrorDirective(t *testing.T) {
+	failing := int32(0)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=30")
+		w.Write([]byte("ok"))
+	})
+	clock := testutils.GetClock()
+	c, err := New(handler, Clock(clock))
+	require.NoError(t, err)
+
+	get(c, "/")
+	atomic.StoreInt32(&failing, 1)
+	clock.Sleep(80 * time.Second)
+	assert.Equal(t, http.StatusOK, get(c, "/").Code)
+
+	clock.Sleep(20 * time.Second)
+	assert.Equal(t, http.StatusInternalServerError, get(c, "/").Code)
+}
+
+func TestStaleIfErrorCircuitBreaker(t *testing.T) {
+	failing := int32(0)
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		o.ServeHTTP(w, req)
+	})
+	clock := testutils.GetClock()
+	cb, err := cbreaker.New(handler, "ResponseCodeRatio(500, 600, 0, 600) > 0.5", cbreaker.Clock(clock))
+	require.NoError(t, err)
+	c, err := New(cb, Clock(clock), StaleIfError(time.Hour), CircuitBreaker(cb))
+	require.NoError(t, err)
+
+	get(c, "/")
+	atomic.StoreInt32(&failing, 1)
+	clock.Sleep(time.Minute)
+	for i := 0; i < 10 && cb.State() != cbreaker.StateTripped; i++ {
+		clock.Sleep(time.Second)
+		assert.Equal(t, http.StatusOK, get(c, "/").Code)
+	}
+	require.Equal(t, cbreaker.StateTripped, cb.State())
+
+	calls := o.count()
+	w := get(c, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "STALE", w.Header().Get(XCache))
+	assert.Equal(t, "version 0 of /", w.Body.String())
+	assert.Equal(t, calls, o.count())
+
+	// no stale response for the other URLs
+	assert.Equal(t, http.StatusServiceUnavailable, get(c, "/other").Code)
+}
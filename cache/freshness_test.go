@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl([]string{`Public, max-age=60`, `s-maxage="120", no-cache`})
+	assert.True(t, cc.has("public"))
+	assert.True(t, cc.has("no-cache"))
+	assert.False(t, cc.has("private"))
+
+	d, ok := cc.duration("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+
+	d, ok = cc.duration("s-maxage")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+
+	_, ok = cc.duration("stale-while-revalidate")
+	assert.False(t, ok)
+
+	d, ok = parseCacheControl([]string{"max-age=soon"}).duration("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), d)
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+
+	tests := []struct {
+		desc     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{desc: "s-maxage first", header: http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, expected: 2 * time.Minute},
+		{desc: "max-age", header: http.Header{"Cache-Control": {"max-age=60"}, "Expires": {date}}, expected: time.Minute},
+		{desc: "no-cache", header: http.Header{"Cache-Control": {"no-cache, max-age=60"}}},
+		{desc: "expires", header: http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, expected: time.Hour},
+		{desc: "invalid expires", header: http.Header{"Expires": {"0"}}},
+		{desc: "default", header: http.Header{}, expected: 5 * time.Second},
+	}
+	for _, test := range tests {
+		cc := parseCacheControl(test.header["Cache-Control"])
+		assert.Equal(t, test.expected, freshnessLifetime(test.header, cc, now, 5*time.Second), test.desc)
+	}
+
+	assert.Equal(t, 30*time.Second, age(http.Header{"Age": {"30"}}))
+	assert.Equal(t, time.Duration(0), age(http.Header{"Age": {"-1"}}))
+}
+
+func TestStorable(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.True(t, storable(req, http.StatusOK, http.Header{}, cacheControl{}))
+	assert.True(t, storable(req, http.StatusNotFound, http.Header{}, cacheControl{}))
+	assert.False(t, storable(req, http.StatusInternalServerError, http.Header{}, cacheControl{}))
+	assert.False(t, storable(req, http.StatusCreated, http.Header{}, cacheControl{}))
+}
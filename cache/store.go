@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is a response stored in the cache, it is never modified once stored but replaced
+type entry struct {
+	key     string
+	primary string
+	vary    []string
+
+	status int
+	header http.Header
+	body   []byte
+
+	// date is when the response was generated by the origin, the time it was received minus its age
+	date time.Time
+	// expires is when the response becomes stale
+	expires time.Time
+	// staleUntil is when the stale response can not be served anymore while being revalidated
+	staleUntil time.Time
+	// staleIfErrorUntil is when the stale response can not stand in for the failures of the backend anymore
+	staleIfErrorUntil time.Time
+
+	// revalidating is protected by the mutex of the store
+	revalidating bool
+	elem         *list.Element
+}
+
+func (e *entry) size() int64 {
+	size := len(e.key) + len(e.body)
+	for k, vv := range e.header {
+		for _, v := range vv {
+			size += len(k) + len(v)
+		}
+	}
+	return int64(size)
+}
+
+// hasValidators tells if the response can be revalidated with a conditional request
+func (e *entry) hasValidators() bool {
+	return e.header.Get("Etag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// variants are the responses stored for a URL, one per combination of the request headers listed by Vary
+type variants struct {
+	vary    []string
+	entries map[string]*entry
+}
+
+// store keeps the entries within a total size, evicting the least recently used ones
+type store struct {
+	mutex    sync.Mutex
+	maxSize  int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*entry
+	variants map[string]*variants
+}
+
+func newStore(maxSize int64) *store {
+	return &store{
+		maxSize:  maxSize,
+		lru:      list.New(),
+		entries:  make(map[string]*entry),
+		variants: make(map[string]*variants),
+	}
+}
+
+// variantKey returns the key of the response to the request among the variants of the URL
+func variantKey(primary string, vary []string, req *http.Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	key := primary
+	for _, name := range vary {
+		key += "\n" + name + ":" + strings.Join(req.Header[name], ",")
+	}
+	return key
+}
+
+// parseVary returns the sorted canonical names of the Vary header
+func parseVary(h http.Header) []string {
+	var vary []string
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+// get returns the response stored for the request, nil if there is none
+func (s *store) get(primary string, req *http.Request) *entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	v := s.variants[primary]
+	if v == nil {
+		return nil
+	}
+	e := v.entries[variantKey(primary, v.vary, req)]
+	if e != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	return e
+}
+
+// put stores the entry, replacing the previous response to the same request.
+// The variants of the URL with another Vary header are dropped.
+func (s *store) put(e *entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if v := s.variants[e.primary]; v != nil && !equalStrings(v.vary, e.vary) {
+		for _, old := range v.entries {
+			s.removeLocked(old)
+		}
+	}
+	if old := s.entries[e.key]; old != nil {
+		s.removeLocked(old)
+	}
+	if e.size() > s.maxSize {
+		return
+	}
+
+	v := s.variants[e.primary]
+	if v == nil {
+		v = &variants{vary: e.vary, entries: make(map[string]*entry)}
+		s.variants[e.primary] = v
+	}
+	v.entries[e.key] = e
+	s.entries[e.key] = e
+	e.elem = s.lru.PushFront(e)
+	s.size += e.size()
+
+	for s.size > s.maxSize {
+		s.removeLocked(s.lru.Back().Value.(*entry))
+	}
+}
+
+// remove removes the entry if it is still stored
+func (s *store) remove(e *entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.entries[e.key] == e {
+		s.removeLocked(e)
+	}
+}
+
+// invalidate removes all the responses stored for the URL
+func (s *store) invalidate(primary string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v := s.variants[primary]; v != nil {
+		for _, e := range v.entries {
+			s.removeLocked(e)
+		}
+	}
+}
+
+func (s *store) removeLocked(e *entry) {
+	delete(s.entries, e.key)
+	s.lru.Remove(e.elem)
+	s.size -= e.size()
+	if v := s.variants[e.primary]; v != nil {
+		delete(v.entries, e.key)
+		if len(v.entries) == 0 {
+			delete(s.variants, e.primary)
+		}
+	}
+}
+
+// startRevalidation marks the entry as being revalidated, false if it already is
+func (s *store) startRevalidation(e *entry) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e.revalidating {
+		return false
+	}
+	e.revalidating = true
+	return true
+}
+
+func (s *store) endRevalidation(e *entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e.revalidating = false
+}
+
+func (s *store) purge() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.size = 0
+	s.lru.Init()
+	s.entries = make(map[string]*entry)
+	s.variants = make(map[string]*variants)
+}
+
+func (s *store) stats() (int, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.entries), s.size
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
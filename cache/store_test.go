@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEntry(req *http.Request, vary []string, body string) *entry {
+	e := &entry{primary: primaryKey(req), vary: vary, status: http.StatusOK, header: http.Header{}, body: []byte(body)}
+	e.key = variantKey(e.primary, vary, req)
+	return e
+}
+
+func TestStoreVariants(t *testing.T) {
+	s := newStore(1 << 20)
+
+	fr := httptest.NewRequest(http.MethodGet, "/", nil)
+	fr.Header.Set("Accept-Language", "fr")
+	de := httptest.NewRequest(http.MethodGet, "/", nil)
+	de.Header.Set("Accept-Language", "de")
+
+	vary := []string{"Accept-Language"}
+	s.put(newTestEntry(fr, vary, "bonjour"))
+	s.put(newTestEntry(de, vary, "hallo"))
+	assert.Equal(t, "bonjour", string(s.get(primaryKey(fr), fr).body))
+	assert.Equal(t, "hallo", string(s.get(primaryKey(de), de).body))
+
+	// another Vary header drops the variants
+	s.put(newTestEntry(fr, nil, "hello"))
+	assert.Equal(t, "hello", string(s.get(primaryKey(de), de).body))
+	n, _ := s.stats()
+	assert.Equal(t, 1, n)
+
+	s.invalidate(primaryKey(fr))
+	assert.Nil(t, s.get(primaryKey(fr), fr))
+	n, size := s.stats()
+	assert.Equal(t, 0, n)
+	assert.EqualValues(t, 0, size)
+}
+
+func TestStoreEviction(t *testing.T) {
+	a := newTestEntry(httptest.NewRequest(http.MethodGet, "/a", nil), nil, "aaaa")
+	s := newStore(2*a.size() + 1)
+
+	for _, path := range []string{"/a", "/b"} {
+		s.put(newTestEntry(httptest.NewRequest(http.MethodGet, path, nil), nil, "body"))
+	}
+	// /a is the most recently used
+	a = s.get(a.primary, httptest.NewRequest(http.MethodGet, "/a", nil))
+	assert.NotNil(t, a)
+	s.put(newTestEntry(httptest.NewRequest(http.MethodGet, "/c", nil), nil, "body"))
+
+	assert.NotNil(t, s.get(a.primary, httptest.NewRequest(http.MethodGet, "/a", nil)))
+	b := httptest.NewRequest(http.MethodGet, "/b", nil)
+	assert.Nil(t, s.get(primaryKey(b), b))
+
+	// too large to be stored
+	s.put(newTestEntry(b, nil, string(make([]byte, 1024))))
+	assert.Nil(t, s.get(primaryKey(b), b))
+
+	s.remove(a)
+	assert.Nil(t, s.get(a.primary, httptest.NewRequest(http.MethodGet, "/a", nil)))
+	assert.True(t, s.startRevalidation(a))
+	assert.False(t, s.startRevalidation(a))
+	s.endRevalidation(a)
+	assert.True(t, s.startRevalidation(a))
+}
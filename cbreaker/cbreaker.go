@@ -14,14 +14,27 @@
 //
 //    allowedRequestsRatio = 0.5 * (Now() - StartRecovery())/RecoveryDuration
 //
+// With the RecoveryRamp option, every request is admitted with a probability ramping up linearly to 1 instead.
+//
 // Two scenarios are possible in the "Recovering" state:
 // 1. Condition matches again, this will reset the state to "Tripped" and reset the timer.
 // 2. Condition does not match, circuit breaker enters "Standby" state
 //
+// With the HalfOpen option, the circuit breaker enters the "HalfOpen" state instead of "Recovering" once
+// FallbackDuration has passed. It lets a limited number of trial requests through, rejecting the others:
+// a trial failing with a network error or a 5xx response trips the circuit breaker again, while the
+// success of all the trials puts it back in "Standby" state.
+//
+// Trip and Reset let an operator force the circuit breaker in the "Tripped" state, until it is reset, and put it back
+// in "Standby" state.
+//
 // It is possible to define actions (e.g. webhooks) of transitions between states:
 //
 // * OnTripped action is called on transition (Standby -> Tripped)
 // * OnStandby action is called on transition (Recovering -> Standby)
+// * OnRecovering action is called on transition (Tripped -> Recovering) and (Tripped -> HalfOpen)
+//
+// The Events option sends every transition to a channel as well.
 //
 package cbreaker
 
@@ -29,12 +42,13 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/utils"
 	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/memmetrics"
-	"github.com/vulcand/oxy/utils"
 )
 
 // CircuitBreaker is http.Handler that implements circuit breaker pattern
@@ -43,27 +57,45 @@ type CircuitBreaker struct {
 	metrics *memmetrics.RTMetrics
 
 	condition hpredicate
+	functions map[string]MetricFunc
+	inflight  int64
 
 	fallbackDuration time.Duration
 	recoveryDuration time.Duration
 
-	onTripped SideEffect
-	onStandby SideEffect
+	onTripped    SideEffect
+	onStandby    SideEffect
+	onRecovering SideEffect
+	events       chan<- StateChange
 
-	state cbState
+	state State
 	until time.Time
+	// forced is set while the circuit breaker is tripped by Trip, until Reset
+	forced bool
 
 	rc *ratioController
 
+	halfOpenTrials  int
+	trialsStarted   int
+	trialsSucceeded int
+
 	checkPeriod time.Duration
 	lastCheck   time.Time
 
+	// rampFrom is the admission probability the recovery starts from, negative without RecoveryRamp
+	rampFrom float64
+
+	window        time.Duration
+	windowBuckets int
+	minRequests   int64
+
 	fallback http.Handler
 	next     http.Handler
 
 	clock timetools.TimeProvider
 
-	log *log.Logger
+	log    *log.Logger
+	logger utils.Logger
 }
 
 // New creates a new CircuitBreaker middleware
@@ -76,6 +108,7 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 		checkPeriod:      defaultCheckPeriod,
 		fallbackDuration: defaultFallbackDuration,
 		recoveryDuration: defaultRecoveryDuration,
+		rampFrom:         -1,
 		fallback:         defaultFallback,
 		log:              log.StandardLogger(),
 	}
@@ -86,13 +119,17 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 		}
 	}
 
-	condition, err := parseExpression(expression)
+	if cb.logger == nil {
+		cb.logger = utils.NewLogrusLogger(cb.log)
+	}
+
+	condition, err := parseExpression(expression, cb.functions)
 	if err != nil {
 		return nil, err
 	}
 	cb.condition = condition
 
-	mt, err := memmetrics.NewRTMetrics()
+	mt, err := cb.newMetrics()
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +138,14 @@ func New(next http.Handler, expression string, options ...CircuitBreakerOption)
 	return cb, nil
 }
 
+// newMetrics creates the metrics the condition is evaluated on, rolling over the window if it is set
+func (c *CircuitBreaker) newMetrics() (*memmetrics.RTMetrics, error) {
+	if c.window > 0 {
+		return memmetrics.NewRTMetrics(memmetrics.RTClock(c.clock), memmetrics.RTWindow(c.window, c.windowBuckets))
+	}
+	return memmetrics.NewRTMetrics(memmetrics.RTClock(c.clock))
+}
+
 // Logger defines the logger the circuit breaker will use.
 //
 // It defaults to logrus.StandardLogger(), the global logger used by logrus.
@@ -111,17 +156,30 @@ func Logger(l *log.Logger) CircuitBreakerOption {
 	}
 }
 
+// StructuredLogger defines the structured logger the circuit breaker logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by Logger.
+func StructuredLogger(l utils.Logger) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.logger = l
+		return nil
+	}
+}
+
 func (c *CircuitBreaker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if c.log.Level >= log.DebugLevel {
-		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
-		logEntry.Debug("vulcand/oxy/circuitbreaker: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/circuitbreaker: completed ServeHttp on request")
+	logger := utils.RequestLogger(req, c.logger)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req)})
+		logEntry.Debugf("vulcand/oxy/circuitbreaker: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/circuitbreaker: completed ServeHttp on request")
 	}
-	if c.activateFallback(w, req) {
+	fallback, trial := c.activateFallback(w, req)
+	if fallback {
 		c.fallback.ServeHTTP(w, req)
 		return
 	}
-	c.serve(w, req)
+	c.serve(w, req, trial)
 }
 
 // Wrap sets the next handler to be called by circuit breaker handler.
@@ -129,52 +187,68 @@ func (c *CircuitBreaker) Wrap(next http.Handler) {
 	c.next = next
 }
 
-// updateState updates internal state and returns true if fallback should be used and false otherwise
-func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Request) bool {
+// updateState updates internal state and returns true if fallback should be used and false otherwise,
+// the second value tells if the request is a trial of the half-open state
+func (c *CircuitBreaker) activateFallback(w http.ResponseWriter, req *http.Request) (bool, bool) {
 	// Quick check with read locks optimized for normal operation use-case
 	if c.isStandby() {
-		return false
+		return false, false
 	}
-	// Circuit breaker is in tripped or recovering state
+	// Circuit breaker is in tripped, recovering or half-open state
 	c.m.Lock()
 	defer c.m.Unlock()
 
-	c.log.Warnf("%v is in error state", c)
+	utils.RequestLogger(req, c.logger).Warnf("%v is in error state", c)
 
 	switch c.state {
-	case stateStandby:
+	case StateStandby:
 		// someone else has set it to standby just now
-		return false
-	case stateTripped:
-		if c.clock.UtcNow().Before(c.until) {
-			return true
+		return false, false
+	case StateTripped:
+		if c.forced || c.clock.UtcNow().Before(c.until) {
+			return true, false
+		}
+		// Probe the endpoints with a few trial requests instead of ramping up the traffic
+		if c.halfOpenTrials > 0 {
+			c.setHalfOpen()
+			return c.allowTrial()
 		}
 		// We have been in active state enough, enter recovering state
 		c.setRecovering()
 		fallthrough
-	case stateRecovering:
+	case StateRecovering:
 		// We have been in recovering state enough, enter standby and allow request
 		if c.clock.UtcNow().After(c.until) {
-			c.setState(stateStandby, c.clock.UtcNow())
-			return false
+			c.setState(StateStandby, c.clock.UtcNow())
+			return false, false
 		}
 		// ratio controller allows this request
 		if c.rc.allowRequest() {
-			return false
+			return false, false
 		}
-		return true
+		return true, false
+	case StateHalfOpen:
+		return c.allowTrial()
 	}
-	return false
+	return false, false
 }
 
-func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
+func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request, trial bool) {
 	start := c.clock.UtcNow()
 	p := utils.NewProxyWriterWithLogger(w, c.log)
 
-	c.next.ServeHTTP(p, req)
+	func() {
+		atomic.AddInt64(&c.inflight, 1)
+		defer atomic.AddInt64(&c.inflight, -1)
+		c.next.ServeHTTP(p, req)
+	}()
 
 	latency := c.clock.UtcNow().Sub(start)
-	c.metrics.Record(p.StatusCode(), latency)
+	c.metrics.RecordRequest(req.Method, p.StatusCode(), latency)
+
+	if trial {
+		c.recordTrial(p.StatusCode())
+	}
 
 	// Note that this call is less expensive than it looks -- checkCondition only performs the real check
 	// periodically. Because of that we can afford to call it here on every single response.
@@ -184,13 +258,49 @@ func (c *CircuitBreaker) serve(w http.ResponseWriter, req *http.Request) {
 func (c *CircuitBreaker) isStandby() bool {
 	c.m.RLock()
 	defer c.m.RUnlock()
-	return c.state == stateStandby
+	return c.state == StateStandby
+}
+
+// State returns the current state of the circuit breaker
+func (c *CircuitBreaker) State() State {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.state
+}
+
+// Trip forces the circuit breaker in the Tripped state, e.g. by an operator during an incident: all the requests
+// fall back until Reset is called, whatever the condition and the durations.
+func (c *CircuitBreaker) Trip() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.forced {
+		return
+	}
+	c.forced = true
+	c.setState(StateTripped, c.clock.UtcNow())
+}
+
+// Reset puts the circuit breaker back in the Standby state with fresh metrics, e.g. once an operator verified the
+// endpoints are healthy again. It ends a Trip as well as a tripping by the condition.
+func (c *CircuitBreaker) Reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.forced = false
+	c.metrics.Reset()
+	if c.state != StateStandby {
+		c.setState(StateStandby, c.clock.UtcNow())
+	}
 }
 
 // String returns log-friendly representation of the circuit breaker state
 func (c *CircuitBreaker) String() string {
+	if c.forced {
+		return fmt.Sprintf("CircuitBreaker(state=%v, forced)", c.state)
+	}
 	switch c.state {
-	case stateTripped, stateRecovering:
+	case StateTripped, StateRecovering, StateHalfOpen:
 		return fmt.Sprintf("CircuitBreaker(state=%v, until=%v)", c.state, c.until)
 	default:
 		return fmt.Sprintf("CircuitBreaker(state=%v)", c.state)
@@ -209,15 +319,31 @@ func (c *CircuitBreaker) exec(s SideEffect) {
 	}()
 }
 
-func (c *CircuitBreaker) setState(new cbState, until time.Time) {
+func (c *CircuitBreaker) setState(new State, until time.Time) {
 	c.log.Debugf("%v setting state to %v, until %v", c, new, until)
+	old := c.state
 	c.state = new
 	c.until = until
 	switch new {
-	case stateTripped:
+	case StateTripped:
 		c.exec(c.onTripped)
-	case stateStandby:
+	case StateStandby:
 		c.exec(c.onStandby)
+	case StateRecovering, StateHalfOpen:
+		c.exec(c.onRecovering)
+	}
+	c.notify(StateChange{From: old, To: new, Until: until, Time: c.clock.UtcNow()})
+}
+
+// notify sends the state change to the events channel without blocking the circuit breaker
+func (c *CircuitBreaker) notify(e StateChange) {
+	if c.events == nil {
+		return
+	}
+	select {
+	case c.events <- e:
+	default:
+		c.log.Warnf("%v events channel is full, dropping state change %v -> %v", c, e.From, e.To)
 	}
 }
 
@@ -242,21 +368,68 @@ func (c *CircuitBreaker) checkAndSet() {
 	}
 	c.lastCheck = c.clock.UtcNow().Add(c.checkPeriod)
 
-	if c.state == stateTripped {
+	if c.state == StateTripped {
 		c.log.Debugf("%v skip set tripped", c)
 		return
 	}
 
+	// too few requests to tell, e.g. one or two failures of a low traffic route
+	if c.metrics.TotalCount() < c.minRequests {
+		return
+	}
+
 	if !c.condition(c) {
 		return
 	}
 
-	c.setState(stateTripped, c.clock.UtcNow().Add(c.fallbackDuration))
+	c.setState(StateTripped, c.clock.UtcNow().Add(c.fallbackDuration))
 	c.metrics.Reset()
 }
 
+func (c *CircuitBreaker) setHalfOpen() {
+	c.setState(StateHalfOpen, c.clock.UtcNow())
+	c.trialsStarted = 0
+	c.trialsSucceeded = 0
+}
+
+// allowTrial lets the request through as a trial while trials are left, the other requests fall back
+func (c *CircuitBreaker) allowTrial() (bool, bool) {
+	if c.trialsStarted >= c.halfOpenTrials {
+		return true, false
+	}
+	c.trialsStarted++
+	return false, true
+}
+
+// recordTrial trips the circuit breaker again on a failed trial, or puts it in standby once all the trials succeeded
+func (c *CircuitBreaker) recordTrial(code int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	// the state changed while the trial was running
+	if c.state != StateHalfOpen {
+		return
+	}
+
+	if code >= http.StatusInternalServerError {
+		c.log.Debugf("%v trial failed with code %d", c, code)
+		c.setState(StateTripped, c.clock.UtcNow().Add(c.fallbackDuration))
+		c.metrics.Reset()
+		return
+	}
+
+	c.trialsSucceeded++
+	if c.trialsSucceeded >= c.halfOpenTrials {
+		c.setState(StateStandby, c.clock.UtcNow())
+	}
+}
+
 func (c *CircuitBreaker) setRecovering() {
-	c.setState(stateRecovering, c.clock.UtcNow().Add(c.recoveryDuration))
+	c.setState(StateRecovering, c.clock.UtcNow().Add(c.recoveryDuration))
+	if c.rampFrom >= 0 {
+		c.rc = newRampController(c.clock, c.recoveryDuration, c.rampFrom, c.log)
+		return
+	}
 	c.rc = newRatioController(c.clock, c.recoveryDuration, c.log)
 }
 
@@ -291,6 +464,31 @@ func RecoveryDuration(d time.Duration) CircuitBreakerOption {
 	}
 }
 
+// RecoveryRamp makes the CircuitBreaker admit every request with a probability ramping up linearly from the given
+// one to 1 over RecoveryDuration in the Recovering state, smoothing the warm-up of the endpoints, instead of letting
+// through a deterministic ratio of the requests going from 0 to 0.5.
+func RecoveryRamp(from float64) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if from < 0 || from >= 1 {
+			return fmt.Errorf("recovery ramp should start in [0, 1), got %v", from)
+		}
+		c.rampFrom = from
+		return nil
+	}
+}
+
+// HalfOpen makes the CircuitBreaker enter the HalfOpen state instead of the Recovering state
+// once FallbackDuration has passed, letting trials requests through to decide whether to close again.
+func HalfOpen(trials int) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if trials < 1 {
+			return fmt.Errorf("half-open trials should be >= 1")
+		}
+		c.halfOpenTrials = trials
+		return nil
+	}
+}
+
 // CheckPeriod is how long the CircuitBreaker will wait between successive
 // checks of the breaker condition.
 func CheckPeriod(d time.Duration) CircuitBreakerOption {
@@ -300,6 +498,48 @@ func CheckPeriod(d time.Duration) CircuitBreakerOption {
 	}
 }
 
+// Window sets the sliding window the metrics of the condition are counted over, it rolls over the given number of
+// buckets, the oldest bucket being dropped every window / buckets. It defaults to 10 seconds in buckets of a second
+// for the counters and to a minute in buckets of 10 seconds for the latency histogram. The buckets can not be
+// shorter than a second.
+func Window(d time.Duration, buckets int) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if buckets < 1 {
+			return fmt.Errorf("window buckets should be >= 1, got %d", buckets)
+		}
+		if d/time.Duration(buckets) < time.Second {
+			return fmt.Errorf("window buckets should last at least a second, got %v", d/time.Duration(buckets))
+		}
+		c.window = d
+		c.windowBuckets = buckets
+		return nil
+	}
+}
+
+// MinRequests is the number of requests the window must hold for the condition to be evaluated, so that a few
+// failures of a low traffic route do not trip the CircuitBreaker.
+func MinRequests(n int) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if n < 0 {
+			return fmt.Errorf("minimum requests should be >= 0, got %d", n)
+		}
+		c.minRequests = int64(n)
+		return nil
+	}
+}
+
+// Function registers a custom function usable in the expression of the CircuitBreaker,
+// e.g. Function("ServerErrors", fn) allows `ServerErrors() > 10.0`.
+func Function(name string, fn MetricFunc) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		if c.functions == nil {
+			c.functions = make(map[string]MetricFunc)
+		}
+		c.functions[name] = fn
+		return nil
+	}
+}
+
 // OnTripped sets a SideEffect to run when entering the Tripped state.
 // Only one SideEffect can be set for this hook.
 func OnTripped(s SideEffect) CircuitBreakerOption {
@@ -318,6 +558,24 @@ func OnStandby(s SideEffect) CircuitBreakerOption {
 	}
 }
 
+// OnRecovering sets a SideEffect to run when entering the Recovering or the HalfOpen state.
+// Only one SideEffect can be set for this hook.
+func OnRecovering(s SideEffect) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.onRecovering = s
+		return nil
+	}
+}
+
+// Events sets a channel receiving every state change of the CircuitBreaker.
+// State changes are dropped while the channel is full, use a buffered channel.
+func Events(ch chan<- StateChange) CircuitBreakerOption {
+	return func(c *CircuitBreaker) error {
+		c.events = ch
+		return nil
+	}
+}
+
 // Fallback defines the http.Handler that the CircuitBreaker should route
 // requests to when it prevents a request from taking its normal path.
 func Fallback(h http.Handler) CircuitBreakerOption {
@@ -327,28 +585,42 @@ func Fallback(h http.Handler) CircuitBreakerOption {
 	}
 }
 
-// cbState is the state of the circuit breaker
-type cbState int
+// State is the state of the circuit breaker
+type State int
+
+// StateChange is a transition between two states of the circuit breaker
+type StateChange struct {
+	From State
+	To   State
+	// Until is the end of the new state for the Tripped and Recovering states
+	Until time.Time
+	// Time is the time of the transition
+	Time time.Time
+}
 
-func (s cbState) String() string {
+func (s State) String() string {
 	switch s {
-	case stateStandby:
+	case StateStandby:
 		return "standby"
-	case stateTripped:
+	case StateTripped:
 		return "tripped"
-	case stateRecovering:
+	case StateRecovering:
 		return "recovering"
+	case StateHalfOpen:
+		return "half-open"
 	}
 	return "undefined"
 }
 
 const (
 	// CircuitBreaker is passing all requests and watching stats
-	stateStandby = iota
+	StateStandby State = iota
 	// CircuitBreaker activates fallback scenario for all requests
-	stateTripped
+	StateTripped
 	// CircuitBreaker passes some requests to go through, rejecting others
-	stateRecovering
+	StateRecovering
+	// CircuitBreaker passes a limited number of trial requests, rejecting others
+	StateHalfOpen
 )
 
 const (
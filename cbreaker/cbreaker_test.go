@@ -9,9 +9,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/oxy/testutils"
 )
 
@@ -55,21 +57,21 @@ func TestFullCycle(t *testing.T) {
 	clock.CurrentTime = clock.CurrentTime.Add(defaultCheckPeriod + time.Millisecond)
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, StateTripped, cb.state)
 
 	// Some time has passed, but we are still in trapped state.
 	clock.CurrentTime = clock.CurrentTime.Add(9 * time.Second)
 	re, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, StateTripped, cb.state)
 
 	// We should be in recovering state by now
 	clock.CurrentTime = clock.CurrentTime.Add(time.Second*1 + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
-	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, StateRecovering, cb.state)
 
 	// 5 seconds after we should be allowing some requests to pass
 	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
@@ -85,11 +87,101 @@ func TestFullCycle(t *testing.T) {
 	// After some time, all is good and we should be in stand by mode again
 	clock.CurrentTime = clock.CurrentTime.Add(5*time.Second + time.Millisecond)
 	re, _, err = testutils.Get(srv.URL)
-	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.Equal(t, StateStandby, cb.state)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 }
 
+func TestHalfOpenCycle(t *testing.T) {
+	status := http.StatusOK
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), HalfOpen(2))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	cb.metrics = statsNetErrors(0.6)
+	clock.CurrentTime = clock.CurrentTime.Add(defaultCheckPeriod + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, StateTripped, cb.state)
+
+	// A failed trial trips the circuit breaker again
+	clock.CurrentTime = clock.CurrentTime.Add(defaultFallbackDuration + time.Millisecond)
+	status = http.StatusInternalServerError
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	assert.Equal(t, StateTripped, cb.state)
+
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	// All the trials succeed, the circuit breaker is back in standby
+	clock.CurrentTime = clock.CurrentTime.Add(defaultFallbackDuration + time.Millisecond)
+	status = http.StatusOK
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, StateHalfOpen, cb.state)
+
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, StateStandby, cb.state)
+}
+
+func TestHalfOpenLimitsTrials(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), HalfOpen(1))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	cb.setState(StateTripped, clock.UtcNow().Add(defaultFallbackDuration))
+	clock.CurrentTime = clock.CurrentTime.Add(defaultFallbackDuration + time.Millisecond)
+
+	trial := make(chan *http.Response)
+	go func() {
+		re, _, _ := testutils.Get(srv.URL)
+		trial <- re
+	}()
+	<-started
+
+	// The only trial is in flight, other requests fall back
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	close(release)
+	re = <-trial
+	require.NotNil(t, re)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, StateStandby, cb.state)
+}
+
+func TestHalfOpenValidation(t *testing.T) {
+	_, err := New(nil, triggerNetRatio, HalfOpen(0))
+	assert.Error(t, err)
+}
+
 func TestRedirectWithPath(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("hello"))
@@ -169,14 +261,14 @@ func TestTriggerDuringRecovery(t *testing.T) {
 	cb.metrics = statsNetErrors(0.6)
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, StateTripped, cb.state)
 
 	// We should be in recovering state by now
 	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
 	re, _, err := testutils.Get(srv.URL)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
-	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, StateRecovering, cb.state)
 
 	// We have matched error condition during recovery state and are going back to tripped state
 	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
@@ -189,7 +281,7 @@ func TestTriggerDuringRecovery(t *testing.T) {
 		}
 	}
 	assert.NotEqual(t, 0, allowed)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, StateTripped, cb.state)
 }
 
 func TestSideEffects(t *testing.T) {
@@ -246,7 +338,7 @@ func TestSideEffects(t *testing.T) {
 
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateTripped), cb.state)
+	assert.Equal(t, StateTripped, cb.state)
 
 	select {
 	case req := <-srv1Chan:
@@ -263,13 +355,13 @@ func TestSideEffects(t *testing.T) {
 	cb.metrics = statsOK()
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateRecovering), cb.state)
+	assert.Equal(t, StateRecovering, cb.state)
 
 	// Going back to standby
 	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
 	_, _, err = testutils.Get(srv.URL)
 	require.NoError(t, err)
-	assert.Equal(t, cbState(stateStandby), cb.state)
+	assert.Equal(t, StateStandby, cb.state)
 
 	select {
 	case req := <-srv2Chan:
@@ -281,6 +373,64 @@ func TestSideEffects(t *testing.T) {
 	}
 }
 
+func TestStateChangeNotifications(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	recovering := make(chan struct{}, 1)
+	onRecovering := SideEffectFunc(func() error {
+		recovering <- struct{}{}
+		return nil
+	})
+
+	events := make(chan StateChange, 10)
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond), OnRecovering(onRecovering), Events(events))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	cb.metrics = statsNetErrors(0.6)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
+	cb.metrics = statsOK()
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	select {
+	case <-recovering:
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for side effect to kick off")
+	}
+
+	clock.CurrentTime = clock.CurrentTime.Add(10*time.Second + time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	var changes []string
+	for len(events) > 0 {
+		e := <-events
+		changes = append(changes, e.From.String()+" -> "+e.To.String())
+	}
+	assert.Equal(t, []string{"standby -> tripped", "tripped -> recovering", "recovering -> standby"}, changes)
+}
+
+func TestEventsDoNotBlock(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	events := make(chan StateChange)
+	cb, err := New(handler, triggerNetRatio, Clock(testutils.GetClock()), Events(events))
+	require.NoError(t, err)
+
+	cb.setState(StateTripped, cb.clock.UtcNow())
+	assert.Equal(t, StateTripped, cb.state)
+}
+
 func statsOK() *memmetrics.RTMetrics {
 	m, err := memmetrics.NewRTMetrics()
 	if err != nil {
@@ -330,3 +480,199 @@ type statusCode struct {
 	Code  int
 	Count int64
 }
+
+func TestMinRequests(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond), MinRequests(5))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	// the failures of the first requests do not trip the circuit breaker
+	for i := 0; i < 4; i++ {
+		clock.CurrentTime = clock.CurrentTime.Add(time.Millisecond)
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+		assert.Equal(t, StateStandby, cb.State())
+	}
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Millisecond)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, StateTripped, cb.State())
+}
+
+func TestWindow(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond), MinRequests(3), Window(3*time.Second, 3))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	// the failures spread over more than the window never add up to the minimum
+	for i := 0; i < 6; i++ {
+		clock.CurrentTime = clock.CurrentTime.Add(2 * time.Second)
+		_, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, StateStandby, cb.State())
+	}
+	assert.EqualValues(t, 2, cb.metrics.TotalCount())
+
+	for i := 0; i < 2; i++ {
+		clock.CurrentTime = clock.CurrentTime.Add(time.Millisecond)
+		_, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, StateTripped, cb.State())
+}
+
+func TestWindowOptions(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	_, err := New(handler, triggerNetRatio, Window(10*time.Second, 0))
+	assert.Error(t, err)
+
+	_, err = New(handler, triggerNetRatio, Window(time.Second, 10))
+	assert.Error(t, err)
+
+	_, err = New(handler, triggerNetRatio, MinRequests(-1))
+	assert.Error(t, err)
+}
+
+func TestTripAndReset(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+	events := make(chan StateChange, 10)
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), Events(events))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	cb.Trip()
+	assert.Equal(t, StateTripped, cb.State())
+	assert.Equal(t, StateTripped, (<-events).To)
+
+	// the forced circuit breaker does not recover by itself
+	clock.CurrentTime = clock.CurrentTime.Add(time.Hour)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, StateTripped, cb.State())
+
+	cb.Trip()
+	assert.Len(t, events, 0)
+
+	cb.Reset()
+	assert.Equal(t, StateStandby, cb.State())
+	assert.Equal(t, StateStandby, (<-events).To)
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestResetTripped(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	cb.metrics = statsNetErrors(0.6)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, StateTripped, cb.State())
+
+	// the metrics are reset along with the state so that the condition does not trip it again
+	cb.metrics = statsNetErrors(0.6)
+	cb.Reset()
+	assert.EqualValues(t, 0, cb.metrics.TotalCount())
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Millisecond)
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, StateStandby, cb.State())
+}
+
+func TestRecoveryRampOption(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	clock := testutils.GetClock()
+
+	cb, err := New(handler, triggerNetRatio, Clock(clock), CheckPeriod(time.Microsecond), RecoveryRamp(0.5))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	cb.metrics = statsNetErrors(0.6)
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, StateTripped, cb.State())
+
+	// the recovery starts admitting about half of the requests
+	clock.CurrentTime = clock.CurrentTime.Add(defaultFallbackDuration + time.Millisecond)
+	allowed := 0
+	for i := 0; i < 200; i++ {
+		re, _, err := testutils.Get(srv.URL)
+		require.NoError(t, err)
+		if re.StatusCode == http.StatusOK {
+			allowed++
+		}
+	}
+	assert.Equal(t, StateRecovering, cb.State())
+	assert.True(t, allowed > 60 && allowed < 140, "%d requests allowed", allowed)
+
+	_, err = New(handler, triggerNetRatio, RecoveryRamp(1))
+	assert.Error(t, err)
+	_, err = New(handler, triggerNetRatio, RecoveryRamp(-0.1))
+	assert.Error(t, err)
+}
+
+func TestStructuredLogger(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	logger, hook := test.NewNullLogger()
+	cb, err := New(handler, triggerNetRatio, StructuredLogger(utils.NewLogrusLogger(logger)))
+	require.NoError(t, err)
+	cb.Trip()
+
+	req := utils.WithRequestID(httptest.NewRequest(http.MethodGet, "/", nil), "abc")
+	w := httptest.NewRecorder()
+	cb.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// the requests served by the fallback are logged with their ID
+	require.NotEmpty(t, hook.Entries)
+	assert.Equal(t, "abc", hook.LastEntry().Data[utils.LogFieldRequestID])
+}
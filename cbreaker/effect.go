@@ -9,8 +9,8 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/heebyunglee/oxy/utils"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 // SideEffect a side effect
@@ -18,6 +18,14 @@ type SideEffect interface {
 	Exec() error
 }
 
+// SideEffectFunc adapts a function to a SideEffect, e.g. to emit metrics or log structured events
+type SideEffectFunc func() error
+
+// Exec calls f()
+func (f SideEffectFunc) Exec() error {
+	return f()
+}
+
 // Webhook Web hook
 type Webhook struct {
 	URL     string
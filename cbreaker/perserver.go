@@ -0,0 +1,87 @@
+package cbreaker
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// PerServer is http.Handler that keeps a separate circuit breaker for every server the requests are sent to,
+// so that a failing server trips its own circuit breaker without affecting the other ones.
+//
+// It is meant to be the next handler of a load balancer, the server being the one set in the request URL:
+//
+//	breakers, _ := cbreaker.NewPerServer(fwd, `NetworkErrorRatio() > 0.5`)
+//	lb, _ := roundrobin.New(breakers)
+//
+// The fallback of a tripped circuit breaker answers 503 by default, wrapping the load balancer
+// with roundrobin.NewRetry sends those requests to another server.
+type PerServer struct {
+	m        *sync.Mutex
+	breakers map[string]*CircuitBreaker
+
+	next       http.Handler
+	expression string
+	options    []CircuitBreakerOption
+}
+
+// NewPerServer creates a new PerServer middleware, every circuit breaker is created with the expression and the options
+func NewPerServer(next http.Handler, expression string, options ...CircuitBreakerOption) (*PerServer, error) {
+	// fail early on invalid settings rather than on the first request
+	if _, err := New(next, expression, options...); err != nil {
+		return nil, err
+	}
+	return &PerServer{
+		m:          &sync.Mutex{},
+		breakers:   make(map[string]*CircuitBreaker),
+		next:       next,
+		expression: expression,
+		options:    options,
+	}, nil
+}
+
+func (p *PerServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	cb, err := p.breaker(req.URL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		return
+	}
+	cb.ServeHTTP(w, req)
+}
+
+// Breaker returns the circuit breaker of the server, if any request was sent to it
+func (p *PerServer) Breaker(u *url.URL) (*CircuitBreaker, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	cb, ok := p.breakers[serverKey(u)]
+	return cb, ok
+}
+
+// RemoveServer drops the circuit breaker of the server, e.g. once it is removed from the load balancer
+func (p *PerServer) RemoveServer(u *url.URL) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	delete(p.breakers, serverKey(u))
+}
+
+func (p *PerServer) breaker(u *url.URL) (*CircuitBreaker, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	key := serverKey(u)
+	if cb, ok := p.breakers[key]; ok {
+		return cb, nil
+	}
+	cb, err := New(p.next, p.expression, p.options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create circuit breaker for %v: %v", key, err)
+	}
+	p.breakers[key] = cb
+	return cb, nil
+}
+
+func serverKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
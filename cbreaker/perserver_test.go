@@ -0,0 +1,125 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/roundrobin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestPerServerIsolatesServers(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	breakers, err := NewPerServer(fwd, triggerNetRatio, Clock(clock))
+	require.NoError(t, err)
+
+	lb, err := roundrobin.New(breakers)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	for i := 0; i < 2; i++ {
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+	}
+
+	cbA, ok := breakers.Breaker(testutils.ParseURI(a.URL))
+	require.True(t, ok)
+	cbA.metrics = statsNetErrors(0.6)
+	clock.CurrentTime = clock.CurrentTime.Add(defaultCheckPeriod + time.Millisecond)
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if re.StatusCode != http.StatusOK {
+			bodies[i] = "fallback"
+		}
+	}
+	// the request tripping the circuit breaker of a is still served
+	assert.Equal(t, []string{"a", "b", "fallback", "b"}, bodies)
+
+	cbB, ok := breakers.Breaker(testutils.ParseURI(b.URL))
+	require.True(t, ok)
+	assert.Equal(t, StateStandby, cbB.state)
+}
+
+func TestPerServerRetryOnTripped(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	breakers, err := NewPerServer(fwd, triggerNetRatio, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	lb, err := roundrobin.New(breakers)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	retry, err := roundrobin.NewRetry(lb)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	_, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+
+	cbA, ok := breakers.Breaker(testutils.ParseURI(a.URL))
+	require.True(t, ok)
+	cbA.setState(StateTripped, cbA.clock.UtcNow().Add(defaultFallbackDuration))
+
+	for i := 0; i < 3; i++ {
+		re, body, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "b", string(body))
+	}
+}
+
+func TestPerServerRemoveServer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	breakers, err := NewPerServer(handler, triggerNetRatio)
+	require.NoError(t, err)
+
+	u := testutils.ParseURI("http://localhost:63450/path")
+	breakers.ServeHTTP(httptest.NewRecorder(), &http.Request{URL: u})
+
+	_, ok := breakers.Breaker(testutils.ParseURI("http://localhost:63450"))
+	assert.True(t, ok)
+
+	breakers.RemoveServer(u)
+	_, ok = breakers.Breaker(u)
+	assert.False(t, ok)
+}
+
+func TestPerServerInvalidExpression(t *testing.T) {
+	_, err := NewPerServer(nil, "Unknown()")
+	assert.Error(t, err)
+}
@@ -2,15 +2,38 @@ package cbreaker
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
+	"github.com/heebyunglee/oxy/memmetrics"
 	"github.com/vulcand/predicate"
 )
 
 type hpredicate func(*CircuitBreaker) bool
 
+// MetricFunc computes a value from the metrics of the circuit breaker, see the Function option
+type MetricFunc func(m *memmetrics.RTMetrics) float64
+
 // parseExpression parses expression in the go language into predicates.
-func parseExpression(in string) (hpredicate, error) {
+// The custom functions take no argument and are compared to float64 constants.
+func parseExpression(in string, custom map[string]MetricFunc) (hpredicate, error) {
+	functions := map[string]interface{}{
+		"LatencyAtQuantileMS": latencyAtQuantile,
+		"LatencyP50MS":        latencyP50,
+		"LatencyP75MS":        latencyP75,
+		"NetworkErrorRatio":   networkErrorRatio,
+		"ResponseCodeRatio":   responseCodeRatio,
+		"ResponseCode":        responseCode,
+		"RequestRate":         requestRate,
+		"ConcurrentRequests":  concurrentRequests,
+	}
+	for name, fn := range custom {
+		if _, ok := functions[name]; ok {
+			return nil, fmt.Errorf("function %v is already defined", name)
+		}
+		functions[name] = customFunction(fn)
+	}
+
 	p, err := predicate.NewParser(predicate.Def{
 		Operators: predicate.Operators{
 			AND: and,
@@ -21,12 +44,9 @@ func parseExpression(in string) (hpredicate, error) {
 			LE:  le,
 			GT:  gt,
 			GE:  ge,
+			NOT: not,
 		},
-		Functions: map[string]interface{}{
-			"LatencyAtQuantileMS": latencyAtQuantile,
-			"NetworkErrorRatio":   networkErrorRatio,
-			"ResponseCodeRatio":   responseCodeRatio,
-		},
+		Functions: functions,
 	})
 	if err != nil {
 		return nil, err
@@ -56,6 +76,14 @@ func latencyAtQuantile(quantile float64) toInt {
 	}
 }
 
+func latencyP50() toInt {
+	return latencyAtQuantile(50)
+}
+
+func latencyP75() toInt {
+	return latencyAtQuantile(75)
+}
+
 func networkErrorRatio() toFloat64 {
 	return func(c *CircuitBreaker) float64 {
 		return c.metrics.NetworkErrorRatio()
@@ -68,6 +96,39 @@ func responseCodeRatio(startA, endA, startB, endB int) toFloat64 {
 	}
 }
 
+// responseCode returns the number of responses with the status code
+func responseCode(code int) toInt {
+	return func(c *CircuitBreaker) int {
+		return int(c.metrics.StatusCodesCounts()[code])
+	}
+}
+
+// requestRate returns the number of requests per second
+func requestRate() toFloat64 {
+	return func(c *CircuitBreaker) float64 {
+		window := c.metrics.CounterWindowSize().Seconds()
+		if window == 0 {
+			return 0
+		}
+		return float64(c.metrics.TotalCount()) / window
+	}
+}
+
+// concurrentRequests returns the number of requests being served
+func concurrentRequests() toInt {
+	return func(c *CircuitBreaker) int {
+		return int(atomic.LoadInt64(&c.inflight))
+	}
+}
+
+func customFunction(fn MetricFunc) func() toFloat64 {
+	return func() toFloat64 {
+		return func(c *CircuitBreaker) float64 {
+			return fn(c.metrics)
+		}
+	}
+}
+
 // or returns predicate by joining the passed predicates with logical 'or'
 func or(fns ...hpredicate) hpredicate {
 	return func(c *CircuitBreaker) bool {
@@ -4,9 +4,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/heebyunglee/oxy/memmetrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/vulcand/oxy/memmetrics"
 )
 
 func TestTripped(t *testing.T) {
@@ -45,6 +45,37 @@ func TestTripped(t *testing.T) {
 			metrics:    statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 500, Count: 4}),
 			expected:   false,
 		},
+		{
+			expression: "LatencyP50MS() > 50 && LatencyP75MS() > 50",
+			metrics:    statsLatencyAtQuantile(50, time.Millisecond*51),
+			expected:   true,
+		},
+		{
+			expression: "ResponseCode(429) > 5",
+			metrics:    statsResponseCodes(statusCode{Code: 200, Count: 5}, statusCode{Code: 429, Count: 6}),
+			expected:   true,
+		},
+		{
+			expression: "ResponseCode(429) > 5",
+			metrics:    statsResponseCodes(statusCode{Code: 200, Count: 6}, statusCode{Code: 500, Count: 6}),
+			expected:   false,
+		},
+		{
+			// 11 requests in a 10 seconds window
+			expression: "RequestRate() > 1.0",
+			metrics:    statsResponseCodes(statusCode{Code: 200, Count: 11}),
+			expected:   true,
+		},
+		{
+			expression: "!(NetworkErrorRatio() > 0.5)",
+			metrics:    statsNetErrors(0.6),
+			expected:   false,
+		},
+		{
+			expression: "!(NetworkErrorRatio() > 0.5)",
+			metrics:    statsNetErrors(0.4),
+			expected:   true,
+		},
 		{
 			// quantile not defined
 			expression: "LatencyAtQuantileMS(40.0) > 50",
@@ -58,7 +89,7 @@ func TestTripped(t *testing.T) {
 		t.Run(test.expression, func(t *testing.T) {
 			t.Parallel()
 
-			p, err := parseExpression(test.expression)
+			p, err := parseExpression(test.expression, nil)
 			require.NoError(t, err)
 			require.NotNil(t, p)
 
@@ -66,3 +97,38 @@ func TestTripped(t *testing.T) {
 		})
 	}
 }
+
+func TestConcurrentRequests(t *testing.T) {
+	p, err := parseExpression("ConcurrentRequests() >= 3", nil)
+	require.NoError(t, err)
+
+	assert.False(t, p(&CircuitBreaker{inflight: 2}))
+	assert.True(t, p(&CircuitBreaker{inflight: 3}))
+}
+
+func TestCustomFunction(t *testing.T) {
+	serverErrors := func(m *memmetrics.RTMetrics) float64 {
+		var count int64
+		for code, c := range m.StatusCodesCounts() {
+			if code >= 500 {
+				count += c
+			}
+		}
+		return float64(count)
+	}
+
+	cb, err := New(nil, "ServerErrors() > 2.0", Function("ServerErrors", serverErrors))
+	require.NoError(t, err)
+
+	cb.metrics = statsResponseCodes(statusCode{Code: 502, Count: 2}, statusCode{Code: 503, Count: 1})
+	assert.True(t, cb.condition(cb))
+
+	cb.metrics = statsResponseCodes(statusCode{Code: 502, Count: 2}, statusCode{Code: 200, Count: 1})
+	assert.False(t, cb.condition(cb))
+
+	_, err = New(nil, "ServerErrors() > 2.0")
+	assert.Error(t, err)
+
+	_, err = New(nil, "NetworkErrorRatio() > 2.0", Function("NetworkErrorRatio", serverErrors))
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package cbreaker
 
 import (
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/mailgun/timetools"
@@ -13,6 +14,10 @@ import (
 //
 //   allowedRequestsRatio = 0.5 * (Now() - Start())/Duration
 //
+// or, with a ramp, admitting every request with a probability going linearly from the ramp start to 1:
+//
+//   admissionProbability = from + (1 - from) * (Now() - Start())/Duration
+//
 type ratioController struct {
 	duration time.Duration
 	start    time.Time
@@ -20,6 +25,10 @@ type ratioController struct {
 	allowed  int
 	denied   int
 
+	ramp   bool
+	from   float64
+	random func() float64
+
 	log *log.Logger
 }
 
@@ -37,8 +46,20 @@ func (r *ratioController) String() string {
 	return fmt.Sprintf("RatioController(target=%f, current=%f, allowed=%d, denied=%d)", r.targetRatio(), r.computeRatio(r.allowed, r.denied), r.allowed, r.denied)
 }
 
+// newRampController creates a controller admitting the requests with a probability ramping up from the given one
+func newRampController(tm timetools.TimeProvider, rampUp time.Duration, from float64, log *log.Logger) *ratioController {
+	r := newRatioController(tm, rampUp, log)
+	r.ramp = true
+	r.from = from
+	r.random = rand.Float64
+	return r
+}
+
 func (r *ratioController) allowRequest() bool {
 	r.log.Debugf("%v", r)
+	if r.ramp {
+		return r.admitRequest()
+	}
 	t := r.targetRatio()
 	// This condition answers the question - would we satisfy the target ratio if we allow this request?
 	e := r.computeRatio(r.allowed+1, r.denied)
@@ -52,6 +73,29 @@ func (r *ratioController) allowRequest() bool {
 	return false
 }
 
+// admitRequest admits the request with the probability of the ramp
+func (r *ratioController) admitRequest() bool {
+	if r.random() < r.admissionProbability() {
+		r.allowed++
+		r.log.Debugf("%v allowed", r)
+		return true
+	}
+	r.denied++
+	r.log.Debugf("%v denied", r)
+	return false
+}
+
+func (r *ratioController) admissionProbability() float64 {
+	if r.duration <= 0 {
+		return 1
+	}
+	p := r.from + (1-r.from)*float64(r.tm.UtcNow().Sub(r.start))/float64(r.duration)
+	if p > 1 {
+		return 1
+	}
+	return p
+}
+
 func (r *ratioController) computeRatio(allowed, denied int) float64 {
 	if denied+allowed == 0 {
 		return 0
@@ -60,6 +104,9 @@ func (r *ratioController) computeRatio(allowed, denied int) float64 {
 }
 
 func (r *ratioController) targetRatio() float64 {
+	if r.ramp {
+		return r.admissionProbability()
+	}
 	// Here's why it's 0.5:
 	// We are watching the following ratio
 	// ratio = a / (a + d)
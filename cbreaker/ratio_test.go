@@ -49,3 +49,32 @@ func round(val float64, roundOn float64, places int) float64 {
 	}
 	return round / pow
 }
+
+func TestRecoveryRamp(t *testing.T) {
+	clock := testutils.GetClock()
+	duration := 10 * time.Second
+	rc := newRampController(clock, duration, 0.2, log.StandardLogger())
+	rc.random = func() float64 { return 0.5 }
+
+	assert.InDelta(t, 0.2, rc.targetRatio(), 1e-9)
+	assert.False(t, rc.allowRequest())
+
+	clock.CurrentTime = clock.CurrentTime.Add(duration / 2)
+	assert.InDelta(t, 0.6, rc.targetRatio(), 1e-9)
+	assert.True(t, rc.allowRequest())
+
+	clock.CurrentTime = clock.CurrentTime.Add(duration)
+	assert.Equal(t, 1.0, rc.targetRatio())
+}
+
+func TestRecoveryRampAdmission(t *testing.T) {
+	clock := testutils.GetClock()
+	rc := newRampController(clock, 10*time.Second, 0.3, log.StandardLogger())
+
+	// about 30% of the requests are admitted at the start of the ramp
+	allowed, denied := 0, 0
+	for i := 0; i < 10000; i++ {
+		sendRequest(&allowed, &denied, rc)
+	}
+	assert.InDelta(t, 0.3, float64(allowed)/10000, 0.03)
+}
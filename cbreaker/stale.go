@@ -0,0 +1,226 @@
+package cbreaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+// NewJSONFallback creates a new ResponseFallback answering with the JSON encoding of v
+func NewJSONFallback(statusCode int, v interface{}) (*ResponseFallback, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponseFallback(Response{StatusCode: statusCode, ContentType: "application/json", Body: body})
+}
+
+// Stale stale model
+type Stale struct {
+	// MaxAge is how long a response can be served once recorded, no limit if 0
+	MaxAge time.Duration
+	// MaxEntries is the number of responses kept, the oldest ones are evicted first, defaults to 1000
+	MaxEntries int
+	// MaxBodyBytes is the size of the largest response body kept, defaults to 1MB
+	MaxBodyBytes int64
+	// Fallback handles the requests without a stale response, answers 503 by default
+	Fallback http.Handler
+}
+
+// StaleFallback fallback handler serving the last successful response to the same GET request.
+// The responses are recorded by the handler returned by Wrap:
+//
+//	stale, _ := cbreaker.NewStaleFallback(cbreaker.Stale{MaxAge: time.Hour})
+//	cb, _ := cbreaker.New(stale.Wrap(fwd), expression, cbreaker.Fallback(stale))
+type StaleFallback struct {
+	s Stale
+
+	m       *sync.Mutex
+	entries map[string]*staleEntry
+	order   []string
+
+	clock timetools.TimeProvider
+
+	log *log.Logger
+}
+
+type staleEntry struct {
+	code     int
+	header   http.Header
+	body     []byte
+	recorded time.Time
+}
+
+// NewStaleFallbackWithLogger creates a new StaleFallback
+func NewStaleFallbackWithLogger(s Stale, l *log.Logger) (*StaleFallback, error) {
+	if s.MaxAge < 0 {
+		return nil, fmt.Errorf("max age should be >= 0")
+	}
+	if s.MaxEntries == 0 {
+		s.MaxEntries = 1000
+	}
+	if s.MaxEntries < 0 {
+		return nil, fmt.Errorf("max entries should be > 0")
+	}
+	if s.MaxBodyBytes == 0 {
+		s.MaxBodyBytes = 1048576
+	}
+	if s.Fallback == nil {
+		s.Fallback = defaultFallback
+	}
+	return &StaleFallback{
+		s:       s,
+		m:       &sync.Mutex{},
+		entries: make(map[string]*staleEntry),
+		clock:   &timetools.RealTime{},
+		log:     l,
+	}, nil
+}
+
+// NewStaleFallback creates a new StaleFallback
+func NewStaleFallback(s Stale) (*StaleFallback, error) {
+	return NewStaleFallbackWithLogger(s, log.StandardLogger())
+}
+
+// Wrap returns a handler recording the successful responses of next to GET requests
+func (f *StaleFallback) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rw := &staleRecorder{ResponseWriter: w, maxBodyBytes: f.s.MaxBodyBytes}
+		next.ServeHTTP(rw, req)
+		if rw.code == http.StatusOK && !rw.overflow {
+			f.record(staleKey(req), rw)
+		}
+	})
+}
+
+func (f *StaleFallback) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.log.Level >= log.DebugLevel {
+		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/fallback/stale: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/fallback/stale: completed ServeHttp on request")
+	}
+
+	e := f.lookup(req)
+	if e == nil {
+		f.s.Fallback.ServeHTTP(w, req)
+		return
+	}
+
+	utils.CopyHeaders(w.Header(), e.header)
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.Header().Add("Warning", `110 - "Response is Stale"`)
+	w.WriteHeader(e.code)
+	if req.Method == http.MethodHead {
+		return
+	}
+	_, err := w.Write(e.body)
+	if err != nil {
+		f.log.Errorf("vulcand/oxy/fallback/stale: failed to write response, err: %v", err)
+	}
+}
+
+func (f *StaleFallback) lookup(req *http.Request) *staleEntry {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	e, ok := f.entries[staleKey(req)]
+	if !ok {
+		return nil
+	}
+	if f.s.MaxAge > 0 && f.clock.UtcNow().Sub(e.recorded) > f.s.MaxAge {
+		return nil
+	}
+	return e
+}
+
+func (f *StaleFallback) record(key string, rw *staleRecorder) {
+	header := make(http.Header)
+	utils.CopyHeaders(header, rw.Header())
+	e := &staleEntry{code: rw.code, header: header, body: rw.body.Bytes(), recorded: f.clock.UtcNow()}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if _, ok := f.entries[key]; ok {
+		f.removeFromOrder(key)
+	}
+	f.entries[key] = e
+	f.order = append(f.order, key)
+	for len(f.order) > f.s.MaxEntries {
+		delete(f.entries, f.order[0])
+		f.order = f.order[1:]
+	}
+}
+
+func (f *StaleFallback) removeFromOrder(key string) {
+	for i, k := range f.order {
+		if k == key {
+			f.order = append(f.order[:i], f.order[i+1:]...)
+			return
+		}
+	}
+}
+
+func staleKey(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// staleRecorder keeps a copy of the response while writing it
+type staleRecorder struct {
+	http.ResponseWriter
+	code         int
+	body         bytes.Buffer
+	maxBodyBytes int64
+	overflow     bool
+}
+
+func (r *staleRecorder) WriteHeader(code int) {
+	if r.code != 0 {
+		return
+	}
+	// informational responses are sent as they are, the final response follows
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		r.ResponseWriter.WriteHeader(code)
+		return
+	}
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *staleRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(b)) > r.maxBodyBytes {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client
+func (r *staleRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
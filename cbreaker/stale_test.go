@@ -0,0 +1,103 @@
+package cbreaker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestJSONFallback(t *testing.T) {
+	fallback, err := NewJSONFallback(http.StatusServiceUnavailable, map[string]string{"error": "degraded"})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	fallback.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error": "degraded"}`, w.Body.String())
+}
+
+func TestStaleFallback(t *testing.T) {
+	status := http.StatusOK
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte("hello " + req.URL.Path))
+	})
+
+	clock := testutils.GetClock()
+
+	stale, err := NewStaleFallback(Stale{MaxAge: time.Minute})
+	require.NoError(t, err)
+	stale.clock = clock
+
+	cb, err := New(stale.Wrap(handler), triggerNetRatio, Clock(clock), Fallback(stale))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cb)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL + "/a")
+	require.NoError(t, err)
+
+	// errors are not recorded
+	status = http.StatusInternalServerError
+	_, _, err = testutils.Get(srv.URL + "/a")
+	require.NoError(t, err)
+
+	cb.setState(StateTripped, clock.UtcNow().Add(defaultFallbackDuration))
+
+	re, body, err := testutils.Get(srv.URL + "/a")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello /a", string(body))
+	assert.Equal(t, "text/plain", re.Header.Get("Content-Type"))
+	assert.NotEmpty(t, re.Header.Get("Warning"))
+
+	re, _, err = testutils.Get(srv.URL + "/b")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	re, _, err = testutils.Post(srv.URL + "/a")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute + time.Second)
+	re, _, err = testutils.Get(srv.URL + "/a")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+}
+
+func TestStaleFallbackLimits(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path))
+	})
+
+	stale, err := NewStaleFallback(Stale{MaxEntries: 2, MaxBodyBytes: 3})
+	require.NoError(t, err)
+
+	recorder := stale.Wrap(handler)
+	for _, path := range []string{"/a", "/b", "/c", "/long"} {
+		recorder.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+	}
+
+	for path, code := range map[string]int{"/a": 503, "/b": 200, "/c": 200, "/long": 503} {
+		w := httptest.NewRecorder()
+		stale.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+		assert.Equal(t, code, w.Code, path)
+	}
+}
+
+func TestStaleFallbackValidation(t *testing.T) {
+	_, err := NewStaleFallback(Stale{MaxAge: -1})
+	assert.Error(t, err)
+
+	_, err = NewStaleFallback(Stale{MaxEntries: -1})
+	assert.Error(t, err)
+}
@@ -0,0 +1,286 @@
+/*
+Package chain composes oxy handlers into a chain of named stages in front of a final handler.
+
+The stages are listed from the outermost one, the first to see the requests, to the innermost one, wrapping the
+final handler. Each stage is built by a Constructor from the handler it wraps. Stages can be inserted, removed,
+replaced and moved while the chain serves requests: the chain is rebuilt and swapped atomically, the requests
+in flight complete on the previous handlers.
+
+Examples of a chain:
+
+	fwd, _ := forward.New()
+
+	c, _ := chain.New(fwd,
+		chain.Stage{Name: "trace", Constructor: func(next http.Handler) (http.Handler, error) {
+			return trace.New(next, os.Stdout)
+		}},
+		chain.Stage{Name: "limit", Constructor: func(next http.Handler) (http.Handler, error) {
+			return connlimit.New(next, extractor, 10)
+		}},
+		chain.Stage{Name: "breaker", Constructor: func(next http.Handler) (http.Handler, error) {
+			return cbreaker.New(next, "NetworkErrorRatio() > 0.5")
+		}},
+	)
+
+	// buffer the requests to retry them, right in front of the forwarder
+	c.InsertAfter("breaker", "buffer", func(next http.Handler) (http.Handler, error) {
+		return buffer.New(next, buffer.Retry(`IsNetworkError() && Attempts() < 2`))
+	})
+
+	http.ListenAndServe(":8080", c)
+
+The constructors are called again every time the chain is rebuilt, so that stateful stages such as circuit
+breakers and limiters start over. A constructor can keep the state by returning the same handler, rewired
+to the new next handler with its Wrap method.
+*/
+package chain
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Constructor builds the handler of a stage from the handler it wraps
+type Constructor func(next http.Handler) (http.Handler, error)
+
+// Func returns a constructor from a plain middleware function
+func Func(f func(next http.Handler) http.Handler) Constructor {
+	return func(next http.Handler) (http.Handler, error) {
+		return f(next), nil
+	}
+}
+
+// Stage is a named stage of a chain
+type Stage struct {
+	Name        string
+	Constructor Constructor
+}
+
+// Chain serves the requests through its stages and its final handler
+type Chain struct {
+	mtx     *sync.Mutex
+	stages  []Stage
+	final   http.Handler
+	handler atomic.Value // holds a holder
+}
+
+// holder lets atomic.Value store handlers of any type
+type holder struct {
+	http.Handler
+}
+
+// New returns a new chain serving the requests through the stages, the first stage being the outermost one
+func New(final http.Handler, stages ...Stage) (*Chain, error) {
+	c := &Chain{
+		mtx:   &sync.Mutex{},
+		final: final,
+	}
+	if err := c.update(append([]Stage{}, stages...)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ServeHTTP serves the request through the current stages
+func (c *Chain) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.handler.Load().(holder).ServeHTTP(w, req)
+}
+
+// Then builds the stages in front of another final handler, e.g. to share the stages between routes.
+// The returned handler is not updated when the chain changes.
+func (c *Chain) Then(final http.Handler) (http.Handler, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return build(c.stages, final)
+}
+
+// Clone returns an independent chain with the same stages in front of another final handler
+func (c *Chain) Clone(final http.Handler) (*Chain, error) {
+	return New(final, c.Stages()...)
+}
+
+// Wrap sets the final handler of the chain
+func (c *Chain) Wrap(final http.Handler) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	h, err := build(c.stages, final)
+	if err != nil {
+		return err
+	}
+	c.final = final
+	c.handler.Store(holder{h})
+	return nil
+}
+
+// Stages returns the stages of the chain, from the outermost one
+func (c *Chain) Stages() []Stage {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]Stage{}, c.stages...)
+}
+
+// Names returns the names of the stages of the chain, from the outermost one
+func (c *Chain) Names() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	names := make([]string, len(c.stages))
+	for i, s := range c.stages {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// Append adds an innermost stage, right in front of the final handler
+func (c *Chain) Append(name string, con Constructor) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.insert(len(c.stages), Stage{Name: name, Constructor: con})
+}
+
+// Prepend adds an outermost stage
+func (c *Chain) Prepend(name string, con Constructor) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.insert(0, Stage{Name: name, Constructor: con})
+}
+
+// InsertBefore adds a stage in front of the stage named mark
+func (c *Chain) InsertBefore(mark, name string, con Constructor) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i, err := c.indexOf(mark)
+	if err != nil {
+		return err
+	}
+	return c.insert(i, Stage{Name: name, Constructor: con})
+}
+
+// InsertAfter adds a stage behind the stage named mark
+func (c *Chain) InsertAfter(mark, name string, con Constructor) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i, err := c.indexOf(mark)
+	if err != nil {
+		return err
+	}
+	return c.insert(i+1, Stage{Name: name, Constructor: con})
+}
+
+// Replace replaces the constructor of a stage, keeping its position
+func (c *Chain) Replace(name string, con Constructor) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i, err := c.indexOf(name)
+	if err != nil {
+		return err
+	}
+	stages := append([]Stage{}, c.stages...)
+	stages[i] = Stage{Name: name, Constructor: con}
+	return c.update(stages)
+}
+
+// Remove removes a stage
+func (c *Chain) Remove(name string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i, err := c.indexOf(name)
+	if err != nil {
+		return err
+	}
+	stages := append([]Stage{}, c.stages[:i]...)
+	return c.update(append(stages, c.stages[i+1:]...))
+}
+
+// MoveBefore moves a stage in front of the stage named mark
+func (c *Chain) MoveBefore(name, mark string) error {
+	return c.move(name, mark, 0)
+}
+
+// MoveAfter moves a stage behind the stage named mark
+func (c *Chain) MoveAfter(name, mark string) error {
+	return c.move(name, mark, 1)
+}
+
+func (c *Chain) move(name, mark string, offset int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if name == mark {
+		return fmt.Errorf("can not move stage %v relative to itself", name)
+	}
+	i, err := c.indexOf(name)
+	if err != nil {
+		return err
+	}
+	if _, err := c.indexOf(mark); err != nil {
+		return err
+	}
+	s := c.stages[i]
+	stages := append([]Stage{}, c.stages[:i]...)
+	stages = append(stages, c.stages[i+1:]...)
+	j := offset
+	for k := range stages {
+		if stages[k].Name == mark {
+			j += k
+			break
+		}
+	}
+	stages = append(stages[:j], append([]Stage{s}, stages[j:]...)...)
+	return c.update(stages)
+}
+
+func (c *Chain) insert(i int, s Stage) error {
+	stages := append([]Stage{}, c.stages[:i]...)
+	stages = append(stages, s)
+	return c.update(append(stages, c.stages[i:]...))
+}
+
+// update builds the stages and swaps the handler, the chain is left untouched on errors
+func (c *Chain) update(stages []Stage) error {
+	h, err := build(stages, c.final)
+	if err != nil {
+		return err
+	}
+	c.stages = stages
+	c.handler.Store(holder{h})
+	return nil
+}
+
+func (c *Chain) indexOf(name string) (int, error) {
+	for i, s := range c.stages {
+		if s.Name == name {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("stage %v not found", name)
+}
+
+func build(stages []Stage, final http.Handler) (http.Handler, error) {
+	if final == nil {
+		return nil, fmt.Errorf("final handler can not be nil")
+	}
+	seen := make(map[string]bool, len(stages))
+	for _, s := range stages {
+		if s.Name == "" {
+			return nil, fmt.Errorf("stage name can not be empty")
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate stage %v", s.Name)
+		}
+		if s.Constructor == nil {
+			return nil, fmt.Errorf("stage %v has no constructor", s.Name)
+		}
+		seen[s.Name] = true
+	}
+
+	h := final
+	for i := len(stages) - 1; i >= 0; i-- {
+		next, err := stages[i].Constructor(h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build stage %v: %v", stages[i].Name, err)
+		}
+		h = next
+	}
+	return h, nil
+}
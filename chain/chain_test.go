@@ -0,0 +1,160 @@
+package chain
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heebyunglee/oxy/buffer"
+	"github.com/heebyunglee/oxy/cbreaker"
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// tag appends the name of the stage to the X-Stages header of the request
+func tag(name string) Constructor {
+	return Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.Header.Add("X-Stages", name)
+			next.ServeHTTP(w, req)
+		})
+	})
+}
+
+var final = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(strings.Join(req.Header["X-Stages"], ",")))
+})
+
+func stages(h http.Handler) string {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rw.Body.String()
+}
+
+func TestOrder(t *testing.T) {
+	c, err := New(final, Stage{Name: "a", Constructor: tag("a")}, Stage{Name: "b", Constructor: tag("b")})
+	require.NoError(t, err)
+	assert.Equal(t, "a,b", stages(c))
+
+	require.NoError(t, c.Append("c", tag("c")))
+	require.NoError(t, c.Prepend("z", tag("z")))
+	assert.Equal(t, "z,a,b,c", stages(c))
+
+	require.NoError(t, c.InsertBefore("b", "x", tag("x")))
+	require.NoError(t, c.InsertAfter("b", "y", tag("y")))
+	assert.Equal(t, "z,a,x,b,y,c", stages(c))
+	assert.Equal(t, []string{"z", "a", "x", "b", "y", "c"}, c.Names())
+
+	require.NoError(t, c.Remove("x"))
+	require.NoError(t, c.Replace("y", tag("Y")))
+	assert.Equal(t, "z,a,b,Y,c", stages(c))
+
+	require.NoError(t, c.MoveBefore("c", "z"))
+	assert.Equal(t, "c,z,a,b,Y", stages(c))
+	require.NoError(t, c.MoveAfter("c", "y"))
+	assert.Equal(t, "z,a,b,Y,c", stages(c))
+	require.NoError(t, c.MoveAfter("z", "a"))
+	assert.Equal(t, "a,z,b,Y,c", stages(c))
+}
+
+func TestErrors(t *testing.T) {
+	_, err := New(nil)
+	assert.Error(t, err)
+
+	_, err = New(final, Stage{Name: "a", Constructor: tag("a")}, Stage{Name: "a", Constructor: tag("a")})
+	assert.Error(t, err)
+
+	_, err = New(final, Stage{Name: "a"})
+	assert.Error(t, err)
+
+	c, err := New(final, Stage{Name: "a", Constructor: tag("a")})
+	require.NoError(t, err)
+
+	assert.Error(t, c.Append("a", tag("a")))
+	assert.Error(t, c.Append("", tag("a")))
+	assert.Error(t, c.Remove("b"))
+	assert.Error(t, c.InsertBefore("b", "c", tag("c")))
+	assert.Error(t, c.MoveBefore("a", "a"))
+	assert.Error(t, c.Wrap(nil))
+
+	// failing constructors leave the chain untouched
+	err = c.Append("b", func(next http.Handler) (http.Handler, error) {
+		return nil, fmt.Errorf("boom")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a"}, c.Names())
+	assert.Equal(t, "a", stages(c))
+}
+
+func TestThenAndClone(t *testing.T) {
+	c, err := New(final, Stage{Name: "a", Constructor: tag("a")})
+	require.NoError(t, err)
+
+	other := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("other:" + strings.Join(req.Header["X-Stages"], ",")))
+	})
+
+	h, err := c.Then(other)
+	require.NoError(t, err)
+	clone, err := c.Clone(other)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Append("b", tag("b")))
+	require.NoError(t, clone.Append("c", tag("c")))
+
+	assert.Equal(t, "a,b", stages(c))
+	assert.Equal(t, "other:a", stages(h))
+	assert.Equal(t, "other:a,c", stages(clone))
+
+	require.NoError(t, c.Wrap(other))
+	assert.Equal(t, "other:a,b", stages(c))
+}
+
+func TestOxyStages(t *testing.T) {
+	attempts := 0
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.Write([]byte("hello"))
+	})
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	c, err := New(redirect,
+		Stage{Name: "breaker", Constructor: func(next http.Handler) (http.Handler, error) {
+			return cbreaker.New(next, "NetworkErrorRatio() > 0.5")
+		}},
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Append("buffer", func(next http.Handler) (http.Handler, error) {
+		return buffer.New(next, buffer.MaxRequestBodyBytes(2))
+	}))
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	re, _, err = testutils.Post(srv.URL, testutils.Body("too large"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+	assert.Equal(t, 1, attempts)
+
+	require.NoError(t, c.Remove("buffer"))
+	re, _, err = testutils.Post(srv.URL, testutils.Body("too large"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, 2, attempts)
+}
@@ -0,0 +1,427 @@
+/*
+Package compress provides http.Handler middleware compressing the responses.
+
+The encoding is negotiated with the Accept-Encoding header of the request. Only the responses with an allowed
+content type and a body of at least a minimum size are compressed: the body is buffered until the minimum size is
+reached, the smaller responses are sent as they are. The responses already encoded by the backends are left untouched.
+The compressing writers are pooled.
+
+gzip and deflate are supported out of the box, other encodings such as brotli can be plugged in.
+
+Examples of a compressing middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Header().Set("Content-Type", "text/html")
+	  w.Write([]byte(page))
+	})
+
+	// Compress the text, JSON, JavaScript and XML responses of 1KB or more
+	compress.New(handler)
+
+	// Prefer brotli, using github.com/andybalholm/brotli
+	compress.New(handler, compress.Encoding("br", func(w io.Writer) (compress.Writer, error) {
+	  return brotli.NewWriter(w), nil
+	}))
+*/
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMinSize is the default minimum size of the compressed responses, in bytes
+	DefaultMinSize = 1024
+)
+
+// DefaultContentTypes are the content types compressed by default, "text/*" matches all the text types
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// Writer is a compressing writer, it is reset to be reused for other responses
+type Writer interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoding is a supported content encoding with its pool of writers
+type encoding struct {
+	name      string
+	newWriter func(w io.Writer) (Writer, error)
+	pool      *sync.Pool
+}
+
+func (e *encoding) get(w io.Writer) (Writer, error) {
+	if cw, ok := e.pool.Get().(Writer); ok {
+		cw.Reset(w)
+		return cw, nil
+	}
+	return e.newWriter(w)
+}
+
+func (e *encoding) put(cw Writer) {
+	e.pool.Put(cw)
+}
+
+// Compress compresses the responses of the next handler
+type Compress struct {
+	next http.Handler
+
+	level        int
+	minSize      int
+	contentTypes []string
+	custom       []*encoding
+	encodings    []*encoding
+
+	log *log.Logger
+}
+
+// New returns a new compressing middleware. New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*Compress, error) {
+	c := &Compress{
+		next:         next,
+		level:        gzip.DefaultCompression,
+		minSize:      DefaultMinSize,
+		contentTypes: DefaultContentTypes,
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(c); err != nil {
+			return nil, err
+		}
+	}
+
+	level := c.level
+	c.encodings = append(c.custom,
+		newEncoding("gzip", func(w io.Writer) (Writer, error) {
+			return gzip.NewWriterLevel(w, level)
+		}),
+		newEncoding("deflate", func(w io.Writer) (Writer, error) {
+			return flate.NewWriter(w, level)
+		}),
+	)
+	return c, nil
+}
+
+func newEncoding(name string, newWriter func(w io.Writer) (Writer, error)) *encoding {
+	return &encoding{name: name, newWriter: newWriter, pool: &sync.Pool{}}
+}
+
+type optSetter func(c *Compress) error
+
+// Level sets the compression level of gzip and deflate, from flate.BestSpeed to flate.BestCompression,
+// defaults to flate.DefaultCompression
+func Level(level int) optSetter {
+	return func(c *Compress) error {
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return fmt.Errorf("invalid compression level %d", level)
+		}
+		c.level = level
+		return nil
+	}
+}
+
+// MinSize sets the minimum size of the compressed responses, in bytes, defaults to DefaultMinSize
+func MinSize(bytes int) optSetter {
+	return func(c *Compress) error {
+		if bytes < 0 {
+			return fmt.Errorf("min size should be >= 0 got %d", bytes)
+		}
+		c.minSize = bytes
+		return nil
+	}
+}
+
+// ContentTypes sets the media types of the compressed responses, "text/*" matches all the text types.
+// Defaults to DefaultContentTypes
+func ContentTypes(types ...string) optSetter {
+	return func(c *Compress) error {
+		if len(types) == 0 {
+			return fmt.Errorf("provide at least one content type")
+		}
+		c.contentTypes = make([]string, len(types))
+		for i, t := range types {
+			c.contentTypes[i] = strings.ToLower(t)
+		}
+		return nil
+	}
+}
+
+// Encoding adds an encoding, e.g. "br" for brotli. The added encodings are preferred to gzip and deflate
+// when the client accepts several encodings with the same quality.
+func Encoding(name string, newWriter func(w io.Writer) (Writer, error)) optSetter {
+	return func(c *Compress) error {
+		if name == "" || newWriter == nil {
+			return fmt.Errorf("encoding needs a name and a writer")
+		}
+		c.custom = append(c.custom, newEncoding(strings.ToLower(name), newWriter))
+		return nil
+	}
+}
+
+// Logger defines the logger the compressing middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(c *Compress) error {
+		c.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by compressing handler.
+func (c *Compress) Wrap(next http.Handler) {
+	c.next = next
+}
+
+func (c *Compress) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/compress: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/compress: completed ServeHttp on request")
+	}
+
+	// the ranges refer to the uncompressed body
+	if req.Method == http.MethodHead || req.Header.Get("Range") != "" {
+		c.next.ServeHTTP(w, req)
+		return
+	}
+
+	cw := &compressWriter{ResponseWriter: w, c: c, enc: c.negotiate(req.Header.Get("Accept-Encoding"))}
+	defer cw.close()
+	c.next.ServeHTTP(cw, req)
+}
+
+// negotiate returns the encoding with the highest quality accepted by the client, nil if none
+func (c *Compress) negotiate(accept string) *encoding {
+	if accept == "" {
+		return nil
+	}
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, q := parseCoding(part)
+		if name != "" {
+			qualities[name] = q
+		}
+	}
+
+	var best *encoding
+	var bestQ float64
+	for _, e := range c.encodings {
+		q, ok := qualities[e.name]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// parseCoding parses a coding of the Accept-Encoding header, e.g. "gzip;q=0.8"
+func parseCoding(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	name := strings.ToLower(strings.TrimSpace(params[0]))
+	q := 1.0
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "q=") {
+			v, err := strconv.ParseFloat(p[2:], 64)
+			if err != nil {
+				return "", 0
+			}
+			q = v
+		}
+	}
+	return name, q
+}
+
+func (c *Compress) allowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.contentTypes {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter buffers the beginning of the body until it can decide whether to compress the response
+type compressWriter struct {
+	http.ResponseWriter
+	c   *Compress
+	enc *encoding
+
+	code       int
+	headerSet  bool
+	decided    bool
+	buf        []byte
+	compressor Writer
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.headerSet {
+		return
+	}
+	// informational responses are sent as they are, the final response follows
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.headerSet = true
+	cw.code = code
+
+	h := cw.Header()
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		cw.decide(false)
+		return
+	}
+	if ct := h.Get("Content-Type"); ct != "" && !cw.c.allowed(ct) {
+		cw.decide(false)
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < cw.c.minSize {
+			cw.decide(false)
+		}
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.headerSet {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) >= cw.c.minSize {
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if cw.compressor != nil {
+		return cw.compressor.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the header, compressing the body if asked to and if the response qualifies,
+// then sends the buffered body
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	h := cw.Header()
+
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	eligible := h.Get("Content-Encoding") == "" && cw.c.allowed(h.Get("Content-Type"))
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if compress && eligible && cw.enc != nil {
+		compressor, err := cw.enc.get(cw.ResponseWriter)
+		if err != nil {
+			cw.c.log.Errorf("vulcand/oxy/compress: failed to create %v writer, err: %v", cw.enc.name, err)
+		} else {
+			cw.compressor = compressor
+			h.Del("Content-Length")
+			h.Del("Accept-Ranges")
+			h.Set("Content-Encoding", cw.enc.name)
+			if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("Etag", "W/"+etag)
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.code)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.compressor != nil {
+		_, err = cw.compressor.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close sends the small buffered responses and terminates the compressed ones
+func (cw *compressWriter) close() {
+	if !cw.headerSet {
+		return
+	}
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.compressor != nil {
+		if err := cw.compressor.Close(); err != nil {
+			cw.c.log.Errorf("vulcand/oxy/compress: failed to close %v writer, err: %v", cw.enc.name, err)
+		}
+		cw.enc.put(cw.compressor)
+		cw.compressor = nil
+	}
+}
+
+// Flush sends any buffered data to the client, the streamed responses are compressed regardless of their size
+func (cw *compressWriter) Flush() {
+	if !cw.headerSet {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.compressor != nil {
+		cw.compressor.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true) when the client connection has gone away
+func (cw *compressWriter) CloseNotify() <-chan bool {
+	if cn, ok := cw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", cw.ResponseWriter)
+}
@@ -0,0 +1,174 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+var page = strings.Repeat("hello, world! ", 200)
+
+func respond(contentType, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Header().Set("Etag", `"v1"`)
+		w.Write([]byte(body))
+	})
+}
+
+func serve(h http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	r, err := gzip.NewReader(strings.NewReader(string(b)))
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestGzip(t *testing.T) {
+	c, err := New(respond("text/html; charset=utf-8", page))
+	require.NoError(t, err)
+
+	rw := serve(c, "deflate;q=0.5, gzip")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "gzip", rw.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rw.Header().Get("Vary"))
+	assert.Equal(t, `W/"v1"`, rw.Header().Get("Etag"))
+	assert.True(t, rw.Body.Len() < len(page))
+	assert.Equal(t, page, gunzip(t, rw.Body.Bytes()))
+
+	// the pooled writers are reused
+	rw = serve(c, "gzip")
+	assert.Equal(t, page, gunzip(t, rw.Body.Bytes()))
+}
+
+func TestDeflate(t *testing.T) {
+	c, err := New(respond("application/json", page), Level(flate.BestSpeed))
+	require.NoError(t, err)
+
+	rw := serve(c, "gzip;q=0.2, deflate")
+	assert.Equal(t, "deflate", rw.Header().Get("Content-Encoding"))
+	out, err := ioutil.ReadAll(flate.NewReader(rw.Body))
+	require.NoError(t, err)
+	assert.Equal(t, page, string(out))
+}
+
+func TestNotCompressed(t *testing.T) {
+	tests := []struct {
+		desc           string
+		handler        http.Handler
+		acceptEncoding string
+		vary           bool
+	}{
+		{desc: "no accept encoding", handler: respond("text/plain", page), vary: true},
+		{desc: "unsupported encoding", handler: respond("text/plain", page), acceptEncoding: "br", vary: true},
+		{desc: "refused encodings", handler: respond("text/plain", page), acceptEncoding: "gzip;q=0, *;q=0", vary: true},
+		{desc: "too small", handler: respond("text/plain", "hello"), acceptEncoding: "gzip", vary: true},
+		{desc: "content type", handler: respond("image/png", page), acceptEncoding: "gzip"},
+		{
+			desc: "already encoded",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Encoding", "identity")
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(page))
+			}),
+			acceptEncoding: "gzip",
+		},
+	}
+	for _, test := range tests {
+		c, err := New(test.handler)
+		require.NoError(t, err)
+
+		rw := serve(c, test.acceptEncoding)
+		assert.NotEqual(t, "gzip", rw.Header().Get("Content-Encoding"), test.desc)
+		assert.Equal(t, test.vary, rw.Header().Get("Vary") != "", test.desc)
+	}
+}
+
+func TestSniffedContentType(t *testing.T) {
+	c, err := New(respond("", "<html><body>"+page+"</body></html>"))
+	require.NoError(t, err)
+
+	rw := serve(c, "gzip")
+	assert.Equal(t, "gzip", rw.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+}
+
+func TestStatusAndContentLength(t *testing.T) {
+	c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "2800")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, page)
+	}), MinSize(10))
+	require.NoError(t, err)
+
+	rw := serve(c, "gzip")
+	assert.Equal(t, http.StatusCreated, rw.Code)
+	assert.Empty(t, rw.Header().Get("Content-Length"))
+	assert.Equal(t, page, gunzip(t, rw.Body.Bytes()))
+}
+
+func TestStreaming(t *testing.T) {
+	c, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "data: 2\n\n")
+	}))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	// the transport transparently decompresses the responses it asked to be gzipped
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.True(t, re.Uncompressed)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", string(body))
+}
+
+func TestCustomEncoding(t *testing.T) {
+	c, err := New(respond("text/plain", page), Encoding("x-test", func(w io.Writer) (Writer, error) {
+		return gzip.NewWriter(w), nil
+	}))
+	require.NoError(t, err)
+
+	rw := serve(c, "gzip, x-test")
+	assert.Equal(t, "x-test", rw.Header().Get("Content-Encoding"))
+	assert.Equal(t, page, gunzip(t, rw.Body.Bytes()))
+}
+
+func TestOptionsValidation(t *testing.T) {
+	_, err := New(nil, Level(10))
+	assert.Error(t, err)
+
+	_, err = New(nil, MinSize(-1))
+	assert.Error(t, err)
+
+	_, err = New(nil, ContentTypes())
+	assert.Error(t, err)
+
+	_, err = New(nil, Encoding("", nil))
+	assert.Error(t, err)
+}
@@ -2,12 +2,15 @@
 package connlimit
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/heebyunglee/oxy/utils"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 // ConnLimiter tracks concurrent connection per token
@@ -20,8 +23,17 @@ type ConnLimiter struct {
 	totalConnections int64
 	next             http.Handler
 
+	maxTotalConnections int64
+	totalErrHandler     utils.ErrorHandler
+
+	queueDepth   int
+	queueTimeout time.Duration
+	waiters      map[string][]*waiter
+
 	errHandler utils.ErrorHandler
+	inflight   utils.Inflight
 	log        *log.Logger
+	logger     utils.Logger
 }
 
 // New creates a new ConnLimiter
@@ -34,6 +46,7 @@ func New(next http.Handler, extract utils.SourceExtractor, maxConnections int64,
 		extract:        extract,
 		maxConnections: maxConnections,
 		connections:    make(map[string]int64),
+		waiters:        make(map[string][]*waiter),
 		next:           next,
 		log:            log.StandardLogger(),
 	}
@@ -48,6 +61,9 @@ func New(next http.Handler, extract utils.SourceExtractor, maxConnections int64,
 			log: cl.log,
 		}
 	}
+	if cl.logger == nil {
+		cl.logger = utils.NewLogrusLogger(cl.log)
+	}
 	return cl, nil
 }
 
@@ -61,20 +77,126 @@ func Logger(l *log.Logger) ConnLimitOption {
 	}
 }
 
+// StructuredLogger defines the structured logger the connection limiter logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by Logger.
+func StructuredLogger(l utils.Logger) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		cl.logger = l
+		return nil
+	}
+}
+
 // Wrap sets the next handler to be called by connexion limiter handler.
 func (cl *ConnLimiter) Wrap(h http.Handler) {
 	cl.next = h
 }
 
+// Connections returns the number of connections of every source currently connected
+func (cl *ConnLimiter) Connections() map[string]int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	connections := make(map[string]int64, len(cl.connections))
+	for token, count := range cl.connections {
+		connections[token] = count
+	}
+	return connections
+}
+
+// TotalConnections returns the number of connections of all the sources together
+func (cl *ConnLimiter) TotalConnections() int64 {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.totalConnections
+}
+
+// SourceConnections is the number of connections of a source
+type SourceConnections struct {
+	Source      string `json:"source"`
+	Connections int64  `json:"connections"`
+	// Queued is the number of requests of the source waiting for a connection, see Queue
+	Queued int `json:"queued"`
+}
+
+// Snapshot is the state of the connections of the limiter at a point in time
+type Snapshot struct {
+	Total  int64 `json:"total"`
+	Queued int   `json:"queued"`
+	// Sources is the number of sources connected
+	Sources int `json:"sources"`
+	// Top are the sources with the most connections, in decreasing order
+	Top []SourceConnections `json:"top"`
+}
+
+// TopConnections returns the n sources with the most connections, in decreasing order,
+// e.g. to spot abusive clients. n <= 0 returns all of them.
+func (cl *ConnLimiter) TopConnections(n int) []SourceConnections {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.topConnections(n)
+}
+
+// Snapshot returns the total number of connections along with the n sources with the most connections,
+// n <= 0 lists all of them
+func (cl *ConnLimiter) Snapshot(n int) Snapshot {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	s := Snapshot{
+		Total:   cl.totalConnections,
+		Sources: len(cl.connections),
+		Top:     cl.topConnections(n),
+	}
+	for _, waiters := range cl.waiters {
+		s.Queued += len(waiters)
+	}
+	return s
+}
+
+func (cl *ConnLimiter) topConnections(n int) []SourceConnections {
+	top := make([]SourceConnections, 0, len(cl.connections))
+	for token, count := range cl.connections {
+		top = append(top, SourceConnections{Source: token, Connections: count, Queued: len(cl.waiters[token])})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Connections != top[j].Connections {
+			return top[i].Connections > top[j].Connections
+		}
+		return top[i].Source < top[j].Source
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete, the queued ones included. It returns the error of the context if it is done first.
+func (cl *ConnLimiter) Shutdown(ctx context.Context) error {
+	return cl.inflight.Shutdown(ctx)
+}
+
 func (cl *ConnLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !cl.inflight.Acquire() {
+		cl.errHandler.ServeHTTP(w, r, utils.ErrShuttingDown)
+		return
+	}
+	defer cl.inflight.Release()
+
+	logger := utils.RequestLogger(r, cl.logger)
 	token, amount, err := cl.extract.Extract(r)
 	if err != nil {
-		cl.log.Errorf("failed to extract source of the connection: %v", err)
+		logger.Errorf("failed to extract source of the connection: %v", err)
 		cl.errHandler.ServeHTTP(w, r, err)
 		return
 	}
-	if err := cl.acquire(token, amount); err != nil {
-		cl.log.Debugf("limiting request source %s: %v", token, err)
+	if err := cl.acquireOrWait(r, token, amount); err != nil {
+		logger.Debugf("limiting request source %s: %v", token, err)
+		if _, ok := err.(*MaxTotalConnError); ok && cl.totalErrHandler != nil {
+			cl.totalErrHandler.ServeHTTP(w, r, err)
+			return
+		}
 		cl.errHandler.ServeHTTP(w, r, err)
 		return
 	}
@@ -88,9 +210,8 @@ func (cl *ConnLimiter) acquire(token string, amount int64) error {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
 
-	connections := cl.connections[token]
-	if connections >= cl.maxConnections {
-		return &MaxConnError{max: cl.maxConnections}
+	if err := cl.limitError(token); err != nil {
+		return err
 	}
 
 	cl.connections[token] += amount
@@ -98,6 +219,17 @@ func (cl *ConnLimiter) acquire(token string, amount int64) error {
 	return nil
 }
 
+// limitError returns the error of the limit a new connection of the source would exceed, if any
+func (cl *ConnLimiter) limitError(token string) error {
+	if cl.connections[token] >= cl.maxConnections {
+		return &MaxConnError{max: cl.maxConnections}
+	}
+	if cl.maxTotalConnections > 0 && cl.totalConnections >= cl.maxTotalConnections {
+		return &MaxTotalConnError{max: cl.maxTotalConnections}
+	}
+	return nil
+}
+
 func (cl *ConnLimiter) release(token string, amount int64) {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
@@ -105,12 +237,126 @@ func (cl *ConnLimiter) release(token string, amount int64) {
 	cl.connections[token] -= amount
 	cl.totalConnections -= amount
 
+	cl.admitWaiters(token)
+	if cl.maxTotalConnections > 0 {
+		// the connection released may be the one the other sources were waiting for
+		for other := range cl.waiters {
+			cl.admitWaiters(other)
+		}
+	}
+
 	// Otherwise it would grow forever
 	if cl.connections[token] == 0 {
 		delete(cl.connections, token)
 	}
 }
 
+// waiter is a request queued until a connection of its source is released
+type waiter struct {
+	amount   int64
+	admitted chan struct{}
+}
+
+// acquireOrWait acquires the connections, queueing the request if the source is at its limit and the queue has room
+func (cl *ConnLimiter) acquireOrWait(req *http.Request, token string, amount int64) error {
+	err := cl.acquire(token, amount)
+	if err == nil || cl.queueDepth == 0 {
+		return err
+	}
+
+	w, err := cl.enqueue(token, amount)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(cl.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.admitted:
+		return nil
+	case <-timer.C:
+		err = cl.queueTimeoutError(token)
+	case <-req.Context().Done():
+		err = req.Context().Err()
+	}
+
+	if cl.dequeue(token, w) {
+		return err
+	}
+	// the connections were acquired for the request while giving up, use them
+	return nil
+}
+
+func (cl *ConnLimiter) enqueue(token string, amount int64) (*waiter, error) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	// a connection may have been released in the meantime
+	err := cl.limitError(token)
+	if err == nil && len(cl.waiters[token]) == 0 {
+		w := &waiter{amount: amount, admitted: make(chan struct{})}
+		cl.admit(token, w)
+		return w, nil
+	}
+	if len(cl.waiters[token]) >= cl.queueDepth {
+		if err == nil {
+			err = &MaxConnError{max: cl.maxConnections}
+		}
+		return nil, err
+	}
+	w := &waiter{amount: amount, admitted: make(chan struct{})}
+	cl.waiters[token] = append(cl.waiters[token], w)
+	return w, nil
+}
+
+// queueTimeoutError returns the error of the limit that kept a queued request of the source waiting
+func (cl *ConnLimiter) queueTimeoutError(token string) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if err := cl.limitError(token); err != nil {
+		return err
+	}
+	return &MaxConnError{max: cl.maxConnections}
+}
+
+// dequeue removes the waiter from the queue, it returns false if the waiter was already admitted
+func (cl *ConnLimiter) dequeue(token string, w *waiter) bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	waiters := cl.waiters[token]
+	for i, candidate := range waiters {
+		if candidate == w {
+			cl.waiters[token] = append(waiters[:i], waiters[i+1:]...)
+			if len(cl.waiters[token]) == 0 {
+				delete(cl.waiters, token)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// admitWaiters acquires the released connections for the queued requests, in order of arrival
+func (cl *ConnLimiter) admitWaiters(token string) {
+	for len(cl.waiters[token]) > 0 && cl.limitError(token) == nil {
+		w := cl.waiters[token][0]
+		cl.waiters[token] = cl.waiters[token][1:]
+		cl.admit(token, w)
+	}
+	if len(cl.waiters[token]) == 0 {
+		delete(cl.waiters, token)
+	}
+}
+
+func (cl *ConnLimiter) admit(token string, w *waiter) {
+	cl.connections[token] += w.amount
+	cl.totalConnections += w.amount
+	close(w.admitted)
+}
+
 // MaxConnError maximum connections reached error
 type MaxConnError struct {
 	max int64
@@ -120,6 +366,15 @@ func (m *MaxConnError) Error() string {
 	return fmt.Sprintf("max connections reached: %d", m.max)
 }
 
+// MaxTotalConnError maximum total connections reached error
+type MaxTotalConnError struct {
+	max int64
+}
+
+func (m *MaxTotalConnError) Error() string {
+	return fmt.Sprintf("max total connections reached: %d", m.max)
+}
+
 // ConnErrHandler connection limiter error handler
 type ConnErrHandler struct {
 	log *log.Logger
@@ -137,12 +392,56 @@ func (e *ConnErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if _, ok := err.(*MaxTotalConnError); ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	utils.DefaultHandler.ServeHTTP(w, req, err)
 }
 
 // ConnLimitOption connection limit option type
 type ConnLimitOption func(l *ConnLimiter) error
 
+// Queue makes the connection limiter queue up to depth requests per source once the source reaches
+// its maximum number of connections, instead of rejecting them. A queued request is served as soon as
+// a connection of its source is released, or rejected once it waited for timeout.
+func Queue(depth int, timeout time.Duration) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		if depth < 1 {
+			return fmt.Errorf("queue depth should be >= 1")
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("queue timeout should be > 0")
+		}
+		cl.queueDepth = depth
+		cl.queueTimeout = timeout
+		return nil
+	}
+}
+
+// MaxTotalConnections limits the connections of all the sources together, on top of the limit per source,
+// so that a few sources cannot exhaust the capacity of the next handler.
+// The requests over this limit are answered with 503 by default.
+func MaxTotalConnections(max int64) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		if max < 1 {
+			return fmt.Errorf("max total connections should be >= 1")
+		}
+		cl.maxTotalConnections = max
+		return nil
+	}
+}
+
+// TotalErrorHandler sets the error handler of the requests over the total connections limit,
+// they are handled by the error handler of the server otherwise
+func TotalErrorHandler(h utils.ErrorHandler) ConnLimitOption {
+	return func(cl *ConnLimiter) error {
+		cl.totalErrHandler = h
+		return nil
+	}
+}
+
 // ErrorHandler sets error handler of the server
 func ErrorHandler(h utils.ErrorHandler) ConnLimitOption {
 	return func(cl *ConnLimiter) error {
@@ -1,10 +1,12 @@
 package connlimit
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -60,6 +62,208 @@ func TestHitLimitAndRelease(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 }
 
+func TestQueueAdmitsOnRelease(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- req.Header.Get("Id")
+		<-release
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 1, Queue(1, time.Second))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	codes := make(chan int, 2)
+	get := func(id string) {
+		re, _, errGet := testutils.Get(srv.URL, testutils.Header("Limit", "a"), testutils.Header("Id", id))
+		if errGet != nil {
+			codes <- 0
+			return
+		}
+		codes <- re.StatusCode
+	}
+
+	go get("1")
+	assert.Equal(t, "1", <-started)
+
+	go get("2")
+	waitForQueue(t, cl, "a", 1)
+
+	// the queue is full
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// the queued request is served once the first one is done
+	release <- true
+	assert.Equal(t, "2", <-started)
+	release <- true
+
+	assert.Equal(t, http.StatusOK, <-codes)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestQueueTimeout(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 1, Queue(10, 10*time.Millisecond))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	done := make(chan bool)
+	go func() {
+		testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+		done <- true
+	}()
+	<-started
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	waitForQueue(t, cl, "a", 0)
+
+	close(release)
+	<-done
+}
+
+func TestQueueValidation(t *testing.T) {
+	_, err := New(nil, headerLimit, 1, Queue(0, time.Second))
+	assert.Error(t, err)
+
+	_, err = New(nil, headerLimit, 1, Queue(1, 0))
+	assert.Error(t, err)
+}
+
+func TestMaxTotalConnections(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Wait") != "" {
+			started <- true
+			<-release
+		}
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 2, MaxTotalConnections(2))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	done := make(chan bool)
+	for _, source := range []string{"a", "b"} {
+		go func(source string) {
+			testutils.Get(srv.URL, testutils.Header("Limit", source), testutils.Header("Wait", "yes"))
+			done <- true
+		}(source)
+		<-started
+	}
+
+	// c is under its own limit but the pool is exhausted
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Limit", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	release <- true
+	<-done
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Limit", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	release <- true
+	<-done
+}
+
+func TestTotalErrorHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	totalErrHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("pool exhausted"))
+	})
+
+	cl, err := New(handler, headerLimit, 1, MaxTotalConnections(1), TotalErrorHandler(totalErrHandler))
+	require.NoError(t, err)
+
+	require.NoError(t, cl.acquire("a", 1))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	req.Header.Set("Limit", "b")
+	cl.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, "pool exhausted", w.Body.String())
+
+	// the limit per source keeps the default handler
+	w = httptest.NewRecorder()
+	req.Header.Set("Limit", "a")
+	cl.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestQueueWaitsForTotalConnections(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 1, MaxTotalConnections(1), Queue(1, time.Second))
+	require.NoError(t, err)
+
+	require.NoError(t, cl.acquire("a", 1))
+
+	codes := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		req.Header.Set("Limit", "b")
+		cl.ServeHTTP(w, req)
+		codes <- w.Code
+	}()
+	waitForQueue(t, cl, "b", 1)
+
+	// releasing a connection of another source admits the queued request
+	cl.release("a", 1)
+	assert.Equal(t, http.StatusOK, <-codes)
+}
+
+func TestMaxTotalConnectionsValidation(t *testing.T) {
+	_, err := New(nil, headerLimit, 1, MaxTotalConnections(0))
+	assert.Error(t, err)
+}
+
+func waitForQueue(t *testing.T, cl *ConnLimiter, token string, length int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		cl.mutex.Lock()
+		queued := len(cl.waiters[token])
+		cl.mutex.Unlock()
+		if queued == length {
+			return
+		}
+		require.True(t, time.Now().Before(deadline), "queue never reached %d requests", length)
+		time.Sleep(time.Millisecond)
+	}
+}
+
 // We've hit the limit and were able to proceed once the request has completed
 func TestCustomHandlers(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -109,3 +313,112 @@ func faultyExtractor(_ *http.Request) (string, int64, error) {
 
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
+
+func TestSnapshot(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 2, Queue(1, 10*time.Second))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(0), cl.TotalConnections())
+	assert.Equal(t, Snapshot{Top: []SourceConnections{}}, cl.Snapshot(10))
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	done := make(chan bool)
+	for _, source := range []string{"a", "b", "a"} {
+		go func(source string) {
+			testutils.Get(srv.URL, testutils.Header("Limit", source))
+			done <- true
+		}(source)
+		<-started
+	}
+
+	// the third request of a waits in the queue
+	go func() {
+		testutils.Get(srv.URL, testutils.Header("Limit", "a"))
+		done <- true
+	}()
+	for i := 0; i < 100 && cl.Snapshot(0).Queued == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	assert.Equal(t, int64(3), cl.TotalConnections())
+	assert.Equal(t, []SourceConnections{{Source: "a", Connections: 2, Queued: 1}}, cl.TopConnections(1))
+	assert.Equal(t, Snapshot{
+		Total:   3,
+		Queued:  1,
+		Sources: 2,
+		Top:     []SourceConnections{{Source: "a", Connections: 2, Queued: 1}, {Source: "b", Connections: 1}},
+	}, cl.Snapshot(0))
+
+	release <- true
+	<-started
+	for i := 0; i < 3; i++ {
+		release <- true
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	assert.Equal(t, int64(0), cl.TotalConnections())
+	assert.Empty(t, cl.TopConnections(0))
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Wait") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("hello"))
+	})
+
+	cl, err := New(handler, headerLimit, 1, Queue(1, time.Second))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(cl)
+	defer srv.Close()
+
+	done := make(chan int, 2)
+	get := func() {
+		re, _, errGet := testutils.Get(srv.URL, testutils.Header("Limit", "a"), testutils.Header("Wait", "yes"))
+		require.NoError(t, errGet)
+		done <- re.StatusCode
+	}
+	go get()
+	<-started
+
+	// the second request is queued until the first one completes
+	go get()
+	waitForQueue(t, cl, "a", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, cl.Shutdown(ctx))
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Limit", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- cl.Shutdown(context.Background())
+	}()
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+
+	assert.NoError(t, <-shutdown)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+}
@@ -0,0 +1,251 @@
+/*
+Package dnscache provides a caching resolver for the names of the backends.
+
+The addresses are kept for a TTL, the Go resolver not exposing the TTLs of the records. Once expired, an entry is
+still served for a grace period while it is refreshed in the background, so that the requests don't wait for the
+resolver, and the last known addresses are kept during the grace period if the refresh fails, so that the backends
+remain reachable during a resolver outage. The failed lookups are cached as well, for a shorter TTL.
+
+Example of a forwarder resolving the backends through a cache:
+
+	cache, _ := dnscache.New(dnscache.TTL(30 * time.Second))
+	fwd, _ := forward.New(forward.DialResolver(cache))
+*/
+package dnscache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the cache
+const (
+	DefaultTTL         = time.Minute
+	DefaultNegativeTTL = 5 * time.Second
+	DefaultGracePeriod = 5 * time.Minute
+)
+
+// Resolver looks up the addresses of a host, as net.Resolver does
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Cache is a Resolver caching the addresses returned by another Resolver
+type Cache struct {
+	resolver    Resolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+	gracePeriod time.Duration
+	clock       timetools.TimeProvider
+
+	mutex   *sync.Mutex
+	entries map[string]*entry
+
+	log *log.Logger
+}
+
+// entry holds the result of the last lookup of a host
+type entry struct {
+	// ready is closed once the first lookup is done
+	ready chan struct{}
+
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+
+	// refreshing is set while the entry is refreshed in the background, not before retry after a failure
+	refreshing bool
+	retry      time.Time
+}
+
+// New returns a new cache, resolving the names with net.DefaultResolver unless set otherwise.
+// New() function supports optional functional arguments
+func New(setters ...optSetter) (*Cache, error) {
+	c := &Cache{
+		resolver:    net.DefaultResolver,
+		ttl:         DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		gracePeriod: DefaultGracePeriod,
+		mutex:       &sync.Mutex{},
+		entries:     make(map[string]*entry),
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.clock == nil {
+		c.clock = &timetools.RealTime{}
+	}
+	return c, nil
+}
+
+type optSetter func(c *Cache) error
+
+// TTL sets how long the addresses are cached, defaults to DefaultTTL
+func TTL(d time.Duration) optSetter {
+	return func(c *Cache) error {
+		if d <= 0 {
+			return fmt.Errorf("TTL should be > 0, got %v", d)
+		}
+		c.ttl = d
+		return nil
+	}
+}
+
+// NegativeTTL sets how long the failed lookups are cached, defaults to DefaultNegativeTTL. 0 disables the caching
+// of the failures. It is also the delay between the background refreshes of an entry failing to refresh.
+func NegativeTTL(d time.Duration) optSetter {
+	return func(c *Cache) error {
+		if d < 0 {
+			return fmt.Errorf("negative TTL can not be negative, got %v", d)
+		}
+		c.negativeTTL = d
+		return nil
+	}
+}
+
+// GracePeriod sets how long the expired addresses are served while they are refreshed, defaults to
+// DefaultGracePeriod. 0 makes the lookups wait for the resolver once the addresses expired.
+func GracePeriod(d time.Duration) optSetter {
+	return func(c *Cache) error {
+		if d < 0 {
+			return fmt.Errorf("grace period can not be negative, got %v", d)
+		}
+		c.gracePeriod = d
+		return nil
+	}
+}
+
+// Upstream sets the resolver of the names, defaults to net.DefaultResolver
+func Upstream(r Resolver) optSetter {
+	return func(c *Cache) error {
+		if r == nil {
+			return fmt.Errorf("resolver can not be nil")
+		}
+		c.resolver = r
+		return nil
+	}
+}
+
+// Clock sets the time provider of the cache, used in tests
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(c *Cache) error {
+		c.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the cache will use.
+func Logger(l *log.Logger) optSetter {
+	return func(c *Cache) error {
+		c.log = l
+		return nil
+	}
+}
+
+// LookupIPAddr returns the addresses of the host, from the cache if they have not expired.
+// The IP addresses are returned as they are.
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	for {
+		c.mutex.Lock()
+		e, ok := c.entries[host]
+		if !ok {
+			e = c.add(host)
+		}
+		c.mutex.Unlock()
+
+		waited := false
+		select {
+		case <-e.ready:
+		default:
+			waited = true
+			select {
+			case <-e.ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		c.mutex.Lock()
+		now := c.clock.UtcNow()
+		switch {
+		case waited || now.Before(e.expires):
+			// the result of the lookup awaited is returned even if it is not cached
+			c.mutex.Unlock()
+			return e.addrs, e.err
+		case e.err == nil && now.Before(e.expires.Add(c.gracePeriod)):
+			if !e.refreshing && !now.Before(e.retry) {
+				e.refreshing = true
+				go c.lookup(host, e)
+			}
+			c.mutex.Unlock()
+			return e.addrs, nil
+		}
+		// too old to be served, the next iteration waits for a new lookup
+		if c.entries[host] == e {
+			delete(c.entries, host)
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// Len returns the number of cached hosts
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// add creates the entry of the host, looked up in the background, and forgets the entries too old to be served.
+// It has to be called with the mutex held.
+func (c *Cache) add(host string) *entry {
+	now := c.clock.UtcNow()
+	for h, e := range c.entries {
+		if !e.refreshing && !e.expires.IsZero() && !now.Before(e.expires.Add(c.gracePeriod)) {
+			delete(c.entries, h)
+		}
+	}
+
+	e := &entry{ready: make(chan struct{}), refreshing: true}
+	c.entries[host] = e
+	go c.lookup(host, e)
+	return e
+}
+
+// lookup resolves the host and updates its entry, the last known addresses are kept if it fails
+func (c *Cache) lookup(host string, e *entry) {
+	addrs, err := c.resolver.LookupIPAddr(context.Background(), host)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.clock.UtcNow()
+	first := e.expires.IsZero()
+	e.refreshing = false
+	switch {
+	case err == nil:
+		e.addrs, e.err, e.expires = addrs, nil, now.Add(c.ttl)
+	case !first && e.err == nil:
+		c.log.Warnf("vulcand/oxy/dnscache: failed to refresh %v, keeping the last addresses: %v", host, err)
+		e.retry = now.Add(c.negativeTTL)
+	default:
+		c.log.Debugf("vulcand/oxy/dnscache: failed to resolve %v: %v", host, err)
+		e.addrs, e.err, e.expires = nil, err, now.Add(c.negativeTTL)
+	}
+	if first {
+		close(e.ready)
+	}
+}
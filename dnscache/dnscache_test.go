@@ -0,0 +1,224 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testResolver returns its addresses or its error, counting the lookups
+type testResolver struct {
+	mutex   sync.Mutex
+	lookups int
+	addrs   []net.IPAddr
+	err     error
+	block   chan struct{}
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookups++
+	return r.addrs, r.err
+}
+
+func (r *testResolver) set(addrs []net.IPAddr, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+func (r *testResolver) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lookups
+}
+
+// waitLookups waits for the background lookups
+func waitLookups(t *testing.T, r *testResolver, n int) {
+	for i := 0; i < 100 && r.count() < n; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.Equal(t, n, r.count())
+	// let the lookup update the entry
+	time.Sleep(10 * time.Millisecond)
+}
+
+func addrs(ips ...string) []net.IPAddr {
+	var out []net.IPAddr
+	for _, ip := range ips {
+		out = append(out, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return out
+}
+
+// testClock is a frozen clock safe for the background lookups
+type testClock struct {
+	mutex sync.Mutex
+	timetools.FreezedTime
+}
+
+func (c *testClock) UtcNow() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.FreezedTime.UtcNow()
+}
+
+func (c *testClock) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.FreezedTime.Sleep(d)
+}
+
+func newTestCache(t *testing.T, r *testResolver, setters ...optSetter) (*Cache, *testClock) {
+	clock := &testClock{FreezedTime: timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}}
+	c, err := New(append([]optSetter{Upstream(r), Clock(clock)}, setters...)...)
+	require.NoError(t, err)
+	return c, clock
+}
+
+func TestCache(t *testing.T) {
+	r := &testResolver{addrs: addrs("192.0.2.1")}
+	c, clock := newTestCache(t, r, TTL(time.Minute))
+
+	for i := 0; i < 3; i++ {
+		res, err := c.LookupIPAddr(context.Background(), "backend")
+		require.NoError(t, err)
+		assert.Equal(t, addrs("192.0.2.1"), res)
+	}
+	assert.Equal(t, 1, r.count())
+
+	// the expired addresses are served while they are refreshed
+	r.set(addrs("192.0.2.2"), nil)
+	clock.Sleep(2 * time.Minute)
+	res, err := c.LookupIPAddr(context.Background(), "backend")
+	require.NoError(t, err)
+	assert.Equal(t, addrs("192.0.2.1"), res)
+
+	waitLookups(t, r, 2)
+	res, err = c.LookupIPAddr(context.Background(), "backend")
+	require.NoError(t, err)
+	assert.Equal(t, addrs("192.0.2.2"), res)
+	assert.Equal(t, 2, r.count())
+}
+
+func TestRefreshFailure(t *testing.T) {
+	r := &testResolver{addrs: addrs("192.0.2.1")}
+	c, clock := newTestCache(t, r, TTL(time.Minute), NegativeTTL(10*time.Second), GracePeriod(5*time.Minute))
+
+	_, err := c.LookupIPAddr(context.Background(), "backend")
+	require.NoError(t, err)
+
+	// the last addresses are kept during the outage of the resolver
+	r.set(nil, &net.DNSError{Err: "server misbehaving", Name: "backend"})
+	clock.Sleep(2 * time.Minute)
+	res, err := c.LookupIPAddr(context.Background(), "backend")
+	require.NoError(t, err)
+	assert.Equal(t, addrs("192.0.2.1"), res)
+	waitLookups(t, r, 2)
+
+	// the refresh is retried after the negative TTL only
+	res, err = c.LookupIPAddr(context.Background(), "backend")
+	require.NoError(t, err)
+	assert.Equal(t, addrs("192.0.2.1"), res)
+	assert.Equal(t, 2, r.count())
+
+	clock.Sleep(10 * time.Second)
+	_, err = c.LookupIPAddr(context.Background(), "backend")
+	require.NoError(t, err)
+	waitLookups(t, r, 3)
+
+	// the addresses are dropped once the grace period is over
+	clock.Sleep(5 * time.Minute)
+	_, err = c.LookupIPAddr(context.Background(), "backend")
+	assert.Error(t, err)
+	assert.Equal(t, 4, r.count())
+}
+
+func TestNegativeCache(t *testing.T) {
+	r := &testResolver{err: &net.DNSError{Err: "no such host", Name: "backend"}}
+	c, clock := newTestCache(t, r, NegativeTTL(10*time.Second))
+
+	for i := 0; i < 2; i++ {
+		_, err := c.LookupIPAddr(context.Background(), "backend")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, r.count())
+
+	r.set(addrs("192.0.2.1"), nil)
+	clock.Sleep(10 * time.Second)
+	res, err := c.LookupIPAddr(context.Background(), "backend")
+	require.NoError(t, err)
+	assert.Equal(t, addrs("192.0.2.1"), res)
+	assert.Equal(t, 2, r.count())
+
+	// the failures are not cached without negative TTL
+	r = &testResolver{err: &net.DNSError{Err: "no such host", Name: "backend"}}
+	c, _ = newTestCache(t, r, NegativeTTL(0))
+	for i := 0; i < 2; i++ {
+		_, err := c.LookupIPAddr(context.Background(), "backend")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, r.count())
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	r := &testResolver{addrs: addrs("192.0.2.1"), block: make(chan struct{})}
+	c, _ := newTestCache(t, r)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.LookupIPAddr(context.Background(), "backend")
+			assert.NoError(t, err)
+			assert.Equal(t, addrs("192.0.2.1"), res)
+		}()
+	}
+
+	// the lookups give up with their context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.LookupIPAddr(ctx, "backend")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(r.block)
+	wg.Wait()
+	assert.Equal(t, 1, r.count())
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestIPAddresses(t *testing.T) {
+	r := &testResolver{}
+	c, _ := newTestCache(t, r)
+
+	res, err := c.LookupIPAddr(context.Background(), "2001:db8::1")
+	require.NoError(t, err)
+	assert.Equal(t, addrs("2001:db8::1"), res)
+	assert.Equal(t, 0, r.count())
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestOptions(t *testing.T) {
+	_, err := New(TTL(0))
+	assert.Error(t, err)
+
+	_, err = New(NegativeTTL(-1))
+	assert.Error(t, err)
+
+	_, err = New(GracePeriod(-1))
+	assert.Error(t, err)
+
+	_, err = New(Upstream(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Headers carrying the client certificate of the requests to the backends
+const (
+	XForwardedTlsClientCert     = "X-Forwarded-Tls-Client-Cert"
+	XForwardedTlsClientCertInfo = "X-Forwarded-Tls-Client-Cert-Info"
+)
+
+// ClientCertOptions selects what the forwarder tells the backends about the certificate
+// the clients authenticated with, when the TLS connection is terminated by the proxy
+type ClientCertOptions struct {
+	// PEM forwards the certificate in PEM, URL-escaped, in PEMHeader
+	PEM bool
+	// PEMHeader defaults to X-Forwarded-Tls-Client-Cert
+	PEMHeader string
+
+	// Subject, SANs and Fingerprint forward the subject, the subject alternative names and the SHA-256 fingerprint
+	// of the certificate in InfoHeader, e.g. Subject="CN=client";SANs="a.example.com,10.0.0.1";Fingerprint="..."
+	// with URL-escaped values
+	Subject     bool
+	SANs        bool
+	Fingerprint bool
+	// InfoHeader defaults to X-Forwarded-Tls-Client-Cert-Info
+	InfoHeader string
+}
+
+// PassTLSClientCert forwards the certificate of the clients to the backends. The headers sent by the clients
+// are always removed, so that the backends can trust them.
+func PassTLSClientCert(opts ClientCertOptions) optSetter {
+	return func(f *Forwarder) error {
+		if !opts.PEM && !opts.Subject && !opts.SANs && !opts.Fingerprint {
+			return fmt.Errorf("the client certificate options forward nothing")
+		}
+		if opts.PEMHeader == "" {
+			opts.PEMHeader = XForwardedTlsClientCert
+		}
+		if opts.InfoHeader == "" {
+			opts.InfoHeader = XForwardedTlsClientCertInfo
+		}
+		f.httpForwarder.clientCert = &opts
+		return nil
+	}
+}
+
+// rewrite removes the client certificate headers of the request and sets them from the certificate of the connection
+func (o *ClientCertOptions) rewrite(req *http.Request) {
+	req.Header.Del(o.PEMHeader)
+	req.Header.Del(o.InfoHeader)
+
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := req.TLS.PeerCertificates[0]
+
+	if o.PEM {
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		req.Header.Set(o.PEMHeader, url.QueryEscape(string(block)))
+	}
+	if info := o.info(cert); info != "" {
+		req.Header.Set(o.InfoHeader, info)
+	}
+}
+
+func (o *ClientCertOptions) info(cert *x509.Certificate) string {
+	var fields []string
+	if o.Subject {
+		fields = append(fields, fmt.Sprintf("Subject=%q", url.QueryEscape(cert.Subject.String())))
+	}
+	if o.SANs {
+		fields = append(fields, fmt.Sprintf("SANs=%q", url.QueryEscape(strings.Join(subjectAltNames(cert), ","))))
+	}
+	if o.Fingerprint {
+		sum := sha256.Sum256(cert.Raw)
+		fields = append(fields, fmt.Sprintf("Fingerprint=%q", hex.EncodeToString(sum[:])))
+	}
+	return strings.Join(fields, ";")
+}
+
+// subjectAltNames returns the DNS names, email addresses, IP addresses and URIs of the certificate
+func subjectAltNames(cert *x509.Certificate) []string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
@@ -0,0 +1,101 @@
+package forward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"testing"
+
+	oxytestutils "github.com/heebyunglee/oxy/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestPassTLSClientCert(t *testing.T) {
+	var header http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(PassTLSClientCert(ClientCertOptions{PEM: true, Subject: true, SANs: true, Fingerprint: true}))
+	require.NoError(t, err)
+
+	proxy, err := oxytestutils.NewTLSTestServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}), oxytestutils.RequireClientCert())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	cert, err := proxy.ClientCertificate("client-a")
+	require.NoError(t, err)
+
+	re, _, err := oxytestutils.Get(proxy.URL,
+		oxytestutils.TLSConfig(proxy.ClientTLSConfig(cert)),
+		oxytestutils.Header(XForwardedTlsClientCertInfo, `Subject="CN=admin"`))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	escaped := header.Get(XForwardedTlsClientCert)
+	raw, err := url.QueryUnescape(escaped)
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(raw))
+	require.NotNil(t, block)
+	assert.Equal(t, cert.Certificate[0], block.Bytes)
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	assert.Equal(t, `Subject="CN%3Dclient-a%2CO%3Doxy";SANs="";Fingerprint="`+hex.EncodeToString(sum[:])+`"`,
+		header.Get(XForwardedTlsClientCertInfo))
+}
+
+func TestPassTLSClientCertSanitizes(t *testing.T) {
+	var header http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(PassTLSClientCert(ClientCertOptions{Subject: true, InfoHeader: "X-Client-Cert"}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the headers of a client without certificate never reach the backend
+	re, _, err := testutils.Get(proxy.URL,
+		testutils.Header("X-Client-Cert", `Subject="CN=admin"`),
+		testutils.Header(XForwardedTlsClientCert, "forged"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Empty(t, header.Get("X-Client-Cert"))
+	assert.Empty(t, header.Get(XForwardedTlsClientCert))
+}
+
+func TestPassTLSClientCertSANs(t *testing.T) {
+	ca, err := oxytestutils.NewTestCA()
+	require.NoError(t, err)
+	cert, err := ca.ServerCertificate("a.example.com", "10.0.0.1")
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	require.NoError(t, err)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+
+	o := &ClientCertOptions{SANs: true, PEMHeader: XForwardedTlsClientCert, InfoHeader: XForwardedTlsClientCertInfo}
+	o.rewrite(req)
+	assert.Equal(t, `SANs="a.example.com%2C10.0.0.1"`, req.Header.Get(XForwardedTlsClientCertInfo))
+
+	_, err = New(PassTLSClientCert(ClientCertOptions{}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,175 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// ConnectTunnel makes the forwarder handle the CONNECT requests by opening a TCP connection to the requested
+// host and splicing the bytes between the client and the host, acting as a forward proxy for HTTPS and other
+// protocols. The tunnels are restricted to the given ports, all ports are allowed if none is given.
+// The tunnels to the loopback, link-local, private and other internal addresses are refused unless their
+// network is allowed with ConnectAllowNetworks, so that the clients can not reach the internal services through
+// the proxy. The host names are resolved before they are checked and the tunnel is dialed to the checked address.
+// CONNECT requests are forwarded to the backend as any other request without this option.
+func ConnectTunnel(ports ...int) optSetter {
+	return func(f *Forwarder) error {
+		c := &connectTunnel{}
+		if len(ports) > 0 {
+			c.ports = make(map[int]bool, len(ports))
+			for _, p := range ports {
+				if p <= 0 || p > 65535 {
+					return fmt.Errorf("invalid CONNECT port %d", p)
+				}
+				c.ports[p] = true
+			}
+		}
+		f.httpForwarder.connect = c
+		return nil
+	}
+}
+
+// ConnectAllowNetworks lets the CONNECT tunnels reach the given networks, e.g. "10.0.0.0/8", that are refused
+// by default as internal addresses. Single IPs are accepted as well.
+func ConnectAllowNetworks(cidrs ...string) optSetter {
+	return func(f *Forwarder) error {
+		networks, err := utils.ParseIPRanges(cidrs...)
+		if err != nil {
+			return err
+		}
+		f.httpForwarder.connectAllowed = append(f.httpForwarder.connectAllowed, networks...)
+		return nil
+	}
+}
+
+// internalNetworks are the networks the CONNECT tunnels can not reach by default: unspecified, loopback,
+// link-local (cloud metadata services included), private and shared address space
+var internalNetworks, _ = utils.ParseIPRanges(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+// connectTunnel holds the settings of the CONNECT tunnels
+type connectTunnel struct {
+	ports map[int]bool
+}
+
+// allowedIP tells if a tunnel can be opened to the IP
+func allowedIP(ip net.IP, allowed utils.IPRanges) bool {
+	if allowed.Contains(ip) {
+		return true
+	}
+	return !internalNetworks.Contains(ip) && !ip.IsMulticast()
+}
+
+// resolveConnect returns the address with the first IP of its host a tunnel can be opened to
+func (f *httpForwarder) resolveConnect(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if allowedIP(ip.IP, f.connectAllowed) {
+			return net.JoinHostPort(ip.IP.String(), port), nil
+		}
+	}
+	return "", errConnectRefused
+}
+
+// errConnectRefused is the error of the tunnels to a host with no allowed address
+var errConnectRefused = fmt.Errorf("the tunnel is refused")
+
+// allowed tells if a tunnel can be opened to the address
+func (c *connectTunnel) allowed(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return false
+	}
+	return c.ports == nil || c.ports[p]
+}
+
+// isConnectRequest tells if the request is a CONNECT request the forwarder tunnels
+func (f *httpForwarder) isConnectRequest(req *http.Request) bool {
+	return f.connect != nil && req.Method == http.MethodConnect
+}
+
+// serveConnect establishes a tunnel between the client and the host of the CONNECT request
+func (f *httpForwarder) serveConnect(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
+	logger := f.requestLogger(req)
+
+	if !f.connect.allowed(req.Host) {
+		logger.Debugf("vulcand/oxy/forward/connect: refusing tunnel to %q", req.Host)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(http.StatusText(http.StatusForbidden)))
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		ctx.errHandler.ServeHTTP(w, req, fmt.Errorf("the response writer %T does not implement http.Hijacker", w))
+		return
+	}
+
+	dial := f.dialContext
+	if dial == nil {
+		dial = defaultDialer().DialContext
+	}
+	dialCtx := req.Context()
+	if f.upstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(dialCtx, f.upstreamTimeout)
+		defer cancel()
+	}
+
+	// the checked address is dialed so that the host can not resolve to another one in the meantime
+	addr, err := f.resolveConnect(dialCtx, req.Host)
+	if err == errConnectRefused {
+		logger.Debugf("vulcand/oxy/forward/connect: refusing tunnel to internal address %q", req.Host)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(http.StatusText(http.StatusForbidden)))
+		return
+	}
+	if err != nil {
+		logger.Errorf("vulcand/oxy/forward/connect: Error resolving %q: %v", req.Host, err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	targetConn, err := dial(dialCtx, "tcp", addr)
+	if err != nil {
+		logger.Errorf("vulcand/oxy/forward/connect: Error dialing %q: %v", req.Host, err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer targetConn.Close()
+
+	clientConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		logger.Errorf("vulcand/oxy/forward/connect: Failed to hijack responseWriter: %v", err)
+		ctx.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		logger.Debugf("vulcand/oxy/forward/connect: Failed to answer the client: %v", err)
+		return
+	}
+
+	// the client may have sent the first bytes of the tunnel along with the request
+	utils.Splice(clientConn, brw.Reader, targetConn)
+}
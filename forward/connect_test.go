@@ -0,0 +1,139 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer answers the bytes it reads until the client half-closes the connection
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// connect sends a CONNECT request for addr followed by payload and returns the connection and the response
+func connect(t *testing.T, proxy, addr, payload string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxy)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n%s", addr, addr, payload)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	return conn, br, res
+}
+
+func TestConnectTunnel(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	f, err := New(ConnectTunnel(), ConnectAllowNetworks("127.0.0.1"))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	conn, br, res := connect(t, proxy.Listener.Addr().String(), echo.Addr().String(), "early ")
+	defer conn.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, err = conn.Write([]byte("data"))
+	require.NoError(t, err)
+	conn.(*net.TCPConn).CloseWrite()
+
+	data, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "early data", string(data))
+}
+
+func TestConnectTunnelPorts(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, port, err := net.SplitHostPort(echo.Addr().String())
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	f, err := New(ConnectTunnel(p), ConnectAllowNetworks("127.0.0.1"))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	conn, _, res := connect(t, proxy.Listener.Addr().String(), echo.Addr().String(), "")
+	conn.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	conn, _, res = connect(t, proxy.Listener.Addr().String(), "127.0.0.1:1", "")
+	conn.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	_, err = New(ConnectTunnel(0))
+	assert.Error(t, err)
+}
+
+func TestConnectTunnelDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	f, err := New(ConnectTunnel(), ConnectAllowNetworks("127.0.0.0/8"))
+	require.NoError(t, err)
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	conn, _, res := connect(t, proxy.Listener.Addr().String(), addr, "")
+	conn.Close()
+	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
+
+func TestConnectTunnelInternalAddresses(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	_, port, err := net.SplitHostPort(echo.Addr().String())
+	require.NoError(t, err)
+
+	f, err := New(ConnectTunnel())
+	require.NoError(t, err)
+	proxy := httptest.NewServer(f)
+	defer proxy.Close()
+
+	for _, addr := range []string{
+		echo.Addr().String(),
+		net.JoinHostPort("localhost", port),
+		"169.254.169.254:80",
+		"[::1]:" + port,
+		"10.0.0.1:443",
+		"0.0.0.0:" + port,
+	} {
+		conn, _, res := connect(t, proxy.Listener.Addr().String(), addr, "")
+		conn.Close()
+		assert.Equal(t, http.StatusForbidden, res.StatusCode, addr)
+	}
+
+	_, err = New(ConnectAllowNetworks("not a network"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,196 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// IPFamily is an address family of the backends
+type IPFamily int
+
+// Address families
+const (
+	// IPAny dials the addresses in the order of the resolver
+	IPAny IPFamily = iota
+	IPv4
+	IPv6
+)
+
+// defaultFallbackDelay is the delay of net.Dialer before racing the fallback address family
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// Resolver looks up the addresses of the backends, as net.Resolver does
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dialContext returns the dial function of the tuned dialer
+func (o *transportOptions) dialContext() dialFunc {
+	d := &familyDialer{dialer: o.dialer, family: o.family, resolver: o.resolver}
+	if o.dialer.LocalAddr != nil {
+		// the local TCP address does not apply to the unix sockets
+		unix := *o.dialer
+		unix.LocalAddr = nil
+		d.unix = &unix
+	}
+	return d.DialContext
+}
+
+// familyDialer dials the preferred address family first, falling back to the other one.
+// The names are looked up with the resolver if any, the dialer resolving them otherwise.
+type familyDialer struct {
+	dialer   *net.Dialer
+	unix     *net.Dialer
+	family   IPFamily
+	resolver Resolver
+}
+
+type dialResult struct {
+	conn    net.Conn
+	err     error
+	primary bool
+}
+
+func (d *familyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.unix != nil && network == unixScheme {
+		return d.unix.DialContext(ctx, network, addr)
+	}
+	if network != "tcp" || (d.family == IPAny && d.resolver == nil) {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	if d.resolver == nil {
+		primary, fallback := "tcp4", "tcp6"
+		if d.family == IPv6 {
+			primary, fallback = fallback, primary
+		}
+		return d.race(ctx,
+			func(ctx context.Context) (net.Conn, error) { return d.dialer.DialContext(ctx, primary, addr) },
+			func(ctx context.Context) (net.Conn, error) { return d.dialer.DialContext(ctx, fallback, addr) })
+	}
+
+	ips, err := d.resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no addresses for %v", host)
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var v4, v6 []string
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(ip.String(), port))
+		} else {
+			v6 = append(v6, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	primary, fallback := v4, v6
+	if d.family == IPv6 || (d.family == IPAny && ips[0].IP.To4() == nil) {
+		primary, fallback = fallback, primary
+	}
+	if len(primary) == 0 {
+		return d.serial(network, fallback)(ctx)
+	}
+	if len(fallback) == 0 {
+		return d.serial(network, primary)(ctx)
+	}
+	return d.race(ctx, d.serial(network, primary), d.serial(network, fallback))
+}
+
+// serial returns a function dialing the addresses one after the other until one succeeds
+func (d *familyDialer) serial(network string, addrs []string) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		var err error
+		for _, addr := range addrs {
+			var conn net.Conn
+			conn, err = d.dialer.DialContext(ctx, network, addr)
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, err
+	}
+}
+
+// race dials the primary addresses, racing the fallback ones after the fallback delay or once the primary ones failed
+func (d *familyDialer) race(ctx context.Context, primary, fallback func(ctx context.Context) (net.Conn, error)) (net.Conn, error) {
+	if d.dialer.FallbackDelay < 0 {
+		conn, err := primary(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		if conn, errFallback := fallback(ctx); errFallback == nil {
+			return conn, nil
+		}
+		return nil, err
+	}
+
+	delay := d.dialer.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	dial := func(dial func(ctx context.Context) (net.Conn, error), primary bool) {
+		go func() {
+			conn, err := dial(ctx)
+			results <- dialResult{conn: conn, err: err, primary: primary}
+		}()
+	}
+	dial(primary, true)
+	pending, fallbackStarted := 1, false
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				dial(fallback, false)
+				pending, fallbackStarted = pending+1, true
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// the losing connection is closed if it completes anyway
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			if r.primary {
+				primaryErr = r.err
+			} else {
+				fallbackErr = r.err
+			}
+			if !fallbackStarted {
+				dial(fallback, false)
+				pending, fallbackStarted = pending+1, true
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
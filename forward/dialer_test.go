@@ -0,0 +1,134 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestFamilyDialerFallback(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+
+	// localhost has no IPv6 address or nothing listens on it
+	for _, delay := range []time.Duration{0, -1, 10 * time.Millisecond} {
+		d := &familyDialer{dialer: &net.Dialer{FallbackDelay: delay}, family: IPv6}
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		require.NoError(t, err, "delay %v", delay)
+		assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+		conn.Close()
+	}
+}
+
+func TestFamilyDialerErrors(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err)
+	l.Close()
+
+	for _, delay := range []time.Duration{0, -1} {
+		d := &familyDialer{dialer: &net.Dialer{FallbackDelay: delay}, family: IPv4}
+		_, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		assert.Error(t, err, "delay %v", delay)
+	}
+}
+
+func TestDialLocalAddr(t *testing.T) {
+	var remoteAddr string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		remoteAddr = req.RemoteAddr
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+	_, unixSocket, cleanup := newUnixSocketServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("unix"))
+	}))
+	defer cleanup()
+
+	f, err := New(DialLocalAddr("127.0.0.1"), DialPreferIPFamily(IPv6), DialFallbackDelay(50*time.Millisecond))
+	require.NoError(t, err)
+
+	for _, backend := range []string{srv.URL, "unix://" + unixSocket} {
+		backendURL := testutils.ParseURI(backend)
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = backendURL
+			f.ServeHTTP(w, req)
+		})
+		re, _, err := testutils.Get(proxy.URL)
+		proxy.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode, backend)
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+}
+
+func TestDialerOptions(t *testing.T) {
+	_, err := New(DialLocalAddr("not an ip"))
+	assert.Error(t, err)
+
+	_, err = New(DialPreferIPFamily(IPFamily(7)))
+	assert.Error(t, err)
+
+	_, err = New(DialContext(defaultDialer().DialContext), DialPreferIPFamily(IPv4))
+	assert.Error(t, err)
+}
+
+// staticResolver resolves all the names to its addresses
+type staticResolver []net.IPAddr
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if len(r) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	return r, nil
+}
+
+func TestDialResolver(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+	backendURL := testutils.ParseURI(srv.URL)
+	_, port, err := net.SplitHostPort(backendURL.Host)
+	require.NoError(t, err)
+	backendURL.Host = net.JoinHostPort("backend.invalid", port)
+
+	// the unreachable IPv6 address falls back to the IPv4 one
+	resolver := staticResolver{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}
+	f, err := New(DialResolver(resolver), DialPreferIPFamily(IPv6))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = backendURL
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	f, err = New(DialResolver(staticResolver{}))
+	require.NoError(t, err)
+
+	re, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+
+	_, err = New(DialResolver(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// FlushInterval is an alias of StreamingFlushInterval that enables streaming as well, see Stream.
+func FlushInterval(interval time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.stream = true
+		return StreamingFlushInterval(interval)(f)
+	}
+}
+
+// FlushBytes flushes the response to the client each time at least size bytes have been written
+// since the previous flush, independently of the flush interval.
+func FlushBytes(size int64) optSetter {
+	return func(f *Forwarder) error {
+		if size < 0 {
+			return errors.New("flush bytes should be >= 0")
+		}
+		f.httpForwarder.flushBytes = size
+		return nil
+	}
+}
+
+// byteFlushWriter flushes the underlying writer once enough bytes have been written
+type byteFlushWriter struct {
+	http.ResponseWriter
+	flusher   http.Flusher
+	threshold int64
+	pending   int64
+}
+
+func newByteFlushWriter(w http.ResponseWriter, threshold int64) http.ResponseWriter {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return w
+	}
+	return &byteFlushWriter{ResponseWriter: w, flusher: flusher, threshold: threshold}
+}
+
+func (w *byteFlushWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.pending += int64(n)
+	if err == nil && w.pending >= w.threshold {
+		w.Flush()
+	}
+	return n, err
+}
+
+// Flush sends any buffered data to the client
+func (w *byteFlushWriter) Flush() {
+	w.pending = 0
+	w.flusher.Flush()
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (w *byteFlushWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", w.ResponseWriter)
+}
+
+// Push initiates an HTTP/2 server push if the underlying writer supports it
+func (w *byteFlushWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
@@ -0,0 +1,100 @@
+package forward
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestFlushInterval(t *testing.T) {
+	f, err := New(FlushInterval(5 * time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Millisecond, f.flushInterval)
+
+	f, err = New(Stream(true), StreamingFlushInterval(5*time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Millisecond, f.flushInterval)
+
+	f, err = New(Stream(false))
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), f.flushInterval)
+}
+
+func TestByteFlushWriterHijack(t *testing.T) {
+	w := newByteFlushWriter(httptest.NewRecorder(), 10)
+	_, ok := w.(http.Hijacker)
+	require.True(t, ok)
+	_, _, err := w.(http.Hijacker).Hijack()
+	assert.Error(t, err)
+	assert.Equal(t, http.ErrNotSupported, w.(http.Pusher).Push("/style.css", nil))
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		conn, _, err := newByteFlushWriter(w, 10).(http.Hijacker).Hijack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\nhijacked"))
+		conn.Close()
+	})
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hijacked", string(body))
+}
+
+func TestFlushBytes(t *testing.T) {
+	received := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "20")
+		w.Write([]byte("0123456789"))
+		w.(http.Flusher).Flush()
+
+		// the rest of the body is only sent once the client got the first chunk
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("abcdefghij"))
+	})
+	defer srv.Close()
+
+	f, err := New(FlushBytes(10))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer re.Body.Close()
+
+	start := time.Now()
+	chunk := make([]byte, 10)
+	_, err = io.ReadFull(re.Body, chunk)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(chunk))
+	assert.True(t, time.Since(start) < time.Second)
+	close(received)
+
+	rest, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghij", string(rest))
+}
+
+func TestFlushBytesInvalid(t *testing.T) {
+	_, err := New(FlushBytes(-1))
+	assert.Error(t, err)
+}
@@ -5,10 +5,12 @@ package forward
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -20,8 +22,8 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/heebyunglee/oxy/utils"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 type WebSocketConn *websocket.Conn
@@ -96,6 +98,23 @@ func Rewriter(r ReqRewriter) optSetter {
 	}
 }
 
+// TrustForwardHeaderFrom makes the default HeaderRewriter keep the forwarding headers of the requests
+// coming from the given CIDRs only, the headers sent by the other peers are replaced to prevent spoofing.
+// It is ignored along with a custom Rewriter.
+func TrustForwardHeaderFrom(cidrs ...string) optSetter {
+	return func(f *Forwarder) error {
+		ranges, err := utils.ParseIPRanges(cidrs...)
+		if err != nil {
+			return err
+		}
+		if len(ranges) == 0 {
+			return errors.New("provide at least one trusted CIDR")
+		}
+		f.trustedIPs = ranges
+		return nil
+	}
+}
+
 // WebsocketTLSClientConfig define the websocker client TLS configuration
 func WebsocketTLSClientConfig(tcc *tls.Config) optSetter {
 	return func(f *Forwarder) error {
@@ -147,6 +166,17 @@ func Logger(l log.FieldLogger) optSetter {
 	}
 }
 
+// StructuredLogger defines the structured logger the forwarder logs the requests with,
+// the fields of the requests, e.g. their ID and backend, are added to every line.
+//
+// It defaults to an adapter of the logger set by Logger.
+func StructuredLogger(l utils.Logger) optSetter {
+	return func(f *Forwarder) error {
+		f.logger = l
+		return nil
+	}
+}
+
 // StateListener defines a state listener for the HTTP forwarder
 func StateListener(stateListener UrlForwardingStateListener) optSetter {
 	return func(f *Forwarder) error {
@@ -179,7 +209,9 @@ func ResponseModifier(responseModifier func(*http.Response) error) optSetter {
 	}
 }
 
-// StreamingFlushInterval defines a streaming flush interval for the HTTP forwarder
+// StreamingFlushInterval defines a streaming flush interval for the HTTP forwarder,
+// a negative interval flushes the response after each write.
+// Responses of unknown length are always flushed after each write when streaming.
 func StreamingFlushInterval(flushInterval time.Duration) optSetter {
 	return func(f *Forwarder) error {
 		f.httpForwarder.flushInterval = flushInterval
@@ -187,6 +219,19 @@ func StreamingFlushInterval(flushInterval time.Duration) optSetter {
 	}
 }
 
+// UpstreamTimeout limits the time a backend has to send the whole response, the request is cancelled
+// once it expires. The deadline of the incoming request context, if any, is always honoured.
+// For websockets only the handshake is subject to the timeout.
+func UpstreamTimeout(timeout time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if timeout < 0 {
+			return errors.New("upstream timeout should be >= 0")
+		}
+		f.httpForwarder.upstreamTimeout = timeout
+		return nil
+	}
+}
+
 // ErrorHandlingRoundTripper a error handling round tripper
 type ErrorHandlingRoundTripper struct {
 	http.RoundTripper
@@ -213,6 +258,17 @@ type Forwarder struct {
 	*handlerContext
 	stateListener UrlForwardingStateListener
 	stream        bool
+	http2         bool
+	upstreamTLS   bool
+	retryAttempts int
+	retryBackoff  time.Duration
+	tracer        Tracer
+
+	proxyProtocolVersion int
+	trustedIPs           utils.IPRanges
+	transport            *transportOptions
+
+	inflight utils.Inflight
 }
 
 // handlerContext defines a handler context for error reporting and logging
@@ -233,10 +289,30 @@ type httpForwarder struct {
 
 	tlsClientConfig *tls.Config
 
-	log OxyLogger
+	log    OxyLogger
+	logger utils.Logger
 
 	bufferPool                    httputil.BufferPool
 	websocketConnectionClosedHook func(req *http.Request, conn net.Conn)
+
+	dialContext dialFunc
+	proxy       func(*http.Request) (*url.URL, error)
+
+	upstreamTimeout time.Duration
+	flushBytes      int64
+
+	pathRewrite *pathRewrite
+	hostRewrite *hostRewrite
+	clientCert  *ClientCertOptions
+	connect     *connectTunnel
+	// connectAllowed are the internal networks the CONNECT tunnels can reach
+	connectAllowed utils.IPRanges
+
+	beforeForward func(req *http.Request)
+	afterResponse func(res *http.Response, duration time.Duration, err error)
+
+	// unixRoundTripper is the bottom of the round tripper chain, it holds the transports to close on shutdown
+	unixRoundTripper *unixSocketRoundTripper
 }
 
 const defaultFlushInterval = time.Duration(100) * time.Millisecond
@@ -262,6 +338,10 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		}
 	}
 
+	if f.logger == nil {
+		f.logger = utils.NewLogrusLogger(f.log)
+	}
+
 	if !f.stream {
 		f.flushInterval = 0
 	} else if f.flushInterval == 0 {
@@ -273,7 +353,51 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		if err != nil {
 			h = "localhost"
 		}
-		f.httpForwarder.rewriter = &HeaderRewriter{TrustForwardHeader: true, Hostname: h}
+		f.httpForwarder.rewriter = &HeaderRewriter{TrustForwardHeader: true, TrustedIPs: f.trustedIPs, Hostname: h}
+	}
+
+	if err := f.validateTLS(); err != nil {
+		return nil, err
+	}
+	if err := f.validateTransport(); err != nil {
+		return nil, err
+	}
+	if f.transport != nil && f.transport.dialer != nil {
+		// websockets and unix sockets dial with the tuned dialer as well
+		f.dialContext = f.transport.dialContext()
+	}
+	if f.transport != nil && f.transport.proxy != nil {
+		// websockets go through the upstream proxy as well
+		f.httpForwarder.proxy = f.transport.proxy
+	}
+
+	if f.dialContext != nil && f.httpForwarder.roundTripper != nil {
+		return nil, errors.New("DialContext can not be used along with a custom RoundTripper")
+	}
+
+	if f.http2 {
+		if f.httpForwarder.roundTripper != nil {
+			return nil, errors.New("HTTP2 can not be used along with a custom RoundTripper")
+		}
+		f.httpForwarder.roundTripper = newHTTP2RoundTripper(f.tlsClientConfig, f.dialContext)
+	}
+
+	if f.proxyProtocolVersion != 0 {
+		if f.http2 || f.httpForwarder.roundTripper != nil {
+			return nil, errors.New("ProxyProtocol can not be used along with HTTP2 or a custom RoundTripper")
+		}
+		f.httpForwarder.roundTripper = newProxyProtocolRoundTripper(f.proxyProtocolVersion, f.tlsClientConfig, f.dialContext)
+	}
+
+	if (f.dialContext != nil || f.upstreamTLS || f.transport != nil) && f.httpForwarder.roundTripper == nil {
+		dial := f.dialContext
+		if dial == nil {
+			dial = defaultDialer().DialContext
+		}
+		transport := newTransport(dial)
+		transport.TLSClientConfig = f.tlsClientConfig
+		f.transport.apply(transport)
+		f.httpForwarder.roundTripper = transport
 	}
 
 	if f.httpForwarder.roundTripper == nil {
@@ -290,6 +414,31 @@ func New(setters ...optSetter) (*Forwarder, error) {
 		}
 	}
 
+	f.httpForwarder.unixRoundTripper = newUnixSocketRoundTripper(f.httpForwarder.roundTripper, f.dialContext)
+	f.httpForwarder.roundTripper = f.httpForwarder.unixRoundTripper
+
+	if f.retryAttempts > 1 {
+		f.httpForwarder.roundTripper = &retryRoundTripper{
+			RoundTripper: f.httpForwarder.roundTripper,
+			attempts:     f.retryAttempts,
+			backoff:      f.retryBackoff,
+		}
+	}
+
+	if f.afterResponse != nil {
+		f.httpForwarder.roundTripper = &hooksRoundTripper{
+			RoundTripper:  f.httpForwarder.roundTripper,
+			afterResponse: f.afterResponse,
+		}
+	}
+
+	if f.tracer != nil {
+		f.httpForwarder.roundTripper = &tracingRoundTripper{
+			RoundTripper: f.httpForwarder.roundTripper,
+			tracer:       f.tracer,
+		}
+	}
+
 	f.httpForwarder.roundTripper = ErrorHandlingRoundTripper{
 		RoundTripper: f.httpForwarder.roundTripper,
 		errorHandler: f.errHandler,
@@ -303,23 +452,49 @@ func New(setters ...optSetter) (*Forwarder, error) {
 // ServeHTTP decides which forwarder to use based on the specified
 // request and delegates to the proper implementation
 func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if f.log.GetLevel() >= log.DebugLevel {
-		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
-		logEntry.Debug("vulcand/oxy/forward: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/forward: completed ServeHttp on request")
+	if !f.inflight.Acquire() {
+		f.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer f.inflight.Release()
+
+	logger := f.requestLogger(req)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req)})
+		logEntry.Debugf("vulcand/oxy/forward: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/forward: completed ServeHttp on request")
 	}
 
 	if f.stateListener != nil {
 		f.stateListener(req.URL, StateConnected)
 		defer f.stateListener(req.URL, StateDisconnected)
 	}
-	if IsWebsocketRequest(req) {
+	if f.httpForwarder.isConnectRequest(req) {
+		f.httpForwarder.serveConnect(w, req, f.handlerContext)
+	} else if IsWebsocketRequest(req) {
 		f.httpForwarder.serveWebSocket(w, req, f.handlerContext)
 	} else {
 		f.httpForwarder.serveHTTP(w, req, f.handlerContext)
 	}
 }
 
+// Shutdown stops forwarding new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being forwarded to complete, websocket connections included. The idle connections to the upstream servers
+// are closed once they are done. It returns the error of the context if it is done first.
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	if err := f.inflight.Shutdown(ctx); err != nil {
+		return err
+	}
+	f.unixRoundTripper.closeIdleConnections()
+	return nil
+}
+
+// requestLogger returns the logger of the request, the one it carries or the one of the forwarder,
+// with the fields of the request
+func (f *httpForwarder) requestLogger(req *http.Request) utils.Logger {
+	return utils.RequestLogger(req, f.logger)
+}
+
 func (f *httpForwarder) getUrlFromRequest(req *http.Request) *url.URL {
 	// If the Request was created by Go via a real HTTP request,  RequestURI will
 	// contain the original query string. If the Request was created in code, RequestURI
@@ -330,7 +505,7 @@ func (f *httpForwarder) getUrlFromRequest(req *http.Request) *url.URL {
 		if err == nil {
 			u = parsedURL
 		} else {
-			f.log.Warnf("vulcand/oxy/forward: error when parsing RequestURI: %s", err)
+			f.requestLogger(req).Warnf("vulcand/oxy/forward: error when parsing RequestURI: %s", err)
 		}
 	}
 	return u
@@ -338,6 +513,10 @@ func (f *httpForwarder) getUrlFromRequest(req *http.Request) *url.URL {
 
 // Modify the request to handle the target URL
 func (f *httpForwarder) modifyRequest(outReq *http.Request, target *url.URL) {
+	if target.Scheme == unixScheme {
+		*outReq = *withUnixSocketPath(outReq, target.Path)
+	}
+
 	outReq.URL = utils.CopyURL(outReq.URL)
 	outReq.URL.Scheme = target.Scheme
 	outReq.URL.Host = target.Host
@@ -349,6 +528,10 @@ func (f *httpForwarder) modifyRequest(outReq *http.Request, target *url.URL) {
 	outReq.URL.RawQuery = u.RawQuery
 	outReq.RequestURI = "" // Outgoing request should not have RequestURI
 
+	if f.pathRewrite != nil {
+		f.pathRewrite.rewrite(outReq.URL)
+	}
+
 	outReq.Proto = "HTTP/1.1"
 	outReq.ProtoMajor = 1
 	outReq.ProtoMinor = 1
@@ -357,45 +540,83 @@ func (f *httpForwarder) modifyRequest(outReq *http.Request, target *url.URL) {
 		f.rewriter.Rewrite(outReq)
 	}
 
+	if f.clientCert != nil {
+		f.clientCert.rewrite(outReq)
+	}
+
 	// Do not pass client Host header unless optsetter PassHostHeader is set.
 	if !f.passHost {
 		outReq.Host = target.Host
 	}
+
+	if f.beforeForward != nil {
+		f.beforeForward(outReq)
+	}
 }
 
 // serveHTTP forwards websocket traffic
 func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request, ctx *handlerContext) {
-	if f.log.GetLevel() >= log.DebugLevel {
-		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
-		logEntry.Debug("vulcand/oxy/forward/websocket: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/forward/websocket: completed ServeHttp on request")
+	logger := f.requestLogger(req)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req)})
+		logEntry.Debugf("vulcand/oxy/forward/websocket: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/forward/websocket: completed ServeHttp on request")
 	}
 
 	outReq := f.copyWebSocketRequest(req)
 
-	dialer := websocket.DefaultDialer
+	// Work on a copy so the TLS settings of this forwarder never leak into the
+	// process-wide default dialer shared with other forwarders.
+	dialer := *websocket.DefaultDialer
 
 	if outReq.URL.Scheme == "wss" && f.tlsClientConfig != nil {
 		dialer.TLSClientConfig = f.tlsClientConfig.Clone()
 		// WebSocket is only in http/1.1
 		dialer.TLSClientConfig.NextProtos = []string{"http/1.1"}
 	}
-	targetConn, resp, err := dialer.DialContext(outReq.Context(), outReq.URL.String(), outReq.Header)
+	if f.dialContext != nil {
+		dialer.NetDialContext = f.dialContext
+	}
+	if f.proxy != nil {
+		dialer.Proxy = f.proxy
+	}
+	if req.URL.Scheme == unixScheme {
+		dial := f.dialContext
+		if dial == nil {
+			dial = defaultDialer().DialContext
+		}
+		socketPath := req.URL.Path
+		dialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx, unixScheme, socketPath)
+		}
+	}
+	dialCtx := outReq.Context()
+	if f.upstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(dialCtx, f.upstreamTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	targetConn, resp, err := dialer.DialContext(dialCtx, outReq.URL.String(), outReq.Header)
+	if f.afterResponse != nil {
+		f.afterResponse(resp, time.Since(start), err)
+	}
 	if err != nil {
 		if resp == nil {
 			ctx.errHandler.ServeHTTP(w, req, err)
 		} else {
-			f.log.Errorf("vulcand/oxy/forward/websocket: Error dialing %q: %v with resp: %d %s", outReq.Host, err, resp.StatusCode, resp.Status)
+			logger.Errorf("vulcand/oxy/forward/websocket: Error dialing %q: %v with resp: %d %s", outReq.Host, err, resp.StatusCode, resp.Status)
 			hijacker, ok := w.(http.Hijacker)
 			if !ok {
-				f.log.Errorf("vulcand/oxy/forward/websocket: %s can not be hijack", reflect.TypeOf(w))
+				logger.Errorf("vulcand/oxy/forward/websocket: %s can not be hijack", reflect.TypeOf(w))
 				ctx.errHandler.ServeHTTP(w, req, err)
 				return
 			}
 
 			conn, _, errHijack := hijacker.Hijack()
 			if errHijack != nil {
-				f.log.Errorf("vulcand/oxy/forward/websocket: Failed to hijack responseWriter")
+				logger.Errorf("vulcand/oxy/forward/websocket: Failed to hijack responseWriter")
 				ctx.errHandler.ServeHTTP(w, req, errHijack)
 				return
 			}
@@ -408,7 +629,7 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 
 			errWrite := resp.Write(conn)
 			if errWrite != nil {
-				f.log.Errorf("vulcand/oxy/forward/websocket: Failed to forward response")
+				logger.Errorf("vulcand/oxy/forward/websocket: Failed to forward response")
 				ctx.errHandler.ServeHTTP(w, req, errWrite)
 				return
 			}
@@ -426,7 +647,7 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 
 	underlyingConn, err := upgrader.Upgrade(w, req, resp.Header)
 	if err != nil {
-		f.log.Errorf("vulcand/oxy/forward/websocket: Error while upgrading connection : %v", err)
+		logger.Errorf("vulcand/oxy/forward/websocket: Error while upgrading connection : %v", err)
 		return
 	}
 	defer func() {
@@ -441,7 +662,7 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 		err := f.websocketPreReplicateHandler(targetConn, underlyingConn)
 		if err != nil {
 			message := "vulcand/oxy/forward/websocket: Error when doing pre-step before starting copy: %v"
-			f.log.Errorf(message, err)
+			logger.Errorf(message, err)
 			return
 		}
 	}
@@ -513,7 +734,7 @@ func (f *httpForwarder) serveWebSocket(w http.ResponseWriter, req *http.Request,
 
 	}
 	if e, ok := err.(*websocket.CloseError); !ok || e.Code == websocket.CloseAbnormalClosure {
-		f.log.Errorf(message, err)
+		logger.Errorf(message, err)
 	}
 }
 
@@ -529,7 +750,7 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 	switch req.URL.Scheme {
 	case "https":
 		outReq.URL.Scheme = "wss"
-	case "http":
+	case "http", unixScheme:
 		outReq.URL.Scheme = "ws"
 	}
 
@@ -540,9 +761,16 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 	outReq.URL.RawQuery = u.RawQuery
 	outReq.RequestURI = "" // Outgoing request should not have RequestURI
 
+	if f.pathRewrite != nil {
+		f.pathRewrite.rewrite(outReq.URL)
+	}
+
 	outReq.URL.Host = req.URL.Host
+	if req.URL.Scheme == unixScheme {
+		outReq.URL.Host = "localhost"
+	}
 	if !f.passHost {
-		outReq.Host = req.URL.Host
+		outReq.Host = outReq.URL.Host
 	}
 
 	outReq.Header = make(http.Header)
@@ -554,15 +782,24 @@ func (f *httpForwarder) copyWebSocketRequest(req *http.Request) (outReq *http.Re
 	if f.rewriter != nil {
 		f.rewriter.Rewrite(outReq)
 	}
+
+	if f.clientCert != nil {
+		f.clientCert.rewrite(outReq)
+	}
+
+	if f.beforeForward != nil {
+		f.beforeForward(outReq)
+	}
 	return outReq
 }
 
 // serveHTTP forwards HTTP traffic using the configured transport
 func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ctx *handlerContext) {
-	if f.log.GetLevel() >= log.DebugLevel {
-		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(inReq))
-		logEntry.Debug("vulcand/oxy/forward/http: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/forward/http: completed ServeHttp on request")
+	logger := f.requestLogger(inReq)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(inReq)})
+		logEntry.Debugf("vulcand/oxy/forward/http: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/forward/http: completed ServeHttp on request")
 	}
 
 	start := time.Now().UTC()
@@ -570,29 +807,58 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 	outReq := new(http.Request)
 	*outReq = *inReq // includes shallow copies of maps, but we handle this in Director
 
+	if f.flushBytes > 0 {
+		w = newByteFlushWriter(w, f.flushBytes)
+	}
+
+	if f.upstreamTimeout > 0 {
+		ctx, cancel := context.WithTimeout(inReq.Context(), f.upstreamTimeout)
+		defer cancel()
+		outReq = outReq.WithContext(ctx)
+	}
+
 	revproxy := httputil.ReverseProxy{
 		Director: func(req *http.Request) {
 			f.modifyRequest(req, inReq.URL)
 		},
-		Transport:      f.roundTripper,
-		FlushInterval:  f.flushInterval,
-		ModifyResponse: f.modifyResponse,
-		BufferPool:     f.bufferPool,
+		Transport:     f.roundTripper,
+		FlushInterval: f.flushInterval,
+		BufferPool:    f.bufferPool,
+	}
+	revproxy.ModifyResponse = func(res *http.Response) error {
+		utils.UpstreamFromRequest(inReq).Set(inReq.URL, time.Now().UTC().Sub(start))
+
+		if f.pathRewrite != nil {
+			f.pathRewrite.rewriteLocation(res, inReq.URL)
+		}
+		if f.hostRewrite != nil {
+			f.hostRewrite.rewrite(res, inReq, inReq.URL)
+		}
+
+		// Long-lived streams must reach the client as soon as the backend writes them,
+		// waiting for the flush interval would hold events back.
+		if f.isStreamingResponse(res) {
+			revproxy.FlushInterval = -1
+		}
+		if f.modifyResponse != nil {
+			return f.modifyResponse(res)
+		}
+		return nil
 	}
 
-	if f.log.GetLevel() >= log.DebugLevel {
+	if logger.DebugEnabled() {
 		pw := utils.NewProxyWriter(w)
 		revproxy.ServeHTTP(pw, outReq)
 
 		if inReq.TLS != nil {
-			f.log.Debugf("vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v tls:version: %x, tls:resume:%t, tls:csuite:%x, tls:server:%v",
+			logger.Debugf("vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v tls:version: %x, tls:resume:%t, tls:csuite:%x, tls:server:%v",
 				inReq.URL, pw.StatusCode(), pw.GetLength(), time.Now().UTC().Sub(start),
 				inReq.TLS.Version,
 				inReq.TLS.DidResume,
 				inReq.TLS.CipherSuite,
 				inReq.TLS.ServerName)
 		} else {
-			f.log.Debugf("vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v",
+			logger.Debugf("vulcand/oxy/forward/http: Round trip: %v, code: %v, Length: %v, duration: %v",
 				inReq.URL, pw.StatusCode(), pw.GetLength(), time.Now().UTC().Sub(start))
 		}
 	} else {
@@ -610,6 +876,21 @@ func (f *httpForwarder) serveHTTP(w http.ResponseWriter, inReq *http.Request, ct
 
 }
 
+// isStreamingResponse determines if the response has to be flushed to the client immediately:
+// server-sent events and gRPC streams always are, responses of unknown length are when streaming is enabled.
+func (f *httpForwarder) isStreamingResponse(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get(ContentType))
+	if mediaType == "text/event-stream" || isGRPCContentType(mediaType) {
+		return true
+	}
+	return f.flushInterval != 0 && res.ContentLength == -1
+}
+
+// isGRPCContentType determines if the media type is one used by gRPC, e.g. application/grpc+proto
+func isGRPCContentType(mediaType string) bool {
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
 // IsWebsocketRequest determines if the specified HTTP request is a
 // websocket handshake request
 func IsWebsocketRequest(req *http.Request) bool {
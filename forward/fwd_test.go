@@ -1,9 +1,11 @@
 package forward
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -241,6 +243,60 @@ func TestCustomTransportTimeout(t *testing.T) {
 	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
 }
 
+func TestUpstreamTimeout(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(UpstreamTimeout(20 * time.Millisecond))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	start := time.Now()
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestIncomingContextDeadline(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		ctx, cancel := context.WithTimeout(req.Context(), 20*time.Millisecond)
+		defer cancel()
+		f.ServeHTTP(w, req.WithContext(ctx))
+	})
+	defer proxy.Close()
+
+	start := time.Now()
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, re.StatusCode)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
 func TestCustomLogger(t *testing.T) {
 	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
 		w.Write([]byte("hello"))
@@ -432,3 +488,196 @@ func TestUnannouncedTrailer(t *testing.T) {
 
 	require.Equal(t, resp.Trailer.Get("X-Trailer"), "foo")
 }
+
+func TestServerSentEventsAreFlushed(t *testing.T) {
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentType, "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	defer srv.Close()
+	defer close(release)
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+	defer re.Body.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(re.Body).ReadString('\n')
+		received <- line
+	}()
+
+	select {
+	case line := <-received:
+		assert.Equal(t, "data: hello\n", line)
+	case <-time.After(time.Second):
+		t.Fatal("event was not flushed to the client")
+	}
+}
+
+func TestIsStreamingResponse(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		contentType   string
+		contentLength int64
+		flushInterval time.Duration
+		expected      bool
+	}{
+		{desc: "server-sent events", contentType: "text/event-stream", contentLength: -1, expected: true},
+		{desc: "grpc", contentType: "application/grpc", contentLength: -1, expected: true},
+		{desc: "grpc with codec", contentType: "application/grpc+proto", contentLength: -1, expected: true},
+		{desc: "chunked without streaming", contentType: "text/plain", contentLength: -1, expected: false},
+		{desc: "chunked with streaming", contentType: "text/plain", contentLength: -1, flushInterval: time.Second, expected: true},
+		{desc: "known length with streaming", contentType: "text/plain", contentLength: 10, flushInterval: time.Second, expected: false},
+	}
+
+	for _, test := range testCases {
+		f := &httpForwarder{flushInterval: test.flushInterval}
+		res := &http.Response{Header: http.Header{ContentType: []string{test.contentType}}, ContentLength: test.contentLength}
+		assert.Equal(t, test.expected, f.isStreamingResponse(res), test.desc)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	done := make(chan int)
+	go func() {
+		re, _, errGet := testutils.Get(proxy.URL)
+		require.NoError(t, errGet)
+		done <- re.StatusCode
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, f.Shutdown(ctx))
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	close(release)
+	assert.NoError(t, f.Shutdown(context.Background()))
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestExpectContinue(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Expect") != "100-continue" {
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+		if req.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL + req.URL.Path)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	send := func(path string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n", path)
+		return conn, bufio.NewReader(conn)
+	}
+
+	// the backend rejects the request before the body is sent
+	conn, r := send("/reject")
+	re, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+	conn.Close()
+
+	// the body is sent once the backend asks for it
+	conn, r = send("/accept")
+	defer conn.Close()
+	re, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusContinue, re.StatusCode)
+
+	conn.Write([]byte("hello"))
+	re, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestInterimResponses(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	re, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusEarlyHints, re.StatusCode)
+	assert.Equal(t, "</style.css>; rel=preload; as=style", re.Header.Get("Link"))
+
+	re, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "", re.Header.Get("Link"))
+}
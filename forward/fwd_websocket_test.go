@@ -798,3 +798,27 @@ func (w *websocketRequest) open() (*websocket.Conn, net.Conn, error) {
 	}
 	return conn, client, err
 }
+
+func TestWebSocketDoesNotAlterDefaultDialer(t *testing.T) {
+	srv := createTLSWebsocketServer()
+	defer srv.Close()
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	f, err := New(PassHostHeader(true), RoundTripper(transport))
+	require.NoError(t, err)
+
+	proxy := createProxyWithForwarder(f, srv.URL)
+	defer proxy.Close()
+
+	resp, err := newWebsocketRequest(
+		withServer(proxy.Listener.Addr().String()),
+		withPath("/ws"),
+		withData("ok"),
+	).send()
+
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+	assert.Nil(t, gorillawebsocket.DefaultDialer.TLSClientConfig)
+}
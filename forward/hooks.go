@@ -0,0 +1,39 @@
+package forward
+
+import (
+	"net/http"
+	"time"
+)
+
+// BeforeForward defines a hook called with the outbound request right before it is sent to the backend,
+// once the URL and the headers have been rewritten. The hook is allowed to modify the request.
+func BeforeForward(hook func(req *http.Request)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.beforeForward = hook
+		return nil
+	}
+}
+
+// AfterResponse defines a hook called once the backend answered or failed to, with the time spent
+// waiting for the response headers. The response is nil if no response was received.
+// For websockets the response is the one of the handshake.
+func AfterResponse(hook func(res *http.Response, duration time.Duration, err error)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.afterResponse = hook
+		return nil
+	}
+}
+
+// hooksRoundTripper reports the outcome of the round trips to the AfterResponse hook
+type hooksRoundTripper struct {
+	http.RoundTripper
+	afterResponse func(res *http.Response, duration time.Duration, err error)
+}
+
+// RoundTrip executes the round trip
+func (rt *hooksRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := rt.RoundTripper.RoundTrip(req)
+	rt.afterResponse(res, time.Since(start), err)
+	return res, err
+}
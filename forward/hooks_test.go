@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestBeforeForward(t *testing.T) {
+	var header, path string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header.Get("X-Injected")
+		path = req.URL.Path
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	f, err := New(BeforeForward(func(req *http.Request) {
+		req.Header.Set("X-Injected", req.URL.Host)
+		req.URL.Path = "/rewritten"
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "/original")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, testutils.ParseURI(srv.URL).Host, header)
+	assert.Equal(t, "/rewritten", path)
+}
+
+func TestAfterResponse(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer srv.Close()
+
+	var code int
+	var duration time.Duration
+	var hookErr error
+	f, err := New(AfterResponse(func(res *http.Response, d time.Duration, err error) {
+		if res != nil {
+			code = res.StatusCode
+		}
+		duration, hookErr = d, err
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, re.StatusCode)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.True(t, duration >= 10*time.Millisecond)
+	assert.NoError(t, hookErr)
+}
+
+func TestAfterResponseError(t *testing.T) {
+	var hookRes *http.Response
+	var hookErr error
+	called := false
+	f, err := New(AfterResponse(func(res *http.Response, d time.Duration, err error) {
+		called = true
+		hookRes, hookErr = res, err
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:63450")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.True(t, called)
+	assert.Nil(t, hookRes)
+	assert.Error(t, hookErr)
+}
@@ -0,0 +1,111 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RewriteLocation rewrites the Location headers of the responses pointing to the backend,
+// so that the clients are redirected to the host they requested instead of the internal name of the backend
+func RewriteLocation() optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.hostRewriter().location = true
+		return nil
+	}
+}
+
+// RewriteCookieDomain rewrites the Domain attribute of the cookies set by the backend for its own name or one
+// of its parent domains. The domain defaults to the host requested by the client when empty.
+func RewriteCookieDomain(domain string) optSetter {
+	return func(f *Forwarder) error {
+		h := f.httpForwarder.hostRewriter()
+		h.cookies = true
+		h.cookieDomain = domain
+		return nil
+	}
+}
+
+// hostRewrite replaces the name of the backend by the public host in the responses
+type hostRewrite struct {
+	location     bool
+	cookies      bool
+	cookieDomain string
+}
+
+func (f *httpForwarder) hostRewriter() *hostRewrite {
+	if f.hostRewrite == nil {
+		f.hostRewrite = &hostRewrite{}
+	}
+	return f.hostRewrite
+}
+
+func (h *hostRewrite) rewrite(res *http.Response, req *http.Request, backend *url.URL) {
+	if h.location {
+		h.rewriteLocation(res, req, backend)
+	}
+	if h.cookies {
+		h.rewriteCookies(res, req, backend)
+	}
+}
+
+func (h *hostRewrite) rewriteLocation(res *http.Response, req *http.Request, backend *url.URL) {
+	location := res.Header.Get("Location")
+	if location == "" || req.Host == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || !strings.EqualFold(u.Host, backend.Host) {
+		return
+	}
+	u.Host = req.Host
+	switch {
+	case req.TLS != nil:
+		u.Scheme = "https"
+	case u.Scheme == "https":
+		u.Scheme = "http"
+	}
+	res.Header.Set("Location", u.String())
+}
+
+func (h *hostRewrite) rewriteCookies(res *http.Response, req *http.Request, backend *url.URL) {
+	cookies := res.Header["Set-Cookie"]
+	if len(cookies) == 0 {
+		return
+	}
+	domain := h.cookieDomain
+	if domain == "" {
+		domain = hostname(req.Host)
+	}
+	if domain == "" {
+		return
+	}
+	backendName := strings.ToLower(backend.Hostname())
+	for i, cookie := range cookies {
+		cookies[i] = rewriteCookieDomain(cookie, backendName, domain)
+	}
+}
+
+// rewriteCookieDomain replaces the Domain attribute of a Set-Cookie header when it covers the backend
+func rewriteCookieDomain(cookie, backendName, domain string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		attr := strings.TrimSpace(part)
+		if len(attr) < len("domain=") || !strings.EqualFold(attr[:len("domain=")], "domain=") {
+			continue
+		}
+		value := strings.ToLower(strings.TrimPrefix(attr[len("domain="):], "."))
+		if value == backendName || strings.HasSuffix(backendName, "."+value) {
+			parts[i] = " Domain=" + domain
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,67 @@
+package forward
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRewriteLocationAndCookies(t *testing.T) {
+	var backendURL string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", backendURL+"/login?next=%2F")
+		w.Header().Add("Set-Cookie", "session=1; Domain=127.0.0.1; Path=/; HttpOnly")
+		w.Header().Add("Set-Cookie", "other=2; domain=example.org")
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer srv.Close()
+	backendURL = srv.URL
+
+	f, err := New(RewriteLocation(), RewriteCookieDomain(""))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Host("www.example.com:8080"))
+	require.NoError(t, err)
+	assert.Equal(t, "http://www.example.com:8080/login?next=%2F", re.Header.Get("Location"))
+	assert.Equal(t, []string{
+		"session=1; Domain=www.example.com; Path=/; HttpOnly",
+		"other=2; domain=example.org",
+	}, re.Header["Set-Cookie"])
+}
+
+func TestRewriteCookieDomain(t *testing.T) {
+	tests := []struct {
+		cookie   string
+		expected string
+	}{
+		{cookie: "a=1; Domain=app.internal", expected: "a=1; Domain=example.com"},
+		{cookie: "a=1; Domain=.internal; Secure", expected: "a=1; Domain=example.com; Secure"},
+		{cookie: "a=1; DOMAIN=APP.INTERNAL", expected: "a=1; Domain=example.com"},
+		{cookie: "a=1; Domain=other.internal", expected: "a=1; Domain=other.internal"},
+		{cookie: "a=1; Path=/", expected: "a=1; Path=/"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, rewriteCookieDomain(test.cookie, "app.internal", "example.com"), test.cookie)
+	}
+}
+
+func TestRewriteLocationOtherHost(t *testing.T) {
+	h := &hostRewrite{location: true}
+	res := &http.Response{Header: http.Header{"Location": {"https://sso.example.com/login"}}}
+	req := &http.Request{Host: "www.example.com"}
+	h.rewrite(res, req, testutils.ParseURI("http://10.0.0.1:8080"))
+	assert.Equal(t, "https://sso.example.com/login", res.Header.Get("Location"))
+
+	res.Header.Set("Location", "https://10.0.0.1:8080/login")
+	h.rewrite(res, req, testutils.ParseURI("http://10.0.0.1:8080"))
+	assert.Equal(t, "http://www.example.com/login", res.Header.Get("Location"))
+}
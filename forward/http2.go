@@ -0,0 +1,76 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTP2 makes the forwarder speak HTTP/2 to the backends: over TLS for https URLs
+// and with prior knowledge (h2c) for cleartext http URLs.
+// The connections are opened with the function set by DialContext, if any, as for HTTP/1.
+// It can not be combined with a custom RoundTripper.
+func HTTP2() optSetter {
+	return func(f *Forwarder) error {
+		f.http2 = true
+		return nil
+	}
+}
+
+// http2RoundTripper dispatches requests to a TLS or a cleartext HTTP/2 transport depending on the URL scheme
+type http2RoundTripper struct {
+	tls *http2.Transport
+	h2c *http2.Transport
+}
+
+func newHTTP2RoundTripper(tlsConfig *tls.Config, dial dialFunc) *http2RoundTripper {
+	if dial == nil {
+		dial = defaultDialer().DialContext
+	}
+	return &http2RoundTripper{
+		tls: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialHTTP2TLS(dial, network, addr, cfg)
+			},
+		},
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			// The h2c transport never negotiates TLS, the connection is opened in clear text
+			// and HTTP/2 is spoken with prior knowledge.
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		},
+	}
+}
+
+// dialHTTP2TLS opens a connection with dial and negotiates HTTP/2 over TLS, as the http2 transport does by default
+func dialHTTP2TLS(dial dialFunc, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := dial(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected ALPN protocol %q, want %q", p, http2.NextProtoTLS)
+	}
+	return tlsConn, nil
+}
+
+// RoundTrip executes the round trip
+func (rt *http2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return rt.h2c.RoundTrip(req)
+	}
+	return rt.tls.RoundTrip(req)
+}
@@ -0,0 +1,157 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestHTTP2Cleartext(t *testing.T) {
+	var proto string
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		w.Write([]byte("hello"))
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	f, err := New(HTTP2())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "HTTP/2.0", proto)
+}
+
+func TestHTTP2TLS(t *testing.T) {
+	var proto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proto = req.Proto
+		w.Write([]byte("hello"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	f, err := New(HTTP2(), WebsocketTLSClientConfig(&tls.Config{InsecureSkipVerify: true}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "HTTP/2.0", proto)
+}
+
+func TestHTTP2DialContext(t *testing.T) {
+	h2cSrv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}), &http2.Server{}))
+	defer h2cSrv.Close()
+
+	tlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	}))
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	var mtx sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mtx.Lock()
+		dialed = append(dialed, addr)
+		mtx.Unlock()
+		return defaultDialer().DialContext(ctx, network, addr)
+	}
+
+	f, err := New(HTTP2(), DialContext(dial), WebsocketTLSClientConfig(&tls.Config{InsecureSkipVerify: true}))
+	require.NoError(t, err)
+
+	for _, target := range []string{h2cSrv.URL, tlsSrv.URL} {
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = testutils.ParseURI(target)
+			f.ServeHTTP(w, req)
+		})
+
+		re, body, err := testutils.Get(proxy.URL)
+		proxy.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+		assert.Equal(t, "HTTP/2.0", string(body))
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []string{h2cSrv.Listener.Addr().String(), tlsSrv.Listener.Addr().String()}, dialed)
+}
+
+func TestHTTP2WithCustomRoundTripper(t *testing.T) {
+	_, err := New(HTTP2(), RoundTripper(http.DefaultTransport))
+	require.Error(t, err)
+}
+
+func TestGRPCTrailers(t *testing.T) {
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(ContentType, "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+		// gRPC servers may also send trailers that were not announced
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	f, err := New(HTTP2())
+	require.NoError(t, err)
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	}))
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodPost, proxy.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set(ContentType, "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	client := proxy.Client()
+	re, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	re.Body.Close()
+
+	assert.Equal(t, 2, re.ProtoMajor)
+	assert.Equal(t, "message", string(body))
+	assert.Equal(t, "0", re.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "ok", re.Trailer.Get("Grpc-Message"))
+}
@@ -0,0 +1,132 @@
+package forward
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// StripPrefix removes a prefix from the path of the requests before forwarding them, e.g. /api/users
+// is forwarded as /users with the prefix /api. The paths without the prefix are forwarded as they are.
+func StripPrefix(prefix string) optSetter {
+	return func(f *Forwarder) error {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || !strings.HasPrefix(prefix, "/") {
+			return errors.New("prefix to strip should start with / and not be empty")
+		}
+		f.httpForwarder.pathRewriter().stripPrefix = prefix
+		return nil
+	}
+}
+
+// AddPrefix adds a prefix to the path of the requests before forwarding them, after StripPrefix
+// and ReplacePath are applied
+func AddPrefix(prefix string) optSetter {
+	return func(f *Forwarder) error {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" || !strings.HasPrefix(prefix, "/") {
+			return errors.New("prefix to add should start with / and not be empty")
+		}
+		f.httpForwarder.pathRewriter().addPrefix = prefix
+		return nil
+	}
+}
+
+// ReplacePath replaces the matches of a regular expression in the path of the requests, after StripPrefix
+// is applied. The replacement can refer to the submatches, see regexp.Regexp.ReplaceAllString.
+// The Location headers of the responses can not be reverted when a path is replaced, they are left untouched.
+func ReplacePath(re *regexp.Regexp, replacement string) optSetter {
+	return func(f *Forwarder) error {
+		if re == nil {
+			return errors.New("path regexp can not be nil")
+		}
+		p := f.httpForwarder.pathRewriter()
+		p.re = re
+		p.replacement = replacement
+		return nil
+	}
+}
+
+// pathRewrite rewrites the paths of the requests, and reverts the rewriting in the Location headers
+// of the responses so that the clients are redirected to paths they can request
+type pathRewrite struct {
+	stripPrefix string
+	addPrefix   string
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (f *httpForwarder) pathRewriter() *pathRewrite {
+	if f.pathRewrite == nil {
+		f.pathRewrite = &pathRewrite{}
+	}
+	return f.pathRewrite
+}
+
+// rewrite rewrites the path of the URL of the outgoing request
+func (p *pathRewrite) rewrite(u *url.URL) {
+	path := u.Path
+	if p.stripPrefix != "" {
+		if trimmed, ok := trimPathPrefix(path, p.stripPrefix); ok {
+			path = trimmed
+		}
+	}
+	if p.re != nil {
+		path = p.re.ReplaceAllString(path, p.replacement)
+	}
+	if p.addPrefix != "" {
+		path = p.addPrefix + path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if path != u.Path {
+		u.Path = path
+		u.RawPath = ""
+	}
+}
+
+// rewriteLocation reverts the prefixes in the Location header pointing to the backend
+func (p *pathRewrite) rewriteLocation(res *http.Response, backend *url.URL) {
+	if p.re != nil {
+		return
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || (u.Host != "" && u.Host != backend.Host) || (u.Host == "" && !strings.HasPrefix(u.Path, "/")) {
+		return
+	}
+
+	path := u.Path
+	if p.addPrefix != "" {
+		trimmed, ok := trimPathPrefix(path, p.addPrefix)
+		if !ok {
+			return
+		}
+		path = trimmed
+	}
+	if p.stripPrefix != "" {
+		path = p.stripPrefix + path
+	}
+	if path != u.Path {
+		u.Path = path
+		u.RawPath = ""
+		res.Header.Set("Location", u.String())
+	}
+}
+
+// trimPathPrefix removes a prefix ending on a segment boundary, /api is a prefix of /api/users but not of /apis
+func trimPathPrefix(path, prefix string) (string, bool) {
+	if path == prefix {
+		return "/", true
+	}
+	if strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix):], true
+	}
+	return path, false
+}
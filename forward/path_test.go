@@ -0,0 +1,106 @@
+package forward
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestPathRewriting(t *testing.T) {
+	var path, query string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path, query = req.URL.Path, req.URL.RawQuery
+		w.Header().Set("Location", "/v1/login")
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer srv.Close()
+
+	f, err := New(StripPrefix("/api/"), AddPrefix("/v1"))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "/api/users?id=1")
+	require.NoError(t, err)
+	assert.Equal(t, "/v1/users", path)
+	assert.Equal(t, "id=1", query)
+	assert.Equal(t, http.StatusCreated, re.StatusCode)
+	assert.Equal(t, "/api/login", re.Header.Get("Location"))
+
+	// the prefix ends on a segment boundary
+	_, _, err = testutils.Get(proxy.URL + "/apis")
+	require.NoError(t, err)
+	assert.Equal(t, "/v1/apis", path)
+}
+
+func TestReplacePath(t *testing.T) {
+	var path string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		w.Header().Set("Location", "/elsewhere")
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer srv.Close()
+
+	f, err := New(StripPrefix("/api"), ReplacePath(regexp.MustCompile(`^/users/(\d+)$`), "/accounts/$1"))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL + "/api/users/42")
+	require.NoError(t, err)
+	assert.Equal(t, "/accounts/42", path)
+	assert.Equal(t, "/elsewhere", re.Header.Get("Location"))
+}
+
+func TestRewriteLocation(t *testing.T) {
+	backend := testutils.ParseURI("http://backend:8080")
+	p := &pathRewrite{stripPrefix: "/api"}
+
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{location: "/login?next=/", expected: "/api/login?next=/"},
+		{location: "http://backend:8080/login", expected: "http://backend:8080/api/login"},
+		{location: "http://other/login", expected: "http://other/login"},
+		{location: "relative", expected: "relative"},
+		{location: "", expected: ""},
+	}
+	for _, test := range tests {
+		res := &http.Response{Header: http.Header{}}
+		if test.location != "" {
+			res.Header.Set("Location", test.location)
+		}
+		p.rewriteLocation(res, backend)
+		assert.Equal(t, test.expected, res.Header.Get("Location"), test.location)
+	}
+
+	u := &url.URL{Path: "/other"}
+	(&pathRewrite{addPrefix: "/v1"}).rewrite(u)
+	assert.Equal(t, "/v1/other", u.Path)
+}
+
+func TestPathOptionsValidation(t *testing.T) {
+	_, err := New(StripPrefix(""))
+	assert.Error(t, err)
+
+	_, err = New(AddPrefix("v1"))
+	assert.Error(t, err)
+
+	_, err = New(ReplacePath(nil, ""))
+	assert.Error(t, err)
+}
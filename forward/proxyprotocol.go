@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// ProxyProtocol makes the forwarder send a PROXY protocol header of the given version (1 or 2)
+// on every connection it opens to the backends, so that they can learn the address of the client.
+// As the header describes a single client, backend connections are not reused between requests.
+// It can not be combined with a custom RoundTripper or HTTP2.
+func ProxyProtocol(version int) optSetter {
+	return func(f *Forwarder) error {
+		if version != 1 && version != 2 {
+			return fmt.Errorf("unsupported PROXY protocol version: %d", version)
+		}
+		f.proxyProtocolVersion = version
+		return nil
+	}
+}
+
+// proxyProtocolRoundTripper opens a dedicated backend connection per request,
+// starting with a PROXY protocol header describing the client of the request
+type proxyProtocolRoundTripper struct {
+	version   int
+	tlsConfig *tls.Config
+	dial      dialFunc
+}
+
+func newProxyProtocolRoundTripper(version int, tlsConfig *tls.Config, dial dialFunc) *proxyProtocolRoundTripper {
+	if dial == nil {
+		dial = defaultDialer().DialContext
+	}
+	return &proxyProtocolRoundTripper{
+		version:   version,
+		tlsConfig: tlsConfig,
+		dial:      dial,
+	}
+}
+
+// RoundTrip executes the round trip
+func (rt *proxyProtocolRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	src, dst := proxyProtocolAddrs(req)
+	transport := newTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := rt.dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.WriteProxyHeader(conn, rt.version, src, dst); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+	transport.TLSClientConfig = rt.tlsConfig
+	transport.DisableKeepAlives = true
+	return transport.RoundTrip(req)
+}
+
+// proxyProtocolAddrs returns the client address and the address the client connected to,
+// both are nil if the request was not received by a net/http server
+func proxyProtocolAddrs(req *http.Request) (net.Addr, net.Addr) {
+	src, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return nil, nil
+	}
+	dst, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return nil, nil
+	}
+	return src, dst
+}
@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		var remoteAddrs []string
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			remoteAddrs = append(remoteAddrs, req.RemoteAddr)
+			w.Write([]byte("hello"))
+		}))
+		srv.Listener = utils.NewProxyProtocolListener(srv.Listener, time.Second)
+		srv.Start()
+
+		f, err := New(ProxyProtocol(version))
+		require.NoError(t, err)
+
+		var clientAddrs []string
+		proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+			clientAddrs = append(clientAddrs, req.RemoteAddr)
+			req.URL = testutils.ParseURI(srv.URL)
+			f.ServeHTTP(w, req)
+		})
+
+		for i := 0; i < 2; i++ {
+			re, body, err := testutils.Get(proxy.URL)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+			assert.Equal(t, "hello", string(body))
+		}
+		assert.Equal(t, clientAddrs, remoteAddrs)
+
+		proxy.Close()
+		srv.Close()
+	}
+}
+
+func TestProxyProtocolUnknownClient(t *testing.T) {
+	var remoteAddr string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		remoteAddr = req.RemoteAddr
+	}))
+	srv.Listener = utils.NewProxyProtocolListener(srv.Listener, time.Second)
+	srv.Start()
+	defer srv.Close()
+
+	f, err := New(ProxyProtocol(2))
+	require.NoError(t, err)
+
+	// the request was not received by a server, the backend gets a LOCAL header
+	req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	req.RemoteAddr = "not an address"
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	host, _, err := net.SplitHostPort(remoteAddr)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+}
+
+func TestProxyProtocolInvalidOptions(t *testing.T) {
+	_, err := New(ProxyProtocol(3))
+	assert.Error(t, err)
+
+	_, err = New(ProxyProtocol(1), HTTP2())
+	assert.Error(t, err)
+
+	_, err = New(ProxyProtocol(1), RoundTripper(http.DefaultTransport))
+	assert.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package forward
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Retry makes the forwarder replay idempotent requests when the connection to the backend
+// is refused or reset, up to attempts times in total and waiting backoff between the attempts.
+// The error handler is only called once all the attempts failed.
+func Retry(attempts int, backoff time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if attempts < 1 {
+			return errors.New("retry attempts should be >= 1")
+		}
+		if backoff < 0 {
+			return errors.New("retry backoff should be >= 0")
+		}
+		f.retryAttempts = attempts
+		f.retryBackoff = backoff
+		return nil
+	}
+}
+
+// retryRoundTripper replays idempotent requests failing with transient connection errors
+type retryRoundTripper struct {
+	http.RoundTripper
+	attempts int
+	backoff  time.Duration
+}
+
+// RoundTrip executes the round trip
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempt := 1
+	for {
+		res, err := rt.RoundTripper.RoundTrip(req)
+		if err == nil || attempt >= rt.attempts || !isIdempotent(req) || !isRetryableError(err) {
+			return res, err
+		}
+		attempt++
+		countResend(req.Context())
+
+		if req.GetBody != nil {
+			body, errBody := req.GetBody()
+			if errBody != nil {
+				return nil, err
+			}
+			// RoundTrippers must not modify the request, work on a shallow copy instead
+			retryReq := *req
+			retryReq.Body = body
+			req = &retryReq
+		}
+
+		timer := time.NewTimer(rt.backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// isIdempotent tells if the request can be safely replayed
+func isIdempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// the body has been consumed by the previous attempt
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// isRetryableError tells if the error is a refused or reset connection
+func isRetryableError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET
+		default:
+			return false
+		}
+	}
+}
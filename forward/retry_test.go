@@ -0,0 +1,112 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+type failingRoundTripper struct {
+	failures int
+	calls    int
+	err      error
+}
+
+func (rt *failingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.calls++
+	if rt.calls <= rt.failures {
+		return nil, rt.err
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func connError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestRetryIdempotentRequest(t *testing.T) {
+	srv := testutils.NewResponder("hello")
+	defer srv.Close()
+
+	rt := &failingRoundTripper{failures: 2, err: connError(syscall.ECONNREFUSED)}
+	f, err := New(RoundTripper(rt), Retry(3, time.Millisecond))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 3, rt.calls)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	rt := &failingRoundTripper{failures: 10, err: connError(syscall.ECONNRESET)}
+	f, err := New(RoundTripper(rt), Retry(2, 0))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:1")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 2, rt.calls)
+}
+
+func TestRetrySkipsNonIdempotentRequest(t *testing.T) {
+	rt := &failingRoundTripper{failures: 10, err: connError(syscall.ECONNREFUSED)}
+	f, err := New(RoundTripper(rt), Retry(3, 0))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:1")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 1, rt.calls)
+}
+
+func TestRetrySkipsOtherErrors(t *testing.T) {
+	rt := &failingRoundTripper{failures: 10, err: connError(syscall.EHOSTUNREACH)}
+	f, err := New(RoundTripper(rt), Retry(3, 0))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:1")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 1, rt.calls)
+}
+
+func TestRetryBadOptions(t *testing.T) {
+	_, err := New(Retry(0, 0))
+	require.Error(t, err)
+
+	_, err = New(Retry(1, -time.Second))
+	require.Error(t, err)
+}
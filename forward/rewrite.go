@@ -5,13 +5,29 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/vulcand/oxy/utils"
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// ForwardedMode selects the forwarding headers set by the HeaderRewriter
+type ForwardedMode int
+
+const (
+	// ForwardedXHeaders sets the legacy X-Forwarded-* headers
+	ForwardedXHeaders ForwardedMode = iota
+	// ForwardedRFC7239 sets the standard Forwarded header only
+	ForwardedRFC7239
+	// ForwardedBoth sets both the X-Forwarded-* and the Forwarded headers
+	ForwardedBoth
 )
 
 // HeaderRewriter is responsible for removing hop-by-hop headers and setting forwarding headers
 type HeaderRewriter struct {
 	TrustForwardHeader bool
-	Hostname           string
+	// TrustedIPs restricts TrustForwardHeader to the requests coming from these networks, the forwarding
+	// headers sent by the other peers are replaced. All the peers are trusted when it is empty.
+	TrustedIPs    utils.IPRanges
+	Hostname      string
+	ForwardedMode ForwardedMode
 }
 
 // clean up IP in case if it is ipv6 address and it has {zone} information in it, like "[fe80::d806:a55d:eb1b:49cc%vEthernet (vmxnet3 Ethernet Adapter - Virtual Switch)]:64692"
@@ -21,8 +37,20 @@ func ipv6fix(clientIP string) string {
 
 // Rewrite rewrite request headers
 func (rw *HeaderRewriter) Rewrite(req *http.Request) {
-	if !rw.TrustForwardHeader {
+	if !rw.trusted(req) {
 		utils.RemoveHeaders(req.Header, XHeaders...)
+		utils.RemoveHeaders(req.Header, Forwarded)
+	}
+
+	if rw.ForwardedMode != ForwardedXHeaders {
+		rw.rewriteForwarded(req)
+	}
+
+	if rw.ForwardedMode == ForwardedRFC7239 {
+		utils.RemoveHeaders(req.Header, XHeaders...)
+		// A nil value prevents http.ReverseProxy from adding its own X-Forwarded-For
+		req.Header[XForwardedFor] = nil
+		return
 	}
 
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
@@ -71,6 +99,35 @@ func (rw *HeaderRewriter) Rewrite(req *http.Request) {
 	}
 }
 
+// trusted tells if the forwarding headers of the request can be kept
+func (rw *HeaderRewriter) trusted(req *http.Request) bool {
+	if !rw.TrustForwardHeader {
+		return false
+	}
+	return len(rw.TrustedIPs) == 0 || rw.TrustedIPs.ContainsAddr(req.RemoteAddr)
+}
+
+// rewriteForwarded appends the element describing this hop to the Forwarded header
+func (rw *HeaderRewriter) rewriteForwarded(req *http.Request) {
+	element := utils.ForwardedElement{
+		Proto: "http",
+		Host:  req.Host,
+		By:    rw.Hostname,
+	}
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		element.For = ipv6fix(clientIP)
+	}
+	if req.TLS != nil {
+		element.Proto = "https"
+	}
+
+	if prior, ok := req.Header[Forwarded]; ok {
+		req.Header.Set(Forwarded, strings.Join(prior, ", ")+", "+element.String())
+	} else {
+		req.Header.Set(Forwarded, element.String())
+	}
+}
+
 func forwardedPort(req *http.Request) string {
 	if req == nil {
 		return ""
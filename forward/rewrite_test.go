@@ -1,9 +1,14 @@
 package forward
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/heebyunglee/oxy/utils"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
 )
 
 func TestIPv6Fix(t *testing.T) {
@@ -59,3 +64,141 @@ func TestIPv6Fix(t *testing.T) {
 		})
 	}
 }
+
+func TestForwardedModes(t *testing.T) {
+	testCases := []struct {
+		desc              string
+		mode              ForwardedMode
+		trust             bool
+		prior             string
+		expectedForwarded string
+		expectXHeaders    bool
+	}{
+		{
+			desc:           "legacy",
+			mode:           ForwardedXHeaders,
+			expectXHeaders: true,
+		},
+		{
+			desc:              "rfc 7239",
+			mode:              ForwardedRFC7239,
+			expectedForwarded: `for="[2001:db8::1]";proto=http;host=example.com;by=proxy`,
+		},
+		{
+			desc:              "both",
+			mode:              ForwardedBoth,
+			expectedForwarded: `for="[2001:db8::1]";proto=http;host=example.com;by=proxy`,
+			expectXHeaders:    true,
+		},
+		{
+			desc:              "trusted prior value is kept",
+			mode:              ForwardedRFC7239,
+			trust:             true,
+			prior:             "for=192.0.2.1",
+			expectedForwarded: `for=192.0.2.1, for="[2001:db8::1]";proto=http;host=example.com;by=proxy`,
+		},
+		{
+			desc:              "untrusted prior value is dropped",
+			mode:              ForwardedRFC7239,
+			prior:             "for=192.0.2.1",
+			expectedForwarded: `for="[2001:db8::1]";proto=http;host=example.com;by=proxy`,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = "[2001:db8::1]:4711"
+			if test.prior != "" {
+				req.Header.Set(Forwarded, test.prior)
+			}
+
+			rw := &HeaderRewriter{TrustForwardHeader: test.trust, Hostname: "proxy", ForwardedMode: test.mode}
+			rw.Rewrite(req)
+
+			assert.Equal(t, test.expectedForwarded, req.Header.Get(Forwarded))
+			assert.Equal(t, test.expectXHeaders, req.Header.Get(XRealIp) != "")
+		})
+	}
+}
+
+func TestForwardedOnlyOmitsXForwardedFor(t *testing.T) {
+	var outHeaders http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHeaders = req.Header
+	})
+	defer srv.Close()
+
+	f, err := New(Rewriter(&HeaderRewriter{ForwardedMode: ForwardedRFC7239}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	_, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+
+	assert.Contains(t, outHeaders.Get(Forwarded), "for=127.0.0.1")
+	assert.Empty(t, outHeaders.Get(XForwardedFor))
+	assert.Empty(t, outHeaders.Get(XForwardedProto))
+}
+
+func TestTrustedIPs(t *testing.T) {
+	trusted, err := utils.ParseIPRanges("10.0.0.0/8")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		expected   string
+	}{
+		{desc: "trusted peer", remoteAddr: "10.1.2.3:4711", expected: "https"},
+		{desc: "untrusted peer", remoteAddr: "192.0.2.1:4711", expected: "http"},
+	}
+
+	for _, test := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set(XForwardedProto, "https")
+		req.Header.Set(XForwardedFor, "198.51.100.1")
+
+		rw := &HeaderRewriter{TrustForwardHeader: true, TrustedIPs: trusted}
+		rw.Rewrite(req)
+
+		assert.Equal(t, test.expected, req.Header.Get(XForwardedProto), test.desc)
+		assert.Equal(t, test.expected == "https", req.Header.Get(XForwardedFor) != "", test.desc)
+	}
+}
+
+func TestTrustForwardHeaderFrom(t *testing.T) {
+	var outHeaders http.Header
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		outHeaders = req.Header
+	})
+	defer srv.Close()
+
+	f, err := New(TrustForwardHeaderFrom("10.0.0.0/8"))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	// the test client connects from 127.0.0.1, it is not trusted
+	_, _, err = testutils.Get(proxy.URL, testutils.Header(XForwardedFor, "198.51.100.1"))
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", outHeaders.Get(XForwardedFor))
+
+	_, err = New(TrustForwardHeaderFrom())
+	assert.Error(t, err)
+	_, err = New(TrustForwardHeaderFrom("10.0.0.0/99"))
+	assert.Error(t, err)
+}
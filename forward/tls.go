@@ -0,0 +1,108 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// The TLS options amend the TLS configuration used to connect to the https and wss backends,
+// starting from the one set by WebsocketTLSClientConfig if it comes first.
+// They can not be combined with a custom RoundTripper.
+
+// RootCAs sets the certificate authorities used to verify the certificates of the backends,
+// defaults to the ones of the host
+func RootCAs(pool *x509.CertPool) optSetter {
+	return func(f *Forwarder) error {
+		f.upstreamTLSConfig().RootCAs = pool
+		return nil
+	}
+}
+
+// ClientCertificates sets the certificates presented to the backends requiring client authentication (mTLS)
+func ClientCertificates(certs ...tls.Certificate) optSetter {
+	return func(f *Forwarder) error {
+		if len(certs) == 0 {
+			return errors.New("provide at least one client certificate")
+		}
+		f.upstreamTLSConfig().Certificates = certs
+		return nil
+	}
+}
+
+// InsecureSkipVerify disables the verification of the certificates of the backends, use it for tests only
+func InsecureSkipVerify(skip bool) optSetter {
+	return func(f *Forwarder) error {
+		f.upstreamTLSConfig().InsecureSkipVerify = skip
+		return nil
+	}
+}
+
+// TLSServerName sets the name sent in the SNI extension and expected in the certificates of the backends,
+// instead of the host of the URL of the backend
+func TLSServerName(name string) optSetter {
+	return func(f *Forwarder) error {
+		f.upstreamTLSConfig().ServerName = name
+		return nil
+	}
+}
+
+// TLSMinVersion sets the minimum TLS version accepted by the forwarder, e.g. tls.VersionTLS12
+func TLSMinVersion(version uint16) optSetter {
+	return func(f *Forwarder) error {
+		if err := checkTLSVersion(version); err != nil {
+			return err
+		}
+		f.upstreamTLSConfig().MinVersion = version
+		return nil
+	}
+}
+
+// TLSMaxVersion sets the maximum TLS version accepted by the forwarder, e.g. tls.VersionTLS13
+func TLSMaxVersion(version uint16) optSetter {
+	return func(f *Forwarder) error {
+		if err := checkTLSVersion(version); err != nil {
+			return err
+		}
+		f.upstreamTLSConfig().MaxVersion = version
+		return nil
+	}
+}
+
+// upstreamTLSConfig returns the TLS configuration amended by the TLS options,
+// copied from the one set by the caller the first time so that it is never modified
+func (f *Forwarder) upstreamTLSConfig() *tls.Config {
+	if !f.upstreamTLS {
+		f.upstreamTLS = true
+		if f.tlsClientConfig != nil {
+			f.tlsClientConfig = f.tlsClientConfig.Clone()
+		} else {
+			f.tlsClientConfig = &tls.Config{}
+		}
+	}
+	return f.tlsClientConfig
+}
+
+func checkTLSVersion(version uint16) error {
+	switch version {
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+		return nil
+	}
+	return fmt.Errorf("unsupported TLS version %#x", version)
+}
+
+// validateTLS checks the TLS options once all of them are set
+func (f *Forwarder) validateTLS() error {
+	if !f.upstreamTLS {
+		return nil
+	}
+	if f.httpForwarder.roundTripper != nil {
+		return errors.New("TLS options can not be used along with a custom RoundTripper")
+	}
+	cfg := f.tlsClientConfig
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return fmt.Errorf("TLS min version %#x is greater than max version %#x", cfg.MinVersion, cfg.MaxVersion)
+	}
+	return nil
+}
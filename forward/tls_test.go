@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	oxytestutils "github.com/heebyunglee/oxy/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	var state *tls.ConnectionState
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		state = req.TLS
+		w.Write([]byte("hello"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	f, err := New(
+		RootCAs(pool),
+		ClientCertificates(srv.TLS.Certificates[0]),
+		TLSServerName("example.com"),
+		TLSMaxVersion(tls.VersionTLS12),
+	)
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	require.NotNil(t, state)
+	assert.Equal(t, "example.com", state.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+	assert.Len(t, state.PeerCertificates, 1)
+}
+
+func TestUpstreamTLSVerification(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	// the certificate of the test server is not trusted by the host
+	f, err := New(TLSMinVersion(tls.VersionTLS12))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+
+	f, err = New(InsecureSkipVerify(true))
+	require.NoError(t, err)
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestUpstreamTLSOptions(t *testing.T) {
+	wsConfig := &tls.Config{ServerName: "ws.example.com"}
+	f, err := New(WebsocketTLSClientConfig(wsConfig), InsecureSkipVerify(true))
+	require.NoError(t, err)
+	assert.True(t, f.tlsClientConfig.InsecureSkipVerify)
+	assert.Equal(t, "ws.example.com", f.tlsClientConfig.ServerName)
+	assert.False(t, wsConfig.InsecureSkipVerify, "the config of the caller must not be modified")
+
+	_, err = New(TLSMinVersion(tls.VersionTLS13), TLSMaxVersion(tls.VersionTLS12))
+	assert.Error(t, err)
+
+	_, err = New(TLSMinVersion(0x0200))
+	assert.Error(t, err)
+
+	_, err = New(ClientCertificates())
+	assert.Error(t, err)
+
+	_, err = New(RoundTripper(http.DefaultTransport), InsecureSkipVerify(true))
+	assert.Error(t, err)
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	srv, err := oxytestutils.NewTLSTestServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}), oxytestutils.RequireClientCert())
+	require.NoError(t, err)
+	defer srv.Close()
+
+	cert, err := srv.ClientCertificate("proxy")
+	require.NoError(t, err)
+
+	f, err := New(RootCAs(srv.CA.Pool()), ClientCertificates(cert))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "proxy", string(body))
+}
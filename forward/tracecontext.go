@@ -0,0 +1,174 @@
+package forward
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers of the trace context propagation formats
+const (
+	TraceParent = "Traceparent"
+	B3TraceID   = "X-B3-Traceid"
+	B3SpanID    = "X-B3-Spanid"
+	B3ParentID  = "X-B3-Parentspanid"
+	B3Sampled   = "X-B3-Sampled"
+	B3Flags     = "X-B3-Flags"
+)
+
+// PropagationFormat is a format of the headers carrying the trace context
+type PropagationFormat int
+
+const (
+	// PropagationW3C is the W3C Trace Context traceparent header
+	PropagationW3C PropagationFormat = iota
+	// PropagationB3 are the multiple X-B3-* headers of Zipkin
+	PropagationB3
+)
+
+// SpanContext identifies a span of a distributed trace
+type SpanContext struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Sampled  bool
+}
+
+// HasParent returns true if the span continues a trace started upstream
+func (sc SpanContext) HasParent() bool {
+	return sc.ParentID != [8]byte{}
+}
+
+type spanContextKey struct{}
+
+// SpanContextFromContext returns the span context started by the trace context tracer, if any
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// traceContext is a Tracer continuing the trace of the incoming request, or starting a new one,
+// without recording the spans
+type traceContext struct {
+	formats []PropagationFormat
+}
+
+// NewTraceContext returns a Tracer that does not record spans but propagates the trace context to the backends,
+// in the given formats or as W3C traceparent by default. The trace of the incoming request is continued whether
+// it is carried by a traceparent or by B3 headers, a new trace is started otherwise. The forwarded request gets
+// a new span ID, the one of the client becomes its parent.
+func NewTraceContext(formats ...PropagationFormat) Tracer {
+	if len(formats) == 0 {
+		formats = []PropagationFormat{PropagationW3C}
+	}
+	return &traceContext{formats: formats}
+}
+
+func (t *traceContext) Start(ctx context.Context, req *http.Request) (context.Context, Span) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		sc, ok = extractTraceParent(req.Header)
+	}
+	if !ok {
+		sc, ok = extractB3(req.Header)
+	}
+	if ok {
+		sc.ParentID = sc.SpanID
+	} else {
+		rand.Read(sc.TraceID[:])
+		sc.Sampled = true
+	}
+	rand.Read(sc.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, sc), noopSpan{}
+}
+
+func (t *traceContext) Inject(ctx context.Context, header http.Header) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return
+	}
+	for _, format := range t.formats {
+		switch format {
+		case PropagationW3C:
+			flags := "00"
+			if sc.Sampled {
+				flags = "01"
+			}
+			header.Set(TraceParent, fmt.Sprintf("00-%x-%x-%s", sc.TraceID, sc.SpanID, flags))
+		case PropagationB3:
+			header.Set(B3TraceID, hex.EncodeToString(sc.TraceID[:]))
+			header.Set(B3SpanID, hex.EncodeToString(sc.SpanID[:]))
+			if sc.HasParent() {
+				header.Set(B3ParentID, hex.EncodeToString(sc.ParentID[:]))
+			} else {
+				header.Del(B3ParentID)
+			}
+			header.Del(B3Flags)
+			if sc.Sampled {
+				header.Set(B3Sampled, "1")
+			} else {
+				header.Set(B3Sampled, "0")
+			}
+		}
+	}
+}
+
+// extractTraceParent parses the W3C traceparent header: version-traceid-parentid-flags
+func extractTraceParent(header http.Header) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header.Get(TraceParent)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if !decodeID(sc.TraceID[:], parts[1]) || !decodeID(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// extractB3 parses the multiple B3 headers, 64 bits trace IDs are left padded with zeros
+func extractB3(header http.Header) (SpanContext, bool) {
+	var sc SpanContext
+	traceID := header.Get(B3TraceID)
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !decodeID(sc.TraceID[:], traceID) || !decodeID(sc.SpanID[:], header.Get(B3SpanID)) {
+		return sc, false
+	}
+	// the sampling decision is deferred to the backend when absent, sample in doubt
+	sc.Sampled = header.Get(B3Sampled) != "0" || header.Get(B3Flags) == "1"
+	return sc, true
+}
+
+// decodeID decodes a hexadecimal ID of the size of dst, IDs made of zeros are invalid
+func decodeID(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(strings.ToLower(s))); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}
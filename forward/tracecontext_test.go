@@ -0,0 +1,81 @@
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceContextNewTrace(t *testing.T) {
+	tracer := NewTraceContext()
+	req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	require.NoError(t, err)
+
+	ctx, _ := tracer.Start(context.Background(), req)
+	sc, ok := SpanContextFromContext(ctx)
+	require.True(t, ok)
+	assert.False(t, sc.HasParent())
+	assert.True(t, sc.Sampled)
+
+	header := make(http.Header)
+	tracer.Inject(ctx, header)
+	assert.Equal(t, fmt.Sprintf("00-%x-%x-01", sc.TraceID, sc.SpanID), header.Get(TraceParent))
+}
+
+func TestTraceContextContinuesW3C(t *testing.T) {
+	tracer := NewTraceContext(PropagationW3C, PropagationB3)
+	req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	require.NoError(t, err)
+	req.Header.Set(TraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	ctx, _ := tracer.Start(context.Background(), req)
+	sc, ok := SpanContextFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", fmt.Sprintf("%x", sc.TraceID))
+	assert.Equal(t, "00f067aa0ba902b7", fmt.Sprintf("%x", sc.ParentID))
+	assert.False(t, sc.Sampled)
+
+	header := make(http.Header)
+	tracer.Inject(ctx, header)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", header.Get(B3TraceID))
+	assert.Equal(t, fmt.Sprintf("%x", sc.SpanID), header.Get(B3SpanID))
+	assert.Equal(t, "00f067aa0ba902b7", header.Get(B3ParentID))
+	assert.Equal(t, "0", header.Get(B3Sampled))
+}
+
+func TestTraceContextContinuesB3(t *testing.T) {
+	tracer := NewTraceContext()
+	req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	require.NoError(t, err)
+	req.Header.Set(B3TraceID, "a3ce929d0e0e4736")
+	req.Header.Set(B3SpanID, "00f067aa0ba902b7")
+	req.Header.Set(B3Sampled, "1")
+
+	ctx, _ := tracer.Start(context.Background(), req)
+	sc, ok := SpanContextFromContext(ctx)
+	require.True(t, ok)
+	assert.Equal(t, "0000000000000000a3ce929d0e0e4736", fmt.Sprintf("%x", sc.TraceID))
+	assert.Equal(t, "00f067aa0ba902b7", fmt.Sprintf("%x", sc.ParentID))
+	assert.True(t, sc.Sampled)
+}
+
+func TestTraceContextInvalidHeaders(t *testing.T) {
+	for _, traceParent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		header := make(http.Header)
+		header.Set(TraceParent, traceParent)
+		_, ok := extractTraceParent(header)
+		assert.False(t, ok, traceParent)
+	}
+}
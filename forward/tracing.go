@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// Attributes of the spans of the forwarded requests, named after the OpenTelemetry semantic conventions
+const (
+	AttributeHTTPMethod     = "http.method"
+	AttributeHTTPURL        = "http.url"
+	AttributePeerName       = "net.peer.name"
+	AttributeHTTPStatusCode = "http.status_code"
+	AttributeResendCount    = "http.resend_count"
+)
+
+// Span is a unit of work of a distributed trace. It is usually implemented on top of the span
+// of a tracing library such as OpenTelemetry.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// Tracer starts the spans of the forwarded requests and propagates their context to the backends.
+// It is usually implemented on top of the tracer and the propagator of a tracing library such as OpenTelemetry,
+// NewTraceContext returns one that only propagates the trace context.
+type Tracer interface {
+	// Start starts a client span for the request sent to the backend, the span is a child of the one
+	// carried by the context or by the headers of the request
+	Start(ctx context.Context, req *http.Request) (context.Context, Span)
+	// Inject writes the context of the span carried by ctx in the headers sent to the backend
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Tracing makes the forwarder start a span around every request sent to a backend, with the method, the URL,
+// the address of the backend, the status code and the number of times the request was resent as attributes.
+// The span ends once the response headers are received. Websocket connections are not traced.
+func Tracing(tracer Tracer) optSetter {
+	return func(f *Forwarder) error {
+		f.tracer = tracer
+		return nil
+	}
+}
+
+type resendsKey struct{}
+
+// countResend counts a request resent by the forwarder to the same backend for the span of the request
+func countResend(ctx context.Context) {
+	if resends, ok := ctx.Value(resendsKey{}).(*int); ok {
+		*resends++
+	}
+}
+
+// tracingRoundTripper wraps the round trips, retries included, in a span
+type tracingRoundTripper struct {
+	http.RoundTripper
+	tracer Tracer
+}
+
+// RoundTrip executes the round trip
+func (rt *tracingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := rt.tracer.Start(req.Context(), req)
+	defer span.End()
+
+	resends := 0
+	ctx = context.WithValue(ctx, resendsKey{}, &resends)
+
+	// RoundTrippers must not modify the request, work on a shallow copy instead
+	outReq := req.WithContext(ctx)
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+	rt.tracer.Inject(ctx, outReq.Header)
+
+	span.SetAttribute(AttributeHTTPMethod, req.Method)
+	span.SetAttribute(AttributeHTTPURL, req.URL.String())
+	span.SetAttribute(AttributePeerName, req.URL.Host)
+
+	res, err := rt.RoundTripper.RoundTrip(outReq)
+
+	// the servers tried before this one by a load balancer count as resends as well
+	if tried := len(utils.ServerAttemptsFromRequest(req).Servers()); tried > 1 {
+		resends += tried - 1
+	}
+	if resends > 0 {
+		span.SetAttribute(AttributeResendCount, resends)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return res, err
+	}
+	span.SetAttribute(AttributeHTTPStatusCode, res.StatusCode)
+	return res, nil
+}
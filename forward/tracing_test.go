@@ -0,0 +1,113 @@
+package forward
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+type recordedSpan struct {
+	mtx        sync.Mutex
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.ended = true
+}
+
+// recordingTracer records the spans and propagates the trace context
+type recordingTracer struct {
+	Tracer
+	mtx   sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, req *http.Request) (context.Context, Span) {
+	ctx, _ = t.Tracer.Start(ctx, req)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	span := &recordedSpan{attributes: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestTracing(t *testing.T) {
+	var traceParent string
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		traceParent = req.Header.Get(TraceParent)
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	tracer := &recordingTracer{Tracer: NewTraceContext()}
+	f, err := New(Tracing(tracer))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL, testutils.Header(TraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the backend gets the trace of the client with the span ID of the forwarded request
+	assert.Regexp(t, "^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$", traceParent)
+	assert.NotContains(t, traceParent, "00f067aa0ba902b7")
+
+	require.Len(t, tracer.spans, 1)
+	span := tracer.spans[0]
+	assert.True(t, span.ended)
+	assert.Equal(t, http.MethodGet, span.attributes[AttributeHTTPMethod])
+	assert.Equal(t, testutils.ParseURI(srv.URL).Host, span.attributes[AttributePeerName])
+	assert.Equal(t, http.StatusOK, span.attributes[AttributeHTTPStatusCode])
+	assert.Nil(t, span.attributes[AttributeResendCount])
+}
+
+func TestTracingRetries(t *testing.T) {
+	rt := &failingRoundTripper{failures: 10, err: connError(syscall.ECONNREFUSED)}
+	tracer := &recordingTracer{Tracer: NewTraceContext()}
+	f, err := New(RoundTripper(rt), Retry(3, time.Millisecond), Tracing(tracer))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://localhost:1")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+
+	require.Len(t, tracer.spans, 1)
+	span := tracer.spans[0]
+	assert.Equal(t, 2, span.attributes[AttributeResendCount])
+	assert.Error(t, span.err)
+	assert.Nil(t, span.attributes[AttributeHTTPStatusCode])
+}
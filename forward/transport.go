@@ -0,0 +1,241 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// transportOptions tune the transport the forwarder creates, the settings default to the ones
+// of http.DefaultTransport
+type transportOptions struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+	tlsHandshakeTimeout time.Duration
+	expectContinue      time.Duration
+	disableKeepAlives   bool
+	proxy               func(*http.Request) (*url.URL, error)
+
+	// dialer is set by the dial options only
+	dialer   *net.Dialer
+	family   IPFamily
+	resolver Resolver
+}
+
+// MaxIdleConns sets the maximum number of idle connections kept open across all the backends, 0 means no limit.
+// It can not be combined with a custom RoundTripper, HTTP2 or ProxyProtocol, as the other connection pool options.
+func MaxIdleConns(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("maximum number of idle connections can not be negative: %v", n)
+		}
+		f.transportOptions().maxIdleConns = n
+		return nil
+	}
+}
+
+// MaxIdleConnsPerHost sets the maximum number of idle connections kept open per backend,
+// 0 means http.DefaultMaxIdleConnsPerHost
+func MaxIdleConnsPerHost(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("maximum number of idle connections per host can not be negative: %v", n)
+		}
+		f.transportOptions().maxIdleConnsPerHost = n
+		return nil
+	}
+}
+
+// MaxConnsPerHost limits the number of connections per backend, dialing, active and idle ones.
+// The requests beyond the limit wait for a connection. 0 means no limit.
+func MaxConnsPerHost(n int) optSetter {
+	return func(f *Forwarder) error {
+		if n < 0 {
+			return fmt.Errorf("maximum number of connections per host can not be negative: %v", n)
+		}
+		f.transportOptions().maxConnsPerHost = n
+		return nil
+	}
+}
+
+// IdleConnTimeout sets how long an idle connection is kept open, 0 means no limit
+func IdleConnTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("idle connection timeout can not be negative: %v", d)
+		}
+		f.transportOptions().idleConnTimeout = d
+		return nil
+	}
+}
+
+// TLSHandshakeTimeout sets the timeout of the TLS handshakes with the backends, 0 means no timeout
+func TLSHandshakeTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("TLS handshake timeout can not be negative: %v", d)
+		}
+		f.transportOptions().tlsHandshakeTimeout = d
+		return nil
+	}
+}
+
+// ExpectContinueTimeout sets how long the requests with an "Expect: 100-continue" header wait for the interim
+// response of the backend before their body is sent anyway, defaults to 1 second. The backends rejecting such
+// a request with a final response spare the upload of its body, 0 sends the bodies without waiting.
+func ExpectContinueTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("expect continue timeout can not be negative: %v", d)
+		}
+		f.transportOptions().expectContinue = d
+		return nil
+	}
+}
+
+// DisableKeepAlives opens a new connection for each request to the backends
+func DisableKeepAlives() optSetter {
+	return func(f *Forwarder) error {
+		f.transportOptions().disableKeepAlives = true
+		return nil
+	}
+}
+
+// DialTimeout sets the timeout of the connections to the backends, 0 means no timeout.
+// It can not be combined with DialContext.
+func DialTimeout(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		if d < 0 {
+			return fmt.Errorf("dial timeout can not be negative: %v", d)
+		}
+		f.transportOptions().dialerOptions().Timeout = d
+		return nil
+	}
+}
+
+// DialKeepAlive sets the interval of the TCP keep-alive probes of the connections to the backends,
+// a negative duration disables them. It can not be combined with DialContext.
+func DialKeepAlive(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.transportOptions().dialerOptions().KeepAlive = d
+		return nil
+	}
+}
+
+// DialFallbackDelay sets how long the connections to the backends wait for the preferred address family before
+// racing a connection to the other family, as specified by the Happy Eyeballs RFC 6555. It defaults to 300ms,
+// a negative delay disables the race and the other family is only tried once the preferred one failed.
+// It can not be combined with DialContext.
+func DialFallbackDelay(d time.Duration) optSetter {
+	return func(f *Forwarder) error {
+		f.transportOptions().dialerOptions().FallbackDelay = d
+		return nil
+	}
+}
+
+// DialLocalAddr binds the connections to the backends to the given local IP address, e.g. to select the
+// network interface they leave from. It can not be combined with DialContext.
+func DialLocalAddr(ip string) optSetter {
+	return func(f *Forwarder) error {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return fmt.Errorf("invalid local IP address %q", ip)
+		}
+		f.transportOptions().dialerOptions().LocalAddr = &net.TCPAddr{IP: addr}
+		return nil
+	}
+}
+
+// DialPreferIPFamily sets the address family dialed first when the name of a backend resolves to both IPv4 and
+// IPv6 addresses, the other family being the fallback. It defaults to the order of the resolver.
+// It can not be combined with DialContext.
+func DialPreferIPFamily(family IPFamily) optSetter {
+	return func(f *Forwarder) error {
+		if family != IPAny && family != IPv4 && family != IPv6 {
+			return fmt.Errorf("invalid IP family %d", family)
+		}
+		o := f.transportOptions()
+		// the preference is applied by the tuned dialer
+		o.dialerOptions()
+		o.family = family
+		return nil
+	}
+}
+
+// DialResolver looks up the names of the backends with the resolver, e.g. a dnscache.Cache, instead of letting
+// the dialer resolve them for every connection. It can not be combined with DialContext.
+func DialResolver(r Resolver) optSetter {
+	return func(f *Forwarder) error {
+		if r == nil {
+			return fmt.Errorf("resolver can not be nil")
+		}
+		o := f.transportOptions()
+		o.dialerOptions()
+		o.resolver = r
+		return nil
+	}
+}
+
+// transportOptions returns the options of the transport, created with the default settings the first time
+func (f *Forwarder) transportOptions() *transportOptions {
+	if f.transport == nil {
+		t := newTransport(nil)
+		f.transport = &transportOptions{
+			maxIdleConns:        t.MaxIdleConns,
+			maxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+			maxConnsPerHost:     t.MaxConnsPerHost,
+			idleConnTimeout:     t.IdleConnTimeout,
+			tlsHandshakeTimeout: t.TLSHandshakeTimeout,
+			expectContinue:      t.ExpectContinueTimeout,
+			disableKeepAlives:   t.DisableKeepAlives,
+		}
+	}
+	return f.transport
+}
+
+func (o *transportOptions) dialerOptions() *net.Dialer {
+	if o.dialer == nil {
+		o.dialer = defaultDialer()
+	}
+	return o.dialer
+}
+
+// apply sets the options on the transport
+func (o *transportOptions) apply(t *http.Transport) {
+	if o == nil {
+		return
+	}
+	t.MaxIdleConns = o.maxIdleConns
+	t.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+	t.MaxConnsPerHost = o.maxConnsPerHost
+	t.IdleConnTimeout = o.idleConnTimeout
+	t.TLSHandshakeTimeout = o.tlsHandshakeTimeout
+	t.ExpectContinueTimeout = o.expectContinue
+	t.DisableKeepAlives = o.disableKeepAlives
+	if o.proxy != nil {
+		t.Proxy = o.proxy
+	}
+}
+
+// validateTransport checks the connection pool options once all of them are set
+func (f *Forwarder) validateTransport() error {
+	if f.transport == nil {
+		return nil
+	}
+	switch {
+	case f.httpForwarder.roundTripper != nil:
+		return errors.New("connection pool options can not be used along with a custom RoundTripper")
+	case f.http2:
+		return errors.New("connection pool options can not be used along with HTTP2")
+	case f.proxyProtocolVersion != 0:
+		return errors.New("connection pool options can not be used along with ProxyProtocol")
+	case f.transport.dialer != nil && f.dialContext != nil:
+		return errors.New("dial options can not be used along with DialContext")
+	}
+	return nil
+}
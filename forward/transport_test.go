@@ -0,0 +1,96 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// builtTransport returns the transport created by the forwarder
+func builtTransport(t *testing.T, f *Forwarder) *http.Transport {
+	rt := f.httpForwarder.roundTripper.(ErrorHandlingRoundTripper).RoundTripper.(*unixSocketRoundTripper).RoundTripper
+	transport, ok := rt.(*http.Transport)
+	require.True(t, ok, "%T is not a transport", rt)
+	return transport
+}
+
+func TestTransportOptions(t *testing.T) {
+	f, err := New(MaxIdleConnsPerHost(32), MaxConnsPerHost(64), IdleConnTimeout(time.Minute))
+	require.NoError(t, err)
+
+	transport := builtTransport(t, f)
+	assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 64, transport.MaxConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	// the other settings keep their defaults
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 10*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, time.Second, transport.ExpectContinueTimeout)
+	assert.NotNil(t, transport.Proxy)
+	assert.Nil(t, f.dialContext)
+
+	f, err = New(DialTimeout(time.Second), DialKeepAlive(-1), TLSHandshakeTimeout(time.Second), MaxIdleConns(0), ExpectContinueTimeout(0))
+	require.NoError(t, err)
+	transport = builtTransport(t, f)
+	assert.Equal(t, time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, time.Duration(0), transport.ExpectContinueTimeout)
+	assert.Equal(t, 0, transport.MaxIdleConns)
+	assert.NotNil(t, f.dialContext)
+}
+
+func TestDisableKeepAlives(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	f, err := New(DisableKeepAlives())
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		re, _, err := testutils.Get(proxy.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt32(&conns))
+}
+
+func TestTransportOptionsValidation(t *testing.T) {
+	_, err := New(MaxConnsPerHost(-1))
+	assert.Error(t, err)
+
+	_, err = New(ExpectContinueTimeout(-1))
+	assert.Error(t, err)
+
+	_, err = New(RoundTripper(http.DefaultTransport), MaxIdleConnsPerHost(10))
+	assert.Error(t, err)
+
+	_, err = New(HTTP2(), IdleConnTimeout(time.Second))
+	assert.Error(t, err)
+
+	_, err = New(DialContext(defaultDialer().DialContext), DialTimeout(time.Second))
+	assert.Error(t, err)
+
+	_, err = New(DialContext(defaultDialer().DialContext), MaxConnsPerHost(10))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,126 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// unixScheme is the scheme of the URLs targeting a unix domain socket, e.g. unix:///var/run/app.sock
+const unixScheme = "unix"
+
+type unixSocketKey struct{}
+
+// dialFunc opens a connection to the given address
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext sets the function used to open the connections to the backends.
+// It can not be combined with a custom RoundTripper.
+func DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) optSetter {
+	return func(f *Forwarder) error {
+		f.httpForwarder.dialContext = dial
+		return nil
+	}
+}
+
+// newTransport creates a transport with the same settings as http.DefaultTransport opening its connections with dial
+func newTransport(dial dialFunc) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func defaultDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// unixSocketPath returns the path of the unix socket the request targets, if any
+func unixSocketPath(req *http.Request) (string, bool) {
+	path, ok := req.Context().Value(unixSocketKey{}).(string)
+	return path, ok
+}
+
+// withUnixSocketPath records the unix socket the request has to be sent to,
+// the path of the target URL being replaced by the path of the request
+func withUnixSocketPath(req *http.Request, target string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), unixSocketKey{}, target))
+}
+
+// unixSocketRoundTripper sends the requests targeting unix sockets over a dedicated transport per socket,
+// the other requests are handled by the wrapped RoundTripper
+type unixSocketRoundTripper struct {
+	http.RoundTripper
+	dial dialFunc
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func newUnixSocketRoundTripper(rt http.RoundTripper, dial dialFunc) *unixSocketRoundTripper {
+	if dial == nil {
+		dial = defaultDialer().DialContext
+	}
+	return &unixSocketRoundTripper{
+		RoundTripper: rt,
+		dial:         dial,
+		transports:   make(map[string]*http.Transport),
+	}
+}
+
+// RoundTrip executes the round trip
+func (rt *unixSocketRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	path, ok := unixSocketPath(req)
+	if !ok || req.URL.Scheme != unixScheme {
+		return rt.RoundTripper.RoundTrip(req)
+	}
+
+	outReq := new(http.Request)
+	*outReq = *req
+	outReq.URL = utils.CopyURL(req.URL)
+	outReq.URL.Scheme = "http"
+	outReq.URL.Host = "localhost"
+	if outReq.Host == "" {
+		outReq.Host = "localhost"
+	}
+	return rt.transport(path).RoundTrip(outReq)
+}
+
+func (rt *unixSocketRoundTripper) transport(path string) *http.Transport {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if t, ok := rt.transports[path]; ok {
+		return t
+	}
+	t := newTransport(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return rt.dial(ctx, unixScheme, path)
+	})
+	t.Proxy = nil
+	rt.transports[path] = t
+	return t
+}
+
+// closeIdleConnections closes the idle connections of the transports to the unix sockets and of the wrapped RoundTripper
+func (rt *unixSocketRoundTripper) closeIdleConnections() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, t := range rt.transports {
+		t.CloseIdleConnections()
+	}
+	if c, ok := rt.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,128 @@
+package forward
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gorillawebsocket "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func newUnixSocketServer(t *testing.T, handler http.Handler) (*httptest.Server, string, func()) {
+	dir, err := ioutil.TempDir("", "oxy")
+	require.NoError(t, err)
+
+	socketPath := filepath.Join(dir, "backend.sock")
+	ln, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = ln
+	srv.Start()
+	return srv, socketPath, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	var requestURI, host string
+	_, socketPath, cleanup := newUnixSocketServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestURI = req.RequestURI
+		host = req.Host
+		w.Write([]byte("hello"))
+	}))
+	defer cleanup()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("unix://" + socketPath)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL + "/some/path?a=b")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "/some/path?a=b", requestURI)
+	assert.Equal(t, "localhost", host)
+}
+
+func TestUnixSocketWebSocket(t *testing.T) {
+	upgrader := gorillawebsocket.Upgrader{}
+	_, socketPath, cleanup := newUnixSocketServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(msgType, msg)
+	}))
+	defer cleanup()
+
+	f, err := New()
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("unix://" + socketPath)
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	conn, _, err := gorillawebsocket.DefaultDialer.Dial("ws://"+proxy.Listener.Addr().String()+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(gorillawebsocket.TextMessage, []byte("ping")))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(msg))
+}
+
+func TestDialContext(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	var dialed []string
+	f, err := New(DialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}))
+	require.NoError(t, err)
+
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI("http://backend.internal")
+		f.ServeHTTP(w, req)
+	})
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, []string{"tcp backend.internal:80"}, dialed)
+}
+
+func TestDialContextWithCustomRoundTripper(t *testing.T) {
+	dial := (&net.Dialer{}).DialContext
+
+	_, err := New(DialContext(dial), RoundTripper(http.DefaultTransport))
+	assert.Error(t, err)
+}
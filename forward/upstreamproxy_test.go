@@ -0,0 +1,214 @@
+package forward
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// socks5Server accepts the CONNECT commands authenticated with user and password, counting the tunnels
+func socks5Server(t *testing.T, user, password string, tunnels *int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn, user, password, tunnels)
+		}
+	}()
+	return l
+}
+
+func serveSocks5(conn net.Conn, user, password string, tunnels *int32) {
+	defer conn.Close()
+	buf := make([]byte, 512)
+
+	// greeting, username/password authentication only
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	u := make([]byte, buf[1])
+	io.ReadFull(conn, u)
+	io.ReadFull(conn, buf[:1])
+	p := make([]byte, buf[0])
+	io.ReadFull(conn, p)
+	if string(u) != user || string(p) != password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// connect command
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(conn, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	atomic.AddInt32(tunnels, 1)
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestUpstreamProxyHTTP(t *testing.T) {
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("backend"))
+	})
+	defer backend.Close()
+
+	var target, auth string
+	proxy := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		target = req.URL.String()
+		auth = req.Header.Get("Proxy-Authorization")
+		w.Write([]byte("proxied"))
+	})
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	f, err := New(UpstreamProxy(proxyURL.String()))
+	require.NoError(t, err)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "proxied", string(body))
+	assert.Equal(t, backend.URL+"/", target)
+	assert.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")), auth)
+}
+
+func TestUpstreamProxySOCKS5(t *testing.T) {
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("backend"))
+	})
+	defer backend.Close()
+
+	var tunnels int32
+	socks := socks5Server(t, "user", "secret", &tunnels)
+	defer socks.Close()
+
+	f, err := New(UpstreamProxy("socks5://user:secret@" + socks.Addr().String()))
+	require.NoError(t, err)
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		f.ServeHTTP(w, req)
+	})
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "backend", string(body))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tunnels))
+
+	// wrong credentials
+	f, err = New(UpstreamProxy("socks5://user:wrong@" + socks.Addr().String()))
+	require.NoError(t, err)
+
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+}
+
+func TestUpstreamProxyFunc(t *testing.T) {
+	internal := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("internal"))
+	})
+	defer internal.Close()
+	external := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("external"))
+	})
+	defer external.Close()
+
+	var tunnels int32
+	socks := socks5Server(t, "user", "secret", &tunnels)
+	defer socks.Close()
+
+	externalURL := testutils.ParseURI(external.URL)
+	f, err := New(UpstreamProxyFunc(func(req *http.Request) (*url.URL, error) {
+		if req.URL.Host == externalURL.Host {
+			return url.Parse("socks5://user:secret@" + socks.Addr().String())
+		}
+		return nil, nil
+	}))
+	require.NoError(t, err)
+
+	for _, backend := range []string{internal.URL, external.URL} {
+		backendURL := testutils.ParseURI(backend)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.URL = backendURL
+			f.ServeHTTP(w, req)
+		}))
+		re, _, err := testutils.Get(srv.URL)
+		srv.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tunnels))
+}
+
+func TestUpstreamProxyOptions(t *testing.T) {
+	_, err := New(UpstreamProxy("ftp://proxy:21"))
+	assert.Error(t, err)
+
+	_, err = New(UpstreamProxy("http://"))
+	assert.Error(t, err)
+
+	_, err = New(UpstreamProxyFunc(nil))
+	assert.Error(t, err)
+
+	_, err = New(UpstreamProxy("http://proxy:3128"), HTTP2())
+	assert.Error(t, err)
+}
@@ -0,0 +1,264 @@
+/*
+Package forwardauth provides http.Handler middleware delegating the authorization of the requests to an external
+service.
+
+For each request, the method, the URI and the headers of the request, without its body, are sent to the
+authorization service. When it answers with a 2xx status code, the request is passed to the next handler with the
+selected headers of the answer, e.g. the identity of the user, otherwise the answer of the service is returned to
+the client as it is, so that the service can redirect to a login page or send a challenge.
+
+The service receives the original request in the following headers:
+
+	X-Forwarded-Method  the method of the request
+	X-Forwarded-Proto   http or https
+	X-Forwarded-Host    the host requested by the client
+	X-Forwarded-Uri     the request URI, path and query
+	X-Forwarded-For     the IP of the client
+
+Examples of forward authentication:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte("hello " + req.Header.Get("X-User")))
+	})
+
+	// Authorize the requests with an external service sending the user in the X-User header
+	fa, _ := forwardauth.New(handler, "http://auth.internal/verify",
+	  forwardauth.AuthResponseHeaders("X-User", "X-Groups"))
+*/
+package forwardauth
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers sent to the authorization service
+const (
+	XForwardedMethod = "X-Forwarded-Method"
+	XForwardedUri    = "X-Forwarded-Uri"
+)
+
+// DefaultTimeout is the timeout of the requests to the authorization service of the default client
+const DefaultTimeout = 30 * time.Second
+
+// ForwardAuth passes the requests authorized by an external service to the next handler
+type ForwardAuth struct {
+	next    http.Handler
+	address string
+	client  *http.Client
+
+	trustForwardHeader  bool
+	authRequestHeaders  []string
+	authResponseHeaders []string
+	errHandler          utils.ErrorHandler
+
+	log *log.Logger
+}
+
+// New returns a new middleware authorizing the requests with the service at the address.
+// New() function supports optional functional arguments
+func New(next http.Handler, address string, setters ...optSetter) (*ForwardAuth, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address of the authorization service: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid address of the authorization service %q, expected an http or https URL", address)
+	}
+	f := &ForwardAuth{
+		next:       next,
+		address:    address,
+		client:     &http.Client{Timeout: DefaultTimeout},
+		errHandler: utils.DefaultHandler,
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(f); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+type optSetter func(f *ForwardAuth) error
+
+// Client sets the client sending the requests to the authorization service, e.g. with a transport
+// presenting a client certificate. The redirects are never followed, they are returned to the clients.
+func Client(c *http.Client) optSetter {
+	return func(f *ForwardAuth) error {
+		if c == nil {
+			return fmt.Errorf("client can not be nil")
+		}
+		f.client = c
+		return nil
+	}
+}
+
+// TrustForwardHeader keeps the X-Forwarded-* headers sent by the clients, use it behind trusted proxies only
+func TrustForwardHeader(b bool) optSetter {
+	return func(f *ForwardAuth) error {
+		f.trustForwardHeader = b
+		return nil
+	}
+}
+
+// AuthRequestHeaders restricts the headers of the request sent to the authorization service,
+// e.g. Authorization and Cookie. All the headers are sent by default.
+func AuthRequestHeaders(names ...string) optSetter {
+	return func(f *ForwardAuth) error {
+		f.authRequestHeaders = canonicalHeaders(names)
+		return nil
+	}
+}
+
+// AuthResponseHeaders sets the headers of the answer of the authorization service copied onto the request
+// passed to the next handler. The headers sent by the client are always removed, so that they can not be forged.
+func AuthResponseHeaders(names ...string) optSetter {
+	return func(f *ForwardAuth) error {
+		f.authResponseHeaders = canonicalHeaders(names)
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler answering the requests when the authorization service can not be reached.
+// Defaults to utils.DefaultHandler.
+func ErrorHandler(h utils.ErrorHandler) optSetter {
+	return func(f *ForwardAuth) error {
+		f.errHandler = h
+		return nil
+	}
+}
+
+// Logger defines the logger the forward authentication will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(f *ForwardAuth) error {
+		f.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by forward authentication handler.
+func (f *ForwardAuth) Wrap(next http.Handler) {
+	f.next = next
+}
+
+func (f *ForwardAuth) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.log.Level >= log.DebugLevel {
+		logEntry := f.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/forwardauth: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/forwardauth: completed ServeHttp on request")
+	}
+
+	authReq, err := f.authRequest(req)
+	if err != nil {
+		f.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	client := *f.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	authRes, err := client.Do(authReq)
+	if err != nil {
+		f.log.Errorf("vulcand/oxy/forwardauth: error calling the authorization service %v, err: %v", f.address, err)
+		f.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer authRes.Body.Close()
+
+	if authRes.StatusCode < http.StatusOK || authRes.StatusCode >= http.StatusMultipleChoices {
+		f.log.Debugf("vulcand/oxy/forwardauth: rejecting Request(%v %v), authorization service answered %v", req.Method, req.URL, authRes.StatusCode)
+		utils.CopyHeaders(w.Header(), authRes.Header)
+		utils.RemoveHeaders(w.Header(), forward.HopHeaders...)
+		w.WriteHeader(authRes.StatusCode)
+		io.Copy(w, authRes.Body)
+		return
+	}
+
+	if len(f.authResponseHeaders) == 0 {
+		f.next.ServeHTTP(w, req)
+		return
+	}
+	outReq := new(http.Request)
+	*outReq = *req
+	// the headers are shared with the original request, work on a copy
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+	for _, name := range f.authResponseHeaders {
+		outReq.Header.Del(name)
+		if values := authRes.Header[name]; len(values) > 0 {
+			outReq.Header[name] = append([]string(nil), values...)
+		}
+	}
+	f.next.ServeHTTP(w, outReq)
+}
+
+// authRequest returns the request sent to the authorization service
+func (f *ForwardAuth) authRequest(req *http.Request) (*http.Request, error) {
+	authReq, err := http.NewRequest(http.MethodGet, f.address, nil)
+	if err != nil {
+		return nil, err
+	}
+	authReq = authReq.WithContext(req.Context())
+
+	if f.authRequestHeaders == nil {
+		utils.CopyHeaders(authReq.Header, req.Header)
+		utils.RemoveHeaders(authReq.Header, forward.HopHeaders...)
+	} else {
+		for _, name := range f.authRequestHeaders {
+			if values := req.Header[name]; len(values) > 0 {
+				authReq.Header[name] = append([]string(nil), values...)
+			}
+		}
+	}
+	// the length of the body of the original request does not apply
+	authReq.Header.Del(forward.ContentLength)
+
+	f.setForwardHeader(authReq.Header, req, XForwardedMethod, req.Method)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	f.setForwardHeader(authReq.Header, req, forward.XForwardedProto, proto)
+	f.setForwardHeader(authReq.Header, req, forward.XForwardedHost, req.Host)
+	f.setForwardHeader(authReq.Header, req, XForwardedUri, req.URL.RequestURI())
+
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := req.Header.Get(forward.XForwardedFor); f.trustForwardHeader && prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		authReq.Header.Set(forward.XForwardedFor, clientIP)
+	} else if !f.trustForwardHeader {
+		authReq.Header.Del(forward.XForwardedFor)
+	}
+	return authReq, nil
+}
+
+func (f *ForwardAuth) setForwardHeader(h http.Header, req *http.Request, name, value string) {
+	if f.trustForwardHeader && req.Header.Get(name) != "" {
+		h.Set(name, req.Header.Get(name))
+		return
+	}
+	h.Set(name, value)
+}
+
+func canonicalHeaders(names []string) []string {
+	canonical := make([]string, len(names))
+	for i, name := range names {
+		canonical[i] = http.CanonicalHeaderKey(name)
+	}
+	return canonical
+}
@@ -0,0 +1,143 @@
+package forwardauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestAuthorized(t *testing.T) {
+	var authReq *http.Request
+	authSrv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		authReq = req
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("who are you?"))
+			return
+		}
+		w.Header().Set("X-User", "alice")
+		w.Header().Set("X-Other", "ignored")
+	})
+	defer authSrv.Close()
+
+	var got *http.Request
+	fa, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+		w.Write([]byte("hello " + req.Header.Get("X-User")))
+	}), authSrv.URL+"/verify", AuthResponseHeaders("x-user"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(fa)
+	defer srv.Close()
+
+	re, body, err := testutils.Post(srv.URL+"/orders?page=2", testutils.Body("order"),
+		testutils.Header("Authorization", "Bearer token"),
+		testutils.Header("X-User", "mallory"),
+		testutils.Header("X-Forwarded-Host", "forged.example.com"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello alice", string(body))
+	assert.Empty(t, got.Header.Get("X-Other"))
+
+	assert.Equal(t, http.MethodGet, authReq.Method)
+	assert.Equal(t, "/verify", authReq.URL.Path)
+	assert.Equal(t, "Bearer token", authReq.Header.Get("Authorization"))
+	assert.Equal(t, http.MethodPost, authReq.Header.Get(XForwardedMethod))
+	assert.Equal(t, "http", authReq.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, srv.Listener.Addr().String(), authReq.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "/orders?page=2", authReq.Header.Get(XForwardedUri))
+	assert.Equal(t, "127.0.0.1", authReq.Header.Get("X-Forwarded-For"))
+	assert.EqualValues(t, 0, authReq.ContentLength)
+}
+
+func TestUnauthorized(t *testing.T) {
+	authSrv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("who are you?"))
+	})
+	defer authSrv.Close()
+
+	called := false
+	fa, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	}), authSrv.URL)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(fa)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, re.StatusCode)
+	assert.Equal(t, `Bearer realm="api"`, re.Header.Get("WWW-Authenticate"))
+	assert.Equal(t, "who are you?", string(body))
+	assert.False(t, called)
+}
+
+func TestRedirectNotFollowed(t *testing.T) {
+	authSrv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "https://login.example.com/?rd="+req.Header.Get(XForwardedUri), http.StatusFound)
+	})
+	defer authSrv.Close()
+
+	fa, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), authSrv.URL)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	fa.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/private", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://login.example.com/?rd=/private", w.Header().Get("Location"))
+}
+
+func TestTrustForwardHeader(t *testing.T) {
+	var authReq *http.Request
+	authSrv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		authReq = req
+	})
+	defer authSrv.Close()
+
+	fa, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), authSrv.URL,
+		TrustForwardHeader(true), AuthRequestHeaders("Cookie", "X-Forwarded-Host"))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Authorization", "Basic YWxpY2U6c2VjcmV0")
+	req.Header.Set("X-Forwarded-Host", "www.example.com")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	fa.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, authReq)
+	assert.Equal(t, "session=1", authReq.Header.Get("Cookie"))
+	assert.Empty(t, authReq.Header.Get("Authorization"))
+	assert.Equal(t, "www.example.com", authReq.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "192.0.2.1, 10.0.0.1", authReq.Header.Get("X-Forwarded-For"))
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	authSrv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {})
+	address := authSrv.URL
+	authSrv.Close()
+
+	fa, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), address)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	fa.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestOptionsValidation(t *testing.T) {
+	_, err := New(nil, "auth.internal/verify")
+	assert.Error(t, err)
+
+	_, err = New(nil, "http://auth.internal/verify", Client(nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,389 @@
+/*
+Package headers provides http.Handler middleware adding, setting and removing request and response headers.
+
+The rules are applied in order. The values are templates where {variable} is replaced by the value of the variable
+for the request:
+
+	{client.ip}              IP of the client
+	{request.host}           host requested by the client
+	{request.scheme}         http or https
+	{request.method}         method of the request
+	{request.path}           path of the request
+	{request.id}             ID assigned by the requestid middleware
+	{request.header.<name>}  header of the request
+	{request.cookie.<name>}  cookie of the request
+	{backend.host}           host of the backend the request is forwarded to
+
+The response headers are set once the next handler writes the response, overwriting the headers of the backend.
+
+Examples of a headers middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte("hello"))
+	})
+
+	headers.New(handler,
+	  // backend hints
+	  headers.SetRequestHeader("X-Client-Scheme", "{request.scheme}"),
+	  headers.RemoveRequestHeader("X-Internal-Token"),
+	  // security headers
+	  headers.SetResponseHeader("Strict-Transport-Security", "max-age=31536000; includeSubDomains"),
+	  headers.SetResponseHeader("X-Frame-Options", "DENY"),
+	  headers.SetResponseHeader("X-Served-By", "{backend.host}"),
+	  headers.RemoveResponseHeader("Server", "X-Powered-By"),
+	)
+*/
+package headers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Action is the action of a rule on a header
+type Action int
+
+const (
+	// ActionSet replaces the values of the header
+	ActionSet Action = iota
+	// ActionAdd appends a value to the header
+	ActionAdd
+	// ActionRemove removes the header
+	ActionRemove
+)
+
+// rule is a compiled header rule
+type rule struct {
+	action Action
+	name   string
+	value  template
+}
+
+func (r *rule) apply(h http.Header, req *http.Request) {
+	switch r.action {
+	case ActionSet:
+		h.Set(r.name, r.value.render(req))
+	case ActionAdd:
+		h.Add(r.name, r.value.render(req))
+	case ActionRemove:
+		h.Del(r.name)
+	}
+}
+
+// Headers applies header rules to the requests and the responses
+type Headers struct {
+	next          http.Handler
+	requestRules  []*rule
+	responseRules []*rule
+
+	log *log.Logger
+}
+
+// New returns a new headers middleware. New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*Headers, error) {
+	h := &Headers{
+		next: next,
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+type optSetter func(h *Headers) error
+
+// SetRequestHeader sets a header of the requests, value is a template
+func SetRequestHeader(name, value string) optSetter {
+	return requestRule(ActionSet, name, value)
+}
+
+// AddRequestHeader adds a value to a header of the requests, value is a template
+func AddRequestHeader(name, value string) optSetter {
+	return requestRule(ActionAdd, name, value)
+}
+
+// RemoveRequestHeader removes headers of the requests
+func RemoveRequestHeader(names ...string) optSetter {
+	return func(h *Headers) error {
+		for _, name := range names {
+			if err := requestRule(ActionRemove, name, "")(h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// SetResponseHeader sets a header of the responses, value is a template
+func SetResponseHeader(name, value string) optSetter {
+	return responseRule(ActionSet, name, value)
+}
+
+// AddResponseHeader adds a value to a header of the responses, value is a template
+func AddResponseHeader(name, value string) optSetter {
+	return responseRule(ActionAdd, name, value)
+}
+
+// RemoveResponseHeader removes headers of the responses
+func RemoveResponseHeader(names ...string) optSetter {
+	return func(h *Headers) error {
+		for _, name := range names {
+			if err := responseRule(ActionRemove, name, "")(h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Logger defines the logger the headers middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(h *Headers) error {
+		h.log = l
+		return nil
+	}
+}
+
+func requestRule(action Action, name, value string) optSetter {
+	return func(h *Headers) error {
+		r, err := newRule(action, name, value)
+		if err != nil {
+			return err
+		}
+		h.requestRules = append(h.requestRules, r)
+		return nil
+	}
+}
+
+func responseRule(action Action, name, value string) optSetter {
+	return func(h *Headers) error {
+		r, err := newRule(action, name, value)
+		if err != nil {
+			return err
+		}
+		h.responseRules = append(h.responseRules, r)
+		return nil
+	}
+}
+
+func newRule(action Action, name, value string) (*rule, error) {
+	if name == "" {
+		return nil, fmt.Errorf("header name can not be empty")
+	}
+	t, err := parseTemplate(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of header %v: %v", name, err)
+	}
+	return &rule{action: action, name: http.CanonicalHeaderKey(name), value: t}, nil
+}
+
+// Wrap sets the next handler to be called by headers handler.
+func (h *Headers) Wrap(next http.Handler) {
+	h.next = next
+}
+
+func (h *Headers) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.log.Level >= log.DebugLevel {
+		logEntry := h.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/headers: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/headers: completed ServeHttp on request")
+	}
+
+	// the forwarder records the backend in the upstream of the request, for {backend.host}
+	outReq := req
+	if len(h.responseRules) != 0 && utils.UpstreamFromRequest(req) == nil {
+		outReq, _ = utils.WithUpstream(req)
+	}
+
+	if len(h.requestRules) != 0 {
+		if outReq == req {
+			outReq = req.WithContext(req.Context())
+		}
+		// the headers are shared with the original request, work on a copy
+		outReq.Header = make(http.Header)
+		utils.CopyHeaders(outReq.Header, req.Header)
+		for _, r := range h.requestRules {
+			r.apply(outReq.Header, outReq)
+		}
+	}
+
+	if len(h.responseRules) == 0 {
+		h.next.ServeHTTP(w, outReq)
+		return
+	}
+
+	hw := &headersWriter{ResponseWriter: w, req: outReq, rules: h.responseRules}
+	h.next.ServeHTTP(hw, outReq)
+
+	// the next handler did not write anything, the response is sent once this handler returns
+	if !hw.headerWritten {
+		hw.applyRules()
+	}
+}
+
+// headersWriter applies the response rules right before the headers are sent
+type headersWriter struct {
+	http.ResponseWriter
+	req           *http.Request
+	rules         []*rule
+	headerWritten bool
+}
+
+func (hw *headersWriter) applyRules() {
+	hw.headerWritten = true
+	for _, r := range hw.rules {
+		r.apply(hw.ResponseWriter.Header(), hw.req)
+	}
+}
+
+func (hw *headersWriter) WriteHeader(code int) {
+	// informational responses carry their own headers
+	if !hw.headerWritten && (code < 100 || code >= 200 || code == http.StatusSwitchingProtocols) {
+		hw.applyRules()
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headersWriter) Write(b []byte) (int, error) {
+	if !hw.headerWritten {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client
+func (hw *headersWriter) Flush() {
+	if !hw.headerWritten {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true) when the client connection has gone away
+func (hw *headersWriter) CloseNotify() <-chan bool {
+	if cn, ok := hw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (hw *headersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := hw.ResponseWriter.(http.Hijacker); ok {
+		hw.headerWritten = true
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", hw.ResponseWriter)
+}
+
+// template is a header value with {variable} placeholders
+type template []segment
+
+// segment is either a literal or a variable
+type segment struct {
+	literal  string
+	variable func(req *http.Request) string
+}
+
+func (t template) render(req *http.Request) string {
+	if len(t) == 1 && t[0].variable == nil {
+		return t[0].literal
+	}
+	b := &strings.Builder{}
+	for _, s := range t {
+		if s.variable != nil {
+			b.WriteString(s.variable(req))
+		} else {
+			b.WriteString(s.literal)
+		}
+	}
+	return b.String()
+}
+
+func parseTemplate(value string) (template, error) {
+	var t template
+	for {
+		start := strings.IndexByte(value, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in %q", value)
+		}
+		v, err := newVariable(value[start+1 : start+end])
+		if err != nil {
+			return nil, err
+		}
+		if start > 0 {
+			t = append(t, segment{literal: value[:start]})
+		}
+		t = append(t, segment{variable: v})
+		value = value[start+end+1:]
+	}
+	if value != "" || len(t) == 0 {
+		t = append(t, segment{literal: value})
+	}
+	return t, nil
+}
+
+func newVariable(name string) (func(req *http.Request) string, error) {
+	switch name {
+	case "client.ip":
+		return clientIP, nil
+	case "request.scheme":
+		return scheme, nil
+	case "request.method":
+		return func(req *http.Request) string { return req.Method }, nil
+	case "request.id":
+		return utils.RequestIDFromRequest, nil
+	case "backend.host":
+		return backendHost, nil
+	}
+	extractor, err := utils.NewExtractor(name)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported variable %q", name)
+	}
+	return func(req *http.Request) string {
+		v, _, _ := extractor.Extract(req)
+		return v
+	}, nil
+}
+
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func scheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// backendHost returns the host of the backend recorded by the forwarder, or the host of the URL of the request
+// when a load balancer already rewrote it
+func backendHost(req *http.Request) string {
+	if u := utils.UpstreamFromRequest(req).URL(); u != nil {
+		return u.Host
+	}
+	return req.URL.Host
+}
@@ -0,0 +1,117 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRequestHeaders(t *testing.T) {
+	var got http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	})
+
+	h, err := New(handler,
+		SetRequestHeader("X-Client", "{client.ip} via {request.scheme}"),
+		AddRequestHeader("X-Tags", "{request.method}:{request.path}"),
+		SetRequestHeader("X-Copied", "{request.header.X-Original}"),
+		RemoveRequestHeader("X-Secret", "X-Other-Secret"),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/users", nil)
+	req.RemoteAddr = "[::1]:4242"
+	req.Header.Set("X-Tags", "first")
+	req.Header.Set("X-Original", "value")
+	req.Header.Set("X-Secret", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "::1 via http", got.Get("X-Client"))
+	assert.Equal(t, []string{"first", "POST:/users"}, got["X-Tags"])
+	assert.Equal(t, "value", got.Get("X-Copied"))
+	assert.Empty(t, got.Get("X-Secret"))
+
+	// the original request is untouched
+	assert.Equal(t, "secret", req.Header.Get("X-Secret"))
+	assert.Empty(t, req.Header.Get("X-Client"))
+}
+
+func TestResponseHeaders(t *testing.T) {
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Write([]byte("hello"))
+	})
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	h, err := New(handler,
+		SetResponseHeader("Strict-Transport-Security", "max-age=31536000"),
+		SetResponseHeader("X-Frame-Options", "DENY"),
+		SetResponseHeader("X-Served-By", "{backend.host}"),
+		RemoveResponseHeader("Server"),
+	)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, "max-age=31536000", re.Header.Get("Strict-Transport-Security"))
+	assert.Equal(t, []string{"DENY"}, re.Header["X-Frame-Options"])
+	assert.Equal(t, testutils.ParseURI(backend.URL).Host, re.Header.Get("X-Served-By"))
+	assert.Empty(t, re.Header.Get("Server"))
+}
+
+func TestResponseHeadersWithoutBody(t *testing.T) {
+	h, err := New(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		AddResponseHeader("X-Id", "{request.host}"))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, "example.com", rw.Header().Get("X-Id"))
+}
+
+func TestTemplates(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-A", "a")
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "", expected: ""},
+		{value: "plain", expected: "plain"},
+		{value: "{request.header.X-A}", expected: "a"},
+		{value: "<{request.header.X-A}{request.header.X-A}>", expected: "<aa>"},
+	}
+	for _, test := range tests {
+		tpl, err := parseTemplate(test.value)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, tpl.render(req), test.value)
+	}
+
+	for _, value := range []string{"{request.header.X-A", "{unknown}", "{}"} {
+		_, err := parseTemplate(value)
+		assert.Error(t, err, value)
+	}
+
+	_, err := New(nil, SetResponseHeader("", "value"))
+	assert.Error(t, err)
+}
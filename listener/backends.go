@@ -0,0 +1,128 @@
+package listener
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrListenerClosed is returned by the Accept method of a closed ConnListener
+var ErrListenerClosed = errors.New("listener closed")
+
+// ConnListener is a net.Listener accepting the connections dispatched to it by a Router,
+// so that an http.Server serving oxy handlers can serve them with Serve or ServeTLS
+type ConnListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+// NewConnListener returns a new ConnListener reporting addr as its address, usually the one of the listener of the router
+func NewConnListener(addr net.Addr) *ConnListener {
+	return &ConnListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// ServeConn hands the connection to the next Accept call, it is closed if the listener is closed
+func (l *ConnListener) ServeConn(conn *Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept waits for the next connection dispatched to the listener
+func (l *ConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the listener, the connections dispatched to it afterwards are closed
+func (l *ConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the address of the listener
+func (l *ConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// DefaultDialTimeout is the time the TCP backends have to accept the connections
+const DefaultDialTimeout = 10 * time.Second
+
+// TCPBackend passes the connections through to a TCP server, e.g. a server terminating TLS itself
+type TCPBackend struct {
+	addr        string
+	dialTimeout time.Duration
+
+	log *log.Logger
+}
+
+// TCPBackendOption provides options for the TCP backends
+type TCPBackendOption func(b *TCPBackend) error
+
+// TCPDialTimeout sets the time the backend has to accept the connections, defaults to DefaultDialTimeout
+func TCPDialTimeout(d time.Duration) TCPBackendOption {
+	return func(b *TCPBackend) error {
+		if d <= 0 {
+			return errors.New("dial timeout should be > 0")
+		}
+		b.dialTimeout = d
+		return nil
+	}
+}
+
+// TCPLogger defines the logger the backend will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func TCPLogger(l *log.Logger) TCPBackendOption {
+	return func(b *TCPBackend) error {
+		b.log = l
+		return nil
+	}
+}
+
+// NewTCPBackend returns a new TCPBackend passing the connections through to the address
+func NewTCPBackend(addr string, opts ...TCPBackendOption) (*TCPBackend, error) {
+	b := &TCPBackend{
+		addr:        addr,
+		dialTimeout: DefaultDialTimeout,
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// ServeConn copies the bytes of the connection to the backend and back until both sides are done
+func (b *TCPBackend) ServeConn(conn *Conn) {
+	defer conn.Close()
+
+	backend, err := net.DialTimeout("tcp", b.addr, b.dialTimeout)
+	if err != nil {
+		b.log.Errorf("vulcand/oxy/listener: failed to dial %v for %v: %v", b.addr, conn.RemoteAddr(), err)
+		return
+	}
+	defer backend.Close()
+
+	// the bytes of the connection are read from conn, the ClientHello was buffered
+	utils.Splice(conn.Conn, conn, backend)
+}
@@ -0,0 +1,82 @@
+package listener
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// recordTypeHandshake is the first byte of the TLS records carrying a ClientHello
+const recordTypeHandshake = 0x16
+
+var errHelloRead = errors.New("client hello read")
+
+// Conn is a connection dispatched by the Router, the bytes read to inspect the ClientHello are replayed
+// to its handler
+type Conn struct {
+	net.Conn
+	// TLS tells if the connection starts with a TLS handshake
+	TLS bool
+	// ServerName is the SNI of the ClientHello, in lower case
+	ServerName string
+	// Protocols are the ALPN protocols offered by the client
+	Protocols []string
+
+	r io.Reader
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// readOnlyConn feeds the TLS server inspecting the ClientHello, it never writes to the client
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// peekClientHello reads the ClientHello of the connection, if it starts with a TLS handshake,
+// and returns the connection replaying the bytes read
+func peekClientHello(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	c := &Conn{Conn: conn}
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, err
+	}
+	if first[0] != recordTypeHandshake {
+		c.r = io.MultiReader(bytes.NewReader(first), conn)
+		return c, nil
+	}
+
+	buf := bytes.NewBuffer(first)
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{Conn: conn, r: io.MultiReader(bytes.NewReader(first), io.TeeReader(conn, buf))}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	c.r = io.MultiReader(bytes.NewReader(buf.Bytes()), conn)
+	if hello == nil {
+		return nil, err
+	}
+
+	c.TLS = true
+	c.ServerName = strings.ToLower(hello.ServerName)
+	c.Protocols = append([]string(nil), hello.SupportedProtos...)
+	return c, nil
+}
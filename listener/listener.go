@@ -0,0 +1,253 @@
+/*
+Package listener provides a TCP front-end dispatching the connections by the SNI and the ALPN protocols of their TLS ClientHello.
+
+The connections are inspected without terminating TLS: they can be passed through to raw TCP backends, for the tenants
+terminating TLS themselves, or handed to http.Servers serving oxy handlers, which terminate TLS or serve plain HTTP.
+The routes are tried in order, the first matching route serves the connection.
+
+Examples of a listener:
+
+	// the http.Server terminating TLS for the proxied domains
+	proxied := listener.NewConnListener(l.Addr())
+	go (&http.Server{Handler: lb}).ServeTLS(proxied, "cert.pem", "key.pem")
+	plain := listener.NewConnListener(l.Addr())
+	go (&http.Server{Handler: lb}).Serve(plain)
+
+	// the tenants terminating TLS themselves
+	tenants, _ := listener.NewTCPBackend("10.0.0.6:443")
+
+	r, _ := listener.New(listener.Routes(
+		listener.Route{ServerName: "*.tenant.example.com", Handler: tenants},
+		listener.Route{Protocols: []string{"h2", "http/1.1"}, Handler: proxied},
+		// plain HTTP
+		listener.Route{Handler: plain},
+	))
+	r.Serve(l)
+*/
+package listener
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultHelloTimeout is the time the clients have to send their ClientHello
+const DefaultHelloTimeout = 10 * time.Second
+
+// Handler serves the connections dispatched by the Router, the handlers own the connections and must close them
+type Handler interface {
+	ServeConn(conn *Conn)
+}
+
+// HandlerFunc is an adapter to use a function as a Handler
+type HandlerFunc func(conn *Conn)
+
+// ServeConn calls f(conn)
+func (f HandlerFunc) ServeConn(conn *Conn) {
+	f(conn)
+}
+
+// Route maps the connections matching a server name and protocols to a handler
+type Route struct {
+	// ServerName is the SNI of the connections, "*.example.com" matches all the subdomains of example.com,
+	// an empty server name matches all the connections, the ones without TLS included
+	ServerName string
+	// Protocols are the ALPN protocols the route serves, the connections offering one of them match,
+	// none matches all the connections
+	Protocols []string
+	// Handler serves the matching connections
+	Handler Handler
+}
+
+type compiledRoute struct {
+	Route
+	serverName string
+	wildcard   bool
+}
+
+func (r *compiledRoute) match(conn *Conn) bool {
+	if r.serverName != "" {
+		if !conn.TLS {
+			return false
+		}
+		if r.wildcard {
+			if !strings.HasSuffix(conn.ServerName, r.serverName) || len(conn.ServerName) == len(r.serverName) {
+				return false
+			}
+		} else if conn.ServerName != r.serverName {
+			return false
+		}
+	}
+	if len(r.Protocols) == 0 {
+		return true
+	}
+	for _, p := range r.Protocols {
+		for _, offered := range conn.Protocols {
+			if p == offered {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// table is the immutable route table swapped on updates
+type table struct {
+	routes []*compiledRoute
+}
+
+// Router dispatches the connections to the handler of the first matching route
+type Router struct {
+	table        atomic.Value // holds a *table
+	notFound     Handler
+	helloTimeout time.Duration
+
+	log *log.Logger
+}
+
+// New returns a new router without routes. New() function supports optional functional arguments
+func New(setters ...optSetter) (*Router, error) {
+	r := &Router{
+		helloTimeout: DefaultHelloTimeout,
+
+		log: log.StandardLogger(),
+	}
+	r.table.Store(&table{})
+	for _, s := range setters {
+		if err := s(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type optSetter func(r *Router) error
+
+// Routes sets the initial routes of the router
+func Routes(routes ...Route) optSetter {
+	return func(r *Router) error {
+		return r.SetRoutes(routes)
+	}
+}
+
+// NotFound sets the handler serving the connections matching no route, they are closed by default
+func NotFound(h Handler) optSetter {
+	return func(r *Router) error {
+		if h == nil {
+			return fmt.Errorf("not found handler can not be nil")
+		}
+		r.notFound = h
+		return nil
+	}
+}
+
+// HelloTimeout sets the time the clients have to send their ClientHello, defaults to DefaultHelloTimeout
+func HelloTimeout(d time.Duration) optSetter {
+	return func(r *Router) error {
+		if d <= 0 {
+			return fmt.Errorf("hello timeout should be > 0")
+		}
+		r.helloTimeout = d
+		return nil
+	}
+}
+
+// Logger defines the logger the router will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(r *Router) error {
+		r.log = l
+		return nil
+	}
+}
+
+// SetRoutes replaces the route table. The table is left untouched if one of the routes is invalid.
+func (r *Router) SetRoutes(routes []Route) error {
+	t := &table{routes: make([]*compiledRoute, 0, len(routes))}
+	for i, route := range routes {
+		if route.Handler == nil {
+			return fmt.Errorf("invalid route %d: handler can not be nil", i)
+		}
+		cr := &compiledRoute{Route: route, serverName: strings.ToLower(route.ServerName)}
+		if strings.HasPrefix(cr.serverName, "*.") {
+			cr.serverName = cr.serverName[1:]
+			cr.wildcard = true
+		}
+		if strings.Contains(cr.serverName, "*") {
+			return fmt.Errorf("invalid route %d: unsupported server name pattern %v", i, route.ServerName)
+		}
+		t.routes = append(t.routes, cr)
+	}
+	r.table.Store(t)
+	return nil
+}
+
+// Routes returns the current routes
+func (r *Router) Routes() []Route {
+	t := r.table.Load().(*table)
+	routes := make([]Route, len(t.routes))
+	for i, cr := range t.routes {
+		routes[i] = cr.Route
+	}
+	return routes
+}
+
+// Serve accepts the connections of the listener and dispatches them until the listener is closed
+func (r *Router) Serve(l net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				r.log.Warnf("vulcand/oxy/listener: accept error: %v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go r.ServeConn(conn)
+	}
+}
+
+// ServeConn reads the ClientHello of the connection and dispatches it to the handler of the first matching route
+func (r *Router) ServeConn(conn net.Conn) {
+	c, err := peekClientHello(conn, r.helloTimeout)
+	if err != nil {
+		r.log.Debugf("vulcand/oxy/listener: failed to read the client hello of %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if h := r.match(c); h != nil {
+		h.ServeConn(c)
+		return
+	}
+	r.log.Debugf("vulcand/oxy/listener: no route for %v, server name %q, protocols %v", conn.RemoteAddr(), c.ServerName, c.Protocols)
+	if r.notFound != nil {
+		r.notFound.ServeConn(c)
+		return
+	}
+	conn.Close()
+}
+
+// match returns the handler of the first route matching the connection, nil if none matches
+func (r *Router) match(conn *Conn) Handler {
+	for _, cr := range r.table.Load().(*table).routes {
+		if cr.match(conn) {
+			return cr.Handler
+		}
+	}
+	return nil
+}
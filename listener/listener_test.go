@@ -0,0 +1,154 @@
+package listener
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRouter(t *testing.T, routes ...Route) (*Router, string) {
+	r, err := New(Routes(routes...), HelloTimeout(time.Second))
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go r.Serve(l)
+	return r, l.Addr().String()
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	backend, err := testutils.NewTLSTestServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("backend " + req.TLS.ServerName))
+	}))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	tcp, err := NewTCPBackend(backend.Listener.Addr().String())
+	require.NoError(t, err)
+
+	_, addr := newRouter(t, Route{ServerName: "LOCALHOST", Handler: tcp})
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	// the TLS connection is terminated by the backend
+	re, body, err := testutils.Get("https://localhost:"+port, testutils.TLSConfig(backend.ClientTLSConfig()))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "backend localhost", string(body))
+
+	// no route for the IP address, the connection is closed
+	_, _, err = testutils.Get("https://"+addr, testutils.TLSConfig(backend.ClientTLSConfig()))
+	assert.Error(t, err)
+}
+
+func TestDispatchToHTTPServers(t *testing.T) {
+	ca, err := testutils.NewTestCA()
+	require.NoError(t, err)
+	cert, err := ca.ServerCertificate("api.example.com", "h2.example.com")
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serve := func(name string, tlsConfig *tls.Config) *ConnListener {
+		cl := NewConnListener(l.Addr())
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name))
+		})}
+		if tlsConfig != nil {
+			go srv.Serve(tls.NewListener(cl, tlsConfig))
+		} else {
+			go srv.Serve(cl)
+		}
+		return cl
+	}
+	api := serve("api", &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer api.Close()
+	alpn := serve("alpn", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}})
+	defer alpn.Close()
+	plain := serve("plain", nil)
+	defer plain.Close()
+
+	r, err := New(Routes(
+		Route{ServerName: "*.example.com", Protocols: []string{"http/1.1"}, Handler: alpn},
+		Route{ServerName: "*.example.com", Handler: api},
+		Route{Handler: plain},
+	))
+	require.NoError(t, err)
+	go r.Serve(l)
+	defer l.Close()
+
+	get := func(serverName string, protos ...string) string {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName: serverName,
+			RootCAs:    ca.Pool(),
+			NextProtos: protos,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		client := &http.Client{Transport: &http.Transport{
+			DialTLS: func(string, string) (net.Conn, error) { return conn, nil },
+		}}
+		re, err := client.Get("https://" + serverName)
+		require.NoError(t, err)
+		defer re.Body.Close()
+		body := make([]byte, 16)
+		n, _ := re.Body.Read(body)
+		return string(body[:n])
+	}
+
+	assert.Equal(t, "api", get("api.example.com"))
+	assert.Equal(t, "alpn", get("h2.example.com", "http/1.1"))
+
+	re, body, err := testutils.Get("http://" + l.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "plain", string(body))
+}
+
+func TestPeekClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{ServerName: "Example.COM", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+
+	c, err := peekClientHello(server, time.Second)
+	require.NoError(t, err)
+	assert.True(t, c.TLS)
+	assert.Equal(t, "example.com", c.ServerName)
+	assert.Equal(t, []string{"h2", "http/1.1"}, c.Protocols)
+
+	// the ClientHello is replayed
+	hello := make([]byte, 1)
+	_, err = c.Read(hello)
+	require.NoError(t, err)
+	assert.Equal(t, byte(recordTypeHandshake), hello[0])
+	client.Close()
+}
+
+func TestSetRoutes(t *testing.T) {
+	r, err := New()
+	require.NoError(t, err)
+
+	h := HandlerFunc(func(conn *Conn) { conn.Close() })
+	require.NoError(t, r.SetRoutes([]Route{{ServerName: "*.example.com", Handler: h}}))
+	assert.Len(t, r.Routes(), 1)
+
+	assert.Error(t, r.SetRoutes([]Route{{ServerName: "a.*.com", Handler: h}}))
+	assert.Error(t, r.SetRoutes([]Route{{ServerName: "example.com"}}))
+	assert.Len(t, r.Routes(), 1)
+
+	assert.NotNil(t, r.match(&Conn{TLS: true, ServerName: "a.example.com"}))
+	assert.Nil(t, r.match(&Conn{TLS: true, ServerName: "example.com"}))
+	assert.Nil(t, r.match(&Conn{}))
+
+	_, err = New(HelloTimeout(0))
+	assert.Error(t, err)
+}
@@ -64,15 +64,46 @@ func (c *RollingCounter) Append(o *RollingCounter) error {
 	return nil
 }
 
+// Merge adds the values of the other counter bucket by bucket, so that the merged counter keeps rolling
+// the values recorded by the other one at the time they were recorded. Both counters must have the same resolution
+// and number of buckets.
+func (c *RollingCounter) Merge(o *RollingCounter) error {
+	if o == nil {
+		return fmt.Errorf("other is nil")
+	}
+	if c == o {
+		return fmt.Errorf("counter cannot merge with itself")
+	}
+	if c.resolution != o.resolution || len(c.values) != len(o.values) {
+		return fmt.Errorf("can't merge counters of different windows: %d buckets of %v and %d buckets of %v",
+			len(c.values), c.resolution, len(o.values), o.resolution)
+	}
+
+	c.cleanup()
+	other := o.Clone()
+	for i, v := range other.values {
+		c.values[i] += v
+	}
+	if other.lastUpdated.After(c.lastUpdated) {
+		c.lastUpdated = other.lastUpdated
+		c.lastBucket = other.lastBucket
+	}
+	if other.countedBuckets > c.countedBuckets {
+		c.countedBuckets = other.countedBuckets
+	}
+	return nil
+}
+
 // Clone clone a counter
 func (c *RollingCounter) Clone() *RollingCounter {
 	c.cleanup()
 	other := &RollingCounter{
-		resolution:  c.resolution,
-		values:      make([]int, len(c.values)),
-		clock:       c.clock,
-		lastBucket:  c.lastBucket,
-		lastUpdated: c.lastUpdated,
+		resolution:     c.resolution,
+		values:         make([]int, len(c.values)),
+		clock:          c.clock,
+		countedBuckets: c.countedBuckets,
+		lastBucket:     c.lastBucket,
+		lastUpdated:    c.lastUpdated,
 	}
 	copy(other.values, c.values)
 	return other
@@ -138,16 +169,16 @@ func (c *RollingCounter) incBucketValue(v int) {
 
 // Returns the number in the moving window bucket that this slot occupies
 func (c *RollingCounter) getBucket(t time.Time) int {
-	return int(t.Truncate(c.resolution).Unix() % int64(len(c.values)))
+	return int(t.UnixNano() / int64(c.resolution) % int64(len(c.values)))
 }
 
 // Reset buckets that were not updated
 func (c *RollingCounter) cleanup() {
 	now := c.clock.UtcNow()
 	for i := 0; i < len(c.values); i++ {
-		now = now.Add(time.Duration(-1*i) * c.resolution)
-		if now.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
-			c.values[c.getBucket(now)] = 0
+		t := now.Add(time.Duration(-1*i) * c.resolution)
+		if t.Truncate(c.resolution).After(c.lastUpdated.Truncate(c.resolution)) {
+			c.values[c.getBucket(t)] = 0
 		} else {
 			break
 		}
@@ -30,3 +30,39 @@ func TestCloneExpired(t *testing.T) {
 
 	assert.EqualValues(t, 2, out.Count())
 }
+
+func TestCounterMerge(t *testing.T) {
+	clockTest := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	a, err := NewCounter(3, time.Second, CounterClock(clockTest))
+	require.NoError(t, err)
+	b, err := NewCounter(3, time.Second, CounterClock(clockTest))
+	require.NoError(t, err)
+
+	b.Inc(2)
+	clockTest.Sleep(time.Second)
+	a.Inc(1)
+	b.Inc(1)
+
+	require.NoError(t, a.Merge(b))
+	assert.EqualValues(t, 4, a.Count())
+	assert.EqualValues(t, 2, a.CountedBuckets())
+	assert.EqualValues(t, 3, b.Count())
+
+	// the values merged from b are rolled out when they were recorded
+	clockTest.Sleep(2 * time.Second)
+	assert.EqualValues(t, 2, a.Count())
+}
+
+func TestCounterMergeInvalid(t *testing.T) {
+	a, err := NewCounter(3, time.Second)
+	require.NoError(t, err)
+	b, err := NewCounter(2, time.Second)
+	require.NoError(t, err)
+
+	assert.Error(t, a.Merge(b))
+	assert.Error(t, a.Merge(nil))
+	assert.Error(t, a.Merge(a))
+}
@@ -0,0 +1,92 @@
+package memmetrics
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+type ewmaOptSetter func(*EWMA) error
+
+// EWMAClock defines the clock of the moving average
+func EWMAClock(c timetools.TimeProvider) ewmaOptSetter {
+	return func(e *EWMA) error {
+		e.clock = c
+		return nil
+	}
+}
+
+// EWMAPeak makes the values above the average replace it rather than being averaged with it, so that the average
+// follows the peaks at once and decays from them slowly.
+func EWMAPeak() ewmaOptSetter {
+	return func(e *EWMA) error {
+		e.peak = true
+		return nil
+	}
+}
+
+// EWMA is an exponentially weighted moving average of values observed over time. The weight of a value decays with
+// its age rather than with the number of values observed since: it is divided by e every decay period, so that the
+// average follows the recent values however irregularly they are observed.
+type EWMA struct {
+	clock   timetools.TimeProvider
+	decay   time.Duration
+	peak    bool
+	value   float64
+	ready   bool
+	updated time.Time
+}
+
+// NewEWMA creates a moving average forgetting the values with the given decay period
+func NewEWMA(decay time.Duration, options ...ewmaOptSetter) (*EWMA, error) {
+	if decay <= 0 {
+		return nil, fmt.Errorf("decay should be > 0, got %v", decay)
+	}
+
+	e := &EWMA{decay: decay}
+	for _, o := range options {
+		if err := o(e); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.clock == nil {
+		e.clock = &timetools.RealTime{}
+	}
+	return e, nil
+}
+
+// Update adds a value to the average, weighted by the time elapsed since the previous one. The first value is
+// taken as is, as are the values above the average if it follows the peaks.
+func (e *EWMA) Update(v float64) {
+	now := e.clock.UtcNow()
+	if !e.ready || (e.peak && v > e.value) {
+		e.value, e.ready, e.updated = v, true, now
+		return
+	}
+
+	elapsed := now.Sub(e.updated)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	w := math.Exp(-float64(elapsed) / float64(e.decay))
+	e.value = e.value*w + v*(1-w)
+	e.updated = now
+}
+
+// Value returns the average, 0 if no value was observed
+func (e *EWMA) Value() float64 {
+	return e.value
+}
+
+// IsReady returns true if a value was observed
+func (e *EWMA) IsReady() bool {
+	return e.ready
+}
+
+// Reset forgets the values observed
+func (e *EWMA) Reset() {
+	e.value, e.ready, e.updated = 0, false, time.Time{}
+}
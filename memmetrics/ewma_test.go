@@ -0,0 +1,65 @@
+package memmetrics
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEWMA(t *testing.T) {
+	clockTest := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	e, err := NewEWMA(time.Second, EWMAClock(clockTest))
+	require.NoError(t, err)
+	assert.False(t, e.IsReady())
+	assert.Equal(t, 0.0, e.Value())
+
+	e.Update(10)
+	assert.True(t, e.IsReady())
+	assert.Equal(t, 10.0, e.Value())
+
+	// the values observed at the same time do not move the average
+	e.Update(100)
+	assert.Equal(t, 10.0, e.Value())
+
+	// the weight of the average is divided by e every decay period
+	clockTest.Sleep(time.Second)
+	e.Update(20)
+	assert.InDelta(t, 20-10/math.E, e.Value(), 1e-9)
+
+	clockTest.Sleep(time.Hour)
+	e.Update(5)
+	assert.InDelta(t, 5, e.Value(), 1e-9)
+
+	e.Reset()
+	assert.False(t, e.IsReady())
+	assert.Equal(t, 0.0, e.Value())
+}
+
+func TestEWMAPeak(t *testing.T) {
+	clockTest := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	e, err := NewEWMA(time.Second, EWMAClock(clockTest), EWMAPeak())
+	require.NoError(t, err)
+
+	e.Update(10)
+	e.Update(50)
+	assert.Equal(t, 50.0, e.Value())
+
+	clockTest.Sleep(time.Second)
+	e.Update(10)
+	assert.InDelta(t, 10+40/math.E, e.Value(), 1e-9)
+}
+
+func TestEWMADecay(t *testing.T) {
+	_, err := NewEWMA(0)
+	assert.Error(t, err)
+}
@@ -70,6 +70,60 @@ func (h *HDRHistogram) RecordValues(v, n int64) error {
 	return h.h.RecordValues(v, n)
 }
 
+// TotalCount returns the number of recorded values
+func (h *HDRHistogram) TotalCount() int64 {
+	return h.h.TotalCount()
+}
+
+// Min returns the approximate minimum recorded value
+func (h *HDRHistogram) Min() int64 {
+	return h.h.Min()
+}
+
+// Max returns the approximate maximum recorded value
+func (h *HDRHistogram) Max() int64 {
+	return h.h.Max()
+}
+
+// Mean returns the approximate arithmetic mean of the recorded values
+func (h *HDRHistogram) Mean() float64 {
+	return h.h.Mean()
+}
+
+// StdDev returns the approximate standard deviation of the recorded values
+func (h *HDRHistogram) StdDev() float64 {
+	return h.h.StdDev()
+}
+
+// LatencySummary summarizes the latencies recorded with microsecond precision at the given quantiles,
+// in percents, or at DefaultQuantiles if none are given
+func (h *HDRHistogram) LatencySummary(quantiles ...float64) (*LatencySummary, error) {
+	if len(quantiles) == 0 {
+		quantiles = DefaultQuantiles
+	}
+	for _, q := range quantiles {
+		if q <= 0 || q > 100 {
+			return nil, fmt.Errorf("quantile should be in (0, 100] got %v", q)
+		}
+	}
+	s := &LatencySummary{Quantiles: make([]Quantile, len(quantiles))}
+	for i, q := range quantiles {
+		s.Quantiles[i].Quantile = q
+	}
+	if h.h == nil || h.h.TotalCount() == 0 {
+		return s, nil
+	}
+	s.Count = h.TotalCount()
+	s.Min = time.Duration(h.Min()) * time.Microsecond
+	s.Max = time.Duration(h.Max()) * time.Microsecond
+	s.Mean = time.Duration(h.Mean() * float64(time.Microsecond))
+	s.StdDev = time.Duration(h.StdDev() * float64(time.Microsecond))
+	for i, q := range quantiles {
+		s.Quantiles[i].Latency = h.LatencyAtQuantile(q)
+	}
+	return s, nil
+}
+
 // Merge merge a HDRHistogram
 func (h *HDRHistogram) Merge(other *HDRHistogram) error {
 	if other == nil {
@@ -79,6 +133,35 @@ func (h *HDRHistogram) Merge(other *HDRHistogram) error {
 	return nil
 }
 
+// DefaultQuantiles are the quantiles of the latency summaries, in percents
+var DefaultQuantiles = []float64{50, 90, 95, 99}
+
+// Quantile is the latency below which a given percentage of the requests completed
+type Quantile struct {
+	Quantile float64       `json:"quantile"` // Quantile - percentage of the requests, e.g. 99
+	Latency  time.Duration `json:"latency"`  // Latency - latency at the quantile
+}
+
+// LatencySummary is a summary of the latencies observed over a window
+type LatencySummary struct {
+	Count     int64         `json:"count"`     // Count - number of latencies recorded
+	Min       time.Duration `json:"min"`       // Min - lowest latency
+	Max       time.Duration `json:"max"`       // Max - highest latency
+	Mean      time.Duration `json:"mean"`      // Mean - arithmetic mean of the latencies
+	StdDev    time.Duration `json:"stddev"`    // StdDev - standard deviation of the latencies
+	Quantiles []Quantile    `json:"quantiles"` // Quantiles - latencies at the requested quantiles, in order
+}
+
+// Latency returns the latency at the quantile q, false if it was not requested
+func (s *LatencySummary) Latency(q float64) (time.Duration, bool) {
+	for _, quantile := range s.Quantiles {
+		if quantile.Quantile == q {
+			return quantile.Latency, true
+		}
+	}
+	return 0, false
+}
+
 type rhOptSetter func(r *RollingHDRHistogram) error
 
 // RollingClock sets a clock
@@ -170,6 +253,29 @@ func (r *RollingHDRHistogram) Append(o *RollingHDRHistogram) error {
 	return nil
 }
 
+// Merge adds the values of the other histogram window by window: the current histogram of the other one
+// is merged into the current one, the previous one into the previous one and so on, so that the merged values
+// are rolled out when they would have been by the other histogram. Both must have the same parameters.
+func (r *RollingHDRHistogram) Merge(o *RollingHDRHistogram) error {
+	if o == nil {
+		return fmt.Errorf("other is nil")
+	}
+	if r == o {
+		return fmt.Errorf("histogram cannot merge with itself")
+	}
+	if r.bucketCount != o.bucketCount || r.period != o.period || r.low != o.low || r.high != o.high || r.sigfigs != o.sigfigs {
+		return fmt.Errorf("can't merge")
+	}
+
+	n := len(r.buckets)
+	for i := 0; i < n; i++ {
+		if err := r.buckets[(r.idx-i+n)%n].Merge(o.buckets[(o.idx-i+n)%n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Reset reset a RollingHDRHistogram
 func (r *RollingHDRHistogram) Reset() {
 	r.idx = 0
@@ -198,6 +304,15 @@ func (r *RollingHDRHistogram) Merged() (*HDRHistogram, error) {
 	return m, nil
 }
 
+// LatencySummary summarizes the latencies recorded over the rolling window, see HDRHistogram.LatencySummary
+func (r *RollingHDRHistogram) LatencySummary(quantiles ...float64) (*LatencySummary, error) {
+	m, err := r.Merged()
+	if err != nil {
+		return nil, err
+	}
+	return m.LatencySummary(quantiles...)
+}
+
 func (r *RollingHDRHistogram) getHist() *HDRHistogram {
 	if r.clock.UtcNow().Sub(r.lastRoll) >= r.period {
 		r.rotate()
@@ -182,3 +182,116 @@ func TestRollingHDRHistogramExportReturnsNewCopy(t *testing.T) {
 	assert.NotNil(t, b.buckets)
 	assert.NotNil(t, b.clock)
 }
+
+func TestLatencySummary(t *testing.T) {
+	h, err := NewHDRHistogram(1, 3600000000, 3)
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		require.NoError(t, h.RecordLatencies(time.Duration(i)*time.Millisecond, 1))
+	}
+
+	s, err := h.LatencySummary()
+	require.NoError(t, err)
+
+	assert.EqualValues(t, 100, s.Count)
+	assert.Equal(t, time.Millisecond, s.Min.Round(time.Millisecond))
+	assert.Equal(t, 100*time.Millisecond, s.Max.Round(time.Millisecond))
+	assert.Equal(t, 51*time.Millisecond, s.Mean.Round(time.Millisecond))
+	assert.Equal(t, 29*time.Millisecond, s.StdDev.Round(time.Millisecond))
+	require.Len(t, s.Quantiles, len(DefaultQuantiles))
+
+	for _, q := range DefaultQuantiles {
+		latency, ok := s.Latency(q)
+		require.True(t, ok)
+		assert.Equal(t, time.Duration(q)*time.Millisecond, latency.Round(time.Millisecond))
+	}
+	_, ok := s.Latency(99.9)
+	assert.False(t, ok)
+
+	s, err = h.LatencySummary(99.9)
+	require.NoError(t, err)
+	latency, ok := s.Latency(99.9)
+	require.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, latency.Round(time.Millisecond))
+}
+
+func TestLatencySummaryEmpty(t *testing.T) {
+	h, err := NewHDRHistogram(1, 3600000, 2)
+	require.NoError(t, err)
+
+	s, err := h.LatencySummary(50)
+	require.NoError(t, err)
+	assert.Equal(t, &LatencySummary{Quantiles: []Quantile{{Quantile: 50}}}, s)
+}
+
+func TestLatencySummaryInvalidQuantiles(t *testing.T) {
+	h, err := NewHDRHistogram(1, 3600000, 2)
+	require.NoError(t, err)
+
+	_, err = h.LatencySummary(0)
+	assert.Error(t, err)
+
+	_, err = h.LatencySummary(50, 100.1)
+	assert.Error(t, err)
+}
+
+func TestRollingLatencySummary(t *testing.T) {
+	clock := testutils.GetClock()
+
+	h, err := NewRollingHDRHistogram(1, 3600000000, 3, time.Second, 2, RollingClock(clock))
+	require.NoError(t, err)
+
+	require.NoError(t, h.RecordLatencies(time.Millisecond, 1))
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	require.NoError(t, h.RecordLatencies(3*time.Millisecond, 1))
+
+	s, err := h.LatencySummary(100)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, s.Count)
+	assert.Equal(t, time.Millisecond, s.Min.Round(time.Millisecond))
+	latency, _ := s.Latency(100)
+	assert.Equal(t, 3*time.Millisecond, latency.Round(time.Millisecond))
+
+	// the first latency is rolled out of the window
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	require.NoError(t, h.RecordLatencies(2*time.Millisecond, 1))
+
+	s, err = h.LatencySummary(100)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, s.Count)
+	assert.Equal(t, 2*time.Millisecond, s.Min.Round(time.Millisecond))
+}
+
+func TestRollingMerge(t *testing.T) {
+	clock := testutils.GetClock()
+
+	a, err := NewRollingHDRHistogram(1, 3600000, 3, time.Second, 2, RollingClock(clock))
+	require.NoError(t, err)
+	b, err := NewRollingHDRHistogram(1, 3600000, 3, time.Second, 2, RollingClock(clock))
+	require.NoError(t, err)
+
+	// b has rotated once, a has not
+	require.NoError(t, b.RecordValues(1, 1))
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	require.NoError(t, b.RecordValues(2, 1))
+	require.NoError(t, a.RecordValues(3, 1))
+
+	require.NoError(t, a.Merge(b))
+	m, err := a.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, m.TotalCount())
+
+	// the value of the previous window of b is rolled out first
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	require.NoError(t, a.RecordValues(4, 1))
+	m, err = a.Merged()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, m.TotalCount())
+	assert.EqualValues(t, 2, m.Min())
+
+	c, err := NewRollingHDRHistogram(1, 3600000, 3, time.Second, 3, RollingClock(clock))
+	require.NoError(t, err)
+	assert.Error(t, a.Merge(c))
+	assert.Error(t, a.Merge(a))
+}
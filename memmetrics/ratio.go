@@ -1,6 +1,7 @@
 package memmetrics
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/mailgun/timetools"
@@ -52,6 +53,22 @@ func NewRatioCounter(buckets int, resolution time.Duration, options ...ratioOptS
 	return rc, nil
 }
 
+// Clone returns a copy of the counter
+func (r *RatioCounter) Clone() *RatioCounter {
+	return &RatioCounter{clock: r.clock, a: r.a.Clone(), b: r.b.Clone()}
+}
+
+// Merge adds the values of the other counter bucket by bucket, see RollingCounter.Merge
+func (r *RatioCounter) Merge(o *RatioCounter) error {
+	if o == nil {
+		return fmt.Errorf("other is nil")
+	}
+	if err := r.a.Merge(o.a); err != nil {
+		return err
+	}
+	return r.b.Merge(o.b)
+}
+
 // Reset reset the counter
 func (r *RatioCounter) Reset() {
 	r.a.Reset()
@@ -166,3 +166,22 @@ func TestNewRatioCounterReset(t *testing.T) {
 	assert.Equal(t, true, fr.IsReady())
 	assert.Equal(t, 1.0, fr.Ratio())
 }
+
+func TestRatioCloneMerge(t *testing.T) {
+	clock := testutils.GetClock()
+
+	a, err := NewRatioCounter(1, time.Second, RatioClock(clock))
+	require.NoError(t, err)
+	a.IncA(1)
+
+	b, err := NewRatioCounter(1, time.Second, RatioClock(clock))
+	require.NoError(t, err)
+	b.IncB(3)
+
+	c := a.Clone()
+	require.NoError(t, c.Merge(b))
+	assert.Equal(t, 0.25, c.Ratio())
+	assert.Equal(t, 1.0, a.Ratio())
+
+	require.Error(t, c.Merge(nil))
+}
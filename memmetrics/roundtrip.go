@@ -2,6 +2,7 @@ package memmetrics
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -10,7 +11,7 @@ import (
 )
 
 // RTMetrics provides aggregated performance metrics for HTTP requests processing
-// such as round trip latency, response codes counters network error and total requests.
+// such as round trip latency, response codes and methods counters network error and total requests.
 // all counters are collected as rolling window counters with defined precision, histograms
 // are a rolling window histograms with defined precision as well.
 // See RTOptions for more detail on parameters.
@@ -19,6 +20,8 @@ type RTMetrics struct {
 	netErrors       *RollingCounter
 	statusCodes     map[int]*RollingCounter
 	statusCodesLock sync.RWMutex
+	methods         map[string]*RollingCounter
+	methodsLock     sync.RWMutex
 	histogram       *RollingHDRHistogram
 	histogramLock   sync.RWMutex
 
@@ -62,11 +65,33 @@ func RTClock(clock timetools.TimeProvider) rrOptSetter {
 	}
 }
 
+// RTWindow sets the rolling window of the counters and of the histogram, rolling over the given number of buckets.
+// The buckets can not be shorter than a second.
+func RTWindow(d time.Duration, buckets int) rrOptSetter {
+	return func(r *RTMetrics) error {
+		if buckets < 1 {
+			return fmt.Errorf("window buckets should be >= 1, got %d", buckets)
+		}
+		resolution := d / time.Duration(buckets)
+		if resolution < time.Second {
+			return fmt.Errorf("window buckets should last at least a second, got %v", resolution)
+		}
+		r.newCounter = func() (*RollingCounter, error) {
+			return NewCounter(buckets, resolution, CounterClock(r.clock))
+		}
+		r.newHist = func() (*RollingHDRHistogram, error) {
+			return NewRollingHDRHistogram(histMin, histMax, histSignificantFigures, resolution, buckets, RollingClock(r.clock))
+		}
+		return nil
+	}
+}
+
 // NewRTMetrics returns new instance of metrics collector.
 func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 	m := &RTMetrics{
 		statusCodes:     make(map[int]*RollingCounter),
 		statusCodesLock: sync.RWMutex{},
+		methods:         make(map[string]*RollingCounter),
 	}
 	for _, s := range settings {
 		if err := s(m); err != nil {
@@ -115,6 +140,8 @@ func NewRTMetrics(settings ...rrOptSetter) (*RTMetrics, error) {
 func (m *RTMetrics) Export() *RTMetrics {
 	m.statusCodesLock.RLock()
 	defer m.statusCodesLock.RUnlock()
+	m.methodsLock.RLock()
+	defer m.methodsLock.RUnlock()
 	m.histogramLock.RLock()
 	defer m.histogramLock.RUnlock()
 
@@ -128,6 +155,11 @@ func (m *RTMetrics) Export() *RTMetrics {
 		exportStatusCodes[code] = rollingCounter.Clone()
 	}
 	export.statusCodes = exportStatusCodes
+	exportMethods := map[string]*RollingCounter{}
+	for method, rollingCounter := range m.methods {
+		exportMethods[method] = rollingCounter.Clone()
+	}
+	export.methods = exportMethods
 	if m.histogram != nil {
 		export.histogram = m.histogram.Export()
 	}
@@ -138,6 +170,60 @@ func (m *RTMetrics) Export() *RTMetrics {
 	return export
 }
 
+// Clone returns a new RTMetrics which is a copy of the current one, see Export
+func (m *RTMetrics) Clone() *RTMetrics {
+	return m.Export()
+}
+
+// Merge adds the metrics of other to the current ones. Unlike Append, the counters and histograms are merged
+// bucket by bucket, the merged values are then rolled out of the window when they would have been by other.
+// It is meant to aggregate the metrics of several handlers or backends, e.g. merging them into a new RTMetrics
+// gives a cluster-wide view. Both RTMetrics must use the same counter and histogram parameters.
+func (m *RTMetrics) Merge(other *RTMetrics) error {
+	if m == other {
+		return errors.New("RTMetrics cannot merge with self")
+	}
+
+	copied := other.Export()
+
+	if err := m.total.Merge(copied.total); err != nil {
+		return err
+	}
+	if err := m.netErrors.Merge(copied.netErrors); err != nil {
+		return err
+	}
+
+	m.statusCodesLock.Lock()
+	defer m.statusCodesLock.Unlock()
+	for code, c := range copied.statusCodes {
+		o, ok := m.statusCodes[code]
+		if !ok {
+			m.statusCodes[code] = c
+			continue
+		}
+		if err := o.Merge(c); err != nil {
+			return err
+		}
+	}
+
+	m.methodsLock.Lock()
+	defer m.methodsLock.Unlock()
+	for method, c := range copied.methods {
+		o, ok := m.methods[method]
+		if !ok {
+			m.methods[method] = c
+			continue
+		}
+		if err := o.Merge(c); err != nil {
+			return err
+		}
+	}
+
+	m.histogramLock.Lock()
+	defer m.histogramLock.Unlock()
+	return m.histogram.Merge(copied.histogram)
+}
+
 // CounterWindowSize gets total windows size
 func (m *RTMetrics) CounterWindowSize() time.Duration {
 	return m.total.WindowSize()
@@ -203,11 +289,35 @@ func (m *RTMetrics) Append(other *RTMetrics) error {
 		}
 	}
 
+	m.methodsLock.Lock()
+	defer m.methodsLock.Unlock()
+	for method, c := range copied.methods {
+		o, ok := m.methods[method]
+		if ok {
+			if err := o.Append(c); err != nil {
+				return err
+			}
+		} else {
+			m.methods[method] = c.Clone()
+		}
+	}
+
 	return m.histogram.Append(copied.histogram)
 }
 
 // Record records a metric
 func (m *RTMetrics) Record(code int, duration time.Duration) {
+	m.record(code, duration)
+}
+
+// RecordRequest records a metric along with the method of the request,
+// the methods that are not standard are counted as OTHER
+func (m *RTMetrics) RecordRequest(method string, code int, duration time.Duration) {
+	m.record(code, duration)
+	m.recordMethod(method)
+}
+
+func (m *RTMetrics) record(code int, duration time.Duration) {
 	m.total.Inc(1)
 	if code == http.StatusGatewayTimeout || code == http.StatusBadGateway {
 		m.netErrors.Inc(1)
@@ -239,6 +349,19 @@ func (m *RTMetrics) StatusCodesCounts() map[int]int64 {
 	return sc
 }
 
+// MethodsCounts returns map with counts of the request methods
+func (m *RTMetrics) MethodsCounts() map[string]int64 {
+	mc := make(map[string]int64)
+	m.methodsLock.RLock()
+	defer m.methodsLock.RUnlock()
+	for k, v := range m.methods {
+		if v.Count() != 0 {
+			mc[k] = v.Count()
+		}
+	}
+	return mc
+}
+
 // LatencyHistogram computes and returns resulting histogram with latencies observed.
 func (m *RTMetrics) LatencyHistogram() (*HDRHistogram, error) {
 	m.histogramLock.Lock()
@@ -246,6 +369,50 @@ func (m *RTMetrics) LatencyHistogram() (*HDRHistogram, error) {
 	return m.histogram.Merged()
 }
 
+// LatencySummary returns the latencies at the given quantiles, in percents, along with their minimum, maximum,
+// mean and standard deviation over the rolling window. DefaultQuantiles are used when none are given.
+func (m *RTMetrics) LatencySummary(quantiles ...float64) (*LatencySummary, error) {
+	m.histogramLock.Lock()
+	defer m.histogramLock.Unlock()
+	return m.histogram.LatencySummary(quantiles...)
+}
+
+// RTSnapshot is a copy of the metrics collected over the rolling window, suitable for JSON serialization
+type RTSnapshot struct {
+	Window            time.Duration    `json:"window"`              // Window - size of the rolling window of the counters
+	Total             int64            `json:"total"`               // Total - count of requests
+	NetworkErrors     int64            `json:"network_errors"`      // NetworkErrors - count of network errors
+	NetworkErrorRatio float64          `json:"network_error_ratio"` // NetworkErrorRatio - ratio of network errors to requests
+	StatusCodes       map[int]int64    `json:"status_codes"`        // StatusCodes - counts per response code
+	StatusClasses     map[string]int64 `json:"status_classes"`      // StatusClasses - counts per class of response codes, e.g. 4xx
+	Methods           map[string]int64 `json:"methods"`             // Methods - counts per request method, see RecordRequest
+	Latency           *LatencySummary  `json:"latency"`             // Latency - summary of the latencies
+}
+
+// Snapshot returns a copy of the metrics with the latencies summarized at the given quantiles,
+// in percents, or at DefaultQuantiles if none are given
+func (m *RTMetrics) Snapshot(quantiles ...float64) (*RTSnapshot, error) {
+	latency, err := m.LatencySummary(quantiles...)
+	if err != nil {
+		return nil, err
+	}
+	codes := m.StatusCodesCounts()
+	classes := make(map[string]int64)
+	for code, count := range codes {
+		classes[fmt.Sprintf("%dxx", code/100)] += count
+	}
+	return &RTSnapshot{
+		Window:            m.CounterWindowSize(),
+		Total:             m.TotalCount(),
+		NetworkErrors:     m.NetworkErrorCount(),
+		NetworkErrorRatio: m.NetworkErrorRatio(),
+		StatusCodes:       codes,
+		StatusClasses:     classes,
+		Methods:           m.MethodsCounts(),
+		Latency:           latency,
+	}, nil
+}
+
 // Reset reset metrics
 func (m *RTMetrics) Reset() {
 	m.statusCodesLock.Lock()
@@ -256,6 +423,9 @@ func (m *RTMetrics) Reset() {
 	m.total.Reset()
 	m.netErrors.Reset()
 	m.statusCodes = make(map[int]*RollingCounter)
+	m.methodsLock.Lock()
+	defer m.methodsLock.Unlock()
+	m.methods = make(map[string]*RollingCounter)
 }
 
 func (m *RTMetrics) recordLatency(d time.Duration) error {
@@ -291,6 +461,34 @@ func (m *RTMetrics) recordStatusCode(statusCode int) error {
 	return nil
 }
 
+// OtherMethod counts the requests with a method that is not standard
+const OtherMethod = "OTHER"
+
+func (m *RTMetrics) recordMethod(method string) error {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+	default:
+		// the methods are chosen by the clients, keep their number bounded
+		method = OtherMethod
+	}
+
+	m.methodsLock.Lock()
+	defer m.methodsLock.Unlock()
+	if c, ok := m.methods[method]; ok {
+		c.Inc(1)
+		return nil
+	}
+
+	c, err := m.newCounter()
+	if err != nil {
+		return err
+	}
+	c.Inc(1)
+	m.methods[method] = c
+	return nil
+}
+
 const (
 	counterBuckets         = 10
 	counterResolution      = time.Second
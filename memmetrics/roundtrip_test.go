@@ -1,6 +1,8 @@
 package memmetrics
 
 import (
+	"encoding/json"
+	"net/http"
 	"runtime"
 	"sync"
 	"testing"
@@ -44,6 +46,82 @@ func TestDefaults(t *testing.T) {
 	assert.Equal(t, time.Duration(0), h.LatencyAtQuantile(100))
 }
 
+func TestRTLatencySummary(t *testing.T) {
+	rr, err := NewRTMetrics(RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	rr.Record(200, time.Second)
+	rr.Record(200, 2*time.Second)
+	rr.Record(200, 3*time.Second)
+
+	s, err := rr.LatencySummary(50, 99)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, s.Count)
+	assert.Equal(t, time.Second, s.Min.Round(100*time.Millisecond))
+	assert.Equal(t, 3*time.Second, s.Max.Round(100*time.Millisecond))
+	assert.Equal(t, 2*time.Second, s.Mean.Round(100*time.Millisecond))
+
+	p50, ok := s.Latency(50)
+	require.True(t, ok)
+	assert.Equal(t, 2*time.Second, p50.Round(100*time.Millisecond))
+	p99, ok := s.Latency(99)
+	require.True(t, ok)
+	assert.Equal(t, 3*time.Second, p99.Round(100*time.Millisecond))
+}
+
+func TestMethodsCounts(t *testing.T) {
+	rr, err := NewRTMetrics(RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	rr.RecordRequest(http.MethodGet, 200, time.Second)
+	rr.RecordRequest(http.MethodGet, 404, time.Second)
+	rr.RecordRequest(http.MethodPost, 429, time.Second)
+	rr.RecordRequest("PROPFIND", 400, time.Second)
+	rr.RecordRequest("FOO", 400, time.Second)
+	rr.Record(200, time.Second)
+
+	assert.EqualValues(t, 6, rr.TotalCount())
+	assert.Equal(t, map[string]int64{http.MethodGet: 2, http.MethodPost: 1, OtherMethod: 2}, rr.MethodsCounts())
+	assert.Equal(t, map[int]int64{200: 2, 400: 2, 404: 1, 429: 1}, rr.StatusCodesCounts())
+
+	rr.Reset()
+	assert.Equal(t, map[string]int64{}, rr.MethodsCounts())
+}
+
+func TestSnapshot(t *testing.T) {
+	rr, err := NewRTMetrics(RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	rr.RecordRequest(http.MethodGet, 200, time.Second)
+	rr.RecordRequest(http.MethodGet, 404, time.Second)
+	rr.RecordRequest(http.MethodPost, 429, time.Second)
+	rr.RecordRequest(http.MethodPost, 502, time.Second)
+
+	s, err := rr.Snapshot(50)
+	require.NoError(t, err)
+
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &out))
+
+	assert.EqualValues(t, 10*time.Second, out["window"])
+	assert.EqualValues(t, 4, out["total"])
+	assert.EqualValues(t, 1, out["network_errors"])
+	assert.EqualValues(t, 0.25, out["network_error_ratio"])
+	assert.Equal(t, map[string]interface{}{"200": 1.0, "404": 1.0, "429": 1.0, "502": 1.0}, out["status_codes"])
+	assert.Equal(t, map[string]interface{}{"2xx": 1.0, "4xx": 2.0, "5xx": 1.0}, out["status_classes"])
+	assert.Equal(t, map[string]interface{}{"GET": 2.0, "POST": 2.0}, out["methods"])
+
+	latency := out["latency"].(map[string]interface{})
+	assert.EqualValues(t, 4, latency["count"])
+	assert.Len(t, latency["quantiles"], 1)
+
+	_, err = rr.Snapshot(0)
+	assert.Error(t, err)
+}
+
 func TestAppend(t *testing.T) {
 	clock := testutils.GetClock()
 
@@ -74,6 +152,84 @@ func TestAppend(t *testing.T) {
 	assert.EqualValues(t, 3, h.LatencyAtQuantile(100)/time.Second)
 }
 
+func TestAppendBreakdowns(t *testing.T) {
+	clock := testutils.GetClock()
+
+	rr, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	rr.RecordRequest(http.MethodGet, 200, time.Second)
+	rr.RecordRequest(http.MethodPost, 429, time.Second)
+
+	rr2, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	rr2.RecordRequest(http.MethodGet, 200, time.Second)
+	rr2.RecordRequest(http.MethodPut, 503, time.Second)
+	rr2.Record(200, time.Second)
+
+	require.NoError(t, rr2.Append(rr))
+	assert.Equal(t, map[string]int64{http.MethodGet: 2, http.MethodPost: 1, http.MethodPut: 1}, rr2.MethodsCounts())
+	assert.Equal(t, map[int]int64{200: 3, 429: 1, 503: 1}, rr2.StatusCodesCounts())
+
+	// the source is left untouched
+	assert.Equal(t, map[string]int64{http.MethodGet: 1, http.MethodPost: 1}, rr.MethodsCounts())
+}
+
+func TestRTMerge(t *testing.T) {
+	clock := testutils.GetClock()
+
+	backend1, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	backend1.RecordRequest(http.MethodGet, 200, time.Second)
+	backend1.RecordRequest(http.MethodGet, 502, 2*time.Second)
+
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+
+	backend2, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	backend2.RecordRequest(http.MethodPost, 200, 3*time.Second)
+
+	cluster, err := NewRTMetrics(RTClock(clock))
+	require.NoError(t, err)
+	require.NoError(t, cluster.Merge(backend1))
+	require.NoError(t, cluster.Merge(backend2))
+
+	assert.EqualValues(t, 3, cluster.TotalCount())
+	assert.EqualValues(t, 1, cluster.NetworkErrorCount())
+	assert.Equal(t, map[int]int64{200: 2, 502: 1}, cluster.StatusCodesCounts())
+	assert.Equal(t, map[string]int64{http.MethodGet: 2, http.MethodPost: 1}, cluster.MethodsCounts())
+
+	h, err := cluster.LatencyHistogram()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, h.TotalCount())
+
+	// the requests of backend1 are rolled out of the counters' window first
+	clock.CurrentTime = clock.CurrentTime.Add(6 * time.Second)
+	assert.EqualValues(t, 1, cluster.TotalCount())
+	assert.Equal(t, map[int]int64{200: 1}, cluster.StatusCodesCounts())
+	assert.Equal(t, map[string]int64{http.MethodPost: 1}, cluster.MethodsCounts())
+
+	// the sources are left untouched
+	assert.EqualValues(t, 1, backend2.TotalCount())
+
+	require.Error(t, cluster.Merge(cluster))
+
+	cluster.Reset()
+	assert.EqualValues(t, 0, cluster.TotalCount())
+}
+
+func TestRTClone(t *testing.T) {
+	rr, err := NewRTMetrics(RTClock(testutils.GetClock()))
+	require.NoError(t, err)
+	rr.RecordRequest(http.MethodGet, 200, time.Second)
+
+	c := rr.Clone()
+	rr.RecordRequest(http.MethodGet, 200, time.Second)
+
+	assert.EqualValues(t, 1, c.TotalCount())
+	assert.Equal(t, map[string]int64{http.MethodGet: 1}, c.MethodsCounts())
+	assert.EqualValues(t, 2, rr.TotalCount())
+}
+
 func TestConcurrentRecords(t *testing.T) {
 	// This test asserts a race condition which requires parallelism
 	runtime.GOMAXPROCS(100)
@@ -149,3 +305,25 @@ func TestRTMetricExportReturnsNewCopy(t *testing.T) {
 		}
 	}
 }
+
+func TestRTWindow(t *testing.T) {
+	clock := &timetools.FreezedTime{
+		CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	m, err := NewRTMetrics(RTClock(clock), RTWindow(4*time.Second, 2))
+	require.NoError(t, err)
+
+	m.Record(http.StatusOK, time.Millisecond)
+	clock.Sleep(2 * time.Second)
+	m.Record(http.StatusBadGateway, time.Millisecond)
+	assert.EqualValues(t, 2, m.TotalCount())
+
+	// the first bucket rolls out of the window
+	clock.Sleep(2 * time.Second)
+	assert.EqualValues(t, 1, m.TotalCount())
+	assert.EqualValues(t, 1, m.NetworkErrorCount())
+
+	_, err = NewRTMetrics(RTWindow(time.Second, 2))
+	assert.Error(t, err)
+}
@@ -0,0 +1,276 @@
+/*
+Package metrics provides http.Handler middleware collecting the metrics of oxy handlers
+and a handler exposing them in the Prometheus text format.
+
+It does not depend on the Prometheus client library, the metrics are kept in memory
+and rendered when the /metrics handler is scraped.
+
+Examples of a metrics middleware:
+
+	m, _ := metrics.New()
+
+	// count the requests, their latency and response classes of the whole proxy
+	handler := m.Wrap("proxy", lb)
+
+	// the same for every server of the load balancer, the forwarder is called with the URL of the server
+	fwd, _ := forward.New()
+	lb, _ := roundrobin.New(m.WrapBackends("proxy", fwd))
+	m.Balancer("proxy", lb)
+
+	// export the state of the circuit breaker
+	m.CircuitBreaker("proxy", cb)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+*/
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/cbreaker"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of the latency histograms
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Balancer is implemented by the load balancers of the roundrobin package
+type Balancer interface {
+	Servers() []*url.URL
+	ServerWeight(u *url.URL) (int, bool)
+}
+
+// Breaker is implemented by the circuit breakers of the cbreaker package
+type Breaker interface {
+	State() cbreaker.State
+}
+
+// Metrics collects the metrics of the handlers it wraps, it is the http.Handler exposing them
+type Metrics struct {
+	namespace string
+	buckets   []float64
+	clock     timetools.TimeProvider
+
+	mtx       *sync.Mutex
+	handlers  map[string]*stats
+	backends  map[string]map[string]*stats
+	balancers map[string]Balancer
+	breakers  map[string]Breaker
+
+	log *log.Logger
+}
+
+// New returns a new metrics collector. New() function supports optional functional arguments
+func New(setters ...optSetter) (*Metrics, error) {
+	m := &Metrics{
+		namespace: "oxy",
+		buckets:   DefaultBuckets,
+		clock:     &timetools.RealTime{},
+
+		mtx:       &sync.Mutex{},
+		handlers:  make(map[string]*stats),
+		backends:  make(map[string]map[string]*stats),
+		balancers: make(map[string]Balancer),
+		breakers:  make(map[string]Breaker),
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type optSetter func(m *Metrics) error
+
+// Namespace sets the prefix of the names of the metrics, defaults to oxy
+func Namespace(namespace string) optSetter {
+	return func(m *Metrics) error {
+		if namespace == "" {
+			return fmt.Errorf("namespace can not be empty")
+		}
+		m.namespace = namespace
+		return nil
+	}
+}
+
+// Buckets sets the upper bounds in seconds of the buckets of the latency histograms, defaults to DefaultBuckets
+func Buckets(buckets ...float64) optSetter {
+	return func(m *Metrics) error {
+		if len(buckets) == 0 {
+			return fmt.Errorf("provide at least one bucket")
+		}
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				return fmt.Errorf("buckets should be in increasing order, got %v", buckets)
+			}
+		}
+		m.buckets = buckets
+		return nil
+	}
+}
+
+// Clock sets the clock measuring the latency
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(m *Metrics) error {
+		m.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the metrics collector will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(m *Metrics) error {
+		m.log = l
+		return nil
+	}
+}
+
+// Wrap returns a handler recording the requests served by next under the handler label
+func (m *Metrics) Wrap(name string, next http.Handler) http.Handler {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	s, ok := m.handlers[name]
+	if !ok {
+		s = newStats(m.buckets)
+		m.handlers[name] = s
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.serve(s, next, w, req)
+	})
+}
+
+// WrapBackends returns a handler recording the requests served by next under the handler label and the backend
+// label, the host of the URL of the request. It is meant to wrap the forwarder of a load balancer,
+// which is called once the URL of the request is rewritten to the one of the server.
+func (m *Metrics) WrapBackends(name string, next http.Handler) http.Handler {
+	m.mtx.Lock()
+	if _, ok := m.backends[name]; !ok {
+		m.backends[name] = make(map[string]*stats)
+	}
+	m.mtx.Unlock()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.serve(m.backendStats(name, req.URL.Host), next, w, req)
+	})
+}
+
+// Balancer exports the weights of the servers of the load balancer under the balancer label
+func (m *Metrics) Balancer(name string, b Balancer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.balancers[name] = b
+}
+
+// CircuitBreaker exports the state of the circuit breaker under the breaker label
+func (m *Metrics) CircuitBreaker(name string, b Breaker) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.breakers[name] = b
+}
+
+func (m *Metrics) backendStats(name, backend string) *stats {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	s, ok := m.backends[name][backend]
+	if !ok {
+		s = newStats(m.buckets)
+		m.backends[name][backend] = s
+	}
+	return s
+}
+
+func (m *Metrics) serve(s *stats, next http.Handler, w http.ResponseWriter, req *http.Request) {
+	start := m.clock.UtcNow()
+	s.begin()
+	pw := utils.NewProxyWriterWithLogger(w, m.log)
+	defer func() {
+		s.end(pw.StatusCode(), m.clock.UtcNow().Sub(start))
+	}()
+
+	next.ServeHTTP(pw, req)
+}
+
+// stats are the metrics of a handler or of a backend
+type stats struct {
+	mtx      sync.Mutex
+	inflight int64
+	requests int64
+	classes  map[string]int64
+	latency  *histogram
+}
+
+func newStats(buckets []float64) *stats {
+	return &stats{classes: make(map[string]int64), latency: newHistogram(buckets)}
+}
+
+func (s *stats) begin() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.inflight++
+}
+
+func (s *stats) end(code int, latency time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.inflight--
+	s.requests++
+	s.classes[responseClass(code)]++
+	s.latency.observe(latency.Seconds())
+}
+
+// snapshot returns a copy of the stats that can be rendered without holding the lock
+func (s *stats) snapshot() *stats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c := &stats{inflight: s.inflight, requests: s.requests, classes: make(map[string]int64, len(s.classes))}
+	for class, count := range s.classes {
+		c.classes[class] = count
+	}
+	c.latency = s.latency.clone()
+	return c
+}
+
+func responseClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// histogram counts the observations per bucket, they are rendered as the cumulative buckets of a Prometheus histogram
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.sum += v
+	h.count++
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+func (h *histogram) clone() *histogram {
+	c := &histogram{bounds: h.bounds, counts: make([]int64, len(h.counts)), sum: h.sum, count: h.count}
+	copy(c.counts, h.counts)
+	return c
+}
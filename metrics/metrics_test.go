@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestWrap(t *testing.T) {
+	clock := testutils.GetClock()
+	m, err := New(Clock(clock), Buckets(0.1, 1))
+	require.NoError(t, err)
+
+	handler := m.Wrap("proxy", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Sleep(500 * time.Millisecond)
+		if req.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	for _, path := range []string{"/", "/", "/error"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+	}
+
+	s := m.handlers["proxy"].snapshot()
+	assert.EqualValues(t, 3, s.requests)
+	assert.EqualValues(t, 0, s.inflight)
+	assert.Equal(t, map[string]int64{"2xx": 2, "5xx": 1}, s.classes)
+	assert.Equal(t, []int64{0, 3}, s.latency.counts)
+	assert.EqualValues(t, 3, s.latency.count)
+	assert.InDelta(t, 1.5, s.latency.sum, 0.0001)
+}
+
+func TestInflight(t *testing.T) {
+	m, err := New()
+	require.NoError(t, err)
+
+	var inflight int64
+	handler := m.Wrap("proxy", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inflight = m.handlers["proxy"].snapshot().inflight
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+
+	assert.EqualValues(t, 1, inflight)
+	assert.EqualValues(t, 0, m.handlers["proxy"].snapshot().inflight)
+}
+
+func TestWrapBackends(t *testing.T) {
+	m, err := New()
+	require.NoError(t, err)
+
+	handler := m.WrapBackends("proxy", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Host == "localhost:5001" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	for _, u := range []string{"http://localhost:5000", "http://localhost:5001", "http://localhost:5001"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, u, nil))
+	}
+
+	assert.Equal(t, map[string]int64{"2xx": 1}, m.backends["proxy"]["localhost:5000"].snapshot().classes)
+	assert.Equal(t, map[string]int64{"5xx": 2}, m.backends["proxy"]["localhost:5001"].snapshot().classes)
+}
+
+func TestOptionsValidation(t *testing.T) {
+	_, err := New(Buckets())
+	assert.Error(t, err)
+
+	_, err = New(Buckets(1, 0.5))
+	assert.Error(t, err)
+
+	_, err = New(Namespace(""))
+	assert.Error(t, err)
+}
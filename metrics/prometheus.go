@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/heebyunglee/oxy/cbreaker"
+)
+
+var breakerStates = []cbreaker.State{cbreaker.StateStandby, cbreaker.StateTripped, cbreaker.StateRecovering, cbreaker.StateHalfOpen}
+
+// ServeHTTP renders the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	m.write(bw)
+	if err := bw.Flush(); err != nil {
+		m.log.Errorf("vulcand/oxy/metrics: failed to write metrics, err: %v", err)
+	}
+}
+
+// labeledStats are the stats of a handler or a backend with their labels
+type labeledStats struct {
+	labels labels
+	stats  *stats
+}
+
+func (m *Metrics) write(w io.Writer) {
+	handlers, backends, balancers, breakers := m.snapshot()
+
+	m.writeStats(w, "", handlers)
+	m.writeStats(w, "backend_", backends)
+
+	name := m.namespace + "_backend_weight"
+	writeHeader(w, name, "gauge", "Weight of the server in the load balancer.")
+	for _, b := range sortedNames(balancers) {
+		for _, u := range balancers[b].Servers() {
+			if weight, ok := balancers[b].ServerWeight(u); ok {
+				writeSample(w, name, labels{"balancer", b, "backend", u.Host}, float64(weight))
+			}
+		}
+	}
+
+	name = m.namespace + "_circuit_breaker_state"
+	writeHeader(w, name, "gauge", "State of the circuit breaker, 1 for the current state.")
+	for _, b := range sortedNames(breakers) {
+		current := breakers[b].State()
+		for _, state := range breakerStates {
+			value := 0.0
+			if state == current {
+				value = 1
+			}
+			writeSample(w, name, labels{"breaker", b, "state", state.String()}, value)
+		}
+	}
+}
+
+// snapshot copies the stats so that they are rendered without holding the lock
+func (m *Metrics) snapshot() ([]labeledStats, []labeledStats, map[string]Balancer, map[string]Breaker) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var handlers []labeledStats
+	for _, h := range sortedNames(m.handlers) {
+		handlers = append(handlers, labeledStats{labels: labels{"handler", h}, stats: m.handlers[h].snapshot()})
+	}
+
+	var backends []labeledStats
+	for _, h := range sortedNames(m.backends) {
+		for _, b := range sortedNames(m.backends[h]) {
+			backends = append(backends, labeledStats{labels: labels{"handler", h, "backend", b}, stats: m.backends[h][b].snapshot()})
+		}
+	}
+
+	balancers := make(map[string]Balancer, len(m.balancers))
+	for name, b := range m.balancers {
+		balancers[name] = b
+	}
+	breakers := make(map[string]Breaker, len(m.breakers))
+	for name, b := range m.breakers {
+		breakers[name] = b
+	}
+	return handlers, backends, balancers, breakers
+}
+
+func (m *Metrics) writeStats(w io.Writer, prefix string, all []labeledStats) {
+	name := m.namespace + "_" + prefix + "requests_total"
+	writeHeader(w, name, "counter", "Total number of requests.")
+	for _, s := range all {
+		writeSample(w, name, s.labels, float64(s.stats.requests))
+	}
+
+	name = m.namespace + "_" + prefix + "responses_total"
+	writeHeader(w, name, "counter", "Total number of responses by class of status code.")
+	for _, s := range all {
+		for _, class := range sortedNames(s.stats.classes) {
+			writeSample(w, name, s.labels.with("class", class), float64(s.stats.classes[class]))
+		}
+	}
+
+	name = m.namespace + "_" + prefix + "requests_in_flight"
+	writeHeader(w, name, "gauge", "Number of requests being served.")
+	for _, s := range all {
+		writeSample(w, name, s.labels, float64(s.stats.inflight))
+	}
+
+	name = m.namespace + "_" + prefix + "request_duration_seconds"
+	writeHeader(w, name, "histogram", "Latency of the requests in seconds.")
+	for _, s := range all {
+		h := s.stats.latency
+		var cumulative int64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			writeSample(w, name+"_bucket", s.labels.with("le", formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, name+"_bucket", s.labels.with("le", "+Inf"), float64(h.count))
+		writeSample(w, name+"_sum", s.labels, h.sum)
+		writeSample(w, name+"_count", s.labels, float64(h.count))
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w io.Writer, name string, l labels, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, l, formatFloat(value))
+}
+
+// labels are the names and values of the labels of a sample, in pairs
+type labels []string
+
+func (l labels) with(name, value string) labels {
+	out := make(labels, len(l), len(l)+2)
+	copy(out, l)
+	return append(out, name, value)
+}
+
+func (l labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(l)/2)
+	for i := 0; i+1 < len(l); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l[i], escapeLabelValue(l[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedNames returns the keys of a map with string keys in order, for a stable output
+func sortedNames(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.String()
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/cbreaker"
+	"github.com/heebyunglee/oxy/roundrobin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestPrometheusFormat(t *testing.T) {
+	clock := testutils.GetClock()
+	m, err := New(Clock(clock), Buckets(0.1, 1))
+	require.NoError(t, err)
+
+	handler := m.Wrap("proxy", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clock.Sleep(500 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP oxy_requests_total Total number of requests.
+# TYPE oxy_requests_total counter
+oxy_requests_total{handler="proxy"} 1
+# HELP oxy_responses_total Total number of responses by class of status code.
+# TYPE oxy_responses_total counter
+oxy_responses_total{handler="proxy",class="2xx"} 1
+# HELP oxy_requests_in_flight Number of requests being served.
+# TYPE oxy_requests_in_flight gauge
+oxy_requests_in_flight{handler="proxy"} 0
+# HELP oxy_request_duration_seconds Latency of the requests in seconds.
+# TYPE oxy_request_duration_seconds histogram
+oxy_request_duration_seconds_bucket{handler="proxy",le="0.1"} 0
+oxy_request_duration_seconds_bucket{handler="proxy",le="1"} 1
+oxy_request_duration_seconds_bucket{handler="proxy",le="+Inf"} 1
+oxy_request_duration_seconds_sum{handler="proxy"} 0.5
+oxy_request_duration_seconds_count{handler="proxy"} 1
+# HELP oxy_backend_requests_total Total number of requests.
+# TYPE oxy_backend_requests_total counter
+# HELP oxy_backend_responses_total Total number of responses by class of status code.
+# TYPE oxy_backend_responses_total counter
+# HELP oxy_backend_requests_in_flight Number of requests being served.
+# TYPE oxy_backend_requests_in_flight gauge
+# HELP oxy_backend_request_duration_seconds Latency of the requests in seconds.
+# TYPE oxy_backend_request_duration_seconds histogram
+# HELP oxy_backend_weight Weight of the server in the load balancer.
+# TYPE oxy_backend_weight gauge
+# HELP oxy_circuit_breaker_state State of the circuit breaker, 1 for the current state.
+# TYPE oxy_circuit_breaker_state gauge
+`, w.Body.String())
+}
+
+func TestBalancerAndBreaker(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	m, err := New(Namespace("proxy"))
+	require.NoError(t, err)
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := roundrobin.New(m.WrapBackends("web", fwd))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(srv.URL), roundrobin.Weight(3)))
+	m.Balancer("web", lb)
+
+	cb, err := cbreaker.New(lb, "NetworkErrorRatio() > 0.5")
+	require.NoError(t, err)
+	m.CircuitBreaker("web", cb)
+
+	proxy := httptest.NewServer(m.Wrap("web", cb))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil))
+
+	host := testutils.ParseURI(srv.URL).Host
+	body := w.Body.String()
+	assert.Contains(t, body, `proxy_requests_total{handler="web"} 1`)
+	assert.Contains(t, body, `proxy_backend_requests_total{handler="web",backend="`+host+`"} 1`)
+	assert.Contains(t, body, `proxy_backend_responses_total{handler="web",backend="`+host+`",class="2xx"} 1`)
+	assert.Contains(t, body, `proxy_backend_weight{balancer="web",backend="`+host+`"} 3`)
+	assert.Contains(t, body, `proxy_circuit_breaker_state{breaker="web",state="standby"} 1`)
+	assert.Contains(t, body, `proxy_circuit_breaker_state{breaker="web",state="tripped"} 0`)
+}
+
+func TestLabelEscaping(t *testing.T) {
+	assert.Equal(t, `{handler="a\"b\\c\nd"}`, labels{"handler", "a\"b\\c\nd"}.String())
+}
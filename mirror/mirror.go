@@ -0,0 +1,238 @@
+/*
+Package mirror provides http.Handler middleware duplicating a share of the requests to a shadow handler.
+
+The mirrored requests are sent asynchronously and their responses are discarded, the client only ever
+receives the response of the next handler. It is useful to test a new version of a service with production traffic.
+
+Examples of a mirroring middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte("hello"))
+	})
+
+	// shadow is usually a load balancer sending the requests to the new version of the service
+	shadow, _ := roundrobin.New(fwd)
+	shadow.UpsertServer(testutils.ParseURI("http://localhost:63451"))
+
+	// Mirror will send 10% of the requests to the shadow handler as well
+	mirror.New(handler, shadow, mirror.Percentage(10))
+*/
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxBodyBytes Mirror requests with a body up to 1MB
+	DefaultMaxBodyBytes = 1048576
+	// DefaultMaxInflight Maximum number of mirrored requests in flight
+	DefaultMaxInflight = 100
+)
+
+// Mirror duplicates a percentage of the requests to a shadow handler
+type Mirror struct {
+	next   http.Handler
+	shadow http.Handler
+
+	percentage   float64
+	maxBodyBytes int64
+	maxInflight  int
+
+	mtx      *sync.Mutex
+	inflight int
+	wg       *sync.WaitGroup
+
+	log *log.Logger
+}
+
+// New returns a new mirror middleware. New() function supports optional functional arguments
+func New(next, shadow http.Handler, setters ...optSetter) (*Mirror, error) {
+	m := &Mirror{
+		next:   next,
+		shadow: shadow,
+
+		percentage:   100,
+		maxBodyBytes: DefaultMaxBodyBytes,
+		maxInflight:  DefaultMaxInflight,
+
+		mtx: &sync.Mutex{},
+		wg:  &sync.WaitGroup{},
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type optSetter func(m *Mirror) error
+
+// Percentage sets the percentage of the requests mirrored to the shadow handler, defaults to 100
+func Percentage(p float64) optSetter {
+	return func(m *Mirror) error {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("percentage should be in [0, 100]")
+		}
+		m.percentage = p
+		return nil
+	}
+}
+
+// MaxBodyBytes sets the size of the largest request body kept in memory to be mirrored, requests with a larger
+// body are not mirrored
+func MaxBodyBytes(n int64) optSetter {
+	return func(m *Mirror) error {
+		if n < 0 {
+			return fmt.Errorf("max body bytes should be >= 0")
+		}
+		m.maxBodyBytes = n
+		return nil
+	}
+}
+
+// MaxInflight sets the maximum number of mirrored requests in flight, requests are not mirrored
+// while the shadow handler is that busy
+func MaxInflight(n int) optSetter {
+	return func(m *Mirror) error {
+		if n < 1 {
+			return fmt.Errorf("max inflight should be >= 1")
+		}
+		m.maxInflight = n
+		return nil
+	}
+}
+
+// Logger defines the logger the mirror will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(m *Mirror) error {
+		m.log = l
+		return nil
+	}
+}
+
+// Wait blocks until all the mirrored requests are done
+func (m *Mirror) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if m.log.Level >= log.DebugLevel {
+		logEntry := m.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/mirror: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/mirror: completed ServeHttp on request")
+	}
+
+	if m.percentage > 0 && rand.Float64()*100 < m.percentage {
+		m.mirror(req)
+	}
+	m.next.ServeHTTP(w, req)
+}
+
+// mirror sends a copy of the request to the shadow handler, the body of the original request is
+// replaced so that both requests can read it
+func (m *Mirror) mirror(req *http.Request) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, m.maxBodyBytes+1))
+		if err != nil {
+			req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), errReader{err}), Closer: req.Body}
+			return
+		}
+		if int64(len(body)) > m.maxBodyBytes {
+			m.log.Debugf("vulcand/oxy/mirror: request body larger than %d bytes, not mirroring", m.maxBodyBytes)
+			req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if !m.acquire() {
+		m.log.Debugf("vulcand/oxy/mirror: %d mirrored requests in flight, not mirroring", m.maxInflight)
+		return
+	}
+
+	// the mirrored request must outlive the original one
+	shadowReq := req.WithContext(context.Background())
+	shadowReq.URL = utils.CopyURL(req.URL)
+	shadowReq.Header = make(http.Header)
+	utils.CopyHeaders(shadowReq.Header, req.Header)
+	if body != nil {
+		shadowReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.release()
+		defer func() {
+			if r := recover(); r != nil {
+				m.log.Errorf("vulcand/oxy/mirror: panic while mirroring request: %v", r)
+			}
+		}()
+		m.shadow.ServeHTTP(&discardWriter{header: make(http.Header)}, shadowReq)
+	}()
+}
+
+func (m *Mirror) acquire() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.inflight >= m.maxInflight {
+		return false
+	}
+	m.inflight++
+	return true
+}
+
+func (m *Mirror) release() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.inflight--
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// errReader replays the error met while reading the original body
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// discardWriter is the response writer of the mirrored requests
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {}
@@ -0,0 +1,152 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/heebyunglee/oxy/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder collects the bodies of the requests it receives
+type recorder struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	r.bodies = append(r.bodies, string(body))
+	r.mu.Unlock()
+	w.Write([]byte("shadow"))
+}
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+func TestMirrorSimple(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(append([]byte("hello "), body...))
+	})
+	shadow := &recorder{}
+
+	m, err := New(handler, shadow)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL, testutils.Body("world"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello world", string(body))
+
+	m.Wait()
+	assert.Equal(t, []string{"world"}, shadow.bodies)
+}
+
+func TestMirrorPercentage(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	shadow := &recorder{}
+
+	m, err := New(handler, shadow, Percentage(0))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+	m.Wait()
+	assert.Equal(t, 0, shadow.count())
+
+	m, err = New(handler, shadow, Percentage(50), MaxInflight(1000))
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	}
+	m.Wait()
+	assert.InDelta(t, 500, shadow.count(), 100)
+}
+
+func TestMirrorLargeBody(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	shadow := &recorder{}
+
+	m, err := New(handler, shadow, MaxBodyBytes(3))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost", strings.NewReader("hello")))
+	m.Wait()
+
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, 0, shadow.count())
+}
+
+func TestMirrorMaxInflight(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	release := make(chan struct{})
+	calls := make(chan struct{}, 10)
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls <- struct{}{}
+		<-release
+	})
+
+	m, err := New(handler, shadow, MaxInflight(1))
+	require.NoError(t, err)
+
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost", nil))
+	close(release)
+	m.Wait()
+
+	assert.Len(t, calls, 1)
+}
+
+func TestMirrorOutlivesRequest(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	done := make(chan error, 1)
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		done <- req.Context().Err()
+	})
+
+	m, err := New(handler, shadow)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	_, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	m.Wait()
+	assert.NoError(t, <-done)
+}
+
+func TestMirrorOptionsValidation(t *testing.T) {
+	_, err := New(nil, nil, Percentage(101))
+	assert.Error(t, err)
+
+	_, err = New(nil, nil, MaxBodyBytes(-1))
+	assert.Error(t, err)
+
+	_, err = New(nil, nil, MaxInflight(0))
+	assert.Error(t, err)
+}
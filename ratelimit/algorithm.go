@@ -0,0 +1,352 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+)
+
+// Algorithm is the algorithm used by the in memory store of the token limiter
+type Algorithm int
+
+const (
+	// TokenBucket lets the sources consume up to burst requests at once, refilled at the average rate
+	TokenBucket Algorithm = iota
+	// SlidingWindow allows average requests per period over a sliding window, the burst is ignored.
+	// The count of the previous window is weighted by its overlap with the sliding window.
+	SlidingWindow
+	// LeakyBucket spaces the requests of a source evenly at the average rate, delaying them.
+	// Up to burst requests wait in the queue, the others are rejected.
+	LeakyBucket
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token-bucket"
+	case SlidingWindow:
+		return "sliding-window"
+	case LeakyBucket:
+		return "leaky-bucket"
+	}
+	return "undefined"
+}
+
+// LimitAlgorithm sets the algorithm of the in memory store, defaults to TokenBucket.
+// It has no effect when a store is set with the Storage option.
+func LimitAlgorithm(a Algorithm) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if a < TokenBucket || a > LeakyBucket {
+			return fmt.Errorf("unsupported algorithm: %v", a)
+		}
+		cl.algorithm = a
+		return nil
+	}
+}
+
+func newAlgorithmStore(a Algorithm, capacity int, clock timetools.TimeProvider) (Store, error) {
+	switch a {
+	case SlidingWindow:
+		return newWindowStore(capacity, clock, newSlidingWindow)
+	case LeakyBucket:
+		return newWindowStore(capacity, clock, newLeakyBucket)
+	}
+	return newMemoryStore(capacity, clock)
+}
+
+// limiter is the state of one rate of a source
+type limiter interface {
+	// check returns the time to wait before the amount can be consumed, or an error if it never can
+	check(now time.Time, amount int64) (time.Duration, error)
+	// consume takes the amount and returns the time the request has to be delayed
+	consume(now time.Time, amount int64) time.Duration
+	usage(now time.Time) Usage
+	update(r *rate)
+	// reset forgets the requests consumed so far
+	reset(now time.Time)
+}
+
+// windowStore keeps one limiter per rate and source in memory, expiring the ones of inactive sources
+type windowStore struct {
+	mutex      sync.Mutex
+	clock      timetools.TimeProvider
+	newLimiter func(r *rate, now time.Time) limiter
+	sources    *ttlmap.TtlMap
+}
+
+func newWindowStore(capacity int, clock timetools.TimeProvider, newLimiter func(r *rate, now time.Time) limiter) (*windowStore, error) {
+	sources, err := ttlmap.NewMapWithProvider(capacity, clock)
+	if err != nil {
+		return nil, err
+	}
+	return &windowStore{clock: clock, newLimiter: newLimiter, sources: sources}, nil
+}
+
+func (s *windowStore) sourceCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sources.Len()
+}
+
+func (s *windowStore) Consume(source string, rates *RateSet, amount int64) (time.Duration, Usage, error) {
+	return s.consumeContext(context.Background(), source, rates, amount)
+}
+
+// consumeContext consumes like Consume, the wait of the queued requests ends early with the error of the context
+// once it is done, e.g. when the client went away
+func (s *windowStore) consumeContext(ctx context.Context, source string, rates *RateSet, amount int64) (time.Duration, Usage, error) {
+	delay, wait, usage, err := s.consume(source, rates, amount)
+	if err != nil || delay > 0 {
+		return delay, usage, err
+	}
+	// the request is queued, wait outside of the lock
+	if wait > 0 {
+		select {
+		case <-s.clock.After(wait):
+		case <-ctx.Done():
+			return 0, usage, ctx.Err()
+		}
+	}
+	return 0, usage, nil
+}
+
+func (s *windowStore) consume(source string, rates *RateSet, amount int64) (time.Duration, time.Duration, Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.UtcNow()
+	limiters := s.limiters(source, rates, now)
+
+	var delay time.Duration
+	for _, l := range limiters {
+		d, err := l.check(now, amount)
+		if err != nil {
+			return UndefinedDelay, 0, Usage{}, err
+		}
+		delay = maxDuration(delay, d)
+	}
+	if delay > 0 {
+		return delay, 0, mostRestrictive(limiters, now), nil
+	}
+
+	var wait time.Duration
+	for _, l := range limiters {
+		wait = maxDuration(wait, l.consume(now, amount))
+	}
+	return 0, wait, mostRestrictive(limiters, now), nil
+}
+
+// limiters returns the limiters of the source matching the rates, creating and updating them as needed
+func (s *windowStore) limiters(source string, rates *RateSet, now time.Time) map[time.Duration]limiter {
+	var limiters map[time.Duration]limiter
+	if v, ok := s.sources.Get(source); ok {
+		limiters = v.(map[time.Duration]limiter)
+	} else {
+		limiters = make(map[time.Duration]limiter, len(rates.m))
+	}
+
+	var maxPeriod time.Duration
+	for period, r := range rates.m {
+		if l, ok := limiters[period]; ok {
+			l.update(r)
+		} else {
+			limiters[period] = s.newLimiter(r, now)
+		}
+		maxPeriod = maxDuration(maxPeriod, period)
+	}
+	for period := range limiters {
+		if _, ok := rates.m[period]; !ok {
+			delete(limiters, period)
+		}
+	}
+	// the state of a source expires after 10 times the longest period of inactivity
+	s.sources.Set(source, limiters, int(maxPeriod/time.Second)*10+1)
+	return limiters
+}
+
+func (s *windowStore) bucketStats(source string) []BucketStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	v, ok := s.sources.Get(source)
+	if !ok {
+		return nil
+	}
+	now := s.clock.UtcNow()
+	limiters := v.(map[time.Duration]limiter)
+	stats := make([]BucketStats, 0, len(limiters))
+	for period, l := range limiters {
+		u := l.usage(now)
+		stats = append(stats, BucketStats{Period: period, Limit: u.Limit, Remaining: u.Remaining, Reset: u.Reset})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Period < stats[j].Period })
+	return stats
+}
+
+func (s *windowStore) resetBuckets(source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if v, ok := s.sources.Get(source); ok {
+		now := s.clock.UtcNow()
+		for _, l := range v.(map[time.Duration]limiter) {
+			l.reset(now)
+		}
+	}
+}
+
+func mostRestrictive(limiters map[time.Duration]limiter, now time.Time) Usage {
+	var u Usage
+	first := true
+	for _, l := range limiters {
+		lu := l.usage(now)
+		if first || lu.Remaining < u.Remaining {
+			u = lu
+			first = false
+		}
+	}
+	return u
+}
+
+// slidingWindow counts the requests of the current and the previous fixed windows
+type slidingWindow struct {
+	period  time.Duration
+	average int64
+	start   time.Time
+	prev    int64
+	cur     int64
+}
+
+func newSlidingWindow(r *rate, now time.Time) limiter {
+	return &slidingWindow{period: r.period, average: r.average, start: now}
+}
+
+// advance moves the current window to the one containing now
+func (w *slidingWindow) advance(now time.Time) {
+	elapsed := now.Sub(w.start)
+	if elapsed < w.period {
+		return
+	}
+	windows := elapsed / w.period
+	if windows == 1 {
+		w.prev = w.cur
+	} else {
+		w.prev = 0
+	}
+	w.cur = 0
+	w.start = w.start.Add(windows * w.period)
+}
+
+// count is the estimated number of requests in the sliding window ending now
+func (w *slidingWindow) count(now time.Time) float64 {
+	overlap := float64(w.period-now.Sub(w.start)) / float64(w.period)
+	return float64(w.prev)*overlap + float64(w.cur)
+}
+
+func (w *slidingWindow) check(now time.Time, amount int64) (time.Duration, error) {
+	if amount > w.average {
+		return UndefinedDelay, fmt.Errorf("requested tokens larger than max tokens")
+	}
+	w.advance(now)
+	if w.count(now)+float64(amount) <= float64(w.average) {
+		return 0, nil
+	}
+	untilNext := w.start.Add(w.period).Sub(now)
+	left := w.average - w.cur - amount
+	if w.prev == 0 || left < 0 {
+		return maxDuration(untilNext, time.Millisecond), nil
+	}
+	// the weight of the previous window decreases until prev*(period-x)/period <= left
+	x := time.Duration(float64(w.period) * (1 - float64(left)/float64(w.prev)))
+	return maxDuration(x-now.Sub(w.start), time.Millisecond), nil
+}
+
+func (w *slidingWindow) consume(now time.Time, amount int64) time.Duration {
+	w.cur += amount
+	return 0
+}
+
+func (w *slidingWindow) usage(now time.Time) Usage {
+	remaining := w.average - int64(w.count(now)+0.999999)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Usage{Limit: w.average, Remaining: remaining, Reset: w.start.Add(w.period).Sub(now)}
+}
+
+func (w *slidingWindow) update(r *rate) {
+	w.average = r.average
+}
+
+func (w *slidingWindow) reset(now time.Time) {
+	w.start = now
+	w.prev = 0
+	w.cur = 0
+}
+
+// leakyBucket lets one request out every period/average, the others wait in a queue of burst requests
+type leakyBucket struct {
+	interval time.Duration
+	burst    int64
+	// next is the time the queue is empty
+	next time.Time
+}
+
+func newLeakyBucket(r *rate, now time.Time) limiter {
+	return &leakyBucket{interval: leakInterval(r), burst: r.burst, next: now}
+}
+
+// leakInterval is the time between two requests leaving the queue, at least a nanosecond for the rates of more
+// than one request per nanosecond
+func leakInterval(r *rate) time.Duration {
+	return maxDuration(r.period/time.Duration(r.average), 1)
+}
+
+// queued is the time the queue needs to be empty
+func (b *leakyBucket) queued(now time.Time) time.Duration {
+	if b.next.Before(now) {
+		return 0
+	}
+	return b.next.Sub(now)
+}
+
+func (b *leakyBucket) check(now time.Time, amount int64) (time.Duration, error) {
+	if amount > b.burst {
+		return UndefinedDelay, fmt.Errorf("requested tokens larger than max tokens")
+	}
+	// the request leaves the queue once the ones before it are out
+	over := b.queued(now) + time.Duration(amount-b.burst)*b.interval
+	if over > 0 {
+		return over, nil
+	}
+	return 0, nil
+}
+
+func (b *leakyBucket) consume(now time.Time, amount int64) time.Duration {
+	wait := b.queued(now)
+	b.next = now.Add(wait + time.Duration(amount)*b.interval)
+	return wait
+}
+
+func (b *leakyBucket) usage(now time.Time) Usage {
+	queued := b.queued(now)
+	remaining := b.burst - int64((queued+b.interval-1)/b.interval)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Usage{Limit: b.burst, Remaining: remaining, Reset: queued}
+}
+
+func (b *leakyBucket) update(r *rate) {
+	b.interval = leakInterval(r)
+	b.burst = r.burst
+}
+
+func (b *leakyBucket) reset(now time.Time) {
+	b.next = now
+}
@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestSlidingWindowStore(t *testing.T) {
+	clock := testutils.GetClock()
+
+	store, err := newAlgorithmStore(SlidingWindow, DefaultCapacity, clock)
+	require.NoError(t, err)
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 4, 1))
+
+	for i := 0; i < 4; i++ {
+		delay, _, err := store.Consume("a", rates, 1)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), delay)
+	}
+
+	// the burst is ignored, the window is full
+	delay, usage, err := store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, delay)
+	assert.Equal(t, Usage{Limit: 4, Remaining: 0, Reset: time.Second}, usage)
+
+	// half of the previous window still counts
+	clock.Sleep(1500 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		delay, _, err = store.Consume("a", rates, 1)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), delay)
+	}
+	delay, _, err = store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, delay)
+
+	clock.Sleep(delay)
+	delay, _, err = store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	_, _, err = store.Consume("b", rates, 5)
+	assert.Error(t, err)
+}
+
+func TestLeakyBucketStore(t *testing.T) {
+	clock := testutils.GetClock()
+
+	store, err := newAlgorithmStore(LeakyBucket, DefaultCapacity, clock)
+	require.NoError(t, err)
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 10, 3))
+
+	// the requests are queued and leave every 100ms
+	start := clock.UtcNow()
+	for i := 0; i < 3; i++ {
+		delay, _, err := store.Consume("a", rates, 1)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), delay)
+		assert.Equal(t, time.Duration(i)*100*time.Millisecond, clock.UtcNow().Sub(start))
+		// the request was delayed, go back to the time the requests arrived
+		clock.CurrentTime = start
+	}
+
+	// the queue is full
+	delay, usage, err := store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, delay)
+	assert.Equal(t, Usage{Limit: 3, Remaining: 0, Reset: 300 * time.Millisecond}, usage)
+
+	clock.Sleep(delay)
+	delay, _, err = store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	_, _, err = store.Consume("b", rates, 4)
+	assert.Error(t, err)
+}
+
+func TestLeakyBucketHighRate(t *testing.T) {
+	clock := testutils.GetClock()
+
+	store, err := newAlgorithmStore(LeakyBucket, DefaultCapacity, clock)
+	require.NoError(t, err)
+
+	// more than one request per nanosecond leaves the queue every nanosecond
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Microsecond, 10000, 2))
+
+	start := clock.UtcNow()
+	for i := 0; i < 2; i++ {
+		delay, _, err := store.Consume("a", rates, 1)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), delay)
+		clock.CurrentTime = start
+	}
+	delay, usage, err := store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Nanosecond, delay)
+	assert.Equal(t, Usage{Limit: 2, Remaining: 0, Reset: 2 * time.Nanosecond}, usage)
+}
+
+func TestLeakyBucketCanceled(t *testing.T) {
+	clock := &waitClock{now: testutils.GetClock().UtcNow(), waiting: make(chan chan time.Time, 1)}
+
+	store, err := newWindowStore(DefaultCapacity, clock, newLeakyBucket)
+	require.NoError(t, err)
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 2))
+
+	delay, _, err := store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	// the queued request stops waiting once its client went away
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := store.consumeContext(ctx, "a", rates, 1)
+		errs <- err
+	}()
+	<-clock.waiting
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+}
+
+func TestLimitAlgorithm(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 10))
+
+	l, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()), LimitAlgorithm(SlidingWindow))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	_, err = New(handler, headerLimit, rates, LimitAlgorithm(Algorithm(42)))
+	assert.Error(t, err)
+}
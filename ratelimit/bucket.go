@@ -84,6 +84,13 @@ func (tb *tokenBucket) rollback() {
 	tb.lastConsumed = 0
 }
 
+// reset fills the bucket, as if no tokens were consumed
+func (tb *tokenBucket) reset() {
+	tb.availableTokens = tb.burst
+	tb.lastRefresh = tb.clock.UtcNow()
+	tb.lastConsumed = 0
+}
+
 // update modifies `average` and `burst` fields of the token bucket according
 // to the provided `Rate`
 func (tb *tokenBucket) update(rate *rate) error {
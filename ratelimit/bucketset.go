@@ -81,6 +81,46 @@ func (tbs *TokenBucketSet) Consume(tokens int64) (time.Duration, error) {
 	return maxDelay, firstErr
 }
 
+// usage returns the usage of the bucket with the fewest remaining tokens
+func (tbs *TokenBucketSet) usage() Usage {
+	var u Usage
+	first := true
+	for _, bucket := range tbs.buckets {
+		if first || bucket.availableTokens < u.Remaining {
+			u = Usage{
+				Limit:     bucket.burst,
+				Remaining: bucket.availableTokens,
+				Reset:     time.Duration(bucket.burst-bucket.availableTokens) * bucket.timePerToken,
+			}
+			first = false
+		}
+	}
+	return u
+}
+
+// stats returns the state of the buckets sorted by period
+func (tbs *TokenBucketSet) stats() []BucketStats {
+	stats := make([]BucketStats, 0, len(tbs.buckets))
+	for _, bucket := range tbs.buckets {
+		bucket.updateAvailableTokens()
+		stats = append(stats, BucketStats{
+			Period:    bucket.period,
+			Limit:     bucket.burst,
+			Remaining: bucket.availableTokens,
+			Reset:     time.Duration(bucket.burst-bucket.availableTokens) * bucket.timePerToken,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Period < stats[j].Period })
+	return stats
+}
+
+// reset fills all the buckets
+func (tbs *TokenBucketSet) reset() {
+	for _, bucket := range tbs.buckets {
+		bucket.reset()
+	}
+}
+
 // GetMaxPeriod returns the max period
 func (tbs *TokenBucketSet) GetMaxPeriod() time.Duration {
 	return tbs.maxPeriod
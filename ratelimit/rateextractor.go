@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+)
+
+// ParseRateSet parses rates written as period:average:burst separated by commas, e.g. "1s:10:20,1m:100:100"
+func ParseRateSet(spec string) (*RateSet, error) {
+	rs := NewRateSet()
+	for _, r := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(r), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("rate should be period:average:burst got %q", r)
+		}
+		period, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid period in rate %q: %v", r, err)
+		}
+		average, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid average in rate %q: %v", r, err)
+		}
+		burst, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid burst in rate %q: %v", r, err)
+		}
+		if err := rs.Add(period, average, burst); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// Spec formats the rates the way ParseRateSet parses them, by increasing period
+func (rs *RateSet) Spec() string {
+	periods := make([]time.Duration, 0, len(rs.m))
+	for p := range rs.m {
+		periods = append(periods, p)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i] < periods[j] })
+	rates := make([]string, len(periods))
+	for i, p := range periods {
+		r := rs.m[p]
+		rates[i] = fmt.Sprintf("%v:%d:%d", r.period, r.average, r.burst)
+	}
+	return strings.Join(rates, ",")
+}
+
+// SignRates returns the value of a signed rates header, see NewSignedHeaderRateExtractor.
+// It is meant to be used by the component deciding the rates of the clients, e.g. an authentication service.
+func SignRates(rates *RateSet, secret []byte) string {
+	spec := rates.Spec()
+	return spec + ";sig=" + signature(spec, secret)
+}
+
+func signature(spec string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(spec))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewSignedHeaderRateExtractor returns a rate extractor reading the rates of the request from a header signed
+// with a shared secret, e.g. set by an authentication service in front of the proxy. The header is written
+// as "1s:10:20,1m:100:100;sig=<signature>", see SignRates.
+// The requests without the header get the default rates, the ones with an invalid signature as well.
+func NewSignedHeaderRateExtractor(header string, secret []byte) (RateExtractor, error) {
+	if header == "" {
+		return nil, fmt.Errorf("header name can not be empty")
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret can not be empty")
+	}
+	return RateExtractorFunc(func(req *http.Request) (*RateSet, error) {
+		value := req.Header.Get(header)
+		if value == "" {
+			return nil, nil
+		}
+		i := strings.LastIndex(value, ";sig=")
+		if i < 0 {
+			return nil, fmt.Errorf("unsigned rates in header %v", header)
+		}
+		spec, sig := value[:i], value[i+len(";sig="):]
+		if !hmac.Equal([]byte(sig), []byte(signature(spec, secret))) {
+			return nil, fmt.Errorf("invalid signature of the rates in header %v", header)
+		}
+		return ParseRateSet(spec)
+	}), nil
+}
+
+// RateLookup returns the rates of a key, e.g. the rates of the plan of the customer owning an API key.
+// It returns nil rates for the keys getting the default rates.
+type RateLookup func(key string) (*RateSet, error)
+
+// LookupOption configures a lookup rate extractor
+type LookupOption func(e *lookupRateExtractor) error
+
+// LookupCapacity sets the maximum number of keys whose rates are cached, defaults to DefaultCapacity
+func LookupCapacity(capacity int) LookupOption {
+	return func(e *lookupRateExtractor) error {
+		if capacity <= 0 {
+			return fmt.Errorf("bad capacity: %v", capacity)
+		}
+		e.capacity = capacity
+		return nil
+	}
+}
+
+// LookupClock sets the clock expiring the cached rates
+func LookupClock(clock timetools.TimeProvider) LookupOption {
+	return func(e *lookupRateExtractor) error {
+		e.clock = clock
+		return nil
+	}
+}
+
+type lookupRateExtractor struct {
+	extract  utils.SourceExtractor
+	lookup   RateLookup
+	ttl      int
+	capacity int
+	clock    timetools.TimeProvider
+	cache    *ttlmap.TtlMap
+}
+
+// cachedRates holds the rates of a key, nil for the default rates
+type cachedRates struct {
+	rates *RateSet
+}
+
+// NewLookupRateExtractor returns a rate extractor looking up the rates of the key extracted from the request,
+// e.g. with utils.NewAPIKeyExtractor. The rates are cached for ttl, rounded up to the second, and the failed
+// lookups are not cached: the requests get the default rates until the lookup succeeds.
+func NewLookupRateExtractor(extract utils.SourceExtractor, lookup RateLookup, ttl time.Duration, opts ...LookupOption) (RateExtractor, error) {
+	if extract == nil || lookup == nil {
+		return nil, fmt.Errorf("provide extract and lookup functions")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl should be > 0 got %v", ttl)
+	}
+	e := &lookupRateExtractor{
+		extract:  extract,
+		lookup:   lookup,
+		ttl:      int((ttl + time.Second - 1) / time.Second),
+		capacity: DefaultCapacity,
+	}
+	for _, o := range opts {
+		if err := o(e); err != nil {
+			return nil, err
+		}
+	}
+	if e.clock == nil {
+		e.clock = &timetools.RealTime{}
+	}
+	cache, err := ttlmap.NewConcurrent(e.capacity, ttlmap.Clock(e.clock))
+	if err != nil {
+		return nil, err
+	}
+	e.cache = cache
+	return e, nil
+}
+
+func (e *lookupRateExtractor) Extract(req *http.Request) (*RateSet, error) {
+	key, _, err := e.extract.Extract(req)
+	if err != nil || key == "" {
+		return nil, nil
+	}
+	if cached, ok := e.cache.Get(key); ok {
+		return cached.(*cachedRates).rates, nil
+	}
+	rates, err := e.lookup(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the rates of %v: %v", key, err)
+	}
+	if err := e.cache.Set(key, &cachedRates{rates: rates}, e.ttl); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestParseRateSet(t *testing.T) {
+	rs, err := ParseRateSet("1m:100:200, 1s:10:20")
+	require.NoError(t, err)
+	assert.Equal(t, "1s:10:20,1m0s:100:200", rs.Spec())
+
+	rs, err = ParseRateSet(rs.Spec())
+	require.NoError(t, err)
+	assert.Equal(t, "1s:10:20,1m0s:100:200", rs.Spec())
+
+	for _, spec := range []string{"", "1s:10", "1x:10:20", "1s:a:20", "1s:10:b", "1s:0:20"} {
+		_, err := ParseRateSet(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestSignedHeaderRateExtractor(t *testing.T) {
+	secret := []byte("secret")
+	extract, err := NewSignedHeaderRateExtractor("X-Rates", secret)
+	require.NoError(t, err)
+
+	paid, err := ParseRateSet("1s:100:100")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rates, err := extract.Extract(req)
+	require.NoError(t, err)
+	assert.Nil(t, rates)
+
+	req.Header.Set("X-Rates", SignRates(paid, secret))
+	rates, err = extract.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, paid.Spec(), rates.Spec())
+
+	req.Header.Set("X-Rates", SignRates(paid, []byte("forged")))
+	_, err = extract.Extract(req)
+	assert.Error(t, err)
+
+	req.Header.Set("X-Rates", "1s:100:100")
+	_, err = extract.Extract(req)
+	assert.Error(t, err)
+
+	_, err = NewSignedHeaderRateExtractor("X-Rates", nil)
+	assert.Error(t, err)
+}
+
+func TestLookupRateExtractor(t *testing.T) {
+	free, err := ParseRateSet("1s:1:1")
+	require.NoError(t, err)
+	paid, err := ParseRateSet("1s:3:3")
+	require.NoError(t, err)
+
+	lookups := 0
+	lookup := func(key string) (*RateSet, error) {
+		lookups++
+		switch key {
+		case "paid":
+			return paid, nil
+		case "broken":
+			return nil, fmt.Errorf("plan database is down")
+		}
+		return nil, nil
+	}
+
+	clock := testutils.GetClock()
+	extractRates, err := NewLookupRateExtractor(utils.NewAPIKeyExtractor("X-Api-Key", ""), lookup, time.Minute, LookupClock(clock))
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	l, err := New(handler, utils.NewAPIKeyExtractor("X-Api-Key", ""), free, Clock(clock), ExtractRates(extractRates))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	codes := func(key string, n int) []int {
+		var out []int
+		for i := 0; i < n; i++ {
+			re, _, err := testutils.Get(srv.URL, testutils.Header("X-Api-Key", key))
+			require.NoError(t, err)
+			out = append(out, re.StatusCode)
+		}
+		return out
+	}
+
+	assert.Equal(t, []int{200, 200, 200, 429}, codes("paid", 4))
+	assert.Equal(t, []int{200, 429}, codes("free", 2))
+	assert.Equal(t, []int{200, 429}, codes("broken", 2))
+	// paid and free are cached, broken is looked up every time
+	assert.Equal(t, 4, lookups)
+
+	clock.Sleep(time.Minute + time.Second)
+	codes("paid", 1)
+	assert.Equal(t, 5, lookups)
+
+	_, err = NewLookupRateExtractor(nil, lookup, time.Minute)
+	assert.Error(t, err)
+	_, err = NewLookupRateExtractor(headerLimit, lookup, 0)
+	assert.Error(t, err)
+	_, err = NewLookupRateExtractor(headerLimit, lookup, time.Minute, LookupCapacity(0))
+	assert.Error(t, err)
+}
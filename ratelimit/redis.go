@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RedisClient is the subset of a Redis client used by RedisStore, it is easily implemented on top of
+// any Redis library, e.g. with github.com/go-redis/redis:
+//
+//	type client struct{ *redis.Client }
+//
+//	func (c client) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+//		return c.Client.Eval(script, keys, args...).Result()
+//	}
+type RedisClient interface {
+	// Eval runs the Lua script and returns its result, integers are returned as int64
+	Eval(script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// redisConsumeScript consumes tokens from the buckets of a source, one hash per bucket.
+// The time is read from the Redis server so that all the nodes agree on it, durations are in microseconds.
+// It returns the delay to wait, 0 if the tokens were consumed or -1 when the amount exceeds a burst,
+// followed by the burst, the remaining tokens and the time to refill the most restrictive bucket.
+const redisConsumeScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local amount = tonumber(ARGV[1])
+local tokens = {}
+local delay = 0
+local usage = nil
+for i = 1, #KEYS do
+  local period = tonumber(ARGV[i * 3 - 1])
+  local average = tonumber(ARGV[i * 3])
+  local burst = tonumber(ARGV[i * 3 + 1])
+  if amount > burst then
+    return {-1, 0, 0, 0}
+  end
+  local state = redis.call('HMGET', KEYS[i], 'tokens', 'ts')
+  local available = tonumber(state[1]) or burst
+  local ts = tonumber(state[2]) or now
+  if now > ts then
+    available = math.min(burst, available + (now - ts) * average / period)
+  end
+  tokens[i] = available
+  if available < amount then
+    delay = math.max(delay, math.ceil((amount - available) * period / average))
+  end
+end
+if delay == 0 then
+  for i = 1, #KEYS do
+    local period = tonumber(ARGV[i * 3 - 1])
+    tokens[i] = tokens[i] - amount
+    redis.call('HMSET', KEYS[i], 'tokens', tokens[i], 'ts', now)
+    redis.call('PEXPIRE', KEYS[i], math.ceil(period / 1000) * 10)
+  end
+end
+for i = 1, #KEYS do
+  local period = tonumber(ARGV[i * 3 - 1])
+  local average = tonumber(ARGV[i * 3])
+  local burst = tonumber(ARGV[i * 3 + 1])
+  if usage == nil or tokens[i] < usage[3] then
+    usage = {delay, burst, tokens[i], math.ceil((burst - tokens[i]) * period / average)}
+  end
+end
+usage[3] = math.floor(usage[3])
+return usage
+`
+
+// RedisStore keeps the token buckets in Redis so that several TokenLimiter instances share the same limits.
+// Every bucket is a hash expiring after 10 times its period of inactivity.
+type RedisStore struct {
+	client RedisClient
+	prefix string
+}
+
+// NewRedisStore creates a new RedisStore, the keys of the buckets start with prefix
+func NewRedisStore(client RedisClient, prefix string) (*RedisStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("provide redis client")
+	}
+	return &RedisStore{client: client, prefix: prefix}, nil
+}
+
+// Consume takes amount tokens from the buckets of the source in one atomic script
+func (s *RedisStore) Consume(source string, rates *RateSet, amount int64) (time.Duration, Usage, error) {
+	periods := make([]time.Duration, 0, len(rates.m))
+	for period := range rates.m {
+		periods = append(periods, period)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i] < periods[j] })
+
+	keys := make([]string, 0, len(periods))
+	args := make([]interface{}, 0, 1+3*len(periods))
+	args = append(args, amount)
+	for _, period := range periods {
+		r := rates.m[period]
+		keys = append(keys, s.prefix+source+":"+strconv.FormatInt(int64(period/time.Microsecond), 10))
+		args = append(args, int64(period/time.Microsecond), r.average, r.burst)
+	}
+
+	res, err := s.client.Eval(redisConsumeScript, keys, args...)
+	if err != nil {
+		return UndefinedDelay, Usage{}, err
+	}
+	values, err := redisInts(res, 4)
+	if err != nil {
+		return UndefinedDelay, Usage{}, err
+	}
+	if values[0] < 0 {
+		return UndefinedDelay, Usage{}, fmt.Errorf("requested tokens larger than max tokens")
+	}
+	usage := Usage{Limit: values[1], Remaining: values[2], Reset: time.Duration(values[3]) * time.Microsecond}
+	return time.Duration(values[0]) * time.Microsecond, usage, nil
+}
+
+// redisInts converts the array of integers returned by a script
+func redisInts(res interface{}, n int) ([]int64, error) {
+	items, ok := res.([]interface{})
+	if !ok || len(items) != n {
+		return nil, fmt.Errorf("unexpected redis result %v", res)
+	}
+	values := make([]int64, n)
+	for i, item := range items {
+		v, ok := item.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected redis result %T", item)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
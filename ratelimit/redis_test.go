@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// fakeRedis records the scripts it runs and returns the configured result
+type fakeRedis struct {
+	keys   []string
+	args   []interface{}
+	result interface{}
+	err    error
+}
+
+func (f *fakeRedis) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	f.keys = keys
+	f.args = args
+	return f.result, f.err
+}
+
+func TestRedisStoreConsume(t *testing.T) {
+	client := &fakeRedis{result: []interface{}{int64(0), int64(2), int64(1), int64(1000000)}}
+
+	store, err := NewRedisStore(client, "oxy:")
+	require.NoError(t, err)
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Minute, 100, 200))
+	require.NoError(t, rates.Add(time.Second, 1, 2))
+
+	delay, usage, err := store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+	assert.Equal(t, Usage{Limit: 2, Remaining: 1, Reset: time.Second}, usage)
+
+	assert.Equal(t, []string{"oxy:a:1000000", "oxy:a:60000000"}, client.keys)
+	assert.Equal(t, []interface{}{int64(1), int64(1000000), int64(1), int64(2), int64(60000000), int64(100), int64(200)}, client.args)
+
+	client.result = []interface{}{int64(1500), int64(2), int64(0), int64(2000000)}
+	delay, _, err = store.Consume("a", rates, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1500*time.Microsecond, delay)
+
+	client.result = []interface{}{int64(-1), int64(0), int64(0), int64(0)}
+	_, _, err = store.Consume("a", rates, 3)
+	assert.Error(t, err)
+
+	client.result = "OK"
+	_, _, err = store.Consume("a", rates, 1)
+	assert.Error(t, err)
+
+	client.result = []interface{}{int64(0), "2"}
+	_, _, err = store.Consume("a", rates, 1)
+	assert.Error(t, err)
+
+	client.err = fmt.Errorf("connection refused")
+	_, _, err = store.Consume("a", rates, 1)
+	assert.Error(t, err)
+}
+
+func TestRedisStoreLimiter(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	client := &fakeRedis{result: []interface{}{int64(0), int64(1), int64(0), int64(1000000)}}
+	store, err := NewRedisStore(client, "")
+	require.NoError(t, err)
+
+	l, err := New(handler, headerLimit, rates, Storage(store))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, []string{"a:1000000"}, client.keys)
+
+	client.result = []interface{}{int64(time.Second / time.Microsecond), int64(1), int64(0), int64(1000000)}
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "1", re.Header.Get("Retry-After"))
+}
+
+func TestRedisStoreNoClient(t *testing.T) {
+	_, err := NewRedisStore(nil, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// RuleSet is an ordered list of rules giving the rates of the requests matching a method and a path pattern.
+// The first matching rule applies, the requests matching no rule get the rates of the token limiter.
+type RuleSet struct {
+	rules []*rule
+}
+
+type rule struct {
+	method  string
+	pattern string
+	rates   *RateSet
+	// key prefixes the source so that every rule has its own buckets
+	key string
+}
+
+// NewRuleSet creates an empty `RuleSet` instance.
+func NewRuleSet() *RuleSet {
+	return &RuleSet{}
+}
+
+// Add appends a rule to the set. An empty method or "*" matches any method. The pattern follows
+// the syntax of path.Match, a pattern ending with a slash matches the whole subtree, e.g. "/api/".
+func (rs *RuleSet) Add(method, pattern string, rates *RateSet) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("invalid pattern: %q, should start with /", pattern)
+	}
+	if _, err := path.Match(pattern, "/"); err != nil {
+		return fmt.Errorf("invalid pattern: %q: %v", pattern, err)
+	}
+	if rates == nil || len(rates.m) == 0 {
+		return fmt.Errorf("provide rates for %v %v", method, pattern)
+	}
+	method = strings.ToUpper(method)
+	if method == "*" {
+		method = ""
+	}
+	rs.rules = append(rs.rules, &rule{
+		method:  method,
+		pattern: pattern,
+		rates:   rates,
+		key:     fmt.Sprintf("%d:%s %s|", len(rs.rules), method, pattern),
+	})
+	return nil
+}
+
+func (rs *RuleSet) match(req *http.Request) *rule {
+	for _, r := range rs.rules {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// String returns the method and the pattern of the rule, e.g. "GET /api/"
+func (r *rule) String() string {
+	method := r.method
+	if method == "" {
+		method = "*"
+	}
+	return method + " " + r.pattern
+}
+
+func (r *rule) matches(req *http.Request) bool {
+	if r.method != "" && r.method != req.Method {
+		return false
+	}
+	if strings.HasSuffix(r.pattern, "/") && strings.HasPrefix(req.URL.Path, r.pattern) {
+		return true
+	}
+	ok, _ := path.Match(r.pattern, req.URL.Path)
+	return ok
+}
+
+// Rules sets the rules evaluated before the rates of the token limiter
+func Rules(rs *RuleSet) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.rules = rs
+		return nil
+	}
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRuleSetAdd(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	rs := NewRuleSet()
+	assert.Error(t, rs.Add("GET", "api", rates))
+	assert.Error(t, rs.Add("GET", "/api/[", rates))
+	assert.Error(t, rs.Add("GET", "/api", nil))
+	assert.Error(t, rs.Add("GET", "/api", NewRateSet()))
+	assert.NoError(t, rs.Add("GET", "/api", rates))
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	rs := NewRuleSet()
+	require.NoError(t, rs.Add("post", "/api/v1/send", rates))
+	require.NoError(t, rs.Add("", "/users/*/avatar", rates))
+	require.NoError(t, rs.Add("*", "/static/", rates))
+
+	testCases := []struct {
+		method string
+		path   string
+		rule   int
+	}{
+		{method: http.MethodPost, path: "/api/v1/send", rule: 0},
+		{method: http.MethodGet, path: "/api/v1/send", rule: -1},
+		{method: http.MethodGet, path: "/users/bob/avatar", rule: 1},
+		{method: http.MethodGet, path: "/users/bob/name", rule: -1},
+		{method: http.MethodDelete, path: "/static/css/site.css", rule: 2},
+		{method: http.MethodGet, path: "/", rule: -1},
+	}
+
+	for _, test := range testCases {
+		req := httptest.NewRequest(test.method, "http://localhost"+test.path, nil)
+		r := rs.match(req)
+		if test.rule < 0 {
+			assert.Nil(t, r, test.path)
+			continue
+		}
+		assert.Equal(t, rs.rules[test.rule], r, test.path)
+	}
+}
+
+func TestRulesHaveTheirOwnBuckets(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	defaultRates := NewRateSet()
+	require.NoError(t, defaultRates.Add(time.Second, 2, 2))
+
+	sendRates := NewRateSet()
+	require.NoError(t, sendRates.Add(time.Second, 1, 1))
+
+	rules := NewRuleSet()
+	require.NoError(t, rules.Add(http.MethodPost, "/api/v1/send", sendRates))
+
+	l, err := New(handler, headerLimit, defaultRates, Clock(testutils.GetClock()), Rules(rules))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Post(srv.URL+"/api/v1/send", testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Post(srv.URL+"/api/v1/send", testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// other routes use the default rates
+	for i := 0; i < 2; i++ {
+		re, _, err = testutils.Get(srv.URL+"/api/v1/list", testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	re, _, err = testutils.Get(srv.URL+"/api/v1/list", testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+}
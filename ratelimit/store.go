@@ -0,0 +1,130 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+)
+
+// Usage describes the most restrictive token bucket of a source after a consumption
+type Usage struct {
+	// Limit is the maximum number of tokens of the bucket
+	Limit int64
+	// Remaining is the number of tokens left in the bucket
+	Remaining int64
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+}
+
+// Store keeps the state of the token buckets of every source.
+// Sharing a Store between several TokenLimiter instances, e.g. a RedisStore, enforces one global limit per source.
+type Store interface {
+	// Consume takes amount tokens from the buckets of the source defined by rates. It returns a zero delay
+	// if the tokens were consumed, otherwise the time to wait until they are available and nothing is consumed.
+	// An error is returned when the amount can never be consumed, e.g. it is larger than the burst.
+	// The usage of the buckets is returned along.
+	Consume(source string, rates *RateSet, amount int64) (time.Duration, Usage, error)
+}
+
+// Occupancy describes how full the in memory store of the token buckets is
+type Occupancy struct {
+	// Sources is the number of sources with buckets in the store, the ones recently expired may be counted
+	Sources int `json:"sources"`
+	// Capacity is the maximum number of sources in the store, the least recently used are evicted beyond
+	Capacity int `json:"capacity"`
+}
+
+// sourceCounter is implemented by the stores that can tell how many sources they hold
+type sourceCounter interface {
+	sourceCount() int
+}
+
+// contextConsumer is implemented by the stores that make the requests wait, the wait ends with the context
+type contextConsumer interface {
+	consumeContext(ctx context.Context, source string, rates *RateSet, amount int64) (time.Duration, Usage, error)
+}
+
+// BucketStats is the state of the bucket of a source for one period of its rates
+type BucketStats struct {
+	// Rule is the method and pattern of the rule the bucket belongs to, empty for the rates of the token limiter
+	Rule   string        `json:"rule,omitempty"`
+	Period time.Duration `json:"period"`
+	// Limit is the maximum number of tokens of the bucket
+	Limit int64 `json:"limit"`
+	// Remaining is the number of tokens left in the bucket
+	Remaining int64 `json:"remaining"`
+	// Reset is the time until the bucket is full again
+	Reset time.Duration `json:"reset"`
+}
+
+// bucketInspector is implemented by the stores that can tell and reset the state of the buckets of a source
+type bucketInspector interface {
+	// bucketStats returns the buckets of the source sorted by period, none if the source has no buckets
+	bucketStats(source string) []BucketStats
+	// resetBuckets fills the buckets of the source, if any
+	resetBuckets(source string)
+}
+
+// memoryStore keeps the token buckets in memory, expiring the ones of inactive sources
+type memoryStore struct {
+	mutex      sync.Mutex
+	clock      timetools.TimeProvider
+	bucketSets *ttlmap.TtlMap
+}
+
+func newMemoryStore(capacity int, clock timetools.TimeProvider) (*memoryStore, error) {
+	bucketSets, err := ttlmap.NewMapWithProvider(capacity, clock)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryStore{clock: clock, bucketSets: bucketSets}, nil
+}
+
+func (s *memoryStore) sourceCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.bucketSets.Len()
+}
+
+func (s *memoryStore) Consume(source string, rates *RateSet, amount int64) (time.Duration, Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucketSetI, exists := s.bucketSets.Get(source)
+	var bucketSet *TokenBucketSet
+
+	if exists {
+		bucketSet = bucketSetI.(*TokenBucketSet)
+		bucketSet.Update(rates)
+	} else {
+		bucketSet = NewTokenBucketSet(rates, s.clock)
+		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
+		// the counters for this ip will expire after 10 seconds of inactivity
+		s.bucketSets.Set(source, bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
+	}
+	delay, err := bucketSet.Consume(amount)
+	return delay, bucketSet.usage(), err
+}
+
+func (s *memoryStore) bucketStats(source string) []BucketStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucketSet, exists := s.bucketSets.Get(source)
+	if !exists {
+		return nil
+	}
+	return bucketSet.(*TokenBucketSet).stats()
+}
+
+func (s *memoryStore) resetBuckets(source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if bucketSet, exists := s.bucketSets.Get(source); exists {
+		bucketSet.(*TokenBucketSet).reset()
+	}
+}
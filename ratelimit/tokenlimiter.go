@@ -3,14 +3,15 @@ package ratelimit
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/heebyunglee/oxy/utils"
 	"github.com/mailgun/timetools"
-	"github.com/mailgun/ttlmap"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 // DefaultCapacity default capacity
@@ -66,14 +67,24 @@ type TokenLimiter struct {
 	defaultRates *RateSet
 	extract      utils.SourceExtractor
 	extractRates RateExtractor
+	rules        *RuleSet
+	configMutex  sync.RWMutex
 	clock        timetools.TimeProvider
-	mutex        sync.Mutex
-	bucketSets   *ttlmap.TtlMap
+	store        Store
+	algorithm    Algorithm
 	errHandler   utils.ErrorHandler
 	capacity     int
+	headers      bool
 	next         http.Handler
 
-	log *log.Logger
+	// maxWait is how long the requests over the rate can be delayed, 0 rejects them right away
+	maxWait    time.Duration
+	maxDelayed int
+	delayMutex sync.Mutex
+	delayed    map[string]int
+
+	log    *log.Logger
+	logger utils.Logger
 }
 
 // New constructs a `TokenLimiter` middleware instance.
@@ -88,6 +99,7 @@ func New(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet
 		next:         next,
 		defaultRates: defaultRates,
 		extract:      extract,
+		delayed:      make(map[string]int),
 
 		log: log.StandardLogger(),
 	}
@@ -98,11 +110,16 @@ func New(next http.Handler, extract utils.SourceExtractor, defaultRates *RateSet
 		}
 	}
 	setDefaults(tl)
-	bucketSets, err := ttlmap.NewMapWithProvider(tl.capacity, tl.clock)
-	if err != nil {
-		return nil, err
+	if tl.logger == nil {
+		tl.logger = utils.NewLogrusLogger(tl.log)
+	}
+	if tl.store == nil {
+		store, err := newAlgorithmStore(tl.algorithm, tl.capacity, tl.clock)
+		if err != nil {
+			return nil, err
+		}
+		tl.store = store
 	}
-	tl.bucketSets = bucketSets
 	return tl, nil
 }
 
@@ -116,11 +133,70 @@ func Logger(l *log.Logger) TokenLimiterOption {
 	}
 }
 
+// StructuredLogger defines the structured logger the token limiter logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by Logger.
+func StructuredLogger(l utils.Logger) TokenLimiterOption {
+	return func(tl *TokenLimiter) error {
+		tl.logger = l
+		return nil
+	}
+}
+
 // Wrap sets the next handler to be called by token limiter handler.
 func (tl *TokenLimiter) Wrap(next http.Handler) {
 	tl.next = next
 }
 
+// Occupancy returns how full the in memory store of the token buckets is,
+// false if the limiter uses a store that can not tell, e.g. a RedisStore
+func (tl *TokenLimiter) Occupancy() (Occupancy, bool) {
+	s, ok := tl.store.(sourceCounter)
+	if !ok {
+		return Occupancy{}, false
+	}
+	return Occupancy{Sources: s.sourceCount(), Capacity: tl.capacity}, true
+}
+
+// BucketStats returns the state of the buckets of a source, as returned by the source extractor, e.g. to tell
+// how throttled a customer is. The buckets of the rules the source made requests to are listed after the ones
+// of the rates of the token limiter. A source without buckets has not made requests recently.
+// It fails if the limiter uses a store that can not tell, e.g. a RedisStore.
+func (tl *TokenLimiter) BucketStats(source string) ([]BucketStats, error) {
+	inspector, ok := tl.store.(bucketInspector)
+	if !ok {
+		return nil, fmt.Errorf("the store %T can not inspect the buckets", tl.store)
+	}
+	stats := inspector.bucketStats(source)
+	if _, _, rules := tl.config(); rules != nil {
+		for _, r := range rules.rules {
+			for _, s := range inspector.bucketStats(r.key + source) {
+				s.Rule = r.String()
+				stats = append(stats, s)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// ResetBucket fills the buckets of a source, the ones of the rules included, e.g. to clear an accidental lockout.
+// It fails if the limiter uses a store that can not reset them, e.g. a RedisStore.
+func (tl *TokenLimiter) ResetBucket(source string) error {
+	inspector, ok := tl.store.(bucketInspector)
+	if !ok {
+		return fmt.Errorf("the store %T can not reset the buckets", tl.store)
+	}
+	inspector.resetBuckets(source)
+	if _, _, rules := tl.config(); rules != nil {
+		for _, r := range rules.rules {
+			inspector.resetBuckets(r.key + source)
+		}
+	}
+	tl.log.Infof("vulcand/oxy/ratelimit: reset the buckets of %v", source)
+	return nil
+}
+
 func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	source, amount, err := tl.extract.Extract(req)
 	if err != nil {
@@ -128,8 +204,12 @@ func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if err := tl.consumeRates(req, source, amount); err != nil {
-		tl.log.Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
+	usage, err := tl.consumeOrWait(req, source, amount)
+	if tl.headers && usage != nil {
+		setUsageHeaders(w.Header(), usage)
+	}
+	if err != nil {
+		utils.RequestLogger(req, tl.logger).Warnf("limiting request %v %v, limit: %v", req.Method, req.URL, err)
 		tl.errHandler.ServeHTTP(w, req, err)
 		return
 	}
@@ -137,50 +217,154 @@ func (tl *TokenLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	tl.next.ServeHTTP(w, req)
 }
 
-func (tl *TokenLimiter) consumeRates(req *http.Request, source string, amount int64) error {
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
-
-	effectiveRates := tl.resolveRates(req)
-	bucketSetI, exists := tl.bucketSets.Get(source)
-	var bucketSet *TokenBucketSet
+// resolveBucket returns the key of the buckets of the request and the rates they are filled at
+func (tl *TokenLimiter) resolveBucket(req *http.Request, source string) (string, *RateSet) {
+	if r := tl.matchRule(req); r != nil {
+		return r.key + source, r.rates
+	}
+	return source, tl.resolveRates(req)
+}
 
-	if exists {
-		bucketSet = bucketSetI.(*TokenBucketSet)
-		bucketSet.Update(effectiveRates)
+func (tl *TokenLimiter) consumeRates(req *http.Request, key string, rates *RateSet, amount int64) (*Usage, error) {
+	var delay time.Duration
+	var usage Usage
+	var err error
+	if c, ok := tl.store.(contextConsumer); ok {
+		delay, usage, err = c.consumeContext(req.Context(), key, rates, amount)
 	} else {
-		bucketSet = NewTokenBucketSet(effectiveRates, tl.clock)
-		// We set ttl as 10 times rate period. E.g. if rate is 100 requests/second per client ip
-		// the counters for this ip will expire after 10 seconds of inactivity
-		tl.bucketSets.Set(source, bucketSet, int(bucketSet.maxPeriod/time.Second)*10+1)
+		delay, usage, err = tl.store.Consume(key, rates, amount)
 	}
-	delay, err := bucketSet.Consume(amount)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if delay > 0 {
-		return &MaxRateError{delay: delay}
+		return &usage, &MaxRateError{delay: delay}
+	}
+	return &usage, nil
+}
+
+// consumeOrWait consumes the rates of the request, delaying it until the tokens are available if the token limiter
+// delays the requests over the rate
+func (tl *TokenLimiter) consumeOrWait(req *http.Request, source string, amount int64) (*Usage, error) {
+	key, rates := tl.resolveBucket(req, source)
+	usage, err := tl.consumeRates(req, key, rates, amount)
+	rerr, ok := err.(*MaxRateError)
+	if !ok || rerr.delay > tl.maxWait || !tl.startDelay(key) {
+		return usage, err
+	}
+	defer tl.endDelay(key)
+
+	deadline := tl.clock.UtcNow().Add(tl.maxWait)
+	for {
+		select {
+		case <-tl.clock.After(rerr.delay):
+		case <-req.Context().Done():
+			return usage, req.Context().Err()
+		}
+
+		// the tokens may have been taken by another request in the meantime
+		usage, err = tl.consumeRates(req, key, rates, amount)
+		rerr, ok = err.(*MaxRateError)
+		if !ok || tl.clock.UtcNow().Add(rerr.delay).After(deadline) {
+			return usage, err
+		}
+	}
+}
+
+// startDelay counts a delayed request of the buckets, it returns false if too many requests of the buckets are
+// delayed already
+func (tl *TokenLimiter) startDelay(key string) bool {
+	tl.delayMutex.Lock()
+	defer tl.delayMutex.Unlock()
+
+	if tl.delayed[key] >= tl.maxDelayed {
+		return false
+	}
+	tl.delayed[key]++
+	return true
+}
+
+func (tl *TokenLimiter) endDelay(key string) {
+	tl.delayMutex.Lock()
+	defer tl.delayMutex.Unlock()
+
+	tl.delayed[key]--
+	if tl.delayed[key] == 0 {
+		delete(tl.delayed, key)
 	}
+}
+
+func setUsageHeaders(h http.Header, usage *Usage) {
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(usage.Limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(usage.Remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(usage.Reset), 10))
+}
+
+// ceilSeconds rounds the duration up to the second so that clients do not come back too early
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// UpdateRates replaces the default rates at runtime. The buckets of every source are updated
+// the next time it makes a request, keeping the tokens they have up to the new burst.
+func (tl *TokenLimiter) UpdateRates(rates *RateSet) error {
+	if rates == nil || len(rates.m) == 0 {
+		return fmt.Errorf("provide default rates")
+	}
+	tl.configMutex.Lock()
+	defer tl.configMutex.Unlock()
+	tl.defaultRates = rates
 	return nil
 }
 
+// SetRateExtractor replaces the rate extractor at runtime, nil restores the default rates
+func (tl *TokenLimiter) SetRateExtractor(e RateExtractor) {
+	tl.configMutex.Lock()
+	defer tl.configMutex.Unlock()
+	tl.extractRates = e
+}
+
+// SetRules replaces the rules at runtime, nil removes them
+func (tl *TokenLimiter) SetRules(rs *RuleSet) {
+	tl.configMutex.Lock()
+	defer tl.configMutex.Unlock()
+	tl.rules = rs
+}
+
+// config returns the current rates configuration
+func (tl *TokenLimiter) config() (*RateSet, RateExtractor, *RuleSet) {
+	tl.configMutex.RLock()
+	defer tl.configMutex.RUnlock()
+	return tl.defaultRates, tl.extractRates, tl.rules
+}
+
+func (tl *TokenLimiter) matchRule(req *http.Request) *rule {
+	_, _, rules := tl.config()
+	if rules == nil {
+		return nil
+	}
+	return rules.match(req)
+}
+
 // effectiveRates retrieves rates to be applied to the request.
 func (tl *TokenLimiter) resolveRates(req *http.Request) *RateSet {
+	defaultRates, extractRates, _ := tl.config()
+
 	// If configuration mapper is not specified for this instance, then return
 	// the default bucket specs.
-	if tl.extractRates == nil {
-		return tl.defaultRates
+	if extractRates == nil {
+		return defaultRates
 	}
 
-	rates, err := tl.extractRates.Extract(req)
+	rates, err := extractRates.Extract(req)
 	if err != nil {
-		tl.log.Errorf("Failed to retrieve rates: %v", err)
-		return tl.defaultRates
+		utils.RequestLogger(req, tl.logger).Errorf("Failed to retrieve rates: %v", err)
+		return defaultRates
 	}
 
 	// If the returned rate set is empty then used the default one.
-	if len(rates.m) == 0 {
-		return tl.defaultRates
+	if rates == nil || len(rates.m) == 0 {
+		return defaultRates
 	}
 
 	return rates
@@ -200,7 +384,7 @@ type RateErrHandler struct{}
 
 func (e *RateErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
 	if rerr, ok := err.(*MaxRateError); ok {
-		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", rerr.delay.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(rerr.delay), 10))
 		w.Header().Set("X-Retry-In", rerr.delay.String())
 		w.WriteHeader(http.StatusTooManyRequests)
 		w.Write([]byte(err.Error()))
@@ -236,7 +420,43 @@ func Clock(clock timetools.TimeProvider) TokenLimiterOption {
 	}
 }
 
-// Capacity sets the capacity
+// RateLimitHeaders makes the token limiter set the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+// headers on every response, describing the token bucket of the source with the fewest remaining tokens.
+// X-RateLimit-Reset is the number of seconds until the bucket is full again.
+func RateLimitHeaders() TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.headers = true
+		return nil
+	}
+}
+
+// Delay makes the token limiter delay the requests over the rate until the tokens they need are available, for up
+// to maxWait, instead of rejecting them right away. It smooths the bursts of the clients while the floods are still
+// rejected: the requests that would wait longer than maxWait, or that find maxDelayed requests of their source
+// delayed already on the same buckets, are rejected as usual. The sources are counted per rule.
+func Delay(maxWait time.Duration, maxDelayed int) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		if maxWait <= 0 {
+			return fmt.Errorf("max wait should be > 0, got %v", maxWait)
+		}
+		if maxDelayed < 1 {
+			return fmt.Errorf("max delayed requests should be >= 1, got %d", maxDelayed)
+		}
+		cl.maxWait = maxWait
+		cl.maxDelayed = maxDelayed
+		return nil
+	}
+}
+
+// Storage sets the store keeping the token buckets, they are kept in memory by default
+func Storage(s Store) TokenLimiterOption {
+	return func(cl *TokenLimiter) error {
+		cl.store = s
+		return nil
+	}
+}
+
+// Capacity sets the capacity of the in memory store
 func Capacity(cap int) TokenLimiterOption {
 	return func(cl *TokenLimiter) error {
 		if cap <= 0 {
@@ -4,13 +4,15 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/testutils"
-	"github.com/vulcand/oxy/utils"
 )
 
 func TestRateSetAdd(t *testing.T) {
@@ -67,6 +69,51 @@ func TestHitLimit(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 }
 
+func TestRateLimitHeaders(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 2, 2))
+	require.NoError(t, rates.Add(time.Minute, 100, 100))
+
+	clock := testutils.GetClock()
+
+	l, err := New(handler, headerLimit, rates, Clock(clock), RateLimitHeaders())
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "2", re.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", re.Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1", re.Header.Get("X-RateLimit-Reset"))
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "0", re.Header.Get("X-RateLimit-Remaining"))
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, "2", re.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", re.Header.Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1", re.Header.Get("Retry-After"))
+}
+
+func TestRetryAfterRoundsUp(t *testing.T) {
+	w := httptest.NewRecorder()
+	defaultErrHandler.ServeHTTP(w, nil, &MaxRateError{delay: 500 * time.Millisecond})
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
 // We've failed to extract client ip
 func TestFailure(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -123,6 +170,38 @@ func TestIsolation(t *testing.T) {
 	assert.Equal(t, http.StatusOK, re.StatusCode)
 }
 
+func TestOccupancy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	for _, a := range []Algorithm{TokenBucket, SlidingWindow, LeakyBucket} {
+		l, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()), Capacity(10), LimitAlgorithm(a))
+		require.NoError(t, err)
+
+		for _, source := range []string{"a", "b", "a"} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Source", source)
+			l.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		o, ok := l.Occupancy()
+		require.True(t, ok, a.String())
+		assert.Equal(t, Occupancy{Sources: 2, Capacity: 10}, o, a.String())
+	}
+
+	store, err := NewRedisStore(&fakeRedis{}, "oxy:")
+	require.NoError(t, err)
+	l, err := New(handler, headerLimit, rates, Storage(store))
+	require.NoError(t, err)
+
+	_, ok := l.Occupancy()
+	assert.False(t, ok)
+}
+
 // Make sure that expiration works (Expiration is triggered after significant amount of time passes)
 func TestExpiration(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -248,6 +327,67 @@ func TestBadRateExtractor(t *testing.T) {
 }
 
 // If configMapper returns empty rates, then the default rate is applied.
+func TestUpdateRates(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	l, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// a new source gets the burst of the new rates
+	assert.Error(t, l.UpdateRates(NewRateSet()))
+	newRates := NewRateSet()
+	require.NoError(t, newRates.Add(time.Second, 3, 3))
+	require.NoError(t, l.UpdateRates(newRates))
+
+	for i := 0; i < 3; i++ {
+		re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// the extractor takes over the default rates
+	l.SetRateExtractor(RateExtractorFunc(func(*http.Request) (*RateSet, error) {
+		rates := NewRateSet()
+		if err := rates.Add(time.Minute, 100, 100); err != nil {
+			return nil, err
+		}
+		return rates, nil
+	}))
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the buckets of rates no longer in use were dropped, the source starts over
+	l.SetRateExtractor(nil)
+	for i := 0; i < 3; i++ {
+		re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+}
+
 func TestExtractorEmpty(t *testing.T) {
 	// Given
 	extractor := func(*http.Request) (*RateSet, error) {
@@ -347,3 +487,306 @@ func faultyExtractor(_ *http.Request) (string, int64, error) {
 
 var headerLimit = utils.ExtractorFunc(headerLimiter)
 var faultyExtract = utils.ExtractorFunc(faultyExtractor)
+
+func TestBucketStatsAndReset(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 2))
+	require.NoError(t, rates.Add(time.Minute, 10, 3))
+
+	apiRates := NewRateSet()
+	require.NoError(t, apiRates.Add(time.Second, 1, 1))
+	rules := NewRuleSet()
+	require.NoError(t, rules.Add("GET", "/api/", apiRates))
+
+	clock := testutils.GetClock()
+
+	l, err := New(handler, headerLimit, rates, Clock(clock), Rules(rules))
+	require.NoError(t, err)
+
+	stats, err := l.BucketStats("a")
+	require.NoError(t, err)
+	assert.Empty(t, stats)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	}
+	re, _, err := testutils.Get(srv.URL+"/api/", testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	stats, err = l.BucketStats("a")
+	require.NoError(t, err)
+	assert.Equal(t, []BucketStats{
+		{Period: time.Second, Limit: 2, Remaining: 0, Reset: 2 * time.Second},
+		{Period: time.Minute, Limit: 3, Remaining: 1, Reset: 12 * time.Second},
+		{Rule: "GET /api/", Period: time.Second, Limit: 1, Remaining: 0, Reset: time.Second},
+	}, stats)
+
+	require.NoError(t, l.ResetBucket("a"))
+
+	stats, err = l.BucketStats("a")
+	require.NoError(t, err)
+	for _, s := range stats {
+		assert.Equal(t, s.Limit, s.Remaining)
+		assert.Equal(t, time.Duration(0), s.Reset)
+	}
+
+	re, _, err = testutils.Get(srv.URL+"/api/", testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the other sources are left as is
+	require.NoError(t, l.ResetBucket("b"))
+	stats, err = l.BucketStats("b")
+	require.NoError(t, err)
+	assert.Empty(t, stats)
+}
+
+func TestBucketStatsAndResetAlgorithms(t *testing.T) {
+	for _, algorithm := range []Algorithm{SlidingWindow, LeakyBucket} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("hello"))
+			})
+
+			rates := NewRateSet()
+			require.NoError(t, rates.Add(time.Second, 1, 1))
+
+			clock := testutils.GetClock()
+
+			l, err := New(handler, headerLimit, rates, Clock(clock), LimitAlgorithm(algorithm))
+			require.NoError(t, err)
+
+			srv := httptest.NewServer(l)
+			defer srv.Close()
+
+			testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+			stats, err := l.BucketStats("a")
+			require.NoError(t, err)
+			require.Len(t, stats, 1)
+			assert.Equal(t, int64(0), stats[0].Remaining)
+
+			require.NoError(t, l.ResetBucket("a"))
+
+			stats, err = l.BucketStats("a")
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), stats[0].Remaining)
+
+			re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, re.StatusCode)
+		})
+	}
+}
+
+func TestBucketStatsUnsupportedStore(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	store, err := NewRedisStore(&fakeRedis{}, "rl:")
+	require.NoError(t, err)
+
+	l, err := New(nil, headerLimit, rates, Storage(store))
+	require.NoError(t, err)
+
+	_, err = l.BucketStats("a")
+	assert.Error(t, err)
+	assert.Error(t, l.ResetBucket("a"))
+}
+
+func TestDelay(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 10, 1))
+
+	clock := testutils.GetClock()
+
+	l, err := New(handler, headerLimit, rates, Clock(clock), Delay(time.Second, 5))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the next request waits for its token instead of being rejected
+	start := clock.UtcNow()
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, 100*time.Millisecond, clock.UtcNow().Sub(start))
+}
+
+func TestDelayMaxWait(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	clock := testutils.GetClock()
+
+	l, err := New(handler, headerLimit, rates, Clock(clock), Delay(100*time.Millisecond, 5))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// the token is available in a second, too late for the request to wait
+	start := clock.UtcNow()
+	re, _, err = testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+	assert.Equal(t, start, clock.UtcNow())
+}
+
+// waitClock is a frozen clock whose waits block until the test releases them
+type waitClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiting chan chan time.Time
+}
+
+func (c *waitClock) UtcNow() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *waitClock) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *waitClock) After(d time.Duration) <-chan time.Time {
+	wait := make(chan time.Time, 1)
+	c.waiting <- wait
+	return wait
+}
+
+func TestDelayMaxDelayed(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 5, 1))
+	rules := NewRuleSet()
+	require.NoError(t, rules.Add("GET", "/api/", rates))
+
+	clock := &waitClock{now: testutils.GetClock().UtcNow(), waiting: make(chan chan time.Time)}
+
+	l, err := New(handler, headerLimit, rates, Clock(clock), Delay(time.Second, 1), Rules(rules))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+
+	type result struct {
+		code int
+		err  error
+	}
+	delay := func(url string) <-chan result {
+		results := make(chan result, 1)
+		go func() {
+			re, _, err := testutils.Get(url, testutils.Header("Source", "a"))
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			results <- result{code: re.StatusCode}
+		}()
+		return results
+	}
+
+	for _, url := range []string{srv.URL, srv.URL + "/api/"} {
+		re, _, err := testutils.Get(url, testutils.Header("Source", "a"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, re.StatusCode)
+	}
+
+	results := delay(srv.URL)
+	wait := <-clock.waiting
+
+	// a source flooding the limiter is rejected once it has enough requests delayed
+	re, _, err := testutils.Get(srv.URL, testutils.Header("Source", "a"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, re.StatusCode)
+
+	// the requests of the other rules are delayed independently
+	apiResults := delay(srv.URL + "/api/")
+	var apiWait chan time.Time
+	select {
+	case apiWait = <-clock.waiting:
+	case r := <-apiResults:
+		clock.Sleep(time.Second)
+		wait <- clock.UtcNow()
+		t.Fatalf("the request of the other rule was not delayed: %+v", r)
+	}
+
+	clock.Sleep(time.Second)
+	wait <- clock.UtcNow()
+	apiWait <- clock.UtcNow()
+
+	for _, results := range []<-chan result{results, apiResults} {
+		r := <-results
+		require.NoError(t, r.err)
+		assert.Equal(t, http.StatusOK, r.code)
+	}
+}
+
+func TestDelayOptions(t *testing.T) {
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	_, err := New(nil, headerLimit, rates, Delay(0, 1))
+	assert.Error(t, err)
+
+	_, err = New(nil, headerLimit, rates, Delay(time.Second, 0))
+	assert.Error(t, err)
+}
+
+func TestStructuredLogger(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	rates := NewRateSet()
+	require.NoError(t, rates.Add(time.Second, 1, 1))
+
+	logger, hook := test.NewNullLogger()
+	l, err := New(handler, headerLimit, rates, Clock(testutils.GetClock()), StructuredLogger(utils.NewLogrusLogger(logger)))
+	require.NoError(t, err)
+
+	req := utils.WithRequestID(httptest.NewRequest(http.MethodGet, "/", nil), "abc")
+	req.Header.Set("Source", "a")
+	for i := 0; i < 2; i++ {
+		l.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the limited request is logged with its ID
+	require.Len(t, hook.Entries, 1)
+	assert.Equal(t, "abc", hook.LastEntry().Data[utils.LogFieldRequestID])
+}
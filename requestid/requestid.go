@@ -0,0 +1,208 @@
+/*
+Package requestid provides http.Handler middleware assigning a unique ID to every request.
+
+The ID of the incoming request is kept if it is valid, a new one is generated otherwise. The ID is stored
+in the context of the request, see utils.RequestIDFromRequest, set in the header of the request passed
+to the next handler, hence forwarded to the backends, and set in the header of the response.
+The debug logs of the requests and the trace records carry it, so that they can be correlated.
+
+Examples of a request ID middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte(utils.RequestIDFromRequest(req)))
+	})
+
+	// Assign an X-Request-Id to the requests not carrying one
+	requestid.New(handler)
+*/
+package requestid
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxLength is the maximum length of an incoming request ID, longer IDs are replaced
+const MaxLength = 200
+
+// RequestID assigns an ID to the requests
+type RequestID struct {
+	next           http.Handler
+	header         string
+	generator      func() string
+	ignoreIncoming bool
+
+	log *log.Logger
+}
+
+// New returns a new request ID middleware. New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*RequestID, error) {
+	r := &RequestID{
+		next:      next,
+		header:    utils.RequestIDHeader,
+		generator: NewUUID,
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type optSetter func(r *RequestID) error
+
+// Header sets the header carrying the request ID, defaults to X-Request-Id
+func Header(name string) optSetter {
+	return func(r *RequestID) error {
+		if name == "" {
+			return fmt.Errorf("header name can not be empty")
+		}
+		r.header = http.CanonicalHeaderKey(name)
+		return nil
+	}
+}
+
+// Generator sets the function generating the request IDs, defaults to NewUUID
+func Generator(g func() string) optSetter {
+	return func(r *RequestID) error {
+		if g == nil {
+			return fmt.Errorf("generator can not be nil")
+		}
+		r.generator = g
+		return nil
+	}
+}
+
+// IgnoreIncoming makes the middleware replace the request ID sent by the client,
+// when the clients are not trusted to generate unique IDs
+func IgnoreIncoming() optSetter {
+	return func(r *RequestID) error {
+		r.ignoreIncoming = true
+		return nil
+	}
+}
+
+// Logger defines the logger the request ID middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(r *RequestID) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by request ID handler.
+func (r *RequestID) Wrap(next http.Handler) {
+	r.next = next
+}
+
+func (r *RequestID) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(r.header)
+	if r.ignoreIncoming || !isValid(id) {
+		id = r.generator()
+	}
+
+	newReq := utils.WithRequestID(req, id)
+	// the headers are shared with the original request, work on a copy
+	newReq.Header = make(http.Header)
+	utils.CopyHeaders(newReq.Header, req.Header)
+	newReq.Header.Set(r.header, id)
+
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(newReq))
+		logEntry.Debug("vulcand/oxy/requestid: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/requestid: completed ServeHttp on request")
+	}
+
+	iw := &idWriter{ResponseWriter: w, header: r.header, id: id}
+	r.next.ServeHTTP(iw, newReq)
+
+	// the next handler did not write anything, the response is sent once this handler returns
+	if !iw.headerWritten {
+		w.Header().Set(r.header, id)
+	}
+}
+
+// idWriter sets the request ID in the header of the response once the next handler is done with it,
+// overwriting the ID echoed by a backend
+type idWriter struct {
+	http.ResponseWriter
+	header        string
+	id            string
+	headerWritten bool
+}
+
+func (iw *idWriter) WriteHeader(code int) {
+	if !iw.headerWritten {
+		iw.headerWritten = true
+		iw.ResponseWriter.Header().Set(iw.header, iw.id)
+	}
+	iw.ResponseWriter.WriteHeader(code)
+}
+
+func (iw *idWriter) Write(b []byte) (int, error) {
+	if !iw.headerWritten {
+		iw.WriteHeader(http.StatusOK)
+	}
+	return iw.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client
+func (iw *idWriter) Flush() {
+	if !iw.headerWritten {
+		iw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true) when the client connection has gone away
+func (iw *idWriter) CloseNotify() <-chan bool {
+	if cn, ok := iw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (iw *idWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := iw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", iw.ResponseWriter)
+}
+
+// isValid tells if the incoming ID can be kept, it must be printable ASCII without spaces
+// so that it can not tamper with the logs
+func isValid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewUUID returns a random UUID (version 4)
+func NewUUID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
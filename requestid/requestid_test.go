@@ -0,0 +1,143 @@
+package requestid
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/heebyunglee/oxy/trace"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+var uuidRe = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestGenerated(t *testing.T) {
+	var fromContext, fromHeader string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fromContext = utils.RequestIDFromRequest(req)
+		fromHeader = req.Header.Get("X-Request-Id")
+		w.Write([]byte("hello"))
+	})
+
+	rid, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+
+	assert.Regexp(t, uuidRe, fromContext)
+	assert.Equal(t, fromContext, fromHeader)
+	assert.Equal(t, fromContext, re.Header.Get("X-Request-Id"))
+
+	first := fromContext
+	re, _, err = testutils.Get(srv.URL)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, re.Header.Get("X-Request-Id"))
+}
+
+func TestIncoming(t *testing.T) {
+	var id string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id = utils.RequestIDFromRequest(req)
+	})
+
+	rid, err := New(handler)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header("X-Request-Id", "client-id"))
+	require.NoError(t, err)
+	assert.Equal(t, "client-id", id)
+	assert.Equal(t, "client-id", re.Header.Get("X-Request-Id"))
+
+	// invalid IDs are replaced
+	re, _, err = testutils.Get(srv.URL, testutils.Header("X-Request-Id", strings.Repeat("a", MaxLength+1)))
+	require.NoError(t, err)
+	assert.Regexp(t, uuidRe, id)
+	assert.Equal(t, id, re.Header.Get("X-Request-Id"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "id with spaces")
+	rid.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Regexp(t, uuidRe, id)
+	assert.Equal(t, "id with spaces", req.Header.Get("X-Request-Id"))
+}
+
+func TestIgnoreIncoming(t *testing.T) {
+	var id string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id = utils.RequestIDFromRequest(req)
+	})
+
+	rid, err := New(handler, IgnoreIncoming(), Header("X-Correlation-Id"), Generator(func() string { return "generated" }))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Correlation-Id", "client-id")
+	rw := httptest.NewRecorder()
+	rid.ServeHTTP(rw, req)
+
+	assert.Equal(t, "generated", id)
+	assert.Equal(t, "generated", rw.Header().Get("X-Correlation-Id"))
+	assert.Empty(t, rw.Header().Get("X-Request-Id"))
+}
+
+func TestForwardedAndTraced(t *testing.T) {
+	var forwarded string
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Get("X-Request-Id")
+		// backends echoing the ID do not duplicate it
+		w.Header().Set("X-Request-Id", forwarded)
+		w.Write([]byte("hello"))
+	})
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	records := &bytes.Buffer{}
+	tr, err := trace.New(handler, records, trace.Fields(trace.FieldRequestID))
+	require.NoError(t, err)
+	rid, err := New(tr)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(rid)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL)
+	require.NoError(t, err)
+
+	assert.Regexp(t, uuidRe, forwarded)
+	assert.Equal(t, []string{forwarded}, re.Header["X-Request-Id"])
+
+	var r map[string]interface{}
+	require.NoError(t, json.Unmarshal(records.Bytes(), &r))
+	assert.Equal(t, forwarded, r["request_id"])
+}
+
+func TestOptionsValidation(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), Header(""))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), Generator(nil))
+	assert.Error(t, err)
+}
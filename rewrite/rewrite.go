@@ -0,0 +1,472 @@
+/*
+Package rewrite provides http.Handler middleware rewriting the response bodies on the fly.
+
+The bodies of the responses with an allowed content type are streamed through string or regular expression
+replacements, and the HTML pages can get a <base href> injected in their head. The bodies are not buffered:
+each replacement holds back a window of bytes, the longest match it can find across two writes of the backend.
+The responses encoded with gzip by the backends are decompressed and compressed again, the responses with other
+encodings are left untouched. The rewritten responses lose their Content-Length and are sent chunked.
+
+Examples of a rewriting middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Header().Set("Content-Type", "text/html")
+	  w.Write([]byte(page))
+	})
+
+	// Point the links of the backend to the public host and serve the pages under /app/
+	rw, _ := rewrite.New(handler,
+		rewrite.Replace("http://10.0.0.1:8080/", "https://example.com/app/"),
+		rewrite.BaseHref("/app/"))
+
+	// Mask the card numbers in the JSON responses
+	rw, _ = rewrite.New(handler,
+		rewrite.ReplaceRegexp(`"card":"\d{12}(\d{4})"`, `"card":"************$1"`),
+		rewrite.ContentTypes("application/json"))
+*/
+package rewrite
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultWindow is the default longest match of the replacements, in bytes
+const DefaultWindow = 4096
+
+// DefaultContentTypes are the content types rewritten by default, "text/*" matches all the text types
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+}
+
+// replacement replaces the matches of a regular expression, the template is expanded as in regexp.Expand
+type replacement struct {
+	re       *regexp.Regexp
+	template []byte
+	// max is the number of matches replaced in a body, 0 replaces all of them
+	max int
+	// htmlOnly replacements apply to the text/html responses only
+	htmlOnly bool
+}
+
+// Rewrite rewrites the response bodies of the next handler
+type Rewrite struct {
+	next http.Handler
+
+	contentTypes []string
+	window       int
+	replacements []*replacement
+
+	log *log.Logger
+}
+
+// New returns a new rewriting middleware. New() function supports optional functional arguments
+func New(next http.Handler, setters ...optSetter) (*Rewrite, error) {
+	r := &Rewrite{
+		next:         next,
+		contentTypes: DefaultContentTypes,
+		window:       DefaultWindow,
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(r); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.replacements) == 0 {
+		return nil, fmt.Errorf("provide at least one replacement")
+	}
+	return r, nil
+}
+
+type optSetter func(r *Rewrite) error
+
+// Replace replaces all the occurrences of old with new. The replacements are applied in order.
+func Replace(old, new string) optSetter {
+	return func(r *Rewrite) error {
+		if old == "" {
+			return fmt.Errorf("the replaced string can not be empty")
+		}
+		r.replacements = append(r.replacements, &replacement{
+			re:       regexp.MustCompile(regexp.QuoteMeta(old)),
+			template: []byte(strings.Replace(new, "$", "$$", -1)),
+		})
+		return nil
+	}
+}
+
+// ReplaceRegexp replaces all the matches of the regular expression with the template, where $1 or ${name}
+// stand for the submatches as in regexp.Expand. The replacements are applied in order.
+// The anchors and word boundaries may match at the edges of the window.
+func ReplaceRegexp(expr, template string) optSetter {
+	return func(r *Rewrite) error {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		r.replacements = append(r.replacements, &replacement{re: re, template: []byte(template)})
+		return nil
+	}
+}
+
+// headRegexp matches the opening head tag of the HTML pages
+var headRegexp = regexp.MustCompile(`(?i)<head(?:\s[^>]*)?>`)
+
+// BaseHref injects <base href="href"> at the beginning of the head of the text/html responses, so that their
+// relative links resolve against href, e.g. the prefix the application is served under.
+func BaseHref(href string) optSetter {
+	return func(r *Rewrite) error {
+		if href == "" {
+			return fmt.Errorf("base href can not be empty")
+		}
+		tag := fmt.Sprintf(`<base href="%s">`, html.EscapeString(href))
+		r.replacements = append(r.replacements, &replacement{
+			re:       headRegexp,
+			template: []byte("$0" + strings.Replace(tag, "$", "$$", -1)),
+			max:      1,
+			htmlOnly: true,
+		})
+		return nil
+	}
+}
+
+// ContentTypes sets the media types of the rewritten responses, "text/*" matches all the text types.
+// Defaults to DefaultContentTypes
+func ContentTypes(types ...string) optSetter {
+	return func(r *Rewrite) error {
+		if len(types) == 0 {
+			return fmt.Errorf("provide at least one content type")
+		}
+		r.contentTypes = make([]string, len(types))
+		for i, t := range types {
+			r.contentTypes[i] = strings.ToLower(t)
+		}
+		return nil
+	}
+}
+
+// Window sets the longest match of the replacements, in bytes, defaults to DefaultWindow.
+// The longer matches are missed when they span two writes of the backend.
+func Window(bytes int) optSetter {
+	return func(r *Rewrite) error {
+		if bytes <= 0 {
+			return fmt.Errorf("window should be > 0 got %d", bytes)
+		}
+		r.window = bytes
+		return nil
+	}
+}
+
+// Logger defines the logger the rewriting middleware will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(r *Rewrite) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by rewriting handler.
+func (r *Rewrite) Wrap(next http.Handler) {
+	r.next = next
+}
+
+func (r *Rewrite) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/rewrite: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/rewrite: completed ServeHttp on request")
+	}
+
+	if req.Method == http.MethodHead {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+
+	rw := &rewriteWriter{ResponseWriter: w, r: r}
+	defer rw.close()
+	r.next.ServeHTTP(rw, req)
+}
+
+// mediaType returns the media type of the content type if it is rewritten, an empty string otherwise
+func (r *Rewrite) mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	for _, t := range r.contentTypes {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// rewriteWriter sends the header once the first bytes of the body tell the content type, if it is missing,
+// and streams the body through the replacements if the response qualifies
+type rewriteWriter struct {
+	http.ResponseWriter
+	r *Rewrite
+
+	code      int
+	headerSet bool
+	decided   bool
+
+	body     io.Writer
+	stages   []*replacer
+	gzip     *gzip.Writer
+	pipe     *io.PipeWriter
+	pipeDone chan struct{}
+	// mtx guards the writes of the decompressing goroutine against the flushes
+	mtx sync.Mutex
+}
+
+func (rw *rewriteWriter) WriteHeader(code int) {
+	if rw.headerSet {
+		return
+	}
+	// informational responses are sent as they are, the final response follows
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		rw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	rw.headerSet = true
+	rw.code = code
+	if rw.Header().Get("Content-Type") != "" {
+		rw.decide(nil)
+	}
+}
+
+func (rw *rewriteWriter) Write(b []byte) (int, error) {
+	if !rw.headerSet {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.decided {
+		rw.decide(b)
+	}
+	if rw.body == nil {
+		return rw.ResponseWriter.Write(b)
+	}
+	if _, err := rw.body.Write(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// decide sends the header, setting up the rewriting of the body if the response qualifies
+func (rw *rewriteWriter) decide(first []byte) {
+	rw.decided = true
+	h := rw.Header()
+
+	if h.Get("Content-Type") == "" && len(first) > 0 && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Type", http.DetectContentType(first))
+	}
+	mediaType := rw.r.mediaType(h.Get("Content-Type"))
+	encoding := strings.ToLower(h.Get("Content-Encoding"))
+
+	var stages []*replacer
+	if mediaType != "" && rw.code != http.StatusNoContent && rw.code != http.StatusNotModified &&
+		rw.code != http.StatusPartialContent && (encoding == "" || encoding == "gzip") {
+		for _, rep := range rw.r.replacements {
+			if !rep.htmlOnly || mediaType == "text/html" {
+				stages = append(stages, &replacer{replacement: rep, window: rw.r.window})
+			}
+		}
+	}
+	if len(stages) == 0 {
+		rw.ResponseWriter.WriteHeader(rw.code)
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Del("Content-Md5")
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+	rw.ResponseWriter.WriteHeader(rw.code)
+
+	var out io.Writer = rw.ResponseWriter
+	if encoding == "gzip" {
+		rw.gzip = gzip.NewWriter(out)
+		out = rw.gzip
+	}
+	for i := len(stages) - 1; i >= 0; i-- {
+		stages[i].next = out
+		out = stages[i]
+	}
+	rw.stages = stages
+	rw.body = out
+
+	if encoding == "gzip" {
+		pr, pw := io.Pipe()
+		rw.pipe = pw
+		rw.pipeDone = make(chan struct{})
+		rw.body = pw
+		go rw.gunzip(pr, &lockedWriter{mtx: &rw.mtx, w: out})
+	}
+}
+
+// gunzip decompresses the body written to the pipe into the replacements
+func (rw *rewriteWriter) gunzip(pr *io.PipeReader, out io.Writer) {
+	defer close(rw.pipeDone)
+
+	zr, err := gzip.NewReader(pr)
+	if err == nil {
+		_, err = io.Copy(out, zr)
+	}
+	if err != nil {
+		rw.r.log.Errorf("vulcand/oxy/rewrite: failed to decompress the gzip response, err: %v", err)
+		pr.CloseWithError(err)
+		return
+	}
+	// drain the rest of the body, e.g. the trailing garbage
+	io.Copy(ioutil.Discard, pr)
+}
+
+// close sends the bytes held back by the replacements and terminates the gzip stream
+func (rw *rewriteWriter) close() {
+	if !rw.headerSet {
+		return
+	}
+	if !rw.decided {
+		rw.decide(nil)
+	}
+	if rw.pipe != nil {
+		rw.pipe.Close()
+		<-rw.pipeDone
+	}
+	for _, s := range rw.stages {
+		if err := s.flush(true); err != nil {
+			rw.r.log.Errorf("vulcand/oxy/rewrite: failed to write the response, err: %v", err)
+			break
+		}
+	}
+	if rw.gzip != nil {
+		if err := rw.gzip.Close(); err != nil {
+			rw.r.log.Errorf("vulcand/oxy/rewrite: failed to close gzip writer, err: %v", err)
+		}
+	}
+}
+
+// Flush sends any buffered data to the client, except the bytes held back by the replacements
+func (rw *rewriteWriter) Flush() {
+	if !rw.headerSet {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if !rw.decided {
+		rw.decide(nil)
+	}
+	rw.mtx.Lock()
+	defer rw.mtx.Unlock()
+	if rw.gzip != nil {
+		rw.gzip.Flush()
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true) when the client connection has gone away
+func (rw *rewriteWriter) CloseNotify() <-chan bool {
+	if cn, ok := rw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (rw *rewriteWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", rw.ResponseWriter)
+}
+
+// lockedWriter serializes the writes with the flushes of the response
+type lockedWriter struct {
+	mtx *sync.Mutex
+	w   io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.w.Write(b)
+}
+
+// replacer applies a replacement to a stream, holding back the last window bytes which may start a match
+type replacer struct {
+	*replacement
+	window int
+	next   io.Writer
+
+	buf   []byte
+	count int
+}
+
+func (r *replacer) Write(b []byte) (int, error) {
+	r.buf = append(r.buf, b...)
+	if len(r.buf) >= 2*r.window {
+		if err := r.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// flush replaces the matches starting before the window held back and writes the bytes up to the window,
+// or all of them at the end of the body
+func (r *replacer) flush(final bool) error {
+	limit := len(r.buf)
+	if !final {
+		limit -= r.window
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	var out []byte
+	pos := 0
+	for _, m := range r.re.FindAllSubmatchIndex(r.buf, -1) {
+		if m[0] >= limit {
+			break
+		}
+		if r.max > 0 && r.count >= r.max {
+			break
+		}
+		out = append(out, r.buf[pos:m[0]]...)
+		out = r.re.Expand(out, r.template, r.buf, m)
+		pos = m[1]
+		r.count++
+	}
+	end := limit
+	if pos > end {
+		end = pos
+	}
+	out = append(out, r.buf[pos:end]...)
+	r.buf = append(r.buf[:0], r.buf[end:]...)
+
+	_, err := r.next.Write(out)
+	return err
+}
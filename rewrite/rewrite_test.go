@@ -0,0 +1,204 @@
+package rewrite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkedHandler writes the body in chunks of the given size
+func chunkedHandler(contentType, body string, size int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Header().Set("Content-Length", "1000")
+		w.Header().Set("Etag", `"v1"`)
+		for len(body) > 0 {
+			n := size
+			if n > len(body) {
+				n = len(body)
+			}
+			w.Write([]byte(body[:n]))
+			body = body[n:]
+		}
+	})
+}
+
+func serve(t *testing.T, h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestReplace(t *testing.T) {
+	body := strings.Repeat("see http://backend:8080/a and $1 ", 10)
+	for _, size := range []int{1, 3, 7, 1000} {
+		rw, err := New(chunkedHandler("text/html", body, size),
+			Replace("http://backend:8080/", "https://example.com/$1"),
+			Window(32))
+		require.NoError(t, err)
+
+		re := serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusOK, re.Code)
+		assert.Equal(t, strings.Replace(body, "http://backend:8080/", "https://example.com/$1", -1), re.Body.String(), "chunk size %d", size)
+		assert.Equal(t, "", re.Header().Get("Content-Length"))
+		assert.Equal(t, `W/"v1"`, re.Header().Get("Etag"))
+	}
+}
+
+func TestReplaceRegexp(t *testing.T) {
+	body := `[{"card":"4111111111111111"},{"card":"5500000000000004"}]`
+	for _, size := range []int{1, 5, 1000} {
+		rw, err := New(chunkedHandler("application/json", body, size),
+			ReplaceRegexp(`"card":"\d{12}(\d{4})"`, `"card":"************$1"`),
+			Window(64))
+		require.NoError(t, err)
+
+		re := serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, `[{"card":"************1111"},{"card":"************0004"}]`, re.Body.String(), "chunk size %d", size)
+	}
+}
+
+func TestChainedReplacements(t *testing.T) {
+	rw, err := New(chunkedHandler("text/plain", "a b c", 1), Replace("a", "b"), Replace("b", "c"))
+	require.NoError(t, err)
+
+	re := serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "c c c", re.Body.String())
+}
+
+func TestBaseHref(t *testing.T) {
+	page := `<html><HEAD lang="en"><title>t</title></HEAD><body><head></head></body></html>`
+	rw, err := New(chunkedHandler("text/html; charset=utf-8", page, 4), BaseHref(`/app/"x"`))
+	require.NoError(t, err)
+
+	re := serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, `<html><HEAD lang="en"><base href="/app/&#34;x&#34;"><title>t</title></HEAD><body><head></head></body></html>`, re.Body.String())
+
+	// the base is injected in the HTML pages only
+	rw, err = New(chunkedHandler("text/plain", page, 4), BaseHref("/app/"))
+	require.NoError(t, err)
+
+	re = serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, page, re.Body.String())
+	assert.Equal(t, "1000", re.Header().Get("Content-Length"))
+}
+
+func TestContentTypes(t *testing.T) {
+	rw, err := New(chunkedHandler("image/png", "aaa", 1), Replace("a", "b"))
+	require.NoError(t, err)
+
+	re := serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "aaa", re.Body.String())
+	assert.Equal(t, "1000", re.Header().Get("Content-Length"))
+
+	// the missing content type is sniffed
+	rw, err = New(chunkedHandler("", "<html><body>aaa</body></html>", 1000), Replace("aaa", "bbb"))
+	require.NoError(t, err)
+
+	re = serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "<html><body>bbb</body></html>", re.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", re.Header().Get("Content-Type"))
+
+	rw, err = New(chunkedHandler("application/json", "aaa", 1), Replace("a", "b"), ContentTypes("text/html"))
+	require.NoError(t, err)
+
+	re = serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "aaa", re.Body.String())
+}
+
+func TestGzip(t *testing.T) {
+	body := strings.Repeat("see http://backend:8080/ ", 1000)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		data := compressed.Bytes()
+		for len(data) > 0 {
+			n := 100
+			if n > len(data) {
+				n = len(data)
+			}
+			w.Write(data[:n])
+			data = data[n:]
+		}
+	})
+	rw, err := New(handler, Replace("http://backend:8080/", "https://example.com/"))
+	require.NoError(t, err)
+
+	re := serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "gzip", re.Header().Get("Content-Encoding"))
+
+	zr, err := gzip.NewReader(re.Body)
+	require.NoError(t, err)
+	decompressed, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Replace(body, "http://backend:8080/", "https://example.com/", -1), string(decompressed))
+}
+
+func TestUntouchedResponses(t *testing.T) {
+	rw, err := New(chunkedHandler("text/html", "aaa", 1), Replace("a", "b"))
+	require.NoError(t, err)
+
+	re := serve(t, rw, httptest.NewRequest(http.MethodHead, "/", nil))
+	assert.Equal(t, "1000", re.Header().Get("Content-Length"))
+
+	// other encodings
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("aaa"))
+	})
+	rw, err = New(handler, Replace("a", "b"))
+	require.NoError(t, err)
+
+	re = serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "aaa", re.Body.String())
+
+	// ranges
+	handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("aaa"))
+	})
+	rw, err = New(handler, Replace("a", "b"))
+	require.NoError(t, err)
+
+	re = serve(t, rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusPartialContent, re.Code)
+	assert.Equal(t, "aaa", re.Body.String())
+}
+
+func TestOptionsValidation(t *testing.T) {
+	handler := chunkedHandler("text/html", "", 1)
+
+	_, err := New(handler)
+	assert.Error(t, err)
+
+	_, err = New(handler, Replace("", "a"))
+	assert.Error(t, err)
+
+	_, err = New(handler, ReplaceRegexp("(", "a"))
+	assert.Error(t, err)
+
+	_, err = New(handler, BaseHref(""))
+	assert.Error(t, err)
+
+	_, err = New(handler, Replace("a", "b"), Window(0))
+	assert.Error(t, err)
+
+	_, err = New(handler, Replace("a", "b"), ContentTypes())
+	assert.Error(t, err)
+}
@@ -0,0 +1,291 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultReplicas = 100
+
+// ConsistentHashOption provides options for the consistent hash load balancer
+type ConsistentHashOption func(*ConsistentHash) error
+
+// ConsistentHashErrorHandler is a functional argument that sets error handler of the server
+func ConsistentHashErrorHandler(h utils.ErrorHandler) ConsistentHashOption {
+	return func(c *ConsistentHash) error {
+		c.errHandler = h
+		return nil
+	}
+}
+
+// ConsistentHashReplicas sets the number of virtual nodes placed on the ring per unit of server weight,
+// more replicas spread the keys more evenly at the cost of memory
+func ConsistentHashReplicas(replicas int) ConsistentHashOption {
+	return func(c *ConsistentHash) error {
+		if replicas <= 0 {
+			return fmt.Errorf("replicas should be > 0")
+		}
+		c.replicas = replicas
+		return nil
+	}
+}
+
+// ConsistentHashRequestRewriteListener is a functional argument that sets a request rewrite listener
+func ConsistentHashRequestRewriteListener(rrl RequestRewriteListener) ConsistentHashOption {
+	return func(c *ConsistentHash) error {
+		c.requestRewriteListener = rrl
+		return nil
+	}
+}
+
+// ConsistentHashLogger defines the logger the consistent hash load balancer will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func ConsistentHashLogger(l *log.Logger) ConsistentHashOption {
+	return func(c *ConsistentHash) error {
+		c.log = l
+		return nil
+	}
+}
+
+// ConsistentHash implements a load balancer http handler picking the server from a hash ring
+// with virtual nodes, keyed on an attribute of the request such as the client IP, a header, a cookie
+// or the URL path (see utils.NewExtractor). Requests with the same key go to the same server,
+// and only the keys of the added or removed servers move when the pool changes.
+type ConsistentHash struct {
+	mutex                  *sync.Mutex
+	next                   http.Handler
+	errHandler             utils.ErrorHandler
+	extractor              utils.SourceExtractor
+	replicas               int
+	servers                []*server
+	ring                   []ringNode
+	requestRewriteListener RequestRewriteListener
+	inflight               utils.Inflight
+
+	log *log.Logger
+}
+
+// ringNode is a virtual node of a server on the hash ring
+type ringNode struct {
+	hash uint32
+	srv  *server
+}
+
+// NewConsistentHash creates a new ConsistentHash, extractor provides the key of the requests
+func NewConsistentHash(next http.Handler, extractor utils.SourceExtractor, opts ...ConsistentHashOption) (*ConsistentHash, error) {
+	if extractor == nil {
+		return nil, fmt.Errorf("key extractor can't be nil")
+	}
+	c := &ConsistentHash{
+		next:      next,
+		extractor: extractor,
+		replicas:  defaultReplicas,
+		mutex:     &sync.Mutex{},
+		servers:   []*server{},
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	if c.errHandler == nil {
+		c.errHandler = utils.DefaultHandler
+	}
+	return c, nil
+}
+
+// Next returns the next handler
+func (c *ConsistentHash) Next() http.Handler {
+	return c.next
+}
+
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete. It returns the error of the context if it is done first.
+func (c *ConsistentHash) Shutdown(ctx context.Context) error {
+	return c.inflight.Shutdown(ctx)
+}
+
+func (c *ConsistentHash) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !c.inflight.Acquire() {
+		c.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer c.inflight.Release()
+
+	if c.log.Level >= log.DebugLevel {
+		logEntry := c.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/roundrobin/consistenthash: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/roundrobin/consistenthash: completed ServeHttp on request")
+	}
+
+	key, _, err := c.extractor.Extract(req)
+	if err != nil {
+		c.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	fwdURL, err := c.ServerForKey(key)
+	if err != nil {
+		c.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.URL = fwdURL
+
+	if c.log.Level >= log.DebugLevel {
+		// log which backend URL we're sending this request to
+		c.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/consistenthash: Forwarding this request to URL")
+	}
+
+	// Emit event to a listener if one exists
+	if c.requestRewriteListener != nil {
+		c.requestRewriteListener(req, &newReq)
+	}
+
+	c.next.ServeHTTP(w, &newReq)
+}
+
+// NextServer gets the server owning the empty key, as there is no request to extract a key from
+func (c *ConsistentHash) NextServer() (*url.URL, error) {
+	return c.ServerForKey("")
+}
+
+// ServerForKey gets the server the requests with the given key are sent to
+func (c *ConsistentHash) ServerForKey(key string) (*url.URL, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.servers) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+	if len(c.ring) == 0 {
+		return nil, fmt.Errorf("all servers have 0 weight")
+	}
+
+	return utils.CopyURL(ringServer(c.ring, key).url), nil
+}
+
+// RemoveServer remove a server
+func (c *ConsistentHash) RemoveServer(u *url.URL) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, index := c.findServerByURL(u)
+	if e == nil {
+		return fmt.Errorf("server not found")
+	}
+	c.servers = append(c.servers[:index], c.servers[index+1:]...)
+	c.buildRing()
+	return nil
+}
+
+// Servers gets servers URL
+func (c *ConsistentHash) Servers() []*url.URL {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	out := make([]*url.URL, len(c.servers))
+	for i, srv := range c.servers {
+		out[i] = srv.url
+	}
+	return out
+}
+
+// ServerWeight gets the server weight
+func (c *ConsistentHash) ServerWeight(u *url.URL) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if s, _ := c.findServerByURL(u); s != nil {
+		return s.weight, true
+	}
+	return -1, false
+}
+
+// UpsertServer adds a server or updates its options if it is already present in the load balancer
+func (c *ConsistentHash) UpsertServer(u *url.URL, options ...ServerOption) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if u == nil {
+		return fmt.Errorf("server URL can't be nil")
+	}
+
+	if s, _ := c.findServerByURL(u); s != nil {
+		for _, o := range options {
+			if err := o(s); err != nil {
+				return err
+			}
+		}
+		c.buildRing()
+		return nil
+	}
+
+	srv := &server{url: utils.CopyURL(u)}
+	for _, o := range options {
+		if err := o(srv); err != nil {
+			return err
+		}
+	}
+
+	if srv.weight == 0 {
+		srv.weight = defaultWeight
+	}
+
+	c.servers = append(c.servers, srv)
+	c.buildRing()
+	return nil
+}
+
+// buildRing places weight * replicas virtual nodes per server on the ring
+func (c *ConsistentHash) buildRing() {
+	c.ring = buildRing(c.ring[:0], c.servers, c.replicas)
+}
+
+// buildRing appends weight * replicas virtual nodes per server to the ring and sorts it
+func buildRing(ring []ringNode, servers []*server, replicas int) []ringNode {
+	for _, srv := range servers {
+		name := srv.url.String()
+		for i := 0; i < srv.weight*replicas; i++ {
+			ring = append(ring, ringNode{
+				hash: crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + name)),
+				srv:  srv,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// ringServer returns the server owning the key on a non empty ring
+func ringServer(ring []ringNode, key string) *server {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].srv
+}
+
+func (c *ConsistentHash) findServerByURL(u *url.URL) (*server, int) {
+	for i, s := range c.servers {
+		if sameURL(u, s.url) {
+			return s, i
+		}
+	}
+	return nil, -1
+}
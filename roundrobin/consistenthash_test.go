@@ -0,0 +1,126 @@
+package roundrobin
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func newHeaderConsistentHash(t *testing.T, next http.Handler, opts ...ConsistentHashOption) *ConsistentHash {
+	extractor, err := utils.NewExtractor("request.header.X-User")
+	require.NoError(t, err)
+
+	lb, err := NewConsistentHash(next, extractor, opts...)
+	require.NoError(t, err)
+	return lb
+}
+
+func TestConsistentHashNoServers(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(newHeaderConsistentHash(t, fwd))
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestConsistentHashStableKeys(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb := newHeaderConsistentHash(t, fwd)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		_, first, err := testutils.Get(proxy.URL, testutils.Header("X-User", user))
+		require.NoError(t, err)
+		_, second, err := testutils.Get(proxy.URL, testutils.Header("X-User", user))
+		require.NoError(t, err)
+
+		assert.Equal(t, string(first), string(second))
+		seen[string(first)] = true
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, seen)
+}
+
+func TestConsistentHashMinimalDisruption(t *testing.T) {
+	lb := newHeaderConsistentHash(t, nil)
+
+	servers := []string{"http://a", "http://b", "http://c", "http://d"}
+	for _, s := range servers {
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(s)))
+	}
+
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		u, err := lb.ServerForKey(key)
+		require.NoError(t, err)
+		before[key] = u.String()
+	}
+
+	require.NoError(t, lb.RemoveServer(testutils.ParseURI("http://d")))
+
+	for key, srv := range before {
+		u, err := lb.ServerForKey(key)
+		require.NoError(t, err)
+		if srv != "http://d" {
+			assert.Equal(t, srv, u.String(), "key %s moved", key)
+		} else {
+			assert.NotEqual(t, "http://d", u.String())
+		}
+	}
+}
+
+func TestConsistentHashWeights(t *testing.T) {
+	lb := newHeaderConsistentHash(t, nil)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a"), Weight(3)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b"), Weight(1)))
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		u, err := lb.ServerForKey(fmt.Sprintf("key-%d", i))
+		require.NoError(t, err)
+		counts[u.Host]++
+	}
+	assert.InDelta(t, 3000, counts["a"], 400)
+	assert.InDelta(t, 1000, counts["b"], 400)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a"), Weight(0)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b"), Weight(0)))
+	_, err := lb.ServerForKey("key")
+	assert.Error(t, err)
+}
+
+func TestConsistentHashInvalidOptions(t *testing.T) {
+	_, err := NewConsistentHash(nil, nil)
+	assert.Error(t, err)
+
+	extractor, err := utils.NewExtractor("client.ip")
+	require.NoError(t, err)
+	_, err = NewConsistentHash(nil, extractor, ConsistentHashReplicas(0))
+	assert.Error(t, err)
+}
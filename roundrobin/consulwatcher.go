@@ -0,0 +1,132 @@
+package roundrobin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultConsulWatcherInterval is the default time between two queries of the Consul catalog
+	DefaultConsulWatcherInterval = time.Second
+	// consulWait is the time Consul holds a blocking query when the service does not change
+	consulWait = 5 * time.Minute
+)
+
+// ConsulWatcher watches the passing instances of a Consul service, through blocking queries of the HTTP API.
+// The servers take the address and port of the instances, and their passing weight.
+type ConsulWatcher struct {
+	pollWatcher
+	address string
+	service string
+	opts    *watcherOptions
+	wait    time.Duration
+
+	mtx   sync.Mutex
+	index uint64
+}
+
+// NewConsulWatcher creates a new ConsulWatcher of the service, address is the URL of a Consul agent,
+// e.g. http://127.0.0.1:8500. An ACL token is passed with WatcherHeader("X-Consul-Token", token).
+func NewConsulWatcher(address, service string, opts ...WatcherOption) (*ConsulWatcher, error) {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Consul address %q", address)
+	}
+	if service == "" {
+		return nil, fmt.Errorf("service can not be empty")
+	}
+	o, err := newWatcherOptions(DefaultConsulWatcherInterval, opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &ConsulWatcher{address: strings.TrimSuffix(address, "/"), service: service, opts: o, wait: consulWait}
+	w.pollWatcher = pollWatcher{name: "Consul service " + service, interval: o.interval, fetch: w.read, log: o.log}
+	return w, nil
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func (w *ConsulWatcher) read(ctx context.Context) ([]ServerSpec, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.wait+watcherTimeout)
+	defer cancel()
+
+	w.mtx.Lock()
+	index := w.index
+	w.mtx.Unlock()
+
+	query := url.Values{}
+	query.Set("passing", "1")
+	query.Set("index", strconv.FormatUint(index, 10))
+	query.Set("wait", strconv.Itoa(int(w.wait/time.Second))+"s")
+	req, err := http.NewRequest(http.MethodGet, w.address+"/v1/health/service/"+url.PathEscape(w.service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range w.opts.header {
+		req.Header[name] = values
+	}
+
+	resp, err := w.opts.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul answered %v: %s", resp.Status, data)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	// the index must go forward, it is reset when it does not as Consul advises
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || next < index {
+		next = 0
+	}
+	w.mtx.Lock()
+	w.index = next
+	w.mtx.Unlock()
+
+	list := []ServerSpec{}
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		if host == "" || e.Service.Port == 0 {
+			continue
+		}
+		list = append(list, ServerSpec{
+			URL:    w.opts.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+			Weight: e.Service.Weights.Passing,
+		})
+	}
+	return list, nil
+}
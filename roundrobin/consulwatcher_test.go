@@ -0,0 +1,90 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestConsulWatcher(t *testing.T) {
+	var mu sync.Mutex
+	index := 7
+	body := `[
+		{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8080, "Weights": {"Passing": 2}}},
+		{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "10.1.0.2", "Port": 8081, "Weights": {"Passing": 1}}}
+	]`
+	var indexes []string
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v1/health/service/api", req.URL.Path)
+		assert.Equal(t, "1", req.URL.Query().Get("passing"))
+		assert.Equal(t, "secret", req.Header.Get("X-Consul-Token"))
+
+		mu.Lock()
+		defer mu.Unlock()
+		indexes = append(indexes, req.URL.Query().Get("index"))
+		w.Header().Set("X-Consul-Index", fmt.Sprint(index))
+		w.Write([]byte(body))
+	})
+	defer srv.Close()
+
+	w, err := NewConsulWatcher(srv.URL, "api", WatcherInterval(5*time.Millisecond),
+		WatcherHeader("X-Consul-Token", "secret"), WatcherScheme("https"))
+	require.NoError(t, err)
+
+	lb := newDNSTestLB(t)
+	s, err := NewServerListSync(lb, w)
+	require.NoError(t, err)
+	s.Start()
+	defer s.Stop()
+
+	waitServers(t, lb, "https://10.0.0.1:8080", "https://10.1.0.2:8081")
+	weight, _ := lb.ServerWeight(testutils.ParseURI("https://10.0.0.1:8080"))
+	assert.Equal(t, 2, weight)
+
+	mu.Lock()
+	index = 8
+	body = `[{"Node": {"Address": "10.0.0.3"}, "Service": {"Port": 8080, "Weights": {"Passing": 1}}}]`
+	mu.Unlock()
+	waitServers(t, lb, "https://10.0.0.3:8080")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "0", indexes[0])
+	assert.Contains(t, indexes, "7")
+}
+
+func TestConsulWatcherResetsIndex(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Consul-Index", "3")
+		w.Write([]byte(`[]`))
+	})
+	defer srv.Close()
+
+	w, err := NewConsulWatcher(srv.URL, "api")
+	require.NoError(t, err)
+	w.index = 10
+
+	list, err := w.read(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	assert.Equal(t, uint64(0), w.index)
+}
+
+func TestConsulWatcherOptions(t *testing.T) {
+	_, err := NewConsulWatcher("", "api")
+	assert.Error(t, err)
+
+	_, err = NewConsulWatcher("http://127.0.0.1:8500", "")
+	assert.Error(t, err)
+
+	_, err = NewConsulWatcher("http://127.0.0.1:8500", "api", WatcherScheme("ftp"))
+	assert.Error(t, err)
+}
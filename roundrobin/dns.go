@@ -0,0 +1,303 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerUpdater adds and removes the servers of a load balancer, e.g. a RoundRobin, a Rebalancer or a HealthChecker
+type ServerUpdater interface {
+	UpsertServer(u *url.URL, options ...ServerOption) error
+	RemoveServer(u *url.URL) error
+}
+
+// DNSLookuper resolves the DNS records, *net.Resolver implements it
+type DNSLookuper interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSOption provides options for the DNS resolver
+type DNSOption func(*DNSResolver) error
+
+// DNSPort sets the port of the servers resolved from A and AAAA records, defaults to the port of the scheme
+func DNSPort(port int) DNSOption {
+	return func(d *DNSResolver) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		d.port = port
+		return nil
+	}
+}
+
+// DNSScheme sets the scheme of the URLs of the servers, defaults to http
+func DNSScheme(scheme string) DNSOption {
+	return func(d *DNSResolver) error {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme %q", scheme)
+		}
+		d.scheme = scheme
+		return nil
+	}
+}
+
+// DNSSRV resolves the SRV records of the service instead of the A and AAAA records of the name,
+// e.g. DNSSRV("http", "tcp") for _http._tcp.<name>. The servers take the port and the weight of the records,
+// only the records with the lowest priority are used.
+func DNSSRV(service, proto string) DNSOption {
+	return func(d *DNSResolver) error {
+		d.srv = true
+		d.service = service
+		d.proto = proto
+		return nil
+	}
+}
+
+// DNSRefreshInterval sets the time between two resolutions, defaults to 30 seconds
+func DNSRefreshInterval(interval time.Duration) DNSOption {
+	return func(d *DNSResolver) error {
+		if interval <= 0 {
+			return fmt.Errorf("refresh interval should be > 0")
+		}
+		d.interval = interval
+		return nil
+	}
+}
+
+// DNSJitter adds a random delay up to jitter to every refresh interval, so that many proxies
+// do not query the DNS servers at the same time. Defaults to 0.
+func DNSJitter(jitter time.Duration) DNSOption {
+	return func(d *DNSResolver) error {
+		if jitter < 0 {
+			return fmt.Errorf("jitter can not be negative")
+		}
+		d.jitter = jitter
+		return nil
+	}
+}
+
+// DNSTimeout sets the timeout of a resolution, defaults to 5 seconds
+func DNSTimeout(timeout time.Duration) DNSOption {
+	return func(d *DNSResolver) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout should be > 0")
+		}
+		d.timeout = timeout
+		return nil
+	}
+}
+
+// DNSServerOptions sets the options of the servers added to the load balancer
+func DNSServerOptions(options ...ServerOption) DNSOption {
+	return func(d *DNSResolver) error {
+		d.options = options
+		return nil
+	}
+}
+
+// DNSLookup sets the resolver of the records, defaults to net.DefaultResolver
+func DNSLookup(l DNSLookuper) DNSOption {
+	return func(d *DNSResolver) error {
+		if l == nil {
+			return fmt.Errorf("lookuper can not be nil")
+		}
+		d.lookup = l
+		return nil
+	}
+}
+
+// DNSLogger defines the logger the DNS resolver will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func DNSLogger(l *log.Logger) DNSOption {
+	return func(d *DNSResolver) error {
+		d.log = l
+		return nil
+	}
+}
+
+// DNSResolver periodically resolves a DNS name and keeps the servers of a load balancer in sync with its records,
+// e.g. the pods of a Kubernetes headless service. Only the servers it added are removed when the records change,
+// and the servers are kept when the resolution fails.
+type DNSResolver struct {
+	mtx  *sync.Mutex
+	lb   ServerUpdater
+	name string
+
+	scheme   string
+	port     int
+	srv      bool
+	service  string
+	proto    string
+	interval time.Duration
+	jitter   time.Duration
+	timeout  time.Duration
+	options  []ServerOption
+	lookup   DNSLookuper
+
+	// servers added to the load balancer by their URL, with the weight of their SRV record
+	servers map[string]resolvedServer
+	stop    chan struct{}
+	done    chan struct{}
+
+	log *log.Logger
+}
+
+type resolvedServer struct {
+	url    *url.URL
+	weight int
+}
+
+// NewDNSResolver creates a new DNSResolver of the name for the load balancer, call Start to begin resolving it
+func NewDNSResolver(lb ServerUpdater, name string, opts ...DNSOption) (*DNSResolver, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name can not be empty")
+	}
+	d := &DNSResolver{
+		mtx:      &sync.Mutex{},
+		lb:       lb,
+		name:     name,
+		scheme:   "http",
+		interval: 30 * time.Second,
+		timeout:  5 * time.Second,
+		lookup:   net.DefaultResolver,
+		servers:  make(map[string]resolvedServer),
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(d); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Servers returns the servers resolved the last time
+func (d *DNSResolver) Servers() []*url.URL {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return sortedServers(d.servers)
+}
+
+// Start resolves the name at once, then every refresh interval until Stop is called
+func (d *DNSResolver) Start() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.stop != nil {
+		return
+	}
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	go d.run(d.stop, d.done)
+}
+
+// Stop stops resolving the name, the load balancer is left as is
+func (d *DNSResolver) Stop() {
+	d.mtx.Lock()
+	stop, done := d.stop, d.done
+	d.stop, d.done = nil, nil
+	d.mtx.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (d *DNSResolver) run(stop, done chan struct{}) {
+	defer close(done)
+
+	for {
+		if err := d.Refresh(); err != nil {
+			d.log.Warnf("vulcand/oxy/roundrobin/dns: failed to resolve %v, keeping the servers: %v", d.name, err)
+		}
+
+		wait := d.interval
+		if d.jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(d.jitter)))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Refresh resolves the name once and updates the load balancer with the changes
+func (d *DNSResolver) Refresh() error {
+	resolved, err := d.resolve()
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	syncServers(d.lb, d.servers, resolved, d.options, d.log)
+	return nil
+}
+
+// resolve returns the servers of the records by their URL
+func (d *DNSResolver) resolve() (map[string]resolvedServer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	resolved := make(map[string]resolvedServer)
+	if d.srv {
+		_, records, err := d.lookup.LookupSRV(ctx, d.service, d.proto, d.name)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return resolved, nil
+		}
+		priority := records[0].Priority
+		for _, r := range records {
+			if r.Priority < priority {
+				priority = r.Priority
+			}
+		}
+		for _, r := range records {
+			if r.Priority != priority {
+				continue
+			}
+			host := strings.TrimSuffix(r.Target, ".")
+			s := resolvedServer{url: d.serverURL(host, int(r.Port)), weight: int(r.Weight)}
+			resolved[s.url.String()] = s
+		}
+		return resolved, nil
+	}
+
+	addrs, err := d.lookup.LookupIPAddr(ctx, d.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		s := resolvedServer{url: d.serverURL(addr.IP.String(), d.port)}
+		resolved[s.url.String()] = s
+	}
+	return resolved, nil
+}
+
+func (d *DNSResolver) serverURL(host string, port int) *url.URL {
+	if port != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return &url.URL{Scheme: d.scheme, Host: host}
+}
@@ -0,0 +1,213 @@
+package roundrobin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// fakeLookup answers the lookups with configurable records
+type fakeLookup struct {
+	mu      sync.Mutex
+	ips     []string
+	srv     []*net.SRV
+	err     error
+	lookups int
+}
+
+func (f *fakeLookup) set(ips ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ips = ips
+	f.err = nil
+}
+
+func (f *fakeLookup) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *fakeLookup) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups
+}
+
+func (f *fakeLookup) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	if f.err != nil {
+		return nil, f.err
+	}
+	var out []net.IPAddr
+	for _, ip := range f.ips {
+		out = append(out, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return out, nil
+}
+
+func (f *fakeLookup) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	if f.err != nil {
+		return "", nil, f.err
+	}
+	return "_" + service + "._" + proto + "." + name, f.srv, nil
+}
+
+func newDNSTestLB(t *testing.T) *RoundRobin {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	return lb
+}
+
+func serverStrings(lb *RoundRobin) []string {
+	var out []string
+	for _, u := range lb.Servers() {
+		out = append(out, u.String())
+	}
+	return out
+}
+
+func TestDNSResolverAddsAndRemovesServers(t *testing.T) {
+	lb := newDNSTestLB(t)
+	lookup := &fakeLookup{}
+	lookup.set("10.0.0.1", "10.0.0.2")
+
+	d, err := NewDNSResolver(lb, "backend.default.svc.cluster.local", DNSPort(8080), DNSLookup(lookup))
+	require.NoError(t, err)
+
+	require.NoError(t, d.Refresh())
+	assert.ElementsMatch(t, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}, serverStrings(lb))
+
+	lookup.set("10.0.0.2", "10.0.0.3")
+	require.NoError(t, d.Refresh())
+	assert.ElementsMatch(t, []string{"http://10.0.0.2:8080", "http://10.0.0.3:8080"}, serverStrings(lb))
+	assert.Len(t, d.Servers(), 2)
+}
+
+func TestDNSResolverKeepsServersOnError(t *testing.T) {
+	lb := newDNSTestLB(t)
+	lookup := &fakeLookup{}
+	lookup.set("10.0.0.1")
+
+	d, err := NewDNSResolver(lb, "backend", DNSLookup(lookup))
+	require.NoError(t, err)
+	require.NoError(t, d.Refresh())
+
+	lookup.fail(errors.New("timeout"))
+	assert.Error(t, d.Refresh())
+	assert.Equal(t, []string{"http://10.0.0.1"}, serverStrings(lb))
+}
+
+func TestDNSResolverLeavesOtherServers(t *testing.T) {
+	lb := newDNSTestLB(t)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://static:80")))
+
+	lookup := &fakeLookup{}
+	lookup.set("10.0.0.1")
+
+	d, err := NewDNSResolver(lb, "backend", DNSPort(80), DNSLookup(lookup))
+	require.NoError(t, err)
+	require.NoError(t, d.Refresh())
+	assert.ElementsMatch(t, []string{"http://static:80", "http://10.0.0.1:80"}, serverStrings(lb))
+
+	lookup.set()
+	require.NoError(t, d.Refresh())
+	assert.Equal(t, []string{"http://static:80"}, serverStrings(lb))
+}
+
+func TestDNSResolverIPv6(t *testing.T) {
+	lb := newDNSTestLB(t)
+	lookup := &fakeLookup{}
+	lookup.set("fd00::1")
+
+	d, err := NewDNSResolver(lb, "backend", DNSScheme("https"), DNSPort(8443), DNSLookup(lookup))
+	require.NoError(t, err)
+	require.NoError(t, d.Refresh())
+	assert.Equal(t, []string{"https://[fd00::1]:8443"}, serverStrings(lb))
+}
+
+func TestDNSResolverSRV(t *testing.T) {
+	lb := newDNSTestLB(t)
+	lookup := &fakeLookup{srv: []*net.SRV{
+		{Target: "pod-a.backend.", Port: 8080, Priority: 10, Weight: 3},
+		{Target: "pod-b.backend.", Port: 8081, Priority: 10, Weight: 1},
+		{Target: "backup.backend.", Port: 8080, Priority: 20, Weight: 1},
+	}}
+
+	d, err := NewDNSResolver(lb, "backend", DNSSRV("http", "tcp"), DNSLookup(lookup))
+	require.NoError(t, err)
+	require.NoError(t, d.Refresh())
+	assert.ElementsMatch(t, []string{"http://pod-a.backend:8080", "http://pod-b.backend:8081"}, serverStrings(lb))
+
+	weight, ok := lb.ServerWeight(testutils.ParseURI("http://pod-a.backend:8080"))
+	assert.True(t, ok)
+	assert.Equal(t, 3, weight)
+
+	lookup.mu.Lock()
+	lookup.srv[0].Weight = 5
+	lookup.mu.Unlock()
+	require.NoError(t, d.Refresh())
+
+	weight, _ = lb.ServerWeight(testutils.ParseURI("http://pod-a.backend:8080"))
+	assert.Equal(t, 5, weight)
+}
+
+func TestDNSResolverStartStop(t *testing.T) {
+	lb := newDNSTestLB(t)
+	lookup := &fakeLookup{}
+	lookup.set("10.0.0.1")
+
+	d, err := NewDNSResolver(lb, "backend", DNSLookup(lookup),
+		DNSRefreshInterval(10*time.Millisecond), DNSJitter(5*time.Millisecond))
+	require.NoError(t, err)
+
+	d.Start()
+	d.Start()
+	for i := 0; i < 100 && lookup.count() < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.Stop()
+	d.Stop()
+
+	assert.True(t, lookup.count() >= 3)
+	assert.Equal(t, []string{"http://10.0.0.1"}, serverStrings(lb))
+
+	count := lookup.count()
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, count, lookup.count())
+}
+
+func TestDNSResolverOptions(t *testing.T) {
+	lb := newDNSTestLB(t)
+
+	_, err := NewDNSResolver(lb, "")
+	assert.Error(t, err)
+
+	_, err = NewDNSResolver(lb, "backend", DNSRefreshInterval(0))
+	assert.Error(t, err)
+
+	_, err = NewDNSResolver(lb, "backend", DNSJitter(-time.Second))
+	assert.Error(t, err)
+
+	_, err = NewDNSResolver(lb, "backend", DNSPort(70000))
+	assert.Error(t, err)
+
+	_, err = NewDNSResolver(lb, "backend", DNSScheme("ftp"))
+	assert.Error(t, err)
+}
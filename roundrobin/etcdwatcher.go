@@ -0,0 +1,131 @@
+package roundrobin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultEtcdWatcherInterval is the default time between two reads of the etcd prefix
+const DefaultEtcdWatcherInterval = 5 * time.Second
+
+// EtcdWatcher watches the keys under a prefix of etcd, through the JSON gateway of the v3 API.
+// The value of every key is either the URL of a server or a JSON object {"url": "...", "weight": 2}.
+// The prefix is read every interval, and the previous servers are kept when etcd can not be reached.
+type EtcdWatcher struct {
+	pollWatcher
+	endpoint string
+	prefix   string
+	opts     *watcherOptions
+}
+
+// NewEtcdWatcher creates a new EtcdWatcher of the prefix, endpoint is the URL of an etcd member, e.g. http://127.0.0.1:2379
+func NewEtcdWatcher(endpoint, prefix string, opts ...WatcherOption) (*EtcdWatcher, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid etcd endpoint %q", endpoint)
+	}
+	if prefix == "" {
+		return nil, fmt.Errorf("prefix can not be empty")
+	}
+	o, err := newWatcherOptions(DefaultEtcdWatcherInterval, opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &EtcdWatcher{endpoint: strings.TrimSuffix(endpoint, "/"), prefix: prefix, opts: o}
+	w.pollWatcher = pollWatcher{name: "etcd prefix " + prefix, interval: o.interval, fetch: w.read, log: o.log}
+	return w, nil
+}
+
+type etcdRange struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+func (w *EtcdWatcher) read(ctx context.Context) ([]ServerSpec, error) {
+	ctx, cancel := context.WithTimeout(ctx, watcherTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(etcdRange{Key: []byte(w.prefix), RangeEnd: prefixEnd([]byte(w.prefix))})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.endpoint+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range w.opts.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.opts.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd answered %v: %s", resp.Status, data)
+	}
+
+	var r etcdRangeResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	list := []ServerSpec{}
+	for _, kv := range r.Kvs {
+		spec, err := parseServerSpec(kv.Value)
+		if err != nil {
+			w.log.Errorf("vulcand/oxy/roundrobin/watcher: ignoring etcd key %s: %v", kv.Key, err)
+			continue
+		}
+		list = append(list, spec)
+	}
+	return list, nil
+}
+
+// parseServerSpec parses a server URL or a JSON server object
+func parseServerSpec(value []byte) (ServerSpec, error) {
+	var spec ServerSpec
+	trimmed := strings.TrimSpace(string(value))
+	if strings.HasPrefix(trimmed, "{") {
+		err := json.Unmarshal(value, &spec)
+		return spec, err
+	}
+	if trimmed == "" {
+		return spec, fmt.Errorf("empty value")
+	}
+	spec.URL = trimmed
+	return spec, nil
+}
+
+// prefixEnd returns the end of the range of the keys starting with prefix, the prefix with its last byte incremented
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// the prefix is all 0xff, range to the end of the keys
+	return []byte{0}
+}
@@ -0,0 +1,104 @@
+package roundrobin
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestEtcdWatcher(t *testing.T) {
+	var mu sync.Mutex
+	values := map[string]string{
+		"/services/api/a": "http://a:80",
+		"/services/api/b": `{"url": "http://b:80", "weight": 4}`,
+		"/services/apix":  "http://other:80",
+	}
+	failing := false
+
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v3/kv/range", req.URL.Path)
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+
+		var r etcdRange
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&r))
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var resp etcdRangeResponse
+		for k, v := range values {
+			if k >= string(r.Key) && k < string(r.RangeEnd) {
+				resp.Kvs = append(resp.Kvs, struct {
+					Key   []byte `json:"key"`
+					Value []byte `json:"value"`
+				}{Key: []byte(k), Value: []byte(v)})
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	defer srv.Close()
+
+	w, err := NewEtcdWatcher(srv.URL, "/services/api/", WatcherInterval(5*time.Millisecond), WatcherHeader("Authorization", "Bearer token"))
+	require.NoError(t, err)
+
+	lb := newDNSTestLB(t)
+	s, err := NewServerListSync(lb, w)
+	require.NoError(t, err)
+	s.Start()
+	defer s.Stop()
+
+	waitServers(t, lb, "http://a:80", "http://b:80")
+	weight, _ := lb.ServerWeight(testutils.ParseURI("http://b:80"))
+	assert.Equal(t, 4, weight)
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	waitServers(t, lb, "http://a:80", "http://b:80")
+
+	mu.Lock()
+	failing = false
+	delete(values, "/services/api/a")
+	mu.Unlock()
+	waitServers(t, lb, "http://b:80")
+}
+
+func TestEtcdWatcherOptions(t *testing.T) {
+	_, err := NewEtcdWatcher("127.0.0.1:2379", "/services")
+	assert.Error(t, err)
+
+	_, err = NewEtcdWatcher("http://127.0.0.1:2379", "")
+	assert.Error(t, err)
+
+	_, err = NewEtcdWatcher("http://127.0.0.1:2379", "/services", WatcherInterval(0))
+	assert.Error(t, err)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("/services0"), prefixEnd([]byte("/services/")))
+	assert.Equal(t, []byte{'a', 0x01}, prefixEnd([]byte{'a', 0x00}))
+	assert.Equal(t, []byte{'b'}, prefixEnd([]byte{'a', 0xff}))
+	assert.Equal(t, []byte{0}, prefixEnd([]byte{0xff}))
+}
+
+func TestParseServerSpec(t *testing.T) {
+	spec, err := parseServerSpec([]byte(" http://a:80\n"))
+	require.NoError(t, err)
+	assert.Equal(t, ServerSpec{URL: "http://a:80"}, spec)
+
+	_, err = parseServerSpec([]byte("{"))
+	assert.Error(t, err)
+
+	_, err = parseServerSpec([]byte(""))
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package roundrobin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultFileWatcherInterval is the default time between two checks of the file
+const DefaultFileWatcherInterval = 5 * time.Second
+
+// FileWatcher watches a JSON or YAML file listing the servers, either as an array or as an object with a
+// "servers" array:
+//
+//	{"servers": [{"url": "http://10.0.0.1:8080", "weight": 2}, {"url": "http://10.0.0.2:8080"}]}
+//
+//	servers:
+//	- url: http://10.0.0.1:8080
+//	  weight: 2
+//
+// Files ending with .yaml or .yml are decoded as YAML, other files as JSON unless their content does not start
+// like a JSON document.
+//
+// There is no file system notification: the file is checked every interval and only read again when it was
+// replaced or its size or modification time changed, a new list is then sent when its content changed.
+// A missing or invalid file keeps the previous servers, so the file can be replaced atomically with a rename.
+type FileWatcher struct {
+	pollWatcher
+	path string
+
+	mtx  sync.Mutex
+	info os.FileInfo
+	list []ServerSpec
+}
+
+// NewFileWatcher creates a new FileWatcher of the file
+func NewFileWatcher(path string, opts ...WatcherOption) (*FileWatcher, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path can not be empty")
+	}
+	o, err := newWatcherOptions(DefaultFileWatcherInterval, opts)
+	if err != nil {
+		return nil, err
+	}
+	w := &FileWatcher{path: path}
+	w.pollWatcher = pollWatcher{name: path, interval: o.interval, fetch: w.read, log: o.log}
+	return w, nil
+}
+
+// read returns the servers of the file, the previous list is returned when the file did not change since it was read
+func (w *FileWatcher) read(ctx context.Context) ([]ServerSpec, error) {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.info != nil && os.SameFile(w.info, info) && w.info.Size() == info.Size() && w.info.ModTime().Equal(info.ModTime()) {
+		return append([]ServerSpec(nil), w.list...), nil
+	}
+
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	var list []ServerSpec
+	if isYAMLFile(w.path, data) {
+		list, err = parseYAMLServerList(data)
+	} else {
+		list, err = parseServerList(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w.info, w.list = info, list
+	return append([]ServerSpec(nil), list...), nil
+}
+
+// isYAMLFile tells if the file is decoded as YAML, by its extension or by a content not starting like JSON
+func isYAMLFile(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	case ".json":
+		return false
+	}
+	trimmed := strings.TrimSpace(string(data))
+	return !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[")
+}
+
+// parseYAMLServerList parses a YAML sequence of servers, or a mapping with a "servers" sequence
+func parseYAMLServerList(data []byte) ([]ServerSpec, error) {
+	var list []ServerSpec
+	if err := yaml.UnmarshalStrict(data, &list); err == nil && list != nil {
+		return list, nil
+	}
+
+	var doc struct {
+		Servers []ServerSpec `yaml:"servers"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Servers == nil {
+		return nil, fmt.Errorf("no servers list")
+	}
+	return doc.Servers, nil
+}
+
+// parseServerList parses a JSON array of servers, or an object with a "servers" array
+func parseServerList(data []byte) ([]ServerSpec, error) {
+	var list []ServerSpec
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+
+	var doc struct {
+		Servers []ServerSpec `json:"servers"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Servers == nil {
+		return nil, fmt.Errorf("no servers list")
+	}
+	return doc.Servers, nil
+}
@@ -0,0 +1,330 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthCheckOption provides options for the health checker
+type HealthCheckOption func(*HealthChecker) error
+
+// HealthCheckPath sets the path probed on every server, defaults to "/"
+func HealthCheckPath(path string) HealthCheckOption {
+	return func(h *HealthChecker) error {
+		h.path = path
+		return nil
+	}
+}
+
+// HealthCheckInterval sets the time between two probes of a server, defaults to 10 seconds
+func HealthCheckInterval(d time.Duration) HealthCheckOption {
+	return func(h *HealthChecker) error {
+		if d <= 0 {
+			return fmt.Errorf("health check interval should be > 0")
+		}
+		h.interval = d
+		return nil
+	}
+}
+
+// HealthCheckTimeout sets the time a server has to answer a probe, defaults to 5 seconds
+func HealthCheckTimeout(d time.Duration) HealthCheckOption {
+	return func(h *HealthChecker) error {
+		if d <= 0 {
+			return fmt.Errorf("health check timeout should be > 0")
+		}
+		h.client.Timeout = d
+		return nil
+	}
+}
+
+// HealthCheckThresholds sets the number of consecutive successful probes after which an unhealthy server
+// is added back, and the number of consecutive failed probes after which a healthy server is removed
+func HealthCheckThresholds(healthy, unhealthy int) HealthCheckOption {
+	return func(h *HealthChecker) error {
+		if healthy < 1 || unhealthy < 1 {
+			return fmt.Errorf("health check thresholds should be >= 1")
+		}
+		h.healthyThreshold = healthy
+		h.unhealthyThreshold = unhealthy
+		return nil
+	}
+}
+
+// HealthCheckTransport sets the round tripper used to send the probes
+func HealthCheckTransport(rt http.RoundTripper) HealthCheckOption {
+	return func(h *HealthChecker) error {
+		h.client.Transport = rt
+		return nil
+	}
+}
+
+// HealthCheckLogger defines the logger the health checker will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func HealthCheckLogger(l *log.Logger) HealthCheckOption {
+	return func(h *HealthChecker) error {
+		h.log = l
+		return nil
+	}
+}
+
+// HealthChecker periodically probes the servers of a load balancer with a GET request, removing the ones
+// failing to answer with a 2xx or 3xx status code and adding them back once they recover.
+// Servers have to be added and removed through the health checker so that it knows about them.
+type HealthChecker struct {
+	mtx *sync.Mutex
+	lb  balancerHandler
+
+	path               string
+	interval           time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+	client             *http.Client
+
+	targets []*hcTarget
+	stop    chan struct{}
+	done    chan struct{}
+
+	log *log.Logger
+}
+
+// hcTarget is a server watched by the health checker
+type hcTarget struct {
+	url *url.URL
+	// options used to add the server back in the load balancer
+	options   []ServerOption
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// NewHealthChecker creates a new HealthChecker for the load balancer, call Start to begin probing
+func NewHealthChecker(lb balancerHandler, opts ...HealthCheckOption) (*HealthChecker, error) {
+	h := &HealthChecker{
+		mtx:                &sync.Mutex{},
+		lb:                 lb,
+		path:               "/",
+		interval:           10 * time.Second,
+		healthyThreshold:   1,
+		unhealthyThreshold: 1,
+		client:             &http.Client{Timeout: 5 * time.Second},
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	// probes must reach the server itself
+	h.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return h, nil
+}
+
+// UpsertServer adds the server to the load balancer and starts watching it.
+// The options are applied again each time the server is added back after a failure.
+func (h *HealthChecker) UpsertServer(u *url.URL, options ...ServerOption) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	t, _ := h.findTarget(u)
+	if t != nil && !t.healthy {
+		t.options = options
+		return nil
+	}
+	if err := h.lb.UpsertServer(u, options...); err != nil {
+		return err
+	}
+	if t != nil {
+		t.options = options
+		return nil
+	}
+	h.targets = append(h.targets, &hcTarget{url: utils.CopyURL(u), options: options, healthy: true})
+	return nil
+}
+
+// RemoveServer removes the server from the load balancer and stops watching it
+func (h *HealthChecker) RemoveServer(u *url.URL) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	t, i := h.findTarget(u)
+	if t == nil {
+		return fmt.Errorf("server not found")
+	}
+	h.targets = append(h.targets[:i], h.targets[i+1:]...)
+	if t.healthy {
+		return h.lb.RemoveServer(u)
+	}
+	return nil
+}
+
+// Servers returns the servers watched by the health checker, healthy or not
+func (h *HealthChecker) Servers() []*url.URL {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	out := make([]*url.URL, len(h.targets))
+	for i, t := range h.targets {
+		out[i] = utils.CopyURL(t.url)
+	}
+	return out
+}
+
+// IsHealthy tells if the server is considered healthy, the second value is false if the server is unknown
+func (h *HealthChecker) IsHealthy(u *url.URL) (bool, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if t, _ := h.findTarget(u); t != nil {
+		return t.healthy, true
+	}
+	return false, false
+}
+
+// Start probes the servers every interval until Stop is called
+func (h *HealthChecker) Start() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	go h.run(h.stop, h.done)
+}
+
+// Stop stops probing the servers, the load balancer is left as is
+func (h *HealthChecker) Stop() {
+	h.Shutdown(context.Background())
+}
+
+// Shutdown stops probing the servers like Stop, waiting for the probe in progress at most until the context is done,
+// in which case it returns the error of the context
+func (h *HealthChecker) Shutdown(ctx context.Context) error {
+	h.mtx.Lock()
+	stop, done := h.stop, h.done
+	h.stop, h.done = nil, nil
+	h.mtx.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *HealthChecker) run(stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.Check()
+		}
+	}
+}
+
+// Check probes all the servers once and updates the load balancer accordingly
+func (h *HealthChecker) Check() {
+	h.mtx.Lock()
+	urls := make([]*url.URL, len(h.targets))
+	for i, t := range h.targets {
+		urls[i] = t.url
+	}
+	h.mtx.Unlock()
+
+	results := make([]error, len(urls))
+	wg := &sync.WaitGroup{}
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u *url.URL) {
+			defer wg.Done()
+			results[i] = h.probe(u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for i, u := range urls {
+		if t, _ := h.findTarget(u); t != nil {
+			h.record(t, results[i])
+		}
+	}
+}
+
+func (h *HealthChecker) probe(u *url.URL) error {
+	probeURL := utils.CopyURL(u)
+	probeURL.Path = h.path
+
+	res, err := h.client.Get(probeURL.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (h *HealthChecker) record(t *hcTarget, err error) {
+	if err == nil {
+		t.successes++
+		t.failures = 0
+	} else {
+		t.failures++
+		t.successes = 0
+	}
+
+	switch {
+	case t.healthy && t.failures >= h.unhealthyThreshold:
+		h.log.Warnf("vulcand/oxy/roundrobin/healthcheck: removing unhealthy server %v: %v", t.url, err)
+		if errRemove := h.lb.RemoveServer(t.url); errRemove != nil {
+			h.log.Errorf("vulcand/oxy/roundrobin/healthcheck: failed to remove server %v: %v", t.url, errRemove)
+			return
+		}
+		t.healthy = false
+	case !t.healthy && t.successes >= h.healthyThreshold:
+		h.log.Infof("vulcand/oxy/roundrobin/healthcheck: adding back healthy server %v", t.url)
+		if errUpsert := h.lb.UpsertServer(t.url, t.options...); errUpsert != nil {
+			h.log.Errorf("vulcand/oxy/roundrobin/healthcheck: failed to add server %v: %v", t.url, errUpsert)
+			return
+		}
+		t.healthy = true
+	}
+}
+
+func (h *HealthChecker) findTarget(u *url.URL) (*hcTarget, int) {
+	for i, t := range h.targets {
+		if sameURL(u, t.url) {
+			return t, i
+		}
+	}
+	return nil, -1
+}
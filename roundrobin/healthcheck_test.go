@@ -0,0 +1,203 @@
+package roundrobin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// healthServer answers the health check path with a configurable status code
+type healthServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	path   string
+}
+
+func newHealthServer(body string) *healthServer {
+	h := &healthServer{status: http.StatusOK}
+	h.Server = testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		h.mu.Lock()
+		status := h.status
+		h.path = req.URL.Path
+		h.mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+	return h
+}
+
+func (h *healthServer) setStatus(status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status = status
+}
+
+func TestHealthCheckRemovesAndReaddsServers(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+
+	b := newHealthServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	hc, err := NewHealthChecker(lb, HealthCheckPath("/health"))
+	require.NoError(t, err)
+
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(a.URL), Weight(2)))
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	hc.Check()
+	assert.Equal(t, "/health", a.path)
+	assert.Len(t, lb.Servers(), 2)
+
+	a.setStatus(http.StatusServiceUnavailable)
+	hc.Check()
+
+	healthy, known := hc.IsHealthy(testutils.ParseURI(a.URL))
+	assert.True(t, known)
+	assert.False(t, healthy)
+	assert.Equal(t, []string{"b", "b", "b"}, seq(t, proxy.URL, 3))
+
+	a.setStatus(http.StatusOK)
+	hc.Check()
+
+	healthy, _ = hc.IsHealthy(testutils.ParseURI(a.URL))
+	assert.True(t, healthy)
+	w, ok := lb.ServerWeight(testutils.ParseURI(a.URL))
+	assert.True(t, ok)
+	assert.Equal(t, 2, w)
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	hc, err := NewHealthChecker(lb, HealthCheckThresholds(2, 3))
+	require.NoError(t, err)
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(a.URL)))
+
+	a.setStatus(http.StatusInternalServerError)
+	hc.Check()
+	hc.Check()
+	assert.Len(t, lb.Servers(), 1)
+	hc.Check()
+	assert.Len(t, lb.Servers(), 0)
+
+	a.setStatus(http.StatusOK)
+	hc.Check()
+	assert.Len(t, lb.Servers(), 0)
+	hc.Check()
+	assert.Len(t, lb.Servers(), 1)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	})
+	defer a.Close()
+	defer close(release)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	hc, err := NewHealthChecker(lb, HealthCheckTimeout(10*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(a.URL)))
+
+	hc.Check()
+	assert.Len(t, lb.Servers(), 0)
+}
+
+func TestHealthCheckStartStop(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+	a.setStatus(http.StatusInternalServerError)
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	hc, err := NewHealthChecker(lb, HealthCheckInterval(time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(a.URL)))
+
+	hc.Start()
+	deadline := time.Now().Add(time.Second)
+	for len(lb.Servers()) != 0 {
+		require.True(t, time.Now().Before(deadline), "server never removed")
+		time.Sleep(time.Millisecond)
+	}
+	hc.Stop()
+	hc.Stop()
+}
+
+func TestHealthCheckShutdown(t *testing.T) {
+	probing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case probing <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	defer a.Close()
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	hc, err := NewHealthChecker(lb, HealthCheckInterval(time.Millisecond), HealthCheckTimeout(time.Second))
+	require.NoError(t, err)
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(a.URL)))
+
+	hc.Start()
+	<-probing
+
+	// the probe in progress outlives the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, hc.Shutdown(ctx))
+
+	close(release)
+	assert.NoError(t, hc.Shutdown(context.Background()))
+}
+
+func TestHealthCheckRemoveServer(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	hc, err := NewHealthChecker(lb)
+	require.NoError(t, err)
+
+	assert.Error(t, hc.RemoveServer(testutils.ParseURI(a.URL)))
+
+	require.NoError(t, hc.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, hc.RemoveServer(testutils.ParseURI(a.URL)))
+	assert.Len(t, lb.Servers(), 0)
+
+	_, known := hc.IsHealthy(testutils.ParseURI(a.URL))
+	assert.False(t, known)
+}
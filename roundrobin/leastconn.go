@@ -0,0 +1,312 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// LeastConnOption provides options for the least connections load balancer
+type LeastConnOption func(*LeastConn) error
+
+// LeastConnErrorHandler is a functional argument that sets error handler of the server
+func LeastConnErrorHandler(h utils.ErrorHandler) LeastConnOption {
+	return func(l *LeastConn) error {
+		l.errHandler = h
+		return nil
+	}
+}
+
+// LeastConnStickySession sets a sticky session
+func LeastConnStickySession(stickySession *StickySession) LeastConnOption {
+	return func(l *LeastConn) error {
+		l.stickySession = stickySession
+		return nil
+	}
+}
+
+// LeastConnRequestRewriteListener is a functional argument that sets a request rewrite listener
+func LeastConnRequestRewriteListener(rrl RequestRewriteListener) LeastConnOption {
+	return func(l *LeastConn) error {
+		l.requestRewriteListener = rrl
+		return nil
+	}
+}
+
+// LeastConnLogger defines the logger the least connections load balancer will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func LeastConnLogger(l *log.Logger) LeastConnOption {
+	return func(lc *LeastConn) error {
+		lc.log = l
+		return nil
+	}
+}
+
+// LeastConn implements a load balancer http handler sending each request to the server with the fewest
+// in-flight requests relative to its weight. Servers with the same load are picked in a round robin fashion.
+type LeastConn struct {
+	mutex      *sync.Mutex
+	next       http.Handler
+	errHandler utils.ErrorHandler
+	// Index of the last picked server (starts from -1)
+	index                  int
+	servers                []*server
+	stickySession          *StickySession
+	requestRewriteListener RequestRewriteListener
+	inflight               utils.Inflight
+
+	log *log.Logger
+}
+
+// NewLeastConn creates a new LeastConn
+func NewLeastConn(next http.Handler, opts ...LeastConnOption) (*LeastConn, error) {
+	lc := &LeastConn{
+		next:    next,
+		index:   -1,
+		mutex:   &sync.Mutex{},
+		servers: []*server{},
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(lc); err != nil {
+			return nil, err
+		}
+	}
+	if lc.errHandler == nil {
+		lc.errHandler = utils.DefaultHandler
+	}
+	return lc, nil
+}
+
+// Next returns the next handler, the in-flight requests going through it are accounted to their server.
+func (l *LeastConn) Next() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		l.acquire(req.URL)
+		defer l.release(req.URL)
+		l.next.ServeHTTP(w, req)
+	})
+}
+
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete. It returns the error of the context if it is done first.
+func (l *LeastConn) Shutdown(ctx context.Context) error {
+	return l.inflight.Shutdown(ctx)
+}
+
+func (l *LeastConn) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !l.inflight.Acquire() {
+		l.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer l.inflight.Release()
+
+	if l.log.Level >= log.DebugLevel {
+		logEntry := l.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/roundrobin/leastconn: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/roundrobin/leastconn: completed ServeHttp on request")
+	}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	stuck := false
+	if l.stickySession != nil {
+		cookieURL, present, err := l.stickySession.GetBackend(&newReq, availableServers(l))
+
+		if err == ErrStickyBackendGone {
+			l.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		if err != nil {
+			log.Warnf("vulcand/oxy/roundrobin/leastconn: error using server from cookie: %v", err)
+		}
+
+		if present {
+			newReq.URL = cookieURL
+			stuck = true
+			l.acquire(cookieURL)
+		}
+	}
+
+	if !stuck {
+		// the server is picked and accounted for atomically so that concurrent requests spread out
+		srv, err := l.nextServer(true)
+		if err != nil {
+			l.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		newReq.URL = utils.CopyURL(srv.url)
+
+		if l.stickySession != nil {
+			l.stickySession.StickRequest(req, newReq.URL, &w)
+		}
+	}
+	defer l.release(newReq.URL)
+
+	if l.log.Level >= log.DebugLevel {
+		// log which backend URL we're sending this request to
+		l.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/leastconn: Forwarding this request to URL")
+	}
+
+	// Emit event to a listener if one exists
+	if l.requestRewriteListener != nil {
+		l.requestRewriteListener(req, &newReq)
+	}
+
+	l.next.ServeHTTP(w, &newReq)
+}
+
+// NextServer gets the server with the fewest in-flight requests
+func (l *LeastConn) NextServer() (*url.URL, error) {
+	srv, err := l.nextServer(false)
+	if err != nil {
+		return nil, err
+	}
+	return utils.CopyURL(srv.url), nil
+}
+
+func (l *LeastConn) nextServer(acquire bool) (*server, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.servers) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+
+	var best *server
+	bestIndex := -1
+	for i := 1; i <= len(l.servers); i++ {
+		index := (l.index + i) % len(l.servers)
+		srv := l.servers[index]
+		if srv.weight == 0 {
+			continue
+		}
+		// compares inflight/weight ratios without divisions
+		if best == nil || srv.inflight*best.weight < best.inflight*srv.weight {
+			best, bestIndex = srv, index
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all servers have 0 weight")
+	}
+
+	l.index = bestIndex
+	if acquire {
+		best.inflight++
+	}
+	return best, nil
+}
+
+func (l *LeastConn) acquire(u *url.URL) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if s, _ := l.findServerByURL(u); s != nil {
+		s.inflight++
+	}
+}
+
+func (l *LeastConn) release(u *url.URL) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if s, _ := l.findServerByURL(u); s != nil && s.inflight > 0 {
+		s.inflight--
+	}
+}
+
+// InFlight gets the number of requests being served by the server
+func (l *LeastConn) InFlight(u *url.URL) (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if s, _ := l.findServerByURL(u); s != nil {
+		return s.inflight, true
+	}
+	return -1, false
+}
+
+// RemoveServer remove a server
+func (l *LeastConn) RemoveServer(u *url.URL) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e, index := l.findServerByURL(u)
+	if e == nil {
+		return fmt.Errorf("server not found")
+	}
+	l.servers = append(l.servers[:index], l.servers[index+1:]...)
+	l.index = -1
+	return nil
+}
+
+// Servers gets servers URL
+func (l *LeastConn) Servers() []*url.URL {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	out := make([]*url.URL, len(l.servers))
+	for i, srv := range l.servers {
+		out[i] = srv.url
+	}
+	return out
+}
+
+// ServerWeight gets the server weight
+func (l *LeastConn) ServerWeight(u *url.URL) (int, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if s, _ := l.findServerByURL(u); s != nil {
+		return s.weight, true
+	}
+	return -1, false
+}
+
+// UpsertServer adds a server or updates its options if it is already present in the load balancer
+func (l *LeastConn) UpsertServer(u *url.URL, options ...ServerOption) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if u == nil {
+		return fmt.Errorf("server URL can't be nil")
+	}
+
+	if s, _ := l.findServerByURL(u); s != nil {
+		for _, o := range options {
+			if err := o(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	srv := &server{url: utils.CopyURL(u)}
+	for _, o := range options {
+		if err := o(srv); err != nil {
+			return err
+		}
+	}
+
+	if srv.weight == 0 {
+		srv.weight = defaultWeight
+	}
+
+	l.servers = append(l.servers, srv)
+	return nil
+}
+
+func (l *LeastConn) findServerByURL(u *url.URL) (*server, int) {
+	for i, s := range l.servers {
+		if sameURL(u, s.url) {
+			return s, i
+		}
+	}
+	return nil, -1
+}
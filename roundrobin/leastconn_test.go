@@ -0,0 +1,157 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestLeastConnNoServers(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := NewLeastConn(fwd)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestLeastConnIdleServersRotate(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := NewLeastConn(fwd)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	assert.Equal(t, []string{"a", "b", "a", "b"}, seq(t, proxy.URL, 4))
+}
+
+func TestLeastConnAvoidsBusyServer(t *testing.T) {
+	release := make(chan struct{})
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := NewLeastConn(fwd)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	done := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(proxy.URL)
+		done <- string(body)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for n, _ := lb.InFlight(testutils.ParseURI(a.URL)); n != 1; n, _ = lb.InFlight(testutils.ParseURI(a.URL)) {
+		require.True(t, time.Now().Before(deadline), "request never reached server a")
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, []string{"b", "b", "b"}, seq(t, proxy.URL, 3))
+
+	close(release)
+	assert.Equal(t, "a", <-done)
+
+	n, ok := lb.InFlight(testutils.ParseURI(a.URL))
+	assert.True(t, ok)
+	assert.Equal(t, 0, n)
+}
+
+func TestLeastConnWeighted(t *testing.T) {
+	lb, err := NewLeastConn(nil)
+	require.NoError(t, err)
+
+	a, b := testutils.ParseURI("http://a"), testutils.ParseURI("http://b")
+	require.NoError(t, lb.UpsertServer(a, Weight(3)))
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+
+	// a can take three times as many requests as b
+	for i := 0; i < 3; i++ {
+		lb.acquire(a)
+	}
+	u, err := lb.NextServer()
+	require.NoError(t, err)
+	assert.Equal(t, b.String(), u.String())
+
+	lb.acquire(b)
+	lb.acquire(b)
+	u, err = lb.NextServer()
+	require.NoError(t, err)
+	assert.Equal(t, a.String(), u.String())
+
+	require.NoError(t, lb.UpsertServer(a, Weight(0)))
+	u, err = lb.NextServer()
+	require.NoError(t, err)
+	assert.Equal(t, b.String(), u.String())
+
+	require.NoError(t, lb.UpsertServer(b, Weight(0)))
+	_, err = lb.NextServer()
+	assert.Error(t, err)
+}
+
+func TestLeastConnNextTracksInFlight(t *testing.T) {
+	var inflight int
+	var lb *LeastConn
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inflight, _ = lb.InFlight(req.URL)
+	})
+
+	lb, err := NewLeastConn(next)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a")))
+
+	req := httptest.NewRequest(http.MethodGet, "http://a", nil)
+	lb.Next().ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 1, inflight)
+
+	n, _ := lb.InFlight(testutils.ParseURI("http://a"))
+	assert.Equal(t, 0, n)
+}
+
+func TestLeastConnRemoveServer(t *testing.T) {
+	lb, err := NewLeastConn(nil)
+	require.NoError(t, err)
+
+	assert.Error(t, lb.RemoveServer(testutils.ParseURI("http://a")))
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a")))
+	require.NoError(t, lb.RemoveServer(testutils.ParseURI("http://a")))
+	assert.Empty(t, lb.Servers())
+}
@@ -0,0 +1,100 @@
+package roundrobin
+
+import "fmt"
+
+// Locality sets the region and the zone of the server, used by PreferLocality
+func Locality(region, zone string) ServerOption {
+	return func(s *server) error {
+		s.region, s.zone = region, zone
+		return nil
+	}
+}
+
+// PreferLocality sends the requests to the servers of the zone of the load balancer, cutting the cross-zone
+// traffic. Once fewer than minServers servers of the zone are available, e.g. because the health checker removed
+// them or they are draining or have no weight, the traffic spills over proportionally to the servers of the other
+// zones of the region, or of the other regions if there are none: with half of the minimum available in the zone,
+// half of the requests go elsewhere. The servers without locality belong to no region nor zone.
+func PreferLocality(region, zone string, minServers int) LBOption {
+	return func(r *RoundRobin) error {
+		if zone == "" {
+			return fmt.Errorf("zone can not be empty")
+		}
+		if minServers < 1 {
+			return fmt.Errorf("minimum number of servers should be >= 1, got %d", minServers)
+		}
+		l := &locality{region: region, zone: zone, minServers: minServers}
+		for i := range l.cursors {
+			l.cursors[i].reset()
+		}
+		r.locality = l
+		return nil
+	}
+}
+
+// locality holds the zone preference of the load balancer
+type locality struct {
+	region, zone string
+	minServers   int
+	// credit accumulates the share of the requests kept in the zone, a request is sent to the zone per unit
+	credit float64
+	// cursors of the zone, the rest of the region and the other regions, each going round its own servers
+	cursors [3]wrrCursor
+}
+
+func allServers(*server) bool {
+	return true
+}
+
+func (l *locality) sameZone(s *server) bool {
+	return s.region == l.region && s.zone == l.zone
+}
+
+func (l *locality) sameRegion(s *server) bool {
+	return s.region == l.region && s.zone != l.zone
+}
+
+func (l *locality) otherRegion(s *server) bool {
+	return s.region != l.region
+}
+
+// localityFilter returns the candidate servers the next request can be sent to, according to the locality
+// preference, and the cursor going round them. It has to be called with the mutex held.
+func (r *RoundRobin) localityFilter(candidates func(*server) bool) (func(*server) bool, *wrrCursor) {
+	l := r.locality
+	if l == nil {
+		return candidates, &r.cursor
+	}
+
+	var zone, region, other int
+	for _, s := range r.servers {
+		if s.weight == 0 || s.drained != nil || !candidates(s) {
+			continue
+		}
+		switch {
+		case l.sameZone(s):
+			zone++
+		case l.sameRegion(s):
+			region++
+		default:
+			other++
+		}
+	}
+
+	share := float64(zone) / float64(l.minServers)
+	if share > 1 {
+		share = 1
+	}
+	l.credit += share
+	tier, cursor := l.otherRegion, &l.cursors[2]
+	switch {
+	case l.credit >= 1 || (region == 0 && other == 0):
+		if l.credit >= 1 {
+			l.credit--
+		}
+		tier, cursor = l.sameZone, &l.cursors[0]
+	case region > 0:
+		tier, cursor = l.sameRegion, &l.cursors[1]
+	}
+	return func(s *server) bool { return candidates(s) && tier(s) }, cursor
+}
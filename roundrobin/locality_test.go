@@ -0,0 +1,85 @@
+package roundrobin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// nextHosts returns the hosts of the next servers picked by the load balancer
+func nextHosts(t *testing.T, lb *RoundRobin, repeat int) []string {
+	var out []string
+	for i := 0; i < repeat; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		out = append(out, u.Host)
+	}
+	return out
+}
+
+func TestPreferLocality(t *testing.T) {
+	for _, smooth := range []bool{false, true} {
+		opts := []LBOption{PreferLocality("eu", "eu-a", 2)}
+		if smooth {
+			opts = append(opts, SmoothWeighting())
+		}
+		lb, err := New(nil, opts...)
+		require.NoError(t, err)
+
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a1"), Locality("eu", "eu-a")))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a2"), Locality("eu", "eu-a")))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b1"), Locality("eu", "eu-b")))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://c1"), Locality("us", "us-a")))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://d1")))
+
+		// the zone has enough servers
+		assert.Equal(t, []string{"a1", "a2", "a1", "a2"}, nextHosts(t, lb, 4))
+
+		// half of the minimum is left, half of the traffic goes to the other zone of the region
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a2"), Weight(0)))
+		assert.Equal(t, []string{"b1", "a1", "b1", "a1"}, nextHosts(t, lb, 4))
+
+		// the other regions take the spill over once the region has no other server
+		require.NoError(t, lb.RemoveServer(testutils.ParseURI("http://b1")))
+		hosts := nextHosts(t, lb, 4)
+		assert.Equal(t, 2, count(hosts, "a1"))
+		assert.Equal(t, 1, count(hosts, "c1"))
+		assert.Equal(t, 1, count(hosts, "d1"))
+
+		// all the traffic leaves the zone without servers
+		require.NoError(t, lb.RemoveServer(testutils.ParseURI("http://a1")))
+		hosts = nextHosts(t, lb, 4)
+		assert.Equal(t, 2, count(hosts, "c1"))
+		assert.Equal(t, 2, count(hosts, "d1"))
+	}
+}
+
+func TestPreferLocalityOnlyZone(t *testing.T) {
+	lb, err := New(nil, PreferLocality("eu", "eu-a", 3))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a1"), Locality("eu", "eu-a")))
+
+	// the zone keeps the traffic when there is nowhere else to go
+	assert.Equal(t, []string{"a1", "a1", "a1"}, nextHosts(t, lb, 3))
+}
+
+func TestPreferLocalityOptions(t *testing.T) {
+	_, err := New(nil, PreferLocality("eu", "", 1))
+	assert.Error(t, err)
+
+	_, err = New(nil, PreferLocality("eu", "eu-a", 0))
+	assert.Error(t, err)
+}
+
+func count(values []string, value string) int {
+	n := 0
+	for _, v := range values {
+		if v == value {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,238 @@
+package roundrobin
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/mailgun/timetools"
+)
+
+// ServerMeter sets the meter the rebalancer rates the server with, instead of the one created by RebalancerMeter.
+// The other load balancers ignore it.
+func ServerMeter(m Meter) ServerOption {
+	return func(s *server) error {
+		if m == nil {
+			return fmt.Errorf("meter can not be nil")
+		}
+		s.meter = m
+		return nil
+	}
+}
+
+// serverMeter returns the meter set by the options, nil if there is none
+func serverMeter(options []ServerOption) Meter {
+	s := &server{}
+	for _, o := range options {
+		if err := o(s); err != nil {
+			return nil
+		}
+	}
+	return s.meter
+}
+
+// MeterOption provides options for the meters of this package
+type MeterOption func(*meterOptions) error
+
+type meterOptions struct {
+	clock      timetools.TimeProvider
+	buckets    int
+	resolution time.Duration
+}
+
+// MeterClock sets a clock
+func MeterClock(clock timetools.TimeProvider) MeterOption {
+	return func(o *meterOptions) error {
+		o.clock = clock
+		return nil
+	}
+}
+
+// MeterWindow sets the rolling window the meter rates the servers over, buckets of resolution each.
+// Defaults to 10 buckets of 1 second, the meter is ready once it has data over the whole window.
+func MeterWindow(buckets int, resolution time.Duration) MeterOption {
+	return func(o *meterOptions) error {
+		if buckets < 2 {
+			return fmt.Errorf("buckets should be >= 2")
+		}
+		if resolution < time.Second {
+			return fmt.Errorf("resolution should be >= 1 second")
+		}
+		o.buckets = buckets
+		o.resolution = resolution
+		return nil
+	}
+}
+
+func newMeterOptions(opts []MeterOption) (*meterOptions, error) {
+	o := &meterOptions{buckets: 10, resolution: time.Second}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.clock == nil {
+		o.clock = &timetools.RealTime{}
+	}
+	return o, nil
+}
+
+type codeMeter struct {
+	r     *memmetrics.RatioCounter
+	codeS int
+	codeE int
+}
+
+// NewCodeMeter rates the servers by the ratio of their responses with a status code in [codeStart, codeEnd),
+// e.g. NewCodeMeter(429, 430) for the rate of throttled requests. The default meter of the rebalancer rates the 500 to 504.
+func NewCodeMeter(codeStart, codeEnd int, opts ...MeterOption) (Meter, error) {
+	if codeStart >= codeEnd {
+		return nil, fmt.Errorf("code range [%d, %d) is empty", codeStart, codeEnd)
+	}
+	o, err := newMeterOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := memmetrics.NewRatioCounter(o.buckets, o.resolution, memmetrics.RatioClock(o.clock))
+	if err != nil {
+		return nil, err
+	}
+	return &codeMeter{r: rc, codeS: codeStart, codeE: codeEnd}, nil
+}
+
+// Rating gets ratio
+func (n *codeMeter) Rating() float64 {
+	return n.r.Ratio()
+}
+
+// Record records a meter
+func (n *codeMeter) Record(code int, d time.Duration) {
+	if code >= n.codeS && code < n.codeE {
+		n.r.IncA(1)
+	} else {
+		n.r.IncB(1)
+	}
+}
+
+// IsReady returns true if the counter is ready
+func (n *codeMeter) IsReady() bool {
+	return n.r.IsReady()
+}
+
+// latency range of the histograms of the latency meter, in microseconds
+const (
+	latencyMin = 1
+	latencyMax = 3600000000
+)
+
+type latencyMeter struct {
+	quantile float64
+	hist     *memmetrics.RollingHDRHistogram
+	requests *memmetrics.RollingCounter
+}
+
+// NewLatencyMeter rates the servers by the latency of their responses at the quantile, in seconds,
+// e.g. NewLatencyMeter(99) for the 99th percentile
+func NewLatencyMeter(quantile float64, opts ...MeterOption) (Meter, error) {
+	if quantile <= 0 || quantile > 100 {
+		return nil, fmt.Errorf("quantile should be in ]0, 100]")
+	}
+	o, err := newMeterOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	hist, err := memmetrics.NewRollingHDRHistogram(latencyMin, latencyMax, 2, o.resolution, o.buckets, memmetrics.RollingClock(o.clock))
+	if err != nil {
+		return nil, err
+	}
+	requests, err := memmetrics.NewCounter(o.buckets, o.resolution, memmetrics.CounterClock(o.clock))
+	if err != nil {
+		return nil, err
+	}
+	return &latencyMeter{quantile: quantile, hist: hist, requests: requests}, nil
+}
+
+// Rating returns the latency at the quantile in seconds
+func (m *latencyMeter) Rating() float64 {
+	h, err := m.hist.Merged()
+	if err != nil {
+		return 0
+	}
+	return h.LatencyAtQuantile(m.quantile).Seconds()
+}
+
+// Record records the latency of a response
+func (m *latencyMeter) Record(code int, d time.Duration) {
+	if d < latencyMin*time.Microsecond {
+		d = latencyMin * time.Microsecond
+	} else if d > latencyMax*time.Microsecond {
+		d = latencyMax * time.Microsecond
+	}
+	m.hist.RecordLatencies(d, 1)
+	m.requests.Inc(1)
+}
+
+// IsReady returns true if the meter has recorded latencies over the whole window
+func (m *latencyMeter) IsReady() bool {
+	return m.requests.CountedBuckets() >= m.requests.Buckets()
+}
+
+// headerScale keeps 3 decimals of the values of the header meter in the integer counters
+const headerScale = 1000
+
+type headerMeter struct {
+	header string
+	sum    *memmetrics.RollingCounter
+	count  *memmetrics.RollingCounter
+}
+
+// NewHeaderMeter rates the servers by the average of the numeric value they report in a response header,
+// e.g. the depth of their request queue. The responses without a valid value are not counted.
+func NewHeaderMeter(header string, opts ...MeterOption) (ResponseMeter, error) {
+	if header == "" {
+		return nil, fmt.Errorf("header can not be empty")
+	}
+	o, err := newMeterOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := memmetrics.NewCounter(o.buckets, o.resolution, memmetrics.CounterClock(o.clock))
+	if err != nil {
+		return nil, err
+	}
+	count, err := memmetrics.NewCounter(o.buckets, o.resolution, memmetrics.CounterClock(o.clock))
+	if err != nil {
+		return nil, err
+	}
+	return &headerMeter{header: header, sum: sum, count: count}, nil
+}
+
+// Rating returns the average value of the header
+func (m *headerMeter) Rating() float64 {
+	count := m.count.Count()
+	if count == 0 {
+		return 0
+	}
+	return float64(m.sum.Count()) / float64(count) / headerScale
+}
+
+// Record does nothing, the values are read from the response headers
+func (m *headerMeter) Record(code int, d time.Duration) {}
+
+// RecordResponse records the value of the header of the response
+func (m *headerMeter) RecordResponse(code int, d time.Duration, header http.Header) {
+	value, err := strconv.ParseFloat(header.Get(m.header), 64)
+	if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	m.sum.Inc(int(value * headerScale))
+	m.count.Inc(1)
+}
+
+// IsReady returns true if the meter has recorded values over the whole window
+func (m *headerMeter) IsReady() bool {
+	return m.count.CountedBuckets() >= m.count.Buckets()
+}
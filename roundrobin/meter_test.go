@@ -0,0 +1,146 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestCodeMeter(t *testing.T) {
+	clock := testutils.GetClock()
+
+	m, err := NewCodeMeter(http.StatusTooManyRequests, http.StatusTooManyRequests+1, MeterClock(clock), MeterWindow(2, time.Second))
+	require.NoError(t, err)
+
+	m.Record(http.StatusTooManyRequests, time.Millisecond)
+	m.Record(http.StatusOK, time.Millisecond)
+	m.Record(http.StatusInternalServerError, time.Millisecond)
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	m.Record(http.StatusTooManyRequests, time.Millisecond)
+	assert.True(t, m.IsReady())
+	assert.Equal(t, 0.5, m.Rating())
+
+	_, err = NewCodeMeter(500, 500)
+	assert.Error(t, err)
+}
+
+func TestLatencyMeter(t *testing.T) {
+	clock := testutils.GetClock()
+
+	m, err := NewLatencyMeter(90, MeterClock(clock), MeterWindow(2, time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), m.Rating())
+
+	for i := 1; i <= 10; i++ {
+		m.Record(http.StatusOK, time.Duration(i)*100*time.Millisecond)
+	}
+	assert.False(t, m.IsReady())
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	m.Record(http.StatusOK, 0)
+	assert.True(t, m.IsReady())
+	assert.InDelta(t, 0.9, m.Rating(), 0.01)
+
+	_, err = NewLatencyMeter(0)
+	assert.Error(t, err)
+
+	_, err = NewLatencyMeter(50, MeterWindow(10, time.Millisecond))
+	assert.Error(t, err)
+
+	_, err = NewLatencyMeter(50, MeterWindow(1, time.Second))
+	assert.Error(t, err)
+}
+
+func TestHeaderMeter(t *testing.T) {
+	clock := testutils.GetClock()
+
+	m, err := NewHeaderMeter("X-Queue-Depth", MeterClock(clock), MeterWindow(2, time.Second))
+	require.NoError(t, err)
+
+	record := func(value string) {
+		h := make(http.Header)
+		if value != "" {
+			h.Set("X-Queue-Depth", value)
+		}
+		m.RecordResponse(http.StatusOK, time.Millisecond, h)
+	}
+	record("2")
+	record("")
+	record("bogus")
+	record("NaN")
+	record("-1")
+	assert.False(t, m.IsReady())
+
+	clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	record("5")
+	assert.True(t, m.IsReady())
+	assert.Equal(t, 3.5, m.Rating())
+
+	_, err = NewHeaderMeter("")
+	assert.Error(t, err)
+}
+
+func TestRebalancerServerMeter(t *testing.T) {
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Queue-Depth", "50")
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Queue-Depth", "1")
+		w.Write([]byte("b"))
+	})
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	rb, err := NewRebalancer(lb, RebalancerClock(clock))
+	require.NoError(t, err)
+
+	newMeter := func() ResponseMeter {
+		m, err := NewHeaderMeter("X-Queue-Depth", MeterClock(clock), MeterWindow(2, time.Second))
+		require.NoError(t, err)
+		return m
+	}
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL), ServerMeter(newMeter())))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL), ServerMeter(newMeter())))
+
+	// the weight and the meter of a server are updated in place
+	meter := newMeter()
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL), ServerMeter(meter)))
+	require.Len(t, rb.servers, 2)
+	assert.Equal(t, meter, rb.servers[1].meter)
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 4; i++ {
+			_, _, err = testutils.Get(proxy.URL)
+			require.NoError(t, err)
+		}
+		clock.CurrentTime = clock.CurrentTime.Add(time.Second)
+	}
+
+	stats := rb.ServersStats()
+	assert.Equal(t, float64(50), stats.Servers[0].Rating)
+	assert.Equal(t, float64(1), stats.Servers[1].Rating)
+	assert.Equal(t, 1, stats.Servers[0].Weight)
+	assert.True(t, stats.Servers[1].Weight > 1)
+
+	assert.Error(t, rb.UpsertServer(testutils.ParseURI(a.URL), ServerMeter(nil)))
+}
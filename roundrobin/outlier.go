@@ -0,0 +1,104 @@
+package roundrobin
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// RebalancerOutlierEjection makes the rebalancer eject a server from the load balancer after consecutiveErrors
+// 5xx responses in a row, network errors included. Once coolDown has elapsed, the server receives probeRatio
+// of the requests (0 < probeRatio <= 1) until one of them succeeds, which restores the server, or fails,
+// which ejects it for another coolDown. The last server in rotation is never ejected.
+func RebalancerOutlierEjection(consecutiveErrors int, coolDown time.Duration, probeRatio float64) RebalancerOption {
+	return func(rb *Rebalancer) error {
+		if consecutiveErrors < 1 {
+			return fmt.Errorf("consecutive errors should be >= 1")
+		}
+		if coolDown <= 0 {
+			return fmt.Errorf("cool down should be > 0")
+		}
+		if probeRatio <= 0 || probeRatio > 1 {
+			return fmt.Errorf("probe ratio should be in ]0, 1]")
+		}
+		rb.outlierErrors = consecutiveErrors
+		rb.outlierCoolDown = coolDown
+		rb.outlierProbeRatio = probeRatio
+		return nil
+	}
+}
+
+// effectiveWeight is the weight the server has in the load balancer, ejected servers get none
+func (s *rbServer) effectiveWeight() int {
+	if s.ejected {
+		return 0
+	}
+	return s.curWeight
+}
+
+// recordOutcome tracks the consecutive errors of the server and ejects or restores it
+func (rb *Rebalancer) recordOutcome(srv *rbServer, code int) {
+	if rb.outlierErrors == 0 {
+		return
+	}
+
+	if code < http.StatusInternalServerError {
+		srv.consecutiveErrors = 0
+		if srv.ejected {
+			rb.log.Infof("vulcand/oxy/roundrobin/rebalancer: probe succeeded, restoring server %v", srv.url)
+			srv.ejected = false
+			rb.next.UpsertServer(srv.url, Weight(srv.effectiveWeight()))
+			rb.decide(DecisionRestore, srv, false)
+		}
+		return
+	}
+
+	srv.consecutiveErrors++
+	if srv.ejected {
+		// the probe failed, wait for another cool down
+		srv.ejectedUntil = rb.clock.UtcNow().Add(rb.outlierCoolDown)
+		return
+	}
+	if srv.consecutiveErrors < rb.outlierErrors || rb.inRotation() <= 1 {
+		return
+	}
+
+	rb.log.Warnf("vulcand/oxy/roundrobin/rebalancer: ejecting server %v after %d consecutive errors", srv.url, srv.consecutiveErrors)
+	srv.ejected = true
+	srv.ejectedUntil = rb.clock.UtcNow().Add(rb.outlierCoolDown)
+	rb.next.UpsertServer(srv.url, Weight(0))
+	rb.decide(DecisionEject, srv, false)
+}
+
+// inRotation counts the servers that are not ejected
+func (rb *Rebalancer) inRotation() int {
+	count := 0
+	for _, s := range rb.servers {
+		if !s.ejected {
+			count++
+		}
+	}
+	return count
+}
+
+// probeServer picks an ejected server whose cool down has elapsed for probeRatio of the requests
+func (rb *Rebalancer) probeServer() *url.URL {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	if rb.outlierErrors == 0 {
+		return nil
+	}
+
+	now := rb.clock.UtcNow()
+	for _, s := range rb.servers {
+		if s.ejected && !now.Before(s.ejectedUntil) && rand.Float64() < rb.outlierProbeRatio {
+			return utils.CopyURL(s.url)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultErrorPenalty = time.Second
+
+// P2COption provides options for the power of two choices load balancer
+type P2COption func(*P2C) error
+
+// P2CErrorHandler is a functional argument that sets error handler of the server
+func P2CErrorHandler(h utils.ErrorHandler) P2COption {
+	return func(p *P2C) error {
+		p.errHandler = h
+		return nil
+	}
+}
+
+// P2CStickySession sets a sticky session
+func P2CStickySession(stickySession *StickySession) P2COption {
+	return func(p *P2C) error {
+		p.stickySession = stickySession
+		return nil
+	}
+}
+
+// P2CRequestRewriteListener is a functional argument that sets a request rewrite listener
+func P2CRequestRewriteListener(rrl RequestRewriteListener) P2COption {
+	return func(p *P2C) error {
+		p.requestRewriteListener = rrl
+		return nil
+	}
+}
+
+// P2CLogger defines the logger the power of two choices load balancer will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func P2CLogger(l *log.Logger) P2COption {
+	return func(p *P2C) error {
+		p.log = l
+		return nil
+	}
+}
+
+// P2CLatency makes the load balancer compare the servers by their response time too: it keeps a moving average of
+// the response time of every server, forgetting the responses with the decay period, and sends the request to the
+// server of the two sampled with the lower average times its requests in flight plus one. The average follows the
+// slower responses at once and recovers from them with the decay, so that a server slowing down is avoided right
+// away. The servers with no response yet are preferred, to measure them.
+func P2CLatency(decay time.Duration) P2COption {
+	return func(p *P2C) error {
+		if decay <= 0 {
+			return fmt.Errorf("decay should be > 0, got %v", decay)
+		}
+		p.decay = decay
+		return nil
+	}
+}
+
+// P2CErrorPenalty sets the response time the errors, i.e. the responses with a 5xx status code, are accounted for
+// when they are faster, so that the failing servers are avoided by P2CLatency. It defaults to a second.
+func P2CErrorPenalty(penalty time.Duration) P2COption {
+	return func(p *P2C) error {
+		if penalty < 0 {
+			return fmt.Errorf("error penalty should be >= 0, got %v", penalty)
+		}
+		p.errorPenalty = penalty
+		return nil
+	}
+}
+
+// P2CClock sets the clock measuring the response times
+func P2CClock(clock timetools.TimeProvider) P2COption {
+	return func(p *P2C) error {
+		p.clock = clock
+		return nil
+	}
+}
+
+// P2C implements a load balancer http handler sampling two random servers for each request and sending it to the
+// one with the fewer in-flight requests relative to its weight. Unlike LeastConn it needs no view of the load of
+// all the servers, so that the busy servers are avoided without all the requests herding to the least loaded one,
+// which copes well with servers of heterogeneous performance.
+type P2C struct {
+	mutex                  *sync.Mutex
+	next                   http.Handler
+	errHandler             utils.ErrorHandler
+	servers                []*server
+	stickySession          *StickySession
+	requestRewriteListener RequestRewriteListener
+	inflight               utils.Inflight
+	// Decay period of the response times, 0 if they are not measured
+	decay        time.Duration
+	errorPenalty time.Duration
+	clock        timetools.TimeProvider
+
+	log *log.Logger
+}
+
+// NewP2C creates a new P2C
+func NewP2C(next http.Handler, opts ...P2COption) (*P2C, error) {
+	p := &P2C{
+		next:    next,
+		mutex:   &sync.Mutex{},
+		servers: []*server{},
+
+		errorPenalty: defaultErrorPenalty,
+		clock:        &timetools.RealTime{},
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(p); err != nil {
+			return nil, err
+		}
+	}
+	if p.errHandler == nil {
+		p.errHandler = utils.DefaultHandler
+	}
+	return p, nil
+}
+
+// Next returns the next handler, the in-flight requests going through it are accounted to their server.
+func (p *P2C) Next() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.acquire(req.URL)
+		defer p.release(req.URL)
+		p.serve(w, req)
+	})
+}
+
+// serve forwards the request to the next handler, measuring the response time of the server if needed
+func (p *P2C) serve(w http.ResponseWriter, req *http.Request) {
+	if p.decay == 0 {
+		p.next.ServeHTTP(w, req)
+		return
+	}
+
+	pw := utils.NewProxyWriter(w)
+	start := p.clock.UtcNow()
+	p.next.ServeHTTP(pw, req)
+	p.record(req.URL, pw.StatusCode(), p.clock.UtcNow().Sub(start))
+}
+
+// record adds the response time of a request to the average of its server
+func (p *P2C) record(u *url.URL, code int, latency time.Duration) {
+	if code >= http.StatusInternalServerError && latency < p.errorPenalty {
+		latency = p.errorPenalty
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if s, _ := p.findServerByURL(u); s != nil && s.latency != nil {
+		s.latency.Update(float64(latency))
+	}
+}
+
+// ServerLatency gets the average response time of the server, 0 if it is not measured
+func (p *P2C) ServerLatency(u *url.URL) (time.Duration, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	s, _ := p.findServerByURL(u)
+	if s == nil {
+		return -1, false
+	}
+	if s.latency == nil {
+		return 0, true
+	}
+	return time.Duration(s.latency.Value()), true
+}
+
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete. It returns the error of the context if it is done first.
+func (p *P2C) Shutdown(ctx context.Context) error {
+	return p.inflight.Shutdown(ctx)
+}
+
+func (p *P2C) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !p.inflight.Acquire() {
+		p.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer p.inflight.Release()
+
+	if p.log.Level >= log.DebugLevel {
+		logEntry := p.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/roundrobin/p2c: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/roundrobin/p2c: completed ServeHttp on request")
+	}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	stuck := false
+	if p.stickySession != nil {
+		cookieURL, present, err := p.stickySession.GetBackend(&newReq, availableServers(p))
+
+		if err == ErrStickyBackendGone {
+			p.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		if err != nil {
+			p.log.Warnf("vulcand/oxy/roundrobin/p2c: error using server from cookie: %v", err)
+		}
+
+		if present {
+			newReq.URL = cookieURL
+			stuck = true
+			p.acquire(cookieURL)
+		}
+	}
+
+	if !stuck {
+		// the server is picked and accounted for atomically so that concurrent requests spread out
+		srv, err := p.nextServer(true)
+		if err != nil {
+			p.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		newReq.URL = utils.CopyURL(srv.url)
+
+		if p.stickySession != nil {
+			p.stickySession.StickRequest(req, newReq.URL, &w)
+		}
+	}
+	defer p.release(newReq.URL)
+
+	if p.log.Level >= log.DebugLevel {
+		// log which backend URL we're sending this request to
+		p.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/p2c: Forwarding this request to URL")
+	}
+
+	// Emit event to a listener if one exists
+	if p.requestRewriteListener != nil {
+		p.requestRewriteListener(req, &newReq)
+	}
+
+	p.serve(w, &newReq)
+}
+
+// NextServer gets the less loaded of two random servers
+func (p *P2C) NextServer() (*url.URL, error) {
+	srv, err := p.nextServer(false)
+	if err != nil {
+		return nil, err
+	}
+	return utils.CopyURL(srv.url), nil
+}
+
+func (p *P2C) nextServer(acquire bool) (*server, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.servers) == 0 {
+		return nil, fmt.Errorf("no servers in the pool")
+	}
+
+	available := make([]*server, 0, len(p.servers))
+	for _, srv := range p.servers {
+		if srv.weight > 0 {
+			available = append(available, srv)
+		}
+	}
+	if len(available) == 0 {
+		return nil, fmt.Errorf("all servers have 0 weight")
+	}
+
+	less := func(a, b *server) bool {
+		// compares inflight/weight ratios without divisions
+		return a.inflight*b.weight < b.inflight*a.weight
+	}
+	if p.decay > 0 {
+		less = func(a, b *server) bool {
+			return latencyCost(a)*float64(b.weight) < latencyCost(b)*float64(a.weight)
+		}
+	}
+	best := pickTwo(available, less)
+	if acquire {
+		best.inflight++
+	}
+	return best, nil
+}
+
+// pickTwo samples two distinct servers and returns the first one unless the second one is less loaded
+func pickTwo(servers []*server, less func(a, b *server) bool) *server {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	i := rand.Intn(len(servers))
+	j := rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	if less(servers[j], servers[i]) {
+		return servers[j]
+	}
+	return servers[i]
+}
+
+// latencyCost rates the load of the server by its average response time times its requests in flight plus one,
+// the servers with no response yet cost their requests in flight only
+func latencyCost(s *server) float64 {
+	return (s.latency.Value() + 1) * float64(s.inflight+1)
+}
+
+func (p *P2C) acquire(u *url.URL) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if s, _ := p.findServerByURL(u); s != nil {
+		s.inflight++
+	}
+}
+
+func (p *P2C) release(u *url.URL) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if s, _ := p.findServerByURL(u); s != nil && s.inflight > 0 {
+		s.inflight--
+	}
+}
+
+// InFlight gets the number of requests being served by the server
+func (p *P2C) InFlight(u *url.URL) (int, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if s, _ := p.findServerByURL(u); s != nil {
+		return s.inflight, true
+	}
+	return -1, false
+}
+
+// RemoveServer remove a server
+func (p *P2C) RemoveServer(u *url.URL) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	e, index := p.findServerByURL(u)
+	if e == nil {
+		return fmt.Errorf("server not found")
+	}
+	p.servers = append(p.servers[:index], p.servers[index+1:]...)
+	return nil
+}
+
+// Servers gets servers URL
+func (p *P2C) Servers() []*url.URL {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	out := make([]*url.URL, len(p.servers))
+	for i, srv := range p.servers {
+		out[i] = srv.url
+	}
+	return out
+}
+
+// ServerWeight gets the server weight
+func (p *P2C) ServerWeight(u *url.URL) (int, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if s, _ := p.findServerByURL(u); s != nil {
+		return s.weight, true
+	}
+	return -1, false
+}
+
+// UpsertServer adds a server or updates its options if it is already present in the load balancer
+func (p *P2C) UpsertServer(u *url.URL, options ...ServerOption) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if u == nil {
+		return fmt.Errorf("server URL can't be nil")
+	}
+
+	if s, _ := p.findServerByURL(u); s != nil {
+		for _, o := range options {
+			if err := o(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	srv := &server{url: utils.CopyURL(u)}
+	for _, o := range options {
+		if err := o(srv); err != nil {
+			return err
+		}
+	}
+
+	if srv.weight == 0 {
+		srv.weight = defaultWeight
+	}
+
+	if p.decay > 0 {
+		latency, err := memmetrics.NewEWMA(p.decay, memmetrics.EWMAClock(p.clock), memmetrics.EWMAPeak())
+		if err != nil {
+			return err
+		}
+		srv.latency = latency
+	}
+
+	p.servers = append(p.servers, srv)
+	return nil
+}
+
+func (p *P2C) findServerByURL(u *url.URL) (*server, int) {
+	for i, s := range p.servers {
+		if sameURL(u, s.url) {
+			return s, i
+		}
+	}
+	return nil, -1
+}
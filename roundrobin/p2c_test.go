@@ -0,0 +1,178 @@
+package roundrobin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestP2CNoServers(t *testing.T) {
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := NewP2C(fwd)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+}
+
+func TestP2CAvoidsBusyServer(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+	b := testutils.NewResponder("b")
+	defer b.Close()
+	c := testutils.NewResponder("c")
+	defer c.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := NewP2C(fwd)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(c.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// the busy server loses against any of the two others
+	lb.acquire(testutils.ParseURI(a.URL))
+	for _, body := range seq(t, proxy.URL, 20) {
+		assert.NotEqual(t, "a", body)
+	}
+
+	lb.release(testutils.ParseURI(a.URL))
+	n, ok := lb.InFlight(testutils.ParseURI(a.URL))
+	assert.True(t, ok)
+	assert.Equal(t, 0, n)
+}
+
+func TestP2CWeighted(t *testing.T) {
+	lb, err := NewP2C(nil)
+	require.NoError(t, err)
+
+	a, b := testutils.ParseURI("http://a"), testutils.ParseURI("http://b")
+	require.NoError(t, lb.UpsertServer(a, Weight(3)))
+	require.NoError(t, lb.UpsertServer(b, Weight(1)))
+
+	// a can take three times as many requests as b
+	for i := 0; i < 2; i++ {
+		lb.acquire(a)
+	}
+	lb.acquire(b)
+	for i := 0; i < 10; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		assert.Equal(t, a.String(), u.String())
+	}
+
+	require.NoError(t, lb.UpsertServer(a, Weight(0)))
+	u, err := lb.NextServer()
+	require.NoError(t, err)
+	assert.Equal(t, b.String(), u.String())
+
+	require.NoError(t, lb.UpsertServer(b, Weight(0)))
+	_, err = lb.NextServer()
+	assert.Error(t, err)
+}
+
+func TestP2CSpread(t *testing.T) {
+	lb, err := NewP2C(nil)
+	require.NoError(t, err)
+
+	for _, u := range []string{"http://a", "http://b", "http://c", "http://d"} {
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(u)))
+	}
+
+	// the requests kept in flight spread over the servers evenly
+	for i := 0; i < 400; i++ {
+		_, err := lb.nextServer(true)
+		require.NoError(t, err)
+	}
+	for _, u := range lb.Servers() {
+		n, _ := lb.InFlight(u)
+		assert.True(t, n >= 95 && n <= 105, "%v has %d requests", u, n)
+	}
+}
+
+func TestP2CLatency(t *testing.T) {
+	slow := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("slow"))
+	})
+	defer slow.Close()
+	fast := testutils.NewResponder("fast")
+	defer fast.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := NewP2C(fwd, P2CLatency(10*time.Second))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(slow.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(fast.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	// once both servers are measured the slow one is avoided
+	bodies := seq(t, proxy.URL, 20)
+	assert.True(t, count(bodies, "slow") <= 2, "slow server got %d requests", count(bodies, "slow"))
+
+	latency, ok := lb.ServerLatency(testutils.ParseURI(slow.URL))
+	assert.True(t, ok)
+	assert.True(t, latency >= 20*time.Millisecond, "%v", latency)
+}
+
+func TestP2CLatencyErrorPenalty(t *testing.T) {
+	lb, err := NewP2C(nil, P2CLatency(10*time.Second), P2CErrorPenalty(time.Second))
+	require.NoError(t, err)
+
+	a, b := testutils.ParseURI("http://a"), testutils.ParseURI("http://b")
+	require.NoError(t, lb.UpsertServer(a))
+	require.NoError(t, lb.UpsertServer(b))
+
+	lb.record(a, http.StatusOK, 100*time.Millisecond)
+	lb.record(b, http.StatusOK, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		assert.Equal(t, b.String(), u.String())
+	}
+
+	// the fast errors count as slow responses
+	lb.record(b, http.StatusBadGateway, time.Millisecond)
+	latency, ok := lb.ServerLatency(b)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, latency)
+	for i := 0; i < 10; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		assert.Equal(t, a.String(), u.String())
+	}
+
+	_, ok = lb.ServerLatency(testutils.ParseURI("http://c"))
+	assert.False(t, ok)
+}
+
+func TestP2CLatencyOptions(t *testing.T) {
+	_, err := NewP2C(nil, P2CLatency(0))
+	assert.Error(t, err)
+
+	_, err = NewP2C(nil, P2CErrorPenalty(-time.Second))
+	assert.Error(t, err)
+}
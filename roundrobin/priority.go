@@ -0,0 +1,37 @@
+package roundrobin
+
+import "fmt"
+
+// Priority sets the priority of the server, 0 being the highest and the default. The requests are sent to the
+// available servers of the highest priority only, the servers of lower priorities being backups taking over once
+// all the servers of higher priorities are removed, e.g. by the health checker, or draining or without weight.
+// The traffic fails back as soon as a server of a higher priority is available again.
+func Priority(p int) ServerOption {
+	return func(s *server) error {
+		if p < 0 {
+			return fmt.Errorf("priority should be >= 0, got %d", p)
+		}
+		s.priority = p
+		return nil
+	}
+}
+
+// priorityFilter returns the candidate servers of the highest priority having an available server.
+// It has to be called with the mutex held.
+func (r *RoundRobin) priorityFilter(candidates func(*server) bool) func(*server) bool {
+	best := -1
+	for _, s := range r.servers {
+		if s.weight == 0 || s.drained != nil || !candidates(s) {
+			continue
+		}
+		if best == -1 || s.priority < best {
+			best = s.priority
+		}
+	}
+	if best == -1 {
+		return candidates
+	}
+	return func(s *server) bool {
+		return candidates(s) && s.priority == best
+	}
+}
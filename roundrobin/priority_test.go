@@ -0,0 +1,50 @@
+package roundrobin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestPriority(t *testing.T) {
+	for _, smooth := range []bool{false, true} {
+		var opts []LBOption
+		if smooth {
+			opts = append(opts, SmoothWeighting())
+		}
+		lb, err := New(nil, opts...)
+		require.NoError(t, err)
+
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a1")))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a2"), Priority(0)))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b1"), Priority(1)))
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://c1"), Priority(2), Weight(2)))
+
+		assert.Equal(t, []string{"a1", "a2", "a1", "a2"}, nextHosts(t, lb, 4))
+
+		// the primaries still available keep the traffic
+		require.NoError(t, lb.RemoveServer(testutils.ParseURI("http://a1")))
+		assert.Equal(t, []string{"a2", "a2"}, nextHosts(t, lb, 2))
+
+		// failover to the next priority with an available server
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a2"), Weight(0)))
+		assert.Equal(t, []string{"b1", "b1"}, nextHosts(t, lb, 2))
+
+		_, err = lb.DrainServer(testutils.ParseURI("http://b1"), 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"c1", "c1"}, nextHosts(t, lb, 2))
+
+		// failback once a primary is back
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a1")))
+		assert.Equal(t, []string{"a1", "a1"}, nextHosts(t, lb, 2))
+	}
+}
+
+func TestPriorityOption(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	assert.Error(t, lb.UpsertServer(testutils.ParseURI("http://a1"), Priority(-1)))
+}
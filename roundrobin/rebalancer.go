@@ -1,16 +1,17 @@
 package roundrobin
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
 	"time"
 
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/utils"
 	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/memmetrics"
-	"github.com/vulcand/oxy/utils"
 )
 
 // RebalancerOption - functional option setter for rebalancer
@@ -23,6 +24,13 @@ type Meter interface {
 	IsReady() bool
 }
 
+// ResponseMeter is a Meter that also rates the servers by the headers of their responses,
+// the rebalancer calls RecordResponse instead of Record on the meters implementing it
+type ResponseMeter interface {
+	Meter
+	RecordResponse(code int, latency time.Duration, header http.Header)
+}
+
 // NewMeterFn type of functions to create new Meter
 type NewMeterFn func() (Meter, error)
 
@@ -54,7 +62,19 @@ type Rebalancer struct {
 
 	requestRewriteListener RequestRewriteListener
 
-	log *log.Logger
+	inflight utils.Inflight
+
+	// outlier ejection settings, disabled when outlierErrors is 0
+	outlierErrors     int
+	outlierCoolDown   time.Duration
+	outlierProbeRatio float64
+
+	// decisionLog is called with every change of the weights, lastDecision is the last one
+	decisionLog  func(RebalancerDecision)
+	lastDecision *RebalancerDecision
+
+	log    *log.Logger
+	logger utils.Logger
 }
 
 // RebalancerClock sets a clock
@@ -127,20 +147,15 @@ func NewRebalancer(handler balancerHandler, opts ...RebalancerOption) (*Rebalanc
 	}
 	if rb.newMeter == nil {
 		rb.newMeter = func() (Meter, error) {
-			rc, err := memmetrics.NewRatioCounter(10, time.Second, memmetrics.RatioClock(rb.clock))
-			if err != nil {
-				return nil, err
-			}
-			return &codeMeter{
-				r:     rc,
-				codeS: http.StatusInternalServerError,
-				codeE: http.StatusGatewayTimeout + 1,
-			}, nil
+			return NewCodeMeter(http.StatusInternalServerError, http.StatusGatewayTimeout+1, MeterClock(rb.clock))
 		}
 	}
 	if rb.errHandler == nil {
 		rb.errHandler = utils.DefaultHandler
 	}
+	if rb.logger == nil {
+		rb.logger = utils.NewLogrusLogger(rb.log)
+	}
 	return rb, nil
 }
 
@@ -154,6 +169,17 @@ func RebalancerLogger(l *log.Logger) RebalancerOption {
 	}
 }
 
+// RebalancerStructuredLogger defines the structured logger the rebalancer logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by RebalancerLogger.
+func RebalancerStructuredLogger(l utils.Logger) RebalancerOption {
+	return func(rb *Rebalancer) error {
+		rb.logger = l
+		return nil
+	}
+}
+
 // Servers gets all servers
 func (rb *Rebalancer) Servers() []*url.URL {
 	rb.mtx.Lock()
@@ -162,11 +188,25 @@ func (rb *Rebalancer) Servers() []*url.URL {
 	return rb.next.Servers()
 }
 
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete. It returns the error of the context if it is done first.
+// The internal load balancer is not shut down, the rebalancer forwards to its servers directly.
+func (rb *Rebalancer) Shutdown(ctx context.Context) error {
+	return rb.inflight.Shutdown(ctx)
+}
+
 func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if rb.log.Level >= log.DebugLevel {
-		logEntry := rb.log.WithField("Request", utils.DumpHttpRequest(req))
-		logEntry.Debug("vulcand/oxy/roundrobin/rebalancer: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/roundrobin/rebalancer: completed ServeHttp on request")
+	if !rb.inflight.Acquire() {
+		rb.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer rb.inflight.Release()
+
+	logger := utils.RequestLogger(req, rb.logger)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req)})
+		logEntry.Debugf("vulcand/oxy/roundrobin/rebalancer: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/roundrobin/rebalancer: completed ServeHttp on request")
 	}
 
 	pw := utils.NewProxyWriter(w)
@@ -175,38 +215,49 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// make shallow copy of request before changing anything to avoid side effects
 	newReq := *req
 	stuck := false
+	attempts := utils.ServerAttemptsFromRequest(req)
 
 	if rb.stickySession != nil {
-		cookieUrl, present, err := rb.stickySession.GetBackend(&newReq, rb.Servers())
+		cookieUrl, present, err := rb.stickySession.GetBackend(&newReq, availableServers(rb.next))
 
+		if err == ErrStickyBackendGone {
+			rb.errHandler.ServeHTTP(w, req, err)
+			return
+		}
 		if err != nil {
-			log.Warnf("vulcand/oxy/roundrobin/rebalancer: error using server from cookie: %v", err)
+			logger.Warnf("vulcand/oxy/roundrobin/rebalancer: error using server from cookie: %v", err)
 		}
 
-		if present {
+		// a replayed request leaves the server it is stuck to if it was tried already
+		if present && !attempts.Tried(cookieUrl) {
 			newReq.URL = cookieUrl
 			stuck = true
 		}
 	}
 
 	if !stuck {
-		fwdURL, err := rb.next.NextServer()
-		if err != nil {
-			rb.errHandler.ServeHTTP(w, req, err)
-			return
+		fwdURL := rb.probeServer()
+		if fwdURL == nil || attempts.Tried(fwdURL) {
+			var err error
+			fwdURL, err = nextUntriedServer(attempts, len(rb.next.Servers()), rb.next.NextServer)
+			if err != nil {
+				rb.errHandler.ServeHTTP(w, req, err)
+				return
+			}
 		}
 
-		if log.GetLevel() >= log.DebugLevel {
+		if logger.DebugEnabled() {
 			// log which backend URL we're sending this request to
-			log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": fwdURL}).Debugf("vulcand/oxy/roundrobin/rebalancer: Forwarding this request to URL")
+			logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": fwdURL}).Debugf("vulcand/oxy/roundrobin/rebalancer: Forwarding this request to URL")
 		}
 
 		if rb.stickySession != nil {
-			rb.stickySession.StickBackend(fwdURL, &w)
+			rb.stickySession.StickRequest(req, fwdURL, &w)
 		}
 
 		newReq.URL = fwdURL
 	}
+	attempts.Add(newReq.URL)
 
 	// Emit event to a listener if one exists
 	if rb.requestRewriteListener != nil {
@@ -215,25 +266,31 @@ func (rb *Rebalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	rb.next.Next().ServeHTTP(pw, &newReq)
 
-	rb.recordMetrics(newReq.URL, pw.StatusCode(), rb.clock.UtcNow().Sub(start))
+	rb.recordMetrics(newReq.URL, pw.StatusCode(), rb.clock.UtcNow().Sub(start), pw.Header())
 	rb.adjustWeights()
 }
 
-func (rb *Rebalancer) recordMetrics(u *url.URL, code int, latency time.Duration) {
+func (rb *Rebalancer) recordMetrics(u *url.URL, code int, latency time.Duration, header http.Header) {
 	rb.mtx.Lock()
 	defer rb.mtx.Unlock()
 	if srv, i := rb.findServer(u); i != -1 {
-		srv.meter.Record(code, latency)
+		if m, ok := srv.meter.(ResponseMeter); ok {
+			m.RecordResponse(code, latency, header)
+		} else {
+			srv.meter.Record(code, latency)
+		}
+		rb.recordOutcome(srv, code)
 	}
 }
 
 func (rb *Rebalancer) reset() {
 	for _, s := range rb.servers {
 		s.curWeight = s.origWeight
-		rb.next.UpsertServer(s.url, Weight(s.origWeight))
+		rb.next.UpsertServer(s.url, Weight(s.effectiveWeight()))
 	}
 	rb.timer = rb.clock.UtcNow().Add(-1 * time.Second)
 	rb.ratings = make([]float64, len(rb.servers))
+	rb.decide(DecisionReset, nil, false)
 }
 
 // Wrap sets the next handler to be called by rebalancer handler.
@@ -254,7 +311,7 @@ func (rb *Rebalancer) UpsertServer(u *url.URL, options ...ServerOption) error {
 		return err
 	}
 	weight, _ := rb.next.ServerWeight(u)
-	if err := rb.upsertServer(u, weight); err != nil {
+	if err := rb.upsertServer(u, weight, serverMeter(options)); err != nil {
 		rb.next.RemoveServer(u)
 		return err
 	}
@@ -283,13 +340,20 @@ func (rb *Rebalancer) removeServer(u *url.URL) error {
 	return nil
 }
 
-func (rb *Rebalancer) upsertServer(u *url.URL, weight int) error {
+// upsertServer adds the server with its meter, or a new meter if it is nil
+func (rb *Rebalancer) upsertServer(u *url.URL, weight int, meter Meter) error {
 	if s, i := rb.findServer(u); i != -1 {
 		s.origWeight = weight
+		if meter != nil {
+			s.meter = meter
+		}
+		return nil
 	}
-	meter, err := rb.newMeter()
-	if err != nil {
-		return err
+	if meter == nil {
+		var err error
+		if meter, err = rb.newMeter(); err != nil {
+			return err
+		}
 	}
 	rbSrv := &rbServer{
 		url:        utils.CopyURL(u),
@@ -343,8 +407,8 @@ func (rb *Rebalancer) adjustWeights() {
 
 func (rb *Rebalancer) applyWeights() {
 	for _, srv := range rb.servers {
-		rb.log.Debugf("upsert server %v, weight %v", srv.url, srv.curWeight)
-		rb.next.UpsertServer(srv.url, Weight(srv.curWeight))
+		rb.log.Debugf("upsert server %v, weight %v", srv.url, srv.effectiveWeight())
+		rb.next.UpsertServer(srv.url, Weight(srv.effectiveWeight()))
 	}
 }
 
@@ -364,6 +428,7 @@ func (rb *Rebalancer) setMarkedWeights() bool {
 	if changed {
 		rb.normalizeWeights()
 		rb.applyWeights()
+		rb.decide(DecisionIncrease, nil, true)
 		return true
 	}
 	return false
@@ -416,7 +481,7 @@ func (rb *Rebalancer) convergeWeights() bool {
 		}
 		changed = true
 		newWeight := decrease(s.origWeight, s.curWeight)
-		log.Debugf("decreasing weight of %v from %v to %v", s.url, s.curWeight, newWeight)
+		rb.log.Debugf("decreasing weight of %v from %v to %v", s.url, s.curWeight, newWeight)
 		s.curWeight = newWeight
 	}
 	if !changed {
@@ -424,6 +489,7 @@ func (rb *Rebalancer) convergeWeights() bool {
 	}
 	rb.normalizeWeights()
 	rb.applyWeights()
+	rb.decide(DecisionConverge, nil, true)
 	return true
 }
 
@@ -468,6 +534,10 @@ type rbServer struct {
 	curWeight  int // current weight
 	good       bool
 	meter      Meter
+
+	consecutiveErrors int       // 5xx responses in a row
+	ejected           bool      // taken out of the load balancer by the outlier ejection
+	ejectedUntil      time.Time // end of the cool down, the server is probed afterwards
 }
 
 const (
@@ -477,30 +547,5 @@ const (
 	FSMGrowFactor = 4
 )
 
-type codeMeter struct {
-	r     *memmetrics.RatioCounter
-	codeS int
-	codeE int
-}
-
-// Rating gets ratio
-func (n *codeMeter) Rating() float64 {
-	return n.r.Ratio()
-}
-
-// Record records a meter
-func (n *codeMeter) Record(code int, d time.Duration) {
-	if code >= n.codeS && code < n.codeE {
-		n.r.IncA(1)
-	} else {
-		n.r.IncB(1)
-	}
-}
-
-// IsReady returns true if the counter is ready
-func (n *codeMeter) IsReady() bool {
-	return n.r.IsReady()
-}
-
 // splitThreshold tells how far the value should go from the median + median absolute deviation before it is considered an outlier
 const splitThreshold = 1.5
@@ -444,3 +444,81 @@ func (tm *testMeter) Record(int, time.Duration) {
 func (tm *testMeter) IsReady() bool {
 	return !tm.notReady
 }
+
+func TestRebalancerOutlierEjection(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+
+	b := newHealthServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	rb, err := NewRebalancer(lb, RebalancerClock(clock), RebalancerOutlierEjection(2, 10*time.Second, 1))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	a.setStatus(http.StatusInternalServerError)
+
+	// a fails twice in a row and gets ejected
+	assert.Equal(t, []string{"a", "b", "a", "b", "b", "b"}, seq(t, proxy.URL, 6))
+	assert.True(t, rb.servers[0].ejected)
+	assert.Equal(t, 0, lb.servers[0].weight)
+
+	// the cool down elapsed but the probe fails
+	clock.CurrentTime = clock.CurrentTime.Add(11 * time.Second)
+	assert.Equal(t, []string{"a", "b", "b"}, seq(t, proxy.URL, 3))
+	assert.True(t, rb.servers[0].ejected)
+
+	// the probe succeeds, a is back in rotation
+	a.setStatus(http.StatusOK)
+	clock.CurrentTime = clock.CurrentTime.Add(11 * time.Second)
+	assert.Equal(t, []string{"a", "a", "b", "a", "b"}, seq(t, proxy.URL, 5))
+	assert.False(t, rb.servers[0].ejected)
+	assert.Equal(t, 1, lb.servers[0].weight)
+}
+
+func TestRebalancerOutlierEjectionKeepsLastServer(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+	a.setStatus(http.StatusBadGateway)
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	rb, err := NewRebalancer(lb, RebalancerOutlierEjection(1, time.Second, 0.1))
+	require.NoError(t, err)
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	assert.Equal(t, []string{"a", "a"}, seq(t, proxy.URL, 2))
+	assert.False(t, rb.servers[0].ejected)
+}
+
+func TestRebalancerOutlierEjectionInvalidOptions(t *testing.T) {
+	for _, opt := range []RebalancerOption{
+		RebalancerOutlierEjection(0, time.Second, 0.1),
+		RebalancerOutlierEjection(1, 0, 0.1),
+		RebalancerOutlierEjection(1, time.Second, 0),
+		RebalancerOutlierEjection(1, time.Second, 1.5),
+	} {
+		_, err := NewRebalancer(nil, opt)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,137 @@
+package roundrobin
+
+import (
+	"time"
+)
+
+// RebalancerMode tells if the rebalancer has shifted the traffic from the original weights
+type RebalancerMode string
+
+const (
+	// RebalancerStable means that all the servers have their original weights
+	RebalancerStable RebalancerMode = "stable"
+	// RebalancerProbing means that the rebalancer has changed the weights and watches the effect of the change
+	RebalancerProbing RebalancerMode = "probing"
+)
+
+// DecisionReason is the reason why the rebalancer changed the weights
+type DecisionReason string
+
+const (
+	// DecisionReset restores the original weights after a server was added or removed
+	DecisionReset DecisionReason = "reset"
+	// DecisionIncrease increases the weights of the servers rated better than the others
+	DecisionIncrease DecisionReason = "increase"
+	// DecisionConverge brings the weights back towards the original ones as the servers are rated alike
+	DecisionConverge DecisionReason = "converge"
+	// DecisionEject ejects a server after consecutive errors, see RebalancerOutlierEjection
+	DecisionEject DecisionReason = "eject"
+	// DecisionRestore restores an ejected server after a successful probe
+	DecisionRestore DecisionReason = "restore"
+)
+
+// RebalancerDecision is a change of the weights made by the rebalancer
+type RebalancerDecision struct {
+	Time   time.Time      `json:"time"`
+	Reason DecisionReason `json:"reason"`
+	// Server is the server ejected or restored, empty for the other reasons
+	Server string `json:"server,omitempty"`
+	// Weights are the weights of the servers after the decision, by URL
+	Weights map[string]int `json:"weights"`
+	// Ratings are the ratings of the servers the decision was based on, by URL, empty for a reset
+	Ratings map[string]float64 `json:"ratings,omitempty"`
+}
+
+// ServerStats is the state of a server of the rebalancer
+type ServerStats struct {
+	URL string `json:"url"`
+	// OriginalWeight is the weight the server was added with
+	OriginalWeight int `json:"original_weight"`
+	// Weight is the weight the server has in the load balancer, 0 if it is ejected
+	Weight int `json:"weight"`
+	// Rating is the rating of the server by its meter, the higher the worse
+	Rating float64 `json:"rating"`
+	// Ready tells if the meter has collected enough data to rate the server
+	Ready bool `json:"ready"`
+	// Good tells if the server was rated better than the others the last time they were compared
+	Good              bool `json:"good"`
+	Ejected           bool `json:"ejected"`
+	ConsecutiveErrors int  `json:"consecutive_errors"`
+}
+
+// RebalancerStats is a snapshot of the state of the rebalancer
+type RebalancerStats struct {
+	Mode    RebalancerMode `json:"mode"`
+	Servers []ServerStats  `json:"servers"`
+	// NextAdjustment is when the weights can be adjusted again
+	NextAdjustment time.Time `json:"next_adjustment"`
+	// LastDecision is the last change of the weights, nil if there was none
+	LastDecision *RebalancerDecision `json:"last_decision,omitempty"`
+}
+
+// RebalancerDecisionLog sets a function called with every change of the weights made by the rebalancer,
+// e.g. to log why the traffic shifted. It is called with the rebalancer locked and must not call it.
+func RebalancerDecisionLog(fn func(RebalancerDecision)) RebalancerOption {
+	return func(rb *Rebalancer) error {
+		rb.decisionLog = fn
+		return nil
+	}
+}
+
+// ServersStats returns a snapshot of the state of the rebalancer and its servers
+func (rb *Rebalancer) ServersStats() RebalancerStats {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+
+	stats := RebalancerStats{
+		Mode:           RebalancerStable,
+		Servers:        make([]ServerStats, 0, len(rb.servers)),
+		NextAdjustment: rb.timer,
+	}
+	for _, s := range rb.servers {
+		if s.curWeight != s.origWeight || s.ejected {
+			stats.Mode = RebalancerProbing
+		}
+		stats.Servers = append(stats.Servers, ServerStats{
+			URL:               s.url.String(),
+			OriginalWeight:    s.origWeight,
+			Weight:            s.effectiveWeight(),
+			Rating:            s.meter.Rating(),
+			Ready:             s.meter.IsReady(),
+			Good:              s.good,
+			Ejected:           s.ejected,
+			ConsecutiveErrors: s.consecutiveErrors,
+		})
+	}
+	if rb.lastDecision != nil {
+		decision := *rb.lastDecision
+		stats.LastDecision = &decision
+	}
+	return stats
+}
+
+// decide records a change of the weights and passes it to the decision log, rated tells if rb.ratings
+// hold the ratings the decision was based on
+func (rb *Rebalancer) decide(reason DecisionReason, server *rbServer, rated bool) {
+	d := RebalancerDecision{
+		Time:    rb.clock.UtcNow(),
+		Reason:  reason,
+		Weights: make(map[string]int, len(rb.servers)),
+	}
+	if server != nil {
+		d.Server = server.url.String()
+	}
+	if rated && len(rb.ratings) == len(rb.servers) {
+		d.Ratings = make(map[string]float64, len(rb.servers))
+	}
+	for i, s := range rb.servers {
+		d.Weights[s.url.String()] = s.effectiveWeight()
+		if d.Ratings != nil {
+			d.Ratings[s.url.String()] = rb.ratings[i]
+		}
+	}
+	rb.lastDecision = &d
+	if rb.decisionLog != nil {
+		rb.decisionLog(d)
+	}
+}
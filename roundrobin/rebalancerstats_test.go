@@ -0,0 +1,132 @@
+package roundrobin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRebalancerServersStats(t *testing.T) {
+	a, b := testutils.NewResponder("a"), testutils.NewResponder("b")
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	newMeter := func() (Meter, error) {
+		return &testMeter{}, nil
+	}
+
+	clock := testutils.GetClock()
+
+	var decisions []RebalancerDecision
+	rb, err := NewRebalancer(lb, RebalancerMeter(newMeter), RebalancerClock(clock),
+		RebalancerDecisionLog(func(d RebalancerDecision) { decisions = append(decisions, d) }))
+	require.NoError(t, err)
+
+	stats := rb.ServersStats()
+	assert.Equal(t, RebalancerStable, stats.Mode)
+	assert.Empty(t, stats.Servers)
+	assert.Nil(t, stats.LastDecision)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	require.Len(t, decisions, 2)
+	assert.Equal(t, DecisionReset, decisions[1].Reason)
+	assert.Equal(t, map[string]int{a.URL: 1, b.URL: 1}, decisions[1].Weights)
+	assert.Nil(t, decisions[1].Ratings)
+
+	rb.servers[0].meter.(*testMeter).rating = 0.3
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	_, _, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+
+	stats = rb.ServersStats()
+	assert.Equal(t, RebalancerProbing, stats.Mode)
+	assert.Equal(t, clock.UtcNow().Add(rb.backoffDuration), stats.NextAdjustment)
+	require.Len(t, stats.Servers, 2)
+	assert.Equal(t, ServerStats{URL: a.URL, OriginalWeight: 1, Weight: 1, Rating: 0.3, Ready: true}, stats.Servers[0])
+	assert.Equal(t, ServerStats{URL: b.URL, OriginalWeight: 1, Weight: FSMGrowFactor, Ready: true, Good: true}, stats.Servers[1])
+
+	require.NotNil(t, stats.LastDecision)
+	assert.Equal(t, DecisionIncrease, stats.LastDecision.Reason)
+	assert.Equal(t, map[string]int{a.URL: 1, b.URL: FSMGrowFactor}, stats.LastDecision.Weights)
+	assert.Equal(t, map[string]float64{a.URL: 0.3, b.URL: 0}, stats.LastDecision.Ratings)
+	assert.Equal(t, decisions[len(decisions)-1], *stats.LastDecision)
+
+	// a recovers, the weights converge back to the original ones
+	rb.servers[0].meter.(*testMeter).rating = 0
+	for i := 0; i < 3; i++ {
+		clock.CurrentTime = clock.CurrentTime.Add(rb.backoffDuration + time.Second)
+		_, _, err = testutils.Get(proxy.URL)
+		require.NoError(t, err)
+	}
+
+	stats = rb.ServersStats()
+	assert.Equal(t, RebalancerStable, stats.Mode)
+	assert.Equal(t, DecisionConverge, stats.LastDecision.Reason)
+	assert.Equal(t, map[string]int{a.URL: 1, b.URL: 1}, stats.LastDecision.Weights)
+
+	_, err = json.Marshal(stats)
+	assert.NoError(t, err)
+}
+
+func TestRebalancerDecisionLogOutlierEjection(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+
+	b := newHealthServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	clock := testutils.GetClock()
+
+	var reasons []DecisionReason
+	rb, err := NewRebalancer(lb, RebalancerClock(clock), RebalancerOutlierEjection(1, 10*time.Second, 1),
+		RebalancerDecisionLog(func(d RebalancerDecision) { reasons = append(reasons, d.Reason) }))
+	require.NoError(t, err)
+
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, rb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(rb)
+	defer proxy.Close()
+
+	a.setStatus(http.StatusInternalServerError)
+	seq(t, proxy.URL, 2)
+
+	stats := rb.ServersStats()
+	assert.Equal(t, RebalancerProbing, stats.Mode)
+	assert.True(t, stats.Servers[0].Ejected)
+	assert.Equal(t, 0, stats.Servers[0].Weight)
+	assert.Equal(t, 1, stats.Servers[0].ConsecutiveErrors)
+	assert.Equal(t, DecisionEject, stats.LastDecision.Reason)
+	assert.Equal(t, a.URL, stats.LastDecision.Server)
+
+	a.setStatus(http.StatusOK)
+	clock.CurrentTime = clock.CurrentTime.Add(11 * time.Second)
+	seq(t, proxy.URL, 1)
+
+	assert.Equal(t, []DecisionReason{DecisionReset, DecisionReset, DecisionEject, DecisionRestore}, reasons)
+	assert.Equal(t, RebalancerStable, rb.ServersStats().Mode)
+}
@@ -0,0 +1,266 @@
+package roundrobin
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRetryMaxBodySize = 1 << 20
+
+// RetryOption provides options for the retry handler
+type RetryOption func(*Retry) error
+
+// RetryAttempts sets the maximum number of servers a request is sent to, defaults to 3
+func RetryAttempts(attempts int) RetryOption {
+	return func(r *Retry) error {
+		if attempts < 1 {
+			return fmt.Errorf("retry attempts should be >= 1")
+		}
+		r.attempts = attempts
+		return nil
+	}
+}
+
+// RetryOnStatus sets the response status codes triggering a retry, defaults to 502 and 503.
+// The forwarder answers with 502 when the connection to the server fails.
+func RetryOnStatus(codes ...int) RetryOption {
+	return func(r *Retry) error {
+		r.codes = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			r.codes[code] = true
+		}
+		return nil
+	}
+}
+
+// RetryMaxBodySize sets the size of the largest request body kept in memory to be replayed, defaults to 1MB.
+// Requests with a larger body are sent once.
+func RetryMaxBodySize(size int64) RetryOption {
+	return func(r *Retry) error {
+		if size < 0 {
+			return fmt.Errorf("max body size should be >= 0")
+		}
+		r.maxBodySize = size
+		return nil
+	}
+}
+
+// RetryErrorHandler is a functional argument that sets error handler of the server
+func RetryErrorHandler(h utils.ErrorHandler) RetryOption {
+	return func(r *Retry) error {
+		r.errHandler = h
+		return nil
+	}
+}
+
+// RetryLogger defines the logger the retry handler will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func RetryLogger(l *log.Logger) RetryOption {
+	return func(r *Retry) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Retry is an http handler picking the servers of a load balancer and sending the request to another server
+// when the chosen one answers with a retryable status code, never trying the same server twice.
+// It replaces the ServeHTTP of the load balancer: the servers are obtained with NextServer and the requests
+// forwarded by the handler returned by Next.
+type Retry struct {
+	lb          balancerHandler
+	attempts    int
+	codes       map[int]bool
+	maxBodySize int64
+	errHandler  utils.ErrorHandler
+
+	log *log.Logger
+}
+
+// NewRetry creates a new Retry handler on top of the load balancer
+func NewRetry(lb balancerHandler, opts ...RetryOption) (*Retry, error) {
+	r := &Retry{
+		lb:          lb,
+		attempts:    3,
+		codes:       map[int]bool{http.StatusBadGateway: true, http.StatusServiceUnavailable: true},
+		maxBodySize: defaultRetryMaxBodySize,
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.errHandler == nil {
+		r.errHandler = utils.DefaultHandler
+	}
+	return r, nil
+}
+
+func (r *Retry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/roundrobin/retry: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/roundrobin/retry: completed ServeHttp on request")
+	}
+
+	body, replayable, err := r.readBody(req)
+	if err != nil {
+		r.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	attempts := r.attempts
+	if !replayable {
+		attempts = 1
+	}
+
+	// the servers tried are carried by the request, e.g. for the spans of the forwarder
+	tried := utils.ServerAttemptsFromRequest(req)
+	if tried == nil {
+		req, tried = utils.WithServerAttempts(req)
+	}
+	for attempt := 1; ; attempt++ {
+		fwdURL, err := r.nextUntried(tried)
+		if err != nil {
+			r.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		tried.Add(fwdURL)
+
+		// make shallow copy of request before changing anything to avoid side effects
+		newReq := *req
+		newReq.URL = fwdURL
+		if body != nil {
+			newReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		last := attempt >= attempts || len(tried.Servers()) >= len(r.lb.Servers())
+		if last {
+			r.lb.Next().ServeHTTP(w, &newReq)
+			return
+		}
+
+		rw := &retryWriter{ResponseWriter: w, header: make(http.Header), retryable: r.codes}
+		r.lb.Next().ServeHTTP(rw, &newReq)
+		if !rw.retried {
+			return
+		}
+		r.log.Debugf("vulcand/oxy/roundrobin/retry: server %v answered %d, retrying on another server", fwdURL, rw.code)
+	}
+}
+
+// readBody reads the body in memory if it is small enough to be replayed, otherwise the body
+// of the request is replaced by one streaming what has been read followed by the rest of the original body
+func (r *Retry) readBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, r.maxBodySize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > r.maxBodySize {
+		req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// nextUntried asks the load balancer for servers until it gets one that was not tried yet
+func (r *Retry) nextUntried(tried *utils.ServerAttempts) (*url.URL, error) {
+	for i := 0; i <= len(r.lb.Servers()); i++ {
+		u, err := r.lb.NextServer()
+		if err != nil {
+			return nil, err
+		}
+		if !tried.Tried(u) {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("no untried server left")
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// retryWriter discards the responses with a retryable status code and passes the other ones through
+type retryWriter struct {
+	http.ResponseWriter
+	header        http.Header
+	retryable     map[int]bool
+	headerWritten bool
+	retried       bool
+	code          int
+}
+
+func (rw *retryWriter) Header() http.Header {
+	if rw.headerWritten && !rw.retried {
+		return rw.ResponseWriter.Header()
+	}
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(code int) {
+	if rw.headerWritten {
+		return
+	}
+	// informational responses are sent as they are, the final response follows
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		h := rw.ResponseWriter.Header()
+		utils.CopyHeaders(h, rw.header)
+		rw.ResponseWriter.WriteHeader(code)
+		for k := range rw.header {
+			h.Del(k)
+		}
+		return
+	}
+	rw.headerWritten = true
+	rw.code = code
+	if rw.retryable[code] {
+		rw.retried = true
+		return
+	}
+	utils.CopyHeaders(rw.ResponseWriter.Header(), rw.header)
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	if !rw.headerWritten {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.retried {
+		return len(b), nil
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client
+func (rw *retryWriter) Flush() {
+	if rw.retried || !rw.headerWritten {
+		return
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (rw *retryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", rw.ResponseWriter)
+}
@@ -0,0 +1,268 @@
+package roundrobin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	oxyforward "github.com/heebyunglee/oxy/forward"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRetryOnStatus(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+	a.setStatus(http.StatusServiceUnavailable)
+
+	b := newHealthServer("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	retry, err := NewRetry(lb)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	assert.Equal(t, []string{"b", "b", "b"}, seq(t, proxy.URL, 3))
+}
+
+// resendTracer records the resend count attribute of the spans of the forwarder
+type resendTracer struct {
+	mtx     sync.Mutex
+	resends []interface{}
+}
+
+func (t *resendTracer) Start(ctx context.Context, req *http.Request) (context.Context, oxyforward.Span) {
+	return ctx, &resendSpan{t: t}
+}
+
+func (t *resendTracer) Inject(ctx context.Context, header http.Header) {}
+
+type resendSpan struct {
+	t       *resendTracer
+	resends interface{}
+}
+
+func (s *resendSpan) SetAttribute(key string, value interface{}) {
+	if key == oxyforward.AttributeResendCount {
+		s.resends = value
+	}
+}
+
+func (s *resendSpan) RecordError(err error) {}
+
+func (s *resendSpan) End() {
+	s.t.mtx.Lock()
+	defer s.t.mtx.Unlock()
+	s.t.resends = append(s.t.resends, s.resends)
+}
+
+func TestRetryTracedResends(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+	a.setStatus(http.StatusServiceUnavailable)
+
+	b := newHealthServer("b")
+	defer b.Close()
+
+	tracer := &resendTracer{}
+	fwd, err := oxyforward.New(oxyforward.Tracing(tracer))
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	retry, err := NewRetry(lb)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	assert.Equal(t, []string{"b"}, seq(t, proxy.URL, 1))
+	// the request sent to b is the second one
+	assert.Equal(t, []interface{}{nil, 1}, tracer.resends)
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:63450")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	retry, err := NewRetry(lb)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	assert.Equal(t, []string{"a", "a"}, seq(t, proxy.URL, 2))
+}
+
+func TestRetryAllServersFail(t *testing.T) {
+	calls := 0
+	failing := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("failing"))
+	})
+	defer failing.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(failing.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:63450")))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://localhost:63451")))
+
+	retry, err := NewRetry(lb, RetryAttempts(5))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	// every server is tried once, the last response is sent back
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryAttempts(t *testing.T) {
+	a := newHealthServer("a")
+	defer a.Close()
+	a.setStatus(http.StatusInternalServerError)
+
+	b := newHealthServer("b")
+	defer b.Close()
+	b.setStatus(http.StatusInternalServerError)
+
+	c := newHealthServer("c")
+	defer c.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(c.URL)))
+
+	retry, err := NewRetry(lb, RetryAttempts(2), RetryOnStatus(http.StatusInternalServerError))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, re.StatusCode)
+	assert.Equal(t, "b", string(body))
+
+	re, body, err = testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "c", string(body))
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	var bodies []string
+	handler := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			bodies = append(bodies, string(body))
+			w.WriteHeader(status)
+		}
+	}
+	a := testutils.NewHandler(handler(http.StatusServiceUnavailable))
+	defer a.Close()
+
+	b := testutils.NewHandler(handler(http.StatusOK))
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	retry, err := NewRetry(lb)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	re, err := http.Post(proxy.URL, "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	re.Body.Close()
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, []string{"hello", "hello"}, bodies)
+}
+
+func TestRetryLargeBodyNotRetried(t *testing.T) {
+	var bodies []string
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	retry, err := NewRetry(lb, RetryMaxBodySize(3))
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(retry)
+	defer proxy.Close()
+
+	re, err := http.Post(proxy.URL, "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	re.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, []string{"hello"}, bodies)
+}
+
+func TestRetryOptionsValidation(t *testing.T) {
+	_, err := NewRetry(nil, RetryAttempts(0))
+	assert.Error(t, err)
+
+	_, err = NewRetry(nil, RetryMaxBodySize(-1))
+	assert.Error(t, err)
+}
@@ -2,13 +2,17 @@
 package roundrobin
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 // Weight is an optional functional argument that sets weight of the server
@@ -38,6 +42,16 @@ func EnableStickySession(stickySession *StickySession) LBOption {
 	}
 }
 
+// SmoothWeighting makes the load balancer use the smooth weighted round robin algorithm of nginx:
+// the servers are interleaved according to their weights instead of the heaviest ones receiving bursts
+// of consecutive requests, and weight updates shift the traffic gradually.
+func SmoothWeighting() LBOption {
+	return func(s *RoundRobin) error {
+		s.smoothWeighting = true
+		return nil
+	}
+}
+
 // RoundRobinRequestRewriteListener is a functional argument that sets error handler of the server
 func RoundRobinRequestRewriteListener(rrl RequestRewriteListener) LBOption {
 	return func(s *RoundRobin) error {
@@ -51,21 +65,27 @@ type RoundRobin struct {
 	mutex      *sync.Mutex
 	next       http.Handler
 	errHandler utils.ErrorHandler
-	// Current index (starts from -1)
-	index                  int
+	// Position of the weighted round robin in the servers
+	cursor                 wrrCursor
 	servers                []*server
-	currentWeight          int
+	smoothWeighting        bool
+	slowStart              time.Duration
+	clock                  timetools.TimeProvider
 	stickySession          *StickySession
+	locality               *locality
+	subset                 *subset
 	requestRewriteListener RequestRewriteListener
+	inflight               utils.Inflight
 
-	log *log.Logger
+	log    *log.Logger
+	logger utils.Logger
 }
 
 // New created a new RoundRobin
 func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 	rr := &RoundRobin{
 		next:          next,
-		index:         -1,
+		cursor:        wrrCursor{index: -1},
 		mutex:         &sync.Mutex{},
 		servers:       []*server{},
 		stickySession: nil,
@@ -80,6 +100,12 @@ func New(next http.Handler, opts ...LBOption) (*RoundRobin, error) {
 	if rr.errHandler == nil {
 		rr.errHandler = utils.DefaultHandler
 	}
+	if rr.clock == nil {
+		rr.clock = &timetools.RealTime{}
+	}
+	if rr.logger == nil {
+		rr.logger = utils.NewLogrusLogger(rr.log)
+	}
 	return rr, nil
 }
 
@@ -93,50 +119,82 @@ func RoundRobinLogger(l *log.Logger) LBOption {
 	}
 }
 
+// RoundRobinStructuredLogger defines the structured logger the round robin load balancer logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by RoundRobinLogger.
+func RoundRobinStructuredLogger(l utils.Logger) LBOption {
+	return func(r *RoundRobin) error {
+		r.logger = l
+		return nil
+	}
+}
+
+// Shutdown stops accepting new requests, answering them with utils.ErrShuttingDown, and waits for the ones
+// being served to complete. It returns the error of the context if it is done first.
+// The next handler is not shut down, it may be shared with other load balancers.
+func (r *RoundRobin) Shutdown(ctx context.Context) error {
+	return r.inflight.Shutdown(ctx)
+}
+
 // Next returns the next handler
 func (r *RoundRobin) Next() http.Handler {
 	return r.next
 }
 
 func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if r.log.Level >= log.DebugLevel {
-		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
-		logEntry.Debug("vulcand/oxy/roundrobin/rr: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/roundrobin/rr: completed ServeHttp on request")
+	if !r.inflight.Acquire() {
+		r.errHandler.ServeHTTP(w, req, utils.ErrShuttingDown)
+		return
+	}
+	defer r.inflight.Release()
+
+	logger := utils.RequestLogger(req, r.logger)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req)})
+		logEntry.Debugf("vulcand/oxy/roundrobin/rr: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/roundrobin/rr: completed ServeHttp on request")
 	}
 
 	// make shallow copy of request before chaning anything to avoid side effects
 	newReq := *req
 	stuck := false
+	attempts := utils.ServerAttemptsFromRequest(req)
 	if r.stickySession != nil {
-		cookieURL, present, err := r.stickySession.GetBackend(&newReq, r.Servers())
+		cookieURL, present, err := r.stickySession.GetBackend(&newReq, availableServers(r))
 
+		if err == ErrStickyBackendGone {
+			r.errHandler.ServeHTTP(w, req, err)
+			return
+		}
 		if err != nil {
-			log.Warnf("vulcand/oxy/roundrobin/rr: error using server from cookie: %v", err)
+			logger.Warnf("vulcand/oxy/roundrobin/rr: error using server from cookie: %v", err)
 		}
 
-		if present {
+		// a replayed request leaves the server it is stuck to if it was tried already
+		if present && !attempts.Tried(cookieURL) {
 			newReq.URL = cookieURL
 			stuck = true
 		}
 	}
 
 	if !stuck {
-		url, err := r.NextServer()
+		url, err := nextUntriedServer(attempts, len(r.Servers()), r.NextServer)
 		if err != nil {
 			r.errHandler.ServeHTTP(w, req, err)
 			return
 		}
 
 		if r.stickySession != nil {
-			r.stickySession.StickBackend(url, &w)
+			r.stickySession.StickRequest(req, url, &w)
 		}
 		newReq.URL = url
 	}
+	attempts.Add(newReq.URL)
 
-	if r.log.Level >= log.DebugLevel {
+	if logger.DebugEnabled() {
 		// log which backend URL we're sending this request to
-		r.log.WithFields(log.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/rr: Forwarding this request to URL")
+		logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req), "ForwardURL": newReq.URL}).Debugf("vulcand/oxy/roundrobin/rr: Forwarding this request to URL")
 	}
 
 	// Emit event to a listener if one exists
@@ -144,9 +202,81 @@ func (r *RoundRobin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		r.requestRewriteListener(req, &newReq)
 	}
 
+	srv := r.acquire(newReq.URL)
+	defer r.release(srv)
+
 	r.next.ServeHTTP(w, &newReq)
 }
 
+// acquire accounts a request to the server, so that draining waits for it
+func (r *RoundRobin) acquire(u *url.URL) *server {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	srv, _ := r.findServerByURL(u)
+	if srv != nil {
+		srv.inflight++
+	}
+	return srv
+}
+
+func (r *RoundRobin) release(srv *server) {
+	if srv == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	srv.inflight--
+	if srv.drained != nil && srv.inflight == 0 {
+		r.removeDrained(srv)
+	}
+}
+
+// DrainServer stops sending new requests to the server, requests already being served and the ones of clients
+// stuck to it by a sticky session are still processed. The server is removed once it has no in-flight requests,
+// or when the timeout expires if it is > 0, and the returned channel is then closed.
+func (r *RoundRobin) DrainServer(u *url.URL, timeout time.Duration) (<-chan struct{}, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	srv, _ := r.findServerByURL(u)
+	if srv == nil {
+		return nil, fmt.Errorf("server not found")
+	}
+	if srv.drained != nil {
+		return srv.drained, nil
+	}
+
+	srv.drained = make(chan struct{})
+	if srv.inflight == 0 {
+		r.removeDrained(srv)
+		return srv.drained, nil
+	}
+
+	if timeout > 0 {
+		time.AfterFunc(timeout, func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.removeDrained(srv)
+		})
+	}
+	return srv.drained, nil
+}
+
+// removeDrained removes the draining server from the pool, if still there, and notifies the drain completion
+func (r *RoundRobin) removeDrained(srv *server) {
+	for i, s := range r.servers {
+		if s == srv {
+			r.servers = append(r.servers[:i], r.servers[i+1:]...)
+			r.resetState()
+			close(srv.drained)
+			return
+		}
+	}
+}
+
 // NextServer gets the next server
 func (r *RoundRobin) NextServer() (*url.URL, error) {
 	srv, err := r.nextServer()
@@ -164,33 +294,67 @@ func (r *RoundRobin) nextServer() (*server, error) {
 		return nil, fmt.Errorf("no servers in the pool")
 	}
 
+	if !r.hasAvailableServer() {
+		return nil, fmt.Errorf("all servers have 0 weight or are draining")
+	}
+
+	now := r.clock.UtcNow()
+	eligible, cursor := r.localityFilter(r.priorityFilter(r.subsetFilter()))
+
+	if r.smoothWeighting {
+		return r.nextSmoothServer(now, eligible)
+	}
+
 	// The algo below may look messy, but is actually very simple
 	// it calculates the GCD  and subtracts it on every iteration, what interleaves servers
 	// and allows us not to build an iterator every time we readjust weights
 
 	// GCD across all enabled servers
-	gcd := r.weightGcd()
+	gcd := r.weightGcd(now, eligible)
 	// Maximum weight across all enabled servers
-	max := r.maxWeight()
+	max := r.maxWeight(now, eligible)
 
 	for {
-		r.index = (r.index + 1) % len(r.servers)
-		if r.index == 0 {
-			r.currentWeight = r.currentWeight - gcd
-			if r.currentWeight <= 0 {
-				r.currentWeight = max
-				if r.currentWeight == 0 {
+		cursor.index = (cursor.index + 1) % len(r.servers)
+		if cursor.index == 0 {
+			cursor.currentWeight = cursor.currentWeight - gcd
+			if cursor.currentWeight <= 0 {
+				cursor.currentWeight = max
+				if cursor.currentWeight == 0 {
 					return nil, fmt.Errorf("all servers have 0 weight")
 				}
 			}
 		}
-		srv := r.servers[r.index]
-		if srv.weight >= r.currentWeight {
+		srv := r.servers[cursor.index]
+		if r.weightOf(srv, now) >= cursor.currentWeight && srv.drained == nil && eligible(srv) {
 			return srv, nil
 		}
 	}
 }
 
+// nextSmoothServer raises the current weight of every server by its weight and picks the server with the highest
+// current weight, which is then lowered by the total weight. Over a cycle each server is picked weight times.
+func (r *RoundRobin) nextSmoothServer(now time.Time, eligible func(*server) bool) (*server, error) {
+	var best *server
+	total := 0
+	for _, srv := range r.servers {
+		weight := r.weightOf(srv, now)
+		if weight == 0 || srv.drained != nil || !eligible(srv) {
+			continue
+		}
+		srv.currentWeight += weight
+		total += weight
+		if best == nil || srv.currentWeight > best.currentWeight {
+			best = srv
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all servers have 0 weight")
+	}
+	best.currentWeight -= total
+	return best, nil
+}
+
 // RemoveServer remove a server
 func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	r.mutex.Lock()
@@ -202,9 +366,22 @@ func (r *RoundRobin) RemoveServer(u *url.URL) error {
 	}
 	r.servers = append(r.servers[:index], r.servers[index+1:]...)
 	r.resetState()
+	if e.drained != nil {
+		close(e.drained)
+	}
 	return nil
 }
 
+// hasAvailableServer tells if a server can receive new requests
+func (r *RoundRobin) hasAvailableServer() bool {
+	for _, s := range r.servers {
+		if s.weight > 0 && s.drained == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Servers gets servers URL
 func (r *RoundRobin) Servers() []*url.URL {
 	r.mutex.Lock()
@@ -247,7 +424,7 @@ func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 		return nil
 	}
 
-	srv := &server{url: utils.CopyURL(u)}
+	srv := &server{url: utils.CopyURL(u), addedAt: r.clock.UtcNow()}
 	for _, o := range options {
 		if err := o(srv); err != nil {
 			return err
@@ -264,12 +441,17 @@ func (r *RoundRobin) UpsertServer(u *url.URL, options ...ServerOption) error {
 }
 
 func (r *RoundRobin) resetIterator() {
-	r.index = -1
-	r.currentWeight = 0
+	r.cursor.reset()
+	if r.locality != nil {
+		for i := range r.locality.cursors {
+			r.locality.cursors[i].reset()
+		}
+	}
 }
 
 func (r *RoundRobin) resetState() {
 	r.resetIterator()
+	r.updateSubset()
 }
 
 func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
@@ -284,23 +466,29 @@ func (r *RoundRobin) findServerByURL(u *url.URL) (*server, int) {
 	return nil, -1
 }
 
-func (r *RoundRobin) maxWeight() int {
+func (r *RoundRobin) maxWeight(now time.Time, eligible func(*server) bool) int {
 	max := -1
 	for _, s := range r.servers {
-		if s.weight > max {
-			max = s.weight
+		if !eligible(s) {
+			continue
+		}
+		if w := r.weightOf(s, now); w > max {
+			max = w
 		}
 	}
 	return max
 }
 
-func (r *RoundRobin) weightGcd() int {
+func (r *RoundRobin) weightGcd(now time.Time, eligible func(*server) bool) int {
 	divisor := -1
 	for _, s := range r.servers {
+		if !eligible(s) {
+			continue
+		}
 		if divisor == -1 {
-			divisor = s.weight
+			divisor = r.weightOf(s, now)
 		} else {
-			divisor = gcd(divisor, s.weight)
+			divisor = gcd(divisor, r.weightOf(s, now))
 		}
 	}
 	return divisor
@@ -313,6 +501,18 @@ func gcd(a, b int) int {
 	return a
 }
 
+// wrrCursor is the position of the weighted round robin algorithm in the servers
+type wrrCursor struct {
+	// Current index (starts from -1)
+	index         int
+	currentWeight int
+}
+
+func (c *wrrCursor) reset() {
+	c.index = -1
+	c.currentWeight = 0
+}
+
 // ServerOption provides various options for server, e.g. weight
 type ServerOption func(*server) error
 
@@ -324,6 +524,24 @@ type server struct {
 	url *url.URL
 	// Relative weight for the enpoint to other enpoints in the load balancer
 	weight int
+	// Current weight used by the smooth weighted round robin algorithm
+	currentWeight int
+	// Number of requests being served by the server
+	inflight int
+	// Closed once the server has been drained, nil if it is not draining
+	drained chan struct{}
+	// Time the server joined the load balancer, used by the slow start
+	addedAt time.Time
+	// Meter rating the server, used by the rebalancer
+	meter Meter
+	// Region and zone of the server, used by the locality preference
+	region, zone string
+	// Whether the server belongs to the subset of the load balancer
+	inSubset bool
+	// Priority of the server, the servers of lower priorities are backups
+	priority int
+	// Moving average of the response time of the server, used by the latency aware balancing
+	latency *memmetrics.EWMA
 }
 
 var defaultWeight = 1
@@ -341,6 +559,23 @@ func sameURL(a, b *url.URL) bool {
 	return a.Path == b.Path && a.Host == b.Host && a.Scheme == b.Scheme
 }
 
+// nextUntriedServer asks next for servers until it gets one the request was not sent to yet,
+// it falls back to the last server returned when they were all tried
+func nextUntriedServer(attempts *utils.ServerAttempts, servers int, next func() (*url.URL, error)) (*url.URL, error) {
+	var u *url.URL
+	for i := 0; i <= servers; i++ {
+		var err error
+		u, err = next()
+		if err != nil {
+			return nil, err
+		}
+		if !attempts.Tried(u) {
+			return u, nil
+		}
+	}
+	return u, nil
+}
+
 type balancerHandler interface {
 	Servers() []*url.URL
 	ServeHTTP(w http.ResponseWriter, req *http.Request)
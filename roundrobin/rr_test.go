@@ -1,9 +1,12 @@
 package roundrobin
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -211,6 +214,75 @@ func TestWeighted(t *testing.T) {
 	assert.Equal(t, false, ok)
 }
 
+func TestSmoothWeighting(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	c := testutils.NewResponder("c")
+	defer c.Close()
+
+	z := testutils.NewResponder("z")
+	defer z.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, SmoothWeighting())
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL), Weight(5)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL), Weight(1)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(c.URL), Weight(1)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(z.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(z.URL), Weight(0)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	assert.Equal(t, []string{"a", "a", "b", "a", "c", "a", "a"}, seq(t, proxy.URL, 7))
+	assert.Equal(t, []string{"a", "a", "b", "a", "c", "a", "a"}, seq(t, proxy.URL, 7))
+}
+
+func TestSmoothWeightingUpsertWeight(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, SmoothWeighting())
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	assert.Equal(t, []string{"a", "b", "a", "b"}, seq(t, proxy.URL, 4))
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL), Weight(3)))
+
+	assert.Equal(t, []string{"b", "a", "b", "b"}, seq(t, proxy.URL, 4))
+}
+
+func TestSmoothWeightingAllZero(t *testing.T) {
+	lb, err := New(nil, SmoothWeighting())
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a"), Weight(1)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a"), Weight(0)))
+
+	_, err = lb.NextServer()
+	assert.Error(t, err)
+}
+
 func TestRequestRewriteListener(t *testing.T) {
 	a := testutils.NewResponder("a")
 	defer a.Close()
@@ -237,3 +309,151 @@ func seq(t *testing.T, url string, repeat int) []string {
 	}
 	return out
 }
+
+func TestDrainServer(t *testing.T) {
+	release := make(chan struct{})
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	inflight := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(proxy.URL)
+		inflight <- string(body)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !hasInflight(lb, testutils.ParseURI(a.URL)) {
+		require.True(t, time.Now().Before(deadline), "request never reached server a")
+		time.Sleep(time.Millisecond)
+	}
+
+	drained, err := lb.DrainServer(testutils.ParseURI(a.URL), 0)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"b", "b", "b"}, seq(t, proxy.URL, 3))
+	assert.Len(t, lb.Servers(), 2)
+
+	select {
+	case <-drained:
+		t.Fatal("drain completed with a request in flight")
+	default:
+	}
+
+	close(release)
+	assert.Equal(t, "a", <-inflight)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain never completed")
+	}
+	assert.Equal(t, []string{b.URL}, []string{lb.Servers()[0].String()})
+}
+
+func TestDrainServerTimeout(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	a := testutils.ParseURI("http://a")
+	require.NoError(t, lb.UpsertServer(a))
+
+	// simulates a request that never completes
+	lb.acquire(a)
+
+	drained, err := lb.DrainServer(a, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	_, err = lb.NextServer()
+	assert.Error(t, err)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain never timed out")
+	}
+	assert.Len(t, lb.Servers(), 0)
+}
+
+func TestDrainIdleServer(t *testing.T) {
+	lb, err := New(nil)
+	require.NoError(t, err)
+
+	_, err = lb.DrainServer(testutils.ParseURI("http://a"), 0)
+	assert.Error(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a")))
+
+	drained, err := lb.DrainServer(testutils.ParseURI("http://a"), 0)
+	require.NoError(t, err)
+
+	_, open := <-drained
+	assert.False(t, open)
+	assert.Len(t, lb.Servers(), 0)
+}
+
+func hasInflight(lb *RoundRobin, u *url.URL) bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	srv, _ := lb.findServerByURL(u)
+	return srv != nil && srv.inflight > 0
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	a := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("a"))
+	})
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd)
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	done := make(chan int)
+	go func() {
+		re, _, errGet := testutils.Get(proxy.URL)
+		require.NoError(t, errGet)
+		done <- re.StatusCode
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, lb.Shutdown(ctx))
+
+	re, _, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+
+	close(release)
+	assert.NoError(t, lb.Shutdown(context.Background()))
+	assert.Equal(t, http.StatusOK, <-done)
+}
@@ -0,0 +1,54 @@
+package roundrobin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mailgun/timetools"
+)
+
+// slowStartScale is the resolution of the weight ramp: during the slow start window weights are multiplied by it
+// so that a server can receive a fraction of the traffic its weight would give it
+const slowStartScale = 100
+
+// SlowStart ramps the effective weight of the servers added to the load balancer linearly from a small
+// fraction of their weight to their full weight over the window, so that cold servers are not overwhelmed.
+// Servers added back after being removed, e.g. by the health checker, go through the slow start again.
+func SlowStart(window time.Duration) LBOption {
+	return func(r *RoundRobin) error {
+		if window < 0 {
+			return fmt.Errorf("slow start window should be >= 0")
+		}
+		r.slowStart = window
+		return nil
+	}
+}
+
+// RoundRobinClock sets the clock used by the slow start
+func RoundRobinClock(clock timetools.TimeProvider) LBOption {
+	return func(r *RoundRobin) error {
+		r.clock = clock
+		return nil
+	}
+}
+
+// weightOf returns the weight the server is scheduled with at the given time
+func (r *RoundRobin) weightOf(s *server, now time.Time) int {
+	if r.slowStart == 0 || s.weight == 0 {
+		return s.weight
+	}
+
+	weight := s.weight * slowStartScale
+	elapsed := now.Sub(s.addedAt)
+	if elapsed >= r.slowStart {
+		return weight
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	ramped := int(int64(weight) * int64(elapsed) / int64(r.slowStart))
+	if ramped < 1 {
+		return 1
+	}
+	return ramped
+}
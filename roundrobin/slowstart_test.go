@@ -0,0 +1,59 @@
+package roundrobin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func countPicks(t *testing.T, lb *RoundRobin, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		u, err := lb.NextServer()
+		require.NoError(t, err)
+		counts[u.Host]++
+	}
+	return counts
+}
+
+func TestSlowStart(t *testing.T) {
+	for _, smooth := range []bool{false, true} {
+		clock := testutils.GetClock()
+
+		opts := []LBOption{SlowStart(10 * time.Second), RoundRobinClock(clock)}
+		if smooth {
+			opts = append(opts, SmoothWeighting())
+		}
+		lb, err := New(nil, opts...)
+		require.NoError(t, err)
+
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://a")))
+		clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://b")))
+
+		// b just joined and gets a tiny share of the traffic
+		counts := countPicks(t, lb, 1010)
+		assert.InDelta(t, 10, counts["b"], 10, "smooth: %v", smooth)
+
+		// half way through the window b has half of its weight
+		clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+		counts = countPicks(t, lb, 1500)
+		assert.InDelta(t, 500, counts["b"], 20, "smooth: %v", smooth)
+
+		// the window elapsed, b has its full weight
+		clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+		counts = countPicks(t, lb, 1000)
+		assert.InDelta(t, 500, counts["b"], 20, "smooth: %v", smooth)
+
+		w, _ := lb.ServerWeight(testutils.ParseURI("http://b"))
+		assert.Equal(t, 1, w)
+	}
+}
+
+func TestSlowStartInvalid(t *testing.T) {
+	_, err := New(nil, SlowStart(-time.Second))
+	assert.Error(t, err)
+}
@@ -1,20 +1,77 @@
 package roundrobin
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// StickyFallback is the behavior of a sticky session once the server it is pinned to is gone, i.e. removed from the
+// load balancer or with a 0 weight
+type StickyFallback int
+
+const (
+	// FallbackRepin pins the session to another server silently, it is the default
+	FallbackRepin StickyFallback = iota
+	// FallbackError answers the request with ErrStickyBackendGone through the error handler of the load balancer,
+	// leaving the cookie as is
+	FallbackError
+	// FallbackRepinNotify pins the session to another server and adds the notify header to the response
+	FallbackRepinNotify
 )
 
+// DefaultStickyNotifyHeader is the response header telling the client that its session was pinned to another
+// server with FallbackRepinNotify
+const DefaultStickyNotifyHeader = "X-Sticky-Session-Repinned"
+
+// ErrStickyBackendGone is the error of the requests pinned to a server that is gone with FallbackError
+var ErrStickyBackendGone = errors.New("sticky session server is gone")
+
 // StickySession is a mixin for load balancers that implements layer 7 (http cookie) session affinity
 type StickySession struct {
 	cookieName string
 	options    CookieOptions
+
+	fallback     StickyFallback
+	notifyHeader string
+	signingKey   []byte
+	aead         cipher.AEAD
+
+	// extractor provides the key of the requests hashed onto the ring, nil if the session uses a cookie
+	extractor utils.SourceExtractor
+	ring      *stickyRing
+}
+
+// stickyRing is the hash ring of the available servers, rebuilt when they change
+type stickyRing struct {
+	mutex   sync.Mutex
+	servers []*url.URL
+	nodes   []ringNode
 }
 
 // CookieOptions has all the options one would like to set on the affinity cookie
 type CookieOptions struct {
 	HTTPOnly bool
 	Secure   bool
+
+	// Path defaults to "/"
+	Path   string
+	Domain string
+	// MaxAge in seconds, 0 makes the cookie last for the browser session
+	MaxAge   int
+	SameSite http.SameSite
 }
 
 // NewStickySession creates a new StickySession
@@ -28,35 +85,228 @@ func NewStickySessionWithOptions(cookieName string, options CookieOptions) *Stic
 	return &StickySession{cookieName: cookieName, options: options}
 }
 
+// SetFallback sets the behavior of the session once the server it is pinned to is gone. The notify header is the
+// response header set to true by FallbackRepinNotify, DefaultStickyNotifyHeader if it is empty.
+func (s *StickySession) SetFallback(fallback StickyFallback, notifyHeader string) *StickySession {
+	s.fallback = fallback
+	s.notifyHeader = notifyHeader
+	if s.notifyHeader == "" {
+		s.notifyHeader = DefaultStickyNotifyHeader
+	}
+	return s
+}
+
+// SetSigningKey signs the affinity cookie with HMAC-SHA256, the cookies that were tampered with being ignored
+func (s *StickySession) SetSigningKey(key []byte) *StickySession {
+	s.signingKey = key
+	return s
+}
+
+// SetEncryptionKey encrypts the affinity cookie with AES-GCM, a key derived from the given one with SHA-256, so
+// that the clients can neither read the URL of their server nor tamper with it
+func (s *StickySession) SetEncryptionKey(key []byte) *StickySession {
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		// can not happen with a 32 bytes key
+		panic(err)
+	}
+	s.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewHashStickySession creates a new StickySession setting no cookie: the requests are pinned by hashing the key
+// provided by the extractor, e.g. the client IP or a header (see utils.NewExtractor), onto a ring of the available
+// servers, for the clients keeping no cookies. As with ConsistentHash only the keys of the servers going or coming
+// back move, so the session is pinned to another server silently once its server is gone whatever the fallback.
+func NewHashStickySession(extractor utils.SourceExtractor) *StickySession {
+	return &StickySession{extractor: extractor, ring: &stickyRing{}}
+}
+
 // GetBackend returns the backend URL stored in the sticky cookie, iff the backend is still in the valid list of servers.
+// It returns ErrStickyBackendGone if the backend is gone with FallbackError.
 func (s *StickySession) GetBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
+	if s.extractor != nil {
+		return s.hashBackend(req, servers)
+	}
+
+	serverURL, err := s.cookieBackend(req)
+	if serverURL == nil || err != nil {
+		return nil, false, err
+	}
+
+	if s.isBackendAlive(serverURL, servers) {
+		return serverURL, true, nil
+	}
+	if s.fallback == FallbackError {
+		return nil, false, ErrStickyBackendGone
+	}
+	return nil, false, nil
+}
+
+// cookieBackend returns the backend URL stored in the sticky cookie, nil if there is none
+func (s *StickySession) cookieBackend(req *http.Request) (*url.URL, error) {
 	cookie, err := req.Cookie(s.cookieName)
 	switch err {
 	case nil:
 	case http.ErrNoCookie:
-		return nil, false, nil
+		return nil, nil
 	default:
-		return nil, false, err
+		return nil, err
+	}
+
+	value, err := s.decode(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(value)
+}
+
+// hashBackend returns the server owning the key of the request on the ring of the servers
+func (s *StickySession) hashBackend(req *http.Request, servers []*url.URL) (*url.URL, bool, error) {
+	if len(servers) == 0 {
+		return nil, false, nil
 	}
 
-	serverURL, err := url.Parse(cookie.Value)
+	key, _, err := s.extractor.Extract(req)
 	if err != nil {
 		return nil, false, err
 	}
 
-	if s.isBackendAlive(serverURL, servers) {
-		return serverURL, true, nil
+	r := s.ring
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !sameURLs(r.servers, servers) {
+		ring := make([]*server, len(servers))
+		for i, u := range servers {
+			ring[i] = &server{url: utils.CopyURL(u), weight: 1}
+		}
+		r.servers = servers
+		r.nodes = buildRing(r.nodes[:0], ring, defaultReplicas)
 	}
-	return nil, false, nil
+	return utils.CopyURL(ringServer(r.nodes, key).url), true, nil
+}
+
+func sameURLs(a, b []*url.URL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameURL(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
 }
 
-// StickBackend creates and sets the cookie
+// StickBackend creates and sets the cookie, it does nothing if the session sets no cookie
 func (s *StickySession) StickBackend(backend *url.URL, w *http.ResponseWriter) {
+	if s.extractor != nil {
+		return
+	}
+
 	opt := s.options
-	cookie := &http.Cookie{Name: s.cookieName, Value: backend.String(), Path: "/", HttpOnly: opt.HTTPOnly, Secure: opt.Secure}
+
+	cp := "/"
+	if opt.Path != "" {
+		cp = opt.Path
+	}
+
+	cookie := &http.Cookie{
+		Name:     s.cookieName,
+		Value:    s.encode(backend.String()),
+		Path:     cp,
+		Domain:   opt.Domain,
+		MaxAge:   opt.MaxAge,
+		HttpOnly: opt.HTTPOnly,
+		Secure:   opt.Secure,
+		SameSite: opt.SameSite,
+	}
 	http.SetCookie(*w, cookie)
 }
 
+// StickRequest creates and sets the cookie pinning the session of the request to the backend, adding the notify
+// header to the response with FallbackRepinNotify if the session was pinned to another server
+func (s *StickySession) StickRequest(req *http.Request, backend *url.URL, w *http.ResponseWriter) {
+	if s.fallback == FallbackRepinNotify && s.extractor == nil {
+		if previous, _ := s.cookieBackend(req); previous != nil && !sameURL(previous, backend) {
+			(*w).Header().Set(s.notifyHeader, "true")
+		}
+	}
+	s.StickBackend(backend, w)
+}
+
+// encode seals the value of the cookie according to the signing and encryption keys
+func (s *StickySession) encode(value string) string {
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			panic(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(value), nil))
+	}
+	if s.signingKey != nil {
+		return value + "." + base64.RawURLEncoding.EncodeToString(s.sign(value))
+	}
+	return value
+}
+
+// decode opens the value of the cookie sealed by encode
+func (s *StickySession) decode(value string) (string, error) {
+	if s.aead != nil {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("malformed cookie: %v", err)
+		}
+		if len(data) < s.aead.NonceSize() {
+			return "", fmt.Errorf("malformed cookie")
+		}
+		nonce, sealed := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+		plain, err := s.aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			return "", fmt.Errorf("invalid cookie: %v", err)
+		}
+		return string(plain), nil
+	}
+	if s.signingKey != nil {
+		i := strings.LastIndex(value, ".")
+		if i < 0 {
+			return "", fmt.Errorf("unsigned cookie")
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+		if err != nil || !hmac.Equal(signature, s.sign(value[:i])) {
+			return "", fmt.Errorf("invalid cookie signature")
+		}
+		return value[:i], nil
+	}
+	return value, nil
+}
+
+func (s *StickySession) sign(value string) []byte {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// availableServers returns the servers of the load balancer that can receive traffic: a sticky session pinned
+// to a server with a 0 weight, e.g. a drained or unhealthy one, falls back to the normal server selection.
+func availableServers(lb interface {
+	Servers() []*url.URL
+	ServerWeight(u *url.URL) (int, bool)
+}) []*url.URL {
+	var out []*url.URL
+	for _, u := range lb.Servers() {
+		if weight, ok := lb.ServerWeight(u); ok && weight > 0 {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
 func (s *StickySession) isBackendAlive(needle *url.URL, haystack []*url.URL) bool {
 	if len(haystack) == 0 {
 		return false
@@ -1,11 +1,14 @@
 package roundrobin
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/heebyunglee/oxy/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vulcand/oxy/forward"
@@ -121,6 +124,68 @@ func TestStickCookieWithOptions(t *testing.T) {
 	assert.True(t, cookie.HttpOnly)
 }
 
+func TestStickCookieWithAttributes(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	options := CookieOptions{Path: "/app", Domain: "example.com", MaxAge: 3600, SameSite: http.SameSiteStrictMode}
+	lb, err := New(fwd, EnableStickySession(NewStickySessionWithOptions("test", options)))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	require.NoError(t, err)
+
+	setCookie := resp.Header.Get("Set-Cookie")
+	assert.Contains(t, setCookie, "Path=/app")
+	assert.Contains(t, setCookie, "Domain=example.com")
+	assert.Contains(t, setCookie, "Max-Age=3600")
+	assert.Contains(t, setCookie, "SameSite=Strict")
+}
+
+func TestStickyFallbackOnZeroWeight(t *testing.T) {
+	a := testutils.NewResponder("a")
+	b := testutils.NewResponder("b")
+
+	defer a.Close()
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test")))
+	require.NoError(t, err)
+
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	// the pinned server is drained, e.g. by a health check
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL), Weight(0)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "test", Value: a.URL})
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(body))
+	assert.Equal(t, b.URL, resp.Cookies()[0].Value)
+}
+
 func TestRemoveRespondingServer(t *testing.T) {
 	a := testutils.NewResponder("a")
 	b := testutils.NewResponder("b")
@@ -290,3 +355,200 @@ func TestBadCookieVal(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
+
+// stickyGet sends a request with the affinity cookie to the proxy
+func stickyGet(t *testing.T, proxyURL string, cookie string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, proxyURL, nil)
+	require.NoError(t, err)
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: "test", Value: cookie})
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestStickyFallbackError(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test").SetFallback(FallbackError, "")))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, body := stickyGet(t, proxy.URL, "http://gone.example.com")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Empty(t, resp.Cookies())
+
+	// the requests with no cookie are pinned as usual
+	resp, body = stickyGet(t, proxy.URL, "")
+	assert.Equal(t, "a", body)
+	assert.Equal(t, a.URL, resp.Cookies()[0].Value)
+}
+
+func TestStickyFallbackRepinNotify(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	sticky := NewStickySession("test").SetFallback(FallbackRepinNotify, "X-Repinned")
+	lb, err := NewLeastConn(fwd, LeastConnStickySession(sticky))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, body := stickyGet(t, proxy.URL, "http://gone.example.com")
+	assert.Equal(t, "a", body)
+	assert.Equal(t, "true", resp.Header.Get("X-Repinned"))
+	assert.Equal(t, a.URL, resp.Cookies()[0].Value)
+
+	// neither the requests pinned to their server nor the new sessions are notified
+	resp, _ = stickyGet(t, proxy.URL, a.URL)
+	assert.Empty(t, resp.Header.Get("X-Repinned"))
+	resp, _ = stickyGet(t, proxy.URL, "")
+	assert.Empty(t, resp.Header.Get("X-Repinned"))
+}
+
+func TestStickySignedCookie(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test").SetSigningKey([]byte("secret"))))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, body := stickyGet(t, proxy.URL, "")
+	require.Equal(t, "a", body)
+	cookie := resp.Cookies()[0].Value
+	assert.Contains(t, cookie, a.URL+".")
+
+	for i := 0; i < 3; i++ {
+		_, body = stickyGet(t, proxy.URL, cookie)
+		assert.Equal(t, "a", body)
+	}
+
+	// a cookie pointing to another server without signature is ignored and replaced
+	resp, _ = stickyGet(t, proxy.URL, b.URL)
+	assert.NotEqual(t, b.URL, resp.Cookies()[0].Value)
+	resp, _ = stickyGet(t, proxy.URL, strings.Replace(cookie, a.URL, b.URL, 1))
+	assert.Len(t, resp.Cookies(), 1)
+}
+
+func TestStickyEncryptedCookie(t *testing.T) {
+	a := testutils.NewResponder("a")
+	defer a.Close()
+	b := testutils.NewResponder("b")
+	defer b.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	lb, err := New(fwd, EnableStickySession(NewStickySession("test").SetEncryptionKey([]byte("secret"))))
+	require.NoError(t, err)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(a.URL)))
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI(b.URL)))
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	resp, body := stickyGet(t, proxy.URL, "")
+	require.Equal(t, "a", body)
+	cookie := resp.Cookies()[0].Value
+	assert.NotContains(t, cookie, "127.0.0.1")
+
+	for i := 0; i < 3; i++ {
+		_, body = stickyGet(t, proxy.URL, cookie)
+		assert.Equal(t, "a", body)
+	}
+
+	// another key can not open the cookie
+	other := NewStickySession("test").SetEncryptionKey([]byte("other"))
+	_, err = other.decode(cookie)
+	assert.Error(t, err)
+
+	resp, _ = stickyGet(t, proxy.URL, b.URL)
+	assert.Len(t, resp.Cookies(), 1)
+}
+
+func TestHashStickySession(t *testing.T) {
+	var servers []*httptest.Server
+	for _, name := range []string{"a", "b", "c"} {
+		srv := testutils.NewResponder(name)
+		defer srv.Close()
+		servers = append(servers, srv)
+	}
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	extractor, err := utils.NewExtractor("request.header.X-User")
+	require.NoError(t, err)
+
+	lb, err := New(fwd, EnableStickySession(NewHashStickySession(extractor)))
+	require.NoError(t, err)
+	for _, srv := range servers {
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(srv.URL)))
+	}
+
+	proxy := httptest.NewServer(lb)
+	defer proxy.Close()
+
+	get := func(user string) string {
+		re, body, err := testutils.Get(proxy.URL, testutils.Header("X-User", user))
+		require.NoError(t, err)
+		assert.Empty(t, re.Header.Get("Set-Cookie"))
+		return string(body)
+	}
+
+	pinned := map[string]string{}
+	for i := 0; i < 30; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		pinned[user] = get(user)
+		for j := 0; j < 3; j++ {
+			assert.Equal(t, pinned[user], get(user), user)
+		}
+	}
+	assert.Len(t, countValues(pinned), 3)
+
+	// only the users of the removed server move
+	require.NoError(t, lb.RemoveServer(testutils.ParseURI(servers[0].URL)))
+	for user, name := range pinned {
+		if name == "a" {
+			assert.NotEqual(t, "a", get(user))
+		} else {
+			assert.Equal(t, name, get(user), user)
+		}
+	}
+}
+
+func countValues(m map[string]string) map[string]int {
+	out := map[string]int{}
+	for _, v := range m {
+		out[v]++
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package roundrobin
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Subset makes the load balancer send the requests to size of its servers only, reducing the number of
+// connections each proxy opens when many proxies front a large number of servers. The instance ID identifies the
+// proxy among the proxies fronting the same servers, they should be numbered from 0 with no gaps.
+//
+// The subsets are assigned by deterministic subsetting: the proxies are grouped in rounds, each round shuffling
+// the servers in its own order and splitting them in subsets of the size, so that every proxy of a round gets
+// a distinct subset and the servers get about the same number of proxies. The assignment only depends on the
+// URLs of the servers, so the proxies agree without coordination. All the servers are used if none of the
+// subset is available.
+func Subset(instanceID, size int) LBOption {
+	return func(r *RoundRobin) error {
+		if instanceID < 0 {
+			return fmt.Errorf("instance ID should be >= 0, got %d", instanceID)
+		}
+		if size < 1 {
+			return fmt.Errorf("subset size should be >= 1, got %d", size)
+		}
+		r.subset = &subset{instanceID: instanceID, size: size}
+		return nil
+	}
+}
+
+// subset holds the subsetting settings of the load balancer
+type subset struct {
+	instanceID int
+	size       int
+}
+
+func inSubset(s *server) bool {
+	return s.inSubset
+}
+
+// updateSubset marks the servers of the subset of the load balancer. It has to be called with the mutex held.
+func (r *RoundRobin) updateSubset() {
+	if r.subset == nil {
+		return
+	}
+
+	servers := make([]*server, len(r.servers))
+	copy(servers, r.servers)
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].url.String() < servers[j].url.String()
+	})
+	for _, s := range servers {
+		s.inSubset = len(servers) <= r.subset.size
+	}
+	if len(servers) <= r.subset.size {
+		return
+	}
+
+	count := len(servers) / r.subset.size
+	round := r.subset.instanceID / count
+	rnd := rand.New(rand.NewSource(int64(round)))
+	rnd.Shuffle(len(servers), func(i, j int) {
+		servers[i], servers[j] = servers[j], servers[i]
+	})
+
+	start := (r.subset.instanceID % count) * r.subset.size
+	for _, s := range servers[start : start+r.subset.size] {
+		s.inSubset = true
+	}
+}
+
+// subsetFilter returns the servers of the subset, or all the servers if none of the subset is available.
+// It has to be called with the mutex held.
+func (r *RoundRobin) subsetFilter() func(*server) bool {
+	if r.subset == nil {
+		return allServers
+	}
+	for _, s := range r.servers {
+		if s.inSubset && s.weight > 0 && s.drained == nil {
+			return inSubset
+		}
+	}
+	return allServers
+}
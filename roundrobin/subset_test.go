@@ -0,0 +1,94 @@
+package roundrobin
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// subsetHosts returns the distinct hosts picked by the load balancer over a few cycles
+func subsetHosts(t *testing.T, lb *RoundRobin) []string {
+	seen := map[string]bool{}
+	for _, h := range nextHosts(t, lb, 3*len(lb.Servers())) {
+		seen[h] = true
+	}
+	var hosts []string
+	for h := range seen {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func newSubsetLB(t *testing.T, instanceID, size, servers int, reverse bool) *RoundRobin {
+	lb, err := New(nil, Subset(instanceID, size))
+	require.NoError(t, err)
+	for i := 0; i < servers; i++ {
+		n := i
+		if reverse {
+			n = servers - 1 - i
+		}
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI(fmt.Sprintf("http://backend%02d", n))))
+	}
+	return lb
+}
+
+func TestSubset(t *testing.T) {
+	// 10 servers make 3 subsets of 3 per round
+	uses := map[string]int{}
+	for round := 0; round < 4; round++ {
+		seen := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			id := round*3 + i
+			hosts := subsetHosts(t, newSubsetLB(t, id, 3, 10, false))
+			require.Len(t, hosts, 3, "instance %d", id)
+
+			// the assignment does not depend on the order the servers were added in
+			assert.Equal(t, hosts, subsetHosts(t, newSubsetLB(t, id, 3, 10, true)))
+
+			for _, h := range hosts {
+				assert.False(t, seen[h], "%v is in two subsets of round %d", h, round)
+				seen[h] = true
+				uses[h]++
+			}
+		}
+	}
+	// every server has between 2 and 4 of the 12 proxies with 3 x 12 / 10 on average
+	for h, n := range uses {
+		assert.True(t, n >= 2 && n <= 4, "%v used by %d proxies", h, n)
+	}
+	assert.Len(t, uses, 10)
+}
+
+func TestSubsetSmallPool(t *testing.T) {
+	lb := newSubsetLB(t, 5, 3, 2, false)
+	assert.Equal(t, []string{"backend00", "backend01"}, subsetHosts(t, lb))
+}
+
+func TestSubsetUnavailable(t *testing.T) {
+	lb := newSubsetLB(t, 0, 2, 4, false)
+	hosts := subsetHosts(t, lb)
+	require.Len(t, hosts, 2)
+
+	// the servers outside of the subset are used once none of the subset is available
+	for _, h := range hosts {
+		require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://"+h), Weight(0)))
+	}
+	others := subsetHosts(t, lb)
+	assert.Len(t, others, 2)
+	for _, h := range hosts {
+		assert.NotContains(t, others, h)
+	}
+}
+
+func TestSubsetOptions(t *testing.T) {
+	_, err := New(nil, Subset(-1, 3))
+	assert.Error(t, err)
+
+	_, err = New(nil, Subset(0, 0))
+	assert.Error(t, err)
+}
@@ -0,0 +1,350 @@
+package roundrobin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerSpec describes a server of a list provided by a ServerListWatcher
+type ServerSpec struct {
+	URL string `json:"url" yaml:"url"`
+	// Weight is the weight of the server, 0 means the weight set by the options of the ServerListSync
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+// ServerListWatcher watches a source of servers, e.g. a file, an etcd prefix or a Consul service
+type ServerListWatcher interface {
+	// Watch sends the complete list of servers once, then every time it changes, until stop is closed.
+	// The channel is closed when the watcher is done.
+	Watch(stop <-chan struct{}) <-chan []ServerSpec
+}
+
+// ServerListSyncOption provides options for the server list sync
+type ServerListSyncOption func(*ServerListSync) error
+
+// ServerListSyncServerOptions sets the options of the servers added to the load balancer
+func ServerListSyncServerOptions(options ...ServerOption) ServerListSyncOption {
+	return func(s *ServerListSync) error {
+		s.options = options
+		return nil
+	}
+}
+
+// ServerListSyncLogger defines the logger the server list sync will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func ServerListSyncLogger(l *log.Logger) ServerListSyncOption {
+	return func(s *ServerListSync) error {
+		s.log = l
+		return nil
+	}
+}
+
+// ServerListSync keeps the servers of a load balancer, e.g. a RoundRobin or a Rebalancer, in sync with the lists
+// sent by a ServerListWatcher, so the backends can change without restarting the process.
+// Only the servers it added are removed when they leave the list.
+type ServerListSync struct {
+	mtx     *sync.Mutex
+	lb      ServerUpdater
+	watcher ServerListWatcher
+	options []ServerOption
+
+	servers map[string]resolvedServer
+	stop    chan struct{}
+	done    chan struct{}
+
+	log *log.Logger
+}
+
+// NewServerListSync creates a new ServerListSync of the load balancer, call Start to begin watching
+func NewServerListSync(lb ServerUpdater, watcher ServerListWatcher, opts ...ServerListSyncOption) (*ServerListSync, error) {
+	if watcher == nil {
+		return nil, fmt.Errorf("watcher can not be nil")
+	}
+	s := &ServerListSync{
+		mtx:     &sync.Mutex{},
+		lb:      lb,
+		watcher: watcher,
+		servers: make(map[string]resolvedServer),
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Start watches the servers until Stop is called
+func (s *ServerListSync) Start() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+// Stop stops watching the servers, the load balancer is left as is
+func (s *ServerListSync) Stop() {
+	s.mtx.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mtx.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *ServerListSync) run(stop, done chan struct{}) {
+	defer close(done)
+
+	updates := s.watcher.Watch(stop)
+	for {
+		select {
+		case <-stop:
+			return
+		case list, ok := <-updates:
+			if !ok {
+				return
+			}
+			s.Update(list)
+		}
+	}
+}
+
+// Update sets the servers of the load balancer to the list
+func (s *ServerListSync) Update(list []ServerSpec) {
+	desired := make(map[string]resolvedServer)
+	for _, spec := range list {
+		u, err := url.Parse(spec.URL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			s.log.Errorf("vulcand/oxy/roundrobin/watcher: ignoring invalid server URL %q", spec.URL)
+			continue
+		}
+		desired[u.String()] = resolvedServer{url: u, weight: spec.Weight}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	syncServers(s.lb, s.servers, desired, s.options, s.log)
+}
+
+// Servers returns the servers added to the load balancer
+func (s *ServerListSync) Servers() []*url.URL {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return sortedServers(s.servers)
+}
+
+// syncServers upserts the desired servers missing from the current ones or with another weight,
+// and removes the current servers that are not desired anymore. current is updated accordingly.
+func syncServers(lb ServerUpdater, current, desired map[string]resolvedServer, options []ServerOption, logger *log.Logger) {
+	for key, s := range desired {
+		if c, ok := current[key]; ok && c.weight == s.weight {
+			continue
+		}
+		opts := options
+		if s.weight > 0 {
+			opts = append(append([]ServerOption(nil), options...), Weight(s.weight))
+		}
+		if err := lb.UpsertServer(s.url, opts...); err != nil {
+			logger.Errorf("vulcand/oxy/roundrobin: failed to add server %v: %v", s.url, err)
+			continue
+		}
+		logger.Debugf("vulcand/oxy/roundrobin: added server %v", s.url)
+		current[key] = s
+	}
+	for key, s := range current {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if err := lb.RemoveServer(s.url); err != nil {
+			logger.Errorf("vulcand/oxy/roundrobin: failed to remove server %v: %v", s.url, err)
+		}
+		logger.Debugf("vulcand/oxy/roundrobin: removed server %v", s.url)
+		delete(current, key)
+	}
+}
+
+func sortedServers(servers map[string]resolvedServer) []*url.URL {
+	out := make([]*url.URL, 0, len(servers))
+	for _, s := range servers {
+		out = append(out, s.url)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].String() < out[j].String() })
+	return out
+}
+
+// watcherTimeout is the time the etcd and Consul servers have to answer a request
+const watcherTimeout = 10 * time.Second
+
+// WatcherOption provides options for the file, etcd and Consul watchers
+type WatcherOption func(*watcherOptions) error
+
+type watcherOptions struct {
+	interval time.Duration
+	client   *http.Client
+	header   http.Header
+	scheme   string
+	log      *log.Logger
+}
+
+func newWatcherOptions(interval time.Duration, opts []WatcherOption) (*watcherOptions, error) {
+	o := &watcherOptions{
+		interval: interval,
+		client:   &http.Client{},
+		header:   make(http.Header),
+		scheme:   "http",
+		log:      log.StandardLogger(),
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// WatcherInterval sets the time between two reads of the source
+func WatcherInterval(d time.Duration) WatcherOption {
+	return func(o *watcherOptions) error {
+		if d <= 0 {
+			return fmt.Errorf("watcher interval should be > 0")
+		}
+		o.interval = d
+		return nil
+	}
+}
+
+// WatcherClient sets the HTTP client of the etcd and Consul watchers. The requests time out after 10 seconds,
+// on top of the time Consul holds its blocking queries.
+func WatcherClient(c *http.Client) WatcherOption {
+	return func(o *watcherOptions) error {
+		if c == nil {
+			return fmt.Errorf("client can not be nil")
+		}
+		o.client = c
+		return nil
+	}
+}
+
+// WatcherHeader adds a header to the requests of the etcd and Consul watchers,
+// e.g. X-Consul-Token or Authorization
+func WatcherHeader(name, value string) WatcherOption {
+	return func(o *watcherOptions) error {
+		o.header.Add(name, value)
+		return nil
+	}
+}
+
+// WatcherScheme sets the scheme of the servers built from the Consul catalog, defaults to http
+func WatcherScheme(scheme string) WatcherOption {
+	return func(o *watcherOptions) error {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme %q", scheme)
+		}
+		o.scheme = scheme
+		return nil
+	}
+}
+
+// WatcherLogger defines the logger the watcher will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func WatcherLogger(l *log.Logger) WatcherOption {
+	return func(o *watcherOptions) error {
+		o.log = l
+		return nil
+	}
+}
+
+// pollWatcher reads the list of servers every interval and sends it when it changed,
+// the previous list is kept when a read fails
+type pollWatcher struct {
+	name     string
+	interval time.Duration
+	fetch    func(ctx context.Context) ([]ServerSpec, error)
+	log      *log.Logger
+}
+
+func (p *pollWatcher) Watch(stop <-chan struct{}) <-chan []ServerSpec {
+	updates := make(chan []ServerSpec)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(updates)
+		defer cancel()
+
+		var last []ServerSpec
+		sent := false
+		for {
+			list, err := p.fetch(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					p.log.Warnf("vulcand/oxy/roundrobin/watcher: failed to read %v, keeping the servers: %v", p.name, err)
+				}
+			} else {
+				sortSpecs(list)
+				if !sent || !equalSpecs(last, list) {
+					select {
+					case updates <- list:
+					case <-stop:
+						return
+					}
+					last, sent = list, true
+				}
+			}
+
+			timer := time.NewTimer(p.interval)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return updates
+}
+
+func sortSpecs(list []ServerSpec) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].URL != list[j].URL {
+			return list[i].URL < list[j].URL
+		}
+		return list[i].Weight < list[j].Weight
+	})
+}
+
+func equalSpecs(a, b []ServerSpec) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
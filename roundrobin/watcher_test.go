@@ -0,0 +1,235 @@
+package roundrobin
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+// staticWatcher sends the lists pushed into its channel
+type staticWatcher struct {
+	lists chan []ServerSpec
+}
+
+func (w *staticWatcher) Watch(stop <-chan struct{}) <-chan []ServerSpec {
+	out := make(chan []ServerSpec)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-stop:
+				return
+			case list := <-w.lists:
+				select {
+				case out <- list:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// waitServers polls the load balancer until it has the servers
+func waitServers(t *testing.T, lb *RoundRobin, expected ...string) {
+	for i := 0; i < 200; i++ {
+		if len(lb.Servers()) == len(expected) && containsAll(serverStrings(lb), expected) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.ElementsMatch(t, expected, serverStrings(lb))
+}
+
+func containsAll(actual, expected []string) bool {
+	for _, e := range expected {
+		found := false
+		for _, a := range actual {
+			if a == e {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServerListSyncUpdatesServers(t *testing.T) {
+	lb := newDNSTestLB(t)
+	require.NoError(t, lb.UpsertServer(testutils.ParseURI("http://static:80")))
+
+	w := &staticWatcher{lists: make(chan []ServerSpec)}
+	s, err := NewServerListSync(lb, w)
+	require.NoError(t, err)
+	s.Start()
+	defer s.Stop()
+
+	w.lists <- []ServerSpec{{URL: "http://a:80", Weight: 3}, {URL: "http://b:80"}, {URL: "not a url"}}
+	waitServers(t, lb, "http://static:80", "http://a:80", "http://b:80")
+
+	weight, _ := lb.ServerWeight(testutils.ParseURI("http://a:80"))
+	assert.Equal(t, 3, weight)
+
+	w.lists <- []ServerSpec{{URL: "http://b:80"}, {URL: "http://c:80"}}
+	waitServers(t, lb, "http://static:80", "http://b:80", "http://c:80")
+	assert.Len(t, s.Servers(), 2)
+}
+
+func TestServerListSyncWithRebalancer(t *testing.T) {
+	lb := newDNSTestLB(t)
+	rb, err := NewRebalancer(lb)
+	require.NoError(t, err)
+
+	s, err := NewServerListSync(rb, &staticWatcher{})
+	require.NoError(t, err)
+
+	s.Update([]ServerSpec{{URL: "http://a:80"}, {URL: "http://b:80"}})
+	assert.Len(t, rb.Servers(), 2)
+
+	s.Update([]ServerSpec{{URL: "http://b:80"}})
+	assert.Equal(t, []string{"http://b:80"}, serverStrings(lb))
+}
+
+func TestFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "servers.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"servers": [{"url": "http://a:80", "weight": 2}]}`), 0644))
+
+	w, err := NewFileWatcher(path, WatcherInterval(5*time.Millisecond))
+	require.NoError(t, err)
+
+	lb := newDNSTestLB(t)
+	s, err := NewServerListSync(lb, w)
+	require.NoError(t, err)
+	s.Start()
+	defer s.Stop()
+
+	waitServers(t, lb, "http://a:80")
+
+	// an invalid file keeps the servers
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"servers": [`), 0644))
+	time.Sleep(20 * time.Millisecond)
+	waitServers(t, lb, "http://a:80")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`[{"url": "http://b:80"}, {"url": "http://c:80"}]`), 0644))
+	waitServers(t, lb, "http://b:80", "http://c:80")
+}
+
+func TestFileWatcherYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "servers.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("servers:\n- url: http://a:80\n  weight: 2\n"), 0644))
+
+	w, err := NewFileWatcher(path, WatcherInterval(5*time.Millisecond))
+	require.NoError(t, err)
+
+	lb := newDNSTestLB(t)
+	s, err := NewServerListSync(lb, w)
+	require.NoError(t, err)
+	s.Start()
+	defer s.Stop()
+
+	waitServers(t, lb, "http://a:80")
+
+	// the file is replaced with a rename
+	tmp := filepath.Join(dir, "servers.tmp")
+	require.NoError(t, ioutil.WriteFile(tmp, []byte("- url: http://b:80\n- url: http://c:80\n"), 0644))
+	require.NoError(t, os.Rename(tmp, path))
+	waitServers(t, lb, "http://b:80", "http://c:80")
+}
+
+func TestFileWatcherUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxy-watcher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "servers.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`[{"url": "http://a:80"}]`), 0644))
+	modTime := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	w, err := NewFileWatcher(path)
+	require.NoError(t, err)
+	list, err := w.read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ServerSpec{{URL: "http://a:80"}}, list)
+
+	// same size and modification time, the file is not read again
+	require.NoError(t, ioutil.WriteFile(path, []byte(`[{"url": "http://b:80"}]`), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+	list, err = w.read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ServerSpec{{URL: "http://a:80"}}, list)
+
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now()))
+	list, err = w.read(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []ServerSpec{{URL: "http://b:80"}}, list)
+}
+
+func TestFileWatcherStop(t *testing.T) {
+	w, err := NewFileWatcher("/nonexistent/servers.json", WatcherInterval(time.Millisecond))
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	updates := w.Watch(stop)
+	close(stop)
+
+	select {
+	case _, ok := <-updates:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("watcher did not stop")
+	}
+}
+
+func TestParseServerList(t *testing.T) {
+	list, err := parseServerList([]byte(`{"servers": []}`))
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = parseServerList([]byte(`{"backends": []}`))
+	assert.Error(t, err)
+
+	list, err = parseServerList([]byte(` [{"url": "http://a:80"}]`))
+	require.NoError(t, err)
+	assert.Equal(t, []ServerSpec{{URL: "http://a:80"}}, list)
+}
+
+func TestParseYAMLServerList(t *testing.T) {
+	list, err := parseYAMLServerList([]byte("servers: []"))
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	_, err = parseYAMLServerList([]byte("backends: []"))
+	assert.Error(t, err)
+
+	// an empty file is not an empty list
+	_, err = parseYAMLServerList([]byte(""))
+	assert.Error(t, err)
+
+	list, err = parseYAMLServerList([]byte("- url: http://a:80\n  weight: 3\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []ServerSpec{{URL: "http://a:80", Weight: 3}}, list)
+
+	assert.True(t, isYAMLFile("servers.yml", []byte(`{"servers": []}`)))
+	assert.False(t, isYAMLFile("servers.json", []byte("servers: []")))
+	assert.True(t, isYAMLFile("servers", []byte("servers: []")))
+	assert.False(t, isYAMLFile("servers", []byte(` [{"url": "http://a:80"}]`)))
+}
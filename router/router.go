@@ -0,0 +1,225 @@
+/*
+Package router provides an http.Handler dispatching the requests to distinct handlers by host and path.
+
+Every route matches a host pattern and a path prefix or regular expression, and usually serves its own chain
+of oxy handlers: its load balancer, its limiters and its circuit breaker. The routes are tried in order, the first
+matching route serves the request. The route table can be replaced at runtime: the new table is compiled first,
+then swapped atomically, so that requests never see a partially updated table.
+
+Examples of a router:
+
+	r, _ := router.New(router.Routes(
+		router.Route{Host: "api.example.com", PathPrefix: "/v2/", Handler: apiV2},
+		router.Route{Host: "api.example.com", Handler: api},
+		router.Route{Host: "*.example.com", PathRegexp: `^/static/.+\.(css|js)$`, Handler: static},
+	))
+
+	// hot reconfiguration
+	r.SetRoutes([]router.Route{{Host: "api.example.com", Handler: apiV3}})
+*/
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Route maps the requests matching a host and a path to a handler
+type Route struct {
+	// Host is the host of the requests, "*.example.com" matches all the subdomains of example.com,
+	// an empty host matches all the hosts
+	Host string
+	// PathPrefix is the prefix of the path of the requests, an empty prefix matches all the paths
+	PathPrefix string
+	// PathRegexp is a regular expression the path of the requests must match, it excludes PathPrefix
+	PathRegexp string
+	// Handler serves the matching requests
+	Handler http.Handler
+	// Name identifies the route in the logs of the requests it serves, defaults to its host and path, e.g. "api.example.com/v2/"
+	Name string
+}
+
+type compiledRoute struct {
+	Route
+	host     string
+	wildcard bool
+	re       *regexp.Regexp
+	name     string
+}
+
+func (r *compiledRoute) match(host, path string) bool {
+	if r.host != "" {
+		if r.wildcard {
+			if !strings.HasSuffix(host, r.host) || len(host) == len(r.host) {
+				return false
+			}
+		} else if host != r.host {
+			return false
+		}
+	}
+	if r.re != nil {
+		return r.re.MatchString(path)
+	}
+	return strings.HasPrefix(path, r.PathPrefix)
+}
+
+// table is the immutable route table swapped on updates
+type table struct {
+	routes []*compiledRoute
+}
+
+// Router dispatches the requests to the handler of the first matching route
+type Router struct {
+	table    atomic.Value // holds a *table
+	notFound http.Handler
+
+	log    *log.Logger
+	logger utils.Logger
+}
+
+// New returns a new router without routes. New() function supports optional functional arguments
+func New(setters ...optSetter) (*Router, error) {
+	r := &Router{
+		notFound: http.NotFoundHandler(),
+
+		log: log.StandardLogger(),
+	}
+	r.table.Store(&table{})
+	for _, s := range setters {
+		if err := s(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+type optSetter func(r *Router) error
+
+// Routes sets the initial routes of the router
+func Routes(routes ...Route) optSetter {
+	return func(r *Router) error {
+		return r.SetRoutes(routes)
+	}
+}
+
+// NotFound sets the handler serving the requests matching no route, defaults to http.NotFoundHandler()
+func NotFound(h http.Handler) optSetter {
+	return func(r *Router) error {
+		if h == nil {
+			return fmt.Errorf("not found handler can not be nil")
+		}
+		r.notFound = h
+		return nil
+	}
+}
+
+// Logger defines the logger the router will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(r *Router) error {
+		r.log = l
+		return nil
+	}
+}
+
+// StructuredLogger defines the structured logger the router attaches to the requests,
+// the handlers of the routes log the requests with it and the name of the route they matched.
+func StructuredLogger(l utils.Logger) optSetter {
+	return func(r *Router) error {
+		r.logger = l
+		return nil
+	}
+}
+
+// SetRoutes replaces the route table. The table is left untouched if one of the routes is invalid.
+func (r *Router) SetRoutes(routes []Route) error {
+	t := &table{routes: make([]*compiledRoute, 0, len(routes))}
+	for i, route := range routes {
+		cr, err := compile(route)
+		if err != nil {
+			return fmt.Errorf("invalid route %d: %v", i, err)
+		}
+		t.routes = append(t.routes, cr)
+	}
+	r.table.Store(t)
+	return nil
+}
+
+// Routes returns the current routes
+func (r *Router) Routes() []Route {
+	t := r.table.Load().(*table)
+	routes := make([]Route, len(t.routes))
+	for i, cr := range t.routes {
+		routes[i] = cr.Route
+	}
+	return routes
+}
+
+func compile(route Route) (*compiledRoute, error) {
+	if route.Handler == nil {
+		return nil, fmt.Errorf("handler can not be nil")
+	}
+	if route.PathPrefix != "" && route.PathRegexp != "" {
+		return nil, fmt.Errorf("path prefix and path regexp are mutually exclusive")
+	}
+	cr := &compiledRoute{Route: route, host: strings.ToLower(route.Host), name: route.Name}
+	if cr.name == "" {
+		cr.name = route.Host + route.PathPrefix + route.PathRegexp
+	}
+	if strings.HasPrefix(cr.host, "*.") {
+		cr.host = cr.host[1:]
+		cr.wildcard = true
+	}
+	if strings.Contains(cr.host, "*") {
+		return nil, fmt.Errorf("unsupported host pattern %v", route.Host)
+	}
+	if route.PathRegexp != "" {
+		re, err := regexp.Compile(route.PathRegexp)
+		if err != nil {
+			return nil, err
+		}
+		cr.re = re
+	}
+	return cr, nil
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.log.Level >= log.DebugLevel {
+		logEntry := r.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/router: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/router: completed ServeHttp on request")
+	}
+
+	if r.logger != nil {
+		req = utils.WithLogger(req, r.logger)
+	}
+	if cr := r.match(req); cr != nil {
+		cr.Handler.ServeHTTP(w, utils.WithRoute(req, cr.name))
+		return
+	}
+	r.notFound.ServeHTTP(w, req)
+}
+
+// match returns the first route matching the request, nil if none matches
+func (r *Router) match(req *http.Request) *compiledRoute {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, cr := range r.table.Load().(*table).routes {
+		if cr.match(host, req.URL.Path) {
+			return cr
+		}
+	}
+	return nil
+}
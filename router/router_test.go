@@ -0,0 +1,137 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(name))
+	})
+}
+
+func serve(h http.Handler, host, path string) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw.Code, rw.Body.String()
+}
+
+func TestMatching(t *testing.T) {
+	r, err := New(Routes(
+		Route{Host: "api.example.com", PathPrefix: "/v2/", Handler: named("v2")},
+		Route{Host: "API.example.com", Handler: named("api")},
+		Route{Host: "*.example.com", PathRegexp: `^/static/.+\.css$`, Handler: named("static")},
+		Route{PathPrefix: "/health", Handler: named("health")},
+	))
+	require.NoError(t, err)
+
+	tests := []struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		{host: "api.example.com", path: "/v2/users", code: http.StatusOK, body: "v2"},
+		{host: "api.example.com:8080", path: "/v1/users", code: http.StatusOK, body: "api"},
+		{host: "Api.Example.Com.", path: "/", code: http.StatusOK, body: "api"},
+		{host: "cdn.eu.example.com", path: "/static/main.css", code: http.StatusOK, body: "static"},
+		{host: "cdn.example.com", path: "/static/main.js", code: http.StatusNotFound},
+		{host: "example.com", path: "/static/main.css", code: http.StatusNotFound},
+		{host: "other.org", path: "/health", code: http.StatusOK, body: "health"},
+		{host: "other.org", path: "/", code: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		code, body := serve(r, test.host, test.path)
+		assert.Equal(t, test.code, code, "%v%v", test.host, test.path)
+		if test.code == http.StatusOK {
+			assert.Equal(t, test.body, body, "%v%v", test.host, test.path)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	r, err := New(NotFound(named("fallback")))
+	require.NoError(t, err)
+
+	code, body := serve(r, "example.com", "/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "fallback", body)
+
+	_, err = New(NotFound(nil))
+	assert.Error(t, err)
+}
+
+func TestSetRoutes(t *testing.T) {
+	r, err := New(Routes(Route{Handler: named("a")}))
+	require.NoError(t, err)
+
+	invalid := [][]Route{
+		{{Handler: named("b")}, {}},
+		{{Host: "a.*.com", Handler: named("b")}},
+		{{PathPrefix: "/", PathRegexp: "/", Handler: named("b")}},
+		{{PathRegexp: "(", Handler: named("b")}},
+	}
+	for _, routes := range invalid {
+		assert.Error(t, r.SetRoutes(routes))
+	}
+	_, body := serve(r, "example.com", "/")
+	assert.Equal(t, "a", body)
+	assert.Len(t, r.Routes(), 1)
+
+	require.NoError(t, r.SetRoutes([]Route{{Host: "example.com", Handler: named("b")}}))
+	_, body = serve(r, "example.com", "/")
+	assert.Equal(t, "b", body)
+	assert.Equal(t, "example.com", r.Routes()[0].Host)
+}
+
+func TestConcurrentSwaps(t *testing.T) {
+	r, err := New(Routes(Route{Handler: named("a")}))
+	require.NoError(t, err)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r.SetRoutes([]Route{{Handler: named("b")}})
+		}()
+		go func() {
+			defer wg.Done()
+			code, body := serve(r, "example.com", "/")
+			assert.Equal(t, http.StatusOK, code)
+			assert.Contains(t, []string{"a", "b"}, body)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRouteLogging(t *testing.T) {
+	l, hook := test.NewNullLogger()
+
+	logRoute := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		utils.RequestLogger(req, nil).Infof("served")
+	})
+
+	r, err := New(StructuredLogger(utils.NewLogrusLogger(l)), Routes(
+		Route{Host: "api.example.com", PathPrefix: "/v2/", Handler: logRoute},
+		Route{Host: "api.example.com", Handler: logRoute, Name: "api"},
+	))
+	require.NoError(t, err)
+
+	serve(r, "api.example.com", "/v2/users")
+	require.Len(t, hook.Entries, 1)
+	assert.Equal(t, "api.example.com/v2/", hook.LastEntry().Data[utils.LogFieldRoute])
+
+	serve(r, "api.example.com", "/v1/users")
+	require.Len(t, hook.Entries, 2)
+	assert.Equal(t, "api", hook.LastEntry().Data[utils.LogFieldRoute])
+}
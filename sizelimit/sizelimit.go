@@ -0,0 +1,264 @@
+/*
+Package sizelimit provides http.Handler middleware rejecting the requests with a body larger than a limit.
+
+Unlike the buffer middleware, the body is not read in advance: it is streamed to the next handler and the request
+is rejected with 413 Request Entity Too Large as soon as the limit is crossed. The requests announcing a larger
+Content-Length are rejected before calling the next handler, the chunked ones once they sent too many bytes.
+
+Examples of a size limiting middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte("hello"))
+	})
+
+	// Reject the requests with a body larger than 10MB
+	sizelimit.New(handler, 10*1024*1024)
+*/
+package sizelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// SizeLimit rejects the requests with a body larger than the limit
+type SizeLimit struct {
+	next       http.Handler
+	maxBytes   int64
+	errHandler utils.ErrorHandler
+
+	log *log.Logger
+}
+
+// New returns a new size limiting middleware. New() function supports optional functional arguments
+func New(next http.Handler, maxBytes int64, setters ...optSetter) (*SizeLimit, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("max bytes should be >= 0 got %d", maxBytes)
+	}
+	s := &SizeLimit{
+		next:     next,
+		maxBytes: maxBytes,
+
+		log: log.StandardLogger(),
+	}
+	for _, o := range setters {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.errHandler == nil {
+		s.errHandler = &SizeErrHandler{}
+	}
+	return s, nil
+}
+
+type optSetter func(s *SizeLimit) error
+
+// Logger defines the logger the size limiter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(s *SizeLimit) error {
+		s.log = l
+		return nil
+	}
+}
+
+// ErrorHandler sets error handler of the server
+func ErrorHandler(h utils.ErrorHandler) optSetter {
+	return func(s *SizeLimit) error {
+		s.errHandler = h
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by size limit handler.
+func (s *SizeLimit) Wrap(next http.Handler) {
+	s.next = next
+}
+
+func (s *SizeLimit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.log.Level >= log.DebugLevel {
+		logEntry := s.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/sizelimit: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/sizelimit: completed ServeHttp on request")
+	}
+
+	if req.ContentLength > s.maxBytes {
+		err := &MaxSizeError{max: s.maxBytes}
+		s.log.Debugf("vulcand/oxy/sizelimit: rejecting Request(%v %v), err: %v", req.Method, req.URL, err)
+		s.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		s.next.ServeHTTP(w, req)
+		return
+	}
+
+	lw := &limitWriter{ResponseWriter: w, header: make(http.Header), req: req, errHandler: s.errHandler}
+	body := &limitReader{ReadCloser: req.Body, max: s.maxBytes, onLimit: lw.limitReached}
+
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.Body = body
+	s.next.ServeHTTP(lw, &newReq)
+
+	// the next handler gave up without answering after the limit was crossed
+	lw.finish()
+}
+
+// limitReader fails the reads once more than max bytes were read
+type limitReader struct {
+	io.ReadCloser
+	max     int64
+	read    int64
+	onLimit func(error)
+	err     error
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	// read one byte more than allowed to detect the bodies just over the limit
+	left := r.max - r.read
+	if int64(len(p)) > left+1 {
+		p = p[:left+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if int64(n) > left {
+		r.err = &MaxSizeError{max: r.max}
+		r.onLimit(r.err)
+		return 0, r.err
+	}
+	r.read += int64(n)
+	return n, err
+}
+
+// limitWriter answers with the error handler once the limit was crossed, discarding the response of the next handler
+// unless it was sent already. The body may be read by another goroutine, e.g. by the transport of a forwarder.
+type limitWriter struct {
+	http.ResponseWriter
+	header     http.Header
+	req        *http.Request
+	errHandler utils.ErrorHandler
+
+	mtx           sync.Mutex
+	err           error
+	headerWritten bool
+}
+
+func (lw *limitWriter) limitReached(err error) {
+	lw.mtx.Lock()
+	defer lw.mtx.Unlock()
+	if lw.err == nil {
+		lw.err = err
+	}
+}
+
+func (lw *limitWriter) Header() http.Header {
+	return lw.header
+}
+
+func (lw *limitWriter) WriteHeader(code int) {
+	// informational responses are sent as they are, the final response follows
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		lw.mtx.Lock()
+		pass := !lw.headerWritten && lw.err == nil
+		lw.mtx.Unlock()
+		if pass {
+			writeInterim(lw.ResponseWriter, lw.header, code)
+		}
+		return
+	}
+	lw.mtx.Lock()
+	if lw.headerWritten {
+		lw.mtx.Unlock()
+		return
+	}
+	if lw.err != nil {
+		lw.headerWritten = true
+		lw.mtx.Unlock()
+		lw.errHandler.ServeHTTP(lw.ResponseWriter, lw.req, lw.err)
+		return
+	}
+	lw.headerWritten = true
+	lw.mtx.Unlock()
+	utils.CopyHeaders(lw.ResponseWriter.Header(), lw.header)
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *limitWriter) Write(b []byte) (int, error) {
+	lw.WriteHeader(http.StatusOK)
+	lw.mtx.Lock()
+	discard := lw.err != nil
+	lw.mtx.Unlock()
+	if discard {
+		return len(b), nil
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+func (lw *limitWriter) finish() {
+	lw.mtx.Lock()
+	defer lw.mtx.Unlock()
+	if !lw.headerWritten && lw.err != nil {
+		lw.headerWritten = true
+		lw.errHandler.ServeHTTP(lw.ResponseWriter, lw.req, lw.err)
+	}
+}
+
+// writeInterim sends an informational response with the headers, they are not kept for the final response
+func writeInterim(w http.ResponseWriter, header http.Header, code int) {
+	h := w.Header()
+	utils.CopyHeaders(h, header)
+	w.WriteHeader(code)
+	for k := range header {
+		h.Del(k)
+	}
+}
+
+// Flush sends any buffered data to the client
+func (lw *limitWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (lw *limitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := lw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", lw.ResponseWriter)
+}
+
+// MaxSizeError is returned when the body of the request is larger than the limit
+type MaxSizeError struct {
+	max int64
+}
+
+func (e *MaxSizeError) Error() string {
+	return fmt.Sprintf("request body larger than %d bytes", e.max)
+}
+
+// SizeErrHandler answers 413 to the requests over the limit
+type SizeErrHandler struct{}
+
+func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if _, ok := err.(*MaxSizeError); ok {
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+}
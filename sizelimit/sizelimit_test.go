@@ -0,0 +1,188 @@
+package sizelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/heebyunglee/oxy/testutils"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnderLimit(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	})
+
+	sl, err := New(handler, 5)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(sl)
+	defer srv.Close()
+
+	re, body, err := testutils.Post(srv.URL, testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestContentLengthOverLimit(t *testing.T) {
+	called := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	})
+
+	sl, err := New(handler, 4)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(sl)
+	defer srv.Close()
+
+	re, _, err := testutils.Post(srv.URL, testutils.Body("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, re.StatusCode)
+	assert.False(t, called)
+}
+
+func TestChunkedOverLimit(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	sl, err := New(handler, 8)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(sl)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", testutils.ParseURI(srv.URL).Host)
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nTransfer-Encoding: chunked\r\n\r\n4\r\ntest\r\n5\r\ntest1\r\n5\r\ntest2\r\n0\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	assert.Equal(t, "HTTP/1.1 413 Request Entity Too Large\r\n", status)
+}
+
+func TestChunkedAtLimit(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	})
+
+	sl, err := New(handler, 9)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", strings.NewReader("testtest1"))
+	req.ContentLength = -1
+	sl.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "testtest1", w.Body.String())
+}
+
+func TestForwardedChunkedOverLimit(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.Header().Set("X-Backend", "yes")
+		w.Write([]byte("hello"))
+	})
+	defer srv.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(srv.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	sl, err := New(rdr, 4)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", strings.NewReader("hello, world"))
+	req.ContentLength = -1
+	sl.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Empty(t, w.Header().Get("X-Backend"))
+}
+
+func TestCustomErrorHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+	})
+
+	errHandler := utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(http.StatusText(http.StatusTeapot)))
+	})
+
+	sl, err := New(handler, 4, ErrorHandler(errHandler))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://localhost", strings.NewReader("hello"))
+	req.ContentLength = -1
+	sl.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTeapot, w.Code)
+}
+
+func TestValidation(t *testing.T) {
+	_, err := New(nil, -1)
+	assert.Error(t, err)
+}
+
+func TestInterimResponses(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Write(body)
+	})
+	sl, err := New(handler, 10)
+	require.NoError(t, err)
+
+	proxy := httptest.NewServer(sl)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello")
+
+	r := bufio.NewReader(conn)
+	re, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusEarlyHints, re.StatusCode)
+	assert.Equal(t, "</style.css>; rel=preload", re.Header.Get("Link"))
+
+	re, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "", re.Header.Get("Link"))
+	body, err := ioutil.ReadAll(re.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
@@ -0,0 +1,148 @@
+/*
+Package split provides http.Handler middleware routing a percentage of the requests to a canary handler
+and the rest to a stable one.
+
+Examples of a splitting middleware:
+
+	// stable and canary are usually load balancers, each one with its own set of servers
+	stable, _ := roundrobin.New(fwd)
+	canary, _ := roundrobin.New(fwd)
+
+	// 5% of the requests go to the canary
+	splitter, _ := split.New(stable, canary, split.Percentage(5))
+
+	// a client always goes to the same side as long as the percentage does not change
+	extractor, _ := utils.NewExtractor("request.header.X-Client-Id")
+	splitter, _ = split.New(stable, canary, split.Percentage(5), split.Key(extractor))
+
+	// the percentage can be changed at runtime
+	splitter.SetPercentage(20)
+*/
+package split
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/heebyunglee/oxy/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// hashBuckets is the number of buckets the keys are hashed into, giving a precision of 0.01%
+const hashBuckets = 10000
+
+// Splitter routes a percentage of the requests to the canary handler and the rest to the stable handler
+type Splitter struct {
+	stable http.Handler
+	canary http.Handler
+
+	mtx        *sync.RWMutex
+	percentage float64
+
+	extractor utils.SourceExtractor
+
+	log *log.Logger
+}
+
+// New returns a new splitter sending all the requests to the stable handler unless a percentage is set.
+// New() function supports optional functional arguments
+func New(stable, canary http.Handler, setters ...optSetter) (*Splitter, error) {
+	s := &Splitter{
+		stable: stable,
+		canary: canary,
+		mtx:    &sync.RWMutex{},
+
+		log: log.StandardLogger(),
+	}
+	for _, set := range setters {
+		if err := set(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+type optSetter func(s *Splitter) error
+
+// Percentage sets the percentage of the requests sent to the canary handler, defaults to 0
+func Percentage(p float64) optSetter {
+	return func(s *Splitter) error {
+		return s.SetPercentage(p)
+	}
+}
+
+// Key makes the splitter hash the key extracted from the request to choose the handler, so that
+// the requests with the same key always go to the same handler. Requests without a key are split randomly.
+func Key(extractor utils.SourceExtractor) optSetter {
+	return func(s *Splitter) error {
+		s.extractor = extractor
+		return nil
+	}
+}
+
+// Logger defines the logger the splitter will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(s *Splitter) error {
+		s.log = l
+		return nil
+	}
+}
+
+// SetPercentage changes the percentage of the requests sent to the canary handler.
+// When the requests are keyed, raising the percentage only moves keys from the stable to the canary handler.
+func (s *Splitter) SetPercentage(p float64) error {
+	if p < 0 || p > 100 {
+		return fmt.Errorf("percentage should be in [0, 100]")
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.percentage = p
+	return nil
+}
+
+// Percentage returns the percentage of the requests sent to the canary handler
+func (s *Splitter) Percentage() float64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.percentage
+}
+
+func (s *Splitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.log.Level >= log.DebugLevel {
+		logEntry := s.log.WithField("Request", utils.DumpHttpRequest(req))
+		logEntry.Debug("vulcand/oxy/split: begin ServeHttp on request")
+		defer logEntry.Debug("vulcand/oxy/split: completed ServeHttp on request")
+	}
+
+	if s.toCanary(req) {
+		s.canary.ServeHTTP(w, req)
+		return
+	}
+	s.stable.ServeHTTP(w, req)
+}
+
+func (s *Splitter) toCanary(req *http.Request) bool {
+	p := s.Percentage()
+	if p <= 0 {
+		return false
+	}
+	if p >= 100 {
+		return true
+	}
+
+	if s.extractor != nil {
+		key, _, err := s.extractor.Extract(req)
+		if err != nil {
+			s.log.Warnf("vulcand/oxy/split: failed to extract key: %v", err)
+		} else if key != "" {
+			bucket := crc32.ChecksumIEEE([]byte(key)) % hashBuckets
+			return float64(bucket) < p*hashBuckets/100
+		}
+	}
+	return rand.Float64()*100 < p
+}
@@ -0,0 +1,93 @@
+package split
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func respond(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(body))
+	})
+}
+
+func serve(t *testing.T, s *Splitter, clientID string) string {
+	req := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+	if clientID != "" {
+		req.Header.Set("X-Client-Id", clientID)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestSplitDefaultsToStable(t *testing.T) {
+	s, err := New(respond("stable"), respond("canary"))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "stable", serve(t, s, ""))
+	}
+}
+
+func TestSplitPercentage(t *testing.T) {
+	s, err := New(respond("stable"), respond("canary"), Percentage(30))
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[serve(t, s, "")]++
+	}
+	assert.InDelta(t, 300, counts["canary"], 80)
+	assert.Equal(t, 1000, counts["canary"]+counts["stable"])
+
+	require.NoError(t, s.SetPercentage(100))
+	assert.Equal(t, float64(100), s.Percentage())
+	assert.Equal(t, "canary", serve(t, s, ""))
+}
+
+func TestSplitKeyIsSticky(t *testing.T) {
+	extractor, err := utils.NewExtractor("request.header.X-Client-Id")
+	require.NoError(t, err)
+
+	s, err := New(respond("stable"), respond("canary"), Percentage(50), Key(extractor))
+	require.NoError(t, err)
+
+	sides := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 500; i++ {
+		id := fmt.Sprintf("client-%d", i)
+		sides[id] = serve(t, s, id)
+		counts[sides[id]]++
+	}
+	assert.InDelta(t, 250, counts["canary"], 80)
+
+	for id, side := range sides {
+		assert.Equal(t, side, serve(t, s, id))
+	}
+
+	// raising the percentage only moves clients to the canary
+	require.NoError(t, s.SetPercentage(80))
+	for id, side := range sides {
+		if side == "canary" {
+			assert.Equal(t, "canary", serve(t, s, id))
+		}
+	}
+}
+
+func TestSplitPercentageValidation(t *testing.T) {
+	_, err := New(respond("stable"), respond("canary"), Percentage(-1))
+	assert.Error(t, err)
+
+	s, err := New(respond("stable"), respond("canary"))
+	require.NoError(t, err)
+	assert.Error(t, s.SetPercentage(101))
+	assert.Equal(t, float64(0), s.Percentage())
+}
@@ -0,0 +1,297 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+const (
+	// DefaultInspectBodyBytes Inspect up to the first 4KB of the responses
+	DefaultInspectBodyBytes = 4096
+	// DefaultMaxRetryBodyBytes Replay requests with a body up to 1MB
+	DefaultMaxRetryBodyBytes = 1048576
+	// DefaultMaxRetryAttempts Maximum retry attempts
+	DefaultMaxRetryAttempts = 10
+)
+
+// Retry provides a predicate that allows stream middleware to replay the request if the response matches
+// certain condition, e.g. an error envelope in a 200 response. Available functions are:
+//
+// Attempts() - limits the amount of retry attempts
+// ResponseCode() - returns http response code
+// IsNetworkError() - tests if response code is related to networking error
+// ResponseHeader("name") - returns the value of a response header
+// BodyContains("text") - tests if the inspected beginning of the response body contains the text
+//
+// Example of the predicate:
+//
+// `Attempts() <= 2 && BodyContains("\"error\":\"unavailable\"")`
+//
+// The beginning of the response is held back until the predicate is evaluated, see InspectBodyBytes.
+// Requests with a body larger than MaxRetryBodyBytes are never replayed.
+func Retry(predicate string) optSetter {
+	return func(s *Stream) error {
+		p, err := parseExpression(predicate)
+		if err != nil {
+			return err
+		}
+		s.retryPredicate = p
+		return nil
+	}
+}
+
+// Rewrite replaces the responses matching the predicate with the response of the handler,
+// once they are not retried anymore. It supports the same functions as Retry.
+func Rewrite(predicate string, h http.Handler) optSetter {
+	return func(s *Stream) error {
+		p, err := parseExpression(predicate)
+		if err != nil {
+			return err
+		}
+		s.rewritePredicate = p
+		s.rewriteHandler = h
+		return nil
+	}
+}
+
+// InspectBodyBytes sets how many bytes of the response body are held back and inspected by the predicates.
+// The predicates are evaluated once that many bytes are received or the response is complete,
+// the rest of the response is then streamed to the client.
+func InspectBodyBytes(n int) optSetter {
+	return func(s *Stream) error {
+		if n < 0 {
+			return fmt.Errorf("inspect bytes should be >= 0 got %d", n)
+		}
+		s.inspectBodyBytes = n
+		return nil
+	}
+}
+
+// MaxRetryBodyBytes sets the size of the largest request body kept in memory to be replayed
+func MaxRetryBodyBytes(m int64) optSetter {
+	return func(s *Stream) error {
+		if m < 0 {
+			return fmt.Errorf("max bytes should be >= 0 got %d", m)
+		}
+		s.maxRetryBodyBytes = m
+		return nil
+	}
+}
+
+// ErrorHandler sets error handler of the server
+func ErrorHandler(h utils.ErrorHandler) optSetter {
+	return func(s *Stream) error {
+		s.errHandler = h
+		return nil
+	}
+}
+
+type action int
+
+const (
+	actionUndecided action = iota
+	actionPass
+	actionRetry
+	actionRewrite
+)
+
+// serveInspected holds back the beginning of the responses to evaluate the predicates,
+// then passes the response through, replays the request or rewrites the response
+func (s *Stream) serveInspected(w http.ResponseWriter, req *http.Request) {
+	logger := utils.RequestLogger(req, s.logger)
+	body, replayable, err := s.readBody(req)
+	if err != nil {
+		logger.Errorf("vulcand/oxy/stream: error when reading request body, err: %v", err)
+		s.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		// make shallow copy of request before changing anything to avoid side effects
+		outreq := *req
+		if body != nil {
+			outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		canRetry := replayable && attempt <= DefaultMaxRetryAttempts
+		iw := &inspectWriter{
+			ResponseWriter: w,
+			header:         make(http.Header),
+			limit:          s.inspectBodyBytes,
+		}
+		iw.decide = func() action {
+			return s.decide(&context{
+				r:            req,
+				attempt:      attempt,
+				responseCode: iw.code,
+				header:       iw.header,
+				body:         iw.buf.Bytes(),
+			}, canRetry)
+		}
+
+		s.next.ServeHTTP(iw, &outreq)
+		if iw.hijacked {
+			return
+		}
+		iw.finish()
+
+		switch iw.action {
+		case actionRetry:
+			logger.Debugf("vulcand/oxy/stream: retry Request(%v %v) attempt %v", req.Method, req.URL, attempt+1)
+			continue
+		case actionRewrite:
+			logger.Debugf("vulcand/oxy/stream: rewriting response %d to Request(%v %v)", iw.code, req.Method, req.URL)
+			s.rewriteHandler.ServeHTTP(w, req)
+		}
+		return
+	}
+}
+
+func (s *Stream) decide(c *context, canRetry bool) action {
+	if canRetry && s.retryPredicate != nil && s.retryPredicate(c) {
+		return actionRetry
+	}
+	if s.rewritePredicate != nil && s.rewritePredicate(c) {
+		return actionRewrite
+	}
+	return actionPass
+}
+
+// readBody reads the body in memory if retries are enabled and it is small enough to be replayed, otherwise
+// the body of the request is replaced by one streaming what has been read followed by the rest of the original body
+func (s *Stream) readBody(req *http.Request) ([]byte, bool, error) {
+	if s.retryPredicate == nil {
+		return nil, false, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, s.maxRetryBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > s.maxRetryBodyBytes {
+		req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// inspectWriter holds back the response until limit bytes of the body are written or the response is complete,
+// it then decides whether the response is passed to the client or discarded
+type inspectWriter struct {
+	http.ResponseWriter
+	header        http.Header
+	code          int
+	headerWritten bool
+	hijacked      bool
+
+	buf    bytes.Buffer
+	limit  int
+	decide func() action
+	action action
+}
+
+func (iw *inspectWriter) Header() http.Header {
+	if iw.action == actionPass {
+		return iw.ResponseWriter.Header()
+	}
+	return iw.header
+}
+
+func (iw *inspectWriter) WriteHeader(code int) {
+	if iw.headerWritten {
+		return
+	}
+	// informational responses are sent as they are, the final response follows
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		if iw.action == actionPass {
+			iw.ResponseWriter.WriteHeader(code)
+			return
+		}
+		h := iw.ResponseWriter.Header()
+		utils.CopyHeaders(h, iw.header)
+		iw.ResponseWriter.WriteHeader(code)
+		for k := range iw.header {
+			h.Del(k)
+		}
+		return
+	}
+	iw.headerWritten = true
+	iw.code = code
+}
+
+func (iw *inspectWriter) Write(b []byte) (int, error) {
+	if !iw.headerWritten {
+		iw.WriteHeader(http.StatusOK)
+	}
+	switch iw.action {
+	case actionPass:
+		return iw.ResponseWriter.Write(b)
+	case actionUndecided:
+		iw.buf.Write(b)
+		if iw.buf.Len() >= iw.limit {
+			iw.resolve()
+		}
+	}
+	return len(b), nil
+}
+
+// resolve evaluates the predicates and sends what was held back if the response is passed through
+func (iw *inspectWriter) resolve() {
+	iw.action = iw.decide()
+	if iw.action != actionPass {
+		return
+	}
+	if !iw.headerWritten {
+		iw.WriteHeader(http.StatusOK)
+	}
+	utils.CopyHeaders(iw.ResponseWriter.Header(), iw.header)
+	iw.ResponseWriter.WriteHeader(iw.code)
+	if iw.buf.Len() > 0 {
+		iw.ResponseWriter.Write(iw.buf.Bytes())
+	}
+	iw.buf.Reset()
+}
+
+// finish decides the fate of the responses shorter than the limit
+func (iw *inspectWriter) finish() {
+	if iw.action == actionUndecided {
+		iw.resolve()
+	}
+}
+
+// Flush sends any buffered data to the client once the response is passed through,
+// nothing is sent before the predicates are evaluated
+func (iw *inspectWriter) Flush() {
+	if iw.action != actionPass {
+		return
+	}
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (iw *inspectWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := iw.ResponseWriter.(http.Hijacker); ok {
+		conn, rw, err := h.Hijack()
+		if err == nil {
+			iw.hijacked = true
+		}
+		return conn, rw, err
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", iw.ResponseWriter)
+}
@@ -0,0 +1,148 @@
+package stream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestRetryOnErrorEnvelope(t *testing.T) {
+	calls := 0
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(t, "some request parameters", string(body))
+		if calls == 1 {
+			w.Write([]byte(`{"error":"unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	})
+	defer srv.Close()
+
+	st := newInspectingStream(t, srv.URL, Retry(`Attempts() <= 2 && BodyContains("\"error\"")`))
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Post(proxy.URL, testutils.Body("some request parameters"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, `{"ok":true}`, string(body))
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryExceedAttempts(t *testing.T) {
+	calls := 0
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("unavailable"))
+	})
+	defer srv.Close()
+
+	st := newInspectingStream(t, srv.URL, Retry(`Attempts() <= 2 && ResponseCode() == 503`))
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, "unavailable", string(body))
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetryLargeRequestBody(t *testing.T) {
+	calls := 0
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(t, "some request parameters", string(body))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+
+	st := newInspectingStream(t, srv.URL, Retry(`ResponseCode() == 503`), MaxRetryBodyBytes(4))
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, _, err := testutils.Post(proxy.URL, testutils.Body("some request parameters"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Equal(t, 1, calls)
+}
+
+func TestInspectedResponseStreamed(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		w.Write([]byte("hello, "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("this response is longer than the inspected part"))
+	})
+	defer srv.Close()
+
+	st := newInspectingStream(t, srv.URL, Retry(`BodyContains("error")`), InspectBodyBytes(4))
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "yes", re.Header.Get("X-Backend"))
+	assert.Equal(t, "hello, this response is longer than the inspected part", string(body))
+}
+
+func TestRewrite(t *testing.T) {
+	srv := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Error", "yes")
+		w.Write([]byte("internal details"))
+	})
+	defer srv.Close()
+
+	rewrite := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("try again later"))
+	})
+
+	st := newInspectingStream(t, srv.URL, Rewrite(`ResponseHeader("X-Error") == "yes"`, rewrite))
+
+	proxy := httptest.NewServer(st)
+	defer proxy.Close()
+
+	re, body, err := testutils.Get(proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, re.StatusCode)
+	assert.Empty(t, re.Header.Get("X-Error"))
+	assert.Equal(t, "try again later", string(body))
+}
+
+func TestInvalidPredicate(t *testing.T) {
+	_, err := New(nil, Retry(`BodyContains(`))
+	assert.Error(t, err)
+
+	_, err = New(nil, Rewrite(`Unknown()`, nil))
+	assert.Error(t, err)
+}
+
+func newInspectingStream(t *testing.T, target string, setters ...optSetter) *Stream {
+	fwd, err := forward.New(forward.Stream(true))
+	require.NoError(t, err)
+
+	rdr := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(target)
+		fwd.ServeHTTP(w, req)
+	})
+
+	st, err := New(rdr, setters...)
+	require.NoError(t, err)
+	return st
+}
@@ -28,14 +28,18 @@ Examples of a streaming middleware:
   // or validation of the data.
   stream.New(handler)
 
+  // Stream will hold back the first 4KB of the responses to replay the request
+  // when the backend answers with an error envelope
+  stream.New(handler, stream.Retry(`Attempts() <= 2 && BodyContains("\"error\"")`))
+
 */
 package stream
 
 import (
 	"net/http"
 
+	"github.com/heebyunglee/oxy/utils"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 const (
@@ -50,12 +54,18 @@ type Stream struct {
 
 	maxResponseBodyBytes int64
 
-	retryPredicate hpredicate
+	retryPredicate   hpredicate
+	rewritePredicate hpredicate
+	rewriteHandler   http.Handler
+
+	inspectBodyBytes  int
+	maxRetryBodyBytes int64
 
 	next       http.Handler
 	errHandler utils.ErrorHandler
 
-	log *log.Logger
+	log    *log.Logger
+	logger utils.Logger
 }
 
 // New returns a new streamer middleware. New() function supports optional functional arguments
@@ -67,6 +77,9 @@ func New(next http.Handler, setters ...optSetter) (*Stream, error) {
 
 		maxResponseBodyBytes: DefaultMaxBodyBytes,
 
+		inspectBodyBytes:  DefaultInspectBodyBytes,
+		maxRetryBodyBytes: DefaultMaxRetryBodyBytes,
+
 		log: log.StandardLogger(),
 	}
 	for _, s := range setters {
@@ -74,6 +87,12 @@ func New(next http.Handler, setters ...optSetter) (*Stream, error) {
 			return nil, err
 		}
 	}
+	if strm.errHandler == nil {
+		strm.errHandler = utils.DefaultHandler
+	}
+	if strm.logger == nil {
+		strm.logger = utils.NewLogrusLogger(strm.log)
+	}
 	return strm, nil
 }
 
@@ -87,6 +106,17 @@ func Logger(l *log.Logger) optSetter {
 	}
 }
 
+// StructuredLogger defines the structured logger the streamer logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by Logger.
+func StructuredLogger(l utils.Logger) optSetter {
+	return func(s *Stream) error {
+		s.logger = l
+		return nil
+	}
+}
+
 type optSetter func(s *Stream) error
 
 // Wrap sets the next handler to be called by stream handler.
@@ -96,10 +126,16 @@ func (s *Stream) Wrap(next http.Handler) error {
 }
 
 func (s *Stream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if s.log.Level >= log.DebugLevel {
-		logEntry := s.log.WithField("Request", utils.DumpHttpRequest(req))
-		logEntry.Debug("vulcand/oxy/stream: begin ServeHttp on request")
-		defer logEntry.Debug("vulcand/oxy/stream: completed ServeHttp on request")
+	logger := utils.RequestLogger(req, s.logger)
+	if logger.DebugEnabled() {
+		logEntry := logger.WithFields(utils.Fields{"Request": utils.DumpHttpRequest(req)})
+		logEntry.Debugf("vulcand/oxy/stream: begin ServeHttp on request")
+		defer logEntry.Debugf("vulcand/oxy/stream: completed ServeHttp on request")
+	}
+
+	if s.retryPredicate != nil || s.rewritePredicate != nil {
+		s.serveInspected(w, req)
+		return
 	}
 
 	s.next.ServeHTTP(w, req)
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 
@@ -17,6 +18,8 @@ type context struct {
 	r            *http.Request
 	attempt      int
 	responseCode int
+	header       http.Header
+	body         []byte
 }
 
 type hpredicate func(*context) bool
@@ -39,6 +42,8 @@ func parseExpression(in string) (hpredicate, error) {
 			"IsNetworkError": isNetworkError,
 			"Attempts":       attempts,
 			"ResponseCode":   responseCode,
+			"ResponseHeader": responseHeader,
+			"BodyContains":   bodyContains,
 		},
 	})
 	if err != nil {
@@ -79,6 +84,20 @@ func responseCode() toInt {
 	}
 }
 
+// ResponseHeader returns mapper of the request to the value of a header of the last response
+func responseHeader(name string) toString {
+	return func(c *context) string {
+		return c.header.Get(name)
+	}
+}
+
+// BodyContains returns a predicate that returns true if the inspected beginning of the last response body contains the text
+func bodyContains(text string) hpredicate {
+	return func(c *context) bool {
+		return bytes.Contains(c.body, []byte(text))
+	}
+}
+
 // IsNetworkError returns a predicate that returns true if last attempt ended with network error.
 func isNetworkError() hpredicate {
 	return func(c *context) bool {
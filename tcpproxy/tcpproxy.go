@@ -0,0 +1,408 @@
+/*
+Package tcpproxy provides a proxy of raw TCP connections, for the protocols other than HTTP, e.g. Redis or MySQL.
+
+The backend of every connection is picked by a load balancer of the roundrobin package, the servers being tcp:// URLs.
+Like the connlimit middleware, the proxy caps the concurrent connections, in total and per source IP.
+The bytes are counted per connection and the connections idle for too long are closed.
+
+Examples of a TCP proxy:
+
+	lb, _ := roundrobin.New(nil)
+	lb.UpsertServer(testutils.ParseURI("tcp://10.0.0.1:6379"))
+	lb.UpsertServer(testutils.ParseURI("tcp://10.0.0.2:6379"))
+
+	p, _ := tcpproxy.New(lb,
+	  tcpproxy.MaxConnections(1000),
+	  tcpproxy.MaxSourceConnections(50),
+	  tcpproxy.IdleTimeout(5*time.Minute),
+	  tcpproxy.OnClose(func(s tcpproxy.ConnStats) {
+	    log.Infof("%v -> %v: %d bytes in, %d bytes out", s.Source, s.Backend, s.BytesIn, s.BytesOut)
+	  }),
+	)
+	p.Serve(l)
+*/
+package tcpproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heebyunglee/oxy/memmetrics"
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the proxy
+const (
+	DefaultDialTimeout = 10 * time.Second
+	DefaultIdleTimeout = 10 * time.Minute
+)
+
+// Balancer picks the backend of the connections, e.g. a roundrobin.RoundRobin or roundrobin.LeastConn
+// whose servers are tcp://host:port URLs
+type Balancer interface {
+	NextServer() (*url.URL, error)
+}
+
+// ConnStats describes a proxied connection once it is closed
+type ConnStats struct {
+	// Source is the address of the client
+	Source string
+	// Backend is the address of the backend, empty if no backend accepted the connection
+	Backend string
+	// BytesIn is the number of bytes sent by the client to the backend
+	BytesIn int64
+	// BytesOut is the number of bytes sent by the backend to the client
+	BytesOut int64
+	// Duration is the time the connection was open
+	Duration time.Duration
+	// Err is the reason the connection was not proxied, e.g. a limit was reached or no backend could be dialed
+	Err error
+}
+
+// Stats describes the activity of the proxy
+type Stats struct {
+	// Connections is the number of connections being proxied
+	Connections int64
+	// BytesIn and BytesOut are the bytes proxied since the proxy was created
+	BytesIn  int64
+	BytesOut int64
+	// DialErrorRatio is the ratio of the dials to the backends that failed over the last 10 seconds
+	DialErrorRatio float64
+}
+
+// MaxConnError is the error of the connections refused because a limit of connections is reached
+type MaxConnError struct {
+	max    int64
+	source string
+}
+
+func (m *MaxConnError) Error() string {
+	if m.source != "" {
+		return fmt.Sprintf("max connections reached for %v: %d", m.source, m.max)
+	}
+	return fmt.Sprintf("max connections reached: %d", m.max)
+}
+
+// Proxy proxies the TCP connections to the backends picked by a load balancer
+type Proxy struct {
+	lb           Balancer
+	dialTimeout  time.Duration
+	idleTimeout  time.Duration
+	dialAttempts int
+
+	mutex             *sync.Mutex
+	maxConnections    int64
+	maxSourceConns    int64
+	connections       int64
+	sourceConnections map[string]int64
+
+	bytesIn    int64
+	bytesOut   int64
+	dialErrors *memmetrics.RatioCounter
+
+	onClose func(ConnStats)
+	clock   timetools.TimeProvider
+	log     *log.Logger
+}
+
+// New returns a new TCP proxy forwarding the connections to the backends picked by the load balancer
+func New(lb Balancer, options ...Option) (*Proxy, error) {
+	if lb == nil {
+		return nil, fmt.Errorf("load balancer can not be nil")
+	}
+	p := &Proxy{
+		lb:                lb,
+		dialTimeout:       DefaultDialTimeout,
+		idleTimeout:       DefaultIdleTimeout,
+		dialAttempts:      1,
+		mutex:             &sync.Mutex{},
+		sourceConnections: make(map[string]int64),
+		log:               log.StandardLogger(),
+	}
+	for _, o := range options {
+		if err := o(p); err != nil {
+			return nil, err
+		}
+	}
+	if p.clock == nil {
+		p.clock = &timetools.RealTime{}
+	}
+	dialErrors, err := memmetrics.NewRatioCounter(10, time.Second, memmetrics.RatioClock(p.clock))
+	if err != nil {
+		return nil, err
+	}
+	p.dialErrors = dialErrors
+	return p, nil
+}
+
+// Option provides options for the proxy
+type Option func(p *Proxy) error
+
+// MaxConnections caps the connections proxied at once, the others are closed at once. Unlimited by default.
+func MaxConnections(max int64) Option {
+	return func(p *Proxy) error {
+		if max < 0 {
+			return fmt.Errorf("max connections should be >= 0")
+		}
+		p.maxConnections = max
+		return nil
+	}
+}
+
+// MaxSourceConnections caps the connections proxied at once per source IP. Unlimited by default.
+func MaxSourceConnections(max int64) Option {
+	return func(p *Proxy) error {
+		if max < 0 {
+			return fmt.Errorf("max source connections should be >= 0")
+		}
+		p.maxSourceConns = max
+		return nil
+	}
+}
+
+// DialTimeout sets the time the backends have to accept the connections, defaults to DefaultDialTimeout
+func DialTimeout(d time.Duration) Option {
+	return func(p *Proxy) error {
+		if d <= 0 {
+			return fmt.Errorf("dial timeout should be > 0")
+		}
+		p.dialTimeout = d
+		return nil
+	}
+}
+
+// IdleTimeout sets the time after which the connections transferring no bytes in either direction are closed,
+// defaults to DefaultIdleTimeout
+func IdleTimeout(d time.Duration) Option {
+	return func(p *Proxy) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout should be > 0")
+		}
+		p.idleTimeout = d
+		return nil
+	}
+}
+
+// DialAttempts sets how many backends are dialed before giving up on a connection, defaults to 1
+func DialAttempts(attempts int) Option {
+	return func(p *Proxy) error {
+		if attempts < 1 {
+			return fmt.Errorf("dial attempts should be >= 1")
+		}
+		p.dialAttempts = attempts
+		return nil
+	}
+}
+
+// OnClose sets a function called with the statistics of every connection once it is closed
+func OnClose(fn func(ConnStats)) Option {
+	return func(p *Proxy) error {
+		p.onClose = fn
+		return nil
+	}
+}
+
+// Clock sets the clock of the dial error ratio
+func Clock(clock timetools.TimeProvider) Option {
+	return func(p *Proxy) error {
+		p.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the proxy will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(p *Proxy) error {
+		p.log = l
+		return nil
+	}
+}
+
+// Stats returns the activity of the proxy
+func (p *Proxy) Stats() Stats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return Stats{
+		Connections:    p.connections,
+		BytesIn:        atomic.LoadInt64(&p.bytesIn),
+		BytesOut:       atomic.LoadInt64(&p.bytesOut),
+		DialErrorRatio: p.dialErrors.Ratio(),
+	}
+}
+
+// Serve accepts the connections of the listener and proxies them until the listener is closed
+func (p *Proxy) Serve(l net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				p.log.Warnf("vulcand/oxy/tcpproxy: accept error: %v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go p.ServeConn(conn)
+	}
+}
+
+// ServeConn proxies the connection to a backend and closes it once either side is done
+func (p *Proxy) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	start := time.Now()
+	stats := ConnStats{Source: conn.RemoteAddr().String()}
+	defer func() {
+		stats.Duration = time.Since(start)
+		if p.onClose != nil {
+			p.onClose(stats)
+		}
+	}()
+
+	source := sourceIP(conn.RemoteAddr())
+	if err := p.acquire(source); err != nil {
+		p.log.Debugf("vulcand/oxy/tcpproxy: refusing %v: %v", stats.Source, err)
+		stats.Err = err
+		return
+	}
+	defer p.release(source)
+
+	backend, err := p.dial()
+	if err != nil {
+		p.log.Errorf("vulcand/oxy/tcpproxy: no backend for %v: %v", stats.Source, err)
+		stats.Err = err
+		return
+	}
+	defer backend.Close()
+	stats.Backend = backend.RemoteAddr().String()
+
+	activity := time.Now().UnixNano()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stats.BytesIn = p.copy(backend, conn, &p.bytesIn, &activity)
+		utils.CloseWrite(backend)
+	}()
+	stats.BytesOut = p.copy(conn, backend, &p.bytesOut, &activity)
+	utils.CloseWrite(conn)
+	<-done
+}
+
+func (p *Proxy) acquire(source string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.maxConnections > 0 && p.connections >= p.maxConnections {
+		return &MaxConnError{max: p.maxConnections}
+	}
+	if p.maxSourceConns > 0 && p.sourceConnections[source] >= p.maxSourceConns {
+		return &MaxConnError{max: p.maxSourceConns, source: source}
+	}
+	p.connections++
+	p.sourceConnections[source]++
+	return nil
+}
+
+func (p *Proxy) release(source string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.connections--
+	p.sourceConnections[source]--
+	// Otherwise it would grow forever
+	if p.sourceConnections[source] == 0 {
+		delete(p.sourceConnections, source)
+	}
+}
+
+// dial connects to the backends picked by the load balancer until one accepts the connection
+func (p *Proxy) dial() (net.Conn, error) {
+	var lastErr error
+	for i := 0; i < p.dialAttempts; i++ {
+		u, err := p.lb.NextServer()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.DialTimeout("tcp", u.Host, p.dialTimeout)
+		p.recordDial(err)
+		if err == nil {
+			return conn, nil
+		}
+		p.log.Warnf("vulcand/oxy/tcpproxy: failed to dial %v: %v", u.Host, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// recordDial records the outcome of a dial in the dial error ratio
+func (p *Proxy) recordDial(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		p.dialErrors.IncA(1)
+	} else {
+		p.dialErrors.IncB(1)
+	}
+}
+
+// copy copies the bytes from src to dst until src is done, the bytes are added to total.
+// activity is the time of the last transfer in either direction, both connections are closed
+// once it is older than the idle timeout.
+func (p *Proxy) copy(dst, src net.Conn, total, activity *int64) int64 {
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(activity, time.Now().UnixNano())
+			dst.SetWriteDeadline(time.Now().Add(p.idleTimeout))
+			if _, errWrite := dst.Write(buf[:n]); errWrite != nil {
+				return written
+			}
+			written += int64(n)
+			atomic.AddInt64(total, int64(n))
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// the other direction may be busy
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(activity)))
+			if idle < p.idleTimeout {
+				continue
+			}
+			p.log.Debugf("vulcand/oxy/tcpproxy: closing %v idle for %v", src.RemoteAddr(), idle)
+			src.Close()
+			dst.Close()
+			return written
+		}
+		if err != nil {
+			if err != io.EOF {
+				p.log.Debugf("vulcand/oxy/tcpproxy: stopped copying from %v: %v", src.RemoteAddr(), err)
+			}
+			return written
+		}
+	}
+}
+
+func sourceIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,157 @@
+package tcpproxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/roundrobin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoServer starts a TCP server sending back the bytes it receives
+func newEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func newProxy(t *testing.T, backends []string, options ...Option) (*Proxy, net.Listener) {
+	lb, err := roundrobin.New(nil)
+	require.NoError(t, err)
+	for _, b := range backends {
+		require.NoError(t, lb.UpsertServer(&url.URL{Scheme: "tcp", Host: b}))
+	}
+
+	p, err := New(lb, options...)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.Serve(l)
+	return p, l
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) string {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	return string(buf)
+}
+
+func TestProxy(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+
+	closed := make(chan ConnStats, 1)
+	p, l := newProxy(t, []string{backend.Addr().String()}, OnClose(func(s ConnStats) { closed <- s }))
+	defer l.Close()
+	addr := l.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	assert.Equal(t, "PING", echo(t, conn, "PING"))
+	assert.Equal(t, "hello", echo(t, conn, "hello"))
+	assert.Equal(t, int64(1), p.Stats().Connections)
+	conn.Close()
+
+	stats := <-closed
+	assert.Equal(t, backend.Addr().String(), stats.Backend)
+	assert.Equal(t, conn.LocalAddr().String(), stats.Source)
+	assert.Equal(t, int64(9), stats.BytesIn)
+	assert.Equal(t, int64(9), stats.BytesOut)
+	assert.NoError(t, stats.Err)
+
+	s := p.Stats()
+	assert.Equal(t, int64(0), s.Connections)
+	assert.Equal(t, int64(9), s.BytesIn)
+	assert.Equal(t, int64(9), s.BytesOut)
+}
+
+func TestMaxConnections(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+
+	closed := make(chan ConnStats, 1)
+	_, l := newProxy(t, []string{backend.Addr().String()}, MaxSourceConnections(1), OnClose(func(s ConnStats) { closed <- s }))
+	defer l.Close()
+	addr := l.Addr().String()
+
+	a, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer a.Close()
+	assert.Equal(t, "a", echo(t, a, "a"))
+
+	// the second connection of the same source is refused
+	b, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer b.Close()
+	_, err = b.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	stats := <-closed
+	assert.IsType(t, &MaxConnError{}, stats.Err)
+	assert.Empty(t, stats.Backend)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+
+	_, l := newProxy(t, []string{backend.Addr().String()}, IdleTimeout(50*time.Millisecond))
+	defer l.Close()
+	addr := l.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "a", echo(t, conn, "a"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDialAttempts(t *testing.T) {
+	backend := newEchoServer(t)
+	defer backend.Close()
+
+	// nothing listens on the address of a closed listener
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dead.Close()
+
+	p, l := newProxy(t, []string{dead.Addr().String(), backend.Addr().String()}, DialAttempts(2))
+	defer l.Close()
+	addr := l.Addr().String()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		assert.Equal(t, "a", echo(t, conn, "a"))
+		conn.Close()
+	}
+	assert.True(t, p.Stats().DialErrorRatio > 0)
+
+	_, err = New(nil)
+	assert.Error(t, err)
+	_, err = New(&roundrobin.RoundRobin{}, DialAttempts(0))
+	assert.Error(t, err)
+}
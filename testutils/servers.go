@@ -0,0 +1,103 @@
+package testutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewWebSocketEchoServer creates a new Server upgrading the requests to websocket connections
+// and sending back every message it receives, until the client closes the connection
+func NewWebSocketEchoServer() *httptest.Server {
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// DialWebSocket opens a websocket connection to the http:// or https:// URL of a Server, e.g. a proxy in front of NewWebSocketEchoServer
+func DialWebSocket(serverURL string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	u := ParseURI(serverURL)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	return websocket.DefaultDialer.Dial(u.String(), header)
+}
+
+// NewDripResponder creates a new Server answering every request with a chunked response made of count chunks,
+// each chunk being flushed interval after the previous one, to test streaming and timeouts
+func NewDripResponder(chunk string, count int, interval time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, _ := w.(http.Flusher)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				select {
+				case <-time.After(interval):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			w.Write([]byte(chunk))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}))
+}
+
+// FlakyServer is a Server failing its first requests before answering the next ones, to test the retry paths
+type FlakyServer struct {
+	*httptest.Server
+	requests int64
+}
+
+// NewFlakyServer creates a new FlakyServer failing the first failures requests with the status code,
+// or by closing the connection without answer if code is 0, then answering the next ones with the response
+func NewFlakyServer(failures int, code int, response string) *FlakyServer {
+	s := &FlakyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&s.requests, 1) > int64(failures) {
+			w.Write([]byte(response))
+			return
+		}
+		if code != 0 {
+			w.WriteHeader(code)
+			w.Write([]byte(strings.ToLower(http.StatusText(code))))
+			return
+		}
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}))
+	return s
+}
+
+// Requests returns the number of requests the server received, the failed ones included
+func (s *FlakyServer) Requests() int {
+	return int(atomic.LoadInt64(&s.requests))
+}
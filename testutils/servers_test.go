@@ -0,0 +1,69 @@
+package testutils
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketEchoServer(t *testing.T) {
+	srv := NewWebSocketEchoServer()
+	defer srv.Close()
+
+	conn, resp, err := DialWebSocket(srv.URL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+	mt, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, mt)
+	assert.Equal(t, "ping", string(msg))
+}
+
+func TestDripResponder(t *testing.T) {
+	srv := NewDripResponder("data\n", 3, 10*time.Millisecond)
+	defer srv.Close()
+
+	start := time.Now()
+	re, body, err := Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, []string{"chunked"}, re.TransferEncoding)
+	assert.Equal(t, "data\ndata\ndata\n", string(body))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+func TestFlakyServer(t *testing.T) {
+	srv := NewFlakyServer(2, http.StatusBadGateway, "ok")
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		re, _, err := Get(srv.URL)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, re.StatusCode)
+	}
+	re, body, err := Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, 3, srv.Requests())
+}
+
+func TestFlakyServerDropsConnections(t *testing.T) {
+	srv := NewFlakyServer(1, 0, "ok")
+	defer srv.Close()
+
+	_, _, err := Get(srv.URL)
+	assert.Error(t, err)
+
+	re, body, err := Get(srv.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "ok", string(body))
+}
@@ -0,0 +1,176 @@
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// TestCA is a certificate authority generated for the tests, issuing server and client certificates
+type TestCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// NewTestCA generates a new certificate authority valid for a day
+func NewTestCA() (*TestCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := certTemplate("oxy test CA")
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	tmpl.BasicConstraintsValid = true
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &TestCA{cert: cert, key: key, pool: pool}, nil
+}
+
+// Pool returns a pool holding the certificate of the authority, to verify the certificates it issued
+func (ca *TestCA) Pool() *x509.CertPool {
+	return ca.pool
+}
+
+// Certificate returns the certificate of the authority
+func (ca *TestCA) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// ServerCertificate issues a server certificate for the hosts, names or IP addresses
+func (ca *TestCA) ServerCertificate(hosts ...string) (tls.Certificate, error) {
+	tmpl, err := certTemplate("oxy test server")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	return ca.issue(tmpl)
+}
+
+// ClientCertificate issues a client certificate with the common name
+func (ca *TestCA) ClientCertificate(commonName string) (tls.Certificate, error) {
+	tmpl, err := certTemplate(commonName)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue(tmpl)
+}
+
+func (ca *TestCA) issue(tmpl *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func certTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"oxy"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+	}, nil
+}
+
+// TLSTestServer is a Server serving TLS with a certificate issued by its own CA
+type TLSTestServer struct {
+	*httptest.Server
+	CA *TestCA
+}
+
+// TLSServerOption provides options for the TLS test servers
+type TLSServerOption func(s *TLSTestServer) error
+
+// RequireClientCert makes the server require a client certificate issued by its CA, i.e. mutual TLS
+func RequireClientCert() TLSServerOption {
+	return func(s *TLSTestServer) error {
+		s.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		s.TLS.ClientCAs = s.CA.Pool()
+		return nil
+	}
+}
+
+// ServerNextProtos sets the protocols the server negotiates with ALPN, e.g. "h2" and "http/1.1"
+func ServerNextProtos(protos ...string) TLSServerOption {
+	return func(s *TLSTestServer) error {
+		s.TLS.NextProtos = protos
+		return nil
+	}
+}
+
+// NewTLSTestServer starts a new Server serving TLS for localhost, 127.0.0.1 and ::1 with a certificate issued
+// by a generated CA. The clients trust it with ClientTLSConfig.
+func NewTLSTestServer(handler http.Handler, opts ...TLSServerOption) (*TLSTestServer, error) {
+	ca, err := NewTestCA()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.ServerCertificate("localhost", "127.0.0.1", "::1")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TLSTestServer{Server: httptest.NewUnstartedServer(handler), CA: ca}
+	s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	for _, o := range opts {
+		if err := o(s); err != nil {
+			return nil, err
+		}
+	}
+	s.StartTLS()
+	return s, nil
+}
+
+// ClientTLSConfig returns a TLS configuration trusting the server, along with the client certificates if any
+func (s *TLSTestServer) ClientTLSConfig(certs ...tls.Certificate) *tls.Config {
+	return &tls.Config{RootCAs: s.CA.Pool(), Certificates: certs}
+}
+
+// ClientCertificate issues a client certificate the server accepts when it requires one
+func (s *TLSTestServer) ClientCertificate(commonName string) (tls.Certificate, error) {
+	return s.CA.ClientCertificate(commonName)
+}
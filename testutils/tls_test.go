@@ -0,0 +1,62 @@
+package testutils
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSTestServer(t *testing.T) {
+	srv, err := NewTLSTestServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.ServerName))
+	}))
+	require.NoError(t, err)
+	defer srv.Close()
+
+	// the certificate of the server is verified with the CA
+	re, _, err := Get(srv.URL, TLSConfig(srv.ClientTLSConfig()))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	// ... and issued for localhost
+	re, body, err := Get("https://localhost:"+ParseURI(srv.URL).Port(), TLSConfig(srv.ClientTLSConfig()))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "localhost", string(body))
+
+	other, err := NewTestCA()
+	require.NoError(t, err)
+	cfg := srv.ClientTLSConfig()
+	cfg.RootCAs = other.Pool()
+	_, _, err = Get(srv.URL, TLSConfig(cfg))
+	assert.Error(t, err)
+}
+
+func TestTLSTestServerClientCert(t *testing.T) {
+	srv, err := NewTLSTestServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}), RequireClientCert())
+	require.NoError(t, err)
+	defer srv.Close()
+
+	_, _, err = Get(srv.URL, TLSConfig(srv.ClientTLSConfig()))
+	assert.Error(t, err)
+
+	cert, err := srv.ClientCertificate("client-a")
+	require.NoError(t, err)
+
+	re, body, err := Get(srv.URL, TLSConfig(srv.ClientTLSConfig(cert)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+	assert.Equal(t, "client-a", string(body))
+
+	// a certificate issued by another CA is rejected
+	other, err := NewTestCA()
+	require.NoError(t, err)
+	cert, err = other.ClientCertificate("client-b")
+	require.NoError(t, err)
+	_, _, err = Get(srv.URL, TLSConfig(srv.ClientTLSConfig(cert)))
+	assert.Error(t, err)
+}
@@ -42,6 +42,7 @@ type ReqOpts struct {
 	Body    string
 	Headers http.Header
 	Auth    *utils.BasicAuth
+	TLS     *tls.Config
 }
 
 // ReqOption request option type
@@ -104,6 +105,15 @@ func BasicAuth(username, password string) ReqOption {
 	}
 }
 
+// TLSConfig sets the TLS configuration of the client for the https URLs, e.g. the ClientTLSConfig of a TLSTestServer.
+// The client skips the verification of the server certificate by default.
+func TLSConfig(c *tls.Config) ReqOption {
+	return func(o *ReqOpts) error {
+		o.TLS = c
+		return nil
+	}
+}
+
 // MakeRequest create and do a request
 func MakeRequest(url string, opts ...ReqOption) (*http.Response, []byte, error) {
 	o := &ReqOpts{}
@@ -135,7 +145,12 @@ func MakeRequest(url string, opts ...ReqOption) (*http.Response, []byte, error)
 	}
 
 	var tr *http.Transport
-	if strings.HasPrefix(url, "https") {
+	if strings.HasPrefix(url, "https") && o.TLS != nil {
+		tr = &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   o.TLS,
+		}
+	} else if strings.HasPrefix(url, "https") {
 		tr = &http.Transport{
 			DisableKeepAlives: true,
 			TLSClientConfig: &tls.Config{
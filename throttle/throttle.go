@@ -0,0 +1,363 @@
+/*
+Package throttle provides http.Handler middleware capping the bandwidth of the request and response bodies.
+
+The bytes read from the request bodies and written to the response bodies are metered by token buckets refilled
+at a rate in bytes per second: per connection, so that a single large download can't saturate the uplink of the proxy,
+and per key, as returned by a source extractor, so that a client opening many connections gets the same share.
+The reads and writes are delayed rather than rejected once a bucket is empty.
+
+Examples of a throttling middleware:
+
+	// sample HTTP handler
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	  w.Write([]byte("hello"))
+	})
+
+	// Cap the downloads to 1MB/s per connection and 4MB/s per client IP
+	extractor, _ := utils.NewExtractor("client.ip")
+	throttle.New(handler, extractor,
+		throttle.ConnRate(0, 1024*1024),
+		throttle.KeyRate(0, 4*1024*1024))
+*/
+package throttle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBurst is the number of bytes a full bucket lets through at once
+const DefaultBurst = 32 * 1024
+
+// Throttle delays the reads of the request bodies and the writes of the response bodies exceeding the rates
+type Throttle struct {
+	next       http.Handler
+	extract    utils.SourceExtractor
+	errHandler utils.ErrorHandler
+	clock      timetools.TimeProvider
+
+	connRead, connWrite int64
+	keyRead, keyWrite   int64
+	burst               int64
+
+	mutex   *sync.Mutex
+	buckets map[string]*buckets
+
+	log *log.Logger
+}
+
+// New returns a new throttling middleware. The extractor tells the key of the requests, it can be nil if the
+// middleware has no per key rates. New() function supports optional functional arguments
+func New(next http.Handler, extract utils.SourceExtractor, setters ...optSetter) (*Throttle, error) {
+	t := &Throttle{
+		next:    next,
+		extract: extract,
+		burst:   DefaultBurst,
+		mutex:   &sync.Mutex{},
+		buckets: make(map[string]*buckets),
+
+		log: log.StandardLogger(),
+	}
+	for _, s := range setters {
+		if err := s(t); err != nil {
+			return nil, err
+		}
+	}
+	if t.connRead == 0 && t.connWrite == 0 && t.keyRead == 0 && t.keyWrite == 0 {
+		return nil, fmt.Errorf("provide a connection or key rate")
+	}
+	if (t.keyRead != 0 || t.keyWrite != 0) && t.extract == nil {
+		return nil, fmt.Errorf("provide extract function for the key rates")
+	}
+	if t.errHandler == nil {
+		t.errHandler = utils.DefaultHandler
+	}
+	if t.clock == nil {
+		t.clock = &timetools.RealTime{}
+	}
+	return t, nil
+}
+
+type optSetter func(t *Throttle) error
+
+// ConnRate sets the bytes per second each connection can read from its request bodies and write to its response
+// bodies, 0 leaves a direction unlimited
+func ConnRate(read, write int64) optSetter {
+	return func(t *Throttle) error {
+		if read < 0 || write < 0 {
+			return fmt.Errorf("connection rates should be >= 0, got read %d, write %d", read, write)
+		}
+		t.connRead, t.connWrite = read, write
+		return nil
+	}
+}
+
+// KeyRate sets the bytes per second the connections sharing a key can read from their request bodies and write to
+// their response bodies altogether, 0 leaves a direction unlimited
+func KeyRate(read, write int64) optSetter {
+	return func(t *Throttle) error {
+		if read < 0 || write < 0 {
+			return fmt.Errorf("key rates should be >= 0, got read %d, write %d", read, write)
+		}
+		t.keyRead, t.keyWrite = read, write
+		return nil
+	}
+}
+
+// Burst sets the number of bytes a full bucket lets through at once, defaults to DefaultBurst.
+// The larger reads and writes are split.
+func Burst(bytes int64) optSetter {
+	return func(t *Throttle) error {
+		if bytes <= 0 {
+			return fmt.Errorf("burst should be > 0, got %d", bytes)
+		}
+		t.burst = bytes
+		return nil
+	}
+}
+
+// ErrorHandler sets the handler of the errors of the extractor
+func ErrorHandler(h utils.ErrorHandler) optSetter {
+	return func(t *Throttle) error {
+		t.errHandler = h
+		return nil
+	}
+}
+
+// Clock sets the clock measuring the rates and sleeping, for tests
+func Clock(clock timetools.TimeProvider) optSetter {
+	return func(t *Throttle) error {
+		t.clock = clock
+		return nil
+	}
+}
+
+// Logger defines the logger the throttle will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) optSetter {
+	return func(t *Throttle) error {
+		t.log = l
+		return nil
+	}
+}
+
+// Wrap sets the next handler to be called by throttle handler.
+func (t *Throttle) Wrap(next http.Handler) {
+	t.next = next
+}
+
+func (t *Throttle) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var keys []string
+	if t.connRead != 0 || t.connWrite != 0 {
+		// the remote address tells the connection apart, the streams of an HTTP/2 connection included
+		keys = append(keys, connPrefix+req.RemoteAddr)
+	}
+	if t.keyRead != 0 || t.keyWrite != 0 {
+		source, _, err := t.extract.Extract(req)
+		if err != nil {
+			t.log.Debugf("vulcand/oxy/throttle: failed to extract the key of Request(%v %v): %v", req.Method, req.URL, err)
+			t.errHandler.ServeHTTP(w, req, err)
+			return
+		}
+		keys = append(keys, keyPrefix+source)
+	}
+
+	bs := t.acquire(keys)
+	defer t.release(keys)
+
+	var read, write []*bucket
+	for _, b := range bs {
+		if b.read != nil {
+			read = append(read, b.read)
+		}
+		if b.write != nil {
+			write = append(write, b.write)
+		}
+	}
+
+	newReq := req
+	if len(read) != 0 && req.Body != nil && req.Body != http.NoBody {
+		// make shallow copy of request before changing anything to avoid side effects
+		r := *req
+		r.Body = &throttledReader{ReadCloser: req.Body, t: t, buckets: read}
+		newReq = &r
+	}
+	if len(write) != 0 {
+		w = &throttledWriter{ResponseWriter: w, t: t, buckets: write}
+	}
+	t.next.ServeHTTP(w, newReq)
+}
+
+// prefixes of the keys of the buckets
+const (
+	connPrefix = "conn:"
+	keyPrefix  = "key:"
+)
+
+// buckets meter the two directions of a connection or key, nil buckets are unlimited
+type buckets struct {
+	read, write *bucket
+	refs        int
+}
+
+// acquire returns the buckets of the keys, creating the missing ones
+func (t *Throttle) acquire(keys []string) []*buckets {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.clock.UtcNow()
+	bs := make([]*buckets, len(keys))
+	for i, key := range keys {
+		b, ok := t.buckets[key]
+		if !ok {
+			read, write := t.connRead, t.connWrite
+			if strings.HasPrefix(key, keyPrefix) {
+				read, write = t.keyRead, t.keyWrite
+			}
+			b = &buckets{read: newBucket(read, t.burst, now), write: newBucket(write, t.burst, now)}
+			t.buckets[key] = b
+		}
+		b.refs++
+		bs[i] = b
+	}
+	return bs
+}
+
+// release forgets the buckets of the keys no request uses anymore
+func (t *Throttle) release(keys []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range keys {
+		if b := t.buckets[key]; b != nil {
+			if b.refs--; b.refs == 0 {
+				delete(t.buckets, key)
+			}
+		}
+	}
+}
+
+// wait takes n bytes out of the buckets and sleeps until all of them have let them through
+func (t *Throttle) wait(bs []*bucket, n int) {
+	if n <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	now := t.clock.UtcNow()
+	var delay time.Duration
+	for _, b := range bs {
+		if d := b.take(now, int64(n)); d > delay {
+			delay = d
+		}
+	}
+	t.mutex.Unlock()
+	if delay > 0 {
+		t.clock.Sleep(delay)
+	}
+}
+
+// bucket is a token bucket of bytes, it goes into debt so that the callers wait for the bytes they took
+type bucket struct {
+	rate   int64 // bytes per second
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst int64, now time.Time) *bucket {
+	if rate == 0 {
+		return nil
+	}
+	return &bucket{rate: rate, burst: burst, tokens: float64(burst), last: now}
+}
+
+// take takes n bytes out of the bucket and returns the time to wait until the bucket is out of debt
+func (b *bucket) take(now time.Time, n int64) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * float64(b.rate)
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// throttledReader delays the reads of the request body
+type throttledReader struct {
+	io.ReadCloser
+	t       *Throttle
+	buckets []*bucket
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.t.burst {
+		p = p[:r.t.burst]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.t.wait(r.buckets, n)
+	return n, err
+}
+
+// throttledWriter delays the writes of the response body. The hijacked connections are not throttled.
+type throttledWriter struct {
+	http.ResponseWriter
+	t       *Throttle
+	buckets []*bucket
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > w.t.burst {
+			chunk = chunk[:w.t.burst]
+		}
+		w.t.wait(w.buckets, len(chunk))
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush sends any buffered data to the client
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that receives at most a single value (true) when the client connection has gone away
+func (w *throttledWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(<-chan bool)
+}
+
+// Hijack lets the caller take over the connection, e.g. for websockets
+func (w *throttledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("the response writer %T does not implement http.Hijacker", w.ResponseWriter)
+}
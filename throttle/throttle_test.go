@@ -0,0 +1,148 @@
+package throttle
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/utils"
+	"github.com/mailgun/timetools"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeHandler(size int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), size))
+	})
+}
+
+func TestConnWriteRate(t *testing.T) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	start := clock.UtcNow()
+
+	th, err := New(writeHandler(100*1024), nil, ConnRate(0, 10*1024), Burst(10*1024), Clock(clock))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	th.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, 100*1024, rw.Body.Len())
+	// the first 10KB are let through by the full bucket
+	assert.Equal(t, 9*time.Second, clock.UtcNow().Sub(start))
+}
+
+func TestConnReadRate(t *testing.T) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	start := clock.UtcNow()
+
+	var body []byte
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		w.Write([]byte("ok"))
+	})
+	th, err := New(handler, nil, ConnRate(1024, 0), Burst(1024), Clock(clock))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	th.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("b", 5*1024))))
+
+	assert.Equal(t, 5*1024, len(body))
+	assert.Equal(t, "ok", rw.Body.String())
+	assert.Equal(t, 4*time.Second, clock.UtcNow().Sub(start))
+}
+
+func TestUnlimitedDirection(t *testing.T) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	start := clock.UtcNow()
+
+	th, err := New(writeHandler(100*1024), nil, ConnRate(1024, 0), Clock(clock))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	th.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, 100*1024, rw.Body.Len())
+	assert.Equal(t, time.Duration(0), clock.UtcNow().Sub(start))
+}
+
+func TestKeyRateIsShared(t *testing.T) {
+	extract := utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		return "client", 1, nil
+	})
+	th, err := New(writeHandler(50*1024), extract, KeyRate(0, 100*1024), Burst(10*1024))
+	require.NoError(t, err)
+
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			th.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Equal(t, 50*1024, rw.Body.Len())
+		}()
+	}
+	wg.Wait()
+
+	// 90KB over the burst at 100KB/s, one connection alone would take 400ms
+	assert.True(t, time.Since(start) >= 800*time.Millisecond, "elapsed %v", time.Since(start))
+
+	// the buckets are forgotten once the requests are done
+	assert.Len(t, th.buckets, 0)
+}
+
+func TestConnRateIsPerConnection(t *testing.T) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2012, 3, 4, 5, 6, 7, 0, time.UTC)}
+	start := clock.UtcNow()
+
+	var th *Throttle
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), 1024))
+		if req.RemoteAddr != "192.0.2.2:1234" {
+			// another connection starts with a full bucket while this one is in flight
+			other := httptest.NewRequest(http.MethodGet, "/", nil)
+			other.RemoteAddr = "192.0.2.2:1234"
+			th.ServeHTTP(httptest.NewRecorder(), other)
+		}
+	})
+	th, err := New(handler, nil, ConnRate(0, 1024), Burst(1024), Clock(clock))
+	require.NoError(t, err)
+
+	th.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, time.Duration(0), clock.UtcNow().Sub(start))
+}
+
+func TestExtractError(t *testing.T) {
+	extract := utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		return "", 0, assert.AnError
+	})
+	th, err := New(writeHandler(10), extract, KeyRate(1024, 1024))
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	th.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+}
+
+func TestNewErrors(t *testing.T) {
+	_, err := New(writeHandler(10), nil)
+	assert.Error(t, err)
+
+	_, err = New(writeHandler(10), nil, KeyRate(1024, 0))
+	assert.Error(t, err)
+
+	_, err = New(writeHandler(10), nil, ConnRate(-1, 0))
+	assert.Error(t, err)
+
+	_, err = New(writeHandler(10), nil, ConnRate(1024, 0), Burst(0))
+	assert.Error(t, err)
+}
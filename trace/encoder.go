@@ -0,0 +1,269 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/heebyunglee/oxy/utils"
+)
+
+// RequestIDHeader is the header carrying the ID of the request recorded as FieldRequestID,
+// when the request was not given one by the requestid middleware
+const RequestIDHeader = utils.RequestIDHeader
+
+// Field is a value of a record that can be selected with the Fields option
+type Field string
+
+// Fields of the records
+const (
+	FieldTime            Field = "time"             // time the request was received, RFC 3339
+	FieldMethod          Field = "method"           // request method
+	FieldURL             Field = "url"              // request URL
+	FieldProto           Field = "proto"            // protocol version of the request
+	FieldStatus          Field = "status"           // response status code
+	FieldClientIP        Field = "client_ip"        // IP address of the client
+	FieldUser            Field = "user"             // user name of the basic authentication
+	FieldTLSVersion      Field = "tls_version"      // TLS version, if it's a TLS connection
+	FieldUpstream        Field = "upstream"         // URL of the server the request was forwarded to
+	FieldUpstreamLatency Field = "upstream_latency" // time the server took to send the response headers in milliseconds
+	FieldLatency         Field = "latency"          // total time spent serving the request in milliseconds
+	FieldBytesIn         Field = "bytes_in"         // size of the request body in bytes
+	FieldBytesOut        Field = "bytes_out"        // size of the response body in bytes
+	FieldRequestID       Field = "request_id"       // request ID
+	FieldReferer         Field = "referer"          // referring URL
+	FieldUserAgent       Field = "user_agent"       // user agent of the client
+)
+
+var knownFields = map[Field]bool{
+	FieldTime: true, FieldMethod: true, FieldURL: true, FieldProto: true, FieldStatus: true,
+	FieldClientIP: true, FieldUser: true, FieldTLSVersion: true, FieldUpstream: true, FieldUpstreamLatency: true,
+	FieldLatency: true, FieldBytesIn: true, FieldBytesOut: true, FieldRequestID: true, FieldReferer: true,
+	FieldUserAgent: true,
+}
+
+// DefaultFields are the fields written by the encoders when the Fields option is not set
+var DefaultFields = []Field{
+	FieldTime, FieldClientIP, FieldMethod, FieldURL, FieldStatus, FieldLatency, FieldBytesIn, FieldBytesOut,
+}
+
+// Fields selects the fields of the records and their order, e.g.
+//
+// Fields(FieldTime, FieldClientIP, FieldUpstream, FieldUpstreamLatency, FieldLatency)
+//
+// The JSON lines encoder then writes flat objects of these fields instead of the whole record.
+func Fields(fields ...Field) Option {
+	return func(t *Tracer) error {
+		if len(fields) == 0 {
+			return fmt.Errorf("provide at least one field")
+		}
+		for _, f := range fields {
+			if !knownFields[f] {
+				return fmt.Errorf("unknown field %q", f)
+			}
+		}
+		t.fields = fields
+		return nil
+	}
+}
+
+// Format sets the encoder of the records, defaults to JSONLines
+func Format(e Encoder) Option {
+	return func(t *Tracer) error {
+		if e == nil {
+			return fmt.Errorf("encoder can not be nil")
+		}
+		t.encoder = e
+		return nil
+	}
+}
+
+// Encoder writes a record to the output of the tracer. Fields are the fields selected with the Fields option,
+// nil if none were selected. Records are written concurrently, an encoder should write a record at once.
+type Encoder interface {
+	Encode(w io.Writer, r *Record, fields []Field) error
+}
+
+// EncoderFunc is an adapter to use ordinary functions as encoders
+type EncoderFunc func(w io.Writer, r *Record, fields []Field) error
+
+// Encode calls f(w, r, fields)
+func (f EncoderFunc) Encode(w io.Writer, r *Record, fields []Field) error {
+	return f(w, r, fields)
+}
+
+// Value returns the value of the field, nil if the record has none
+func (r *Record) Value(f Field) interface{} {
+	switch f {
+	case FieldTime:
+		return r.Start.Format(time.RFC3339Nano)
+	case FieldMethod:
+		return r.Request.Method
+	case FieldURL:
+		return r.Request.URL
+	case FieldProto:
+		return r.Request.Proto
+	case FieldStatus:
+		return r.Response.Code
+	case FieldClientIP:
+		return r.Request.ClientIP
+	case FieldUser:
+		return optional(r.Request.User)
+	case FieldTLSVersion:
+		if r.Request.TLS == nil {
+			return nil
+		}
+		return r.Request.TLS.Version
+	case FieldUpstream:
+		if r.Upstream == nil {
+			return nil
+		}
+		return r.Upstream.URL
+	case FieldUpstreamLatency:
+		if r.Upstream == nil {
+			return nil
+		}
+		return r.Upstream.Roundtrip
+	case FieldLatency:
+		return r.Response.Roundtrip
+	case FieldBytesIn:
+		return r.Request.BodyBytes
+	case FieldBytesOut:
+		return r.Response.BodyBytes
+	case FieldRequestID:
+		return optional(r.Request.ID)
+	case FieldReferer:
+		return optional(r.Request.Referer)
+	case FieldUserAgent:
+		return optional(r.Request.UserAgent)
+	}
+	return nil
+}
+
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// JSONLines returns an encoder writing a JSON object per line. The whole record is written
+// unless fields are selected, a flat object of the selected fields is written then.
+func JSONLines() Encoder {
+	return EncoderFunc(encodeJSON)
+}
+
+func encodeJSON(w io.Writer, r *Record, fields []Field) error {
+	if len(fields) == 0 {
+		return json.NewEncoder(w).Encode(r)
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(string(f))
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(r.Value(f))
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Logfmt returns an encoder writing the fields as key=value pairs separated by spaces, a record per line.
+// DefaultFields are written unless fields are selected, missing values are left empty.
+func Logfmt() Encoder {
+	return EncoderFunc(encodeLogfmt)
+}
+
+func encodeLogfmt(w io.Writer, r *Record, fields []Field) error {
+	if len(fields) == 0 {
+		fields = DefaultFields
+	}
+	buf := &bytes.Buffer{}
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(string(f))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(r.Value(f)))
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		s = val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+	if s == "" || strings.IndexFunc(s, needsQuoting) != -1 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func needsQuoting(r rune) bool {
+	return r <= ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+}
+
+// ApacheCombined returns an encoder writing the records in the Combined Log Format of the Apache HTTP server:
+//
+// 127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326 "http://example.com/" "Mozilla/5.0"
+//
+// The format is fixed, the selected fields are ignored.
+func ApacheCombined() Encoder {
+	return EncoderFunc(encodeCombined)
+}
+
+func encodeCombined(w io.Writer, r *Record, fields []Field) error {
+	bytesOut := "-"
+	if r.Response.BodyBytes > 0 {
+		bytesOut = strconv.FormatInt(r.Response.BodyBytes, 10)
+	}
+	_, err := fmt.Fprintf(w, "%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		orDash(r.Request.ClientIP),
+		orDash(r.Request.User),
+		r.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Request.Method, escapeQuotes(r.Request.URL), r.Request.Proto,
+		r.Response.Code,
+		bytesOut,
+		orDash(escapeQuotes(r.Request.Referer)),
+		orDash(escapeQuotes(r.Request.UserAgent)))
+	return err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func escapeQuotes(s string) string {
+	return strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1)
+}
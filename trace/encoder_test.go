@@ -0,0 +1,124 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/forward"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vulcand/oxy/testutils"
+)
+
+func TestTraceFieldsJSON(t *testing.T) {
+	backend := testutils.NewHandler(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer backend.Close()
+
+	fwd, err := forward.New()
+	require.NoError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL = testutils.ParseURI(backend.URL)
+		fwd.ServeHTTP(w, req)
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, Fields(FieldClientIP, FieldUpstream, FieldUpstreamLatency, FieldLatency, FieldRequestID, FieldTLSVersion))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	re, _, err := testutils.Get(srv.URL, testutils.Header(RequestIDHeader, "abc"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, re.StatusCode)
+
+	var r map[string]interface{}
+	require.NoError(t, json.Unmarshal(trace.Bytes(), &r))
+
+	assert.Len(t, r, 6)
+	assert.Equal(t, "127.0.0.1", r["client_ip"])
+	assert.Equal(t, backend.URL, r["upstream"])
+	assert.Equal(t, "abc", r["request_id"])
+	assert.Nil(t, r["tls_version"])
+	assert.True(t, r["latency"].(float64) >= r["upstream_latency"].(float64))
+	assert.True(t, strings.HasPrefix(trace.String(), `{"client_ip":"127.0.0.1","upstream":`))
+}
+
+func TestTraceLogfmt(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, Format(Logfmt()), Fields(FieldMethod, FieldURL, FieldStatus, FieldBytesIn, FieldBytesOut, FieldUserAgent, FieldUpstream))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/hello?a=b", ioutil.NopCloser(strings.NewReader("123456")))
+	req.Header.Set("User-Agent", "oxy test")
+	tr.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, "method=POST url=\"/hello?a=b\" status=201 bytes_in=6 bytes_out=5 user_agent=\"oxy test\" upstream=\n", trace.String())
+}
+
+func TestTraceLogfmtDefaultFields(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, Format(Logfmt()))
+	require.NoError(t, err)
+
+	tr.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	line := trace.String()
+	for _, f := range DefaultFields {
+		assert.Contains(t, line, string(f)+"=")
+	}
+	assert.Contains(t, line, " client_ip=192.0.2.1 method=GET url=/ status=200 ")
+}
+
+func TestTraceApacheCombined(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	trace := &bytes.Buffer{}
+	tr, err := New(handler, trace, Format(ApacheCombined()))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+	req.SetBasicAuth("frank", "secret")
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("User-Agent", `Mozilla/5.0 "test"`)
+	tr.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := trace.String()
+	assert.True(t, strings.HasPrefix(line, "192.0.2.1 - frank ["), line)
+	assert.True(t, strings.HasSuffix(line, `] "GET /index.html HTTP/1.1" 200 5 "http://example.com/" "Mozilla/5.0 \"test\""`+"\n"), line)
+
+	start := line[strings.Index(line, "[")+1 : strings.Index(line, "]")]
+	_, err = time.Parse("02/Jan/2006:15:04:05 -0700", start)
+	assert.NoError(t, err)
+}
+
+func TestTraceFieldsValidation(t *testing.T) {
+	_, err := New(http.NotFoundHandler(), &bytes.Buffer{}, Fields())
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), &bytes.Buffer{}, Fields(FieldMethod, Field("unknown")))
+	assert.Error(t, err)
+
+	_, err = New(http.NotFoundHandler(), &bytes.Buffer{}, Format(nil))
+	assert.Error(t, err)
+}
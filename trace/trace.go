@@ -3,15 +3,16 @@ package trace
 
 import (
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/heebyunglee/oxy/utils"
 	log "github.com/sirupsen/logrus"
-	"github.com/vulcand/oxy/utils"
 )
 
 // Option is a functional option setter for Tracer
@@ -41,24 +42,29 @@ func ResponseHeaders(headers ...string) Option {
 	}
 }
 
-// Tracer records request and response emitting JSON structured data to the output
+// Tracer records request and response emitting structured data to the output
 type Tracer struct {
 	errHandler  utils.ErrorHandler
 	next        http.Handler
 	reqHeaders  []string
 	respHeaders []string
 	writer      io.Writer
+	fields      []Field
+	encoder     Encoder
 
-	log *log.Logger
+	log    *log.Logger
+	logger utils.Logger
 }
 
 // New creates a new Tracer middleware that emits all the request/response information in structured format
 // to writer and passes the request to the next handler. It can optionally capture request and response headers,
-// see RequestHeaders and ResponseHeaders options for details.
+// see RequestHeaders and ResponseHeaders options for details. The records are written as JSON lines by default,
+// see Fields and Format options to select what is recorded and how.
 func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 	t := &Tracer{
-		writer: writer,
-		next:   next,
+		writer:  writer,
+		next:    next,
+		encoder: JSONLines(),
 
 		log: log.StandardLogger(),
 	}
@@ -70,6 +76,9 @@ func New(next http.Handler, writer io.Writer, opts ...Option) (*Tracer, error) {
 	if t.errHandler == nil {
 		t.errHandler = utils.DefaultHandler
 	}
+	if t.logger == nil {
+		t.logger = utils.NewLogrusLogger(t.log)
+	}
 	return t, nil
 }
 
@@ -83,35 +92,108 @@ func Logger(l *log.Logger) Option {
 	}
 }
 
+// StructuredLogger defines the structured logger the tracer logs the requests with,
+// the fields of the requests, e.g. their ID and route, are added to every line.
+//
+// It defaults to an adapter of the logger set by Logger.
+func StructuredLogger(l utils.Logger) Option {
+	return func(t *Tracer) error {
+		t.logger = l
+		return nil
+	}
+}
+
 func (t *Tracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
+	req, upstream := utils.WithUpstream(req)
+
+	// count the bytes of the bodies of unknown length as they are read
+	var in *countingReader
+	if bodyBytes(req.Header) == 0 && req.Body != nil && req.Body != http.NoBody {
+		in = &countingReader{ReadCloser: req.Body}
+		req.Body = in
+	}
+
 	pw := utils.NewProxyWriterWithLogger(w, t.log)
 	t.next.ServeHTTP(pw, req)
 
-	l := t.newRecord(req, pw, time.Since(start))
-	if err := json.NewEncoder(t.writer).Encode(l); err != nil {
-		t.log.Errorf("Failed to marshal request: %v", err)
+	l := t.newRecord(req, pw, start, time.Since(start))
+	if in != nil {
+		l.Request.BodyBytes = in.count()
+	}
+	if u := upstream.URL(); u != nil {
+		l.Upstream = &Upstream{
+			URL:       u.String(),
+			Roundtrip: float64(upstream.Latency()) / float64(time.Millisecond),
+		}
+	}
+	if err := t.encoder.Encode(t.writer, l, t.fields); err != nil {
+		utils.RequestLogger(req, t.logger).Errorf("Failed to marshal request: %v", err)
 	}
 }
 
-func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, diff time.Duration) *Record {
+func (t *Tracer) newRecord(req *http.Request, pw *utils.ProxyWriter, start time.Time, diff time.Duration) *Record {
+	user, _, _ := req.BasicAuth()
+	out := bodyBytes(pw.Header())
+	if out == 0 {
+		out = pw.GetLength()
+	}
 	return &Record{
+		Start: start,
 		Request: Request{
 			Method:    req.Method,
 			URL:       req.URL.String(),
+			Proto:     req.Proto,
+			ClientIP:  clientIP(req),
+			User:      user,
+			ID:        requestID(req),
+			Referer:   req.Referer(),
+			UserAgent: req.UserAgent(),
 			TLS:       newTLS(req),
 			BodyBytes: bodyBytes(req.Header),
 			Headers:   captureHeaders(req.Header, t.reqHeaders),
 		},
 		Response: Response{
 			Code:      pw.StatusCode(),
-			BodyBytes: bodyBytes(pw.Header()),
+			BodyBytes: out,
 			Roundtrip: float64(diff) / float64(time.Millisecond),
 			Headers:   captureHeaders(pw.Header(), t.respHeaders),
 		},
 	}
 }
 
+// requestID returns the ID assigned by the requestid middleware, or the one sent by the client
+func requestID(req *http.Request) string {
+	if id := utils.RequestIDFromRequest(req); id != "" {
+		return id
+	}
+	return req.Header.Get(RequestIDHeader)
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// countingReader counts the bytes read from the request body, possibly by the goroutine of a transport
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReader) count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
+
 func newTLS(req *http.Request) *TLS {
 	if req.TLS == nil {
 		return nil
@@ -143,17 +225,25 @@ func captureHeaders(in http.Header, headers []string) http.Header {
 
 // Record represents a structured request and response record
 type Record struct {
-	Request  Request  `json:"request"`
-	Response Response `json:"response"`
+	Start    time.Time `json:"start"`              // Start - time the request was received
+	Request  Request   `json:"request"`            // Request - the request received from the client
+	Response Response  `json:"response"`           // Response - the response sent to the client
+	Upstream *Upstream `json:"upstream,omitempty"` // Upstream - optional upstream record, will be recorded if the request was forwarded
 }
 
 // Request contains information about an HTTP request
 type Request struct {
-	Method    string      `json:"method"`            // Method - request method
-	BodyBytes int64       `json:"body_bytes"`        // BodyBytes - size of request body in bytes
-	URL       string      `json:"url"`               // URL - Request URL
-	Headers   http.Header `json:"headers,omitempty"` // Headers - optional request headers, will be recorded if configured
-	TLS       *TLS        `json:"tls,omitempty"`     // TLS - optional TLS record, will be recorded if it's a TLS connection
+	Method    string      `json:"method"`               // Method - request method
+	BodyBytes int64       `json:"body_bytes"`           // BodyBytes - size of request body in bytes
+	URL       string      `json:"url"`                  // URL - Request URL
+	Proto     string      `json:"proto,omitempty"`      // Proto - protocol version of the request
+	ClientIP  string      `json:"client_ip,omitempty"`  // ClientIP - IP address of the client
+	User      string      `json:"user,omitempty"`       // User - user name of the basic authentication, if any
+	ID        string      `json:"id,omitempty"`         // ID - request ID, will be recorded if the request carries one
+	Referer   string      `json:"referer,omitempty"`    // Referer - referring URL, if any
+	UserAgent string      `json:"user_agent,omitempty"` // UserAgent - user agent of the client, if any
+	Headers   http.Header `json:"headers,omitempty"`    // Headers - optional request headers, will be recorded if configured
+	TLS       *TLS        `json:"tls,omitempty"`        // TLS - optional TLS record, will be recorded if it's a TLS connection
 }
 
 // Response contains information about HTTP response
@@ -164,6 +254,12 @@ type Response struct {
 	BodyBytes int64       `json:"body_bytes"`        // BodyBytes - size of response body in bytes
 }
 
+// Upstream contains information about the server the request was forwarded to
+type Upstream struct {
+	URL       string  `json:"url"`       // URL - URL of the server
+	Roundtrip float64 `json:"roundtrip"` // Roundtrip - time the server took to send the response headers in milliseconds
+}
+
 // TLS contains information about this TLS connection
 type TLS struct {
 	Version     string `json:"version"`      // Version - TLS version
@@ -182,6 +278,8 @@ func versionToString(v uint16) string {
 		return "TLS11"
 	case tls.VersionTLS12:
 		return "TLS12"
+	case tls.VersionTLS13:
+		return "TLS13"
 	}
 	return fmt.Sprintf("unknown: %x", v)
 }
@@ -0,0 +1,295 @@
+/*
+Package udpproxy provides a proxy of UDP datagrams, e.g. for DNS or syslog servers.
+
+The datagrams of a client, identified by its address and port, make up a session forwarded to one backend
+picked by a load balancer of the roundrobin package, the servers being udp:// URLs. The replies of the backend
+are sent back to the client. The sessions receiving no datagram in either direction for the idle timeout are closed.
+
+Examples of a UDP proxy:
+
+	lb, _ := roundrobin.New(nil)
+	lb.UpsertServer(testutils.ParseURI("udp://10.0.0.1:53"))
+	lb.UpsertServer(testutils.ParseURI("udp://10.0.0.2:53"))
+
+	p, _ := udpproxy.New(lb, udpproxy.IdleTimeout(30*time.Second))
+
+	conn, _ := net.ListenPacket("udp", ":53")
+	p.Serve(conn)
+*/
+package udpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the proxy
+const (
+	DefaultIdleTimeout = time.Minute
+	// maxDatagramSize is the largest UDP payload
+	maxDatagramSize = 65535
+)
+
+// Balancer picks the backend of the sessions, e.g. a roundrobin.RoundRobin whose servers are udp://host:port URLs
+type Balancer interface {
+	NextServer() (*url.URL, error)
+}
+
+// Stats describes the activity of the proxy
+type Stats struct {
+	// Sessions is the number of open sessions
+	Sessions int
+	// DatagramsIn and BytesIn are the datagrams and bytes forwarded from the clients to the backends
+	DatagramsIn int64
+	BytesIn     int64
+	// DatagramsOut and BytesOut are the datagrams and bytes forwarded from the backends to the clients
+	DatagramsOut int64
+	BytesOut     int64
+	// Dropped is the number of datagrams of the clients that could not be forwarded
+	Dropped int64
+}
+
+// Proxy forwards the datagrams of the clients to the backends picked by a load balancer
+type Proxy struct {
+	lb          Balancer
+	idleTimeout time.Duration
+	maxSessions int
+
+	mutex    *sync.Mutex
+	sessions map[string]*session
+
+	datagramsIn  int64
+	bytesIn      int64
+	datagramsOut int64
+	bytesOut     int64
+	dropped      int64
+
+	log *log.Logger
+}
+
+// session forwards the datagrams of a client to its backend
+type session struct {
+	client   net.Addr
+	backend  *net.UDPConn
+	activity int64 // unix nanoseconds of the last datagram in either direction
+	closed   int32 // set once the backend connection is closed
+}
+
+// New returns a new UDP proxy forwarding the datagrams to the backends picked by the load balancer
+func New(lb Balancer, options ...Option) (*Proxy, error) {
+	if lb == nil {
+		return nil, fmt.Errorf("load balancer can not be nil")
+	}
+	p := &Proxy{
+		lb:          lb,
+		idleTimeout: DefaultIdleTimeout,
+		mutex:       &sync.Mutex{},
+		sessions:    make(map[string]*session),
+		log:         log.StandardLogger(),
+	}
+	for _, o := range options {
+		if err := o(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Option provides options for the proxy
+type Option func(p *Proxy) error
+
+// IdleTimeout sets the time after which the sessions without datagrams in either direction are closed,
+// defaults to DefaultIdleTimeout
+func IdleTimeout(d time.Duration) Option {
+	return func(p *Proxy) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout should be > 0")
+		}
+		p.idleTimeout = d
+		return nil
+	}
+}
+
+// MaxSessions caps the open sessions, the datagrams of the new clients are dropped beyond. Unlimited by default.
+func MaxSessions(max int) Option {
+	return func(p *Proxy) error {
+		if max < 0 {
+			return fmt.Errorf("max sessions should be >= 0")
+		}
+		p.maxSessions = max
+		return nil
+	}
+}
+
+// Logger defines the logger the proxy will use.
+//
+// It defaults to logrus.StandardLogger(), the global logger used by logrus.
+func Logger(l *log.Logger) Option {
+	return func(p *Proxy) error {
+		p.log = l
+		return nil
+	}
+}
+
+// Stats returns the activity of the proxy
+func (p *Proxy) Stats() Stats {
+	p.mutex.Lock()
+	sessions := len(p.sessions)
+	p.mutex.Unlock()
+	return Stats{
+		Sessions:     sessions,
+		DatagramsIn:  atomic.LoadInt64(&p.datagramsIn),
+		BytesIn:      atomic.LoadInt64(&p.bytesIn),
+		DatagramsOut: atomic.LoadInt64(&p.datagramsOut),
+		BytesOut:     atomic.LoadInt64(&p.bytesOut),
+		Dropped:      atomic.LoadInt64(&p.dropped),
+	}
+}
+
+// Serve forwards the datagrams received on conn until it is closed, the open sessions are closed along
+func (p *Proxy) Serve(conn net.PacketConn) error {
+	defer p.closeSessions()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		if err := p.forward(conn, client, buf[:n]); err != nil {
+			p.log.Debugf("vulcand/oxy/udpproxy: dropping the datagram of %v: %v", client, err)
+			atomic.AddInt64(&p.dropped, 1)
+			continue
+		}
+		atomic.AddInt64(&p.datagramsIn, 1)
+		atomic.AddInt64(&p.bytesIn, int64(n))
+	}
+}
+
+// forward writes the datagram to the backend of the client. The session may be closed as idle right when
+// the datagram arrives, the datagram is then written once more to a new session.
+func (p *Proxy) forward(conn net.PacketConn, client net.Addr, b []byte) error {
+	for attempt := 1; ; attempt++ {
+		s, err := p.session(conn, client)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&s.activity, time.Now().UnixNano())
+		_, err = s.backend.Write(b)
+		if err == nil || attempt > 1 || atomic.LoadInt32(&s.closed) == 0 {
+			return err
+		}
+		// makes sure the stale session is not returned again
+		p.closeSession(s)
+	}
+}
+
+// session returns the session of the client, a new one is opened with a backend if it has none
+func (p *Proxy) session(conn net.PacketConn, client net.Addr) (*session, error) {
+	key := client.String()
+
+	p.mutex.Lock()
+	s, ok := p.sessions[key]
+	full := p.maxSessions > 0 && len(p.sessions) >= p.maxSessions
+	p.mutex.Unlock()
+	if ok {
+		return s, nil
+	}
+	if full {
+		return nil, fmt.Errorf("max sessions reached: %d", p.maxSessions)
+	}
+
+	// the backend is resolved and dialed without holding the lock, the stats and the replies are not blocked
+	u, err := p.lb.NextServer()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// another session may have been opened in the meantime
+	if s, ok := p.sessions[key]; ok {
+		backend.Close()
+		return s, nil
+	}
+	if p.maxSessions > 0 && len(p.sessions) >= p.maxSessions {
+		backend.Close()
+		return nil, fmt.Errorf("max sessions reached: %d", p.maxSessions)
+	}
+
+	s = &session{client: client, backend: backend, activity: time.Now().UnixNano()}
+	p.sessions[key] = s
+	go p.reply(conn, s)
+	return s, nil
+}
+
+// reply sends the datagrams of the backend back to the client until the session is idle for too long
+func (p *Proxy) reply(conn net.PacketConn, s *session) {
+	defer p.closeSession(s)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		s.backend.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		n, err := s.backend.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// the client may still be sending
+				if time.Since(time.Unix(0, atomic.LoadInt64(&s.activity))) < p.idleTimeout {
+					continue
+				}
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// e.g. the ICMP port unreachable of a backend not listening yet
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&s.activity, time.Now().UnixNano())
+		if _, err := conn.WriteTo(buf[:n], s.client); err != nil {
+			p.log.Debugf("vulcand/oxy/udpproxy: failed to send a reply to %v: %v", s.client, err)
+			return
+		}
+		atomic.AddInt64(&p.datagramsOut, 1)
+		atomic.AddInt64(&p.bytesOut, int64(n))
+	}
+}
+
+func (p *Proxy) closeSession(s *session) {
+	atomic.StoreInt32(&s.closed, 1)
+	p.mutex.Lock()
+	if p.sessions[s.client.String()] == s {
+		delete(p.sessions, s.client.String())
+	}
+	p.mutex.Unlock()
+	s.backend.Close()
+}
+
+func (p *Proxy) closeSessions() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, s := range p.sessions {
+		atomic.StoreInt32(&s.closed, 1)
+		s.backend.Close()
+		delete(p.sessions, key)
+	}
+}
@@ -0,0 +1,230 @@
+package udpproxy
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heebyunglee/oxy/roundrobin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoServer starts a UDP server sending back the datagrams it receives prefixed with its name
+func newEchoServer(t *testing.T, name string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(name+":"), buf[:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+func newProxy(t *testing.T, backends []net.PacketConn, options ...Option) (*Proxy, net.PacketConn) {
+	lb, err := roundrobin.New(nil)
+	require.NoError(t, err)
+	for _, b := range backends {
+		require.NoError(t, lb.UpsertServer(&url.URL{Scheme: "udp", Host: b.LocalAddr().String()}))
+	}
+
+	p, err := New(lb, options...)
+	require.NoError(t, err)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.Serve(conn)
+	return p, conn
+}
+
+func dial(t *testing.T, proxy net.PacketConn) net.Conn {
+	conn, err := net.Dial("udp", proxy.LocalAddr().String())
+	require.NoError(t, err)
+	return conn
+}
+
+func exchange(t *testing.T, conn net.Conn, msg string) string {
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestProxy(t *testing.T) {
+	backend := newEchoServer(t, "a")
+	defer backend.Close()
+
+	p, l := newProxy(t, []net.PacketConn{backend})
+	defer l.Close()
+
+	conn := dial(t, l)
+	defer conn.Close()
+
+	assert.Equal(t, "a:hello", exchange(t, conn, "hello"))
+	assert.Equal(t, "a:world", exchange(t, conn, "world"))
+
+	stats := p.Stats()
+	assert.Equal(t, 1, stats.Sessions)
+	assert.EqualValues(t, 2, stats.DatagramsIn)
+	assert.EqualValues(t, 10, stats.BytesIn)
+	assert.EqualValues(t, 2, stats.DatagramsOut)
+	assert.EqualValues(t, 14, stats.BytesOut)
+}
+
+func TestRoundRobinSessions(t *testing.T) {
+	a := newEchoServer(t, "a")
+	defer a.Close()
+	b := newEchoServer(t, "b")
+	defer b.Close()
+
+	p, l := newProxy(t, []net.PacketConn{a, b})
+	defer l.Close()
+
+	c1 := dial(t, l)
+	defer c1.Close()
+	c2 := dial(t, l)
+	defer c2.Close()
+
+	assert.Equal(t, "a:1", exchange(t, c1, "1"))
+	assert.Equal(t, "b:1", exchange(t, c2, "1"))
+	// the sessions stick to their backend
+	assert.Equal(t, "a:2", exchange(t, c1, "2"))
+	assert.Equal(t, "b:2", exchange(t, c2, "2"))
+
+	assert.Equal(t, 2, p.Stats().Sessions)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	a := newEchoServer(t, "a")
+	defer a.Close()
+	b := newEchoServer(t, "b")
+	defer b.Close()
+
+	p, l := newProxy(t, []net.PacketConn{a, b}, IdleTimeout(50*time.Millisecond))
+	defer l.Close()
+
+	conn := dial(t, l)
+	defer conn.Close()
+
+	assert.Equal(t, "a:1", exchange(t, conn, "1"))
+
+	for i := 0; i < 100 && p.Stats().Sessions != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, p.Stats().Sessions)
+
+	// a new session is opened with the next backend
+	assert.Equal(t, "b:2", exchange(t, conn, "2"))
+}
+
+func TestSendAtIdleDeadline(t *testing.T) {
+	a := newEchoServer(t, "a")
+	defer a.Close()
+	b := newEchoServer(t, "b")
+	defer b.Close()
+
+	p, l := newProxy(t, []net.PacketConn{a, b}, IdleTimeout(time.Hour))
+	defer l.Close()
+
+	conn := dial(t, l)
+	defer conn.Close()
+	assert.Equal(t, "a:1", exchange(t, conn, "1"))
+
+	// the session reached its idle deadline: its backend is closed but Serve can still find it
+	p.mutex.Lock()
+	s := p.sessions[conn.LocalAddr().String()]
+	p.mutex.Unlock()
+	require.NotNil(t, s)
+	atomic.StoreInt32(&s.closed, 1)
+	s.backend.Close()
+
+	// the datagram is forwarded on a new session
+	assert.Equal(t, "b:2", exchange(t, conn, "2"))
+	stats := p.Stats()
+	assert.Equal(t, 1, stats.Sessions)
+	assert.EqualValues(t, 0, stats.Dropped)
+}
+
+func TestSendAroundIdleDeadline(t *testing.T) {
+	backend := newEchoServer(t, "a")
+	defer backend.Close()
+
+	idle := 20 * time.Millisecond
+	p, l := newProxy(t, []net.PacketConn{backend}, IdleTimeout(idle))
+	defer l.Close()
+
+	conn := dial(t, l)
+	defer conn.Close()
+
+	// the sessions expire right when the next datagram arrives, none is lost
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "a:x", exchange(t, conn, "x"))
+		time.Sleep(idle + time.Duration(i-5)*time.Millisecond)
+	}
+	assert.EqualValues(t, 0, p.Stats().Dropped)
+}
+
+func TestMaxSessions(t *testing.T) {
+	backend := newEchoServer(t, "a")
+	defer backend.Close()
+
+	p, l := newProxy(t, []net.PacketConn{backend}, MaxSessions(1))
+	defer l.Close()
+
+	c1 := dial(t, l)
+	defer c1.Close()
+	c2 := dial(t, l)
+	defer c2.Close()
+
+	assert.Equal(t, "a:1", exchange(t, c1, "1"))
+
+	_, err := c2.Write([]byte("1"))
+	require.NoError(t, err)
+	c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = c2.Read(make([]byte, 16))
+	assert.Error(t, err)
+
+	stats := p.Stats()
+	assert.Equal(t, 1, stats.Sessions)
+	assert.EqualValues(t, 1, stats.Dropped)
+}
+
+func TestServeClosesSessions(t *testing.T) {
+	backend := newEchoServer(t, "a")
+	defer backend.Close()
+
+	p, l := newProxy(t, []net.PacketConn{backend})
+
+	conn := dial(t, l)
+	defer conn.Close()
+	assert.Equal(t, "a:1", exchange(t, conn, "1"))
+
+	l.Close()
+	for i := 0; i < 100 && p.Stats().Sessions != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, p.Stats().Sessions)
+}
+
+func TestNewErrors(t *testing.T) {
+	_, err := New(nil)
+	assert.Error(t, err)
+
+	lb, err := roundrobin.New(nil)
+	require.NoError(t, err)
+	_, err = New(lb, IdleTimeout(0))
+	assert.Error(t, err)
+	_, err = New(lb, MaxSessions(-1))
+	assert.Error(t, err)
+}
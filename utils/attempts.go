@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+type serverAttemptsKey struct{}
+
+// ServerAttempts records the servers a request was sent to. The load balancers pick a server the request
+// was not sent to yet when the request carries it, so that a replayed request does not hit the same broken server.
+// The methods of a nil ServerAttempts do nothing.
+type ServerAttempts struct {
+	mtx  sync.Mutex
+	urls []*url.URL
+}
+
+// WithServerAttempts returns a shallow copy of the request carrying a new ServerAttempts
+func WithServerAttempts(req *http.Request) (*http.Request, *ServerAttempts) {
+	a := &ServerAttempts{}
+	return req.WithContext(context.WithValue(req.Context(), serverAttemptsKey{}, a)), a
+}
+
+// ServerAttemptsFromRequest returns the ServerAttempts carried by the request, nil if there is none
+func ServerAttemptsFromRequest(req *http.Request) *ServerAttempts {
+	a, _ := req.Context().Value(serverAttemptsKey{}).(*ServerAttempts)
+	return a
+}
+
+// Add records that the request was sent to the server
+func (a *ServerAttempts) Add(u *url.URL) {
+	if a == nil {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.urls = append(a.urls, CopyURL(u))
+}
+
+// Tried returns true if the request was sent to the server already
+func (a *ServerAttempts) Tried(u *url.URL) bool {
+	if a == nil {
+		return false
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for _, tried := range a.urls {
+		if tried.Scheme == u.Scheme && tried.Host == u.Host && tried.Path == u.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// Servers returns the servers the request was sent to, in order
+func (a *ServerAttempts) Servers() []*url.URL {
+	if a == nil {
+		return nil
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	urls := make([]*url.URL, len(a.urls))
+	for i, u := range a.urls {
+		urls[i] = CopyURL(u)
+	}
+	return urls
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerAttempts(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(t, ServerAttemptsFromRequest(req))
+
+	req, a := WithServerAttempts(req)
+	assert.Equal(t, a, ServerAttemptsFromRequest(req))
+
+	a.Add(&url.URL{Scheme: "http", Host: "localhost:5000"})
+	assert.True(t, a.Tried(&url.URL{Scheme: "http", Host: "localhost:5000"}))
+	assert.False(t, a.Tried(&url.URL{Scheme: "http", Host: "localhost:5001"}))
+	assert.Len(t, a.Servers(), 1)
+}
+
+func TestNilServerAttempts(t *testing.T) {
+	var a *ServerAttempts
+	a.Add(&url.URL{Scheme: "http", Host: "localhost:5000"})
+	assert.False(t, a.Tried(&url.URL{Scheme: "http", Host: "localhost:5000"}))
+	assert.Empty(t, a.Servers())
+}
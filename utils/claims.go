@@ -0,0 +1,22 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+)
+
+type claimsKey struct{}
+
+// WithClaims returns a shallow copy of the request carrying the verified claims of its token in its context
+func WithClaims(req *http.Request, claims map[string]interface{}) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), claimsKey{}, claims))
+}
+
+// ClaimsFromRequest returns the verified claims carried by the context of the request, nil if there are none
+func ClaimsFromRequest(req *http.Request) map[string]interface{} {
+	if req == nil {
+		return nil
+	}
+	claims, _ := req.Context().Value(claimsKey{}).(map[string]interface{})
+	return claims
+}
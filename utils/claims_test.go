@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaims(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Nil(t, ClaimsFromRequest(req))
+	assert.Nil(t, ClaimsFromRequest(nil))
+
+	claims := map[string]interface{}{"sub": "alice", "tenant": "acme"}
+	withClaims := WithClaims(req, claims)
+	assert.Equal(t, claims, ClaimsFromRequest(withClaims))
+	assert.Nil(t, ClaimsFromRequest(req))
+}
@@ -27,6 +27,7 @@ type SerializableHttpRequest struct {
 	RemoteAddr       string
 	RequestURI       string
 	TLS              *tls.ConnectionState
+	RequestID        string `json:",omitempty"`
 }
 
 // Clone clone a request
@@ -46,6 +47,7 @@ func Clone(r *http.Request) *SerializableHttpRequest {
 	rc.Host = r.Host
 	rc.RemoteAddr = r.RemoteAddr
 	rc.RequestURI = r.RequestURI
+	rc.RequestID = RequestIDFromRequest(r)
 	return rc
 }
 
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NewForwardedForExtractor returns an extractor keying the requests on the real IP of the client behind
+// the trusted proxies: the rightmost hop of the X-Forwarded-For header that is not trusted.
+// The header is ignored when the peer itself is not trusted, since the client may have forged it.
+func NewForwardedForExtractor(trusted IPRanges) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		var hops []string
+		for _, value := range req.Header["X-Forwarded-For"] {
+			for _, hop := range strings.Split(value, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		return realClient(req, hops, trusted)
+	})
+}
+
+// NewForwardedExtractor returns an extractor keying the requests on the real client behind the trusted proxies
+// according to the RFC 7239 Forwarded header: the for parameter of the rightmost element that is not trusted.
+// Obfuscated identifiers such as "_hidden" are returned as they are.
+func NewForwardedExtractor(trusted IPRanges) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		var hops []string
+		for _, value := range req.Header["Forwarded"] {
+			elements, err := ParseForwarded(value)
+			if err != nil {
+				return "", 0, err
+			}
+			for _, e := range elements {
+				if e.For != "" {
+					hops = append(hops, e.For)
+				}
+			}
+		}
+		return realClient(req, hops, trusted)
+	})
+}
+
+// realClient walks the hops from the peer towards the client, skipping the trusted proxies
+func realClient(req *http.Request, hops []string, trusted IPRanges) (string, int64, error) {
+	peer := ParseAddrIP(req.RemoteAddr)
+	if peer == nil {
+		return "", 0, fmt.Errorf("failed to parse client IP: %v", req.RemoteAddr)
+	}
+	if !trusted.Contains(peer) {
+		return peer.String(), 1, nil
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := ParseAddrIP(hops[i])
+		if ip == nil {
+			// obfuscated or unknown node, the hops before it can not be trusted
+			return hops[i], 1, nil
+		}
+		if !trusted.Contains(ip) || i == 0 {
+			return ip.String(), 1, nil
+		}
+	}
+	return peer.String(), 1, nil
+}
+
+// NewAPIKeyExtractor returns an extractor keying the requests on the API key sent in a header,
+// or in a query parameter when param is not empty. It fails when the request carries no key.
+func NewAPIKeyExtractor(header, param string) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		if key := req.Header.Get(header); key != "" {
+			return key, 1, nil
+		}
+		if param != "" {
+			if key := req.URL.Query().Get(param); key != "" {
+				return key, 1, nil
+			}
+		}
+		return "", 0, fmt.Errorf("no API key found in the request")
+	})
+}
+
+// NewJWTClaimExtractor returns an extractor keying the requests on a claim of the JSON Web Token sent in the
+// Authorization header as a bearer token, e.g. "sub". The claims verified by a middleware in front, see
+// ClaimsFromRequest, are used when present. Otherwise the token is decoded but not verified: put the extractor
+// behind a middleware verifying the tokens so that clients can not impersonate others.
+func NewJWTClaimExtractor(claim string) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		if claims := ClaimsFromRequest(req); claims != nil {
+			return claimValue(claims, claim)
+		}
+		auth := req.Header.Get("Authorization")
+		if len(auth) < len("bearer ") || !strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+			return "", 0, fmt.Errorf("no bearer token found in the request")
+		}
+		parts := strings.Split(strings.TrimSpace(auth[len("bearer "):]), ".")
+		if len(parts) != 3 {
+			return "", 0, fmt.Errorf("malformed JSON web token")
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return "", 0, fmt.Errorf("malformed JSON web token payload: %v", err)
+		}
+		claims := make(map[string]interface{})
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return "", 0, fmt.Errorf("malformed JSON web token claims: %v", err)
+		}
+		return claimValue(claims, claim)
+	})
+}
+
+func claimValue(claims map[string]interface{}, claim string) (string, int64, error) {
+	switch v := claims[claim].(type) {
+	case string:
+		if v != "" {
+			return v, 1, nil
+		}
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), 1, nil
+	}
+	return "", 0, fmt.Errorf("claim %v not found in the JSON web token", claim)
+}
+
+// NewExtractorChain returns an extractor trying the extractors in order, the first non-empty key wins,
+// e.g. the API key of the request or else the IP of the client
+func NewExtractorChain(extractors ...SourceExtractor) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		err := fmt.Errorf("no extractor")
+		for _, e := range extractors {
+			var key string
+			var amount int64
+			key, amount, err = e.Extract(req)
+			if err == nil && key != "" {
+				return key, amount, nil
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("no source found in the request")
+		}
+		return "", 0, err
+	})
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardedForExtractor(t *testing.T) {
+	trusted, err := ParseIPRanges("10.0.0.0/8")
+	require.NoError(t, err)
+	extractor := NewForwardedForExtractor(trusted)
+
+	tests := []struct {
+		desc       string
+		remoteAddr string
+		xff        []string
+		expected   string
+	}{
+		{desc: "untrusted peer", remoteAddr: "192.0.2.1:80", xff: []string{"198.51.100.1"}, expected: "192.0.2.1"},
+		{desc: "trusted peer without header", remoteAddr: "10.0.0.1:80", expected: "10.0.0.1"},
+		{desc: "rightmost untrusted hop", remoteAddr: "10.0.0.1:80", xff: []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, expected: "198.51.100.1"},
+		{desc: "several headers", remoteAddr: "10.0.0.1:80", xff: []string{"203.0.113.9", "198.51.100.1"}, expected: "198.51.100.1"},
+		{desc: "only trusted hops", remoteAddr: "10.0.0.1:80", xff: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{desc: "ipv6 hop", remoteAddr: "10.0.0.1:80", xff: []string{"2001:db8::1"}, expected: "2001:db8::1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header["X-Forwarded-For"] = test.xff
+		key, amount, err := extractor.Extract(req)
+		require.NoError(t, err, test.desc)
+		assert.Equal(t, test.expected, key, test.desc)
+		assert.EqualValues(t, 1, amount)
+	}
+}
+
+func TestForwardedExtractor(t *testing.T) {
+	trusted, err := ParseIPRanges("10.0.0.0/8")
+	require.NoError(t, err)
+	extractor := NewForwardedExtractor(trusted)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:80"
+	req.Header.Set("Forwarded", `for=203.0.113.9, for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`)
+	key, _, err := extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", key)
+
+	req.Header.Set("Forwarded", `for=203.0.113.9, for=_hidden, for=10.0.0.2`)
+	key, _, err = extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "_hidden", key)
+
+	req.Header.Set("Forwarded", `for`)
+	_, _, err = extractor.Extract(req)
+	assert.Error(t, err)
+}
+
+func TestAPIKeyExtractor(t *testing.T) {
+	extractor := NewAPIKeyExtractor("X-Api-Key", "api_key")
+
+	req := httptest.NewRequest(http.MethodGet, "/?api_key=from-query", nil)
+	key, _, err := extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "from-query", key)
+
+	req.Header.Set("X-Api-Key", "from-header")
+	key, _, err = extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "from-header", key)
+
+	_, _, err = NewAPIKeyExtractor("X-Api-Key", "").Extract(httptest.NewRequest(http.MethodGet, "/?api_key=a", nil))
+	assert.Error(t, err)
+}
+
+func jwt(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"HS256"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestJWTClaimExtractor(t *testing.T) {
+	tests := []struct {
+		auth     string
+		claim    string
+		expected string
+	}{
+		{auth: "Bearer " + jwt(`{"sub":"alice"}`), claim: "sub", expected: "alice"},
+		{auth: "bearer " + jwt(`{"org":42}`), claim: "org", expected: "42"},
+		{auth: "Bearer " + jwt(`{"sub":"alice"}`), claim: "org"},
+		{auth: "Basic YWxpY2U6c2VjcmV0", claim: "sub"},
+		{auth: "Bearer not.a.token", claim: "sub"},
+		{auth: "Bearer token", claim: "sub"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", test.auth)
+		key, _, err := NewJWTClaimExtractor(test.claim).Extract(req)
+		if test.expected == "" {
+			assert.Error(t, err, test.auth)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, key)
+	}
+}
+
+func TestJWTClaimExtractorVerifiedClaims(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+jwt(`{"sub":"forged"}`))
+	req = WithClaims(req, map[string]interface{}{"sub": "alice"})
+
+	key, _, err := NewJWTClaimExtractor("sub").Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "alice", key)
+}
+
+func TestExtractorChain(t *testing.T) {
+	clientIP, err := NewExtractor("client.ip")
+	require.NoError(t, err)
+	extractor := NewExtractorChain(NewAPIKeyExtractor("X-Api-Key", ""), clientIP)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:80"
+	key, _, err := extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", key)
+
+	req.Header.Set("X-Api-Key", "key")
+	key, _, err = extractor.Extract(req)
+	require.NoError(t, err)
+	assert.Equal(t, "key", key)
+
+	_, _, err = NewExtractorChain().Extract(req)
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ForwardedElement is a single proxy hop of the RFC 7239 Forwarded header
+type ForwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+	By    string
+}
+
+// String formats the element as a forwarded-element, quoting the values where required
+func (e ForwardedElement) String() string {
+	var pairs []string
+	if e.For != "" {
+		pairs = append(pairs, "for="+quoteForwardedValue(formatForwardedNode(e.For)))
+	}
+	if e.Proto != "" {
+		pairs = append(pairs, "proto="+quoteForwardedValue(e.Proto))
+	}
+	if e.Host != "" {
+		pairs = append(pairs, "host="+quoteForwardedValue(e.Host))
+	}
+	if e.By != "" {
+		pairs = append(pairs, "by="+quoteForwardedValue(formatForwardedNode(e.By)))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// FormatForwarded formats the elements as a Forwarded header value
+func FormatForwarded(elements []ForwardedElement) string {
+	out := make([]string, len(elements))
+	for i, e := range elements {
+		out[i] = e.String()
+	}
+	return strings.Join(out, ", ")
+}
+
+// ParseForwarded parses the value of a Forwarded header into its elements, the first element being
+// the one added by the proxy closest to the client. Unknown parameters are ignored.
+func ParseForwarded(header string) ([]ForwardedElement, error) {
+	var elements []ForwardedElement
+	for _, rawElement := range splitQuoted(header, ',') {
+		if strings.TrimSpace(rawElement) == "" {
+			continue
+		}
+		var e ForwardedElement
+		for _, pair := range splitQuoted(rawElement, ';') {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("malformed forwarded pair: %q", pair)
+			}
+			value, err := unquoteForwardedValue(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToLower(strings.TrimSpace(kv[0])) {
+			case "for":
+				e.For = value
+			case "proto":
+				e.Proto = value
+			case "host":
+				e.Host = value
+			case "by":
+				e.By = value
+			}
+		}
+		elements = append(elements, e)
+	}
+	return elements, nil
+}
+
+// ForwardedNodeIP returns the IP address of a for/by node such as `[2001:db8::1]:4711` or `192.0.2.1`,
+// obfuscated identifiers and "unknown" nodes yield nil
+func ForwardedNodeIP(node string) net.IP {
+	host := node
+	if h, _, err := net.SplitHostPort(node); err == nil {
+		host = h
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// formatForwardedNode encloses IPv6 addresses in square brackets as required by the node syntax
+func formatForwardedNode(node string) string {
+	if ip := net.ParseIP(node); ip != nil && ip.To4() == nil {
+		return "[" + node + "]"
+	}
+	return node
+}
+
+func quoteForwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+func unquoteForwardedValue(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+		return "", fmt.Errorf("unterminated quoted string: %s", value)
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range value[1 : len(value)-1] {
+		if !escaped && c == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String(), nil
+}
+
+// splitQuoted splits s around sep, ignoring separators inside of quoted strings
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	quoted, escaped := false, false
+	start := 0
+	for i, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// isTokenChar reports whether c may appear in an RFC 7230 token
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
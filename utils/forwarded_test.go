@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardedElementString(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		element  ForwardedElement
+		expected string
+	}{
+		{
+			desc:     "empty",
+			element:  ForwardedElement{},
+			expected: "",
+		},
+		{
+			desc:     "ipv4",
+			element:  ForwardedElement{For: "192.0.2.60", Proto: "http", By: "203.0.113.43"},
+			expected: "for=192.0.2.60;proto=http;by=203.0.113.43",
+		},
+		{
+			desc:     "ipv6 is bracketed and quoted",
+			element:  ForwardedElement{For: "2001:db8:cafe::17"},
+			expected: `for="[2001:db8:cafe::17]"`,
+		},
+		{
+			desc:     "host with port is quoted",
+			element:  ForwardedElement{Host: "example.com:8080", Proto: "https"},
+			expected: `proto=https;host="example.com:8080"`,
+		},
+		{
+			desc:     "quotes are escaped",
+			element:  ForwardedElement{By: `a "proxy"`},
+			expected: `by="a \"proxy\""`,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, test.element.String())
+		})
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	elements, err := ParseForwarded(`for=192.0.2.43, For="[2001:db8:cafe::17]:4711";proto=https;host="a,b;c", for=unknown`)
+	require.NoError(t, err)
+
+	assert.Equal(t, []ForwardedElement{
+		{For: "192.0.2.43"},
+		{For: "[2001:db8:cafe::17]:4711", Proto: "https", Host: "a,b;c"},
+		{For: "unknown"},
+	}, elements)
+}
+
+func TestParseForwardedRoundTrip(t *testing.T) {
+	in := []ForwardedElement{
+		{For: "2001:db8:cafe::17", Proto: "http", Host: "example.com:80", By: "proxy"},
+		{For: "10.0.0.1", Proto: "https"},
+	}
+
+	out, err := ParseForwarded(FormatForwarded(in))
+	require.NoError(t, err)
+
+	require.Len(t, out, 2)
+	assert.Equal(t, "[2001:db8:cafe::17]", out[0].For)
+	assert.Equal(t, "example.com:80", out[0].Host)
+	assert.Equal(t, in[1], out[1])
+}
+
+func TestParseForwardedErrors(t *testing.T) {
+	headers := []string{
+		"for",
+		`for="192.0.2.43`,
+	}
+	for _, h := range headers {
+		_, err := ParseForwarded(h)
+		require.Error(t, err, h)
+	}
+}
+
+func TestForwardedNodeIP(t *testing.T) {
+	assert.Equal(t, net.ParseIP("192.0.2.43"), ForwardedNodeIP("192.0.2.43"))
+	assert.Equal(t, net.ParseIP("192.0.2.43"), ForwardedNodeIP("192.0.2.43:80"))
+	assert.Equal(t, net.ParseIP("2001:db8:cafe::17"), ForwardedNodeIP("[2001:db8:cafe::17]:4711"))
+	assert.Equal(t, net.ParseIP("2001:db8:cafe::17"), ForwardedNodeIP("[2001:db8:cafe::17]"))
+	assert.Nil(t, ForwardedNodeIP("unknown"))
+	assert.Nil(t, ForwardedNodeIP("_hidden"))
+}
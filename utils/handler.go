@@ -39,11 +39,13 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err err
 		statusCode = http.StatusBadGateway
 	} else if err == context.Canceled {
 		statusCode = StatusClientClosedRequest
+	} else if err == ErrShuttingDown {
+		statusCode = http.StatusServiceUnavailable
 	}
 
 	w.WriteHeader(statusCode)
 	w.Write([]byte(statusText(statusCode)))
-	log.Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
+	RequestLogEntry(log.StandardLogger(), req).Debugf("'%d %s' caused by: %v", statusCode, statusText(statusCode), err)
 }
 
 func statusText(statusCode int) string {
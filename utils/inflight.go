@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrShuttingDown is the error of the requests arriving once a handler is shutting down,
+// the default error handler answers them with 503
+var ErrShuttingDown = errors.New("shutting down")
+
+// Inflight tracks the requests being served by a handler, so that it can stop accepting new ones
+// and wait for the others to complete when it shuts down. The zero value is ready to use.
+type Inflight struct {
+	mutex    sync.Mutex
+	count    int64
+	shutdown bool
+	// idle is closed once the handler is shutting down and serves no request anymore
+	idle chan struct{}
+}
+
+// Acquire accounts a new request, it returns false if the handler is shutting down
+// and the request should be rejected with ErrShuttingDown
+func (i *Inflight) Acquire() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.shutdown {
+		return false
+	}
+	i.count++
+	return true
+}
+
+// Release accounts the completion of a request acquired before
+func (i *Inflight) Release() {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.count--
+	if i.shutdown && i.count == 0 {
+		close(i.idle)
+	}
+}
+
+// Count returns the number of requests being served
+func (i *Inflight) Count() int64 {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.count
+}
+
+// ShuttingDown tells if Shutdown was called
+func (i *Inflight) ShuttingDown() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.shutdown
+}
+
+// Shutdown stops accepting new requests and waits for the ones being served to complete,
+// it returns the error of the context if it is done first
+func (i *Inflight) Shutdown(ctx context.Context) error {
+	i.mutex.Lock()
+	if !i.shutdown {
+		i.shutdown = true
+		i.idle = make(chan struct{})
+		if i.count == 0 {
+			close(i.idle)
+		}
+	}
+	idle := i.idle
+	i.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflight(t *testing.T) {
+	var i Inflight
+
+	assert.True(t, i.Acquire())
+	assert.True(t, i.Acquire())
+	assert.Equal(t, int64(2), i.Count())
+	assert.False(t, i.ShuttingDown())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, i.Shutdown(ctx))
+	assert.True(t, i.ShuttingDown())
+	assert.False(t, i.Acquire())
+
+	done := make(chan error)
+	go func() {
+		done <- i.Shutdown(context.Background())
+	}()
+
+	i.Release()
+	i.Release()
+	assert.NoError(t, <-done)
+	assert.Equal(t, int64(0), i.Count())
+
+	// shutting down again returns at once
+	assert.NoError(t, i.Shutdown(context.Background()))
+}
+
+func TestInflightShutdownIdle(t *testing.T) {
+	var i Inflight
+	assert.NoError(t, i.Shutdown(context.Background()))
+	assert.False(t, i.Acquire())
+}
+
+func TestStdHandlerShuttingDown(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	DefaultHandler.ServeHTTP(w, req, ErrShuttingDown)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPRanges is a list of IP networks, e.g. the addresses of the trusted proxies
+type IPRanges []*net.IPNet
+
+// ParseIPRanges parses a list of CIDRs such as 10.0.0.0/8 or fd00::/8, single IPs are accepted as well
+func ParseIPRanges(cidrs ...string) (IPRanges, error) {
+	ranges := make(IPRanges, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		ranges = append(ranges, network)
+	}
+	return ranges, nil
+}
+
+// Contains tells if the IP belongs to one of the networks
+func (r IPRanges) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range r {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAddr tells if the address, an IP with or without a port such as http.Request.RemoteAddr,
+// belongs to one of the networks
+func (r IPRanges) ContainsAddr(addr string) bool {
+	return r.Contains(ParseAddrIP(addr))
+}
+
+// ParseAddrIP returns the IP of an address with or without a port, nil if it is not an IP
+func ParseAddrIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	// drop the zone of IPv6 link-local addresses
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	return net.ParseIP(addr)
+}
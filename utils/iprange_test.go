@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPRanges(t *testing.T) {
+	ranges, err := ParseIPRanges("10.0.0.0/8", " 192.168.1.1 ", "fd00::/8", "::1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		addr     string
+		expected bool
+	}{
+		{addr: "10.1.2.3", expected: true},
+		{addr: "10.1.2.3:4242", expected: true},
+		{addr: "192.168.1.1:80", expected: true},
+		{addr: "192.168.1.2:80", expected: false},
+		{addr: "[fd00::1]:443", expected: true},
+		{addr: "[fe80::1%eth0]:443", expected: false},
+		{addr: "::1", expected: true},
+		{addr: "11.0.0.1", expected: false},
+		{addr: "not an ip", expected: false},
+		{addr: "", expected: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ranges.ContainsAddr(test.addr), test.addr)
+	}
+	assert.True(t, ranges.Contains(net.ParseIP("::ffff:10.0.0.1")))
+
+	_, err = ParseIPRanges("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseIPRanges("localhost")
+	assert.Error(t, err)
+}
+
+func TestParseAddrIP(t *testing.T) {
+	assert.Equal(t, "fe80::1", ParseAddrIP("[fe80::1%eth0]:80").String())
+	assert.Equal(t, "1.2.3.4", ParseAddrIP("1.2.3.4").String())
+	assert.Nil(t, ParseAddrIP("example.com:80"))
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields are the structured fields attached to the log lines
+type Fields map[string]interface{}
+
+// Logger is the structured logger the handlers log the requests with.
+// Adapters are provided for logrus, zap and log/slog.
+type Logger interface {
+	// WithFields returns a logger adding the fields to every line
+	WithFields(fields Fields) Logger
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	// DebugEnabled tells if the debug lines are logged, so that the costly ones can be skipped
+	DebugEnabled() bool
+}
+
+// The fields the request loggers set
+const (
+	LogFieldRequestID = "request_id"
+	LogFieldRoute     = "route"
+	LogFieldBackend   = "backend"
+)
+
+type loggerKey struct{}
+
+type routeKey struct{}
+
+// WithLogger returns a shallow copy of the request carrying the logger, the handlers serving the request
+// log with it instead of their own logger
+func WithLogger(req *http.Request, l Logger) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), loggerKey{}, l))
+}
+
+// WithRoute returns a shallow copy of the request carrying the name of the route it matched
+func WithRoute(req *http.Request, route string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeKey{}, route))
+}
+
+// RouteFromRequest returns the name of the route carried by the request, an empty string if there is none
+func RouteFromRequest(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	route, _ := req.Context().Value(routeKey{}).(string)
+	return route
+}
+
+// RequestLogger returns the logger carried by the request, or fallback if there is none, with the fields of the request:
+// its ID, the route it matched and the backend it is forwarded to once a load balancer picked it.
+// The fields are only attached once a line is logged, the requests logging nothing do not pay for them.
+// The standard logger of logrus is used if fallback is nil.
+func RequestLogger(req *http.Request, fallback Logger) Logger {
+	l, ok := req.Context().Value(loggerKey{}).(Logger)
+	if !ok {
+		l = fallback
+	}
+	if l == nil {
+		l = NewLogrusLogger(log.StandardLogger())
+	}
+
+	// the URL of the requests received by a server has no host, the load balancers set it to the backend
+	if RequestIDFromRequest(req) == "" && RouteFromRequest(req) == "" && (req.URL == nil || req.URL.Host == "") {
+		return l
+	}
+	return &requestLogger{Logger: l, req: req}
+}
+
+// requestLogger attaches the fields of the request to its logger on the first line logged
+type requestLogger struct {
+	Logger
+	req *http.Request
+
+	once       sync.Once
+	withFields Logger
+}
+
+func (r *requestLogger) fields() Logger {
+	r.once.Do(func() {
+		fields := Fields{}
+		if id := RequestIDFromRequest(r.req); id != "" {
+			fields[LogFieldRequestID] = id
+		}
+		if route := RouteFromRequest(r.req); route != "" {
+			fields[LogFieldRoute] = route
+		}
+		if r.req.URL != nil && r.req.URL.Host != "" {
+			fields[LogFieldBackend] = r.req.URL.Scheme + "://" + r.req.URL.Host
+		}
+		r.withFields = r.Logger.WithFields(fields)
+	})
+	return r.withFields
+}
+
+func (r *requestLogger) WithFields(fields Fields) Logger {
+	return r.fields().WithFields(fields)
+}
+
+func (r *requestLogger) Debugf(format string, args ...interface{}) {
+	if r.Logger.DebugEnabled() {
+		r.fields().Debugf(format, args...)
+	}
+}
+
+func (r *requestLogger) Infof(format string, args ...interface{}) {
+	r.fields().Infof(format, args...)
+}
+
+func (r *requestLogger) Warnf(format string, args ...interface{}) {
+	r.fields().Warnf(format, args...)
+}
+
+func (r *requestLogger) Errorf(format string, args ...interface{}) {
+	r.fields().Errorf(format, args...)
+}
+
+// logrusLogger adapts a logrus logger or entry
+type logrusLogger struct {
+	log.FieldLogger
+}
+
+// NewLogrusLogger adapts a logrus.Logger, a logrus.Entry or any logrus.FieldLogger
+func NewLogrusLogger(l log.FieldLogger) Logger {
+	return &logrusLogger{FieldLogger: l}
+}
+
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{FieldLogger: l.FieldLogger.WithFields(log.Fields(fields))}
+}
+
+func (l *logrusLogger) DebugEnabled() bool {
+	switch fl := l.FieldLogger.(type) {
+	case *log.Logger:
+		return fl.IsLevelEnabled(log.DebugLevel)
+	case *log.Entry:
+		return fl.Logger.IsLevelEnabled(log.DebugLevel)
+	case interface{ GetLevel() log.Level }:
+		return fl.GetLevel() >= log.DebugLevel
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+//go:build go1.21
+// +build go1.21
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// slogLogger adapts a log/slog logger
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger adapts a *slog.Logger, available with Go 1.21 and later
+func NewSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+func (s *slogLogger) WithFields(fields Fields) Logger {
+	args := make([]interface{}, 0, 2*len(fields))
+	for k, v := range fields {
+		args = append(args, k, v)
+	}
+	return &slogLogger{l: s.l.With(args...)}
+}
+
+func (s *slogLogger) Debugf(format string, args ...interface{}) {
+	s.l.Debug(fmt.Sprintf(format, args...))
+}
+
+func (s *slogLogger) Infof(format string, args ...interface{}) {
+	s.l.Info(fmt.Sprintf(format, args...))
+}
+
+func (s *slogLogger) Warnf(format string, args ...interface{}) {
+	s.l.Warn(fmt.Sprintf(format, args...))
+}
+
+func (s *slogLogger) Errorf(format string, args ...interface{}) {
+	s.l.Error(fmt.Sprintf(format, args...))
+}
+
+func (s *slogLogger) DebugEnabled() bool {
+	return s.l.Enabled(context.Background(), slog.LevelDebug)
+}
@@ -0,0 +1,27 @@
+//go:build go1.21
+// +build go1.21
+
+package utils
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	assert.False(t, l.DebugEnabled())
+
+	req := WithRequestID(httptest.NewRequest(http.MethodGet, "/", nil), "abc")
+	RequestLogger(req, l).Warnf("limited %d", 3)
+	l.Debugf("skipped")
+
+	assert.Contains(t, buf.String(), `level=WARN msg="limited 3" request_id=abc`)
+	assert.NotContains(t, buf.String(), "skipped")
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogger(t *testing.T) {
+	l, hook := test.NewNullLogger()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	RequestLogger(req, NewLogrusLogger(l)).Infof("hello %s", "world")
+	require.Len(t, hook.Entries, 1)
+	assert.Equal(t, "hello world", hook.LastEntry().Message)
+	assert.Empty(t, hook.LastEntry().Data)
+
+	req = WithRequestID(req, "abc")
+	req = WithRoute(req, "api")
+	req.URL.Scheme = "http"
+	req.URL.Host = "10.0.0.1:8080"
+	RequestLogger(req, NewLogrusLogger(l)).Warnf("forwarding")
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, logrus.Fields{
+		LogFieldRequestID: "abc",
+		LogFieldRoute:     "api",
+		LogFieldBackend:   "http://10.0.0.1:8080",
+	}, hook.LastEntry().Data)
+
+	// the logger carried by the request wins over the fallback
+	carried, carriedHook := test.NewNullLogger()
+	req = WithLogger(req, NewLogrusLogger(carried).WithFields(Fields{"tenant": "t1"}))
+	RequestLogger(req, NewLogrusLogger(l)).Errorf("failed")
+	assert.Len(t, hook.Entries, 2)
+	require.Len(t, carriedHook.Entries, 1)
+	assert.Equal(t, "t1", carriedHook.LastEntry().Data["tenant"])
+	assert.Equal(t, "abc", carriedHook.LastEntry().Data[LogFieldRequestID])
+}
+
+// countingLogger counts the calls to WithFields
+type countingLogger struct {
+	Logger
+	withFields int
+}
+
+func (c *countingLogger) WithFields(fields Fields) Logger {
+	c.withFields++
+	return c.Logger.WithFields(fields)
+}
+
+func TestRequestLoggerLazyFields(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	l.SetLevel(logrus.InfoLevel)
+	counting := &countingLogger{Logger: NewLogrusLogger(l)}
+
+	req := WithRequestID(httptest.NewRequest(http.MethodGet, "/", nil), "abc")
+	logger := RequestLogger(req, counting)
+	assert.False(t, logger.DebugEnabled())
+
+	// nothing logged, the fields are not built
+	logger.Debugf("skipped")
+	assert.Equal(t, 0, counting.withFields)
+	assert.Empty(t, hook.Entries)
+
+	logger.Infof("first")
+	logger.Warnf("second")
+	assert.Equal(t, 1, counting.withFields)
+	require.Len(t, hook.Entries, 2)
+	assert.Equal(t, "abc", hook.LastEntry().Data[LogFieldRequestID])
+}
+
+func TestLogrusLoggerDebugEnabled(t *testing.T) {
+	l, _ := test.NewNullLogger()
+	l.SetLevel(logrus.InfoLevel)
+	assert.False(t, NewLogrusLogger(l).DebugEnabled())
+	assert.False(t, NewLogrusLogger(l).WithFields(Fields{"a": 1}).DebugEnabled())
+
+	l.SetLevel(logrus.DebugLevel)
+	assert.True(t, NewLogrusLogger(l).DebugEnabled())
+}
+
+type fakeSugaredLogger struct {
+	lines []string
+}
+
+func (f *fakeSugaredLogger) log(level, msg string, kv []interface{}) {
+	f.lines = append(f.lines, fmt.Sprintf("%s %s %v", level, msg, kv))
+}
+
+func (f *fakeSugaredLogger) Debugw(msg string, kv ...interface{}) { f.log("debug", msg, kv) }
+func (f *fakeSugaredLogger) Infow(msg string, kv ...interface{})  { f.log("info", msg, kv) }
+func (f *fakeSugaredLogger) Warnw(msg string, kv ...interface{})  { f.log("warn", msg, kv) }
+func (f *fakeSugaredLogger) Errorw(msg string, kv ...interface{}) { f.log("error", msg, kv) }
+
+func TestZapLogger(t *testing.T) {
+	f := &fakeSugaredLogger{}
+	l := NewZapLogger(f)
+
+	l.Infof("hello %d", 1)
+	withID := l.WithFields(Fields{"request_id": "abc"})
+	withID.Errorf("failed")
+	l.Debugf("no fields")
+
+	assert.Equal(t, []string{
+		"info hello 1 []",
+		"error failed [request_id abc]",
+		"debug no fields []",
+	}, f.lines)
+}
+
+// fakeZapLevel, fakeZapLogger and fakeZapCore have the shape of zapcore.Level, zap.Logger and zapcore.Core
+type fakeZapLevel int8
+
+type fakeZapCore struct {
+	level fakeZapLevel
+}
+
+func (c *fakeZapCore) Enabled(l fakeZapLevel) bool { return l >= c.level }
+
+type fakeZapLogger struct {
+	core *fakeZapCore
+}
+
+func (l *fakeZapLogger) Core() *fakeZapCore { return l.core }
+
+type fakeZapSugaredLogger struct {
+	fakeSugaredLogger
+	logger *fakeZapLogger
+}
+
+func (f *fakeZapSugaredLogger) Desugar() *fakeZapLogger { return f.logger }
+
+func TestZapLoggerDebugEnabled(t *testing.T) {
+	core := &fakeZapCore{level: 0}
+	l := NewZapLogger(&fakeZapSugaredLogger{logger: &fakeZapLogger{core: core}})
+	assert.False(t, l.DebugEnabled())
+	assert.False(t, l.WithFields(Fields{"a": 1}).DebugEnabled())
+
+	// the level of zap can change at runtime
+	core.level = -1
+	assert.True(t, l.DebugEnabled())
+
+	// the level of a logger with no core can not be told, the costly debug lines are skipped
+	assert.False(t, NewZapLogger(&fakeSugaredLogger{}).DebugEnabled())
+}
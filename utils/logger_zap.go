@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ZapSugaredLogger is the subset of the methods of a *zap.SugaredLogger the zap adapter logs with
+type ZapSugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// zapLogger adapts a zap sugared logger, the fields are passed as key-value pairs on every line
+type zapLogger struct {
+	l             ZapSugaredLogger
+	keysAndValues []interface{}
+	// debugEnabled asks the core of the zap logger whether it logs the debug level
+	debugEnabled func() bool
+}
+
+// NewZapLogger adapts a *zap.SugaredLogger, e.g. NewZapLogger(zapLogger.Sugar()).
+// The level is read from the core of the zap logger, l.Desugar().Core(), so that the costly debug lines are
+// skipped when zap does not log them. They are always skipped for the loggers with no such core.
+func NewZapLogger(l ZapSugaredLogger) Logger {
+	return &zapLogger{l: l, debugEnabled: zapDebugEnabled(l)}
+}
+
+// zapDebugLevel is the value of zapcore.DebugLevel
+const zapDebugLevel = -1
+
+// zapDebugEnabled returns a function calling l.Desugar().Core().Enabled(zapcore.DebugLevel), found by reflection
+// so that oxy does not depend on zap
+func zapDebugEnabled(l ZapSugaredLogger) func() bool {
+	disabled := func() bool { return false }
+
+	desugar := reflect.ValueOf(l).MethodByName("Desugar")
+	if !desugar.IsValid() || desugar.Type().NumIn() != 0 || desugar.Type().NumOut() != 1 {
+		return disabled
+	}
+	logger := desugar.Call(nil)[0]
+	core := logger.MethodByName("Core")
+	if !core.IsValid() || core.Type().NumIn() != 0 || core.Type().NumOut() != 1 {
+		return disabled
+	}
+	enabled := core.Call(nil)[0].MethodByName("Enabled")
+	if !enabled.IsValid() {
+		return disabled
+	}
+	t := enabled.Type()
+	if t.NumIn() != 1 || t.NumOut() != 1 || t.Out(0).Kind() != reflect.Bool {
+		return disabled
+	}
+	switch t.In(0).Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+	default:
+		return disabled
+	}
+	level := reflect.New(t.In(0)).Elem()
+	level.SetInt(zapDebugLevel)
+	args := []reflect.Value{level}
+	return func() bool {
+		return enabled.Call(args)[0].Bool()
+	}
+}
+
+func (z *zapLogger) WithFields(fields Fields) Logger {
+	kv := make([]interface{}, len(z.keysAndValues), len(z.keysAndValues)+2*len(fields))
+	copy(kv, z.keysAndValues)
+	for k, v := range fields {
+		kv = append(kv, k, v)
+	}
+	return &zapLogger{l: z.l, keysAndValues: kv, debugEnabled: z.debugEnabled}
+}
+
+func (z *zapLogger) Debugf(format string, args ...interface{}) {
+	z.l.Debugw(fmt.Sprintf(format, args...), z.keysAndValues...)
+}
+
+func (z *zapLogger) Infof(format string, args ...interface{}) {
+	z.l.Infow(fmt.Sprintf(format, args...), z.keysAndValues...)
+}
+
+func (z *zapLogger) Warnf(format string, args ...interface{}) {
+	z.l.Warnw(fmt.Sprintf(format, args...), z.keysAndValues...)
+}
+
+func (z *zapLogger) Errorf(format string, args ...interface{}) {
+	z.l.Errorw(fmt.Sprintf(format, args...), z.keysAndValues...)
+}
+
+func (z *zapLogger) DebugEnabled() bool {
+	return z.debugEnabled()
+}
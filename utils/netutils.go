@@ -59,9 +59,12 @@ func (p *ProxyWriter) Write(buf []byte) (int, error) {
 	return p.w.Write(buf)
 }
 
-// WriteHeader writes status code
+// WriteHeader writes status code, the informational responses such as 103 Early Hints are passed through
+// without being recorded as the status code
 func (p *ProxyWriter) WriteHeader(code int) {
-	p.code = code
+	if code < 100 || code >= 200 || code == http.StatusSwitchingProtocols {
+		p.code = code
+	}
 	p.w.WriteHeader(code)
 }
 
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -92,3 +93,16 @@ func BenchmarkCopyHeaders(b *testing.B) {
 		CopyHeaders(dstHeaders[n], sourceHeaders[n])
 	}
 }
+
+func TestProxyWriterInterimResponses(t *testing.T) {
+	rw := httptest.NewRecorder()
+	pw := NewProxyWriter(rw)
+
+	pw.WriteHeader(http.StatusEarlyHints)
+	assert.Equal(t, http.StatusOK, pw.StatusCode())
+
+	pw.WriteHeader(http.StatusCreated)
+	pw.Write([]byte("hello"))
+	assert.Equal(t, http.StatusCreated, pw.StatusCode())
+	assert.EqualValues(t, 5, pw.GetLength())
+}
@@ -0,0 +1,261 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol version 2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// maximum length of a version 1 header, CRLF included
+	proxyProtocolV1MaxLength = 107
+	// DefaultProxyHeaderTimeout is how long a connection may take to send its PROXY header
+	DefaultProxyHeaderTimeout = 10 * time.Second
+)
+
+// WriteProxyHeader writes a PROXY protocol header of the given version (1 or 2) describing a
+// connection from src to dst. If any of the addresses is not a TCP address an UNKNOWN (v1) or
+// LOCAL (v2) header is written.
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	known := srcOk && dstOk && srcTCP != nil && dstTCP != nil
+
+	var header []byte
+	switch version {
+	case 1:
+		header = formatProxyHeaderV1(known, srcTCP, dstTCP)
+	case 2:
+		header = formatProxyHeaderV2(known, srcTCP, dstTCP)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version: %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+func formatProxyHeaderV1(known bool, src, dst *net.TCPAddr) []byte {
+	if !known {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func formatProxyHeaderV2(known bool, src, dst *net.TCPAddr) []byte {
+	buf := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+	if !known {
+		// LOCAL command, unspecified family, no addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	family := byte(0x11) // TCP over IPv4
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		family = 0x21 // TCP over IPv6
+	}
+	buf.Write([]byte{0x21, family})
+	binary.Write(buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
+
+// ReadProxyHeader reads a PROXY protocol header (version 1 or 2) from r and returns the source
+// and destination addresses it describes. Both addresses are nil for UNKNOWN and LOCAL headers.
+func ReadProxyHeader(r *bufio.Reader) (src net.Addr, dst net.Addr, err error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	prefix, errPeek := r.Peek(6)
+	if errPeek != nil {
+		return nil, nil, errPeek
+	}
+	if string(prefix) != "PROXY " {
+		return nil, nil, fmt.Errorf("missing PROXY protocol header")
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("PROXY protocol v1 header is too long or not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid PROXY protocol address: %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port: %q", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version: %d", verCmd>>4)
+	}
+	switch verCmd & 0x0F {
+	case 0x00:
+		// LOCAL: the connection was established by the proxy itself, e.g. for health checks
+		return nil, nil, nil
+	case 0x01:
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol command: %d", verCmd&0x0F)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// UNIX sockets and unspecified families carry no usable TCP address
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("PROXY protocol v2 address block is too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// ProxyProtocolListener wraps a listener whose connections start with a PROXY protocol header,
+// e.g. the ones coming from HAProxy or an AWS network load balancer. The accepted connections report
+// the original client address as their RemoteAddr, so it ends up in http.Request.RemoteAddr.
+type ProxyProtocolListener struct {
+	net.Listener
+	headerTimeout time.Duration
+}
+
+// NewProxyProtocolListener creates a new ProxyProtocolListener, headerTimeout limits the time a client
+// may take to send the header (DefaultProxyHeaderTimeout if 0).
+func NewProxyProtocolListener(l net.Listener, headerTimeout time.Duration) *ProxyProtocolListener {
+	if headerTimeout == 0 {
+		headerTimeout = DefaultProxyHeaderTimeout
+	}
+	return &ProxyProtocolListener{Listener: l, headerTimeout: headerTimeout}
+}
+
+// Accept waits for and returns the next connection. The header is parsed lazily on the first
+// Read, RemoteAddr or LocalAddr call so that a slow client can not block the accept loop.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), headerTimeout: l.headerTimeout}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+
+	once      sync.Once
+	headerErr error
+	src       net.Addr
+	dst       net.Addr
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		c.src, c.dst, c.headerErr = ReadProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		version int
+		src     net.Addr
+		dst     net.Addr
+	}{
+		{
+			desc:    "v1 ipv4",
+			version: 1,
+			src:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443},
+		},
+		{
+			desc:    "v1 ipv6",
+			version: 1,
+			src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			desc:    "v2 ipv4",
+			version: 2,
+			src:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443},
+		},
+		{
+			desc:    "v2 ipv6",
+			version: 2,
+			src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, WriteProxyHeader(buf, test.version, test.src, test.dst))
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			r := bufio.NewReader(buf)
+			src, dst, err := ReadProxyHeader(r)
+			require.NoError(t, err)
+			assert.Equal(t, test.src.String(), src.String())
+			assert.Equal(t, test.dst.String(), dst.String())
+
+			rest, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "GET / HTTP/1.1\r\n", string(rest))
+		})
+	}
+}
+
+func TestProxyHeaderUnknownAddresses(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		buf := &bytes.Buffer{}
+		require.NoError(t, WriteProxyHeader(buf, version, nil, nil))
+
+		src, dst, err := ReadProxyHeader(bufio.NewReader(buf))
+		require.NoError(t, err)
+		assert.Nil(t, src)
+		assert.Nil(t, dst)
+	}
+}
+
+func TestProxyHeaderV1Format(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WriteProxyHeader(buf, 1,
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443})
+	require.NoError(t, err)
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", buf.String())
+}
+
+func TestProxyHeaderInvalid(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		header string
+	}{
+		{desc: "no header", header: "GET / HTTP/1.1\r\n"},
+		{desc: "missing fields", header: "PROXY TCP4 192.0.2.1\r\n"},
+		{desc: "bad address", header: "PROXY TCP4 nope 198.51.100.2 56324 443\r\n"},
+		{desc: "bad port", header: "PROXY TCP4 192.0.2.1 198.51.100.2 99999 443\r\n"},
+		{desc: "not terminated", header: "PROXY TCP4 " + strings.Repeat("1", 200)},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			_, _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(test.header)))
+			assert.Error(t, err)
+		})
+	}
+
+	assert.Error(t, WriteProxyHeader(&bytes.Buffer{}, 3, nil, nil))
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	remoteAddr := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		remoteAddr <- req.RemoteAddr
+	})}
+	go srv.Serve(NewProxyProtocolListener(ln, time.Second))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = WriteProxyHeader(conn, 2,
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		ln.Addr())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "192.0.2.1:56324", <-remoteAddr)
+}
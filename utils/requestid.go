@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header carrying the ID of the requests
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a shallow copy of the request carrying the request ID in its context
+func WithRequestID(req *http.Request, id string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+}
+
+// RequestIDFromRequest returns the ID carried by the context of the request, an empty string if there is none
+func RequestIDFromRequest(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestLogEntry returns a log entry of the logger with the request_id field set to the ID of the request,
+// so that the messages logged while serving a request can be correlated
+func RequestLogEntry(l *log.Logger, req *http.Request) *log.Entry {
+	entry := log.NewEntry(l)
+	if id := RequestIDFromRequest(req); id != "" {
+		entry = entry.WithField("request_id", id)
+	}
+	return entry
+}
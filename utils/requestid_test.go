@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	assert.Equal(t, "", RequestIDFromRequest(req))
+
+	req = WithRequestID(req, "abc")
+	assert.Equal(t, "abc", RequestIDFromRequest(req))
+	assert.Contains(t, DumpHttpRequest(req), `"RequestID":"abc"`)
+}
+
+func TestRequestLogEntry(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := log.New()
+	l.Out = out
+
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	RequestLogEntry(l, req).Info("no id")
+	assert.NotContains(t, out.String(), "request_id")
+
+	RequestLogEntry(l, WithRequestID(req, "abc")).Info("with id")
+	assert.Contains(t, out.String(), "request_id=abc")
+}
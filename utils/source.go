@@ -39,6 +39,22 @@ func NewExtractor(variable string) (SourceExtractor, error) {
 		}
 		return makeHeaderExtractor(header), nil
 	}
+	if strings.HasPrefix(variable, "request.cookie.") {
+		cookie := strings.TrimPrefix(variable, "request.cookie.")
+		if len(cookie) == 0 {
+			return nil, fmt.Errorf("wrong cookie: %s", cookie)
+		}
+		return makeCookieExtractor(cookie), nil
+	}
+	if variable == "request.path" {
+		return ExtractorFunc(extractPath), nil
+	}
+	if variable == "request.route" {
+		return ExtractorFunc(extractRoute), nil
+	}
+	if variable == "request.backend" {
+		return ExtractorFunc(extractBackend), nil
+	}
 	return nil, fmt.Errorf("unsupported limiting variable: '%s'", variable)
 }
 
@@ -59,3 +75,27 @@ func makeHeaderExtractor(header string) SourceExtractor {
 		return req.Header.Get(header), 1, nil
 	})
 }
+
+func makeCookieExtractor(name string) SourceExtractor {
+	return ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return "", 1, nil
+		}
+		return cookie.Value, 1, nil
+	})
+}
+
+func extractPath(req *http.Request) (string, int64, error) {
+	return req.URL.Path, 1, nil
+}
+
+// extractRoute returns the name of the route the request matched, see WithRoute
+func extractRoute(req *http.Request) (string, int64, error) {
+	return RouteFromRequest(req), 1, nil
+}
+
+// extractBackend returns the host of the backend the request is forwarded to, once a load balancer picked it
+func extractBackend(req *http.Request) (string, int64, error) {
+	return req.URL.Host, 1, nil
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewExtractor(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/some/path?a=b", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-User", "bob")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s3cr3t"})
+	req = WithRoute(req, "api")
+
+	testCases := []struct {
+		variable string
+		expected string
+	}{
+		{variable: "client.ip", expected: "10.0.0.1"},
+		{variable: "request.host", expected: "example.com"},
+		{variable: "request.header.X-User", expected: "bob"},
+		{variable: "request.cookie.session", expected: "s3cr3t"},
+		{variable: "request.cookie.missing", expected: ""},
+		{variable: "request.path", expected: "/some/path"},
+		{variable: "request.route", expected: "api"},
+		{variable: "request.backend", expected: "example.com"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.variable, func(t *testing.T) {
+			t.Parallel()
+
+			extractor, err := NewExtractor(test.variable)
+			require.NoError(t, err)
+
+			token, amount, err := extractor.Extract(req)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, token)
+			assert.EqualValues(t, 1, amount)
+		})
+	}
+}
+
+func TestNewExtractorInvalid(t *testing.T) {
+	for _, variable := range []string{"request.header.", "request.cookie.", "request.unknown"} {
+		_, err := NewExtractor(variable)
+		assert.Error(t, err, variable)
+	}
+}
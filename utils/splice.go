@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"io"
+	"net"
+)
+
+// CloseWrite half-closes the connection so that the peer reads EOF, it is closed if it does not support it
+func CloseWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// Splice copies the bytes read from the client to the backend and the bytes of the backend to the client
+// until both directions are done. Each side is half-closed once the bytes for it are all copied.
+// The bytes of the client are read from r, e.g. a reader holding what was already buffered, or from client if r is nil.
+func Splice(client net.Conn, r io.Reader, backend net.Conn) {
+	if r == nil {
+		r = client
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(backend, r)
+		CloseWrite(backend)
+	}()
+	io.Copy(client, backend)
+	CloseWrite(client)
+	<-done
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPair returns both ends of a TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	peer := <-accepted
+	require.NotNil(t, peer)
+	return conn, peer
+}
+
+func TestSplice(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	defer client.Close()
+	proxyBackend, backend := tcpPair(t)
+	defer backend.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Splice(proxyClient, strings.NewReader("early "), proxyBackend)
+	}()
+
+	// the backend reads the buffered bytes, then EOF once the reader is done
+	data, err := ioutil.ReadAll(backend)
+	require.NoError(t, err)
+	assert.Equal(t, "early ", string(data))
+
+	_, err = backend.Write([]byte("reply"))
+	require.NoError(t, err)
+	CloseWrite(backend)
+
+	data, err = ioutil.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(data))
+	<-done
+}
+
+func TestCloseWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	// a pipe can not be half-closed, it is closed
+	CloseWrite(a)
+	_, err := a.Write([]byte("x"))
+	assert.Error(t, err)
+}
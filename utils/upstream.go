@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type upstreamKey struct{}
+
+// Upstream records the server a request was eventually forwarded to and how long the server took to answer,
+// so that a middleware in front of a load balancer can report them.
+// The methods of a nil Upstream do nothing.
+type Upstream struct {
+	mtx     sync.Mutex
+	url     *url.URL
+	latency time.Duration
+}
+
+// WithUpstream returns a shallow copy of the request carrying a new Upstream
+func WithUpstream(req *http.Request) (*http.Request, *Upstream) {
+	u := &Upstream{}
+	return req.WithContext(context.WithValue(req.Context(), upstreamKey{}, u)), u
+}
+
+// UpstreamFromRequest returns the Upstream carried by the request, nil if there is none
+func UpstreamFromRequest(req *http.Request) *Upstream {
+	u, _ := req.Context().Value(upstreamKey{}).(*Upstream)
+	return u
+}
+
+// Set records the server the request was forwarded to and the time it took to receive the response headers
+func (u *Upstream) Set(server *url.URL, latency time.Duration) {
+	if u == nil {
+		return
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.url = CopyURL(server)
+	u.latency = latency
+}
+
+// URL returns the server the request was forwarded to, nil if it was not forwarded
+func (u *Upstream) URL() *url.URL {
+	if u == nil {
+		return nil
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.url == nil {
+		return nil
+	}
+	return CopyURL(u.url)
+}
+
+// Latency returns the time the server took to send the response headers
+func (u *Upstream) Latency() time.Duration {
+	if u == nil {
+		return 0
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.latency
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstream(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost", nil)
+	assert.Nil(t, UpstreamFromRequest(req))
+
+	req, u := WithUpstream(req)
+	assert.Equal(t, u, UpstreamFromRequest(req))
+	assert.Nil(t, u.URL())
+
+	u.Set(&url.URL{Scheme: "http", Host: "localhost:5000"}, time.Second)
+	assert.Equal(t, "http://localhost:5000", u.URL().String())
+	assert.Equal(t, time.Second, u.Latency())
+}
+
+func TestNilUpstream(t *testing.T) {
+	var u *Upstream
+	u.Set(&url.URL{Scheme: "http", Host: "localhost:5000"}, time.Second)
+	assert.Nil(t, u.URL())
+	assert.Equal(t, time.Duration(0), u.Latency())
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+)
+
+type userKey struct{}
+
+// WithUser returns a shallow copy of the request carrying the name of the authenticated user in its context
+func WithUser(req *http.Request, user string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), userKey{}, user))
+}
+
+// UserFromRequest returns the name of the authenticated user carried by the context of the request,
+// an empty string if there is none
+func UserFromRequest(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	user, _ := req.Context().Value(userKey{}).(string)
+	return user
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUser(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Empty(t, UserFromRequest(req))
+	assert.Empty(t, UserFromRequest(nil))
+
+	withUser := WithUser(req, "alice")
+	assert.Equal(t, "alice", UserFromRequest(withUser))
+	assert.Empty(t, UserFromRequest(req))
+}